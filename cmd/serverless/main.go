@@ -7,6 +7,7 @@ import (
 	"syscall"
 
 	"github.com/akos011221/serverless/pkg/cli"
+	"github.com/akos011221/serverless/pkg/logging"
 	"github.com/akos011221/serverless/pkg/server"
 	"github.com/akos011221/serverless/pkg/storage"
 	"github.com/sirupsen/logrus"
@@ -22,12 +23,19 @@ var rootCmd = &cobra.Command{
 // config holds global CLI flags, so the platform is configurable without code change.
 var config struct {
 	configFile string
+	logLevel   string
+	ui         bool
 }
 
 // init configures CLI flags, binding them to the config struct.
 func init() {
 	rootCmd.PersistentFlags().StringVar(&config.configFile, "config", "config/config.yaml",
 		"Path to the YAML configuration file")
+	rootCmd.PersistentFlags().StringVar(&config.logLevel, "log-level", "",
+		"Log level (trace, debug, info, warn, error), overrides log_level of the configuration")
+
+	// Let commands add their own hooks without replacing the root's
+	cobra.EnableTraverseRunHooks = true
 }
 
 // runServer starts the server component of the platform.
@@ -39,14 +47,40 @@ func runServer(cmd *cobra.Command, args []string) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	cfg, err := server.LoadConfig(config.configFile, log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to load configuration")
+	}
+	if config.ui {
+		cfg.UI = true
+	}
+
+	// The level flag wins over the configured level
+	level := cfg.LogLevel
+	if config.logLevel != "" {
+		level = config.logLevel
+	}
+	if level != "" {
+		if err := logging.SetLevel(log, level); err != nil {
+			log.WithError(err).Fatal("Failed to configure logging")
+		}
+	}
+	if cfg.LogFile != "" {
+		file, err := logging.AddFile(log, cfg.LogFile)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to configure logging")
+		}
+		defer file.Close()
+	}
+
 	// SQLite storage for function metadata
-	store, err := storage.NewStore("serverless.db", log)
+	store, err := storage.NewStore(cfg.DBPath, log)
 	if err != nil {
 		log.WithError(err).Fatal("failed to initialize storage")
 	}
 
 	// Server that handles the function deployment and invocation
-	srv, err := server.NewServer(store, log)
+	srv, err := server.NewServer(cfg, store, log)
 	if err != nil {
 		log.WithError(err).Fatal("Failed to initialize server")
 	}
@@ -75,16 +109,28 @@ func runServer(cmd *cobra.Command, args []string) {
 }
 
 func main() {
-	rootCmd.AddCommand(&cobra.Command{
+	runCmd := &cobra.Command{
 		Use:   "run",
 		Short: "Start the serverless platform server",
 		Run:   runServer,
-	})
+	}
+	runCmd.Flags().BoolVar(&config.ui, "ui", false,
+		"Also serve the dashboard at /ui/, as ui of the configuration does")
+	rootCmd.AddCommand(runCmd)
 
 	log := logrus.New()
 	log.SetFormatter(&logrus.TextFormatter{ForceColors: true})
 	log.SetLevel(logrus.InfoLevel)
-	cli.RegisterCommands(rootCmd, config.configFile, log)
+
+	// Apply the level flag to the CLI logger before any command runs
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if config.logLevel == "" {
+			return nil
+		}
+		return logging.SetLevel(log, config.logLevel)
+	}
+
+	cli.RegisterCommands(rootCmd, &config.configFile, log)
 
 	if err := rootCmd.Execute(); err != nil {
 		log.WithError(err).Fatal("CLI execution failed")
@@ -16,12 +16,18 @@ type Response struct {
 	Result string `json:"result"`
 }
 
+// Exit codes tell the platform how the invocation went: 0 is a success (200),
+// 2 rejects the event (400, unless the function maps exit codes differently
+// with --exit-status), and any other code is an internal error (500). Output
+// written before exiting is returned for mapped codes.
+const exitInvalidEvent = 2
+
 func main() {
 	// Read event from stdin
 	var event Event
 	if err := json.NewDecoder(os.Stdin).Decode(&event); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		json.NewEncoder(os.Stdout).Encode(map[string]string{"error": fmt.Sprintf("invalid event: %v", err)})
+		os.Exit(exitInvalidEvent)
 	}
 
 	// Process event
@@ -5,15 +5,32 @@
 package cli
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/akos011221/serverless/pkg/envsubst"
+	"github.com/akos011221/serverless/pkg/logging"
+	"github.com/docker/go-units"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v2"
@@ -23,6 +40,124 @@ import (
 type Config struct {
 	ServerAddr string `yaml:"server_addr"` // HTTP server address
 	DBPath     string `yaml:"db_path"`     // SQLite database path
+	TLSCert    string `yaml:"tls_cert"`    // Certificate of the server, which is then reached over HTTPS
+	Insecure   bool   `yaml:"insecure"`    // Don't verify the certificate of the server, overridden by --insecure
+	GRPCAddr   string `yaml:"grpc_addr"`   // gRPC server address, used by invoke --grpc
+
+	// Command run against each built image before it's registered, with the
+	// image name appended as the last argument (e.g. ["trivy", "image", "--exit-code", "1"]).
+	// A nonzero exit fails the deploy.
+	ScanCommand []string `yaml:"scan_command"`
+
+	// Largest image a build may produce (e.g. 500MB), larger ones fail the
+	// deploy before registration. Empty for no limit, overridden by --max-image-size.
+	MaxImageSize string `yaml:"max_image_size"`
+
+	LogLevel string `yaml:"log_level"` // Level of the CLI logs, overridden by --log-level
+
+	// Go module settings of function builds, e.g. {"GOPRIVATE": "*.corp.example.com"},
+	// see goModuleVars for the ones forwarded. Unset ones come from the environment.
+	GoEnv map[string]string `yaml:"go_env"`
+
+	// netrc file with the credentials of private module hosts, given to builds
+	// as a secret so it's never stored in an image layer
+	Netrc string `yaml:"netrc"`
+
+	httpClient *http.Client // Client of the server's API, set once the configuration is loaded
+	tlsConfig  *tls.Config  // TLS configuration of connections to the server, nil without TLS
+}
+
+// goBuilderImage is the image functions are compiled in.
+const goBuilderImage = "golang:1.24"
+
+// defaultBaseImage is the image functions run on. The binary is static, so it
+// needs nothing beyond CA certificates and timezone data.
+const defaultBaseImage = "gcr.io/distroless/static-debian12"
+
+// dockerfileTemplate is the generated Dockerfile, parameterized with the
+// builder and base images. Functions without their own go.mod get one
+// generated, so they can be built outside of the repository's module. The Go
+// module settings are build arguments (see goModuleVars), and the netrc file
+// a secret mounted only while modules are downloaded.
+const dockerfileTemplate = `FROM %s AS build
+ARG GOPRIVATE
+ARG GONOPROXY
+ARG GONOSUMDB
+ARG GOPROXY
+ARG GOINSECURE
+WORKDIR /src
+COPY . .
+RUN --mount=type=secret,id=netrc,target=/root/.netrc \
+    if [ ! -f go.mod ]; then go mod init function && go mod tidy; fi && go mod download
+RUN CGO_ENABLED=0 GOOS=linux go build -trimpath -ldflags="-s -w" -o /out/function .
+
+FROM %s
+COPY --from=build /out/function /app/function
+ENTRYPOINT ["/app/function"]
+`
+
+// deployOptions holds the flags of the deploy command.
+type deployOptions struct {
+	skipScan       bool          // Skip the configured image scan
+	maxImageSize   string        // Largest image the build may produce, overriding the configured one
+	user           string        // User the function runs as inside the container
+	workingDir     string        // Working directory inside the container
+	stopSignal     string        // Signal the function is stopped with, e.g. SIGINT
+	entrypoint     []string      // Overrides the image entrypoint
+	args           []string      // Arguments passed to the entrypoint
+	eventSchema    string        // Path to the JSON Schema events must match
+	defaultEvent   string        // Path to the JSON object events are merged over
+	lockTimeout    time.Duration // How long to wait for a concurrent deploy of the function
+	baseImage      string        // Image the compiled function runs on
+	maxRetries     int           // Retries of failed async invocations
+	retryBackoff   time.Duration // Backoff before the first retry, doubled on each further one
+	dedupWindow    time.Duration // Window in which identical events are processed once
+	cacheTTL       time.Duration // How long results are reused for the same event
+	timeout        time.Duration // Execution timeout, 0 for the server's
+	readonly       bool          // Mount the root filesystem read-only
+	writableTmp    bool          // Mount a writable tmpfs at /tmp
+	runtime        string        // Language the function is written in
+	env            []string      // Environment variables as KEY=VALUE
+	labels         []string      // Labels as KEY=VALUE
+	dns            []string      // DNS servers of the function's containers
+	extraHosts     []string      // Extra /etc/hosts entries as host:ip
+	memory         string        // Memory limit, e.g. 128m
+	cpus           float64       // CPU limit in cores
+	maxOutput      string        // Cap on the output of an execution, e.g. 1m
+	contentType    string        // Media type of the function's output
+	eventFormat    string        // Format of the event on the function's stdin
+	responseFormat string        // Format of the function's output
+	logDestination string        // Where the function's stderr is forwarded
+	logPayloads    bool          // Have the server log the event and output of executions
+	redactPaths    []string      // JSON paths masked in the logged payloads
+	concurrency    int           // Executions the function may run at once, 0 for no limit
+	secrets        []string      // Secrets as NAME=VALUE, or NAME to read the value from the environment
+	exitStatuses   []string      // Exit code to HTTP status mappings as CODES=STATUS
+	image          string        // Prebuilt image to register instead of building the function
+	buildArgs      []string      // Docker build arguments as KEY=VALUE
+	platforms      []string      // Platforms to build the image for with buildx, e.g. linux/arm64
+	dockerfile     string        // Dockerfile to build the function with, instead of its own or the generated one
+	version        string        // Version of the function stamped on its image
+	verifyImage    bool          // Have the server check the prebuilt image exists before registering it
+	alwaysPull     optionalBool  // Pull the image before each run, unset for the server's default
+	snapshot       bool          // Restore the function from a checkpoint, if the server has snapshots enabled
+	runOnce        bool          // Refuse invocations once a run completed, unless forced
+	cleanupOnFail  bool          // Remove the built image when registering the function fails
+
+	flagChanged func(flag string) bool // Reports whether a flag was given, set by the command
+	progress    *progress              // Reports the phases of the deploy, set by the command
+}
+
+// invokeOptions holds the flags of the invoke command.
+type invokeOptions struct {
+	timeout time.Duration // Deadline of the request, 0 for none
+	async   bool          // Submit a job instead of waiting for the result
+	wait    bool          // Wait for a submitted job to finish
+	retries int           // Retries of transient failures, 0 for none
+	grpc    bool          // Invoke over the gRPC API instead of HTTP
+	digest  string        // Revision of the function to invoke, empty for the current one
+	force   bool          // Run a run_once function even when it completed
+	uploads []string      // Files uploaded as multipart/form-data, as FIELD=@PATH
 }
 
 // loadConfig reads and parses the YAML configuration file.
@@ -41,151 +176,2052 @@ func loadConfig(filePath string, log *logrus.Logger) (Config, error) {
 		return config, fmt.Errorf("failed to read config file: %v", err)
 	}
 
+	// Environment variable references in values are expanded before parsing
+	data, err = envsubst.ExpandYAML(data)
+	if err != nil {
+		return config, fmt.Errorf("failed to expand config file: %v", err)
+	}
+
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return config, fmt.Errorf("failed to parse config file: %v", err)
 	}
 
-	log.WithField("config", config).Info("Configuration loaded")
+	log.WithField("config", redactConfig(config)).Info("Configuration loaded")
 	return config, nil
 }
 
 // RegisterCommands adds CLI commands to the root command.
 // It provides modularity by decoupling the CLI logic from the main package.
-func RegisterCommands(rootCmd *cobra.Command, configFile string, log *logrus.Logger) {
-	config, err := loadConfig(configFile, log)
-	if err != nil {
-		log.WithError(err).Fatal("Failed to load configuration")
+// The configuration is loaded once the flags are parsed, right before a command runs.
+func RegisterCommands(rootCmd *cobra.Command, configFile *string, log *logrus.Logger) {
+	var config Config
+	var insecure bool
+	rootCmd.PersistentFlags().BoolVar(&insecure, "insecure", false,
+		"Don't verify the TLS certificate of the server, e.g. a self-signed one in development")
+	loadCLIConfig := func(cmd *cobra.Command, args []string) error {
+		var err error
+		if config, err = loadConfig(*configFile, log); err != nil {
+			return fmt.Errorf("failed to load configuration: %v", err)
+		}
+		// Flags win over the file
+		if cmd.Flags().Changed("insecure") {
+			config.Insecure = insecure
+		}
+		if config.tlsConfig, err = newTLSConfig(config, config.Insecure); err != nil {
+			return fmt.Errorf("failed to load configuration: %v", err)
+		}
+		config.httpClient = newHTTPClient(config.tlsConfig)
+		// The level flag is applied by the root command
+		if cmd.Flags().Changed("log-level") {
+			config.LogLevel, _ = cmd.Flags().GetString("log-level")
+			return nil
+		}
+		if config.LogLevel != "" {
+			return logging.SetLevel(log, config.LogLevel)
+		}
+		return nil
 	}
 
 	// Deploy command: `serverless deploy [function-name]`
-	// This compiles the function, builds a Docker image, and register it with the server
+	// This builds the function (see build), or takes a prebuilt image with --image, and registers it with the server
+	var deployOpts deployOptions
+	var watch, all bool
+	var deployOutput string
 	deployCmd := &cobra.Command{
 		Use:   "deploy [function-name]",
 		Short: "Deploy a function to the platform",
+		Long: "Deploy a function to the platform. With --all, every function in the functions directory is " +
+			"deployed, each after the functions listed in the depends_on of its manifest.",
+		Args: cobra.RangeArgs(0, 1),
+		Run: func(cmd *cobra.Command, args []string) {
+			deployOpts.flagChanged = cmd.Flags().Changed
+			progress, err := newProgress(deployOutput, log)
+			if err != nil {
+				log.WithError(err).Fatal("Deploy failed")
+			}
+			deployOpts.progress = progress
+			if all {
+				if len(args) > 0 || watch || deployOpts.image != "" {
+					log.Fatal("--all deploys every function, it can't be combined with a function name, --watch or --image")
+				}
+				if err := deployAll(deployOpts, config, log); err != nil {
+					log.WithError(err).Fatal("Deploy failed")
+				}
+				log.Info("All functions deployed successfully")
+				return
+			}
+			if len(args) == 0 {
+				log.Fatal("A function name is required, or --all to deploy every function")
+			}
+			functionName := args[0]
+			if !watch {
+				if err := deployFunction(functionName, deployOpts, config, log); err != nil {
+					log.WithError(err).WithField("function", functionName).Fatal("Deploy failed")
+				}
+				log.WithField("function", functionName).Info("Function deployed successfully")
+				return
+			}
+
+			// Watching redeploys on every change of the sources, until interrupted
+			if deployOpts.image != "" {
+				log.WithField("function", functionName).Fatal("--watch rebuilds the function from its sources, it can't be used with --image")
+			}
+			ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+			redeploy := func() {
+				if err := deployFunction(functionName, deployOpts, config, log); err != nil {
+					log.WithError(err).WithField("function", functionName).Error("Deploy failed, waiting for changes")
+					return
+				}
+				log.WithField("function", functionName).Info("Function deployed successfully")
+			}
+			redeploy()
+			log.WithField("function", functionName).Info("Watching for changes, press Ctrl+C to stop")
+			functionDir := filepath.Join("functions", functionName)
+			if err := watchFunction(ctx, functionDir, watchDebounce, redeploy, log); err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Watch failed")
+			}
+		},
+	}
+	addBuildFlags(deployCmd, &deployOpts)
+	deployCmd.Flags().BoolVar(&all, "all", false,
+		"Deploy every function in the functions directory, in the order of their depends_on")
+	deployCmd.Flags().BoolVar(&watch, "watch", false,
+		"Keep running and redeploy the function whenever its sources change")
+	deployCmd.Flags().StringVarP(&deployOutput, "output", "o", outputText,
+		"Format of the deploy progress: text, or json for one event per line on stdout")
+	deployCmd.Flags().StringVar(&deployOpts.image, "image", "",
+		"Register a prebuilt image (e.g. registry.example.com/hello:1.2) instead of building the function")
+	deployCmd.Flags().BoolVar(&deployOpts.cleanupOnFail, "cleanup-on-failure", false,
+		"Remove the built image when the server doesn't register the function, so a retry starts clean")
+	addFunctionFlags(deployCmd, &deployOpts)
+
+	// Register command: `serverless register [function-name] --image [image]`
+	// This registers a prebuilt image with the server, without the function's sources
+	var registerOpts deployOptions
+	var registerOutput string
+	registerCmd := &cobra.Command{
+		Use:   "register [function-name]",
+		Short: "Register a prebuilt image as a function",
+		Long: "Register an image that is already built, e.g. by a CI pipeline, as a function. Nothing is " +
+			"compiled or built; a manifest in the function's directory is still applied if there is one.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			functionName := args[0]
+			registerOpts.flagChanged = cmd.Flags().Changed
+			progress, err := newProgress(registerOutput, log)
+			if err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Register failed")
+			}
+			registerOpts.progress = progress
+			if err := deployFunction(functionName, registerOpts, config, log); err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Register failed")
+			}
+			log.WithField("function", functionName).Info("Function registered successfully")
+		},
+	}
+	registerCmd.Flags().StringVar(&registerOpts.image, "image", "",
+		"Image to register (e.g. registry.example.com/hello:1.2)")
+	registerCmd.MarkFlagRequired("image")
+	registerCmd.Flags().StringVar(&registerOpts.runtime, "runtime", "go",
+		"Language the function is written in")
+	registerCmd.Flags().BoolVar(&registerOpts.verifyImage, "verify", false,
+		"Have the server check that the image exists, pulling it if needed, and refuse to register it otherwise")
+	registerCmd.Flags().StringVarP(&registerOutput, "output", "o", outputText,
+		"Format of the progress: text, or json for one event per line on stdout")
+	addFunctionFlags(registerCmd, &registerOpts)
+
+	// Build command: `serverless build [function-name]`
+	// This compiles the function and builds its Docker image, without registering it
+	var buildOpts deployOptions
+	buildCmd := &cobra.Command{
+		Use:   "build [function-name]",
+		Short: "Build the image of a function without deploying it",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			functionName := args[0]
-			if err := deployFunction(functionName, config, log); err != nil {
-				log.WithError(err).WithField("function", functionName).Fatal("Deploy failed")
+			buildOpts.flagChanged = cmd.Flags().Changed
+			if _, err := applyManifest(functionName, filepath.Join("functions", functionName), &buildOpts, log); err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Build failed")
 			}
-			log.WithField("function", functionName).Info("Function deployed successfully")
+			build, err := buildFunction(functionName, buildOpts, config, log)
+			if err == nil {
+				err = promoteBuild(build)
+			}
+			if err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Build failed")
+			}
+			output, _ := json.MarshalIndent(build, "", "  ") // Safe to ignore error, as the result is controlled
+			fmt.Println(string(output))
 		},
 	}
+	addBuildFlags(buildCmd, &buildOpts)
 
 	// Invoke command: `serverless invoke [function-name] [event-json]`
 	// This sends an HTTP request to trigger function execution with the provided event
+	var invokeOpts invokeOptions
+	var eventFile string
 	invokeCmd := &cobra.Command{
-		Use:   "invoke [function-name] [event-json]",
+		Use:   "invoke [function-name] [event-json | -]",
 		Short: "Invoke a function with a JSON event",
-		Args:  cobra.ExactArgs(2),
+		Long: "Invoke a function with a JSON event. The event is given as an argument, " +
+			"read from stdin when the argument is -, or read from the file given with --event-file. " +
+			"With --upload, files are uploaded instead, and the function gets an event listing them.",
+		Args: cobra.RangeArgs(1, 2),
 		Run: func(cmd *cobra.Command, args []string) {
 			functionName := args[0]
-			eventJSON := args[1]
-			result, err := invokeFunction(functionName, eventJSON, config, log)
+			var eventJSON string
+			var err error
+			if len(invokeOpts.uploads) > 0 {
+				if len(args) > 1 || eventFile != "" || invokeOpts.async || invokeOpts.grpc {
+					log.WithField("function", functionName).Fatal("--upload can't be combined with an event, --async or --grpc")
+				}
+				_, err = parseUploads(invokeOpts.uploads)
+			} else {
+				eventJSON, err = readEvent(args[1:], eventFile, cmd.InOrStdin())
+			}
+			if err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Invoke failed")
+			}
+
+			// Abort the request on Ctrl+C, so the server cancels the execution too
+			ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+
+			if invokeOpts.wait && !invokeOpts.async {
+				log.WithField("function", functionName).Fatal("--wait requires --async")
+			}
+
+			invoke := invokeFunction
+			if invokeOpts.grpc {
+				if invokeOpts.async || invokeOpts.retries > 0 || invokeOpts.digest != "" || invokeOpts.force {
+					log.WithField("function", functionName).Fatal("--grpc doesn't support --async, --retries, --digest or --force")
+				}
+				invoke = invokeGRPC
+			}
+			result, err := invoke(ctx, functionName, eventJSON, invokeOpts, config, log)
 			if err != nil {
 				log.WithError(err).WithField("function", functionName).Fatal("Invoke failed")
 			}
 			fmt.Println(result)
 		},
 	}
+	invokeCmd.Flags().DurationVar(&invokeOpts.timeout, "timeout", 0,
+		"Maximum time to wait for the invocation (e.g. 30s), 0 waits indefinitely")
+	invokeCmd.Flags().BoolVar(&invokeOpts.async, "async", false,
+		"Run the function in the background and print the job, see `serverless job get`")
+	invokeCmd.Flags().BoolVar(&invokeOpts.wait, "wait", false,
+		"With --async, wait for the job to finish and print its result, bounded by --timeout")
+	invokeCmd.Flags().IntVar(&invokeOpts.retries, "retries", 0,
+		"Retry up to this many times when the server is unreachable or replies 502, 503 or 504")
+	invokeCmd.Flags().StringVar(&eventFile, "event-file", "",
+		"Path to a file containing the JSON event")
+	invokeCmd.Flags().BoolVar(&invokeOpts.grpc, "grpc", false,
+		"Invoke over the server's gRPC API, at grpc_addr of the configuration")
+	invokeCmd.Flags().StringVar(&invokeOpts.digest, "digest", "",
+		"Invoke the revision of the function deployed with this image digest (sha256:...)")
+	invokeCmd.Flags().BoolVar(&invokeOpts.force, "force", false,
+		"Run a run_once function even when it already completed")
+	invokeCmd.Flags().StringArrayVar(&invokeOpts.uploads, "upload", nil,
+		"Upload a file as FIELD=@PATH (e.g. image=@photo.jpg), repeat for each file; the function reads "+
+			"the files under /run/uploads, listed in its event")
 
-	rootCmd.AddCommand(deployCmd, invokeCmd)
-}
+	// Invoke-all command: `serverless invoke-all --label key=value [event-json]`
+	// This invokes every function with the given labels, e.g. for a cache flush
+	var selector []string
+	var allEventFile string
+	invokeAllCmd := &cobra.Command{
+		Use:   "invoke-all --label key=value [event-json | -]",
+		Short: "Invoke every function matching labels with the same event",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(selector) == 0 {
+				log.Fatal("At least one --label is required")
+			}
+			eventJSON, err := readEvent(args, allEventFile, cmd.InOrStdin())
+			if err != nil {
+				log.WithError(err).Fatal("Invoke failed")
+			}
 
-// deployFunction handles the deployment of a user function.
-// It compiles the function, builds the Docker image, and registers it with the server.
-func deployFunction(name string, config Config, log *logrus.Logger) error {
-	// Validate that the function directory exists
-	functionDir := filepath.Join("functions", name)
-	if _, err := os.Stat(functionDir); os.IsNotExist(err) {
-		return fmt.Errorf("function directory %s does not exist", functionDir)
+			results, failed, err := invokeAll(cmd.Context(), selector, eventJSON, config)
+			if err != nil {
+				log.WithError(err).Fatal("Invoke failed")
+			}
+			fmt.Println(results)
+			if failed > 0 {
+				log.WithField("failed", failed).Fatal("Some invocations failed")
+			}
+		},
 	}
+	invokeAllCmd.Flags().StringArrayVar(&selector, "label", nil,
+		"Label functions must have as key=value, repeat to require several")
+	invokeAllCmd.Flags().StringVar(&allEventFile, "event-file", "",
+		"Path to a file containing the JSON event")
 
-	// Compile the function into a binary
-	cmd := exec.Command("go", "build", "-o", "function", ".")
-	cmd.Env = append(os.Environ(),
-		"CGO_ENABLED=0",
-		"GOOS=linux",
-		"GOARCH=amd64",
-	)
-	cmd.Dir = functionDir
-	cmd.Stderr = os.Stderr // Forward compilation errors to user
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to compile function: %v", err)
+	// Describe command: `serverless describe [function-name]`
+	// This shows the full metadata of a deployed function
+	describeCmd := &cobra.Command{
+		Use:   "describe [function-name]",
+		Short: "Show the full metadata of a function",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			functionName := args[0]
+			details, err := describeFunction(functionName, config)
+			if err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Describe failed")
+			}
+			fmt.Println(details)
+		},
 	}
-	log.WithField("function", name).Info("Function compiled")
 
-	// Create a minimal Dockerfile
-	dockerfile := `
-FROM golang:1.24
-COPY function /app/function
-ENTRYPOINT ["/app/function"]
-`
-	dockerfilePath := filepath.Join(functionDir, "Dockerfile")
-	if err := os.WriteFile(dockerfilePath, []byte(dockerfile), 0644); err != nil {
-		return fmt.Errorf("failed to create Dockerfile: %v", err)
+	// List command: `serverless list`
+	// This shows the metadata of all deployed functions
+	var includeDeleted bool
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the deployed functions",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			functions, err := listFunctions(includeDeleted, config)
+			if err != nil {
+				log.WithError(err).Fatal("List failed")
+			}
+			fmt.Println(functions)
+		},
 	}
-	log.WithField("function", name).Info("Dockerfile created")
+	listCmd.Flags().BoolVar(&includeDeleted, "include-deleted", false,
+		"Include deleted functions, which can be brought back with `serverless restore`")
 
-	// Build the Docker image
-	imageName := fmt.Sprintf("serverless-%s:latest", name)
-	cmd = exec.Command("docker", "build", "-t", imageName, ".")
-	cmd.Dir = functionDir
-	cmd.Stderr = os.Stderr // Show Docker errors to the user
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to build Docker image: %v", err)
+	// Export command: `serverless export [--output file]`
+	// This dumps the metadata of all functions, to be imported on another server
+	var exportFile string
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export the metadata of all functions",
+		Long: "Export the metadata of all functions as JSON, to recreate them with `serverless import`, " +
+			"e.g. on another server. Images are referenced by tag, and secret values aren't exported.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			out := cmd.OutOrStdout()
+			if exportFile != "" {
+				file, err := os.Create(exportFile)
+				if err != nil {
+					log.WithError(err).Fatal("Export failed")
+				}
+				defer file.Close()
+				out = file
+			}
+			if err := exportFunctions(out, config); err != nil {
+				log.WithError(err).Fatal("Export failed")
+			}
+		},
 	}
-	log.WithField("function", name).Info("Docker image built")
+	exportCmd.Flags().StringVarP(&exportFile, "output", "o", "",
+		"File to write the export to, instead of stdout")
 
-	// Register the function with the server via HTTP POST
-	metadata := map[string]string{
-		"name":    name,
-		"image":   imageName,
-		"runtime": "go",
+	// Import command: `serverless import [file]`
+	// This deploys the functions of an export, running their exported images
+	var overwrite bool
+	importCmd := &cobra.Command{
+		Use:   "import [file]",
+		Short: "Deploy the functions of an export",
+		Long: "Deploy the functions of a file written by `serverless export`, without building them: " +
+			"they run the exported images, which must be available to the server and are pinned to what their tags " +
+			"refer to there. Replaced functions keep their secrets.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := importFunctions(args[0], overwrite, config, log); err != nil {
+				log.WithError(err).Fatal("Import failed")
+			}
+		},
 	}
-	body, _ := json.Marshal(metadata) // Safe to ignore error, as metadata is controlled
-	resp, err := http.Post(fmt.Sprintf("http://%s/functions", config.ServerAddr), "application/json", bytes.NewReader(body))
-	if err != nil {
-		return fmt.Errorf("failed to register function with server: %v", err)
+	importCmd.Flags().BoolVar(&overwrite, "overwrite", false,
+		"Replace functions that already exist, instead of skipping them")
+
+	// Delete command: `serverless delete [function-name]`
+	// This removes a function, which can be restored until it's redeployed
+	deleteCmd := &cobra.Command{
+		Use:   "delete [function-name]",
+		Short: "Delete a function",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			functionName := args[0]
+			if _, err := serverRequest(http.MethodDelete, "/functions/"+functionName, config); err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Delete failed")
+			}
+			log.WithField("function", functionName).Info("Function deleted, undo with `serverless restore`")
+		},
 	}
-	defer resp.Body.Close()
 
-	// Check server response
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
+	// Restore command: `serverless restore [function-name]`
+	// This brings back a deleted function
+	restoreCmd := &cobra.Command{
+		Use:   "restore [function-name]",
+		Short: "Restore a deleted function",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			functionName := args[0]
+			details, err := restoreFunction(functionName, config)
+			if err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Restore failed")
+			}
+			fmt.Println(details)
+		},
+	}
+
+	// PS command: `serverless ps`
+	// This shows the containers currently running functions
+	psCmd := &cobra.Command{
+		Use:   "ps",
+		Short: "List the containers of functions",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := listContainers(os.Stdout, config); err != nil {
+				log.WithError(err).Fatal("Failed to list containers")
+			}
+		},
+	}
+
+	// GC command: `serverless gc`
+	// This removes images of functions that are no longer deployed
+	gcCmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove unused function images",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			report, err := collectGarbage(config)
+			if err != nil {
+				log.WithError(err).Fatal("Garbage collection failed")
+			}
+			fmt.Println(report)
+		},
+	}
+
+	// Prune command: `serverless prune`
+	// This removes the stopped containers of functions, e.g. left behind by a crash
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove stopped function containers",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			report, err := pruneContainers(config)
+			if err != nil {
+				log.WithError(err).Fatal("Failed to prune containers")
+			}
+			fmt.Println(report)
+		},
+	}
+
+	// Warm command: `serverless warm [function-name]`
+	// This prepares a function before a traffic spike, pulling its image if it's missing
+	warmCmd := &cobra.Command{
+		Use:   "warm [function-name]",
+		Short: "Prepare a function for invocations",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			functionName := args[0]
+			report, err := warmFunction(functionName, config)
+			if err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Warm failed")
+			}
+			fmt.Println(report)
+		},
+	}
+
+	// Job command: `serverless job get [job-id]`, `serverless job cancel [job-id]`
+	// This shows the state of an async invocation, or cancels it
+	jobCmd := &cobra.Command{
+		Use:   "job",
+		Short: "Manage async invocations",
+	}
+	jobCmd.AddCommand(&cobra.Command{
+		Use:   "get [job-id]",
+		Short: "Show the state and result of a job",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			jobID := args[0]
+			job, err := getJob(jobID, config)
+			if err != nil {
+				log.WithError(err).WithField("job", jobID).Fatal("Failed to get job")
+			}
+			fmt.Println(job)
+		},
+	})
+	jobCmd.AddCommand(&cobra.Command{
+		Use:   "cancel [job-id]",
+		Short: "Cancel a pending or running job",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			jobID := args[0]
+			job, err := cancelJob(jobID, config)
+			if err != nil {
+				log.WithError(err).WithField("job", jobID).Fatal("Failed to cancel job")
+			}
+			fmt.Println(job)
+		},
+	})
+
+	// Alias command: `serverless alias set [alias] [function=digest]... --weight N...`
+	// This routes invocations of the alias to revisions of a function by weight, e.g. for canary deploys
+	aliasCmd := &cobra.Command{
+		Use:   "alias",
+		Short: "Manage aliases routing traffic between function revisions",
+	}
+	var weights []int
+	setAliasCmd := &cobra.Command{
+		Use:   "set [alias] [function=digest]...",
+		Short: "Point an alias at function revisions with traffic weights",
+		Long: "Point an alias at one or more revisions of a function, given by the image digest they were " +
+			"deployed with. Invoking the alias runs one of them, picked at random in proportion to its weight, " +
+			"e.g. `serverless alias set prod hello=sha256:aaa... hello=sha256:bbb... --weight 90 --weight 10`.",
+		Args: cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			aliasName := args[0]
+			alias, err := setAlias(aliasName, args[1:], weights, config)
+			if err != nil {
+				log.WithError(err).WithField("alias", aliasName).Fatal("Failed to set alias")
+			}
+			fmt.Println(alias)
+		},
+	}
+	setAliasCmd.Flags().IntSliceVar(&weights, "weight", nil, "Traffic weight of each revision, in order (default 1 each)")
+	aliasCmd.AddCommand(setAliasCmd)
+	aliasCmd.AddCommand(&cobra.Command{
+		Use:   "get [alias]",
+		Short: "Show the revisions an alias routes to",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			aliasName := args[0]
+			body, err := serverRequest(http.MethodGet, "/aliases/"+aliasName, config)
+			if err != nil {
+				log.WithError(err).WithField("alias", aliasName).Fatal("Failed to get alias")
+			}
+			alias, err := indentJSON(body)
+			if err != nil {
+				log.WithError(err).WithField("alias", aliasName).Fatal("Failed to get alias")
+			}
+			fmt.Println(alias)
+		},
+	})
+
+	// Config command: `serverless config set [function-name] [field=value]...`
+	// This changes some fields of a deployed function without redeploying it
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Manage the configuration of deployed functions, and view the CLI's",
+	}
+	configCmd.AddCommand(&cobra.Command{
+		Use:   "set [function-name] [field=value]...",
+		Short: "Change fields of a function, leaving the others intact",
+		Long: "Change fields of a deployed function, named as in `serverless describe`. Values are " +
+			"parsed as JSON when they're valid JSON and taken as strings otherwise, " +
+			"e.g. `serverless config set hello memory_bytes=268435456 user=app 'env={\"DEBUG\":\"1\"}'`.",
+		Args: cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			functionName := args[0]
+			details, err := setFunctionConfig(functionName, args[1:], config)
+			if err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Failed to update function")
+			}
+			fmt.Println(details)
+		},
+	})
+
+	// Config view command: `serverless config view [-o json]`
+	// This prints the configuration the CLI runs with, once every source is applied
+	var viewOutput string
+	configViewCmd := &cobra.Command{
+		Use:   "view",
+		Short: "Print the effective configuration",
+		Long: "Print the configuration the CLI runs with: the defaults, overridden by the configuration file " +
+			"with its ${VAR} references expanded from the environment, overridden by --log-level and --insecure. " +
+			"Go module settings missing from go_env are shown as builds get them from the environment. " +
+			"Passwords in URLs are redacted, here and in the logs.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := viewConfig(cmd.OutOrStdout(), config, viewOutput); err != nil {
+				log.WithError(err).Fatal("Failed to print configuration")
+			}
+		},
+	}
+	configViewCmd.Flags().StringVarP(&viewOutput, "output", "o", outputYAML,
+		"Format of the configuration: yaml or json")
+	configCmd.AddCommand(configViewCmd)
+
+	// Logs command: `serverless logs --follow [function-name]`
+	// This streams the output of the function's running invocation
+	var follow bool
+	logsCmd := &cobra.Command{
+		Use:   "logs [function-name]",
+		Short: "Stream the output of a running invocation",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			functionName := args[0]
+			if !follow {
+				// Containers are removed after their invocation, so only
+				// running invocations have logs
+				log.Fatal("Only live logs are available, use --follow")
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+
+			if err := followLogs(ctx, functionName, config, os.Stdout, os.Stderr); err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Failed to stream logs")
+			}
+		},
+	}
+	logsCmd.Flags().BoolVarP(&follow, "follow", "f", false,
+		"Follow the output of the function's running invocation")
+
+	// Audit command: `serverless audit [--function name]`
+	// This shows who deployed, updated or deleted functions, and when
+	var auditFunction string
+	var auditLimit int
+	auditCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Show the recent changes to functions",
+		Long: "Show the recent deploys, updates, deletions and restorations of functions, newest first, " +
+			"with who made them: $SERVERLESS_ACTOR, or else the user running the CLI.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := listAuditEvents(os.Stdout, auditFunction, auditLimit, config); err != nil {
+				log.WithError(err).Fatal("Failed to list audit events")
+			}
+		},
+	}
+	auditCmd.Flags().StringVar(&auditFunction, "function", "",
+		"Only show the changes to this function")
+	auditCmd.Flags().IntVar(&auditLimit, "limit", 50,
+		"Number of changes to show")
+
+	// Run-local command: `serverless run-local [function-name] [event-json]`
+	// This runs a function's binary directly with the event, without Docker or the server
+	var localOpts deployOptions
+	var localEventFile string
+	runLocalCmd := &cobra.Command{
+		Use:   "run-local [function-name] [event-json | -]",
+		Short: "Run a function locally with a JSON event, without Docker or the server",
+		Long: "Compile a function to a native binary and run it with the event on stdin, printing its output, " +
+			"as the platform would but without a container. Only Go functions are supported. The event is " +
+			"given like for invoke.",
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			functionName := args[0]
+			localOpts.flagChanged = cmd.Flags().Changed
+			eventJSON, err := readEvent(args[1:], localEventFile, cmd.InOrStdin())
+			if err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Run failed")
+			}
+			ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+			if err := runLocal(ctx, functionName, eventJSON, localOpts, config, os.Stdout, os.Stderr, log); err != nil {
+				log.WithError(err).WithField("function", functionName).Fatal("Run failed")
+			}
+		},
+	}
+	runLocalCmd.Flags().StringVar(&localOpts.runtime, "runtime", "go",
+		"Language the function is written in")
+	runLocalCmd.Flags().StringArrayVar(&localOpts.env, "env", nil,
+		"Environment variable of the function as KEY=VALUE, repeat for each variable")
+	runLocalCmd.Flags().StringArrayVar(&localOpts.args, "arg", nil,
+		"Argument passed to the function, repeat for each argument")
+	runLocalCmd.Flags().DurationVar(&localOpts.timeout, "timeout", 30*time.Second,
+		"How long the function may run before it's killed, passed to it as $SERVERLESS_TIMEOUT_MS")
+	runLocalCmd.Flags().StringVar(&localEventFile, "event-file", "",
+		"Path to a file containing the JSON event")
+
+	commands := []*cobra.Command{deployCmd, registerCmd, buildCmd, runLocalCmd, invokeCmd, invokeAllCmd, describeCmd, listCmd, exportCmd, importCmd, deleteCmd, restoreCmd, psCmd, pruneCmd, gcCmd, warmCmd, jobCmd, aliasCmd, configCmd, logsCmd, auditCmd}
+	for _, cmd := range commands {
+		cmd.PersistentPreRunE = loadCLIConfig
+	}
+	rootCmd.AddCommand(commands...)
+}
+
+// buildResult describes the image built for a function.
+type buildResult struct {
+	Image     string   `json:"image"`
+	Digest    string   `json:"digest"`
+	Platforms []string `json:"platforms,omitempty"`
+	tag       string   // Temporary tag of a fresh build, moved to Image by promoteBuild
+}
+
+// addBuildFlags adds the flags that control building a function's image,
+// shared by the build and deploy commands.
+func addBuildFlags(cmd *cobra.Command, opts *deployOptions) {
+	cmd.Flags().BoolVar(&opts.skipScan, "skip-scan", false,
+		"Skip the image scan configured with scan_command")
+	cmd.Flags().StringVar(&opts.maxImageSize, "max-image-size", "",
+		"Largest image the build may produce (e.g. 500MB), 0 for no limit; overrides max_image_size of the configuration")
+	cmd.Flags().StringVar(&opts.baseImage, "base-image", defaultBaseImage,
+		"Image the compiled function runs on (e.g. alpine:3.20)")
+	cmd.Flags().DurationVar(&opts.lockTimeout, "lock-timeout", 5*time.Minute,
+		"How long to wait for a concurrent build of the same function to finish")
+	cmd.Flags().StringVar(&opts.runtime, "runtime", "go",
+		"Language the function is written in")
+	cmd.Flags().StringVar(&opts.dockerfile, "dockerfile", "",
+		"Dockerfile to build the function with, the function's directory being the build context "+
+			"(defaults to the Dockerfile in that directory, or a generated one for Go functions)")
+	cmd.Flags().StringArrayVar(&opts.buildArgs, "build-arg", nil,
+		"Build argument passed to docker build as KEY=VALUE, repeat for each argument")
+	cmd.Flags().StringSliceVar(&opts.platforms, "platform", nil,
+		"Platforms to build a multi-architecture image for with docker buildx (e.g. linux/amd64,linux/arm64), "+
+			"the server runs the one matching its host; defaults to the platform of the Docker host. "+
+			"Several platforms need the containerd image store of Docker")
+	cmd.Flags().StringVar(&opts.version, "version", "",
+		"Version of the function, stamped on its image (defaults to git describe of the sources)")
+}
+
+// addFunctionFlags adds the flags that configure a function, shared by the
+// deploy and register commands.
+func addFunctionFlags(cmd *cobra.Command, opts *deployOptions) {
+	cmd.Flags().StringVar(&opts.user, "user", "",
+		"User the function runs as, as user[:group] (defaults to a non-root user)")
+	cmd.Flags().StringVar(&opts.workingDir, "working-dir", "",
+		"Working directory inside the container")
+	cmd.Flags().StringVar(&opts.stopSignal, "stop-signal", "",
+		"Signal the function is stopped with on timeout or cancellation, e.g. SIGINT (defaults to SIGTERM)")
+	cmd.Flags().StringArrayVar(&opts.entrypoint, "entrypoint", nil,
+		"Entrypoint of the function, repeat for each element (defaults to /app/function)")
+	cmd.Flags().StringArrayVar(&opts.args, "arg", nil,
+		"Argument passed to the entrypoint, repeat for each argument")
+	cmd.Flags().StringVar(&opts.eventSchema, "event-schema", "",
+		"Path to a JSON Schema file that events must match")
+	cmd.Flags().StringVar(&opts.defaultEvent, "default-event", "",
+		"Path to a JSON object file that events are deep-merged over, used as-is for empty events")
+	cmd.Flags().IntVar(&opts.maxRetries, "max-retries", 0,
+		"How many times a failed async invocation is retried")
+	cmd.Flags().DurationVar(&opts.dedupWindow, "dedup-window", 0,
+		"Within this time after an invocation, an identical event gets its result instead of invoking "+
+			"the function again (e.g. 5m), 0 disables it")
+	cmd.Flags().DurationVar(&opts.cacheTTL, "cache-ttl", 0,
+		"For deterministic functions, how long a result is served again for the same event (e.g. 1m), "+
+			"0 disables caching; clients bypass it with Cache-Control: no-cache")
+	cmd.Flags().DurationVar(&opts.timeout, "timeout", 0,
+		"How long an execution may run (e.g. 2m), up to the server's max_execution_timeout; "+
+			"0 uses the server's execution_timeout. The function reads it from $SERVERLESS_TIMEOUT_MS")
+	cmd.Flags().DurationVar(&opts.retryBackoff, "retry-backoff", time.Second,
+		"Delay before the first retry of an async invocation, doubled for each further retry")
+	cmd.Flags().BoolVar(&opts.readonly, "readonly-rootfs", true,
+		"Mount the function's root filesystem read-only, writes are only possible to /tmp")
+	cmd.Flags().BoolVar(&opts.writableTmp, "writable-tmp", true,
+		"Mount a writable in-memory /tmp")
+	cmd.Flags().Var(&opts.alwaysPull, "always-pull",
+		"Pull the function's image from its registry before each run, so a moved tag takes effect "+
+			"(defaults to the server's always_pull; locally built images are never pulled)")
+	cmd.Flags().Lookup("always-pull").NoOptDefVal = "true"
+	cmd.Flags().BoolVar(&opts.snapshot, "snapshot", false,
+		"Experimental: restore the function from a checkpoint of it once initialized, for fast cold starts "+
+			"of heavy-init functions; needs snapshots enabled on the server, functions with secrets aren't restored")
+	cmd.Flags().BoolVar(&opts.runOnce, "run-once", false,
+		"Run the function once, e.g. a migration: once a run completed, invocations are refused unless forced with invoke --force")
+	cmd.Flags().StringArrayVar(&opts.env, "env", nil,
+		"Environment variable of the function as KEY=VALUE, repeat for each variable")
+	cmd.Flags().StringArrayVar(&opts.labels, "label", nil,
+		"Label of the function as KEY=VALUE, repeat for each label (see invoke-all)")
+	cmd.Flags().StringArrayVar(&opts.dns, "dns", nil,
+		"DNS server of the function's containers, repeat for each server (defaults to the engine's)")
+	cmd.Flags().StringArrayVar(&opts.extraHosts, "extra-host", nil,
+		"Entry added to /etc/hosts of the function's containers as host:ip, repeat for each entry")
+	cmd.Flags().StringVar(&opts.memory, "memory", "",
+		"Memory limit of the function (e.g. 128m), unlimited by default")
+	cmd.Flags().Float64Var(&opts.cpus, "cpus", 0,
+		"CPU limit of the function in cores (e.g. 0.5), unlimited by default")
+	cmd.Flags().StringArrayVar(&opts.secrets, "secret", nil,
+		"Secret of the function as NAME=VALUE, or NAME to take the value of that environment variable, "+
+			"readable by the function from /run/secrets/NAME; repeat for each secret")
+	cmd.Flags().IntVar(&opts.concurrency, "max-concurrency", 0,
+		"Executions the function may run at once, beyond which invocations get 429 (0 for no limit of its own)")
+	cmd.Flags().StringVar(&opts.logDestination, "log-destination", "",
+		"Where the function's stderr is forwarded, tagged with the invocation: log (the server's logs at debug level, "+
+			"the default), stdout (the server's stdout as JSON lines), file:<path> (in the server's function_log_dir) or none")
+	cmd.Flags().BoolVar(&opts.logPayloads, "log-payloads", false,
+		"Have the server log the event and output of every execution, for debugging (see --redact)")
+	cmd.Flags().StringArrayVar(&opts.redactPaths, "redact", nil,
+		"Path of a value masked in the logged payloads, e.g. user.email or cards.*.number, repeat for each path")
+	cmd.Flags().StringVar(&opts.contentType, "content-type", "",
+		"Media type of the function's output, sent as the Content-Type of invocations (defaults to application/json)")
+	cmd.Flags().StringVar(&opts.eventFormat, "event-format", "",
+		"Format of the event on the function's stdin: json (the default), msgpack (transcoded from the JSON event) "+
+			"or raw (the request body as-is)")
+	cmd.Flags().StringVar(&opts.responseFormat, "response-format", "",
+		"Format of the function's output: json (the default), msgpack (transcoded to JSON for the caller) "+
+			"or raw (returned as-is, as application/octet-stream unless --content-type says otherwise)")
+	cmd.Flags().StringVar(&opts.maxOutput, "max-output", "",
+		"Cap on the output of an execution (e.g. 1m), the function is killed beyond it "+
+			"(defaults to max_output_bytes of the server)")
+	cmd.Flags().StringArrayVar(&opts.exitStatuses, "exit-status", nil,
+		"Map nonzero exit codes to an HTTP status as CODES=STATUS (e.g. 3=404 or 10-19=422), "+
+			"repeat for each mapping (defaults to 2=400)")
+}
+
+// optionalBool is a boolean flag that tells being unset apart from false, for
+// options whose default is decided by the server.
+type optionalBool struct {
+	value *bool
+}
+
+// String returns the value of the flag, empty when unset.
+func (b *optionalBool) String() string {
+	if b.value == nil {
+		return ""
 	}
+	return strconv.FormatBool(*b.value)
+}
 
+// Set parses the value of the flag.
+func (b *optionalBool) Set(s string) error {
+	value, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	b.value = &value
 	return nil
 }
 
-// invokeFunction triggers a function execution by sending an HTTP request.
-// It passes the event JSON and return the function's response.
-func invokeFunction(name, eventJSON string, config Config, log *logrus.Logger) (string, error) {
-	// Validate the event JSON to catch syntax errors
-	var event any
-	if err := json.Unmarshal([]byte(eventJSON), &event); err != nil {
-		return "", fmt.Errorf("invalid event JSON: %v", err)
+// Type names the flag's type in the help.
+func (b *optionalBool) Type() string {
+	return "bool"
+}
+
+// deployFunction handles the deployment of a user function.
+// It compiles the function, builds the Docker image, and registers it with the server.
+func deployFunction(name string, opts deployOptions, config Config, log *logrus.Logger) error {
+	// A prebuilt image doesn't need the function's sources
+	functionDir := filepath.Join("functions", name)
+	if opts.image == "" {
+		if err := checkFunctionDir(functionDir); err != nil {
+			return err
+		}
 	}
 
-	// Send HTTP POST request to the server's invoke endpoint
-	body := bytes.NewBufferString(eventJSON)
-	resp, err := http.Post(fmt.Sprintf("http://%s/invoke/%s", config.ServerAddr, name), "application/json", body)
+	m, err := applyManifest(name, functionDir, &opts, log)
 	if err != nil {
-		return "", fmt.Errorf("failed to send invoke request: %v", err)
+		return err
+	}
+	var manifestEnv, manifestLabels map[string]string
+	if m != nil {
+		manifestEnv, manifestLabels = m.Env, m.Labels
+	}
+	env, err := mergeKeyValues(manifestEnv, opts.env, "environment variable")
+	if err != nil {
+		return err
+	}
+	labels, err := mergeKeyValues(manifestLabels, opts.labels, "label")
+	if err != nil {
+		return err
+	}
+	statuses, err := exitStatuses(m, opts.exitStatuses)
+	if err != nil {
+		return err
+	}
+	secrets, err := secretValues(opts.secrets)
+	if err != nil {
+		return err
+	}
+	if opts.runtime == "" {
+		// Functions that don't declare their runtime are written in Go
+		opts.runtime = "go"
+	}
+	var memoryBytes int64
+	if opts.memory != "" {
+		if memoryBytes, err = units.RAMInBytes(opts.memory); err != nil {
+			return fmt.Errorf("invalid memory limit %q: %v", opts.memory, err)
+		}
+	}
+	var maxOutputBytes int64
+	if opts.maxOutput != "" {
+		if maxOutputBytes, err = units.RAMInBytes(opts.maxOutput); err != nil || maxOutputBytes <= 0 {
+			return fmt.Errorf("invalid output cap %q, expected a size such as 1m", opts.maxOutput)
+		}
+	}
+	if opts.dedupWindow < 0 {
+		return fmt.Errorf("invalid dedup window %v", opts.dedupWindow)
+	}
+	if opts.cacheTTL < 0 {
+		return fmt.Errorf("invalid cache TTL %v", opts.cacheTTL)
+	}
+	if opts.timeout < 0 {
+		return fmt.Errorf("invalid timeout %v", opts.timeout)
+	}
+	if opts.concurrency < 0 {
+		return fmt.Errorf("invalid concurrency limit %d", opts.concurrency)
+	}
+	if opts.cpus < 0 {
+		return fmt.Errorf("invalid CPU limit %v", opts.cpus)
 	}
-	defer resp.Body.Close()
 
-	// Read the response body
-	result, err := io.ReadAll(resp.Body)
+	// Read the event schema and default event early, so a bad path doesn't
+	// waste a build
+	eventSchema, err := readJSONFile(opts.eventSchema, "event schema")
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %v", err)
+		return err
+	}
+	defaultEvent, err := readJSONFile(opts.defaultEvent, "default event")
+	if err != nil {
+		return err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(result))
+	// Build the function, unless a prebuilt image is deployed. The build
+	// only gets the function's tag once it's registered, so a failed
+	// registration leaves the deployed image tagged
+	var build buildResult
+	if opts.image == "" {
+		if build, err = buildFunction(name, opts, config, log); err != nil {
+			return err
+		}
+	} else {
+		build = prebuiltImage(name, opts.image, log)
+		build.Platforms = opts.platforms
 	}
 
-	log.WithField("function", name).Info("Function invoked successfully")
-	return string(result), nil
+	// Register the function with the server via HTTP POST
+	metadata := map[string]any{
+		"name":             name,
+		"image":            build.Image,
+		"digest":           build.Digest,
+		"platforms":        build.Platforms,
+		"runtime":          opts.runtime,
+		"env":              env,
+		"labels":           labels,
+		"exit_statuses":    statuses,
+		"memory_bytes":     memoryBytes,
+		"nano_cpus":        int64(opts.cpus * 1e9),
+		"dns":              opts.dns,
+		"extra_hosts":      opts.extraHosts,
+		"max_output_bytes": maxOutputBytes,
+		"content_type":     opts.contentType,
+		"event_format":     opts.eventFormat,
+		"response_format":  opts.responseFormat,
+		"log_destination":  opts.logDestination,
+		"log_payloads":     opts.logPayloads,
+		"redact_paths":     opts.redactPaths,
+		"max_concurrency":  opts.concurrency,
+		"secrets":          secrets,
+		"user":             opts.user,
+		"working_dir":      opts.workingDir,
+		"stop_signal":      opts.stopSignal,
+		"entrypoint":       opts.entrypoint,
+		"args":             opts.args,
+		"event_schema":     eventSchema,
+		"default_event":    defaultEvent,
+		"max_retries":      opts.maxRetries,
+		"retry_backoff_ms": opts.retryBackoff.Milliseconds(),
+		"dedup_window_ms":  opts.dedupWindow.Milliseconds(),
+		"cache_ttl_ms":     opts.cacheTTL.Milliseconds(),
+		"timeout_ms":       opts.timeout.Milliseconds(),
+		"readonly_rootfs":  opts.readonly,
+		"writable_tmp":     opts.writableTmp,
+		"verify_image":     opts.verifyImage,
+		"always_pull":      opts.alwaysPull.value,
+		"snapshot":         opts.snapshot,
+		"run_once":         opts.runOnce,
+	}
+	body, _ := json.Marshal(metadata) // Safe to ignore error, as metadata is controlled
+	var registered registration
+	err = opts.progress.phase(name, phaseRegistering, func() error {
+		registered, err = registerFunction(body, config)
+		return err
+	})
+	if err != nil {
+		if opts.image == "" {
+			discardBuild(name, build, opts.cleanupOnFail, log)
+		}
+		return err
+	}
+	if opts.image == "" {
+		if err := promoteBuild(build); err != nil {
+			return err
+		}
+	}
+	if registered.TimeoutMs > 0 {
+		log.WithFields(logrus.Fields{
+			"function": name,
+			"timeout":  time.Duration(registered.TimeoutMs) * time.Millisecond,
+		}).Info("Function registered with its execution timeout")
+	}
+	return nil
+}
+
+// discardBuild handles the image of a deploy whose registration failed, which
+// the server doesn't know about. The function's tag still points to the
+// image deployed before, while the build only has its temporary tag: with
+// cleanup that tag is removed, otherwise the user is told it's left behind.
+func discardBuild(name string, build buildResult, cleanup bool, log *logrus.Logger) {
+	logger := log.WithFields(logrus.Fields{"function": name, "image": build.tag})
+	if !cleanup {
+		logger.Warn("Function not registered, its built image is left behind; retry the deploy, or use --cleanup-on-failure to remove it")
+		return
+	}
+	if err := removeImage(build.tag); err != nil {
+		logger.WithError(err).Warn("Function not registered, and failed to remove its built image")
+		return
+	}
+	logger.Info("Function not registered, removed its built image")
+}
+
+// promoteBuild moves the function's tag to a fresh build, and drops the
+// temporary tag it was built under.
+func promoteBuild(build buildResult) error {
+	if err := tagImage(build.tag, build.Image); err != nil {
+		return err
+	}
+	return removeImage(build.tag)
+}
+
+// removeImage removes a local image by its tag. The image itself stays as
+// long as other tags or containers use it.
+func removeImage(imageName string) error {
+	out, err := exec.Command("docker", "image", "rm", imageName).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove image %s: %v: %s", imageName, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// buildFunction compiles a function and builds its Docker image, without
+// registering it with the server. The options must have the manifest applied.
+// The image is returned under a temporary tag, see promoteBuild.
+func buildFunction(name string, opts deployOptions, config Config, log *logrus.Logger) (buildResult, error) {
+	functionDir := filepath.Join("functions", name)
+	if err := checkFunctionDir(functionDir); err != nil {
+		return buildResult{}, err
+	}
+	// A function's own Dockerfile can build any runtime from any layout,
+	// while the generated one compiles the Go sources of the directory
+	dockerfilePath, err := functionDockerfile(functionDir, opts.dockerfile)
+	if err != nil {
+		return buildResult{}, err
+	}
+	if dockerfilePath == "" && opts.runtime != "go" {
+		return buildResult{}, fmt.Errorf("unsupported runtime %q, only go is supported without a Dockerfile", opts.runtime)
+	}
+	if dockerfilePath == "" {
+		if err := checkRuntime(functionDir, opts.runtime); err != nil {
+			return buildResult{}, err
+		}
+	}
+	maxImageSize, err := imageSizeLimit(opts, config)
+	if err != nil {
+		return buildResult{}, err
+	}
+	if dockerfilePath != "" && len(opts.entrypoint) == 0 {
+		if err := checkDockerfile(dockerfilePath); err != nil {
+			return buildResult{}, err
+		}
+	}
+
+	// Serialize builds of the same function, which share the build directory
+	lock, err := acquireDeployLock(functionDir, opts.lockTimeout)
+	if err != nil {
+		return buildResult{}, err
+	}
+	defer lock.release()
+
+	// Without its own Dockerfile, the function is built with a multi-stage
+	// one: it's compiled in the Go image, and only the static binary is
+	// shipped on the small base image. It's given on stdin, so nothing is
+	// written to the function's directory
+	var generated string
+	if dockerfilePath == "" {
+		generated = fmt.Sprintf(dockerfileTemplate, goBuilderImage, opts.baseImage)
+		dockerfilePath = "-"
+	} else {
+		log.WithFields(logrus.Fields{"function": name, "dockerfile": dockerfilePath}).Info("Building with the function's Dockerfile")
+	}
+
+	// Build the Docker image, stamped with where it comes from. It's built
+	// under a temporary tag, and only gets the function's tag once the
+	// caller promotes it. Private modules resolve with the forwarded Go
+	// settings and netrc file, while explicit build arguments win over the
+	// settings
+	imageName := functionImage(name)
+	tag := buildTag(name)
+	goEnv, err := goModuleEnv(config)
+	if err != nil {
+		return buildResult{}, err
+	}
+	netrc, err := netrcFile(config)
+	if err != nil {
+		return buildResult{}, err
+	}
+	buildArgs, err := mergeKeyValues(goEnv, opts.buildArgs, "build argument")
+	if err != nil {
+		return buildResult{}, err
+	}
+	labels := imageLabels(name, functionDir, opts.version)
+
+	// Several platforms need buildx, without it the image is built for the
+	// Docker host only
+	platforms := opts.platforms
+	if len(platforms) > 0 && !buildxAvailable() {
+		log.WithFields(logrus.Fields{"function": name, "platforms": platforms}).Warn(
+			"docker buildx is not available, building for the platform of the Docker host only")
+		platforms = nil
+	}
+	// The image is loaded into the local image store, which the classic one
+	// only can for a single platform
+	if len(platforms) > 1 && !containerdImageStore() {
+		return buildResult{}, fmt.Errorf("building for several platforms (%s) needs the containerd image store of Docker "+
+			"to load the image locally; enable it, or build for a single --platform", strings.Join(platforms, ","))
+	}
+
+	err = opts.progress.phase(name, phaseBuilding, func() error {
+		cmd := exec.Command("docker", dockerBuildArgs(tag, dockerfilePath, buildArgs, labels, platforms, netrc)...)
+		cmd.Dir = functionDir
+		cmd.Stdin = strings.NewReader(generated)
+		// Show compilation and Docker errors to the user
+		output, showOutput := opts.progress.commandOutput()
+		cmd.Stderr = output
+		if err := cmd.Run(); err != nil {
+			showOutput()
+			return fmt.Errorf("failed to build Docker image: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return buildResult{}, err
+	}
+	log.WithField("function", name).Info("Docker image built")
+	// The temporary tag stays only on a build that passed the checks, until
+	// the caller promotes it
+	passed := false
+	defer func() {
+		if passed {
+			return
+		}
+		if err := removeImage(tag); err != nil {
+			log.WithError(err).WithField("function", name).Warn("Failed to remove the temporary tag of the build")
+		}
+	}()
+
+	// Record the ID of the built image, so the function keeps running this
+	// exact image even when the tag is rebuilt later
+	digest, err := imageDigest(tag)
+	if err != nil {
+		return buildResult{}, err
+	}
+	log.WithFields(logrus.Fields{"function": name, "digest": digest}).Info("Image digest recorded")
+
+	// Keep oversized images out of the registry and off the hosts
+	if maxImageSize > 0 {
+		if err := checkImageSize(tag, maxImageSize); err != nil {
+			return buildResult{}, err
+		}
+	}
+
+	// Gate the image on the scan, if one is configured
+	if len(config.ScanCommand) > 0 {
+		if opts.skipScan {
+			log.WithField("function", name).Warn("Skipping image scan")
+		} else {
+			err := opts.progress.phase(name, phaseScanning, func() error {
+				output, showOutput := opts.progress.commandOutput()
+				if err := scanImage(tag, config.ScanCommand, output); err != nil {
+					showOutput()
+					return err
+				}
+				return nil
+			})
+			if err != nil {
+				return buildResult{}, err
+			}
+			log.WithField("function", name).Info("Image scan passed")
+		}
+	}
+
+	passed = true
+	return buildResult{Image: imageName, Digest: digest, Platforms: platforms, tag: tag}, nil
+}
+
+// functionImage returns the tag of the image built for a function.
+func functionImage(name string) string {
+	return fmt.Sprintf("serverless-%s:latest", name)
+}
+
+// buildTag returns a temporary tag to build a function's image under, unique
+// to the build.
+func buildTag(name string) string {
+	return fmt.Sprintf("serverless-%s:build-%d", name, time.Now().UnixNano())
+}
+
+// tagImage points a tag at a local image.
+func tagImage(imageName, tag string) error {
+	out, err := exec.Command("docker", "image", "tag", imageName, tag).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to tag image %s as %s: %v: %s", imageName, tag, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Labels stamped on the images of functions.
+const (
+	labelFunction = "serverless.function"
+	labelVersion  = "org.opencontainers.image.version"
+	labelRevision = "org.opencontainers.image.revision"
+)
+
+// imageLabels returns the labels stamped on a function's image: its name,
+// and its version and git commit when known. The version defaults to what
+// git describe says of the sources.
+func imageLabels(name, functionDir, version string) map[string]string {
+	labels := map[string]string{labelFunction: name}
+	if version == "" {
+		version = gitOutput(functionDir, "describe", "--tags", "--always", "--dirty")
+	}
+	if version != "" {
+		labels[labelVersion] = version
+	}
+	if revision := gitOutput(functionDir, "rev-parse", "HEAD"); revision != "" {
+		labels[labelRevision] = revision
+	}
+	return labels
+}
+
+// gitOutput runs a git command in dir and returns its trimmed output, empty
+// when it fails, e.g. because dir isn't in a git repository.
+func gitOutput(dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// dockerBuildArgs returns the arguments of the docker build command of a
+// function, in a stable order. Given platforms, the image is built for each
+// with buildx, and loaded into the local image store, which needs the
+// containerd image store of Docker for more than one platform. Given a netrc
+// file, it's passed as the netrc secret.
+func dockerBuildArgs(imageName, dockerfile string, buildArgs, labels map[string]string, platforms []string, netrc string) []string {
+	args := []string{"build", "-t", imageName, "-f", dockerfile}
+	if len(platforms) > 0 {
+		args = []string{"buildx", "build", "--platform", strings.Join(platforms, ","), "--load", "-t", imageName, "-f", dockerfile}
+	}
+	for _, pair := range keyValuePairs(buildArgs) {
+		args = append(args, "--build-arg", pair)
+	}
+	for _, pair := range keyValuePairs(labels) {
+		args = append(args, "--label", pair)
+	}
+	if netrc != "" {
+		args = append(args, "--secret", "id="+netrcSecret+",src="+netrc)
+	}
+	return append(args, ".")
+}
+
+// buildxAvailable reports whether the docker buildx plugin is installed.
+func buildxAvailable() bool {
+	return exec.Command("docker", "buildx", "version").Run() == nil
+}
+
+// containerdImageStore reports whether Docker keeps images in the containerd
+// image store, which holds images for several platforms.
+func containerdImageStore() bool {
+	out, err := exec.Command("docker", "info", "--format", "{{json .DriverStatus}}").Output()
+	return err == nil && strings.Contains(string(out), "io.containerd.snapshotter")
+}
+
+// prebuiltImage describes an image deployed with --image. Its ID is recorded
+// when the image is present locally; otherwise the function runs whatever the
+// reference points to once the server pulls it, e.g. with `serverless warm`.
+func prebuiltImage(name, imageName string, log *logrus.Logger) buildResult {
+	digest, err := imageDigest(imageName)
+	if err != nil {
+		log.WithError(err).WithField("function", name).Warn("Image not found locally, registering it without a digest")
+		return buildResult{Image: imageName}
+	}
+	return buildResult{Image: imageName, Digest: digest}
+}
+
+// checkFunctionDir validates that the directory of a function's sources exists.
+func checkFunctionDir(functionDir string) error {
+	if _, err := os.Stat(functionDir); os.IsNotExist(err) {
+		return fmt.Errorf("function directory %s does not exist", functionDir)
+	}
+	return nil
+}
+
+// applyManifest fills in the options missing from the flags from the
+// function's manifest, returning the manifest, or nil when there's none.
+func applyManifest(name, functionDir string, opts *deployOptions, log *logrus.Logger) (*manifest, error) {
+	m, err := loadManifest(functionDir)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		m.apply(opts, opts.flagChanged)
+		log.WithField("function", name).Info("Manifest loaded")
+	}
+	return m, nil
+}
+
+// secretValues parses secrets given as NAME=VALUE, or as NAME alone to take
+// the value from the environment, which keeps it out of the shell history.
+func secretValues(flags []string) (map[string]string, error) {
+	secrets := make(map[string]string, len(flags))
+	for _, flag := range flags {
+		name, value, ok := strings.Cut(flag, "=")
+		if name == "" {
+			// The flag isn't quoted, as it holds the value
+			return nil, fmt.Errorf("invalid secret without a name, expected NAME=VALUE or NAME")
+		}
+		if !ok {
+			if value, ok = os.LookupEnv(name); !ok {
+				return nil, fmt.Errorf("secret %s is not set in the environment", name)
+			}
+		}
+		secrets[name] = value
+	}
+	return secrets, nil
+}
+
+// readJSONFile reads an optional JSON document given with a flag, returning
+// nil when no path is given.
+func readJSONFile(path, what string) (json.RawMessage, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", what, err)
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%s %s is not valid JSON", what, path)
+	}
+	return data, nil
+}
+
+// imageDigest returns the content-addressed ID of a local image.
+func imageDigest(imageName string) (string, error) {
+	out, err := exec.Command("docker", "image", "inspect", "--format", "{{.Id}}", imageName).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %v", imageName, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// imageSizeLimit returns the largest image a build may produce, from the
+// --max-image-size flag or else the configuration, 0 for no limit.
+func imageSizeLimit(opts deployOptions, config Config) (int64, error) {
+	size, source := config.MaxImageSize, "max_image_size"
+	if opts.maxImageSize != "" {
+		size, source = opts.maxImageSize, "--max-image-size"
+	}
+	if size == "" || size == "0" {
+		return 0, nil
+	}
+	limit, err := units.FromHumanSize(size)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid %s %q, expected a size like 500MB, or 0 for no limit", source, size)
+	}
+	return limit, nil
+}
+
+// checkImageSize fails when a local image is larger than limit bytes.
+func checkImageSize(imageName string, limit int64) error {
+	out, err := exec.Command("docker", "image", "inspect", "--format", "{{.Size}}", imageName).Output()
+	if err != nil {
+		return fmt.Errorf("failed to inspect image %s: %v", imageName, err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("failed to read the size of image %s: %v", imageName, err)
+	}
+	if size > limit {
+		return fmt.Errorf("image %s is %s, larger than the limit of %s; use a multi-stage build "+
+			"that ships only what the function needs on a small base image", imageName,
+			units.HumanSize(float64(size)), units.HumanSize(float64(limit)))
+	}
+	return nil
+}
+
+// scanImage runs the configured scanner against an image, writing its output
+// to output. A nonzero exit means the image failed the scan.
+func scanImage(imageName string, scanCommand []string, output io.Writer) error {
+	args := append(scanCommand[1:len(scanCommand):len(scanCommand)], imageName)
+	cmd := exec.Command(scanCommand[0], args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("image scan failed (use --skip-scan to bypass): %v", err)
+	}
+	return nil
+}
+
+// readEvent returns the event from exactly one of its sources: the positional
+// argument, stdin (when the argument is "-"), or the event file.
+func readEvent(args []string, eventFile string, stdin io.Reader) (string, error) {
+	switch {
+	case len(args) > 0 && eventFile != "":
+		return "", fmt.Errorf("provide the event either as an argument or with --event-file, not both")
+	case eventFile != "":
+		data, err := os.ReadFile(eventFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read event file: %v", err)
+		}
+		return string(data), nil
+	case len(args) > 0 && args[0] == "-":
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return "", fmt.Errorf("failed to read event from stdin: %v", err)
+		}
+		return string(data), nil
+	case len(args) > 0:
+		return args[0], nil
+	default:
+		return "", fmt.Errorf("no event provided, pass it as an argument, - for stdin, or with --event-file")
+	}
+}
+
+// invokeFunction triggers a function execution by sending an HTTP request.
+// It passes the event JSON and return the function's response. A nonzero timeout
+// puts a deadline on the request; cancelling ctx aborts it.
+func invokeFunction(ctx context.Context, name, eventJSON string, opts invokeOptions, config Config, log *logrus.Logger) (string, error) {
+	timeout := opts.timeout
+	// Validate the event JSON to catch syntax errors, uploads have the
+	// server make the event
+	var event any
+	if len(opts.uploads) == 0 {
+		if err := json.Unmarshal([]byte(eventJSON), &event); err != nil {
+			return "", fmt.Errorf("invalid event JSON: %v", err)
+		}
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Send HTTP POST request to the server's invoke endpoint, retrying
+	// transient failures if asked to
+	var resp *http.Response
+	var result []byte
+	for attempt := 0; ; attempt++ {
+		var err error
+		resp, result, err = sendInvoke(ctx, name, eventJSON, opts, config)
+		if ctx.Err() != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return "", fmt.Errorf("invoke timed out after %s", timeout)
+			}
+			return "", fmt.Errorf("invoke cancelled")
+		}
+		if attempt >= opts.retries || !retryable(resp, err) {
+			if err != nil {
+				return "", err
+			}
+			break
+		}
+
+		delay := invokeRetryDelay(attempt, resp)
+		fields := logrus.Fields{"function": name, "attempt": attempt + 1, "delay": delay}
+		if err != nil {
+			log.WithError(err).WithFields(fields).Warn("Invoke failed, retrying")
+		} else {
+			log.WithFields(fields).WithField("status", resp.StatusCode).Warn("Invoke failed, retrying")
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+
+	if opts.async && resp.StatusCode == http.StatusAccepted {
+		log.WithField("function", name).Info("Job submitted")
+		if !opts.wait {
+			return indentJSON(result)
+		}
+		return waitForJob(ctx, result, timeout, config, log)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(result))
+	}
+
+	log.WithField("function", name).Info("Function invoked successfully")
+	return string(result), nil
+}
+
+// upload is a file uploaded with an invocation.
+type upload struct {
+	Field string // Form field the file is uploaded as
+	Path  string // Local path of the file
+}
+
+// parseUploads parses --upload values of the form FIELD=@PATH.
+func parseUploads(values []string) ([]upload, error) {
+	uploads := make([]upload, 0, len(values))
+	for _, value := range values {
+		field, path, ok := strings.Cut(value, "=")
+		if !ok || field == "" || !strings.HasPrefix(path, "@") || len(path) == 1 {
+			return nil, fmt.Errorf("invalid upload %q, expected FIELD=@PATH", value)
+		}
+		uploads = append(uploads, upload{Field: field, Path: path[1:]})
+	}
+	return uploads, nil
+}
+
+// uploadBody encodes files as a multipart/form-data body, returning it with
+// its content type.
+func uploadBody(values []string) ([]byte, string, error) {
+	uploads, err := parseUploads(values)
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	for _, upload := range uploads {
+		file, err := os.Open(upload.Path)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read upload: %v", err)
+		}
+		part, err := form.CreateFormFile(upload.Field, filepath.Base(upload.Path))
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		file.Close()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read upload %s: %v", upload.Path, err)
+		}
+	}
+	if err := form.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), form.FormDataContentType(), nil
+}
+
+// compressThreshold is the event size from which invoke requests are gzipped.
+const compressThreshold = 8 << 10
+
+// sendInvoke sends a single invoke request and reads the response.
+func sendInvoke(ctx context.Context, name, eventJSON string, opts invokeOptions, config Config) (*http.Response, []byte, error) {
+	// Large events are compressed. Compressed responses are decompressed by
+	// the HTTP client, which asks for gzip by itself.
+	body := []byte(eventJSON)
+	contentType := "application/json"
+	if len(opts.uploads) > 0 {
+		var err error
+		if body, contentType, err = uploadBody(opts.uploads); err != nil {
+			return nil, nil, err
+		}
+	}
+	compressed := len(opts.uploads) == 0 && len(body) >= compressThreshold
+	if compressed {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body) // Writes to a buffer don't fail
+		gz.Close()
+		body = buf.Bytes()
+	}
+
+	query := url.Values{}
+	if opts.digest != "" {
+		query.Set("digest", opts.digest)
+	}
+	if opts.force {
+		query.Set("force", "true")
+	}
+	path := "/invoke/" + name
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.url(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create invoke request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if opts.async {
+		req.Header.Set("X-Serverless-Async", "true")
+	}
+
+	resp, err := config.client().Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to send invoke request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Read the response body
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	return resp, result, nil
+}
+
+// Backoff between invoke retries, doubled for every attempt and jittered so
+// many clients don't retry in lockstep.
+const (
+	invokeRetryBase     = 200 * time.Millisecond
+	invokeRetryMax      = 10 * time.Second
+	maxInvokeRetryShift = 6 // Doubling further only exceeds invokeRetryMax, and overflows eventually
+)
+
+// retryable reports whether an invoke attempt failed transiently: the server
+// couldn't be reached, or replied it's unavailable or timed out. Client errors
+// are never retried.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// invokeRetryDelay returns the wait before the retry following the given
+// attempt, honoring the server's Retry-After when it asks for longer.
+func invokeRetryDelay(attempt int, resp *http.Response) time.Duration {
+	delay := min(invokeRetryBase<<min(attempt, maxInvokeRetryShift), invokeRetryMax)
+	// Half of the delay is fixed, the other half random
+	delay = delay/2 + rand.N(delay/2+1)
+
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			delay = max(delay, time.Duration(seconds)*time.Second)
+		}
+	}
+	return delay
+}
+
+// invokeAll invokes the functions matching the label selector, returning the
+// per-function results and how many of them failed.
+func invokeAll(ctx context.Context, selector []string, eventJSON string, config Config) (string, int, error) {
+	if !json.Valid([]byte(eventJSON)) {
+		return "", 0, fmt.Errorf("invalid event JSON")
+	}
+
+	query := url.Values{"label": selector}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		config.url("/invoke?"+query.Encode()), strings.NewReader(eventJSON))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create invoke request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := config.client().Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to send invoke request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var response struct {
+		Results map[string]struct {
+			Status int `json:"status"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", 0, fmt.Errorf("invalid response: %v", err)
+	}
+	failed := 0
+	for _, result := range response.Results {
+		if result.Status != http.StatusOK {
+			failed++
+		}
+	}
+
+	results, err := indentJSON(body)
+	return results, failed, err
+}
+
+// describeFunction fetches a function's metadata from the server.
+func describeFunction(name string, config Config) (string, error) {
+	body, err := serverRequest(http.MethodGet, "/functions/"+name, config)
+	if err != nil {
+		return "", err
+	}
+	return indentJSON(body)
+}
+
+// listFunctions returns the metadata of all functions.
+func listFunctions(includeDeleted bool, config Config) (string, error) {
+	path := "/functions"
+	if includeDeleted {
+		path += "?include_deleted=true"
+	}
+	body, err := serverRequest(http.MethodGet, path, config)
+	if err != nil {
+		return "", err
+	}
+	return indentJSON(body)
+}
+
+// listContainers renders the containers of functions as a table.
+func listContainers(out io.Writer, config Config) error {
+	body, err := serverRequest(http.MethodGet, "/containers", config)
+	if err != nil {
+		return err
+	}
+	var containers []struct {
+		ID         string `json:"id"`
+		Function   string `json:"function"`
+		Invocation string `json:"invocation"`
+		State      string `json:"state"`
+		AgeSeconds int64  `json:"age_seconds"`
+	}
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+
+	table := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(table, "CONTAINER ID\tFUNCTION\tINVOCATION\tSTATE\tAGE")
+	for _, c := range containers {
+		id := c.ID
+		if len(id) > 12 {
+			id = id[:12] // Short form, as shown by docker ps
+		}
+		age := units.HumanDuration(time.Duration(c.AgeSeconds) * time.Second)
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", id, c.Function, c.Invocation, c.State, age)
+	}
+	return table.Flush()
+}
+
+// listAuditEvents renders the recent changes to functions as a table.
+func listAuditEvents(out io.Writer, functionName string, limit int, config Config) error {
+	query := url.Values{"limit": {strconv.Itoa(limit)}}
+	if functionName != "" {
+		query.Set("function", functionName)
+	}
+	body, err := serverRequest(http.MethodGet, "/audit?"+query.Encode(), config)
+	if err != nil {
+		return err
+	}
+	var events []struct {
+		Time     time.Time `json:"time"`
+		Function string    `json:"function"`
+		Action   string    `json:"action"`
+		Actor    string    `json:"actor"`
+		Details  string    `json:"details"`
+	}
+	if err := json.Unmarshal(body, &events); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+
+	table := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(table, "TIME\tFUNCTION\tACTION\tACTOR\tDETAILS")
+	for _, e := range events {
+		actor := e.Actor
+		if actor == "" {
+			actor = "-"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.DateTime), e.Function, e.Action, actor, e.Details)
+	}
+	return table.Flush()
+}
+
+// restoreFunction brings back a deleted function and returns its metadata.
+func restoreFunction(name string, config Config) (string, error) {
+	body, err := serverRequest(http.MethodPost, "/functions/"+name+"/restore", config)
+	if err != nil {
+		return "", err
+	}
+	return indentJSON(body)
+}
+
+// collectGarbage asks the server to remove unused images and returns its report.
+func collectGarbage(config Config) (string, error) {
+	body, err := serverRequest(http.MethodPost, "/gc", config)
+	if err != nil {
+		return "", err
+	}
+	return indentJSON(body)
+}
+
+// pruneContainers asks the server to remove stopped function containers and
+// returns its report.
+func pruneContainers(config Config) (string, error) {
+	body, err := serverRequest(http.MethodPost, "/prune", config)
+	if err != nil {
+		return "", err
+	}
+	return indentJSON(body)
+}
+
+// warmFunction asks the server to prepare a function and returns its report.
+func warmFunction(name string, config Config) (string, error) {
+	body, err := serverRequest(http.MethodPost, "/functions/"+name+"/warm", config)
+	if err != nil {
+		return "", err
+	}
+	return indentJSON(body)
+}
+
+// getJob fetches the state of an async invocation from the server.
+func getJob(jobID string, config Config) (string, error) {
+	body, err := serverRequest(http.MethodGet, "/jobs/"+jobID, config)
+	if err != nil {
+		return "", err
+	}
+	return indentJSON(body)
+}
+
+// cancelJob cancels an async invocation on the server and returns its state.
+func cancelJob(jobID string, config Config) (string, error) {
+	body, err := serverRequest(http.MethodPost, "/jobs/"+jobID+"/cancel", config)
+	if err != nil {
+		return "", err
+	}
+	return indentJSON(body)
+}
+
+// jobWaitInterval is how long each job request is held by the server while
+// waiting for the job to change.
+const jobWaitInterval = 30 * time.Second
+
+// jobState is the part of a job's state needed to wait for it.
+type jobState struct {
+	JobID  string `json:"job_id"`
+	Status string `json:"status"`
+	Result string `json:"result"`
+	Error  string `json:"error"`
+}
+
+// waitForJob long-polls the job submitted with the given response until it
+// finishes, and returns its result. Retries are waited for as well.
+func waitForJob(ctx context.Context, submitted []byte, timeout time.Duration, config Config, log *logrus.Logger) (string, error) {
+	var job jobState
+	if err := json.Unmarshal(submitted, &job); err != nil {
+		return "", fmt.Errorf("invalid job response: %v", err)
+	}
+
+	for job.Status != "succeeded" && job.Status != "failed" && job.Status != "cancelled" {
+		url := config.url(fmt.Sprintf("/jobs/%s?wait=%s", job.JobID, jobWaitInterval))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to create job request: %v", err)
+		}
+
+		resp, err := config.client().Do(req)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return "", fmt.Errorf("job %s still running after %s", job.JobID, timeout)
+			}
+			if errors.Is(err, context.Canceled) {
+				return "", fmt.Errorf("stopped waiting for job %s", job.JobID)
+			}
+			return "", fmt.Errorf("failed to send job request: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to read job response: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
+		}
+		if err := json.Unmarshal(body, &job); err != nil {
+			return "", fmt.Errorf("invalid job response: %v", err)
+		}
+	}
+
+	if job.Status == "failed" {
+		return "", fmt.Errorf("job %s failed: %s", job.JobID, job.Error)
+	}
+	if job.Status == "cancelled" {
+		return "", fmt.Errorf("job %s was cancelled", job.JobID)
+	}
+	log.WithField("job", job.JobID).Info("Job succeeded")
+	return job.Result, nil
+}
+
+// setAlias points an alias at the revisions given as function=digest pairs,
+// weighted by the weight at the same position, or equally without weights.
+func setAlias(name string, pairs []string, weights []int, config Config) (string, error) {
+	if len(weights) > 0 && len(weights) != len(pairs) {
+		return "", fmt.Errorf("got %d weights for %d targets", len(weights), len(pairs))
+	}
+
+	type target struct {
+		Digest string `json:"digest"`
+		Weight int    `json:"weight"`
+	}
+	var function string
+	targets := make([]target, 0, len(pairs))
+	for i, pair := range pairs {
+		fn, digest, ok := strings.Cut(pair, "=")
+		if !ok || fn == "" || digest == "" {
+			return "", fmt.Errorf("invalid target %q, expected function=digest", pair)
+		}
+		if function != "" && fn != function {
+			return "", fmt.Errorf("targets must be revisions of one function, got %s and %s", function, fn)
+		}
+		function = fn
+
+		weight := 1
+		if len(weights) > 0 {
+			weight = weights[i]
+		}
+		if weight < 0 {
+			return "", fmt.Errorf("invalid weight %d of %s, expected a non-negative integer", weight, digest)
+		}
+		targets = append(targets, target{Digest: digest, Weight: weight})
+	}
+
+	body, _ := json.Marshal(map[string]any{"function": function, "targets": targets}) // Safe to ignore error, as the targets are controlled
+	req, err := http.NewRequest(http.MethodPut, config.url("/aliases/"+name), bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := config.client().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(result))
+	}
+	return indentJSON(result)
+}
+
+// setFunctionConfig changes the given fields of a function, given as
+// field=value pairs, and returns its updated metadata.
+func setFunctionConfig(name string, pairs []string, config Config) (string, error) {
+	fields := make(map[string]json.RawMessage, len(pairs))
+	for _, pair := range pairs {
+		field, value, ok := strings.Cut(pair, "=")
+		if !ok || field == "" {
+			return "", fmt.Errorf("invalid field %q, expected field=value", pair)
+		}
+		// Values that aren't JSON are strings, so they don't need quoting
+		if json.Valid([]byte(value)) {
+			fields[field] = json.RawMessage(value)
+		} else {
+			fields[field], _ = json.Marshal(value) // Safe to ignore error, as strings always marshal
+		}
+	}
+
+	body, _ := json.Marshal(fields) // Safe to ignore error, as the values are valid JSON
+	req, err := http.NewRequest(http.MethodPatch, config.url("/functions/"+name), bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := config.client().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(result))
+	}
+	return indentJSON(result)
+}
+
+// maxLogLine is the longest line of output followLogs takes, well beyond what
+// the default bufio.Scanner limit of 64KiB allows.
+const maxLogLine = 16 << 20
+
+// followLogs streams a function's running invocation output from the server's
+// event stream, writing each line to stdout or stderr as it arrives.
+func followLogs(ctx context.Context, name string, config Config, stdout, stderr io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		config.url("/functions/"+name+"/logs/stream"), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := config.client().Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("failed to send logs request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	// Each event is an "event:" line, a "data:" line and a blank line
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+			switch event {
+			case "stdout":
+				fmt.Fprintln(stdout, data)
+			case "stderr":
+				fmt.Fprintln(stderr, data)
+			case "end":
+				fmt.Fprintf(stderr, "(%s)\n", data)
+				return nil
+			case "error":
+				return fmt.Errorf("log stream failed: %s", data)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to read log stream: %v", err)
+	}
+	return nil
+}
+
+// serverRequest sends a bodyless request to the server and returns the
+// response body, failing on any status other than 200.
+func serverRequest(method, path string, config Config) ([]byte, error) {
+	req, err := http.NewRequest(method, config.url(path), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := config.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return nil, fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+// indentJSON formats a JSON response for display.
+func indentJSON(data []byte) (string, error) {
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return "", fmt.Errorf("invalid response: %v", err)
+	}
+	return out.String(), nil
 }
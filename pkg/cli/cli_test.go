@@ -0,0 +1,1501 @@
+package cli
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// fakeCommands puts scripts named after commands first on PATH. Each records
+// its name and arguments in the returned log before running its script.
+func fakeCommands(t *testing.T, scripts map[string]string) string {
+	t.Helper()
+	bin := t.TempDir()
+	log := filepath.Join(bin, "commands.log")
+	for name, script := range scripts {
+		content := "#!/bin/sh\necho \"" + name + " $*\" >> " + log + "\n" + script + "\n"
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+// buildTagPattern matches the temporary tags of builds (see buildTag).
+var buildTagPattern = regexp.MustCompile(`(serverless-[\w.-]+):build-\d+`)
+
+// commandsRun returns the commands recorded in the log of fakeCommands. The
+// temporary tags of builds are shortened to NAME:build, so they compare.
+func commandsRun(t *testing.T, log string) []string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = buildTagPattern.ReplaceAll(data, []byte("$1:build"))
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// buildCommands are scripts of the commands building functions, which
+// succeed without doing anything.
+var buildCommands = map[string]string{
+	"go":     "touch function",
+	"docker": "exit 0",
+}
+
+// withFunction changes to a workspace with the sources of a function of the
+// given name, restoring the working directory once the test is done. Builds
+// don't get the Go module settings of the environment running the tests.
+func withFunction(t *testing.T, name string) {
+	t.Helper()
+	for _, name := range goModuleVars {
+		t.Setenv(name, "")
+	}
+	workspace := t.TempDir()
+	dir := filepath.Join(workspace, "functions", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(workspace); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// fakeServer records the requests of the CLI, answering them with handler.
+type fakeServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string // Method and path of each request
+}
+
+// newFakeServer starts a server answering with handler, or 200 when nil.
+func newFakeServer(t *testing.T, handler http.HandlerFunc) *fakeServer {
+	t.Helper()
+	s := &fakeServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		s.mu.Unlock()
+		if handler != nil {
+			handler(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// received returns the requests received so far.
+func (s *fakeServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// testLogger returns a logger discarding its output.
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func TestDeployScan(t *testing.T) {
+	tests := []struct {
+		name         string
+		scanner      string // Script of the scanner, none when empty
+		skipScan     bool
+		wantScanned  bool
+		wantRegister bool
+	}{
+		{name: "no scanner", wantRegister: true},
+		{name: "clean image", scanner: "exit 0", wantScanned: true, wantRegister: true},
+		{name: "vulnerable image", scanner: "echo CVE-2024-0001; exit 1", wantScanned: true},
+		{name: "scan skipped", scanner: "exit 1", skipScan: true, wantRegister: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			scripts := maps.Clone(buildCommands)
+			config := Config{}
+			if tt.scanner != "" {
+				scripts["scan"] = tt.scanner
+				config.ScanCommand = []string{"scan", "--severity", "HIGH"}
+			}
+			commands := fakeCommands(t, scripts)
+			server := newFakeServer(t, nil)
+			config.ServerAddr = server.Listener.Addr().String()
+
+			err := deployFunction("hello", deployOptions{skipScan: tt.skipScan}, config, testLogger())
+			if (err != nil) == tt.wantRegister {
+				t.Fatalf("deployFunction = %v, want error %v", err, !tt.wantRegister)
+			}
+			scanned, promoted, removed := false, false, false
+			for _, command := range commandsRun(t, commands) {
+				promoted = promoted || command == "docker image tag serverless-hello:build serverless-hello:latest"
+				removed = removed || command == "docker image rm serverless-hello:build"
+				if strings.HasPrefix(command, "scan ") {
+					scanned = true
+					if command != "scan --severity HIGH serverless-hello:build" {
+						t.Errorf("scanner run as %q, want the image appended", command)
+					}
+				}
+			}
+			if scanned != tt.wantScanned {
+				t.Errorf("scanned = %v, want %v", scanned, tt.wantScanned)
+			}
+			// A rejected build never gets the function's tag
+			if promoted != tt.wantRegister || !removed {
+				t.Errorf("promoted = %v, temporary tag removed = %v, want %v and true", promoted, removed, tt.wantRegister)
+			}
+			if registered := len(server.received()) > 0; registered != tt.wantRegister {
+				t.Errorf("registered = %v, want %v", registered, tt.wantRegister)
+			}
+		})
+	}
+}
+
+func TestDescribeFunction(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{name: "found", status: http.StatusOK, body: `{"name":"hello","image":"hello:latest"}`, want: "{\n  \"name\": \"hello\",\n  \"image\": \"hello:latest\"\n}"},
+		{name: "not found", status: http.StatusNotFound, body: "Function not found", wantErr: true},
+		{name: "not JSON", status: http.StatusOK, body: "<html>", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			got, err := describeFunction("hello", Config{ServerAddr: server.Listener.Addr().String()})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("describeFunction = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("describeFunction = %q, want %q", got, tt.want)
+			}
+			if requests := server.received(); len(requests) != 1 || requests[0] != "GET /functions/hello" {
+				t.Errorf("requests = %q, want GET /functions/hello", requests)
+			}
+		})
+	}
+}
+
+func TestReadEvent(t *testing.T) {
+	eventFile := filepath.Join(t.TempDir(), "event.json")
+	if err := os.WriteFile(eventFile, []byte(`{"from":"file"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		args      []string
+		eventFile string
+		want      string
+		wantErr   bool
+	}{
+		{name: "argument", args: []string{`{"from":"argument"}`}, want: `{"from":"argument"}`},
+		{name: "stdin", args: []string{"-"}, want: `{"from":"stdin"}`},
+		{name: "file", eventFile: eventFile, want: `{"from":"file"}`},
+		{name: "missing file", eventFile: filepath.Join(t.TempDir(), "missing.json"), wantErr: true},
+		{name: "argument and file", args: []string{`{}`}, eventFile: eventFile, wantErr: true},
+		{name: "stdin and file", args: []string{"-"}, eventFile: eventFile, wantErr: true},
+		{name: "none", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readEvent(tt.args, tt.eventFile, strings.NewReader(`{"from":"stdin"}`))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readEvent = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("readEvent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFollowLogs(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		events     string
+		wantStdout string
+		wantStderr string
+		wantErr    bool
+	}{
+		{
+			name:   "invocation output",
+			status: http.StatusOK,
+			events: "event: stdout\ndata: one\n\nevent: stderr\ndata: oops\n\n" +
+				"event: stdout\ndata: " + strings.Repeat("x", 100*1024) + "\n\nevent: end\ndata: invocation finished\n\n",
+			wantStdout: "one\n" + strings.Repeat("x", 100*1024) + "\n",
+			wantStderr: "oops\n(invocation finished)\n",
+		},
+		{
+			name:       "nothing running",
+			status:     http.StatusOK,
+			events:     "event: end\ndata: no running invocation\n\n",
+			wantStderr: "(no running invocation)\n",
+		},
+		{name: "stream failed", status: http.StatusOK, events: "event: error\ndata: boom\n\n", wantErr: true},
+		{name: "unknown function", status: http.StatusNotFound, events: "Function not found", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.events))
+			})
+
+			var stdout, stderr strings.Builder
+			err := followLogs(context.Background(), "hello", Config{ServerAddr: server.Listener.Addr().String()}, &stdout, &stderr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("followLogs = %v, want error %v", err, tt.wantErr)
+			}
+			if stdout.String() != tt.wantStdout || stderr.String() != tt.wantStderr {
+				t.Errorf("stdout %q, stderr %q, want %q, %q", stdout.String(), stderr.String(), tt.wantStdout, tt.wantStderr)
+			}
+			if requests := server.received(); len(requests) != 1 || requests[0] != "GET /functions/hello/logs/stream" {
+				t.Errorf("requests = %q, want GET /functions/hello/logs/stream", requests)
+			}
+		})
+	}
+}
+
+func TestDeployDockerfile(t *testing.T) {
+	tests := []struct {
+		name      string
+		baseImage string
+	}{
+		{name: "distroless", baseImage: defaultBaseImage},
+		{name: "alpine", baseImage: "alpine:3.20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			// The generated Dockerfile is given to docker build on stdin
+			received := filepath.Join(t.TempDir(), "Dockerfile")
+			scripts := maps.Clone(buildCommands)
+			scripts["docker"] = `[ "$1" = build ] && cat > ` + received + `; exit 0`
+			commands := fakeCommands(t, scripts)
+			server := newFakeServer(t, nil)
+
+			err := deployFunction("hello", deployOptions{baseImage: tt.baseImage}, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if err != nil {
+				t.Fatalf("deployFunction failed: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join("functions", "hello", "Dockerfile")); !os.IsNotExist(err) {
+				t.Errorf("Dockerfile written to the function's directory: %v", err)
+			}
+			data, err := os.ReadFile(received)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dockerfile := string(data)
+			// The function is compiled statically in the build stage, and
+			// only its binary is copied onto the base image
+			for _, want := range []string{
+				"FROM " + goBuilderImage + " AS build\n",
+				"CGO_ENABLED=0",
+				"FROM " + tt.baseImage + "\n",
+				"COPY --from=build /out/function /app/function\n",
+			} {
+				if !strings.Contains(dockerfile, want) {
+					t.Errorf("Dockerfile lacks %q:\n%s", want, dockerfile)
+				}
+			}
+			if strings.Index(dockerfile, "AS build") > strings.Index(dockerfile, "FROM "+tt.baseImage) {
+				t.Errorf("the base image stage comes before the build stage:\n%s", dockerfile)
+			}
+			for _, command := range commandsRun(t, commands) {
+				if strings.HasPrefix(command, "go ") {
+					t.Errorf("compiled on the host: %q", command)
+				}
+			}
+		})
+	}
+}
+
+func TestInvokeAsyncWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		states  []string // Status of the job in each job response, the last one repeated
+		timeout time.Duration
+		want    string
+		wantErr string
+	}{
+		{name: "completes within the wait", states: []string{"running", "succeeded"}, timeout: 5 * time.Second, want: `{"ok":true}`},
+		{name: "fails", states: []string{"failed"}, timeout: 5 * time.Second, wantErr: "failed: boom"},
+		{name: "times out", states: []string{"running"}, timeout: 300 * time.Millisecond, wantErr: "still running"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			polls := 0
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPost {
+					w.WriteHeader(http.StatusAccepted)
+					w.Write([]byte(`{"job_id":"j1","status":"pending"}`))
+					return
+				}
+				if r.URL.Query().Get("wait") == "" {
+					t.Errorf("job polled without waiting: %s", r.URL)
+				}
+				mu.Lock()
+				state := tt.states[min(polls, len(tt.states)-1)]
+				polls++
+				mu.Unlock()
+				if state == "running" {
+					// Held by the server like a long poll, until the client gives up
+					select {
+					case <-r.Context().Done():
+						return
+					case <-time.After(50 * time.Millisecond):
+					}
+				}
+				fmt.Fprintf(w, `{"job_id":"j1","status":%q,"result":"{\"ok\":true}","error":"boom"}`, state)
+			})
+			opts := invokeOptions{async: true, wait: true, timeout: tt.timeout}
+
+			got, err := invokeFunction(context.Background(), "hello", `{}`, opts, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("invokeFunction = %v, want an error with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("invokeFunction failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("result = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployDigest(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name         string
+		docker       string // Script of docker
+		wantRegister bool
+	}{
+		{name: "inspected", docker: `[ "$1" = image ] && echo ` + digest + `; exit 0`, wantRegister: true},
+		{name: "inspect fails", docker: `[ "$1" = image ] && exit 1; exit 0`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			scripts := maps.Clone(buildCommands)
+			scripts["docker"] = tt.docker
+			commands := fakeCommands(t, scripts)
+			var registered map[string]any
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&registered)
+			})
+
+			err := deployFunction("hello", deployOptions{}, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if (err == nil) != tt.wantRegister {
+				t.Fatalf("deployFunction = %v, want error %v", err, !tt.wantRegister)
+			}
+			if !tt.wantRegister {
+				if len(server.received()) != 0 {
+					t.Error("registered without a digest")
+				}
+				return
+			}
+			if registered["digest"] != digest {
+				t.Errorf("registered digest %v, want %s", registered["digest"], digest)
+			}
+			inspected := false
+			for _, command := range commandsRun(t, commands) {
+				inspected = inspected || command == "docker image inspect --format {{.Id}} serverless-hello:build"
+			}
+			if !inspected {
+				t.Errorf("the built image wasn't inspected: %q", commandsRun(t, commands))
+			}
+		})
+	}
+}
+
+func TestDeployMaxOutput(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxOutput string
+		want      any // max_output_bytes registered, nil when the deploy fails
+	}{
+		{name: "server default", want: float64(0)},
+		{name: "size", maxOutput: "1m", want: float64(1 << 20)},
+		{name: "bytes", maxOutput: "4096", want: float64(4096)},
+		{name: "zero", maxOutput: "0"},
+		{name: "invalid", maxOutput: "lots"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			fakeCommands(t, buildCommands)
+			var registered map[string]any
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&registered)
+			})
+
+			err := deployFunction("hello", deployOptions{maxOutput: tt.maxOutput}, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if (err != nil) != (tt.want == nil) {
+				t.Fatalf("deployFunction = %v, want error %v", err, tt.want == nil)
+			}
+			if tt.want == nil {
+				if len(server.received()) != 0 {
+					t.Error("registered with an invalid output cap")
+				}
+				return
+			}
+			if registered["max_output_bytes"] != tt.want {
+				t.Errorf("registered max_output_bytes %v, want %v", registered["max_output_bytes"], tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		reply   string // Body of the server's reply
+		want    any    // timeout_ms registered, nil when the deploy fails
+	}{
+		{name: "server's timeout", reply: `{"name":"hello","timeout_ms":30000}`, want: float64(0)},
+		{name: "own timeout", timeout: 2 * time.Minute, reply: `{"name":"hello","timeout_ms":120000}`, want: float64(120000)},
+		{name: "older server", timeout: time.Minute, want: float64(60000)},
+		{name: "undecodable reply", timeout: time.Minute, reply: "OK", want: float64(60000)},
+		{name: "negative", timeout: -time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			fakeCommands(t, buildCommands)
+			var registered map[string]any
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&registered)
+				w.Write([]byte(tt.reply))
+			})
+
+			err := deployFunction("hello", deployOptions{timeout: tt.timeout}, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if (err != nil) != (tt.want == nil) {
+				t.Fatalf("deployFunction = %v, want error %v", err, tt.want == nil)
+			}
+			if tt.want == nil {
+				if len(server.received()) != 0 {
+					t.Error("registered with an invalid timeout")
+				}
+				return
+			}
+			if registered["timeout_ms"] != tt.want {
+				t.Errorf("registered timeout_ms %v, want %v", registered["timeout_ms"], tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildFunction(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name     string
+		function string // Function whose sources exist
+		runtime  string
+		want     buildResult
+		wantErr  bool
+	}{
+		{name: "built", function: "hello", runtime: "go", want: buildResult{Image: "serverless-hello:latest", Digest: digest}},
+		{name: "missing sources", function: "other", runtime: "go", wantErr: true},
+		{name: "unsupported runtime", function: "hello", runtime: "python", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, tt.function)
+			scripts := maps.Clone(buildCommands)
+			scripts["docker"] = `[ "$1" = image ] && echo ` + digest + `; exit 0`
+			scripts["git"] = "exit 128" // Not a repository
+			commands := fakeCommands(t, scripts)
+			server := newFakeServer(t, nil)
+
+			build, err := buildFunction("hello", deployOptions{runtime: tt.runtime}, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildFunction = %v, want error %v", err, tt.wantErr)
+			}
+			// The build keeps its temporary tag until it's promoted
+			if !tt.wantErr && !buildTagPattern.MatchString(build.tag) {
+				t.Errorf("build tagged %q, want a temporary tag", build.tag)
+			}
+			build.tag = ""
+			if !reflect.DeepEqual(build, tt.want) {
+				t.Errorf("build = %+v, want %+v", build, tt.want)
+			}
+			if len(server.received()) != 0 {
+				t.Errorf("building registered the function: %q", server.received())
+			}
+			built := false
+			for _, command := range commandsRun(t, commands) {
+				built = built || command == "docker build -t serverless-hello:build -f - --label serverless.function=hello ."
+			}
+			if built == tt.wantErr {
+				t.Errorf("image built = %v, want %v: %q", built, !tt.wantErr, commandsRun(t, commands))
+			}
+		})
+	}
+}
+
+func TestDockerBuildArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		buildArgs map[string]string
+		labels    map[string]string
+		platforms []string
+		netrc     string
+		want      []string
+	}{
+		{name: "plain build", want: []string{"build", "-t", "img", "-f", "Dockerfile", "."}},
+		{
+			name:      "build args and labels sorted",
+			buildArgs: map[string]string{"B": "2", "A": "1"},
+			labels:    map[string]string{labelVersion: "v1.2.0", labelFunction: "hello"},
+			want: []string{"build", "-t", "img", "-f", "Dockerfile", "--build-arg", "A=1", "--build-arg", "B=2",
+				"--label", "org.opencontainers.image.version=v1.2.0", "--label", "serverless.function=hello", "."},
+		},
+		{
+			name:      "one platform",
+			platforms: []string{"linux/arm64"},
+			want:      []string{"buildx", "build", "--platform", "linux/arm64", "--load", "-t", "img", "-f", "Dockerfile", "."},
+		},
+		{
+			name:      "several platforms",
+			platforms: []string{"linux/amd64", "linux/arm64"},
+			want:      []string{"buildx", "build", "--platform", "linux/amd64,linux/arm64", "--load", "-t", "img", "-f", "Dockerfile", "."},
+		},
+		{
+			name:  "netrc secret",
+			netrc: "/home/u/.netrc",
+			want:  []string{"build", "-t", "img", "-f", "Dockerfile", "--secret", "id=netrc,src=/home/u/.netrc", "."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dockerBuildArgs("img", "Dockerfile", tt.buildArgs, tt.labels, tt.platforms, tt.netrc); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dockerBuildArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildTag(t *testing.T) {
+	validTag := regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	tests := []string{"hello", "my-func", "a.b_c"}
+	for _, name := range tests {
+		t.Run(name, func(t *testing.T) {
+			first, second := buildTag(name), buildTag(name)
+			if first == second {
+				t.Errorf("buildTag(%s) returned %s twice, want a tag unique to each build", name, first)
+			}
+			repository, tag, ok := strings.Cut(first, ":")
+			if !ok || repository != "serverless-"+name || !validTag.MatchString(tag) {
+				t.Errorf("buildTag(%s) = %s, want a valid tag of serverless-%s", name, first, name)
+			}
+			if first == functionImage(name) {
+				t.Errorf("buildTag(%s) is the function's image %s", name, first)
+			}
+		})
+	}
+}
+
+func TestDeployCleanupOnFailure(t *testing.T) {
+	const (
+		promote = "docker image tag serverless-hello:build serverless-hello:latest"
+		remove  = "docker image rm serverless-hello:build"
+	)
+	tests := []struct {
+		name         string
+		image        string // Prebuilt image deployed, none to build
+		cleanup      bool
+		registerFail bool
+		want         []string // Image commands run after the build
+	}{
+		{name: "registered", want: []string{promote, remove}},
+		{name: "registered with cleanup", cleanup: true, want: []string{promote, remove}},
+		{name: "failed", registerFail: true},
+		{name: "failed with cleanup", cleanup: true, registerFail: true, want: []string{remove}},
+		{name: "prebuilt image failed with cleanup", image: "registry.example.com/hello:1", cleanup: true, registerFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			commands := fakeCommands(t, buildCommands)
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.registerFail {
+					http.Error(w, "database is locked", http.StatusInternalServerError)
+				}
+			})
+
+			opts := deployOptions{image: tt.image, cleanupOnFail: tt.cleanup}
+			err := deployFunction("hello", opts, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if (err != nil) != tt.registerFail {
+				t.Fatalf("deployFunction = %v, want error %v", err, tt.registerFail)
+			}
+			var got []string
+			for _, command := range commandsRun(t, commands) {
+				if strings.HasPrefix(command, "docker image tag ") || strings.HasPrefix(command, "docker image rm ") {
+					got = append(got, command)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("image commands = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageLabels(t *testing.T) {
+	const revision = "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		name    string
+		git     string // Script of git
+		version string // Given with --version
+		want    map[string]string
+	}{
+		{
+			name: "repository",
+			git:  `[ "$1" = describe ] && echo v1.2.0-3-g0123456; [ "$1" = rev-parse ] && echo ` + revision + `; exit 0`,
+			want: map[string]string{labelFunction: "hello", labelVersion: "v1.2.0-3-g0123456", labelRevision: revision},
+		},
+		{
+			name:    "given version",
+			git:     `[ "$1" = rev-parse ] && echo ` + revision + `; exit 0`,
+			version: "1.2.0",
+			want:    map[string]string{labelFunction: "hello", labelVersion: "1.2.0", labelRevision: revision},
+		},
+		{name: "not a repository", git: "exit 128", want: map[string]string{labelFunction: "hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			fakeCommands(t, map[string]string{"git": tt.git})
+			if got := imageLabels("hello", filepath.Join("functions", "hello"), tt.version); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("labels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployBuildArgs(t *testing.T) {
+	withFunction(t, "hello")
+	scripts := maps.Clone(buildCommands)
+	scripts["git"] = "exit 128"
+	commands := fakeCommands(t, scripts)
+	server := newFakeServer(t, nil)
+
+	opts := deployOptions{buildArgs: []string{"GOPROXY=direct", "VERSION=1.2"}, version: "1.2"}
+	if err := deployFunction("hello", opts, Config{ServerAddr: server.Listener.Addr().String()}, testLogger()); err != nil {
+		t.Fatalf("deployFunction failed: %v", err)
+	}
+	want := "docker build -t serverless-hello:build -f - --build-arg GOPROXY=direct --build-arg VERSION=1.2 " +
+		"--label org.opencontainers.image.version=1.2 --label serverless.function=hello ."
+	built := false
+	for _, command := range commandsRun(t, commands) {
+		built = built || command == want
+	}
+	if !built {
+		t.Errorf("commands run %q, want %q", commandsRun(t, commands), want)
+	}
+
+	if err := deployFunction("hello", deployOptions{buildArgs: []string{"VERSION"}}, Config{ServerAddr: server.Listener.Addr().String()}, testLogger()); err == nil {
+		t.Error("deploying with a build argument without a value succeeded")
+	}
+}
+
+func TestDeployGoModuleEnv(t *testing.T) {
+	withFunction(t, "hello")
+	// Set in the environment, configured, and given as a build argument, the
+	// last winning
+	t.Setenv("GOPROXY", "https://goproxy.acme.com")
+	scripts := maps.Clone(buildCommands)
+	scripts["docker"] = `[ "$1" = image ] && echo sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef; exit 0`
+	scripts["git"] = "exit 128"
+	commands := fakeCommands(t, scripts)
+	server := newFakeServer(t, nil)
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(netrc, []byte("machine github.com login x password y\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := "server_addr: " + server.Listener.Addr().String() + "\n" +
+		"netrc: " + netrc + "\n" +
+		"go_env:\n  GOPRIVATE: \"*.corp.example.com\"\n  GONOSUMDB: \"*.corp.example.com\"\n"
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	log := testLogger()
+	failed := false
+	log.ExitFunc = func(int) { failed = true }
+	rootCmd := &cobra.Command{Use: "serverless"}
+	RegisterCommands(rootCmd, &configFile, log)
+	rootCmd.SetArgs([]string{"deploy", "hello", "--build-arg", "GOPRIVATE=github.com/acme/*,*.corp.example.com"})
+	if err := rootCmd.Execute(); err != nil || failed {
+		t.Fatalf("deploy command failed: %v", err)
+	}
+
+	want := "docker build -t serverless-hello:build -f - " +
+		"--build-arg GONOSUMDB=*.corp.example.com --build-arg GOPRIVATE=github.com/acme/*,*.corp.example.com " +
+		"--build-arg GOPROXY=https://goproxy.acme.com --label serverless.function=hello " +
+		"--secret id=netrc,src=" + netrc + " ."
+	built := false
+	for _, command := range commandsRun(t, commands) {
+		built = built || command == want
+	}
+	if !built {
+		t.Errorf("commands run %q, want %q", commandsRun(t, commands), want)
+	}
+}
+
+func TestDeployPrebuiltImage(t *testing.T) {
+	const (
+		image  = "registry.example.com/hello:1.2"
+		digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	)
+	tests := []struct {
+		name       string
+		docker     string // Script of docker
+		wantDigest any
+	}{
+		{name: "present locally", docker: `[ "$1" = image ] && echo ` + digest + `; exit 0`, wantDigest: digest},
+		{name: "not pulled yet", docker: "exit 1", wantDigest: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The function's sources aren't needed
+			withFunction(t, "other")
+			scripts := maps.Clone(buildCommands)
+			scripts["docker"] = tt.docker
+			commands := fakeCommands(t, scripts)
+			var registered map[string]any
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&registered)
+			})
+
+			err := deployFunction("hello", deployOptions{image: image}, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if err != nil {
+				t.Fatalf("deployFunction failed: %v", err)
+			}
+			if registered["image"] != image || registered["digest"] != tt.wantDigest {
+				t.Errorf("registered image %v (digest %v), want %s (digest %v)", registered["image"], registered["digest"], image, tt.wantDigest)
+			}
+			for _, command := range commandsRun(t, commands) {
+				if command != "docker image inspect --format {{.Id}} "+image {
+					t.Errorf("ran %q, want the prebuilt image only inspected", command)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterCommand(t *testing.T) {
+	const image = "registry.example.com/hello:1.2"
+	tests := []struct {
+		name       string
+		args       []string
+		status     int // Status the server answers with
+		wantVerify any
+		wantFail   bool
+	}{
+		{name: "registered", args: []string{"--image", image}, status: http.StatusOK, wantVerify: false},
+		{name: "verified", args: []string{"--image", image, "--verify"}, status: http.StatusOK, wantVerify: true},
+		{name: "nonexistent image", args: []string{"--image", image, "--verify"}, status: http.StatusUnprocessableEntity, wantVerify: true, wantFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The function's sources aren't needed, nor is anything built
+			withFunction(t, "other")
+			commands := fakeCommands(t, map[string]string{"docker": "exit 1", "go": "exit 1"})
+			var registered map[string]any
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&registered)
+				w.WriteHeader(tt.status)
+			})
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte("server_addr: "+server.Listener.Addr().String()+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			log := testLogger()
+			failed := false
+			log.ExitFunc = func(int) { failed = true }
+			rootCmd := &cobra.Command{Use: "serverless"}
+			RegisterCommands(rootCmd, &configFile, log)
+			rootCmd.SetArgs(append([]string{"register", "hello"}, tt.args...))
+			if err := rootCmd.Execute(); err != nil {
+				t.Fatalf("register command failed: %v", err)
+			}
+
+			if failed != tt.wantFail {
+				t.Errorf("register failed = %v, want %v", failed, tt.wantFail)
+			}
+			if registered["image"] != image || registered["runtime"] != "go" || registered["verify_image"] != tt.wantVerify {
+				t.Errorf("registered %v, want %s verified %v", registered, image, tt.wantVerify)
+			}
+			for _, command := range commandsRun(t, commands) {
+				if !strings.HasPrefix(command, "docker image inspect") {
+					t.Errorf("ran %q, want nothing built", command)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterCommandWithoutImage(t *testing.T) {
+	rootCmd := &cobra.Command{Use: "serverless"}
+	configFile := ""
+	RegisterCommands(rootCmd, &configFile, testLogger())
+	rootCmd.SetArgs([]string{"register", "hello"})
+	rootCmd.SetOut(io.Discard)
+	rootCmd.SetErr(io.Discard)
+	if err := rootCmd.Execute(); err == nil || !strings.Contains(err.Error(), "image") {
+		t.Errorf("register without --image = %v, want the missing flag reported", err)
+	}
+}
+
+func TestSetAlias(t *testing.T) {
+	const (
+		stable = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		canary = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	tests := []struct {
+		name     string
+		pairs    []string
+		weights  []int
+		wantBody string // Body sent to the server, none when the targets are rejected
+	}{
+		{
+			name:     "weighted",
+			pairs:    []string{"hello=" + stable, "hello=" + canary},
+			weights:  []int{90, 10},
+			wantBody: `{"function":"hello","targets":[{"digest":"` + stable + `","weight":90},{"digest":"` + canary + `","weight":10}]}`,
+		},
+		{
+			name:     "single",
+			pairs:    []string{"hello=" + canary},
+			weights:  []int{10},
+			wantBody: `{"function":"hello","targets":[{"digest":"` + canary + `","weight":10}]}`,
+		},
+		{
+			name:     "even",
+			pairs:    []string{"hello=" + stable, "hello=" + canary},
+			wantBody: `{"function":"hello","targets":[{"digest":"` + stable + `","weight":1},{"digest":"` + canary + `","weight":1}]}`,
+		},
+		{name: "weight count", pairs: []string{"hello=" + stable, "hello=" + canary}, weights: []int{10}},
+		{name: "two functions", pairs: []string{"hello=" + stable, "other=" + canary}},
+		{name: "no digest", pairs: []string{"hello"}},
+		{name: "negative weight", pairs: []string{"hello=" + stable}, weights: []int{-1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ = io.ReadAll(r.Body)
+				w.Write([]byte(`{}`))
+			})
+
+			_, err := setAlias("prod", tt.pairs, tt.weights, Config{ServerAddr: server.Listener.Addr().String()})
+			if (err != nil) != (tt.wantBody == "") {
+				t.Fatalf("setAlias = %v, want error %v", err, tt.wantBody == "")
+			}
+			if tt.wantBody == "" {
+				if requests := server.received(); len(requests) != 0 {
+					t.Errorf("requests = %q, want none for rejected targets", requests)
+				}
+				return
+			}
+			if requests := server.received(); len(requests) != 1 || requests[0] != "PUT /aliases/prod" {
+				t.Errorf("requests = %q, want PUT /aliases/prod", requests)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("body = %s, want %s", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSetFunctionConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		pairs    []string
+		status   int    // Status the server answers with
+		wantBody string // Body sent to the server, none when the fields are rejected
+		wantErr  bool
+	}{
+		{name: "number", pairs: []string{"memory_bytes=268435456"}, wantBody: `{"memory_bytes":268435456}`},
+		{name: "string", pairs: []string{"user=app"}, wantBody: `{"user":"app"}`},
+		{name: "quoted string", pairs: []string{`user="1000:1000"`}, wantBody: `{"user":"1000:1000"}`},
+		{name: "object", pairs: []string{`env={"DEBUG":"1"}`}, wantBody: `{"env":{"DEBUG":"1"}}`},
+		{name: "value with equals", pairs: []string{"args=a=b"}, wantBody: `{"args":"a=b"}`},
+		{name: "several", pairs: []string{"max_retries=3", "readonly_rootfs=true"}, wantBody: `{"max_retries":3,"readonly_rootfs":true}`},
+		{name: "no value", pairs: []string{"user"}, wantErr: true},
+		{name: "no field", pairs: []string{"=app"}, wantErr: true},
+		{name: "rejected", pairs: []string{"timeout=60"}, status: http.StatusBadRequest, wantBody: `{"timeout":60}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ = io.ReadAll(r.Body)
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				w.Write([]byte(`{"name":"hello"}`))
+			})
+
+			_, err := setFunctionConfig("hello", tt.pairs, Config{ServerAddr: server.Listener.Addr().String()})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setFunctionConfig = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantBody == "" {
+				if requests := server.received(); len(requests) != 0 {
+					t.Errorf("requests = %q, want none for rejected fields", requests)
+				}
+				return
+			}
+			if requests := server.received(); len(requests) != 1 || requests[0] != "PATCH /functions/hello" {
+				t.Errorf("requests = %q, want PATCH /functions/hello", requests)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("body = %s, want %s", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestInvokeRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int // Status of each response, the last one repeated
+		retries      int
+		wantAttempts int
+		wantErr      bool
+		minElapsed   time.Duration // Least backoff the retries must have waited
+	}{
+		{
+			name:         "fails twice then succeeds",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK},
+			retries:      3,
+			wantAttempts: 3,
+			minElapsed:   invokeRetryBase/2 + invokeRetryBase,
+		},
+		{name: "gateway timeout", statuses: []int{http.StatusGatewayTimeout, http.StatusOK}, retries: 1, wantAttempts: 2, minElapsed: invokeRetryBase / 2},
+		{name: "retries exhausted", statuses: []int{http.StatusServiceUnavailable}, retries: 2, wantAttempts: 3, wantErr: true},
+		{name: "opt-in", statuses: []int{http.StatusServiceUnavailable, http.StatusOK}, wantAttempts: 1, wantErr: true},
+		{name: "bad request", statuses: []int{http.StatusBadRequest, http.StatusOK}, retries: 3, wantAttempts: 1, wantErr: true},
+		{name: "not found", statuses: []int{http.StatusNotFound, http.StatusOK}, retries: 3, wantAttempts: 1, wantErr: true},
+		{name: "too many requests", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, retries: 3, wantAttempts: 1, wantErr: true},
+		{name: "function error", statuses: []int{http.StatusInternalServerError, http.StatusOK}, retries: 3, wantAttempts: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				status := tt.statuses[min(attempts, len(tt.statuses)-1)]
+				attempts++
+				mu.Unlock()
+				w.WriteHeader(status)
+				w.Write([]byte(`{"ok":true}`))
+			})
+			opts := invokeOptions{retries: tt.retries}
+
+			start := time.Now()
+			got, err := invokeFunction(context.Background(), "hello", `{}`, opts, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			elapsed := time.Since(start)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("invokeFunction = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != `{"ok":true}` {
+				t.Errorf("result = %q, want the successful response", got)
+			}
+			if len(server.received()) != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", len(server.received()), tt.wantAttempts)
+			}
+			if elapsed < tt.minElapsed {
+				t.Errorf("retried after %s, want a backoff of at least %s", elapsed, tt.minElapsed)
+			}
+		})
+	}
+}
+
+func TestInvokeRetriesUnreachable(t *testing.T) {
+	// A closed server refuses connections, which are retried like 503s
+	server := newFakeServer(t, nil)
+	addr := server.Listener.Addr().String()
+	server.Close()
+
+	start := time.Now()
+	_, err := invokeFunction(context.Background(), "hello", `{}`, invokeOptions{retries: 1}, Config{ServerAddr: addr}, testLogger())
+	if err == nil {
+		t.Fatal("invokeFunction succeeded against a closed server")
+	}
+	if elapsed := time.Since(start); elapsed < invokeRetryBase/2 {
+		t.Errorf("gave up after %s, want a retry after at least %s", elapsed, invokeRetryBase/2)
+	}
+}
+
+func TestInvokeRetryDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		attempt    int
+		retryAfter string
+		min, max   time.Duration
+	}{
+		{name: "first", attempt: 0, min: invokeRetryBase / 2, max: invokeRetryBase},
+		{name: "doubled", attempt: 2, min: 2 * invokeRetryBase, max: 4 * invokeRetryBase},
+		{name: "capped", attempt: 20, min: invokeRetryMax / 2, max: invokeRetryMax},
+		{name: "beyond the shift cap", attempt: 37, min: invokeRetryMax / 2, max: invokeRetryMax},
+		{name: "huge", attempt: 1000, min: invokeRetryMax / 2, max: invokeRetryMax},
+		{name: "retry after", attempt: 0, retryAfter: "3", min: 3 * time.Second, max: 3 * time.Second},
+		{name: "shorter retry after", attempt: 20, retryAfter: "1", min: invokeRetryMax / 2, max: invokeRetryMax},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tt.retryAfter != "" {
+				resp.Header.Set("Retry-After", tt.retryAfter)
+			}
+			// Jitter makes every delay differ, all must stay within the bounds
+			for range 100 {
+				if delay := invokeRetryDelay(tt.attempt, resp); delay < tt.min || delay > tt.max {
+					t.Fatalf("delay = %s, want between %s and %s", delay, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestInvokeCompression(t *testing.T) {
+	tests := []struct {
+		name         string
+		event        string
+		wantEncoding string // Content-Encoding of the request
+	}{
+		{name: "small event", event: `{"a":1}`},
+		{name: "large event", event: `{"data":"` + strings.Repeat("x", compressThreshold) + `"}`, wantEncoding: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+					t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+				}
+				body := io.Reader(r.Body)
+				if tt.wantEncoding == "gzip" {
+					gz, err := gzip.NewReader(r.Body)
+					if err != nil {
+						t.Errorf("event isn't gzip: %v", err)
+						return
+					}
+					body = gz
+				}
+				event, _ := io.ReadAll(body)
+				if string(event) != tt.event {
+					t.Errorf("server received %d bytes, want the %d byte event", len(event), len(tt.event))
+				}
+
+				// Echo the event compressed, if the client accepts it
+				if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+					t.Error("client doesn't accept gzip responses")
+					w.Write(event)
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				gz.Write(event)
+				gz.Close()
+			})
+
+			got, err := invokeFunction(context.Background(), "hello", tt.event, invokeOptions{}, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if err != nil {
+				t.Fatalf("invokeFunction failed: %v", err)
+			}
+			if got != tt.event {
+				t.Errorf("result has %d bytes, want the %d byte response decompressed", len(got), len(tt.event))
+			}
+		})
+	}
+}
+
+func TestParseUploads(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    []upload
+		wantErr bool
+	}{
+		{name: "none", values: nil, want: []upload{}},
+		{name: "one", values: []string{"doc=@report.txt"}, want: []upload{{Field: "doc", Path: "report.txt"}}},
+		{
+			name:   "several, = in the path",
+			values: []string{"a=@x.png", "b=@dir/y=1.png"},
+			want:   []upload{{Field: "a", Path: "x.png"}, {Field: "b", Path: "dir/y=1.png"}},
+		},
+		{name: "no @", values: []string{"doc=report.txt"}, wantErr: true},
+		{name: "no path", values: []string{"doc=@"}, wantErr: true},
+		{name: "no field", values: []string{"=@report.txt"}, wantErr: true},
+		{name: "no =", values: []string{"@report.txt"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseUploads(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseUploads(%q) error = %v, want error %v", tt.values, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseUploads(%q) = %+v, want %+v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvokeUploads(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"a.txt": "first", "b.bin": strings.Repeat("x", compressThreshold)}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Encoding"); got != "" {
+			t.Errorf("Content-Encoding = %q, uploads aren't compressed", got)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("body isn't multipart/form-data: %v", err)
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+		var got []string
+		for field, headers := range r.MultipartForm.File {
+			for _, header := range headers {
+				file, _ := header.Open()
+				content, _ := io.ReadAll(file)
+				file.Close()
+				if string(content) != files[header.Filename] {
+					t.Errorf("%s has %d bytes, want %d", header.Filename, len(content), len(files[header.Filename]))
+				}
+				got = append(got, field+"="+header.Filename)
+			}
+		}
+		slices.Sort(got)
+		if want := []string{"doc=a.txt", "doc=b.bin"}; !slices.Equal(got, want) {
+			t.Errorf("uploaded %q, want %q", got, want)
+		}
+		w.Write([]byte(`{"ok":true}`))
+	})
+
+	opts := invokeOptions{uploads: []string{
+		"doc=@" + filepath.Join(dir, "a.txt"),
+		"doc=@" + filepath.Join(dir, "b.bin"),
+	}}
+	got, err := invokeFunction(context.Background(), "hello", "", opts, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+	if err != nil {
+		t.Fatalf("invokeFunction failed: %v", err)
+	}
+	if got != `{"ok":true}` {
+		t.Errorf("result = %q, want the response", got)
+	}
+
+	// A missing file fails before anything is sent
+	if _, _, err := uploadBody([]string{"doc=@" + filepath.Join(dir, "missing.txt")}); err == nil {
+		t.Error("uploadBody of a missing file succeeded")
+	}
+}
+
+func TestInvokeAll(t *testing.T) {
+	tests := []struct {
+		name       string
+		selector   []string
+		status     int
+		body       string
+		wantQuery  string
+		wantFailed int
+		wantErr    bool
+	}{
+		{
+			name:      "all succeed",
+			selector:  []string{"group=cron"},
+			status:    http.StatusOK,
+			body:      `{"results":{"a":{"status":200},"b":{"status":200}}}`,
+			wantQuery: "label=group%3Dcron",
+		},
+		{
+			name:       "partial failure",
+			selector:   []string{"group=cron", "team=b"},
+			status:     http.StatusOK,
+			body:       `{"results":{"a":{"status":200},"b":{"status":500,"error":"boom"},"c":{"status":422}}}`,
+			wantQuery:  "label=group%3Dcron&label=team%3Db",
+			wantFailed: 2,
+		},
+		{name: "no match", selector: []string{"group=none"}, status: http.StatusNotFound, body: "No functions match", wantQuery: "label=group%3Dnone", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.RawQuery
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			_, failed, err := invokeAll(context.Background(), tt.selector, `{}`, Config{ServerAddr: server.Listener.Addr().String()})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("invokeAll = %v, want error %v", err, tt.wantErr)
+			}
+			if query != tt.wantQuery {
+				t.Errorf("query = %q, want %q", query, tt.wantQuery)
+			}
+			if failed != tt.wantFailed {
+				t.Errorf("%d failed, want %d", failed, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestRestoreFunction(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "restored", status: http.StatusOK},
+		{name: "not deleted", status: http.StatusNotFound, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"name":"hello"}`))
+			})
+
+			_, err := restoreFunction("hello", Config{ServerAddr: server.Listener.Addr().String()})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("restoreFunction = %v, want error %v", err, tt.wantErr)
+			}
+			if requests := server.received(); len(requests) != 1 || requests[0] != "POST /functions/hello/restore" {
+				t.Errorf("requests = %q, want POST /functions/hello/restore", requests)
+			}
+		})
+	}
+}
+
+func TestListFunctions(t *testing.T) {
+	tests := []struct {
+		name           string
+		includeDeleted bool
+		wantQuery      string
+	}{
+		{name: "deployed"},
+		{name: "including deleted", includeDeleted: true, wantQuery: "include_deleted=true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.RawQuery
+				w.Write([]byte(`[]`))
+			})
+
+			if _, err := listFunctions(tt.includeDeleted, Config{ServerAddr: server.Listener.Addr().String()}); err != nil {
+				t.Fatalf("listFunctions failed: %v", err)
+			}
+			if requests := server.received(); len(requests) != 1 || requests[0] != "GET /functions" {
+				t.Errorf("requests = %q, want GET /functions", requests)
+			}
+			if query != tt.wantQuery {
+				t.Errorf("query = %q, want %q", query, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestSecretValues(t *testing.T) {
+	t.Setenv("SERVERLESS_TEST_TOKEN", "from-env")
+	tests := []struct {
+		name    string
+		flags   []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "none", want: map[string]string{}},
+		{name: "value", flags: []string{"API_TOKEN=s3cr3t"}, want: map[string]string{"API_TOKEN": "s3cr3t"}},
+		{name: "value with equals", flags: []string{"DSN=user=app"}, want: map[string]string{"DSN": "user=app"}},
+		{name: "empty value", flags: []string{"API_TOKEN="}, want: map[string]string{"API_TOKEN": ""}},
+		{name: "from environment", flags: []string{"SERVERLESS_TEST_TOKEN"}, want: map[string]string{"SERVERLESS_TEST_TOKEN": "from-env"}},
+		{name: "unset in environment", flags: []string{"SERVERLESS_TEST_UNSET"}, wantErr: true},
+		{name: "no name", flags: []string{"=s3cr3t"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := secretValues(tt.flags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("secretValues = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !maps.Equal(got, tt.want) {
+				t.Errorf("secrets = %v, want %v", got, tt.want)
+			}
+			if err != nil && strings.Contains(err.Error(), "s3cr3t") {
+				t.Errorf("error %q holds the secret value", err)
+			}
+		})
+	}
+}
+
+func TestListContainers(t *testing.T) {
+	server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"id":"0123456789abcdef0123","function":"hello","invocation":"inv-1","state":"running","age_seconds":90},
+			{"id":"short","function":"other","state":"created","age_seconds":3600}
+		]`))
+	})
+
+	var out strings.Builder
+	if err := listContainers(&out, Config{ServerAddr: server.Listener.Addr().String()}); err != nil {
+		t.Fatalf("listContainers failed: %v", err)
+	}
+	want := "CONTAINER ID   FUNCTION   INVOCATION   STATE     AGE\n" +
+		"0123456789ab   hello      inv-1        running   About a minute\n" +
+		"short          other                   created   About an hour\n"
+	if out.String() != want {
+		t.Errorf("table =\n%s\nwant\n%s", out.String(), want)
+	}
+	if requests := server.received(); len(requests) != 1 || requests[0] != "GET /containers" {
+		t.Errorf("requests = %q, want GET /containers", requests)
+	}
+}
+
+func TestListAuditEvents(t *testing.T) {
+	tests := []struct {
+		name      string
+		function  string
+		limit     int
+		wantQuery string
+	}{
+		{name: "all functions", limit: 50, wantQuery: "limit=50"},
+		{name: "one function", function: "hello", limit: 10, wantQuery: "function=hello&limit=10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.RawQuery
+				w.Write([]byte(`[
+					{"time":"2026-10-16T10:00:00Z","function":"hello","action":"update","actor":"alice","details":"max_retries"},
+					{"time":"2026-10-16T09:00:00Z","function":"hello","action":"deploy","details":"hello:1"}
+				]`))
+			})
+
+			var out bytes.Buffer
+			if err := listAuditEvents(&out, tt.function, tt.limit, Config{ServerAddr: server.Listener.Addr().String()}); err != nil {
+				t.Fatalf("listAuditEvents failed: %v", err)
+			}
+			if requests := server.received(); len(requests) != 1 || requests[0] != "GET /audit" {
+				t.Errorf("requests = %q, want GET /audit", requests)
+			}
+			if query != tt.wantQuery {
+				t.Errorf("query = %q, want %q", query, tt.wantQuery)
+			}
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if len(lines) != 3 || !strings.HasPrefix(lines[0], "TIME") {
+				t.Fatalf("output = %q, want a header and 2 events", out.String())
+			}
+			if fields := strings.Fields(lines[1]); len(fields) != 6 || fields[4] != "alice" || fields[5] != "max_retries" {
+				t.Errorf("first event = %q, want hello updated by alice", lines[1])
+			}
+			if fields := strings.Fields(lines[2]); len(fields) != 6 || fields[4] != "-" {
+				t.Errorf("second event = %q, want - for the missing actor", lines[2])
+			}
+		})
+	}
+}
+
+func TestImageSizeLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    string
+		config  string
+		want    int64
+		wantErr string // Part of the error, empty for success
+	}{
+		{name: "no limit"},
+		{name: "configured", config: "500MB", want: 500_000_000},
+		{name: "flag wins", flag: "1GB", config: "500MB", want: 1_000_000_000},
+		{name: "flag disables", flag: "0", config: "500MB"},
+		{name: "invalid configuration", config: "big", wantErr: "invalid max_image_size"},
+		{name: "invalid flag", flag: "-5MB", wantErr: "invalid --max-image-size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := imageSizeLimit(deployOptions{maxImageSize: tt.flag}, Config{MaxImageSize: tt.config})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("imageSizeLimit = %d, %v, want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("imageSizeLimit = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckImageSize(t *testing.T) {
+	fakeCommands(t, map[string]string{"docker": "echo 734003200"})
+
+	if err := checkImageSize("serverless-hello:build-1", 1_000_000_000); err != nil {
+		t.Errorf("checkImageSize within the limit = %v", err)
+	}
+	err := checkImageSize("serverless-hello:build-1", 500_000_000)
+	if err == nil || !strings.Contains(err.Error(), "larger than the limit of 500MB") || !strings.Contains(err.Error(), "multi-stage") {
+		t.Errorf("checkImageSize over the limit = %v, want an error with the limit and advice", err)
+	}
+}
@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+)
+
+// actorHeader tells the server who makes a change, for its audit log.
+const actorHeader = "X-Actor"
+
+// newHTTPClient returns the client of the server's API, using TLS with
+// tlsConfig if it isn't nil. Requests name the actor, see currentActor.
+func newHTTPClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: actorTransport{base: transport, actor: currentActor()}}
+}
+
+// newTLSConfig returns the TLS configuration of connections to the server,
+// nil when it doesn't use TLS. Its certificate is trusted besides the
+// system's CAs, so a self-signed one works without skipping verification;
+// insecure skips it altogether.
+func newTLSConfig(config Config, insecure bool) (*tls.Config, error) {
+	if config.TLSCert == "" && !insecure {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+	if config.TLSCert != "" && !insecure {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		cert, err := os.ReadFile(config.TLSCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS certificate: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(cert) {
+			return nil, fmt.Errorf("no PEM certificate found in %s", config.TLSCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// currentActor returns who runs the CLI: $SERVERLESS_ACTOR, e.g. set by a CI
+// pipeline, or else the name of the user.
+func currentActor() string {
+	if actor := os.Getenv("SERVERLESS_ACTOR"); actor != "" {
+		return actor
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return ""
+}
+
+// actorTransport names the actor on every request.
+type actorTransport struct {
+	base  http.RoundTripper
+	actor string
+}
+
+// RoundTrip sends the request with the actor header, unless it has one.
+func (t actorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.actor == "" || req.Header.Get(actorHeader) != "" {
+		return t.base.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set(actorHeader, t.actor)
+	return t.base.RoundTrip(req)
+}
+
+// client returns the client of the server's API.
+func (c Config) client() *http.Client {
+	if c.httpClient != nil {
+		return c.httpClient
+	}
+	return http.DefaultClient
+}
+
+// url returns the URL of a path of the server's API, using HTTPS when the
+// server has a TLS certificate, or its certificate isn't verified.
+func (c Config) url(path string) string {
+	scheme := "http"
+	if c.TLSCert != "" || c.Insecure {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, c.ServerAddr, path)
+}
@@ -0,0 +1,183 @@
+package cli
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// writeCertificate writes a DER certificate to a PEM file.
+func writeCertificate(t *testing.T, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// selfSignedCertificate returns a self-signed certificate for 127.0.0.1,
+// unrelated to the one of TLS test servers.
+func selfSignedCertificate(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "serverless test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	return der
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer server.Close()
+	other := writeCertificate(t, selfSignedCertificate(t))
+
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		cert          string // Certificate file trusted by the CLI
+		insecure      bool
+		wantClientErr bool
+		wantErr       bool
+	}{
+		{name: "server certificate", cert: writeCertificate(t, server.Certificate().Raw)},
+		{name: "other certificate", cert: other, wantErr: true},
+		{name: "other certificate, insecure", cert: other, insecure: true},
+		{name: "no certificate, insecure", insecure: true},
+		{name: "plain HTTP to an HTTPS server", wantErr: true},
+		{name: "missing certificate", cert: filepath.Join(t.TempDir(), "missing.pem"), wantClientErr: true},
+		{name: "not a certificate", cert: invalid, wantClientErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{ServerAddr: server.Listener.Addr().String(), TLSCert: tt.cert, Insecure: tt.insecure}
+			tlsConfig, err := newTLSConfig(config, config.Insecure)
+			if (err != nil) != tt.wantClientErr {
+				t.Fatalf("newTLSConfig = %v, want error %v", err, tt.wantClientErr)
+			}
+			if err != nil {
+				return
+			}
+			config.httpClient = newHTTPClient(tlsConfig)
+
+			_, err = serverRequest(http.MethodGet, "/status", config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("serverRequest = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigURL(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{name: "plain HTTP", config: Config{ServerAddr: "localhost:8080"}, want: "http://localhost:8080/functions"},
+		{name: "HTTPS", config: Config{ServerAddr: "localhost:8443", TLSCert: "cert.pem"}, want: "https://localhost:8443/functions"},
+		{name: "HTTPS, insecure", config: Config{ServerAddr: "localhost:8443", Insecure: true}, want: "https://localhost:8443/functions"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.url("/functions"); got != tt.want {
+				t.Errorf("url = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActorHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		envActor  string
+		header    string // Set on the request already
+		wantActor string
+	}{
+		{name: "from the environment", envActor: "ci-pipeline", wantActor: "ci-pipeline"},
+		{name: "set by the request", envActor: "ci-pipeline", header: "alice", wantActor: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SERVERLESS_ACTOR", tt.envActor)
+			var actor string
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				actor = r.Header.Get(actorHeader)
+			})
+			client := newHTTPClient(nil)
+
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/functions", nil)
+			if tt.header != "" {
+				req.Header.Set(actorHeader, tt.header)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if actor != tt.wantActor {
+				t.Errorf("actor = %q, want %q", actor, tt.wantActor)
+			}
+			if tt.header != "" && req.Header.Get(actorHeader) != tt.header {
+				t.Error("the request was modified")
+			}
+		})
+	}
+}
+
+func TestInsecureFlag(t *testing.T) {
+	requests := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte("server_addr: "+server.Listener.Addr().String()+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a certificate, --insecure alone reaches the server over HTTPS
+	log := testLogger()
+	failed := false
+	log.ExitFunc = func(int) { failed = true }
+	rootCmd := &cobra.Command{Use: "serverless"}
+	RegisterCommands(rootCmd, &configFile, log)
+	rootCmd.SetArgs([]string{"list", "--insecure"})
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if failed || requests != 1 {
+		t.Errorf("list failed = %v with %d requests, want it to list over HTTPS", failed, requests)
+	}
+}
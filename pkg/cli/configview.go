@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// outputYAML is the default output format of config view, which also
+// writes outputJSON.
+const outputYAML = "yaml"
+
+// viewConfig writes the effective configuration in format, yaml or json: the
+// defaults, overridden by the configuration file with its environment
+// variable references expanded, overridden by the flags the caller applied.
+// The Go module settings are those of builds, see goModuleEnv. Credentials in
+// URLs are redacted.
+func viewConfig(out io.Writer, config Config, format string) error {
+	goEnv, err := goModuleEnv(config)
+	if err != nil {
+		return err
+	}
+	config.GoEnv = goEnv
+	data, err := yaml.Marshal(redactConfig(config))
+	if err != nil {
+		return fmt.Errorf("failed to encode configuration: %v", err)
+	}
+	switch format {
+	case outputYAML:
+		_, err = out.Write(data)
+		return err
+	case outputJSON:
+		var view map[string]any
+		if err := yaml.Unmarshal(data, &view); err != nil {
+			return fmt.Errorf("failed to encode configuration: %v", err)
+		}
+		encoded, err := json.MarshalIndent(jsonValue(view), "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode configuration: %v", err)
+		}
+		_, err = fmt.Fprintln(out, string(encoded))
+		return err
+	default:
+		return fmt.Errorf("invalid output format %q, expected %s or %s", format, outputYAML, outputJSON)
+	}
+}
+
+// redactConfig returns a copy of the configuration with the passwords of the
+// URLs it holds, e.g. of a module proxy, redacted.
+func redactConfig(config Config) Config {
+	config.ServerAddr = redactURLs(config.ServerAddr)
+	config.GoEnv = maps.Clone(config.GoEnv)
+	for name, value := range config.GoEnv {
+		config.GoEnv[name] = redactURLs(value)
+	}
+	return config
+}
+
+// redactURLs redacts the passwords of the URLs in a value, which may be a
+// list of them separated by commas or pipes, as GOPROXY is. Anything that
+// isn't a URL with a password is left intact.
+func redactURLs(value string) string {
+	var b strings.Builder
+	start := 0
+	for i := 0; i <= len(value); i++ {
+		if i < len(value) && value[i] != ',' && value[i] != '|' {
+			continue
+		}
+		element := value[start:i]
+		if u, err := url.Parse(element); err == nil && u.User != nil {
+			element = u.Redacted()
+		}
+		b.WriteString(element)
+		if i < len(value) {
+			b.WriteByte(value[i])
+		}
+		start = i + 1
+	}
+	return b.String()
+}
+
+// jsonValue converts a value decoded from YAML to one encoding/json
+// accepts, whose maps are keyed by strings.
+func jsonValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = jsonValue(item)
+		}
+		return v
+	case map[any]any:
+		converted := make(map[string]any, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return converted
+	case []any:
+		for i, item := range v {
+			v[i] = jsonValue(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// localFunctions returns the names of the functions in the functions
+// directory, sorted.
+func localFunctions() ([]string, error) {
+	entries, err := os.ReadDir("functions")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list functions: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// functionDependencies reads the depends_on of the manifests of functions,
+// keyed by function. Every dependency must be one of the functions.
+func functionDependencies(names []string) (map[string][]string, error) {
+	dependencies := make(map[string][]string, len(names))
+	for _, name := range names {
+		m, err := loadManifest(filepath.Join("functions", name))
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			dependencies[name] = m.DependsOn
+		}
+	}
+	for _, name := range names {
+		for _, dependency := range dependencies[name] {
+			if !slices.Contains(names, dependency) {
+				return nil, fmt.Errorf("function %s depends on %s, which isn't in functions/", name, dependency)
+			}
+		}
+	}
+	return dependencies, nil
+}
+
+// deployOrder sorts functions so each comes after the functions it depends
+// on, otherwise keeping them in alphabetical order. A dependency cycle fails
+// the sort, naming the functions in it.
+func deployOrder(names []string, dependencies map[string][]string) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(names))
+	order := make([]string, 0, len(names))
+	var path []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			cycle := slices.Concat(path[slices.Index(path, name):], []string{name})
+			return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+		state[name] = visiting
+		path = append(path, name)
+		dependsOn := slices.Clone(dependencies[name])
+		slices.Sort(dependsOn)
+		for _, dependency := range dependsOn {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+		order = append(order, name)
+		return nil
+	}
+
+	sorted := slices.Clone(names)
+	slices.Sort(sorted)
+	for _, name := range sorted {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// deployAll deploys every function in the functions directory, each after
+// the functions it depends on. The first failure stops the deploy, as the
+// functions depending on the failed one can't be deployed.
+func deployAll(opts deployOptions, config Config, log *logrus.Logger) error {
+	names, err := localFunctions()
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no functions in functions/")
+	}
+	dependencies, err := functionDependencies(names)
+	if err != nil {
+		return err
+	}
+	order, err := deployOrder(names, dependencies)
+	if err != nil {
+		return err
+	}
+
+	log.WithField("order", order).Info("Deploying all functions")
+	for _, name := range order {
+		if err := deployFunction(name, opts, config, log); err != nil {
+			return fmt.Errorf("failed to deploy %s: %v", name, err)
+		}
+		log.WithField("function", name).Info("Function deployed successfully")
+	}
+	return nil
+}
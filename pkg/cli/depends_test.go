@@ -0,0 +1,146 @@
+package cli
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withFunctions changes to a workspace with the sources of functions, each
+// with the manifest given, none when empty.
+func withFunctions(t *testing.T, manifests map[string]string) {
+	t.Helper()
+	names := slices.Sorted(maps.Keys(manifests))
+	withFunction(t, names[0])
+	for _, name := range names {
+		dir := filepath.Join("functions", name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if manifests[name] != "" {
+			writeManifest(t, dir, manifests[name])
+		}
+	}
+}
+
+func TestDeployOrder(t *testing.T) {
+	tests := []struct {
+		name         string
+		names        []string
+		dependencies map[string][]string
+		want         []string
+		wantErr      string // Part of the error, empty for success
+	}{
+		{name: "independent", names: []string{"c", "a", "b"}, want: []string{"a", "b", "c"}},
+		{
+			name:         "chain",
+			names:        []string{"api", "db", "web"},
+			dependencies: map[string][]string{"api": {"db"}, "web": {"api"}},
+			want:         []string{"db", "api", "web"},
+		},
+		{
+			name:         "diamond",
+			names:        []string{"app", "auth", "cache", "db"},
+			dependencies: map[string][]string{"app": {"cache", "auth"}, "auth": {"db"}, "cache": {"db"}},
+			want:         []string{"db", "auth", "cache", "app"},
+		},
+		{
+			name:         "cycle",
+			names:        []string{"a", "b", "c"},
+			dependencies: map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}},
+			wantErr:      "dependency cycle: a -> b -> c -> a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := deployOrder(tt.names, tt.dependencies)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("deployOrder = %q, %v, want an error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(got, tt.want) {
+				t.Errorf("deployOrder = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFunctionDependencies(t *testing.T) {
+	withFunctions(t, map[string]string{
+		"api": "runtime: go\ndepends_on: [db]\n",
+		"db":  "runtime: go\n",
+		"web": "",
+	})
+	got, err := functionDependencies([]string{"api", "db", "web"})
+	if err != nil {
+		t.Fatalf("functionDependencies failed: %v", err)
+	}
+	if len(got) != 2 || !slices.Equal(got["api"], []string{"db"}) || len(got["db"]) != 0 {
+		t.Errorf("dependencies = %q, want api on db", got)
+	}
+
+	writeManifest(t, filepath.Join("functions", "web"), "depends_on: [cache]\n")
+	if _, err := functionDependencies([]string{"api", "db", "web"}); err == nil || !strings.Contains(err.Error(), "web depends on cache") {
+		t.Errorf("functionDependencies with an unknown dependency = %v, want an error naming it", err)
+	}
+}
+
+func TestDeployAll(t *testing.T) {
+	withFunctions(t, map[string]string{
+		"api": "runtime: go\ndepends_on: [db]\n",
+		"db":  "runtime: go\n",
+		"web": "runtime: go\ndepends_on: [api]\n",
+	})
+	fakeCommands(t, buildCommands)
+	var mu sync.Mutex
+	var deployed []string
+	server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var function struct{ Name string }
+		if r.Method == http.MethodPost && r.URL.Path == "/functions" && json.NewDecoder(r.Body).Decode(&function) == nil {
+			mu.Lock()
+			deployed = append(deployed, function.Name)
+			mu.Unlock()
+		}
+	})
+
+	if err := deployAll(deployOptions{}, Config{ServerAddr: server.Listener.Addr().String()}, testLogger()); err != nil {
+		t.Fatalf("deployAll failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"db", "api", "web"}; !slices.Equal(deployed, want) {
+		t.Errorf("deployed %q, want %q", deployed, want)
+	}
+}
+
+func TestValidateDependsOn(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "api")
+	tests := []struct {
+		dependsOn []string
+		want      string // Problem reported, empty for none
+	}{
+		{dependsOn: []string{"db"}},
+		{dependsOn: []string{"api"}, want: "depends_on: a function can't depend on itself"},
+		{dependsOn: []string{""}, want: `depends_on: invalid function name ""`},
+		{dependsOn: []string{"../db"}, want: `depends_on: invalid function name "../db"`},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.dependsOn, ","), func(t *testing.T) {
+			problems := (&manifest{DependsOn: tt.dependsOn}).validate(dir)
+			if tt.want == "" && len(problems) > 0 || tt.want != "" && !slices.Contains(problems, tt.want) {
+				t.Errorf("problems = %q, want %q", problems, tt.want)
+			}
+		})
+	}
+}
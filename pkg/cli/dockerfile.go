@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dockerfileName is the name of a function's own Dockerfile, used instead of
+// the generated one when present.
+const dockerfileName = "Dockerfile"
+
+// functionDockerfile returns the absolute path of the Dockerfile a function
+// is built with, as docker build runs in the function's directory: the one
+// given with --dockerfile, or else the one in its directory. An empty path
+// means the function has none, and the generated one is used.
+func functionDockerfile(functionDir, override string) (string, error) {
+	if override != "" {
+		if _, err := os.Stat(override); err != nil {
+			return "", fmt.Errorf("failed to read Dockerfile: %v", err)
+		}
+		return filepath.Abs(override)
+	}
+
+	path := filepath.Join(functionDir, dockerfileName)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read Dockerfile: %v", err)
+	}
+	// Deploys used to write the generated Dockerfile into the function's
+	// directory, and a leftover one isn't the function's own
+	if bytes.HasPrefix(content, []byte(generatedDockerfilePrefix())) {
+		return "", nil
+	}
+	return filepath.Abs(path)
+}
+
+// generatedDockerfilePrefix returns the start of every generated Dockerfile,
+// up to the base image, which varies.
+func generatedDockerfilePrefix() string {
+	head, _, _ := strings.Cut(dockerfileTemplate, "FROM %s\nCOPY")
+	return fmt.Sprintf(head, goBuilderImage)
+}
+
+// checkDockerfile makes sure the image a Dockerfile builds runs something:
+// its final stage must set an ENTRYPOINT or CMD, which gets the event on
+// stdin and writes the result to stdout. Functions that set their own
+// entrypoint at deploy time don't need one.
+func checkDockerfile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read Dockerfile: %v", err)
+	}
+	defer file.Close()
+
+	// Only instructions after the last FROM describe the final image; lines
+	// continued with a backslash don't start an instruction
+	stages, runs := 0, false
+	continued := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		isContinuation := continued
+		continued = strings.HasSuffix(line, "\\")
+		if isContinuation || line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		instruction, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(instruction) {
+		case "FROM":
+			stages++
+			runs = false
+		case "ENTRYPOINT", "CMD":
+			runs = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read Dockerfile: %v", err)
+	}
+
+	if stages == 0 {
+		return fmt.Errorf("invalid Dockerfile %s: no FROM instruction", path)
+	}
+	if !runs {
+		return fmt.Errorf("invalid Dockerfile %s: the final stage needs an ENTRYPOINT or CMD that reads the event "+
+			"from stdin and writes the result to stdout, or deploy with --entrypoint", path)
+	}
+	return nil
+}
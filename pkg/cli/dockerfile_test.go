@@ -0,0 +1,129 @@
+package cli
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFunctionDockerfile(t *testing.T) {
+	tests := []struct {
+		name     string
+		own      string // Content of the function's Dockerfile, none when empty
+		override string // Given with --dockerfile, relative to the workspace
+		want     string // Relative to the workspace
+		wantErr  bool
+	}{
+		{name: "generated"},
+		{name: "own", own: "FROM python:3.12\nCMD [\"python\", \"main.py\"]\n", want: "functions/hello/Dockerfile"},
+		{name: "leftover generated", own: fmt.Sprintf(dockerfileTemplate, goBuilderImage, defaultBaseImage)},
+		{name: "override", own: "FROM python:3.12\n", override: "build/Dockerfile.prod", want: "build/Dockerfile.prod"},
+		{name: "missing override", override: "build/Dockerfile.missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			functionDir := filepath.Join("functions", "hello")
+			if tt.own != "" {
+				writeFile(t, filepath.Join(functionDir, dockerfileName), tt.own)
+			}
+			if err := os.Mkdir("build", 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeFile(t, filepath.Join("build", "Dockerfile.prod"), "FROM alpine\n")
+
+			got, err := functionDockerfile(functionDir, tt.override)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("functionDockerfile = %v, want error %v", err, tt.wantErr)
+			}
+			want := tt.want
+			if want != "" {
+				if want, err = filepath.Abs(want); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got != want {
+				t.Errorf("Dockerfile = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCheckDockerfile(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		wantErr    bool
+	}{
+		{name: "entrypoint", dockerfile: "FROM alpine\nENTRYPOINT [\"/app/function\"]\n"},
+		{name: "cmd", dockerfile: "FROM python:3.12\ncmd python main.py\n"},
+		{name: "multi-stage", dockerfile: "FROM golang AS build\nRUN go build\nFROM alpine\nCOPY --from=build /out /app\nENTRYPOINT [\"/app/out\"]\n"},
+		{name: "no instructions", dockerfile: "# Nothing yet\n", wantErr: true},
+		{name: "no entrypoint", dockerfile: "FROM alpine\nCOPY function /app/function\n", wantErr: true},
+		{name: "entrypoint of the build stage only", dockerfile: "FROM golang AS build\nCMD [\"go\", \"test\"]\nFROM alpine\n", wantErr: true},
+		{name: "commented out", dockerfile: "FROM alpine\n# ENTRYPOINT [\"/app/function\"]\n", wantErr: true},
+		{name: "continued line", dockerfile: "FROM alpine\nRUN echo \\\n  CMD\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), dockerfileName)
+			writeFile(t, path, tt.dockerfile)
+			if err := checkDockerfile(path); (err != nil) != tt.wantErr {
+				t.Errorf("checkDockerfile = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeployOwnDockerfile(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		opts       deployOptions
+		wantErr    bool
+	}{
+		{name: "python", dockerfile: "FROM python:3.12\nCMD [\"python\", \"main.py\"]\n", opts: deployOptions{runtime: "python"}},
+		{name: "no entrypoint", dockerfile: "FROM python:3.12\n", opts: deployOptions{runtime: "python"}, wantErr: true},
+		{
+			name:       "entrypoint at deploy",
+			dockerfile: "FROM python:3.12\n",
+			opts:       deployOptions{runtime: "python", entrypoint: []string{"python", "main.py"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			writeFile(t, filepath.Join("functions", "hello", dockerfileName), tt.dockerfile)
+			scripts := maps.Clone(buildCommands)
+			scripts["git"] = "exit 128"
+			commands := fakeCommands(t, scripts)
+			server := newFakeServer(t, nil)
+
+			err := deployFunction("hello", tt.opts, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deployFunction = %v, want error %v", err, tt.wantErr)
+			}
+			if registered := len(server.received()) > 0; registered == tt.wantErr {
+				t.Errorf("registered = %v, want %v", registered, !tt.wantErr)
+			}
+			// docker build runs in the function's directory, so the path is absolute
+			dockerfile, err := filepath.Abs(filepath.Join("functions", "hello", dockerfileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			built := false
+			for _, command := range commandsRun(t, commands) {
+				if strings.HasPrefix(command, "go ") {
+					t.Errorf("compiled on the host: %q", command)
+				}
+				built = built || command == "docker build -t serverless-hello:build -f "+dockerfile+" --label serverless.function=hello ."
+			}
+			if built == tt.wantErr {
+				t.Errorf("built with the function's Dockerfile = %v, want %v: %q", built, !tt.wantErr, commandsRun(t, commands))
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// exportFunctions writes the metadata of all functions to out, in the format
+// import reads.
+func exportFunctions(out io.Writer, config Config) error {
+	body, err := serverRequest(http.MethodGet, "/functions/export", config)
+	if err != nil {
+		return err
+	}
+	exported, err := indentJSON(body)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, exported)
+	return err
+}
+
+// importFunctions deploys the functions of an export file, without building
+// them: they run the exported images, pinned to what their tags refer to on
+// the server. Functions that already exist are skipped, unless overwrite is
+// set, and then keep their secrets. It fails if any function wasn't imported.
+func importFunctions(path string, overwrite bool, config Config, log *logrus.Logger) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read export file: %v", err)
+	}
+	var functions []json.RawMessage
+	if err := json.Unmarshal(data, &functions); err != nil {
+		return fmt.Errorf("invalid export file %s: %v", path, err)
+	}
+
+	var failed []string
+	for _, raw := range functions {
+		var header struct {
+			Name        string   `json:"name"`
+			SecretNames []string `json:"secret_names"`
+		}
+		if err := json.Unmarshal(raw, &header); err != nil || header.Name == "" {
+			return fmt.Errorf("invalid export file %s: every function needs a name", path)
+		}
+		logger := log.WithField("function", header.Name)
+
+		exists, err := functionExists(header.Name, config)
+		if err != nil {
+			return err
+		}
+		if exists && !overwrite {
+			logger.Warn("Function already exists, skipping it (use --overwrite to replace it)")
+			failed = append(failed, header.Name)
+			continue
+		}
+
+		function, err := importMetadata(raw)
+		if err != nil {
+			return fmt.Errorf("invalid export file %s: %v", path, err)
+		}
+		if _, err := registerFunction(function, config); err != nil {
+			logger.WithError(err).Error("Failed to import function")
+			failed = append(failed, header.Name)
+			continue
+		}
+		if len(header.SecretNames) > 0 && !exists {
+			logger.WithField("secrets", header.SecretNames).Warn("Secrets aren't exported, set them again with deploy --secret")
+		}
+		logger.Info("Function imported")
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d functions not imported: %s", len(failed), len(functions), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// importMetadata returns the deploy metadata of an exported function. A
+// digest only identifies an image on the engine it was exported from, so
+// it's dropped and the server pins the image the tag refers to instead, and
+// the secrets of the function being replaced, if any, are kept.
+func importMetadata(exported json.RawMessage) ([]byte, error) {
+	var metadata map[string]json.RawMessage
+	if err := json.Unmarshal(exported, &metadata); err != nil {
+		return nil, err
+	}
+	delete(metadata, "digest")
+	metadata["pin_digest"] = json.RawMessage("true")
+	metadata["keep_secrets"] = json.RawMessage("true")
+	return json.Marshal(metadata)
+}
+
+// functionExists reports whether a function is deployed.
+func functionExists(name string, config Config) (bool, error) {
+	resp, err := config.client().Get(config.url("/functions/" + name))
+	if err != nil {
+		return false, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
+	}
+}
+
+// registration is what the server tells of a function it registered.
+type registration struct {
+	Name      string `json:"name"`
+	TimeoutMs int64  `json:"timeout_ms"` // Effective execution timeout, 0 when the server doesn't say
+}
+
+// registerFunction registers a function with the server from its metadata.
+func registerFunction(metadata []byte, config Config) (registration, error) {
+	resp, err := config.client().Post(config.url("/functions"), "application/json", bytes.NewReader(metadata))
+	if err != nil {
+		return registration{}, fmt.Errorf("failed to register function with server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return registration{}, fmt.Errorf("server returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	// The function is registered by now, so a reply that doesn't decode,
+	// e.g. the empty one of older servers, only leaves the details unknown
+	var registered registration
+	json.NewDecoder(resp.Body).Decode(&registered) // Safe to ignore error, see above
+	return registered, nil
+}
@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		exported string
+		want     map[string]any
+		wantErr  bool
+	}{
+		{
+			name:     "digest dropped and pinned again",
+			exported: `{"name":"hello","image":"app:1","digest":"sha256:abc","runtime":"go"}`,
+			want:     map[string]any{"name": "hello", "image": "app:1", "runtime": "go", "pin_digest": true, "keep_secrets": true},
+		},
+		{
+			name:     "unpinned function",
+			exported: `{"name":"hello","image":"app:1"}`,
+			want:     map[string]any{"name": "hello", "image": "app:1", "pin_digest": true, "keep_secrets": true},
+		},
+		{
+			name:     "exported flags overridden",
+			exported: `{"name":"hello","pin_digest":false,"keep_secrets":false}`,
+			want:     map[string]any{"name": "hello", "pin_digest": true, "keep_secrets": true},
+		},
+		{
+			name:     "other fields kept as exported",
+			exported: `{"name":"hello","env":{"A":"1"},"max_retries":3,"labels":null}`,
+			want: map[string]any{
+				"name": "hello", "env": map[string]any{"A": "1"}, "max_retries": float64(3), "labels": nil,
+				"pin_digest": true, "keep_secrets": true,
+			},
+		},
+		{name: "not an object", exported: `["hello"]`, wantErr: true},
+		{name: "not JSON", exported: `{`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata, err := importMetadata(json.RawMessage(tt.exported))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("importMetadata = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var got map[string]any
+			if err := json.Unmarshal(metadata, &got); err != nil {
+				t.Fatalf("the metadata isn't a JSON object: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("importMetadata(%s) = %s, want %v", tt.exported, metadata, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportFunctions(t *testing.T) {
+	exported := `[
+		{"name":"hello","image":"hello:1","runtime":"go","digest":"sha256:abc"},
+		{"name":"world","image":"world:1","runtime":"go","secret_names":["TOKEN"]}
+	]`
+	tests := []struct {
+		name         string
+		existing     map[string]bool
+		overwrite    bool
+		wantImported []string
+		wantErr      bool
+	}{
+		{name: "new functions", wantImported: []string{"hello", "world"}},
+		{name: "existing function skipped", existing: map[string]bool{"world": true}, wantImported: []string{"hello"}, wantErr: true},
+		{name: "existing function replaced", existing: map[string]bool{"world": true}, overwrite: true, wantImported: []string{"hello", "world"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var imported []string
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					if !tt.existing[strings.TrimPrefix(r.URL.Path, "/functions/")] {
+						w.WriteHeader(http.StatusNotFound)
+					}
+					return
+				}
+				body, _ := io.ReadAll(r.Body)
+				var metadata map[string]any
+				if err := json.Unmarshal(body, &metadata); err != nil {
+					t.Errorf("invalid deploy request: %v", err)
+				}
+				if _, ok := metadata["digest"]; ok || metadata["pin_digest"] != true || metadata["keep_secrets"] != true {
+					t.Errorf("deploy request %s, want the digest dropped and pin_digest and keep_secrets set", body)
+				}
+				imported = append(imported, metadata["name"].(string))
+			})
+			path := filepath.Join(t.TempDir(), "export.json")
+			if err := os.WriteFile(path, []byte(exported), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := importFunctions(path, tt.overwrite, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("importFunctions = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(imported, tt.wantImported) {
+				t.Errorf("imported %q, want %q", imported, tt.wantImported)
+			}
+		})
+	}
+}
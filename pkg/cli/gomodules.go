@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// goModuleVars are the Go environment variables forwarded to the compilation
+// of functions, so modules resolve as they do for the developer, private ones
+// included. They're passed to docker build as build arguments, which the
+// generated Dockerfile declares; a function's own Dockerfile can declare
+// them too.
+var goModuleVars = []string{"GOPRIVATE", "GONOPROXY", "GONOSUMDB", "GOPROXY", "GOINSECURE"}
+
+// netrcSecret is the ID of the build secret holding the netrc file, mounted
+// at /root/.netrc by the generated Dockerfile.
+const netrcSecret = "netrc"
+
+// goModuleEnv returns the Go environment of a build: each of goModuleVars as
+// configured with go_env, or else as set in the CLI's environment. Unset ones
+// are left out, so the go command's defaults apply.
+func goModuleEnv(config Config) (map[string]string, error) {
+	for name := range config.GoEnv {
+		if !slices.Contains(goModuleVars, name) {
+			return nil, fmt.Errorf("go_env can't set %s, only %s", name, strings.Join(goModuleVars, ", "))
+		}
+	}
+
+	env := make(map[string]string)
+	for _, name := range goModuleVars {
+		value, ok := config.GoEnv[name]
+		if !ok {
+			value = os.Getenv(name)
+		}
+		if value != "" {
+			env[name] = value
+		}
+	}
+	return env, nil
+}
+
+// netrcFile returns the configured netrc file with the credentials of private
+// module hosts, empty when there's none. The file must exist, so a typo
+// doesn't surface as an authentication failure in the middle of the build.
+func netrcFile(config Config) (string, error) {
+	if config.Netrc == "" {
+		return "", nil
+	}
+	path := config.Netrc
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to find the home directory for netrc %s: %v", path, err)
+		}
+		path = home + "/" + rest
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid netrc file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("invalid netrc file: %s is not a regular file", path)
+	}
+	return path, nil
+}
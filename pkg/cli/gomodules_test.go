@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGoModuleEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ map[string]string // Environment of the CLI
+		goEnv   map[string]string // go_env of the configuration
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "nothing set", want: map[string]string{}},
+		{
+			name:    "from the environment",
+			environ: map[string]string{"GOPRIVATE": "github.com/acme/*", "GOFLAGS": "-mod=vendor"},
+			want:    map[string]string{"GOPRIVATE": "github.com/acme/*"},
+		},
+		{
+			name:    "configured over the environment",
+			environ: map[string]string{"GOPROXY": "https://proxy.golang.org"},
+			goEnv:   map[string]string{"GOPROXY": "https://goproxy.acme.com", "GONOSUMDB": "github.com/acme/*"},
+			want:    map[string]string{"GOPROXY": "https://goproxy.acme.com", "GONOSUMDB": "github.com/acme/*"},
+		},
+		{
+			name:    "configured empty",
+			environ: map[string]string{"GOPROXY": "https://proxy.golang.org"},
+			goEnv:   map[string]string{"GOPROXY": ""},
+			want:    map[string]string{},
+		},
+		{name: "other variable", goEnv: map[string]string{"CGO_ENABLED": "1"}, wantErr: "go_env can't set CGO_ENABLED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range append(goModuleVars, "GOFLAGS") {
+				t.Setenv(name, tt.environ[name])
+			}
+			got, err := goModuleEnv(Config{GoEnv: tt.goEnv})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("goModuleEnv = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("goModuleEnv = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetrcFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	netrc := filepath.Join(home, ".netrc")
+	if err := os.WriteFile(netrc, []byte("machine github.com login x password y\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		netrc   string
+		want    string
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "absolute", netrc: netrc, want: netrc},
+		{name: "in the home directory", netrc: "~/.netrc", want: netrc},
+		{name: "missing", netrc: filepath.Join(home, "missing"), wantErr: true},
+		{name: "directory", netrc: home, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := netrcFile(Config{Netrc: tt.netrc})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("netrcFile = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("netrcFile = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/akos011221/serverless/pkg/rpc"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// dialGRPC connects to the server's gRPC API, over TLS when the server has a
+// certificate.
+func dialGRPC(config Config) (*grpc.ClientConn, error) {
+	if config.GRPCAddr == "" {
+		return nil, errors.New("grpc_addr is not configured")
+	}
+	creds := insecure.NewCredentials()
+	if config.tlsConfig != nil {
+		creds = credentials.NewTLS(config.tlsConfig)
+	}
+	conn, err := grpc.NewClient(config.GRPCAddr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", config.GRPCAddr, err)
+	}
+	return conn, nil
+}
+
+// invokeGRPC invokes a function over gRPC and returns its output.
+func invokeGRPC(ctx context.Context, name, eventJSON string, opts invokeOptions, config Config, log *logrus.Logger) (string, error) {
+	if !json.Valid([]byte(eventJSON)) {
+		return "", fmt.Errorf("invalid event JSON")
+	}
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+
+	conn, err := dialGRPC(config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if actor := currentActor(); actor != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, rpc.ActorKey, actor)
+	}
+	request := &rpc.InvokeRequest{Function: name, Event: json.RawMessage(eventJSON)}
+	response, err := rpc.NewClient(conn).Invoke(ctx, request)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.DeadlineExceeded:
+			if ctx.Err() != nil {
+				return "", fmt.Errorf("invoke timed out after %s", opts.timeout)
+			}
+		case codes.Canceled:
+			return "", fmt.Errorf("invoke cancelled")
+		}
+		return "", fmt.Errorf("server returned %s: %s", status.Code(err), status.Convert(err).Message())
+	}
+
+	log.WithFields(logrus.Fields{
+		"function":   response.Function,
+		"cold_start": response.ColdStart,
+		"exec_ms":    response.ExecMs,
+	}).Info("Function invoked successfully")
+	return string(response.Output), nil
+}
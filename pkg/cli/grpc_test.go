@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeFunctions is a gRPC functions service whose invocations are handled by
+// invoke, recording the requests and actors it received.
+type fakeFunctions struct {
+	invoke   func(ctx context.Context, request *rpc.InvokeRequest) (*rpc.InvokeResponse, error)
+	mu       sync.Mutex
+	requests []*rpc.InvokeRequest
+	actors   []string
+}
+
+// Invoke records the request and passes it to the fake's invoke.
+func (f *fakeFunctions) Invoke(ctx context.Context, request *rpc.InvokeRequest) (*rpc.InvokeResponse, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	f.actors = append(f.actors, metadata.ValueFromIncomingContext(ctx, rpc.ActorKey)...)
+	f.mu.Unlock()
+	return f.invoke(ctx, request)
+}
+
+// received returns the requests the fake received, and who sent them.
+func (f *fakeFunctions) received() ([]*rpc.InvokeRequest, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests, f.actors
+}
+
+// Deploy isn't used by the CLI over gRPC.
+func (f *fakeFunctions) Deploy(context.Context, *rpc.DeployRequest) (*rpc.DeployResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not implemented")
+}
+
+// List isn't used by the CLI over gRPC.
+func (f *fakeFunctions) List(context.Context, *rpc.ListRequest) (*rpc.ListResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not implemented")
+}
+
+// serveGRPC serves functions on a free local port and returns its address.
+func serveGRPC(t *testing.T, functions rpc.FunctionsServer) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	rpc.RegisterFunctionsServer(server, functions)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestInvokeGRPC(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      string
+		opts       invokeOptions
+		invoke     func(ctx context.Context, request *rpc.InvokeRequest) (*rpc.InvokeResponse, error)
+		wantOutput string
+		wantErr    string // Part of the error, empty for success
+		wantCalls  int
+	}{
+		{
+			name:  "success",
+			event: `{"user":"alice"}`,
+			invoke: func(_ context.Context, request *rpc.InvokeRequest) (*rpc.InvokeResponse, error) {
+				return &rpc.InvokeResponse{Function: request.Function, Output: []byte("hello " + string(request.Event))}, nil
+			},
+			wantOutput: `hello {"user":"alice"}`,
+			wantCalls:  1,
+		},
+		{
+			name:  "not found",
+			event: `{}`,
+			invoke: func(context.Context, *rpc.InvokeRequest) (*rpc.InvokeResponse, error) {
+				return nil, status.Error(codes.NotFound, "Function hello not found")
+			},
+			wantErr:   "NotFound: Function hello not found",
+			wantCalls: 1,
+		},
+		{
+			name:  "timeout",
+			event: `{}`,
+			opts:  invokeOptions{timeout: 50 * time.Millisecond},
+			invoke: func(ctx context.Context, _ *rpc.InvokeRequest) (*rpc.InvokeResponse, error) {
+				<-ctx.Done()
+				return nil, status.FromContextError(ctx.Err()).Err()
+			},
+			wantErr:   "invoke timed out after 50ms",
+			wantCalls: 1,
+		},
+		{name: "invalid event", event: `{`, wantErr: "invalid event JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SERVERLESS_ACTOR", "alice")
+			functions := &fakeFunctions{invoke: tt.invoke}
+			config := Config{GRPCAddr: serveGRPC(t, functions)}
+
+			got, err := invokeGRPC(context.Background(), "hello", tt.event, tt.opts, config, testLogger())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("invokeGRPC = %v, want error containing %q", err, tt.wantErr)
+				}
+			} else if err != nil || got != tt.wantOutput {
+				t.Fatalf("invokeGRPC = %q, %v, want %q", got, err, tt.wantOutput)
+			}
+
+			requests, actors := functions.received()
+			if len(requests) != tt.wantCalls {
+				t.Fatalf("server received %d calls, want %d", len(requests), tt.wantCalls)
+			}
+			if tt.wantCalls > 0 && (requests[0].Function != "hello" || len(actors) != 1 || actors[0] != "alice") {
+				t.Errorf("server received %+v from %q, want a call of hello from alice", requests[0], actors)
+			}
+		})
+	}
+}
+
+func TestInvokeGRPCNotConfigured(t *testing.T) {
+	_, err := invokeGRPC(context.Background(), "hello", `{}`, invokeOptions{}, Config{}, testLogger())
+	if err == nil || !strings.Contains(err.Error(), "grpc_addr") {
+		t.Errorf("invokeGRPC = %v, want an error about grpc_addr", err)
+	}
+}
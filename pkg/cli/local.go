@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// timeoutEnv tells a function its execution timeout in milliseconds, as the
+// server does (see orchestrator.TimeoutEnv).
+const timeoutEnv = "SERVERLESS_TIMEOUT_MS"
+
+// runLocal compiles a function to a native binary and runs it with the event
+// on stdin, writing its stdout to stdout and its stderr to stderr, like the
+// platform runs it but without a container or a server. Only runtimes that
+// compile to a native binary are supported.
+func runLocal(ctx context.Context, name, eventJSON string, opts deployOptions, config Config, stdout, stderr io.Writer, log *logrus.Logger) error {
+	functionDir := filepath.Join("functions", name)
+	if err := checkFunctionDir(functionDir); err != nil {
+		return err
+	}
+	m, err := applyManifest(name, functionDir, &opts, log)
+	if err != nil {
+		return err
+	}
+	if opts.runtime != "go" {
+		return fmt.Errorf("unsupported runtime %q, run-local only runs functions compiled to a native binary (go)", opts.runtime)
+	}
+	if err := checkRuntime(functionDir, opts.runtime); err != nil {
+		return err
+	}
+	if !json.Valid([]byte(eventJSON)) {
+		return fmt.Errorf("invalid JSON event")
+	}
+	var manifestEnv map[string]string
+	if m != nil {
+		manifestEnv = m.Env
+	}
+	env, err := mergeKeyValues(manifestEnv, opts.env, "environment variable")
+	if err != nil {
+		return err
+	}
+	if opts.timeout <= 0 {
+		return fmt.Errorf("invalid timeout %v", opts.timeout)
+	}
+	goEnv, err := goModuleEnv(config)
+	if err != nil {
+		return err
+	}
+	netrc, err := netrcFile(config)
+	if err != nil {
+		return err
+	}
+
+	// The binary is built outside the function's directory, so nothing is
+	// left in the sources
+	buildDir, err := os.MkdirTemp("", "serverless-"+name+"-")
+	if err != nil {
+		return fmt.Errorf("failed to create build directory: %v", err)
+	}
+	defer os.RemoveAll(buildDir)
+	binary := filepath.Join(buildDir, "function")
+
+	// Modules resolve as in a deploy, with the same Go settings and netrc
+	build := exec.CommandContext(ctx, "go", "build", "-trimpath", "-o", binary, ".")
+	build.Dir = functionDir
+	build.Env = append(os.Environ(), keyValuePairs(goEnv)...)
+	if netrc != "" {
+		build.Env = append(build.Env, "NETRC="+netrc)
+	}
+	build.Stderr = stderr
+	if err := build.Run(); err != nil {
+		return fmt.Errorf("failed to build function: %v", err)
+	}
+	log.WithField("function", name).Debug("Function built")
+
+	// The function gets the environment of the CLI, with its own variables
+	// and timeout on top, and is killed when the timeout expires
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary, opts.args...)
+	cmd.Dir = functionDir
+	cmd.Env = append(os.Environ(), keyValuePairs(env)...)
+	cmd.Env = append(cmd.Env, timeoutEnv+"="+strconv.FormatInt(opts.timeout.Milliseconds(), 10))
+	cmd.Stdin = strings.NewReader(eventJSON)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	began := time.Now()
+	err = cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("function timed out after %v", opts.timeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("function exited with code %d", exitErr.ExitCode())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run function: %v", err)
+	}
+	log.WithFields(logrus.Fields{
+		"function": name,
+		"exec_ms":  time.Since(began).Milliseconds(),
+	}).Debug("Function ran locally")
+	return nil
+}
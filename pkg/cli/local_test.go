@@ -0,0 +1,161 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunLocal(t *testing.T) {
+	tests := []struct {
+		name       string
+		function   string // Script the function is built to, none when the build fails
+		event      string
+		opts       deployOptions
+		wantOutput string
+		wantErr    string // Part of the error, empty for success
+		wantBuilt  bool
+	}{
+		{
+			name:       "output",
+			function:   `cat; echo " $MODE $SERVERLESS_TIMEOUT_MS $1"`,
+			event:      `{"user":"alice"}`,
+			opts:       deployOptions{runtime: "go", env: []string{"MODE=test"}, args: []string{"first"}, timeout: 2 * time.Second},
+			wantOutput: `{"user":"alice"} test 2000 first` + "\n",
+			wantBuilt:  true,
+		},
+		{
+			name:      "exit code",
+			function:  "exit 3",
+			event:     `{}`,
+			opts:      deployOptions{runtime: "go", timeout: time.Second},
+			wantErr:   "function exited with code 3",
+			wantBuilt: true,
+		},
+		{
+			name:      "timed out",
+			function:  "exec sleep 5",
+			event:     `{}`,
+			opts:      deployOptions{runtime: "go", timeout: 100 * time.Millisecond},
+			wantErr:   "function timed out after 100ms",
+			wantBuilt: true,
+		},
+		{name: "build fails", event: `{}`, opts: deployOptions{runtime: "go", timeout: time.Second}, wantErr: "failed to build function", wantBuilt: true},
+		{name: "invalid event", event: `{`, opts: deployOptions{runtime: "go", timeout: time.Second}, wantErr: "invalid JSON event"},
+		{name: "unsupported runtime", event: `{}`, opts: deployOptions{runtime: "python", timeout: time.Second}, wantErr: "unsupported runtime"},
+		{name: "invalid environment", event: `{}`, opts: deployOptions{runtime: "go", env: []string{"MODE"}, timeout: time.Second}, wantErr: "environment variable"},
+		{name: "no timeout", event: `{}`, opts: deployOptions{runtime: "go"}, wantErr: "invalid timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			// The fake go writes the function's script as the binary,
+			// given after -o
+			build := "exit 1"
+			if tt.function != "" {
+				build = "printf '#!/bin/sh\\n%s\\n' '" + tt.function + "' > \"$4\" && chmod +x \"$4\""
+			}
+			commands := fakeCommands(t, map[string]string{"go": build})
+
+			var stdout, stderr bytes.Buffer
+			err := runLocal(context.Background(), "hello", tt.event, tt.opts, Config{}, &stdout, &stderr, testLogger())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("runLocal = %v, want error containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("runLocal failed: %v (stderr %q)", err, stderr.String())
+			}
+			if got := stdout.String(); got != tt.wantOutput {
+				t.Errorf("output = %q, want %q", got, tt.wantOutput)
+			}
+			built := false
+			for _, command := range commandsRun(t, commands) {
+				built = built || strings.HasPrefix(command, "go build -trimpath -o ")
+			}
+			if built != tt.wantBuilt {
+				t.Errorf("built = %v, want %v", built, tt.wantBuilt)
+			}
+		})
+	}
+}
+
+func TestRunLocalGoModuleEnv(t *testing.T) {
+	withFunction(t, "hello")
+	t.Setenv("GOPROXY", "https://goproxy.acme.com")
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(netrc, []byte("machine github.com login x password y\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The fake go records the module settings it's run with
+	buildEnv := filepath.Join(t.TempDir(), "env")
+	fakeCommands(t, map[string]string{
+		"go": `env | grep -E '^(GOPRIVATE|GONOPROXY|GONOSUMDB|GOPROXY|GOINSECURE|NETRC)=.' | sort > ` + buildEnv +
+			` && printf '#!/bin/sh\ncat\n' > "$4" && chmod +x "$4"`,
+	})
+
+	config := Config{GoEnv: map[string]string{"GOPRIVATE": "*.corp.example.com"}, Netrc: netrc}
+	opts := deployOptions{runtime: "go", timeout: time.Second}
+	var stdout, stderr bytes.Buffer
+	if err := runLocal(context.Background(), "hello", `{}`, opts, config, &stdout, &stderr, testLogger()); err != nil {
+		t.Fatalf("runLocal failed: %v (stderr %q)", err, stderr.String())
+	}
+
+	data, err := os.ReadFile(buildEnv)
+	if err != nil {
+		t.Fatalf("go build didn't run: %v", err)
+	}
+	want := "GOPRIVATE=*.corp.example.com\nGOPROXY=https://goproxy.acme.com\nNETRC=" + netrc + "\n"
+	if string(data) != want {
+		t.Errorf("go build ran with\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestRunLocalExample(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("the go toolchain isn't available")
+	}
+	// The example function of the repository, built for real
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(filepath.Join("..", "..")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	tests := []struct {
+		name       string
+		event      string
+		wantOutput string
+		wantErr    string
+	}{
+		{name: "greeting", event: `{"data":"world"}`, wantOutput: `{"result":"Hey, world"}` + "\n"},
+		{name: "invalid event", event: `[1]`, wantErr: "function exited with code 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			opts := deployOptions{timeout: time.Minute}
+			err := runLocal(context.Background(), "example", tt.event, opts, Config{}, &stdout, &stderr, testLogger())
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("runLocal = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("runLocal failed: %v (stderr %q)", err, stderr.String())
+			}
+			if got := stdout.String(); got != tt.wantOutput {
+				t.Errorf("output = %q, want %q", got, tt.wantOutput)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// lockFileName is the advisory lock file serializing deploys of a function.
+const lockFileName = ".deploy.lock"
+
+// lockPollInterval is how often a busy lock is retried.
+const lockPollInterval = 200 * time.Millisecond
+
+// deployLock is an exclusive advisory lock on a function directory.
+type deployLock struct {
+	file *os.File
+}
+
+// acquireDeployLock locks the function directory, so concurrent deploys of the
+// same function don't clobber each other's build artifacts. It waits up to
+// timeout for a concurrent deploy to finish.
+func acquireDeployLock(functionDir string, timeout time.Duration) (*deployLock, error) {
+	path := filepath.Join(functionDir, lockFileName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return &deployLock{file: file}, nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("another deploy of this function is still running, gave up waiting after %s", timeout)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// release unlocks the function directory.
+func (l *deployLock) release() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentDeploys(t *testing.T) {
+	withFunction(t, "hello")
+	steps := filepath.Join(t.TempDir(), "steps.log")
+	scripts := maps.Clone(buildCommands)
+	// Each build takes a while, so unserialized deploys would overlap
+	scripts["docker"] = "[ \"$1\" = build ] || exit 0; echo begin >> " + steps + "; sleep 0.3; echo end >> " + steps
+	fakeCommands(t, scripts)
+	server := newFakeServer(t, nil)
+	config := Config{ServerAddr: server.Listener.Addr().String()}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = deployFunction("hello", deployOptions{lockTimeout: time.Minute}, config, testLogger())
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("deploy %d failed: %v", i, err)
+		}
+	}
+	data, err := os.ReadFile(steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Fields(string(data)); strings.Join(got, " ") != "begin end begin end" {
+		t.Errorf("builds ran as %q, want one after the other", got)
+	}
+	if registered := len(server.received()); registered != 2 {
+		t.Errorf("%d registrations, want 2", registered)
+	}
+}
+
+func TestDeployLockTimeout(t *testing.T) {
+	withFunction(t, "hello")
+	commands := fakeCommands(t, buildCommands)
+	server := newFakeServer(t, nil)
+
+	held, err := acquireDeployLock(filepath.Join("functions", "hello"), 0)
+	if err != nil {
+		t.Fatalf("acquireDeployLock failed: %v", err)
+	}
+	defer held.release()
+
+	began := time.Now()
+	err = deployFunction("hello", deployOptions{lockTimeout: 300 * time.Millisecond}, Config{ServerAddr: server.Listener.Addr().String()}, testLogger())
+	if err == nil || !strings.Contains(err.Error(), "another deploy") {
+		t.Fatalf("deployFunction = %v, want the lock timeout", err)
+	}
+	if waited := time.Since(began); waited < 300*time.Millisecond {
+		t.Errorf("gave up after %v, want the lock timeout waited", waited)
+	}
+	if run := commandsRun(t, commands); len(run) != 0 {
+		t.Errorf("commands run without the lock: %q", run)
+	}
+	if len(server.received()) != 0 {
+		t.Error("function registered without the lock")
+	}
+}
@@ -0,0 +1,458 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/functionio"
+	"github.com/akos011221/serverless/pkg/stopsignal"
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v2"
+)
+
+// manifestFile is the name of the deploy manifest in a function's directory.
+const manifestFile = "serverless.yaml"
+
+// manifest declares the deploy options of a function, so deploys are
+// reproducible without repeating flags. Flags given on the command line take
+// precedence over the manifest.
+type manifest struct {
+	Runtime        string            `yaml:"runtime"`
+	BaseImage      string            `yaml:"base_image"`
+	Dockerfile     string            `yaml:"dockerfile"` // Relative to the function directory
+	BuildArgs      map[string]string `yaml:"build_args"` // Passed to docker build, --build-arg wins for the same key
+	Platforms      []string          `yaml:"platforms"`  // Built with docker buildx, e.g. [linux/amd64, linux/arm64]
+	Version        string            `yaml:"version"`    // Stamped on the image, defaults to git describe
+	User           string            `yaml:"user"`
+	WorkingDir     string            `yaml:"working_dir"`
+	StopSignal     string            `yaml:"stop_signal"` // e.g. SIGINT, defaults to SIGTERM
+	Entrypoint     []string          `yaml:"entrypoint"`
+	Args           []string          `yaml:"args"`
+	Env            map[string]string `yaml:"env"`
+	Labels         map[string]string `yaml:"labels"`
+	DNS            []string          `yaml:"dns"`             // DNS servers, e.g. [10.0.0.2]
+	ExtraHosts     []string          `yaml:"extra_hosts"`     // /etc/hosts entries as host:ip
+	ExitStatuses   map[string]int    `yaml:"exit_statuses"`   // e.g. {"2": 400, "10-19": 422}
+	EventSchema    string            `yaml:"event_schema"`    // Relative to the function directory
+	DefaultEvent   string            `yaml:"default_event"`   // Relative to the function directory
+	ContentType    string            `yaml:"content_type"`    // Media type of the output, e.g. text/plain
+	EventFormat    string            `yaml:"event_format"`    // json, msgpack or raw
+	ResponseFormat string            `yaml:"response_format"` // json, msgpack or raw
+	LogDestination string            `yaml:"log_destination"`
+	LogPayloads    *bool             `yaml:"log_payloads"`
+	RedactPaths    []string          `yaml:"redact_paths"` // e.g. [user.email, cards.*.number]
+	MaxRetries     *int              `yaml:"max_retries"`
+	MaxConcurrency *int              `yaml:"max_concurrency"`
+	RetryBackoff   *time.Duration    `yaml:"retry_backoff"`
+	DedupWindow    *time.Duration    `yaml:"dedup_window"`
+	CacheTTL       *time.Duration    `yaml:"cache_ttl"`
+	Timeout        *time.Duration    `yaml:"timeout"`
+	ReadonlyRootfs *bool             `yaml:"readonly_rootfs"`
+	WritableTmp    *bool             `yaml:"writable_tmp"`
+	AlwaysPull     *bool             `yaml:"always_pull"`
+	Snapshot       *bool             `yaml:"snapshot"`
+	RunOnce        *bool             `yaml:"run_once"`
+	DependsOn      []string          `yaml:"depends_on"` // Functions deploy --all deploys before this one
+	Limits         struct {
+		Memory string  `yaml:"memory"` // e.g. 128m
+		CPUs   float64 `yaml:"cpus"`
+		Output string  `yaml:"output"` // Cap on the output of an execution, e.g. 1m
+	} `yaml:"limits"`
+}
+
+// loadManifest reads the manifest of a function, if it has one. Unknown keys
+// are rejected, so a typo doesn't silently fall back to a default.
+func loadManifest(functionDir string) (*manifest, error) {
+	path := filepath.Join(functionDir, manifestFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	var m manifest
+	var problems []string
+	if err := yaml.UnmarshalStrict(data, &m); err != nil {
+		// Unknown keys and values of the wrong type are reported along with
+		// the other problems, the rest of the manifest is still decoded
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("invalid manifest %s: %v", path, err)
+		}
+		problems = append(problems, typeProblems(typeErr)...)
+	}
+
+	// File references are relative to the manifest
+	m.EventSchema = resolvePath(functionDir, m.EventSchema)
+	m.DefaultEvent = resolvePath(functionDir, m.DefaultEvent)
+	m.Dockerfile = resolvePath(functionDir, m.Dockerfile)
+
+	problems = append(problems, m.validate(functionDir)...)
+	if len(problems) > 0 {
+		return nil, &manifestError{Path: path, Problems: problems}
+	}
+	return &m, nil
+}
+
+// manifestError lists every problem of a manifest, each naming the key it's
+// about, so they can all be fixed at once.
+type manifestError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *manifestError) Error() string {
+	return fmt.Sprintf("invalid manifest %s:\n  %s", e.Path, strings.Join(e.Problems, "\n  "))
+}
+
+// unknownField matches the error yaml gives for a key the manifest doesn't have.
+var unknownField = regexp.MustCompile(`^(line \d+): field (\S+) not found in type \S+$`)
+
+// typeProblems describes the problems of a manifest found while decoding it.
+func typeProblems(err *yaml.TypeError) []string {
+	problems := make([]string, 0, len(err.Errors))
+	for _, message := range err.Errors {
+		if match := unknownField.FindStringSubmatch(message); match != nil {
+			message = fmt.Sprintf("%s: unknown key %s", match[1], match[2])
+		}
+		problems = append(problems, message)
+	}
+	return problems
+}
+
+// manifestLogDestinations are the values of log_destination, to list in
+// messages.
+var manifestLogDestinations = []string{
+	functionio.LogToServer, functionio.LogToStdout, functionio.LogToNone,
+	functionio.LogToFile + "<path in the server's function_log_dir>",
+}
+
+// validPlatform matches a platform such as linux/amd64 or linux/arm/v7.
+var validPlatform = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// validate checks the values of a decoded manifest, returning a problem for
+// each invalid one, prefixed with its key. Values flags can still override
+// are checked all the same, a manifest should be valid by itself.
+func (m *manifest) validate(functionDir string) []string {
+	var problems []string
+	add := func(key, format string, args ...any) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+	}
+
+	// A function's own Dockerfile can build any runtime, the generated one
+	// only Go
+	dockerfile, err := functionDockerfile(functionDir, m.Dockerfile)
+	if err != nil {
+		add("dockerfile", "%v", err)
+	}
+	if m.Runtime != "" && dockerfile == "" && err == nil {
+		if _, known := runtimeSources[m.Runtime]; !known {
+			add("runtime", "unknown runtime %q, expected one of %s", m.Runtime, strings.Join(knownRuntimes(), ", "))
+		} else if m.Runtime != "go" {
+			add("runtime", "%s functions need a Dockerfile, only go functions are built without one", m.Runtime)
+		}
+	}
+	if strings.ContainsAny(m.BaseImage, " \t\n") {
+		add("base_image", "invalid image reference %q", m.BaseImage)
+	}
+	for _, key := range sortedKeys(m.BuildArgs) {
+		if key == "" {
+			add("build_args", "empty argument name")
+		}
+	}
+	for _, platform := range m.Platforms {
+		if !validPlatform.MatchString(platform) {
+			add("platforms", "invalid platform %q, expected e.g. linux/amd64", platform)
+		}
+	}
+	if m.WorkingDir != "" && !strings.HasPrefix(m.WorkingDir, "/") {
+		add("working_dir", "%q must be an absolute path", m.WorkingDir)
+	}
+	if m.StopSignal != "" && !stopsignal.Valid(m.StopSignal) {
+		add("stop_signal", "invalid signal %q, expected a name such as SIGINT", m.StopSignal)
+	}
+	for _, key := range sortedKeys(m.Env) {
+		if key == "" || strings.Contains(key, "=") {
+			add("env", "invalid variable name %q", key)
+		}
+	}
+	for _, key := range sortedKeys(m.Labels) {
+		if key == "" {
+			add("labels", "empty label name")
+		}
+	}
+	for _, server := range m.DNS {
+		if net.ParseIP(server) == nil {
+			add("dns", "%q is not an IP address", server)
+		}
+	}
+	for _, entry := range m.ExtraHosts {
+		host, ip, ok := strings.Cut(entry, ":")
+		if !ok || host == "" || net.ParseIP(ip) == nil {
+			add("extra_hosts", "invalid entry %q, expected host:ip", entry)
+		}
+	}
+	codes := make([]string, 0, len(m.ExitStatuses))
+	for code := range m.ExitStatuses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if !validExitCodes(code) {
+			add("exit_statuses", "invalid exit codes %q, expected a code or range within 1-255 (e.g. 2 or 10-19)", code)
+		}
+		if status := m.ExitStatuses[code]; status < 400 || status > 599 {
+			add("exit_statuses", "exit codes %s must map to a 4xx or 5xx status, got %d", code, status)
+		}
+	}
+	for key, path := range map[string]string{"event_schema": m.EventSchema, "default_event": m.DefaultEvent} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			add(key, "%s is not a readable file", path)
+		}
+	}
+	if m.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(m.ContentType); err != nil {
+			add("content_type", "invalid media type %q: %v", m.ContentType, err)
+		}
+	}
+	for key, format := range map[string]string{"event_format": m.EventFormat, "response_format": m.ResponseFormat} {
+		if !functionio.ValidFormat(format) {
+			add(key, "unknown format %q, expected one of %s", format, strings.Join(functionio.Formats, ", "))
+		}
+	}
+	if !functionio.ValidLogDestination(m.LogDestination) {
+		add("log_destination", "unknown destination %q, expected one of %s",
+			m.LogDestination, strings.Join(manifestLogDestinations, ", "))
+	}
+	for _, path := range m.RedactPaths {
+		if slices.Contains(strings.Split(path, "."), "") {
+			add("redact_paths", "invalid path %q, expected keys separated by dots (e.g. user.email)", path)
+		}
+	}
+	for _, dependency := range m.DependsOn {
+		if dependency == "" || strings.ContainsAny(dependency, `/\`) {
+			add("depends_on", "invalid function name %q", dependency)
+		} else if dependency == filepath.Base(functionDir) {
+			add("depends_on", "a function can't depend on itself")
+		}
+	}
+	if m.MaxRetries != nil && *m.MaxRetries < 0 {
+		add("max_retries", "must not be negative, got %d", *m.MaxRetries)
+	}
+	if m.MaxConcurrency != nil && *m.MaxConcurrency < 0 {
+		add("max_concurrency", "must not be negative, got %d", *m.MaxConcurrency)
+	}
+	durations := []struct {
+		key   string
+		value *time.Duration
+	}{{"retry_backoff", m.RetryBackoff}, {"dedup_window", m.DedupWindow}, {"cache_ttl", m.CacheTTL}, {"timeout", m.Timeout}}
+	for _, d := range durations {
+		if d.value != nil && *d.value < 0 {
+			add(d.key, "must not be negative, got %v", *d.value)
+		}
+	}
+	for key, size := range map[string]string{"limits.memory": m.Limits.Memory, "limits.output": m.Limits.Output} {
+		if size == "" {
+			continue
+		}
+		if bytes, err := units.RAMInBytes(size); err != nil || bytes <= 0 {
+			add(key, "invalid size %q, expected e.g. 128m", size)
+		}
+	}
+	if m.Limits.CPUs < 0 {
+		add("limits.cpus", "must not be negative, got %v", m.Limits.CPUs)
+	}
+
+	// Problems of keys checked from maps come in random order
+	sort.Strings(problems)
+	return problems
+}
+
+// knownRuntimes returns the runtimes of runtimeSources, sorted.
+func knownRuntimes() []string {
+	return sortedKeys(runtimeSources)
+}
+
+// sortedKeys returns the keys of a map, sorted.
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validExitCodes reports whether codes is an exit code or an inclusive range
+// of them, within 1-255.
+func validExitCodes(codes string) bool {
+	lowText, highText, isRange := strings.Cut(codes, "-")
+	low, err := strconv.Atoi(lowText)
+	if err != nil {
+		return false
+	}
+	high := low
+	if isRange {
+		if high, err = strconv.Atoi(highText); err != nil {
+			return false
+		}
+	}
+	return low >= 1 && high <= 255 && low <= high
+}
+
+// resolvePath makes a relative path relative to dir.
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// apply fills in the deploy options from the manifest, except those set with
+// a flag. changed reports whether a flag was given.
+func (m *manifest) apply(opts *deployOptions, changed func(flag string) bool) {
+	if changed == nil {
+		changed = func(string) bool { return false }
+	}
+	setString := func(flag string, dst *string, value string) {
+		if value != "" && !changed(flag) {
+			*dst = value
+		}
+	}
+	setList := func(flag string, dst *[]string, value []string) {
+		if len(value) > 0 && !changed(flag) {
+			*dst = value
+		}
+	}
+
+	setString("runtime", &opts.runtime, m.Runtime)
+	setString("base-image", &opts.baseImage, m.BaseImage)
+	setString("version", &opts.version, m.Version)
+	setString("dockerfile", &opts.dockerfile, m.Dockerfile)
+	setString("user", &opts.user, m.User)
+	setString("working-dir", &opts.workingDir, m.WorkingDir)
+	setString("stop-signal", &opts.stopSignal, m.StopSignal)
+	setList("platform", &opts.platforms, m.Platforms)
+	setList("entrypoint", &opts.entrypoint, m.Entrypoint)
+	setList("arg", &opts.args, m.Args)
+	setList("dns", &opts.dns, m.DNS)
+	setList("extra-host", &opts.extraHosts, m.ExtraHosts)
+	setString("event-schema", &opts.eventSchema, m.EventSchema)
+	setString("default-event", &opts.defaultEvent, m.DefaultEvent)
+	setString("content-type", &opts.contentType, m.ContentType)
+	setString("event-format", &opts.eventFormat, m.EventFormat)
+	setString("response-format", &opts.responseFormat, m.ResponseFormat)
+	setString("log-destination", &opts.logDestination, m.LogDestination)
+	setList("redact", &opts.redactPaths, m.RedactPaths)
+	setString("memory", &opts.memory, m.Limits.Memory)
+	setString("max-output", &opts.maxOutput, m.Limits.Output)
+
+	// Build arguments of the manifest come first, so flags override them
+	if len(m.BuildArgs) > 0 {
+		opts.buildArgs = append(keyValuePairs(m.BuildArgs), opts.buildArgs...)
+	}
+
+	if m.MaxRetries != nil && !changed("max-retries") {
+		opts.maxRetries = *m.MaxRetries
+	}
+	if m.MaxConcurrency != nil && !changed("max-concurrency") {
+		opts.concurrency = *m.MaxConcurrency
+	}
+	if m.RetryBackoff != nil && !changed("retry-backoff") {
+		opts.retryBackoff = *m.RetryBackoff
+	}
+	if m.DedupWindow != nil && !changed("dedup-window") {
+		opts.dedupWindow = *m.DedupWindow
+	}
+	if m.CacheTTL != nil && !changed("cache-ttl") {
+		opts.cacheTTL = *m.CacheTTL
+	}
+	if m.Timeout != nil && !changed("timeout") {
+		opts.timeout = *m.Timeout
+	}
+	if m.ReadonlyRootfs != nil && !changed("readonly-rootfs") {
+		opts.readonly = *m.ReadonlyRootfs
+	}
+	if m.WritableTmp != nil && !changed("writable-tmp") {
+		opts.writableTmp = *m.WritableTmp
+	}
+	if m.AlwaysPull != nil && !changed("always-pull") {
+		opts.alwaysPull.value = m.AlwaysPull
+	}
+	if m.Snapshot != nil && !changed("snapshot") {
+		opts.snapshot = *m.Snapshot
+	}
+	if m.RunOnce != nil && !changed("run-once") {
+		opts.runOnce = *m.RunOnce
+	}
+	if m.LogPayloads != nil && !changed("log-payloads") {
+		opts.logPayloads = *m.LogPayloads
+	}
+	if m.Limits.CPUs != 0 && !changed("cpus") {
+		opts.cpus = m.Limits.CPUs
+	}
+}
+
+// exitStatuses returns the exit code to HTTP status mapping given as
+// CODES=STATUS flags, or the manifest's when there are no such flags.
+func exitStatuses(m *manifest, flags []string) (map[string]int, error) {
+	if len(flags) == 0 {
+		if m != nil {
+			return m.ExitStatuses, nil
+		}
+		return nil, nil
+	}
+
+	statuses := make(map[string]int, len(flags))
+	for _, pair := range flags {
+		codes, status, ok := strings.Cut(pair, "=")
+		code, err := strconv.Atoi(status)
+		if !ok || codes == "" || err != nil {
+			return nil, fmt.Errorf("invalid exit status %q, expected CODES=STATUS (e.g. 2=400 or 10-19=422)", pair)
+		}
+		statuses[codes] = code
+	}
+	return statuses, nil
+}
+
+// keyValuePairs returns values as KEY=VALUE pairs, in a stable order.
+func keyValuePairs(values map[string]string) []string {
+	pairs := make([]string, 0, len(values))
+	for key, value := range values {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// mergeKeyValues merges values from the manifest with those given as
+// KEY=VALUE flags, which win for the same key. what names the values in errors.
+func mergeKeyValues(fromManifest map[string]string, flags []string, what string) (map[string]string, error) {
+	merged := make(map[string]string, len(fromManifest)+len(flags))
+	for key, value := range fromManifest {
+		merged[key] = value
+	}
+	for _, pair := range flags {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid %s %q, expected KEY=VALUE", what, pair)
+		}
+		merged[key] = value
+	}
+	return merged, nil
+}
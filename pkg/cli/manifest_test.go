@@ -0,0 +1,371 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// writeManifest writes the manifest of the function in dir.
+func writeManifest(t *testing.T, dir, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, manifestFile), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // Manifest content, no manifest when empty
+		want    *manifest
+		wantErr bool
+	}{
+		{name: "none"},
+		{
+			name: "full",
+			content: `runtime: go
+base_image: alpine:3.20
+env:
+  GREETING: hello
+event_schema: schema.json
+default_event: defaults.json
+max_retries: 3
+retry_backoff: 2s
+readonly_rootfs: false
+limits:
+  memory: 128m
+  cpus: 0.5
+`,
+			want: func() *manifest {
+				m := &manifest{
+					Runtime:      "go",
+					BaseImage:    "alpine:3.20",
+					Env:          map[string]string{"GREETING": "hello"},
+					EventSchema:  "schema.json", // Both made relative to the function directory below
+					DefaultEvent: "defaults.json",
+					MaxRetries:   ptr(3),
+					RetryBackoff: ptr(2 * time.Second),
+				}
+				m.ReadonlyRootfs = ptr(false)
+				m.Limits.Memory = "128m"
+				m.Limits.CPUs = 0.5
+				return m
+			}(),
+		},
+		{name: "unknown key", content: "runtime: go\nenvironment: prod\n", wantErr: true},
+		{name: "misspelled key", content: "base_imag: alpine\n", wantErr: true},
+		{name: "wrong type", content: "max_retries: many\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.content != "" {
+				writeManifest(t, dir, tt.content)
+			}
+			if tt.want != nil {
+				// Referenced files must exist
+				for _, path := range []*string{&tt.want.EventSchema, &tt.want.DefaultEvent} {
+					if *path == "" {
+						continue
+					}
+					*path = filepath.Join(dir, *path)
+					if err := os.WriteFile(*path, []byte(`{}`), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			got, err := loadManifest(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadManifest = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("manifest = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// ptr returns a pointer to v.
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestManifestApply(t *testing.T) {
+	m := &manifest{Runtime: "go", User: "1000:1000", Entrypoint: []string{"/app/function"}, MaxRetries: ptr(3), WritableTmp: ptr(false)}
+	m.Limits.Memory = "128m"
+	m.Limits.CPUs = 0.5
+
+	tests := []struct {
+		name    string
+		opts    deployOptions // Options as parsed from the flags
+		changed []string      // Flags given on the command line
+		want    deployOptions
+	}{
+		{
+			name: "manifest fills in",
+			opts: deployOptions{runtime: "go", writableTmp: true},
+			want: deployOptions{runtime: "go", user: "1000:1000", entrypoint: []string{"/app/function"}, maxRetries: 3, memory: "128m", cpus: 0.5},
+		},
+		{
+			name:    "flags win",
+			opts:    deployOptions{runtime: "go", user: "app", memory: "256m", cpus: 2, maxRetries: 0, writableTmp: true},
+			changed: []string{"user", "memory", "cpus", "max-retries", "writable-tmp"},
+			want:    deployOptions{runtime: "go", user: "app", entrypoint: []string{"/app/function"}, memory: "256m", cpus: 2, writableTmp: true},
+		},
+		{
+			name:    "default flag values don't win",
+			opts:    deployOptions{runtime: "go", user: "", writableTmp: true},
+			changed: []string{"entrypoint"},
+			want:    deployOptions{runtime: "go", user: "1000:1000", maxRetries: 3, memory: "128m", cpus: 0.5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := func(flag string) bool {
+				for _, c := range tt.changed {
+					if c == flag {
+						return true
+					}
+				}
+				return false
+			}
+
+			opts := tt.opts
+			m.apply(&opts, changed)
+			if !reflect.DeepEqual(opts, tt.want) {
+				t.Errorf("options = %+v, want %+v", opts, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeKeyValues(t *testing.T) {
+	m := map[string]string{"GREETING": "hello", "LEVEL": "info"}
+	tests := []struct {
+		name     string
+		manifest map[string]string
+		flags    []string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{name: "none", want: map[string]string{}},
+		{name: "manifest", manifest: m, want: map[string]string{"GREETING": "hello", "LEVEL": "info"}},
+		{name: "flags win", manifest: m, flags: []string{"LEVEL=debug", "EXTRA=a=b"}, want: map[string]string{"GREETING": "hello", "LEVEL": "debug", "EXTRA": "a=b"}},
+		{name: "no value", flags: []string{"LEVEL"}, wantErr: true},
+		{name: "no name", flags: []string{"=debug"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeKeyValues(tt.manifest, tt.flags, "environment variable")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeKeyValues = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeKeyValues = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployManifestPrecedence(t *testing.T) {
+	const manifest = `runtime: go
+env:
+  GREETING: hello
+  LEVEL: info
+limits:
+  memory: 128m
+  cpus: 0.5
+`
+	tests := []struct {
+		name       string
+		args       []string // Flags of the deploy command
+		wantEnv    map[string]any
+		wantMemory float64
+		wantCPUs   float64
+		wantFail   bool
+	}{
+		{
+			name:       "manifest",
+			wantEnv:    map[string]any{"GREETING": "hello", "LEVEL": "info"},
+			wantMemory: 128 << 20,
+			wantCPUs:   0.5e9,
+		},
+		{
+			name:       "flags override",
+			args:       []string{"--env", "LEVEL=debug", "--memory", "256m", "--cpus", "2"},
+			wantEnv:    map[string]any{"GREETING": "hello", "LEVEL": "debug"},
+			wantMemory: 256 << 20,
+			wantCPUs:   2e9,
+		},
+		{
+			name:       "some flags",
+			args:       []string{"--cpus", "1"},
+			wantEnv:    map[string]any{"GREETING": "hello", "LEVEL": "info"},
+			wantMemory: 128 << 20,
+			wantCPUs:   1e9,
+		},
+		{name: "runtime flag", args: []string{"--runtime", "python"}, wantFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			writeManifest(t, filepath.Join("functions", "hello"), manifest)
+			scripts := maps.Clone(buildCommands)
+			scripts["docker"] = `[ "$1" = image ] && echo sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef; exit 0`
+			fakeCommands(t, scripts)
+			var registered map[string]any
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewDecoder(r.Body).Decode(&registered)
+			})
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte("server_addr: "+server.Listener.Addr().String()+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Run the deploy command as the CLI does, so only flags given count
+			// as set. It exits on failure, which the logger records instead.
+			log := testLogger()
+			failed := false
+			log.ExitFunc = func(int) { failed = true }
+			rootCmd := &cobra.Command{Use: "serverless"}
+			RegisterCommands(rootCmd, &configFile, log)
+			rootCmd.SetArgs(append([]string{"deploy", "hello"}, tt.args...))
+			if err := rootCmd.Execute(); err != nil {
+				t.Fatalf("deploy command failed: %v", err)
+			}
+
+			if failed != tt.wantFail {
+				t.Fatalf("deploy failed = %v, want %v", failed, tt.wantFail)
+			}
+			if tt.wantFail {
+				if len(server.received()) != 0 {
+					t.Error("function registered despite the failure")
+				}
+				return
+			}
+			if !reflect.DeepEqual(registered["env"], tt.wantEnv) {
+				t.Errorf("registered env %v, want %v", registered["env"], tt.wantEnv)
+			}
+			if registered["memory_bytes"] != tt.wantMemory || registered["nano_cpus"] != tt.wantCPUs {
+				t.Errorf("registered limits of %v bytes and %v nano CPUs, want %v and %v",
+					registered["memory_bytes"], registered["nano_cpus"], tt.wantMemory, tt.wantCPUs)
+			}
+		})
+	}
+}
+
+func TestValidExitCodes(t *testing.T) {
+	tests := []struct {
+		codes string
+		want  bool
+	}{
+		{codes: "1", want: true},
+		{codes: "255", want: true},
+		{codes: "10-19", want: true},
+		{codes: "7-7", want: true},
+		{codes: "0"},
+		{codes: "256"},
+		{codes: "19-10"},
+		{codes: "1-256"},
+		{codes: "-1"},
+		{codes: "1-"},
+		{codes: ""},
+		{codes: "two"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codes, func(t *testing.T) {
+			if got := validExitCodes(tt.codes); got != tt.want {
+				t.Errorf("validExitCodes(%q) = %v, want %v", tt.codes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifestProblems(t *testing.T) {
+	tests := []struct {
+		name         string
+		manifest     string   // Empty for a function without one
+		wantProblems []string // Expected problems, in order
+		wantErr      bool     // Whether the manifest can't be read at all
+	}{
+		{name: "no manifest"},
+		{name: "valid", manifest: "runtime: go\nenv:\n  A: b\nexit_statuses:\n  \"2\": 400\nlog_destination: file:hello.log\n"},
+		{
+			name:         "unknown key",
+			manifest:     "runtime: go\nenvironment:\n  A: b\n",
+			wantProblems: []string{"line 2: unknown key environment"},
+		},
+		{
+			name:         "wrong type",
+			manifest:     "max_retries: many\n",
+			wantProblems: []string{"line 1: cannot unmarshal !!str `many` into int"},
+		},
+		{
+			name:     "every problem reported",
+			manifest: "runtime: cobol\nlog_destination: file:/var/log/hello.log\nexit_statuses:\n  \"0\": 200\nmax_retries: -1\n",
+			wantProblems: []string{
+				"exit_statuses: exit codes 0 must map to a 4xx or 5xx status, got 200",
+				"exit_statuses: invalid exit codes \"0\", expected a code or range within 1-255 (e.g. 2 or 10-19)",
+				"log_destination: unknown destination \"file:/var/log/hello.log\", expected one of " + strings.Join(manifestLogDestinations, ", "),
+				"max_retries: must not be negative, got -1",
+				"runtime: unknown runtime \"cobol\", expected one of " + strings.Join(knownRuntimes(), ", "),
+			},
+		},
+		{
+			name:         "missing referenced file",
+			manifest:     "event_schema: schema.json\n",
+			wantProblems: []string{"event_schema: "},
+		},
+		{name: "not YAML", manifest: "runtime: [go\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.manifest != "" {
+				if err := os.WriteFile(filepath.Join(dir, manifestFile), []byte(tt.manifest), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m, err := loadManifest(dir)
+			var problems *manifestError
+			switch {
+			case tt.wantErr:
+				if err == nil || errors.As(err, &problems) {
+					t.Fatalf("loadManifest = %v, want a read error", err)
+				}
+				return
+			case len(tt.wantProblems) > 0:
+				if !errors.As(err, &problems) {
+					t.Fatalf("loadManifest = %v, want the manifest's problems", err)
+				}
+			case err != nil:
+				t.Fatalf("loadManifest failed: %v", err)
+			case (m == nil) != (tt.manifest == ""):
+				t.Fatalf("loadManifest = %+v, want a manifest %v", m, tt.manifest != "")
+			}
+			if problems == nil {
+				return
+			}
+			if len(problems.Problems) != len(tt.wantProblems) {
+				t.Fatalf("problems = %q, want %q", problems.Problems, tt.wantProblems)
+			}
+			for i, want := range tt.wantProblems {
+				if !strings.HasPrefix(problems.Problems[i], want) {
+					t.Errorf("problem %d = %q, want %q", i, problems.Problems[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Phases of a deploy, reported as they start and finish.
+const (
+	phaseBuilding    = "building"    // Compiling the function and building its image
+	phaseScanning    = "scanning"    // Running the configured image scan
+	phaseRegistering = "registering" // Registering the function with the server
+)
+
+// phaseTitles describe the phases on a terminal.
+var phaseTitles = map[string]string{
+	phaseBuilding:    "Compiling and building image",
+	phaseScanning:    "Scanning image",
+	phaseRegistering: "Registering with the server",
+}
+
+// Output formats of the deploy progress, chosen with --output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// spinnerFrames are drawn in turn while a phase runs on a terminal.
+var spinnerFrames = []rune("⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏")
+
+// progressEvent is a machine-readable progress report, one JSON object per line.
+type progressEvent struct {
+	Function   string `json:"function"`
+	Phase      string `json:"phase"`
+	Status     string `json:"status"`                // started, done or failed
+	DurationMs *int64 `json:"duration_ms,omitempty"` // Set once the phase ended
+	Error      string `json:"error,omitempty"`
+}
+
+// progress reports the phases of a deploy: as JSON events in JSON mode, with
+// a spinner when stderr is a terminal, and as log lines otherwise. A nil
+// progress reports nothing.
+type progress struct {
+	format   string    // outputText or outputJSON
+	terminal bool      // Whether to draw a spinner, in text mode
+	out      io.Writer // Where JSON events or the spinner are written
+	log      *logrus.Logger
+}
+
+// newProgress creates a progress reporter for the given output format.
+func newProgress(format string, log *logrus.Logger) (*progress, error) {
+	switch format {
+	case outputJSON:
+		return &progress{format: format, out: os.Stdout, log: log}, nil
+	case outputText:
+		return &progress{format: format, terminal: isTerminal(os.Stderr), out: os.Stderr, log: log}, nil
+	default:
+		return nil, fmt.Errorf("invalid output format %q, expected %s or %s", format, outputText, outputJSON)
+	}
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// quiet reports whether the output of the commands run by the phases is held
+// back, as it would garble the spinner or mix with the JSON events.
+func (p *progress) quiet() bool {
+	return p != nil && (p.format == outputJSON || p.terminal)
+}
+
+// commandOutput returns where a command run by a phase writes its output,
+// and a function to call if the command fails. When the progress is quiet,
+// the output is only shown on failure, so the user can see what went wrong.
+func (p *progress) commandOutput() (io.Writer, func()) {
+	if !p.quiet() {
+		return os.Stderr, func() {}
+	}
+	var buf bytes.Buffer
+	return &buf, func() { os.Stderr.Write(buf.Bytes()) }
+}
+
+// phase runs one phase of the deploy of a function, reporting its start,
+// its end and how long it took.
+func (p *progress) phase(function, name string, run func() error) error {
+	if p == nil {
+		return run()
+	}
+
+	began := time.Now()
+	p.event(progressEvent{Function: function, Phase: name, Status: "started"})
+	stop := p.spin(name, began)
+	err := run()
+	stop()
+
+	duration := time.Since(began).Milliseconds()
+	event := progressEvent{Function: function, Phase: name, Status: "done", DurationMs: &duration}
+	if err != nil {
+		event.Status = "failed"
+		event.Error = err.Error()
+	}
+	p.event(event)
+	return err
+}
+
+// event reports a progress event in the chosen format. The spinner shows
+// phases starting, so in text mode only their end is reported.
+func (p *progress) event(event progressEvent) {
+	switch {
+	case p.format == outputJSON:
+		line, _ := json.Marshal(event) // Safe to ignore error, as the event is controlled
+		fmt.Fprintln(p.out, string(line))
+	case event.Status == "started":
+	case p.terminal:
+		mark := "✓"
+		if event.Status == "failed" {
+			mark = "✗"
+		}
+		fmt.Fprintf(p.out, "\r\033[K%s %s (%s)\n", mark, phaseTitles[event.Phase], time.Duration(*event.DurationMs)*time.Millisecond)
+	default:
+		p.log.WithFields(logrus.Fields{
+			"function":    event.Function,
+			"phase":       event.Phase,
+			"status":      event.Status,
+			"duration_ms": *event.DurationMs,
+		}).Info(phaseTitles[event.Phase])
+	}
+}
+
+// spin draws a spinner for a running phase on the terminal, until the
+// returned function is called.
+func (p *progress) spin(name string, began time.Time) func() {
+	if p.format != outputText || !p.terminal {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for frame := 0; ; frame++ {
+			elapsed := time.Since(began).Truncate(100 * time.Millisecond)
+			fmt.Fprintf(p.out, "\r\033[K%c %s (%s)", spinnerFrames[frame%len(spinnerFrames)], phaseTitles[name], elapsed)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
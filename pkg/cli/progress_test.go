@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeployProgress(t *testing.T) {
+	tests := []struct {
+		name       string
+		scanner    string // Script of the scanner, none when empty
+		status     int    // Status the server registers the function with
+		wantEvents []string
+		wantErr    bool
+	}{
+		{
+			name:   "deployed",
+			status: http.StatusOK,
+			wantEvents: []string{
+				"building started", "building done",
+				"registering started", "registering done",
+			},
+		},
+		{
+			name:    "scanned",
+			scanner: "exit 0",
+			status:  http.StatusOK,
+			wantEvents: []string{
+				"building started", "building done",
+				"scanning started", "scanning done",
+				"registering started", "registering done",
+			},
+		},
+		{
+			name:    "vulnerable image",
+			scanner: "exit 1",
+			wantEvents: []string{
+				"building started", "building done",
+				"scanning started", "scanning failed",
+			},
+			wantErr: true,
+		},
+		{
+			name:   "rejected",
+			status: http.StatusBadRequest,
+			wantEvents: []string{
+				"building started", "building done",
+				"registering started", "registering failed",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFunction(t, "hello")
+			scripts := maps.Clone(buildCommands)
+			config := Config{}
+			if tt.scanner != "" {
+				scripts["scan"] = tt.scanner
+				config.ScanCommand = []string{"scan"}
+			}
+			fakeCommands(t, scripts)
+			server := newFakeServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			})
+			config.ServerAddr = server.Listener.Addr().String()
+			var out bytes.Buffer
+			opts := deployOptions{progress: &progress{format: outputJSON, out: &out, log: testLogger()}}
+
+			err := deployFunction("hello", opts, config, testLogger())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("deployFunction = %v, want error %v", err, tt.wantErr)
+			}
+
+			var events []string
+			scanner := bufio.NewScanner(&out)
+			for scanner.Scan() {
+				var event progressEvent
+				if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+					t.Fatalf("invalid progress event %q: %v", scanner.Text(), err)
+				}
+				if event.Function != "hello" {
+					t.Errorf("event of function %q, want hello", event.Function)
+				}
+				if (event.DurationMs != nil) != (event.Status != "started") {
+					t.Errorf("%s %s event has duration %v, want one once the phase ended", event.Phase, event.Status, event.DurationMs)
+				}
+				if (event.Error != "") != (event.Status == "failed") {
+					t.Errorf("%s %s event has error %q, want one for failures only", event.Phase, event.Status, event.Error)
+				}
+				events = append(events, event.Phase+" "+event.Status)
+			}
+			if !reflect.DeepEqual(events, tt.wantEvents) {
+				t.Errorf("events = %q, want %q", events, tt.wantEvents)
+			}
+		})
+	}
+}
+
+func TestProgressTerminal(t *testing.T) {
+	var out bytes.Buffer
+	p := &progress{format: outputText, terminal: true, out: &out, log: testLogger()}
+	p.phase("hello", phaseBuilding, func() error { return nil })
+	p.phase("hello", phaseRegistering, func() error { return fmt.Errorf("server returned status 500") })
+
+	// Every phase ends its spinner line with its outcome
+	var outcomes []string
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		last := line[strings.LastIndex(line, "\r\033[K")+len("\r\033[K"):]
+		outcomes = append(outcomes, last[:strings.LastIndex(last, " (")])
+	}
+	want := []string{"✓ " + phaseTitles[phaseBuilding], "✗ " + phaseTitles[phaseRegistering]}
+	if !reflect.DeepEqual(outcomes, want) {
+		t.Errorf("outcomes = %q, want %q", outcomes, want)
+	}
+}
+
+func TestNewProgress(t *testing.T) {
+	for _, format := range []string{outputText, outputJSON} {
+		if _, err := newProgress(format, testLogger()); err != nil {
+			t.Errorf("newProgress(%q) failed: %v", format, err)
+		}
+	}
+	if _, err := newProgress("yaml", testLogger()); err == nil {
+		t.Error("newProgress accepted an unknown format")
+	}
+}
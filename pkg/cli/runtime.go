@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// runtimeSources lists, for each runtime the CLI knows, the files in a
+// function's directory that show it's written for that runtime: its sources
+// or its package manifest. Other runtimes aren't checked, as a function's own
+// Dockerfile may build anything.
+var runtimeSources = map[string][]string{
+	"go":     {"*.go", "go.mod"},
+	"python": {"*.py", "requirements.txt", "pyproject.toml"},
+	"node":   {"*.js", "*.mjs", "*.ts", "package.json"},
+	"java":   {"*.java", "pom.xml", "build.gradle", "build.gradle.kts"},
+	"rust":   {"*.rs", "Cargo.toml"},
+	"ruby":   {"*.rb", "Gemfile"},
+}
+
+// checkRuntime makes sure a function's directory holds sources of its declared
+// runtime before building it with the generated Dockerfile, so a mismatch is
+// reported as such rather than as a failing build. The error names the
+// runtime the sources are for, when it can tell.
+func checkRuntime(functionDir, runtime string) error {
+	patterns, known := runtimeSources[runtime]
+	if !known {
+		return nil
+	}
+	found, err := sourcesMatching(functionDir, patterns)
+	if err != nil {
+		return err
+	}
+	if len(found) > 0 {
+		return nil
+	}
+
+	detected := detectRuntimes(functionDir)
+	if len(detected) == 0 {
+		return fmt.Errorf("runtime %s declared, but %s has none of its files (%s)",
+			runtime, functionDir, strings.Join(patterns, ", "))
+	}
+	return fmt.Errorf("runtime %s declared, but %s has %s files, set the runtime to match (e.g. runtime: %s in %s)",
+		runtime, functionDir, strings.Join(detected, " and "), detected[0], manifestFile)
+}
+
+// detectRuntimes returns the known runtimes a function's directory has files
+// of, in a stable order.
+func detectRuntimes(functionDir string) []string {
+	var detected []string
+	for runtime, patterns := range runtimeSources {
+		if found, err := sourcesMatching(functionDir, patterns); err == nil && len(found) > 0 {
+			detected = append(detected, runtime)
+		}
+	}
+	sort.Strings(detected)
+	return detected
+}
+
+// sourcesMatching returns the files directly in dir matching any of the glob
+// patterns.
+func sourcesMatching(dir string, patterns []string) ([]string, error) {
+	var found []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid source pattern %q: %v", pattern, err)
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+				found = append(found, match)
+			}
+		}
+	}
+	return found, nil
+}
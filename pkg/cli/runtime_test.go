@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckRuntime(t *testing.T) {
+	tests := []struct {
+		name    string
+		runtime string
+		files   []string // Created in the function's directory, a trailing / makes a directory
+		wantErr string   // Part of the error expected, empty for none
+	}{
+		{name: "go sources", runtime: "go", files: []string{"main.go"}},
+		{name: "go module only", runtime: "go", files: []string{"go.mod"}},
+		{name: "python manifest", runtime: "python", files: []string{"requirements.txt"}},
+		{name: "node typescript", runtime: "node", files: []string{"index.ts"}},
+		{name: "mixed sources", runtime: "python", files: []string{"main.go", "handler.py"}},
+		{name: "unknown runtime", runtime: "deno", files: []string{"main.go"}},
+		{name: "empty runtime", runtime: "", files: nil},
+		{
+			name:    "other runtime's sources",
+			runtime: "python",
+			files:   []string{"main.go", "go.mod"},
+			wantErr: "has go files, set the runtime to match (e.g. runtime: go in " + manifestFile + ")",
+		},
+		{
+			name:    "several other runtimes",
+			runtime: "rust",
+			files:   []string{"main.go", "index.js"},
+			wantErr: "has go and node files",
+		},
+		{
+			name:    "no sources",
+			runtime: "go",
+			files:   []string{"README.md"},
+			wantErr: "has none of its files (*.go, go.mod)",
+		},
+		{
+			name:    "directory named like a source",
+			runtime: "go",
+			files:   []string{"main.go/"},
+			wantErr: "has none of its files",
+		},
+		{
+			name:    "sources in subdirectories only",
+			runtime: "go",
+			files:   []string{"cmd/", "cmd/main.go"},
+			wantErr: "has none of its files",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, file := range tt.files {
+				path := filepath.Join(dir, file)
+				var err error
+				if strings.HasSuffix(file, "/") {
+					err = os.Mkdir(path, 0755)
+				} else {
+					err = os.WriteFile(path, nil, 0644)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := checkRuntime(dir, tt.runtime)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkRuntime(%s) failed: %v", tt.runtime, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkRuntime(%s) = %v, want an error containing %q", tt.runtime, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// watchDebounce is how long a function's sources must be left alone before
+// it's redeployed, so saving several files at once triggers a single deploy.
+const watchDebounce = 500 * time.Millisecond
+
+// watchFunction calls redeploy whenever the sources in functionDir change,
+// until ctx is done. Changes are debounced by quiet.
+func watchFunction(ctx context.Context, functionDir string, quiet time.Duration, redeploy func(), log *logrus.Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch function sources: %v", err)
+	}
+	defer watcher.Close()
+	if err := watchTree(watcher, functionDir); err != nil {
+		return err
+	}
+
+	// The timer is only armed while changes are pending
+	timer := time.NewTimer(quiet)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op == fsnotify.Chmod || ignoredSource(event.Name) {
+				continue
+			}
+			// fsnotify doesn't watch recursively, so new directories are added
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := watchTree(watcher, event.Name); err != nil {
+						log.WithError(err).Warn("Failed to watch new directory")
+					}
+				}
+			}
+			log.WithField("file", event.Name).Debug("Function source changed")
+			timer.Reset(quiet)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.WithError(err).Warn("Error watching function sources")
+		case <-timer.C:
+			redeploy()
+		}
+	}
+}
+
+// watchTree adds a directory and all its subdirectories to the watcher.
+func watchTree(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != dir && ignoredSource(path) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			return fmt.Errorf("failed to watch %s: %v", path, err)
+		}
+		return nil
+	})
+}
+
+// ignoredSource reports whether a changed file isn't a source of the
+// function: hidden files, such as the deploy lock, and editor backup files.
+func ignoredSource(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~")
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFunction(t *testing.T) {
+	const quiet = 50 * time.Millisecond
+	tests := []struct {
+		name          string
+		change        func(t *testing.T, dir string)
+		wantRedeploys int
+	}{
+		{
+			name: "edit",
+			change: func(t *testing.T, dir string) {
+				writeFile(t, filepath.Join(dir, "main.go"), "package main // edited")
+			},
+			wantRedeploys: 1,
+		},
+		{
+			name: "burst of saves",
+			change: func(t *testing.T, dir string) {
+				for i := range 5 {
+					writeFile(t, filepath.Join(dir, "main.go"), "package main // edit "+string(rune('a'+i)))
+					time.Sleep(quiet / 5)
+				}
+				writeFile(t, filepath.Join(dir, "util.go"), "package main")
+			},
+			wantRedeploys: 1,
+		},
+		{
+			name: "new directory",
+			change: func(t *testing.T, dir string) {
+				if err := os.Mkdir(filepath.Join(dir, "internal"), 0755); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(2 * quiet) // Let the watcher add it
+				writeFile(t, filepath.Join(dir, "internal", "util.go"), "package internal")
+			},
+			wantRedeploys: 2, // Creating the directory is a change too
+		},
+		{
+			name: "Dockerfile",
+			change: func(t *testing.T, dir string) {
+				writeFile(t, filepath.Join(dir, "Dockerfile"), "FROM scratch")
+			},
+			wantRedeploys: 1,
+		},
+		{
+			name: "lock and editor files",
+			change: func(t *testing.T, dir string) {
+				writeFile(t, filepath.Join(dir, lockFileName), "{}")
+				writeFile(t, filepath.Join(dir, ".main.go.swp"), "")
+				writeFile(t, filepath.Join(dir, "main.go~"), "")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeFile(t, filepath.Join(dir, "main.go"), "package main")
+			redeploys := make(chan struct{}, 10)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- watchFunction(ctx, dir, quiet, func() { redeploys <- struct{}{} }, testLogger())
+			}()
+			time.Sleep(quiet) // Let the watcher start
+
+			tt.change(t, dir)
+			time.Sleep(5 * quiet)
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("watchFunction failed: %v", err)
+			}
+			if got := len(redeploys); got != tt.wantRedeploys {
+				t.Errorf("redeployed %d times, want %d", got, tt.wantRedeploys)
+			}
+		})
+	}
+}
+
+func TestWatchFunctionMissing(t *testing.T) {
+	err := watchFunction(context.Background(), filepath.Join(t.TempDir(), "missing"), time.Millisecond, func() {}, testLogger())
+	if err == nil {
+		t.Error("watching a missing function succeeded")
+	}
+}
+
+// writeFile writes a file, failing the test on error.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
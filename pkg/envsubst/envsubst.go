@@ -0,0 +1,88 @@
+// This package expands environment variable references in configuration files, so secrets and
+// per-host settings can be kept out of the files themselves.
+package envsubst
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ExpandYAML replaces $VAR and ${VAR} references in the values of a YAML
+// document with the values of the environment variables, and returns the
+// document. Keys and comments are left alone. ${VAR:-default} uses the
+// default when the variable is unset or empty, and $$ is a literal $. An
+// unquoted value is typed once expanded, e.g. "port: ${PORT}" is a number.
+// Referencing an unset variable without a default is an error, so a missing
+// secret doesn't silently become an empty value.
+func ExpandYAML(data []byte) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %v", err)
+	}
+	if document.Kind == 0 {
+		// Empty, nothing to expand
+		return data, nil
+	}
+
+	missing := make(map[string]bool)
+	expandNode(&document, missing)
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("environment variables not set: %s", strings.Join(names, ", "))
+	}
+	return yaml.Marshal(&document)
+}
+
+// expandNode expands the references in the scalar values under node,
+// recording the variables that aren't set in missing.
+func expandNode(node *yaml.Node, missing map[string]bool) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		// Keys and values alternate, only the values are expanded
+		for i := 1; i < len(node.Content); i += 2 {
+			expandNode(node.Content[i], missing)
+		}
+	case yaml.ScalarNode:
+		expanded := expand(node.Value, missing)
+		if expanded == node.Value {
+			return
+		}
+		node.Value = expanded
+		if node.Style == 0 {
+			// Plain values are typed by what they expanded to
+			node.Tag = ""
+		}
+	default:
+		for _, child := range node.Content {
+			expandNode(child, missing)
+		}
+	}
+}
+
+// expand replaces the references in a value, recording the variables that
+// aren't set in missing.
+func expand(value string, missing map[string]bool) string {
+	return os.Expand(value, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+
+		name, fallback, hasDefault := strings.Cut(name, ":-")
+		value, ok := os.LookupEnv(name)
+		if hasDefault && value == "" {
+			return fallback
+		}
+		if !ok {
+			missing[name] = true
+		}
+		return value
+	})
+}
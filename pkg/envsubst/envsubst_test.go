@@ -0,0 +1,134 @@
+package envsubst
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestExpandYAML(t *testing.T) {
+	t.Setenv("ENVSUBST_HOST", "db.internal")
+	t.Setenv("ENVSUBST_PORT", "5432")
+	t.Setenv("ENVSUBST_EMPTY", "")
+	t.Setenv("ENVSUBST_QUOTE", `pa"ss: word`)
+
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]any
+	}{
+		{
+			name:  "braced and bare references",
+			input: "url: postgres://${ENVSUBST_HOST}:$ENVSUBST_PORT/app\n",
+			want:  map[string]any{"url": "postgres://db.internal:5432/app"},
+		},
+		{
+			name:  "plain value typed once expanded",
+			input: "port: ${ENVSUBST_PORT}\n",
+			want:  map[string]any{"port": 5432},
+		},
+		{
+			name:  "quoted value stays a string",
+			input: "port: \"${ENVSUBST_PORT}\"\n",
+			want:  map[string]any{"port": "5432"},
+		},
+		{
+			name:  "default for an unset variable",
+			input: "host: ${ENVSUBST_UNSET:-localhost}\n",
+			want:  map[string]any{"host": "localhost"},
+		},
+		{
+			name:  "default for an empty variable",
+			input: "host: ${ENVSUBST_EMPTY:-localhost}\n",
+			want:  map[string]any{"host": "localhost"},
+		},
+		{
+			name:  "default ignored when set",
+			input: "host: ${ENVSUBST_HOST:-localhost}\n",
+			want:  map[string]any{"host": "db.internal"},
+		},
+		{
+			name:  "empty variable without default",
+			input: "token: \"${ENVSUBST_EMPTY}\"\n",
+			want:  map[string]any{"token": ""},
+		},
+		{
+			name:  "escaped dollar",
+			input: "price: \"$$5\"\n",
+			want:  map[string]any{"price": "$5"},
+		},
+		{
+			name:  "value with YAML syntax",
+			input: "password: ${ENVSUBST_QUOTE}\n",
+			want:  map[string]any{"password": `pa"ss: word`},
+		},
+		{
+			name:  "keys left alone",
+			input: "${ENVSUBST_HOST}: x\n",
+			want:  map[string]any{"${ENVSUBST_HOST}": "x"},
+		},
+		{
+			name:  "nested values and sequences",
+			input: "db:\n  hosts:\n    - ${ENVSUBST_HOST}\n    - other\n",
+			want:  map[string]any{"db": map[string]any{"hosts": []any{"db.internal", "other"}}},
+		},
+		{
+			name:  "comments left alone",
+			input: "# uses $ENVSUBST_UNSET\nhost: x\n",
+			want:  map[string]any{"host": "x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expanded, err := ExpandYAML([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("ExpandYAML failed: %v", err)
+			}
+			var got map[string]any
+			if err := yaml.Unmarshal(expanded, &got); err != nil {
+				t.Fatalf("the expanded document isn't YAML: %v\n%s", err, expanded)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExpandYAML(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandYAMLEmpty(t *testing.T) {
+	for _, input := range []string{"", "# only a comment\n"} {
+		expanded, err := ExpandYAML([]byte(input))
+		if err != nil {
+			t.Fatalf("ExpandYAML(%q) failed: %v", input, err)
+		}
+		if string(expanded) != input {
+			t.Errorf("ExpandYAML(%q) = %q, want it unchanged", input, expanded)
+		}
+	}
+}
+
+func TestExpandYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr string
+	}{
+		{name: "invalid YAML", input: "a: [\n", wantErr: "invalid YAML"},
+		{name: "unset variable", input: "token: ${ENVSUBST_UNSET}\n", wantErr: "ENVSUBST_UNSET"},
+		{
+			name:    "every unset variable listed once",
+			input:   "a: $ENVSUBST_UNSET_B\nb: ${ENVSUBST_UNSET_A}\nc: $ENVSUBST_UNSET_B\n",
+			wantErr: "environment variables not set: ENVSUBST_UNSET_A, ENVSUBST_UNSET_B",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ExpandYAML([]byte(tt.input))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ExpandYAML(%q) = %v, want an error containing %q", tt.input, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Package functionio lists the formats of the events and outputs of functions
+// and the destinations of their stderr, so the CLI checks manifests against
+// the same values the server accepts.
+package functionio
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Formats of the events written to a function's stdin and of the output it
+// writes, see storage.Function.EventFormat and ResponseFormat.
+const (
+	FormatJSON    = "json"    // JSON, passed through as-is (the default)
+	FormatMsgpack = "msgpack" // MessagePack, transcoded from and to JSON by the server
+	FormatRaw     = "raw"     // Bytes passed through without being interpreted
+)
+
+// Formats are the event and response formats, to list in messages.
+var Formats = []string{FormatJSON, FormatMsgpack, FormatRaw}
+
+// ValidFormat reports whether format is an event or response format,
+// empty meaning JSON.
+func ValidFormat(format string) bool {
+	switch format {
+	case "", FormatJSON, FormatMsgpack, FormatRaw:
+		return true
+	}
+	return false
+}
+
+// Destinations of the stderr of functions, see storage.Function.LogDestination.
+const (
+	LogToServer = "log"    // The server's logs, at debug level (the default)
+	LogToStdout = "stdout" // The server's stdout, as JSON lines
+	LogToNone   = "none"   // Discarded
+	LogToFile   = "file:"  // Prefix of a file in the function log directory, appended to as JSON lines
+)
+
+// ValidLogDestination reports whether destination is a destination of stderr:
+// empty, log, stdout, none, or file: followed by a path relative to the
+// function log directory, which can't leave it.
+func ValidLogDestination(destination string) bool {
+	switch destination {
+	case "", LogToServer, LogToStdout, LogToNone:
+		return true
+	}
+	path, ok := strings.CutPrefix(destination, LogToFile)
+	return ok && filepath.IsLocal(path)
+}
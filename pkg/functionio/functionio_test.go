@@ -0,0 +1,53 @@
+package functionio
+
+import "testing"
+
+func TestValidFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		want   bool
+	}{
+		{format: "", want: true},
+		{format: FormatJSON, want: true},
+		{format: FormatMsgpack, want: true},
+		{format: FormatRaw, want: true},
+		{format: "JSON"},
+		{format: "xml"},
+		{format: "json "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if got := ValidFormat(tt.format); got != tt.want {
+				t.Errorf("ValidFormat(%q) = %v, want %v", tt.format, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidLogDestination(t *testing.T) {
+	tests := []struct {
+		destination string
+		want        bool
+	}{
+		{destination: "", want: true},
+		{destination: LogToServer, want: true},
+		{destination: LogToStdout, want: true},
+		{destination: LogToNone, want: true},
+		{destination: "file:hello.log", want: true},
+		{destination: "file:functions/hello.log", want: true},
+		{destination: "file:"},
+		{destination: "file:/var/log/hello.log"},
+		{destination: "file:../hello.log"},
+		{destination: "file:logs/../../hello.log"},
+		{destination: "stderr"},
+		{destination: "LOG"},
+		{destination: "/var/log/hello.log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			if got := ValidLogDestination(tt.destination); got != tt.want {
+				t.Errorf("ValidLogDestination(%q) = %v, want %v", tt.destination, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+// This package configures the platform's loggers: their level, and the files logs are written to
+// next to the console.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ParseLevel parses a log level name, e.g. "debug" or "warn".
+func ParseLevel(name string) (logrus.Level, error) {
+	level, err := logrus.ParseLevel(name)
+	if err != nil {
+		return 0, fmt.Errorf("invalid log level %q, expected one of panic, fatal, error, warn, info, debug, trace", name)
+	}
+	return level, nil
+}
+
+// SetLevel sets the level of a logger by name.
+func SetLevel(log *logrus.Logger, name string) error {
+	level, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	return nil
+}
+
+// AddFile makes a logger write to the file at path as well, appending to it.
+// The returned file is closed by the caller once logging is done.
+func AddFile(log *logrus.Logger, path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+	log.SetOutput(io.MultiWriter(log.Out, file))
+	return file, nil
+}
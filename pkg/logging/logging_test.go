@@ -0,0 +1,117 @@
+package logging
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    logrus.Level
+		wantErr bool
+	}{
+		{name: "trace", want: logrus.TraceLevel},
+		{name: "debug", want: logrus.DebugLevel},
+		{name: "info", want: logrus.InfoLevel},
+		{name: "warn", want: logrus.WarnLevel},
+		{name: "warning", want: logrus.WarnLevel},
+		{name: "error", want: logrus.ErrorLevel},
+		{name: "DEBUG", want: logrus.DebugLevel},
+		{name: "verbose", wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLevel(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLevel(%q) = %v, want error %v", tt.name, err, tt.wantErr)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), "debug") {
+					t.Errorf("error %q doesn't list the valid levels", err)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("ParseLevel(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	tests := []struct {
+		level     string
+		wantDebug bool
+		wantInfo  bool
+	}{
+		{level: "debug", wantDebug: true, wantInfo: true},
+		{level: "info", wantInfo: true},
+		{level: "warn"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			var out bytes.Buffer
+			log := logrus.New()
+			log.SetOutput(&out)
+			if err := SetLevel(log, tt.level); err != nil {
+				t.Fatalf("SetLevel failed: %v", err)
+			}
+
+			log.Debug("debug message")
+			log.Info("info message")
+			if got := strings.Contains(out.String(), "debug message"); got != tt.wantDebug {
+				t.Errorf("debug message logged = %v, want %v", got, tt.wantDebug)
+			}
+			if got := strings.Contains(out.String(), "info message"); got != tt.wantInfo {
+				t.Errorf("info message logged = %v, want %v", got, tt.wantInfo)
+			}
+		})
+	}
+
+	log := logrus.New()
+	if err := SetLevel(log, "loud"); err == nil {
+		t.Error("SetLevel accepted an invalid level")
+	}
+	if log.GetLevel() != logrus.InfoLevel {
+		t.Errorf("level = %v after an invalid level, want it unchanged", log.GetLevel())
+	}
+}
+
+func TestAddFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serverless.log")
+	if err := os.WriteFile(path, []byte("earlier\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var console bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&console)
+	file, err := AddFile(log, path)
+	if err != nil {
+		t.Fatalf("AddFile failed: %v", err)
+	}
+	log.Info("to both")
+	file.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "earlier\n") || !strings.Contains(string(data), "to both") {
+		t.Errorf("log file = %q, want the message appended", data)
+	}
+	if !strings.Contains(console.String(), "to both") {
+		t.Errorf("console = %q, want the message there too", console.String())
+	}
+
+	if _, err := AddFile(log, filepath.Join(t.TempDir(), "missing", "serverless.log")); err == nil {
+		t.Error("AddFile succeeded in a missing directory")
+	}
+}
@@ -0,0 +1,372 @@
+// Package msgpack transcodes between JSON and MessagePack, for functions that
+// take their events or write their output as MessagePack. Only the types JSON
+// can represent are supported: binary strings decode to base64 strings, like
+// encoding/json does with byte slices, and extension types are rejected.
+package msgpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// maxDepth bounds the nesting of decoded arrays and maps.
+const maxDepth = 1000
+
+// errTruncated is returned when a MessagePack document ends early.
+var errTruncated = errors.New("unexpected end of MessagePack data")
+
+// FromJSON encodes a JSON document as MessagePack. Numbers are encoded as the
+// smallest integer type holding them, or as a float64. Object keys are
+// encoded in sorted order, so equal documents encode the same.
+func FromJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON: trailing data after the document")
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ToJSON decodes a single MessagePack document into JSON.
+func ToJSON(data []byte) ([]byte, error) {
+	d := &decoder{data: data}
+	value, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("trailing data after the MessagePack document")
+	}
+	out, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode JSON: %v", err)
+	}
+	return out, nil
+}
+
+// encode appends the MessagePack encoding of a decoded JSON value.
+func encode(buf *bytes.Buffer, value any) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		return encodeNumber(buf, v)
+	case string:
+		encodeString(buf, v)
+	case []any:
+		encodeLength(buf, len(v), 0x90, 15, 0xdc)
+		for _, item := range v {
+			if err := encode(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		encodeLength(buf, len(v), 0x80, 15, 0xde)
+		for _, key := range keys {
+			encodeString(buf, key)
+			if err := encode(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported JSON value of type %T", value)
+	}
+	return nil
+}
+
+// encodeNumber encodes a JSON number as an integer when it is one, or else as
+// a float64.
+func encodeNumber(buf *bytes.Buffer, n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		encodeInt(buf, i)
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		buf.WriteByte(0xcf)
+		buf.Write(binary.BigEndian.AppendUint64(nil, u))
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %s: %v", n, err)
+	}
+	buf.WriteByte(0xcb)
+	buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+	return nil
+}
+
+// encodeInt encodes an integer in its smallest representation.
+func encodeInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(i)})
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(i)))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	case i >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(i)})
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(i)))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+	default:
+		buf.WriteByte(0xd3)
+		buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+}
+
+// encodeString encodes a UTF-8 string.
+func encodeString(buf *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n <= 31:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(0xdb)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+	buf.WriteString(s)
+}
+
+// encodeLength encodes the length of an array or map: in the fixed format
+// up to fixMax, or else with a 16 or 32 bit length (code16 and code16+1).
+func encodeLength(buf *bytes.Buffer, n int, fixCode byte, fixMax int, code16 byte) {
+	switch {
+	case n <= fixMax:
+		buf.WriteByte(fixCode | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(code16 + 1)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+// decoder reads MessagePack values into the types encoding/json marshals.
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+// next returns the following n bytes.
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (d *decoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// decode reads the next value.
+func (d *decoder) decode(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("MessagePack data nested too deeply")
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	code := b[0]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return d.decodeMap(int(code&0x0f), depth)
+	case code&0xf0 == 0x90:
+		return d.decodeArray(int(code&0x0f), depth)
+	case code&0xe0 == 0xa0:
+		return d.decodeString(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.next(int(n))
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Clone(data), nil
+	case 0xca:
+		bits, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return finite(float64(math.Float32frombits(uint32(bits))))
+	case 0xcb:
+		bits, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return finite(math.Float64frombits(bits))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (code - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		u, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign-extend from the encoded size
+		shift := 64 - 8*size
+		return int64(u<<shift) >> shift, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n), depth)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xc7, 0xc8, 0xc9:
+		return nil, fmt.Errorf("unsupported MessagePack extension type")
+	}
+	return nil, fmt.Errorf("invalid MessagePack type code 0x%02x", code)
+}
+
+// decodeString reads a string of n bytes.
+func (d *decoder) decodeString(n int) (string, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeArray reads n values.
+func (d *decoder) decodeArray(n int, depth int) ([]any, error) {
+	// Every value takes at least a byte, which bounds what a bogus length
+	// can make us allocate
+	if n > len(d.data)-d.pos {
+		return nil, errTruncated
+	}
+	values := make([]any, 0, n)
+	for i := 0; i < n; i++ {
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// decodeMap reads n key-value pairs. Keys that aren't strings are formatted
+// as strings, as JSON object keys must be.
+func (d *decoder) decodeMap(n int, depth int) (map[string]any, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, errTruncated
+	}
+	values := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case string:
+			values[k] = value
+		case []any, map[string]any:
+			return nil, fmt.Errorf("unsupported MessagePack map key of type %T", key)
+		default:
+			values[fmt.Sprint(k)] = value
+		}
+	}
+	return values, nil
+}
+
+// finite rejects the floats JSON can't represent.
+func finite(f float64) (any, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("MessagePack float %v can't be represented in JSON", f)
+	}
+	return f, nil
+}
@@ -0,0 +1,162 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string // Expected JSON after the round trip, when it differs
+	}{
+		{name: "null", json: `null`},
+		{name: "booleans", json: `[true,false]`},
+		{name: "positive fixint", json: `127`},
+		{name: "negative fixint", json: `-32`},
+		{name: "uint8", json: `255`},
+		{name: "uint16", json: `65535`},
+		{name: "uint32", json: `4294967295`},
+		{name: "int64", json: `9223372036854775807`},
+		{name: "uint64", json: `18446744073709551615`},
+		{name: "int8", json: `-128`},
+		{name: "int16", json: `-32768`},
+		{name: "int32", json: `-2147483648`},
+		{name: "min int64", json: `-9223372036854775808`},
+		{name: "float", json: `1.5`},
+		{name: "exponent", json: `1e300`, want: `1e+300`},
+		{name: "empty string", json: `""`},
+		{name: "str8", json: `"` + strings.Repeat("a", 200) + `"`},
+		{name: "str16", json: `"` + strings.Repeat("b", 70000) + `"`},
+		{name: "unicode", json: `"héllo, 世界"`},
+		{name: "nested", json: `{"a":[1,{"b":null}],"c":"d"}`},
+		{name: "keys sorted", json: `{"b":1,"a":2}`, want: `{"a":2,"b":1}`},
+		{name: "array16", json: `[` + strings.Repeat(`0,`, 20) + `0]`},
+		{name: "whitespace", json: " {\"a\" : 1} \n", want: `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := FromJSON([]byte(tt.json))
+			if err != nil {
+				t.Fatalf("FromJSON(%.40s) failed: %v", tt.json, err)
+			}
+			decoded, err := ToJSON(encoded)
+			if err != nil {
+				t.Fatalf("ToJSON failed: %v", err)
+			}
+			want := tt.want
+			if want == "" {
+				want = tt.json
+			}
+			if string(decoded) != want {
+				t.Errorf("round trip of %.40s gave %.40s", tt.json, decoded)
+			}
+		})
+	}
+}
+
+func TestFromJSONEncoding(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want string // Hex of the MessagePack encoding
+	}{
+		{name: "positive fixint", json: `1`, want: "01"},
+		{name: "negative fixint", json: `-1`, want: "ff"},
+		{name: "uint8", json: `200`, want: "ccc8"},
+		{name: "int8", json: `-100`, want: "d09c"},
+		{name: "uint16", json: `256`, want: "cd0100"},
+		{name: "float64", json: `0.5`, want: "cb3fe0000000000000"},
+		{name: "fixstr", json: `"hi"`, want: "a26869"},
+		{name: "fixarray", json: `[1,2]`, want: "920102"},
+		{name: "fixmap", json: `{"a":true}`, want: "81a161c3"},
+		{name: "nil", json: `null`, want: "c0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := FromJSON([]byte(tt.json))
+			if err != nil {
+				t.Fatalf("FromJSON(%s) failed: %v", tt.json, err)
+			}
+			if got := hex.EncodeToString(encoded); got != tt.want {
+				t.Errorf("FromJSON(%s) = %s, want %s", tt.json, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{name: "empty", json: ``},
+		{name: "invalid", json: `{"a":}`},
+		{name: "trailing data", json: `{} {}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := FromJSON([]byte(tt.json)); err == nil {
+				t.Errorf("FromJSON(%q) succeeded, want an error", tt.json)
+			}
+		})
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		data string // Hex of the MessagePack document
+		want string
+	}{
+		{name: "float32", data: "ca3fc00000", want: `1.5`},
+		{name: "bin8 as base64", data: "c403010203", want: `"AQID"`},
+		{name: "integer map key", data: "8101a178", want: `{"1":"x"}`},
+		{name: "boolean map key", data: "81c3c0", want: `{"true":null}`},
+		{name: "map16", data: "de0001a16101", want: `{"a":1}`},
+		{name: "array32", data: "dd0000000107", want: `[7]`},
+		{name: "str8", data: "d903616263", want: `"abc"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.data)
+			got, err := ToJSON(data)
+			if err != nil {
+				t.Fatalf("ToJSON(%s) failed: %v", tt.data, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("ToJSON(%s) = %s, want %s", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "truncated string", data: []byte{0xa5, 'a'}},
+		{name: "truncated uint16", data: []byte{0xcd, 0x01}},
+		{name: "bogus array length", data: []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{name: "bogus map length", data: []byte{0xdf, 0xff, 0xff, 0xff, 0xff}},
+		{name: "trailing data", data: []byte{0x01, 0x02}},
+		{name: "extension", data: []byte{0xd4, 0x01, 0x00}},
+		{name: "never used code", data: []byte{0xc1}},
+		{name: "NaN", data: []byte{0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1}},
+		{name: "infinity", data: []byte{0xca, 0x7f, 0x80, 0, 0}},
+		{name: "array map key", data: []byte{0x81, 0x90, 0x01}},
+		{name: "nested too deeply", data: append(bytes.Repeat([]byte{0x91}, maxDepth+2), 0x01)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := ToJSON(tt.data); err == nil {
+				t.Errorf("ToJSON(%x) = %s, want an error", tt.data, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/errdefs"
+	"github.com/sirupsen/logrus"
+)
+
+// ContainerInfo describes a container created for a function.
+type ContainerInfo struct {
+	ID         string    `json:"id"`
+	Function   string    `json:"function"`
+	Invocation string    `json:"invocation,omitempty"`
+	Version    string    `json:"version,omitempty"` // Image digest of the revision it runs
+	Image      string    `json:"image"`
+	State      string    `json:"state"`  // e.g. running, exited
+	Status     string    `json:"status"` // Human-readable, e.g. "Up 3 seconds"
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ListContainers lists the containers created for functions, running or
+// not, oldest first. Containers are removed after their invocation, so
+// long-lived ones point at stuck invocations or failed cleanups.
+func (o *Orchestrator) ListContainers(ctx context.Context) ([]ContainerInfo, error) {
+	apiCtx, cancel := o.apiContext(ctx)
+	defer cancel()
+	containers, err := o.listManagedContainers(apiCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]ContainerInfo, 0, len(containers))
+	for _, c := range containers {
+		infos = append(infos, ContainerInfo{
+			ID:         c.ID,
+			Function:   c.Labels[LabelFunction],
+			Invocation: c.Labels[LabelInvocation],
+			Version:    c.Labels[LabelVersion],
+			Image:      c.Labels[LabelImage],
+			State:      c.State,
+			Status:     c.Status,
+			CreatedAt:  time.Unix(c.Created, 0).UTC(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.Before(infos[j].CreatedAt)
+	})
+	return infos, nil
+}
+
+// ContainerPruneReport summarizes a removal of stopped function containers.
+type ContainerPruneReport struct {
+	Removed        []string `json:"removed"`         // IDs of the removed containers
+	SpaceReclaimed uint64   `json:"space_reclaimed"` // Bytes of their writable layers
+}
+
+// prunableStates are the states of function containers that no invocation
+// uses anymore: never started, exited, or failed to be removed.
+var prunableStates = []string{"created", "exited", "dead"}
+
+// pruneMinAge spares recent containers from pruning, as their invocation may
+// be about to start or remove them.
+const pruneMinAge = time.Minute
+
+// PruneContainers removes the function containers that aren't running, e.g.
+// left behind when the server crashed mid-invocation. Only containers with
+// the function label are considered, so other containers are never touched,
+// and running or recent ones are left to their invocation.
+func (o *Orchestrator) PruneContainers(ctx context.Context) (*ContainerPruneReport, error) {
+	args := filters.NewArgs(filters.Arg("label", LabelFunction))
+	for _, state := range prunableStates {
+		args.Add("status", state)
+	}
+	listCtx, cancel := o.apiContext(ctx)
+	containers, err := o.docker.ContainerList(listCtx, container.ListOptions{All: true, Size: true, Filters: args})
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+
+	report := &ContainerPruneReport{Removed: []string{}}
+	cutoff := time.Now().Add(-pruneMinAge)
+	for _, c := range containers {
+		if time.Unix(c.Created, 0).After(cutoff) {
+			continue
+		}
+		// Not forced, so a container started meanwhile isn't killed
+		removeCtx, cancel := o.apiContext(ctx)
+		err := o.docker.ContainerRemove(removeCtx, c.ID, container.RemoveOptions{})
+		cancel()
+		if err != nil && !errdefs.IsNotFound(err) {
+			o.log.WithError(err).WithField("container", c.ID).Warn("Failed to remove container")
+			continue
+		}
+		report.Removed = append(report.Removed, c.ID)
+		if c.SizeRw > 0 {
+			report.SpaceReclaimed += uint64(c.SizeRw)
+		}
+	}
+
+	o.log.WithFields(logrus.Fields{
+		"removed":         len(report.Removed),
+		"space_reclaimed": report.SpaceReclaimed,
+	}).Info("Containers pruned")
+	return report, nil
+}
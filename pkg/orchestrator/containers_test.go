@@ -0,0 +1,91 @@
+package orchestrator
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestListContainers(t *testing.T) {
+	docker := &fakeDocker{containers: []container.Summary{
+		{
+			ID:      "newer",
+			Created: 200,
+			State:   "running",
+			Status:  "Up 3 seconds",
+			Labels:  map[string]string{LabelFunction: "hello", LabelVersion: "sha256:abc", LabelImage: "app:1", LabelInvocation: "inv-2"},
+		},
+		{
+			ID:      "older",
+			Created: 100,
+			State:   "exited",
+			Labels:  map[string]string{LabelFunction: "other", LabelImage: "app:2"},
+		},
+	}}
+	o := newTestOrchestrator(docker, Config{})
+
+	infos, err := o.ListContainers(context.Background())
+	if err != nil {
+		t.Fatalf("ListContainers failed: %v", err)
+	}
+	if !docker.listFilter.ExactMatch("label", LabelFunction) {
+		t.Errorf("listed with filters %v, want the containers with the function label", docker.listFilter)
+	}
+	if len(infos) != 2 || infos[0].ID != "older" || infos[1].ID != "newer" {
+		t.Fatalf("containers = %+v, want older then newer", infos)
+	}
+	want := ContainerInfo{
+		ID:         "newer",
+		Function:   "hello",
+		Invocation: "inv-2",
+		Version:    "sha256:abc",
+		Image:      "app:1",
+		State:      "running",
+		Status:     "Up 3 seconds",
+		CreatedAt:  time.Unix(200, 0).UTC(),
+	}
+	if infos[1] != want {
+		t.Errorf("container = %+v, want %+v", infos[1], want)
+	}
+	if infos[0].Invocation != "" || infos[0].Version != "" {
+		t.Errorf("container without invocation and version labels reports %+v", infos[0])
+	}
+}
+
+func TestPruneContainers(t *testing.T) {
+	old := time.Now().Add(-time.Hour).Unix()
+	docker := &fakeDocker{containers: []container.Summary{
+		{ID: "exited", Created: old, State: "exited", SizeRw: 2048, Labels: map[string]string{LabelFunction: "hello"}},
+		{ID: "recent", Created: time.Now().Unix(), State: "created", SizeRw: 512, Labels: map[string]string{LabelFunction: "hello"}},
+		{ID: "dead", Created: old, State: "dead", Labels: map[string]string{LabelFunction: "other"}},
+	}}
+	o := newTestOrchestrator(docker, Config{})
+
+	report, err := o.PruneContainers(context.Background())
+	if err != nil {
+		t.Fatalf("PruneContainers failed: %v", err)
+	}
+	if !docker.listFilter.ExactMatch("label", LabelFunction) {
+		t.Errorf("listed with filters %v, want the containers with the function label", docker.listFilter)
+	}
+	for _, state := range []string{"created", "exited", "dead"} {
+		if !docker.listFilter.ExactMatch("status", state) {
+			t.Errorf("listed with filters %v, want %s containers", docker.listFilter, state)
+		}
+	}
+	if docker.listFilter.ExactMatch("status", "running") {
+		t.Errorf("listed with filters %v, want running containers spared", docker.listFilter)
+	}
+	if want := []string{"exited", "dead"}; !slices.Equal(report.Removed, want) || !slices.Equal(docker.removed, want) {
+		t.Errorf("removed %q (reported %q), want %q", docker.removed, report.Removed, want)
+	}
+	if docker.removeForced {
+		t.Error("containers were removed by force")
+	}
+	if report.SpaceReclaimed != 2048 {
+		t.Errorf("space reclaimed = %d, want 2048", report.SpaceReclaimed)
+	}
+}
@@ -0,0 +1,44 @@
+package orchestrator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Container engines the orchestrator can run functions on. Podman serves a
+// Docker-compatible API, so both are driven by the same client.
+const (
+	EngineDocker = "docker"
+	EnginePodman = "podman"
+)
+
+// ValidEngine reports whether the orchestrator supports a container engine.
+func ValidEngine(engine string) bool {
+	return engine == EngineDocker || engine == EnginePodman
+}
+
+// engineHost returns the default API address of a container engine.
+func engineHost(engine string) (string, error) {
+	switch engine {
+	case "", EngineDocker:
+		return "", nil // The client's default
+	case EnginePodman:
+		return podmanSocket(), nil
+	default:
+		return "", fmt.Errorf("unsupported container engine %q, expected %s or %s", engine, EngineDocker, EnginePodman)
+	}
+}
+
+// podmanSocket returns the address of the Podman API socket: the system
+// one for root, and the user's one for rootless Podman.
+func podmanSocket() string {
+	if os.Getuid() == 0 {
+		return "unix:///run/podman/podman.sock"
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = fmt.Sprintf("/run/user/%d", os.Getuid())
+	}
+	return "unix://" + filepath.Join(runtimeDir, "podman", "podman.sock")
+}
@@ -0,0 +1,41 @@
+package orchestrator
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEngineHost(t *testing.T) {
+	// Root talks to the system socket, other users to their own
+	podman := "unix:///run/user/1000/podman/podman.sock"
+	if os.Getuid() == 0 {
+		podman = "unix:///run/podman/podman.sock"
+	}
+
+	tests := []struct {
+		name      string
+		engine    string
+		want      string
+		wantValid bool
+	}{
+		{name: "default", want: ""},
+		{name: "docker", engine: EngineDocker, want: "", wantValid: true},
+		{name: "podman", engine: EnginePodman, want: podman, wantValid: true},
+		{name: "unknown", engine: "containerd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+			host, err := engineHost(tt.engine)
+			if wantErr := tt.engine != "" && !tt.wantValid; (err != nil) != wantErr {
+				t.Fatalf("engineHost = %v, want error %v", err, wantErr)
+			}
+			if host != tt.want {
+				t.Errorf("host = %q, want %q", host, tt.want)
+			}
+			if valid := ValidEngine(tt.engine); valid != tt.wantValid {
+				t.Errorf("ValidEngine(%q) = %v, want %v", tt.engine, valid, tt.wantValid)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package orchestrator
+
+import (
+	"fmt"
+
+	"github.com/akos011221/serverless/pkg/functionio"
+	"github.com/akos011221/serverless/pkg/msgpack"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// EventFormatError is returned when an event can't be encoded in the format
+// its function takes, e.g. an event that isn't JSON for a MessagePack function.
+type EventFormatError struct {
+	Format string
+	Err    error
+}
+
+func (e *EventFormatError) Error() string {
+	return fmt.Sprintf("event can't be delivered as %s: %v", e.Format, e.Err)
+}
+
+// OutputFormatError is returned when a function's output isn't in the format
+// it declares.
+type OutputFormatError struct {
+	Format string
+	Err    error
+}
+
+func (e *OutputFormatError) Error() string {
+	return fmt.Sprintf("function output is not valid %s: %v", e.Format, e.Err)
+}
+
+// encodeEvent encodes an event for a function's stdin.
+func encodeEvent(function *storage.Function, event []byte) ([]byte, error) {
+	if function.EventFormat != functionio.FormatMsgpack {
+		return event, nil
+	}
+	encoded, err := msgpack.FromJSON(event)
+	if err != nil {
+		return nil, &EventFormatError{Format: functionio.FormatMsgpack, Err: err}
+	}
+	return encoded, nil
+}
+
+// decodeOutput decodes a function's output into what's returned to the caller.
+func decodeOutput(function *storage.Function, output []byte) ([]byte, error) {
+	if function.ResponseFormat != functionio.FormatMsgpack {
+		return output, nil
+	}
+	decoded, err := msgpack.ToJSON(output)
+	if err != nil {
+		return nil, &OutputFormatError{Format: functionio.FormatMsgpack, Err: err}
+	}
+	return decoded, nil
+}
@@ -0,0 +1,299 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
+)
+
+// imagePrefix is the repository prefix of the images built for functions.
+const imagePrefix = "serverless-"
+
+// BuiltImage reports whether a function runs the image the CLI built for it,
+// exactly serverless-<name>:latest, rather than one from a registry.
+func BuiltImage(function *storage.Function) bool {
+	return function.Image == imagePrefix+function.Name+":latest" && !strings.Contains(function.Image, "/")
+}
+
+// PruneReport summarizes an image garbage collection.
+type PruneReport struct {
+	Removed        []string `json:"removed"`         // Image references that were removed
+	SpaceReclaimed uint64   `json:"space_reclaimed"` // Bytes freed, including dangling layers
+}
+
+// WarmReport describes the preparation of a function for invocations.
+type WarmReport struct {
+	Image      string `json:"image"`       // Image the function runs
+	Pulled     bool   `json:"pulled"`      // Whether the image had to be pulled
+	DurationMs int64  `json:"duration_ms"` // Time taken to prepare the function
+}
+
+// Warm makes sure a function's image is present, pulling it if it's missing
+// or the function always pulls, so the first invocation doesn't pay for it. An image that can't be pulled,
+// e.g. a locally built one that was removed, is reported as ErrImageNotFound.
+func (o *Orchestrator) Warm(ctx context.Context, function *storage.Function) (*WarmReport, error) {
+	began := time.Now()
+	ref := imageRef(function)
+	report := &WarmReport{Image: ref}
+
+	_, err := o.docker.ImageInspect(ctx, ref)
+	if err != nil && !client.IsErrNotFound(err) {
+		return nil, fmt.Errorf("failed to inspect image: %v", err)
+	}
+	missing := err != nil
+	if missing || o.alwaysPull(function) {
+		// A function that always pulls gets what its tag refers to
+		if o.alwaysPull(function) {
+			ref = function.Image
+		}
+		o.log.WithFields(logrus.Fields{"function": function.Name, "image": ref}).Info("Pulling image")
+		if err := o.pullImage(ctx, ref); err != nil {
+			if missing {
+				return nil, fmt.Errorf("%w: %s: %v", ErrImageNotFound, ref, err)
+			}
+			return nil, fmt.Errorf("failed to pull image %s: %v", ref, err)
+		}
+		report.Pulled = true
+	}
+
+	report.DurationMs = time.Since(began).Milliseconds()
+	o.log.WithFields(logrus.Fields{
+		"function": function.Name,
+		"pulled":   report.Pulled,
+	}).Info("Function warmed")
+	return report, nil
+}
+
+// ImageDigest returns the ID of a local image, which pins it as a function's
+// digest.
+func (o *Orchestrator) ImageDigest(ctx context.Context, ref string) (string, error) {
+	ctx, cancel := o.apiContext(ctx)
+	defer cancel()
+
+	inspect, err := o.docker.ImageInspect(ctx, ref)
+	if client.IsErrNotFound(err) {
+		return "", fmt.Errorf("%w: %s", ErrImageNotFound, ref)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image: %v", err)
+	}
+	return inspect.ID, nil
+}
+
+// ImageLabels returns the labels of a function's image, or nil when the image
+// isn't present on the Docker host. The image isn't pulled.
+func (o *Orchestrator) ImageLabels(ctx context.Context, function *storage.Function) (map[string]string, error) {
+	ctx, cancel := o.apiContext(ctx)
+	defer cancel()
+
+	inspect, err := o.docker.ImageInspect(ctx, imageRef(function))
+	if client.IsErrNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image: %v", err)
+	}
+	if inspect.Config == nil {
+		return nil, nil
+	}
+	return inspect.Config.Labels, nil
+}
+
+// refreshImage pulls the image of a function that always pulls before it
+// runs, so a tag moved in its registry takes effect without redeploying. It
+// returns the function to run: a function pinned to an image ID is run with
+// the ID of the image its tag refers to after the pull.
+func (o *Orchestrator) refreshImage(ctx context.Context, function *storage.Function) (*storage.Function, error) {
+	if !o.alwaysPull(function) {
+		return function, nil
+	}
+	o.log.WithFields(logrus.Fields{"function": function.Name, "image": function.Image}).Debug("Pulling image")
+	if err := o.pullImage(ctx, function.Image); err != nil {
+		return nil, fmt.Errorf("failed to pull image %s: %v", function.Image, err)
+	}
+	if function.Digest == "" {
+		return function, nil
+	}
+	digest, err := o.ImageDigest(ctx, function.Image)
+	if err != nil {
+		return nil, err
+	}
+	refreshed := *function
+	refreshed.Digest = digest
+	return &refreshed, nil
+}
+
+// alwaysPull reports whether a function's image is pulled before each run:
+// as the function sets, or else the server's default, whether or not it's
+// pinned to an image ID. Only images from a registry are pulled, images
+// built for functions are local.
+func (o *Orchestrator) alwaysPull(function *storage.Function) bool {
+	if BuiltImage(function) {
+		return false
+	}
+	if function.AlwaysPull != nil {
+		return *function.AlwaysPull
+	}
+	return o.config.AlwaysPull
+}
+
+// pullImage pulls an image, returning once the pull completed.
+func (o *Orchestrator) pullImage(ctx context.Context, ref string) error {
+	progress, err := o.docker.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+	// The pull completes once its progress stream is consumed
+	if _, err := io.Copy(io.Discard, progress); err != nil {
+		return fmt.Errorf("failed to pull image: %v", err)
+	}
+	return nil
+}
+
+// PullImages pulls images concurrently, e.g. the base images function builds
+// start from, so the first build doesn't wait for them. Progress is logged
+// per layer at debug level. It returns once every pull finished, with the
+// errors of those that failed keyed by image.
+func (o *Orchestrator) PullImages(ctx context.Context, refs []string) map[string]error {
+	var mu sync.Mutex
+	failed := make(map[string]error)
+	var wg sync.WaitGroup
+	for _, ref := range refs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			began := time.Now()
+			log := o.log.WithField("image", ref)
+			log.Info("Pulling image")
+			if err := o.pullImageLogged(ctx, ref, log); err != nil {
+				mu.Lock()
+				failed[ref] = err
+				mu.Unlock()
+				return
+			}
+			log.WithField("duration", time.Since(began).Round(time.Millisecond)).Info("Image pulled")
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+// pullMessage is a line of the progress stream of a pull.
+type pullMessage struct {
+	ID             string          `json:"id"`     // Layer the message is about, if any
+	Status         string          `json:"status"` // e.g. Downloading or Pull complete
+	ProgressDetail json.RawMessage `json:"progressDetail"`
+	Error          string          `json:"error"`
+}
+
+// pullImageLogged is pullImage, logging the status changes of the layers and
+// failing on errors reported in the progress stream.
+func (o *Orchestrator) pullImageLogged(ctx context.Context, ref string, log *logrus.Entry) error {
+	progress, err := o.docker.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+
+	decoder := json.NewDecoder(progress)
+	for {
+		var message pullMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read pull progress: %v", err)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("%s", message.Error)
+		}
+		// Byte counts of downloads in flight are too many to log
+		if len(message.ProgressDetail) > 2 {
+			continue
+		}
+		if message.ID != "" {
+			log.WithField("layer", message.ID).Debug(message.Status)
+		} else {
+			log.Debug(message.Status)
+		}
+	}
+}
+
+// PruneImages removes function images that aren't referenced by any current
+// function, plus dangling layers. inUse holds the image references (tag, digest
+// or ID) of the deployed functions; images matching any of them are never removed.
+func (o *Orchestrator) PruneImages(ctx context.Context, inUse []string) (*PruneReport, error) {
+	keep := make(map[string]bool, len(inUse))
+	for _, ref := range inUse {
+		keep[ref] = true
+	}
+
+	images, err := o.docker.ImageList(ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", imagePrefix+"*")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %v", err)
+	}
+
+	report := &PruneReport{Removed: []string{}}
+	for _, img := range images {
+		if imageInUse(img, keep) {
+			continue
+		}
+
+		removedAll := true
+		for _, tag := range img.RepoTags {
+			if !strings.HasPrefix(tag, imagePrefix) {
+				// Tagged by someone else as well, leave that tag alone
+				removedAll = false
+				continue
+			}
+			if _, err := o.docker.ImageRemove(ctx, tag, image.RemoveOptions{PruneChildren: true}); err != nil {
+				// Most likely still used by a container, try again next time
+				o.log.WithError(err).WithField("image", tag).Warn("Failed to remove image")
+				removedAll = false
+				continue
+			}
+			report.Removed = append(report.Removed, tag)
+		}
+		if removedAll && img.Size > 0 {
+			report.SpaceReclaimed += uint64(img.Size)
+		}
+	}
+
+	// Remove the dangling layers left behind by rebuilds
+	dangling, err := o.docker.ImagesPrune(ctx, filters.NewArgs(filters.Arg("dangling", "true")))
+	if err != nil {
+		return report, fmt.Errorf("failed to prune dangling images: %v", err)
+	}
+	report.SpaceReclaimed += dangling.SpaceReclaimed
+
+	o.log.WithFields(logrus.Fields{
+		"removed":         len(report.Removed),
+		"space_reclaimed": report.SpaceReclaimed,
+	}).Info("Images pruned")
+	return report, nil
+}
+
+// imageInUse reports whether any reference of the image is in the keep set.
+func imageInUse(img image.Summary, keep map[string]bool) bool {
+	if keep[img.ID] {
+		return true
+	}
+	for _, ref := range append(img.RepoTags, img.RepoDigests...) {
+		if keep[ref] {
+			return true
+		}
+	}
+	return false
+}
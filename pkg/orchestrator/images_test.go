@@ -0,0 +1,363 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// fakeImages is a client holding images, recording those removed.
+type fakeImages struct {
+	dockerClient
+	images  []image.Summary
+	removed []string // References of the images removed
+	pruned  bool     // Whether dangling images were pruned
+	pulled  []string // References of the images pulled
+	pullErr error    // Error pulling images fails with
+}
+
+// ImageInspect finds an image by ID or tag.
+func (d *fakeImages) ImageInspect(ctx context.Context, imageID string, options ...client.ImageInspectOption) (image.InspectResponse, error) {
+	for _, img := range d.images {
+		if img.ID == imageID || slices.Contains(img.RepoTags, imageID) {
+			return image.InspectResponse{ID: img.ID}, nil
+		}
+	}
+	return image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("No such image: %s", imageID))
+}
+
+// ImagePull records the pull of an image, which streams its progress.
+func (d *fakeImages) ImagePull(ctx context.Context, ref string, options image.PullOptions) (io.ReadCloser, error) {
+	if d.pullErr != nil {
+		return nil, d.pullErr
+	}
+	d.pulled = append(d.pulled, ref)
+	return io.NopCloser(strings.NewReader(`{"status":"Downloaded newer image"}`)), nil
+}
+
+// ImageList returns all images.
+func (d *fakeImages) ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error) {
+	return d.images, nil
+}
+
+// ImageRemove records the removal of an image.
+func (d *fakeImages) ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	d.removed = append(d.removed, imageID)
+	return []image.DeleteResponse{{Untagged: imageID}}, nil
+}
+
+// ImagesPrune records the pruning of dangling images.
+func (d *fakeImages) ImagesPrune(ctx context.Context, pruneFilters filters.Args) (image.PruneReport, error) {
+	d.pruned = true
+	return image.PruneReport{SpaceReclaimed: 5}, nil
+}
+
+func TestPruneImages(t *testing.T) {
+	images := []image.Summary{
+		{ID: "sha256:1", RepoTags: []string{"serverless-hello:latest"}, Size: 100},
+		{ID: "sha256:2", RepoTags: []string{"serverless-old:latest"}, Size: 200},
+		{ID: "sha256:3", RepoTags: []string{"serverless-pinned:latest"}, RepoDigests: []string{"serverless-pinned@sha256:aa"}, Size: 300},
+		{ID: "sha256:4", RepoTags: []string{"serverless-shared:latest", "shared:latest"}, Size: 400},
+	}
+	tests := []struct {
+		name      string
+		inUse     []string
+		want      []string
+		wantSpace uint64
+	}{
+		{
+			name:      "by tag",
+			inUse:     []string{"serverless-hello:latest", "serverless-pinned:latest"},
+			want:      []string{"serverless-old:latest", "serverless-shared:latest"},
+			wantSpace: 200 + 5,
+		},
+		{
+			name:      "by digest and ID",
+			inUse:     []string{"serverless-pinned@sha256:aa", "sha256:1", "sha256:2", "sha256:4"},
+			want:      []string{},
+			wantSpace: 5,
+		},
+		{
+			name:      "none deployed",
+			want:      []string{"serverless-hello:latest", "serverless-old:latest", "serverless-pinned:latest", "serverless-shared:latest"},
+			wantSpace: 100 + 200 + 300 + 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeImages{images: images}
+			o := newTestOrchestrator(docker, Config{})
+
+			report, err := o.PruneImages(context.Background(), tt.inUse)
+			if err != nil {
+				t.Fatalf("PruneImages failed: %v", err)
+			}
+			if !reflect.DeepEqual(report.Removed, tt.want) {
+				t.Errorf("removed %q, want %q", report.Removed, tt.want)
+			}
+			if len(docker.removed) != len(tt.want) {
+				t.Errorf("images removed from docker = %q, want %q", docker.removed, tt.want)
+			}
+			if report.SpaceReclaimed != tt.wantSpace {
+				t.Errorf("space reclaimed = %d, want %d", report.SpaceReclaimed, tt.wantSpace)
+			}
+			if !docker.pruned {
+				t.Error("dangling images not pruned")
+			}
+		})
+	}
+}
+
+func TestWarm(t *testing.T) {
+	const digest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	tests := []struct {
+		name              string
+		function          storage.Function
+		pullErr           error
+		wantPulled        []string
+		wantImageNotFound bool
+	}{
+		{name: "present", function: storage.Function{Name: "hello", Image: "serverless-hello:latest"}},
+		{name: "missing", function: storage.Function{Name: "hello", Image: "registry.example.com/hello:1.0"}, wantPulled: []string{"registry.example.com/hello:1.0"}},
+		{name: "pinned digest missing", function: storage.Function{Name: "hello", Image: "serverless-hello:latest", Digest: digest}, wantPulled: []string{digest}},
+		{
+			name:              "can't be pulled",
+			function:          storage.Function{Name: "hello", Image: "serverless-gone:latest"},
+			pullErr:           errors.New("pull access denied"),
+			wantImageNotFound: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeImages{
+				images:  []image.Summary{{ID: "sha256:1", RepoTags: []string{"serverless-hello:latest"}}},
+				pullErr: tt.pullErr,
+			}
+			o := newTestOrchestrator(docker, Config{})
+
+			report, err := o.Warm(context.Background(), &tt.function)
+			if errors.Is(err, ErrImageNotFound) != tt.wantImageNotFound {
+				t.Fatalf("Warm = %v, want ErrImageNotFound %v", err, tt.wantImageNotFound)
+			}
+			if !slices.Equal(docker.pulled, tt.wantPulled) {
+				t.Errorf("pulled %q, want %q", docker.pulled, tt.wantPulled)
+			}
+			if err != nil {
+				return
+			}
+			if report.Pulled != (len(tt.wantPulled) > 0) {
+				t.Errorf("report says pulled %v, want %v", report.Pulled, len(tt.wantPulled) > 0)
+			}
+		})
+	}
+}
+
+// fakeRegistry pulls images by setting their IDs. The other calls aren't
+// implemented.
+type fakeRegistry struct {
+	dockerClient
+	remote map[string]string // IDs of the images pulled, by reference
+	local  map[string]string // IDs of the images present, by reference
+	pulls  []string
+}
+
+// ImagePull makes the remote image local.
+func (r *fakeRegistry) ImagePull(ctx context.Context, ref string, options image.PullOptions) (io.ReadCloser, error) {
+	r.pulls = append(r.pulls, ref)
+	id, ok := r.remote[ref]
+	if !ok {
+		return nil, errors.New("pull access denied")
+	}
+	r.local[ref] = id
+	return io.NopCloser(strings.NewReader(`{"status":"Downloaded newer image"}`)), nil
+}
+
+// ImageInspect returns the ID of a local image.
+func (r *fakeRegistry) ImageInspect(ctx context.Context, ref string, options ...client.ImageInspectOption) (image.InspectResponse, error) {
+	id, ok := r.local[ref]
+	if !ok {
+		return image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("No such image: %s", ref))
+	}
+	return image.InspectResponse{ID: id}, nil
+}
+
+func TestRefreshImage(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name       string
+		function   storage.Function
+		serverPull bool
+		remote     map[string]string
+		wantPull   bool
+		wantDigest string
+		wantErr    bool
+	}{
+		{
+			name:       "server default off",
+			function:   storage.Function{Name: "f", Image: "alpine:3", Digest: "sha256:old"},
+			remote:     map[string]string{"alpine:3": "sha256:new"},
+			wantDigest: "sha256:old",
+		},
+		{
+			name:       "server default on",
+			function:   storage.Function{Name: "f", Image: "alpine:3"},
+			serverPull: true,
+			remote:     map[string]string{"alpine:3": "sha256:new"},
+			wantPull:   true,
+		},
+		{
+			name:     "function opts in",
+			function: storage.Function{Name: "f", Image: "alpine:3", AlwaysPull: &yes},
+			remote:   map[string]string{"alpine:3": "sha256:new"},
+			wantPull: true,
+		},
+		{
+			name:       "function opts out",
+			function:   storage.Function{Name: "f", Image: "alpine:3", AlwaysPull: &no},
+			serverPull: true,
+			remote:     map[string]string{"alpine:3": "sha256:new"},
+		},
+		{
+			name:       "pinned function runs the pulled image",
+			function:   storage.Function{Name: "f", Image: "alpine:3", Digest: "sha256:old", AlwaysPull: &yes},
+			remote:     map[string]string{"alpine:3": "sha256:new"},
+			wantPull:   true,
+			wantDigest: "sha256:new",
+		},
+		{
+			name:       "built image never pulled",
+			function:   storage.Function{Name: "f", Image: "serverless-f:latest", Digest: "sha256:old", AlwaysPull: &yes},
+			serverPull: true,
+			wantDigest: "sha256:old",
+		},
+		{
+			name:     "pull fails",
+			function: storage.Function{Name: "f", Image: "private/app:1", AlwaysPull: &yes},
+			wantPull: true,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := &fakeRegistry{remote: tt.remote, local: map[string]string{}}
+			o := newTestOrchestrator(registry, Config{AlwaysPull: tt.serverPull})
+			function := tt.function
+
+			refreshed, err := o.refreshImage(context.Background(), &function)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("refreshImage = %v, want error %v", err, tt.wantErr)
+			}
+			if pulled := len(registry.pulls) > 0; pulled != tt.wantPull {
+				t.Errorf("image pulled = %v, want %v", pulled, tt.wantPull)
+			}
+			if err != nil {
+				return
+			}
+			if refreshed.Digest != tt.wantDigest {
+				t.Errorf("digest run = %q, want %q", refreshed.Digest, tt.wantDigest)
+			}
+			if function.Digest != tt.function.Digest {
+				t.Errorf("refreshImage changed the function's digest to %q", function.Digest)
+			}
+		})
+	}
+}
+
+func TestImageDigest(t *testing.T) {
+	registry := &fakeRegistry{local: map[string]string{"alpine:3": "sha256:abc"}}
+	o := newTestOrchestrator(registry, Config{})
+
+	digest, err := o.ImageDigest(context.Background(), "alpine:3")
+	if err != nil || digest != "sha256:abc" {
+		t.Errorf("ImageDigest = %q, %v, want sha256:abc", digest, err)
+	}
+	if _, err := o.ImageDigest(context.Background(), "missing:1"); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("ImageDigest of a missing image = %v, want ErrImageNotFound", err)
+	}
+}
+
+func TestBuiltImage(t *testing.T) {
+	tests := []struct {
+		name  string
+		image string
+		want  bool
+	}{
+		{name: "hello", image: "serverless-hello:latest", want: true},
+		{name: "my-func", image: "serverless-my-func:latest", want: true},
+		{name: "hello", image: "serverless-hello"},
+		{name: "hello", image: "serverless-hello:v2"},
+		{name: "hello", image: "serverless-other:latest"},
+		{name: "hello", image: "registry.example.com/serverless-hello:latest"},
+		{name: "team/hello", image: "serverless-team/hello:latest"},
+		{name: "hello", image: "docker.io/library/serverless-hello:latest"},
+		{name: "hello", image: "alpine:latest"},
+		{name: "hello", image: "serverless-hello:latest@sha256:0000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			function := &storage.Function{Name: tt.name, Image: tt.image}
+			if got := BuiltImage(function); got != tt.want {
+				t.Errorf("BuiltImage(%s, %s) = %v, want %v", tt.name, tt.image, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakePulls is a client whose pulls stream the progress held for each
+// reference, failing for references without one.
+type fakePulls struct {
+	dockerClient
+	progress map[string]string // Progress stream, by reference
+}
+
+// ImagePull streams the progress of ref.
+func (d *fakePulls) ImagePull(ctx context.Context, ref string, options image.PullOptions) (io.ReadCloser, error) {
+	progress, ok := d.progress[ref]
+	if !ok {
+		return nil, errdefs.NotFound(fmt.Errorf("manifest for %s not found", ref))
+	}
+	return io.NopCloser(strings.NewReader(progress)), nil
+}
+
+func TestPullImages(t *testing.T) {
+	docker := &fakePulls{progress: map[string]string{
+		"alpine:3": `{"status":"Pulling from library/alpine","id":"3"}
+{"status":"Downloading","id":"a1b2","progressDetail":{"current":512,"total":1024}}
+{"status":"Pull complete","id":"a1b2","progressDetail":{}}
+{"status":"Downloaded newer image for alpine:3"}`,
+		"golang:1.23": `{"status":"Pulling from library/golang","id":"1.23"}
+{"errorDetail":{"message":"toomanyrequests: rate limit reached"},"error":"toomanyrequests: rate limit reached"}`,
+		"python:3": `{"status":"Pulling fs layer","id":"c3d4"}
+{"status":`,
+	}}
+	o := newTestOrchestrator(docker, Config{})
+
+	failed := o.PullImages(context.Background(), []string{"alpine:3", "golang:1.23", "python:3", "missing:1"})
+	wantErrs := map[string]string{
+		"golang:1.23": "toomanyrequests: rate limit reached",
+		"python:3":    "failed to read pull progress",
+		"missing:1":   "manifest for missing:1 not found",
+	}
+	if len(failed) != len(wantErrs) {
+		t.Errorf("failed pulls = %v, want %d of them", failed, len(wantErrs))
+	}
+	for ref, want := range wantErrs {
+		if err := failed[ref]; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("pull of %s failed with %v, want an error containing %q", ref, err, want)
+		}
+	}
+	if err, ok := failed["alpine:3"]; ok {
+		t.Errorf("pull of alpine:3 failed: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// ErrNoRunningContainer is returned when a function has no running invocation.
+var ErrNoRunningContainer = errors.New("no running invocation")
+
+// FollowLogs streams the output of a function's most recent running container
+// into stdout and stderr, until the container exits or ctx is cancelled.
+// Containers are removed once their invocation finishes, so only running
+// invocations can be followed.
+func (o *Orchestrator) FollowLogs(ctx context.Context, functionName string, stdout, stderr io.Writer) error {
+	containers, err := o.docker.ContainerList(ctx, container.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("label", LabelFunction+"="+functionName),
+			filters.Arg("status", "running"),
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %v", err)
+	}
+	if len(containers) == 0 {
+		return ErrNoRunningContainer
+	}
+
+	latest := containers[0]
+	for _, c := range containers[1:] {
+		if c.Created > latest.Created {
+			latest = c
+		}
+	}
+
+	logs, err := o.docker.ContainerLogs(ctx, latest.ID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get container logs: %v", err)
+	}
+	defer logs.Close()
+
+	// Without a TTY, stdout and stderr are multiplexed on the stream
+	if _, err := stdcopy.StdCopy(stdout, stderr, logs); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to read container logs: %v", err)
+	}
+	return nil
+}
@@ -6,94 +6,699 @@ package orchestrator
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/akos011221/serverless/pkg/storage"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/checkpoint"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 )
 
-// Orchestrator manages containerized function execution.
+// dockerClient is the subset of the Docker API used by the orchestrator.
+type dockerClient interface {
+	Ping(ctx context.Context) (types.Ping, error)
+	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig,
+		networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error)
+	ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error
+	ContainerAttach(ctx context.Context, containerID string, options container.AttachOptions) (types.HijackedResponse, error)
+	ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error
+	ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.WaitResponse, <-chan error)
+	ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error
+	ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error)
+	ContainerLogs(ctx context.Context, containerID string, options container.LogsOptions) (io.ReadCloser, error)
+	CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options container.CopyToContainerOptions) error
+	ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error)
+	ImageInspect(ctx context.Context, imageID string, options ...client.ImageInspectOption) (image.InspectResponse, error)
+	ImagePull(ctx context.Context, ref string, options image.PullOptions) (io.ReadCloser, error)
+	ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error)
+	ImagesPrune(ctx context.Context, pruneFilters filters.Args) (image.PruneReport, error)
+	CheckpointCreate(ctx context.Context, containerID string, options checkpoint.CreateOptions) error
+	CheckpointList(ctx context.Context, containerID string, options checkpoint.ListOptions) ([]checkpoint.Summary, error)
+	CheckpointDelete(ctx context.Context, containerID string, options checkpoint.DeleteOptions) error
+	ServerVersion(ctx context.Context) (types.Version, error)
+}
+
+// Labels set on every container created for a function, so they can be
+// correlated with functions in `docker ps` and found by external tooling.
+const (
+	LabelFunction   = "serverless.function"   // Name of the function
+	LabelVersion    = "serverless.version"    // Revision of the function, the image it was deployed with
+	LabelImage      = "serverless.image"      // Image the function runs
+	LabelInvocation = "serverless.invocation" // ID of the invocation the container serves
+)
+
+// TimeoutEnv is the environment variable telling a function its execution
+// timeout in milliseconds, so it can avoid starting work it can't finish.
+const TimeoutEnv = "SERVERLESS_TIMEOUT_MS"
+
+// Config holds orchestrator settings.
+type Config struct {
+	Engine string // Container engine, EngineDocker or EnginePodman (empty for Docker)
+	Host   string // API address of the engine, e.g. unix:///run/podman/podman.sock, empty for its default
+
+	DefaultUser string // User functions run as when they don't specify one
+
+	// Bounds each Docker API request, so a wedged daemon fails invocations
+	// instead of hanging them. Waiting for a container to exit isn't bounded
+	// by it. 0 disables the timeout.
+	APITimeout time.Duration
+
+	// Concurrent executions to keep Docker connections for, so they're reused
+	// instead of being opened and closed on every request
+	MaxConcurrency int
+
+	// Cap on the output of an execution for functions without their own,
+	// so a chatty function can't exhaust the server's memory. 0 disables it.
+	MaxOutputBytes int64
 
+	// Directory the file: log destinations of functions are relative to,
+	// empty to disallow them
+	FunctionLogDir string
+
+	// How long a cancelled or timed out function gets to exit after SIGTERM,
+	// before it's killed. 0 kills it right away.
+	StopGracePeriod time.Duration
+
+	// Pull the images of functions from their registry before each run,
+	// unless a function sets otherwise, like Kubernetes' imagePullPolicy:
+	// Always. Locally built images are never pulled.
+	AlwaysPull bool
+
+	// Experimental: restore functions with Snapshot set from a checkpoint,
+	// see snapshots. Checkpoints are written to SnapshotDir on the engine's
+	// host, of a container that ran for SnapshotDelay to initialize.
+	Snapshots     bool
+	SnapshotDir   string
+	SnapshotDelay time.Duration
+}
+
+// Orchestrator manages containerized function execution.
 type Orchestrator struct {
-	docker *client.Client
-	log    *logrus.Logger
+	docker   dockerClient
+	config   Config
+	log      *logrus.Logger
+	platform ocispec.Platform // Platform of the engine's host, empty when unknown
+
+	snapshots *snapshots // Checkpoints of functions, see Config.Snapshots
 }
 
+const (
+	pingAttempts = 5               // How many times to try reaching the Docker daemon at startup
+	pingTimeout  = 5 * time.Second // Timeout of a single attempt
+)
+
+// pingInterval is the delay between attempts to reach the Docker daemon,
+// shortened by tests.
+var pingInterval = 2 * time.Second
+
 // NewOrchestrator initializes the orchestrator.
-func NewOrchestrator(log *logrus.Logger) (*Orchestrator, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+// Creating the Docker client doesn't connect to the daemon, so it's pinged
+// explicitly to fail fast at startup instead of on the first invocation.
+func NewOrchestrator(config Config, log *logrus.Logger) (*Orchestrator, error) {
+	// The engine's default host configures the transport unless the
+	// environment points elsewhere, and a configured host wins over both
+	host, err := engineHost(config.Engine)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = client.DefaultDockerHost
+	}
+	opts := []client.Opt{
+		client.WithHTTPClient(newDockerHTTPClient(config.MaxConcurrency)),
+		client.WithHost(host),
+		client.FromEnv,
+		client.WithAPIVersionNegotiation(),
+	}
+	if config.Host != "" {
+		opts = append(opts, client.WithHost(config.Host))
+	}
+
+	// The client is safe for concurrent use, all executions share it and its
+	// connection pool
+	cli, err := client.NewClientWithOpts(opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Docker client: %v", err)
 	}
-	return &Orchestrator{docker: cli, log: log}, nil
+
+	o := &Orchestrator{docker: cli, config: config, log: log, snapshots: newSnapshots()}
+	if err := o.waitForDocker(); err != nil {
+		engine := config.Engine
+		if engine == "" {
+			engine = EngineDocker
+		}
+		return nil, fmt.Errorf("%s engine at %s is unreachable, make sure it's running: %v", engine, cli.DaemonHost(), err)
+	}
+	if o.platform, err = o.hostPlatform(context.Background()); err != nil {
+		log.WithError(err).Warn("Functions built for several platforms run the engine's default one")
+	}
+	log.WithFields(logrus.Fields{
+		"engine":   config.Engine,
+		"host":     cli.DaemonHost(),
+		"platform": o.platform.OS + "/" + o.platform.Architecture,
+	}).Info("Connected to the container engine")
+	return o, nil
+}
+
+// Idle connections kept to the daemon per concurrent execution, which makes a
+// few requests at a time (e.g. waiting for the container while removing another).
+const idleConnsPerExecution = 2
+
+// newDockerHTTPClient returns the HTTP client for the Docker API. The default
+// one keeps only a couple of idle connections, so under concurrency most
+// requests would open a new connection.
+func newDockerHTTPClient(maxConcurrency int) *http.Client {
+	idle := max(maxConcurrency, 1) * idleConnsPerExecution
+	transport := &http.Transport{
+		MaxIdleConns:        idle,
+		MaxIdleConnsPerHost: idle,
+		IdleConnTimeout:     30 * time.Second,
+	}
+	return &http.Client{Transport: transport, CheckRedirect: client.CheckRedirect}
+}
+
+// apiContext bounds a single Docker API request by the configured timeout.
+func (o *Orchestrator) apiContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.config.APITimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, o.config.APITimeout)
+}
+
+// waitForDocker pings the Docker daemon, retrying a few times to tolerate a
+// daemon that is still starting up.
+func (o *Orchestrator) waitForDocker() error {
+	var err error
+	for attempt := 1; attempt <= pingAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		_, err = o.docker.Ping(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		o.log.WithError(err).WithField("attempt", attempt).Warn("Docker daemon not reachable")
+		if attempt < pingAttempts {
+			time.Sleep(pingInterval)
+		}
+	}
+	return fmt.Errorf("gave up after %d attempts: %v", pingAttempts, err)
+}
+
+// cleanupTimeout bounds container removal, which runs on its own context so
+// that a cancelled invocation still gets its container cleaned up.
+const cleanupTimeout = 10 * time.Second
+
+// Result is the outcome of a function execution, along with a timing breakdown
+// useful for understanding invocation latency.
+type Result struct {
+	Output    []byte
+	ColdStart bool          // True when a fresh container was created for the invocation
+	Create    time.Duration // Time spent creating the container
+	Start     time.Duration // Time spent starting the container
+	Exec      time.Duration // Time from start until the function exited
+	Restored  bool          // True when the function was restored from its snapshot
 }
 
-// Execute runs a function in a container.
-func (o *Orchestrator) Execute(ctx context.Context, function *storage.Function, event []byte) ([]byte, error) {
-	// Create container
-	resp, err := o.docker.ContainerCreate(ctx, &container.Config{
-		Image:       function.Image,
-		Cmd:         []string{"/app/function"},
-		OpenStdin:   true,
-		StdinOnce:   true,
-		AttachStdin: true,
-	}, nil, nil, nil, "")
+// Execute runs a function in a container, labeled with the invocation ID.
+// The secrets are readable as files in the container, see SecretsMountPoint,
+// as are the files uploaded with the invocation, see WithUploads.
+// Cancelling ctx (e.g. when the client disconnects or the execution times
+// out) aborts the execution: the function is stopped, with a grace period to
+// clean up, and the container removed.
+func (o *Orchestrator) Execute(ctx context.Context, invocationID string, function *storage.Function, secrets map[string]string, event []byte) (*Result, error) {
+	return o.ExecuteStream(ctx, invocationID, function, secrets, event, nil)
+}
+
+// ExecuteStream is Execute, additionally copying the function's stdout to
+// stdout as it's written, for functions that stream their output. The output
+// is still collected, and capped, in the result.
+func (o *Orchestrator) ExecuteStream(ctx context.Context, invocationID string, function *storage.Function, secrets map[string]string, event []byte, stdout io.Writer) (*Result, error) {
+	// Every container is created fresh for now, so each invocation is a
+	// cold start
+	result := &Result{ColdStart: true}
+
+	event, err := encodeEvent(function, event)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create container: %v", err)
+		return nil, err
 	}
-	defer o.cleanupContainer(ctx, resp.ID)
 
-	// Start container
-	if err := o.docker.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		return nil, fmt.Errorf("failed to start container: %v", err)
+	// Create container, with a fresh pull of the image if the function
+	// always pulls
+	began := time.Now()
+	function, err = o.refreshImage(ctx, function)
+	if err != nil {
+		return nil, err
 	}
+	platform, err := o.containerPlatform(function)
+	if err != nil {
+		return nil, err
+	}
+	config := o.containerConfig(invocationID, function)
+	config.OpenStdin = true
+	config.StdinOnce = true
+	config.AttachStdin = true
+
+	host := hostConfig(function, secrets)
+	mountUploads(host, uploadsDir(ctx))
 
-	// Write event to container's stdin
-	hijacked, err := o.docker.ContainerAttach(ctx, resp.ID, container.AttachOptions{
+	apiCtx, cancel := o.apiContext(ctx)
+	resp, err := o.docker.ContainerCreate(apiCtx, config, host, nil, platform, "")
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx)
+		}
+		return nil, createError(config.Image, err)
+	}
+	// A container that exited is removed by Docker (see hostConfig), while
+	// one that didn't start or is still running, e.g. on cancellation or
+	// beyond its output cap, is removed here
+	exited := false
+	defer func() {
+		if exited {
+			return
+		}
+		if ctx.Err() != nil {
+			// The grace period runs in the background, so the cancelled
+			// invocation is answered right away
+			go func() {
+				o.stopContainer(resp.ID, function)
+				o.cleanupContainer(resp.ID)
+			}()
+			return
+		}
+		o.cleanupContainer(resp.ID)
+	}()
+	err = o.copySecrets(ctx, resp.ID, secrets)
+	if err == nil {
+		err = o.copyUploads(ctx, resp.ID, uploadsDir(ctx))
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx)
+		}
+		return nil, err
+	}
+	result.Create = time.Since(began)
+
+	// Attach before starting, so the output of a function that exits right
+	// away isn't lost. The attached connection outlives the request, only
+	// setting it up is bounded
+	apiCtx, cancel = o.apiContext(ctx)
+	hijacked, err := o.docker.ContainerAttach(apiCtx, resp.ID, container.AttachOptions{
 		Stream: true,
 		Stdin:  true,
 		Stdout: true,
+		Stderr: true,
 	})
+	cancel()
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx)
+		}
 		return nil, fmt.Errorf("failed to attach to container: %v", err)
 	}
 	defer hijacked.Close()
 
-	_, err = hijacked.Conn.Write(event)
+	stderr, err := o.forwardStderr(function, invocationID)
 	if err != nil {
+		return nil, err
+	}
+	defer stderr.Close()
+
+	// Reading the attached stream doesn't observe ctx, so close the
+	// connection on cancellation to unblock it
+	stop := context.AfterFunc(ctx, hijacked.Close)
+	defer stop()
+
+	// Wait for the exit before starting as well: once the container exits
+	// it's removed, and its exit code with it
+	statusCh, errCh := o.docker.ContainerWait(ctx, resp.ID, container.WaitConditionNextExit)
+
+	// Start container, from the function's snapshot if it has one. A
+	// snapshot that can't be restored is dropped, and the function started
+	// as usual
+	began = time.Now()
+	startOptions := o.startOptions(function)
+	if uploadsDir(ctx) != "" {
+		// Checkpoints are taken without the uploads mount
+		startOptions = container.StartOptions{}
+	}
+	apiCtx, cancel = o.apiContext(ctx)
+	err = o.docker.ContainerStart(apiCtx, resp.ID, startOptions)
+	cancel()
+	if err != nil && startOptions.CheckpointID != "" && ctx.Err() == nil {
+		o.log.WithError(err).WithField("function", function.Name).Warn("Failed to restore snapshot, starting function")
+		apiCtx, cancel = o.apiContext(ctx)
+		o.forgetSnapshot(apiCtx, resp.ID, startOptions.CheckpointID)
+		cancel()
+		startOptions = container.StartOptions{}
+		apiCtx, cancel = o.apiContext(ctx)
+		err = o.docker.ContainerStart(apiCtx, resp.ID, startOptions)
+		cancel()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx)
+		}
+		return nil, fmt.Errorf("failed to start container: %v", err)
+	}
+	result.Start = time.Since(began)
+	result.Restored = startOptions.CheckpointID != ""
+	began = time.Now()
+
+	// Write event to container's stdin. A function may exit without reading
+	// it, closing stdin under the write; its output and exit code still count
+	_, err = hijacked.Conn.Write(event)
+	if err != nil && ctx.Err() != nil {
+		return nil, cancelledError(ctx)
+	}
+	if err != nil && !stdinClosed(err) {
 		return nil, fmt.Errorf("failed to write event: %v", err)
 	}
+	if err != nil {
+		o.log.WithError(err).WithField("function", function.Name).Debug("Function exited before reading its event")
+	}
 	hijacked.CloseWrite()
 
-	// Read output
-	var output bytes.Buffer
-	_, err = io.Copy(&output, hijacked.Reader)
+	// Without a TTY, stdout and stderr are multiplexed on the stream. The
+	// output is stdout, up to its cap, while stderr is forwarded
+	output := &cappedBuffer{limit: o.outputLimit(function)}
+	var dst io.Writer = output
+	if stdout != nil {
+		dst = io.MultiWriter(output, stdout)
+	}
+	_, err = stdcopy.StdCopy(dst, stderr, hijacked.Reader)
+	if ctx.Err() != nil {
+		return nil, cancelledError(ctx)
+	}
+	if output.exceeded {
+		// Returning removes the container, which kills the function
+		return nil, &OutputLimitError{Limit: output.limit}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to read output: %v", err)
 	}
 
-	// Wait for container to exit
-	statusCh, errCh := o.docker.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+	// Wait for container to exit, the wait ends on cancellation as well
 	select {
 	case err := <-errCh:
+		if ctx.Err() != nil {
+			return nil, cancelledError(ctx)
+		}
 		return nil, fmt.Errorf("container wait failed: %v", err)
 	case status := <-statusCh:
+		exited = true
 		if status.StatusCode != 0 {
-			return nil, fmt.Errorf("container exited with code %d", status.StatusCode)
+			// A failing function may not manage to write its declared
+			// format, its output is kept as written then
+			out := output.Bytes()
+			if decoded, err := decodeOutput(function, out); err == nil {
+				out = decoded
+			}
+			return nil, &ExitError{Code: status.StatusCode, Output: out}
 		}
 	}
 
-	o.log.WithField("function", function.Name).Info("Function executed")
-	return output.Bytes(), nil
+	result.Exec = time.Since(began)
+	if result.Output, err = decodeOutput(function, output.Bytes()); err != nil {
+		return nil, err
+	}
+
+	o.log.WithFields(logrus.Fields{
+		"function":  function.Name,
+		"coldstart": result.ColdStart,
+		"create_ms": result.Create.Milliseconds(),
+		"start_ms":  result.Start.Milliseconds(),
+		"exec_ms":   result.Exec.Milliseconds(),
+		"restored":  result.Restored,
+	}).Info("Function executed")
+	o.snapshotAfterRun(function)
+	return result, nil
+}
+
+// cancelledError is returned when ctx is cancelled during an execution,
+// whichever Docker call observed it. The container is stopped and removed.
+func cancelledError(ctx context.Context) error {
+	return fmt.Errorf("execution cancelled: %v", ctx.Err())
+}
+
+// cappedBuffer collects the output of an execution, failing writes beyond
+// its limit, if it has one.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	exceeded bool
+}
+
+// Write appends p to the buffer, unless that would exceed the limit.
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.limit > 0 && int64(b.Len()+len(p)) > b.limit {
+		b.exceeded = true
+		return 0, &OutputLimitError{Limit: b.limit}
+	}
+	return b.Buffer.Write(p)
+}
+
+// stdinClosed reports whether writing to a container's stdin failed because
+// the container closed it, usually by exiting.
+func stdinClosed(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed)
+}
+
+// ExitError is returned when a function exits with a nonzero code. The output
+// written before exiting is kept, as functions may explain the failure there.
+type ExitError struct {
+	Code   int64
+	Output []byte
 }
 
-// cleanupContainer removes a container
-func (o *Orchestrator) cleanupContainer(ctx context.Context, containerID string) {
-	if err := o.docker.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true}); err != nil {
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("container exited with code %d", e.Code)
+}
+
+// OutputLimitError is returned when a function writes more output than its
+// cap. The function is killed and its output discarded.
+type OutputLimitError struct {
+	Limit int64
+}
+
+func (e *OutputLimitError) Error() string {
+	return fmt.Sprintf("function output exceeded the limit of %d bytes", e.Limit)
+}
+
+// outputLimit returns the cap on the output of a function's executions, 0 for none.
+func (o *Orchestrator) outputLimit(function *storage.Function) int64 {
+	if function.MaxOutputBytes > 0 {
+		return function.MaxOutputBytes
+	}
+	return o.config.MaxOutputBytes
+}
+
+// defaultEntrypoint is where the generated images place the function binary.
+var defaultEntrypoint = []string{"/app/function"}
+
+// containerConfig returns the container configuration of a function, without
+// the stream settings which depend on how the container is used.
+func (o *Orchestrator) containerConfig(invocationID string, function *storage.Function) *container.Config {
+	user := function.User
+	if user == "" {
+		user = o.config.DefaultUser
+	}
+
+	entrypoint := function.Entrypoint
+	if len(entrypoint) == 0 {
+		entrypoint = defaultEntrypoint
+	}
+
+	env := environment(function.Env)
+	if function.TimeoutMs > 0 {
+		env = append(env, TimeoutEnv+"="+strconv.FormatInt(function.TimeoutMs, 10))
+	}
+
+	// The grace period also applies when the container is stopped otherwise,
+	// e.g. with docker stop or when the daemon shuts down
+	stopTimeout := graceSeconds(o.config.StopGracePeriod)
+
+	return &container.Config{
+		Image:       imageRef(function),
+		Entrypoint:  entrypoint,
+		Cmd:         function.Args,
+		Env:         env,
+		User:        user,
+		WorkingDir:  function.WorkingDir,
+		StopSignal:  function.StopSignal,
+		StopTimeout: &stopTimeout,
+		Labels: map[string]string{
+			LabelFunction:   function.Name,
+			LabelVersion:    imageRef(function),
+			LabelImage:      function.Image,
+			LabelInvocation: invocationID,
+		},
+	}
+}
+
+// tmpfsOptions are the mount options of the writable /tmp of functions.
+const tmpfsOptions = "rw,noexec,nosuid,size=64m"
+
+// tmpfsVolumeOptions are the options of the volumes files are copied to: the
+// local driver mounts them as a tmpfs, so the files are kept in memory.
+var tmpfsVolumeOptions = map[string]string{
+	"type":   "tmpfs",
+	"device": "tmpfs",
+	"o":      "mode=0755,nosuid,nodev,noexec",
+}
+
+// tmpfsVolume returns the mount of an anonymous volume on a tmpfs at target,
+// for copyFiles to fill once the container is created. It lives in the
+// engine, with the container, so no other user of the host can read the
+// files, and is removed along with the container. A tmpfs mount of the
+// container itself won't do: it only exists while the container runs, so
+// nothing can be copied to it before the function starts.
+func tmpfsVolume(target string) mount.Mount {
+	return mount.Mount{
+		Type:   mount.TypeVolume,
+		Target: target,
+		VolumeOptions: &mount.VolumeOptions{
+			DriverConfig: &mount.Driver{Name: "local", Options: tmpfsVolumeOptions},
+		},
+	}
+}
+
+// copyFiles copies a tar archive of files to dst in a container created but
+// not yet started. The files are owned by the function's user.
+func (o *Orchestrator) copyFiles(ctx context.Context, containerID, dst string, archive io.Reader) error {
+	apiCtx, cancel := o.apiContext(ctx)
+	defer cancel()
+	// CopyUIDGID makes the engine chown the files to the container's user
+	return o.docker.CopyToContainer(apiCtx, containerID, dst, archive, container.CopyToContainerOptions{CopyUIDGID: true})
+}
+
+// hostConfig returns the host configuration of a function's containers, with
+// a volume for its secrets mounted, if any, see mountSecrets.
+func hostConfig(function *storage.Function, secrets map[string]string) *container.HostConfig {
+	config := &container.HostConfig{
+		DNS:            function.DNS,
+		ExtraHosts:     function.ExtraHosts,
+		ReadonlyRootfs: function.ReadonlyRootfs,
+		Resources: container.Resources{
+			Memory:   function.MemoryBytes,
+			NanoCPUs: function.NanoCPUs,
+		},
+	}
+	if function.WritableTmp {
+		config.Tmpfs = map[string]string{"/tmp": tmpfsOptions}
+	}
+	mountSecrets(config, secrets)
+
+	// Docker removes the container once it exits, so containers don't leak
+	// when the server crashes or a removal fails. The tradeoff is that the
+	// exit code and output must be captured before the exit, which is why
+	// Execute attaches and waits before starting the container, and that
+	// `docker logs` can't show a finished invocation
+	config.AutoRemove = true
+	return config
+}
+
+// ErrImageNotFound is returned when a function's image doesn't exist, e.g.
+// because it was removed after the function was deployed.
+var ErrImageNotFound = errors.New("function image not found")
+
+// createError describes a failure to create a function container, telling a
+// missing image apart from other failures.
+func createError(image string, err error) error {
+	if client.IsErrNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrImageNotFound, image)
+	}
+	return fmt.Errorf("failed to create container: %v", err)
+}
+
+// imageRef returns the image a function runs: the image it was deployed with
+// when its digest is known, so a rebuilt tag doesn't change the function.
+func imageRef(function *storage.Function) string {
+	if function.Digest != "" {
+		return function.Digest
+	}
+	return function.Image
+}
+
+// environment returns a function's environment variables as KEY=VALUE pairs,
+// in a stable order.
+func environment(env map[string]string) []string {
+	pairs := make([]string, 0, len(env))
+	for name, value := range env {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// cleanupContainer removes a container, killing it if it's running. A
+// container already removed, or being removed, by Docker is left alone.
+func (o *Orchestrator) cleanupContainer(containerID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	// Removing its volumes removes the one holding its secrets
+	err := o.docker.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+	if err != nil && !errdefs.IsNotFound(err) && !errdefs.IsConflict(err) {
 		o.log.WithError(err).Warn("Failed to remove container")
 	}
 }
+
+// stopContainer stops a container gracefully: the function gets its stop
+// signal, SIGTERM unless it set one, and is killed if it's still running
+// after the grace period. Removing the container would kill it right away.
+func (o *Orchestrator) stopContainer(containerID string, function *storage.Function) {
+	if o.config.StopGracePeriod <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.config.StopGracePeriod+cleanupTimeout)
+	defer cancel()
+
+	seconds := graceSeconds(o.config.StopGracePeriod)
+	options := container.StopOptions{Signal: function.StopSignal, Timeout: &seconds}
+	if err := o.docker.ContainerStop(ctx, containerID, options); err != nil {
+		o.log.WithError(err).Warn("Failed to stop container")
+	}
+}
+
+// graceSeconds converts a grace period to the whole seconds Docker takes,
+// rounding up so a short grace period isn't turned into an immediate kill.
+func graceSeconds(grace time.Duration) int {
+	return int(math.Ceil(grace.Seconds()))
+}
+
+// listManagedContainers lists all containers (running or not) created by the
+// orchestrator, found by their function label.
+func (o *Orchestrator) listManagedContainers(ctx context.Context) ([]container.Summary, error) {
+	containers, err := o.docker.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", LabelFunction)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+	return containers, nil
+}
@@ -0,0 +1,1032 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeDocker runs a fake function container: the function reads its event,
+// then calls run, which writes its stdout, multiplexed like without a TTY.
+// Containers exit with exitCode.
+type fakeDocker struct {
+	dockerClient
+	run      func(event []byte, output io.Writer)
+	exitCode int64
+
+	mu sync.Mutex // Guards the recorded requests of concurrent executions
+
+	created     *container.Config     // Configuration of the last container created
+	createdHost *container.HostConfig // Host configuration of the last container created
+	createErr   error                 // Error creating containers fails with
+
+	containers []container.Summary // Containers listed
+	listFilter filters.Args        // Filters of the last listing
+
+	removed      []string // IDs of the containers removed
+	removeForced bool     // Whether the last removal was forced
+	removeVolume bool     // Whether the last removal removed the container's volumes
+	removeCtxErr error    // Error of the context of the last removal
+
+	stopped     []int    // Grace periods, in seconds, of the containers stopped
+	stopSignals []string // Signals the containers are stopped with, empty for their own
+
+	copies  []fakeCopy // Archives copied to containers
+	copyErr error      // Error copying to containers fails with, after reading the archive
+
+	// Output of a function that writes it and exits as soon as it starts,
+	// without reading its event, when set
+	earlyOutput string
+	attached    net.Conn // Container end of the attached connection, for early exits
+	exited      bool     // Whether the early exiting function ran
+}
+
+// ContainerCreate creates the fake container.
+func (d *fakeDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig,
+	networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.created = config
+	d.createdHost = hostConfig
+	if d.createErr != nil {
+		return container.CreateResponse{}, d.createErr
+	}
+	return container.CreateResponse{ID: "c1"}, nil
+}
+
+// ContainerStart runs an early exiting function, whose output only reaches
+// a connection attached before. Other functions run once attached to.
+func (d *fakeDocker) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.earlyOutput == "" {
+		return nil
+	}
+	d.exited = true
+	if d.attached != nil {
+		stdcopy.NewStdWriter(d.attached, stdcopy.Stdout).Write([]byte(d.earlyOutput))
+		d.attached.Close()
+	}
+	return nil
+}
+
+// ContainerAttach runs the function on the other end of a pipe. Early
+// exiting functions get a socket instead, which fails writes once closed as
+// Docker's does.
+func (d *fakeDocker) ContainerAttach(ctx context.Context, containerID string, options container.AttachOptions) (types.HijackedResponse, error) {
+	if d.earlyOutput != "" {
+		conn, function, err := socketPair()
+		if err != nil {
+			return types.HijackedResponse{}, err
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.exited {
+			function.Close() // Attached too late, the output is gone
+		} else {
+			d.attached = function
+		}
+		return types.NewHijackedResponse(conn, ""), nil
+	}
+
+	conn, function := net.Pipe()
+	go func() {
+		defer function.Close()
+		event := make([]byte, 4096)
+		n, _ := function.Read(event)
+		d.run(event[:n], stdoutConn{function})
+	}()
+	return types.NewHijackedResponse(conn, ""), nil
+}
+
+// stdoutConn is the container's end of an attached connection, on which
+// writes go to stdout.
+type stdoutConn struct {
+	net.Conn
+}
+
+// Write writes p as a stdout frame.
+func (c stdoutConn) Write(p []byte) (int, error) {
+	return stdcopy.NewStdWriter(c.Conn, stdcopy.Stdout).Write(p)
+}
+
+// socketPair returns both ends of a connected Unix socket.
+func socketPair() (net.Conn, net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var conns [2]net.Conn
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socket")
+		conns[i], err = net.FileConn(file)
+		file.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return conns[0], conns[1], nil
+}
+
+// ContainerWait reports the container exited with exitCode.
+func (d *fakeDocker) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.WaitResponse, <-chan error) {
+	statusCh := make(chan container.WaitResponse, 1)
+	statusCh <- container.WaitResponse{StatusCode: d.exitCode}
+	return statusCh, make(chan error)
+}
+
+// ContainerStop records the grace period and signal the container is stopped
+// with.
+func (d *fakeDocker) ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = append(d.stopped, *options.Timeout)
+	d.stopSignals = append(d.stopSignals, options.Signal)
+	return nil
+}
+
+// removals returns the IDs of the containers removed so far. Containers of
+// cancelled executions are removed in the background.
+func (d *fakeDocker) removals() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.removed...)
+}
+
+// ContainerRemove records the removal.
+func (d *fakeDocker) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.removed = append(d.removed, containerID)
+	d.removeForced = options.Force
+	d.removeVolume = options.RemoveVolumes
+	d.removeCtxErr = ctx.Err()
+	return nil
+}
+
+// ContainerList returns the containers, recording the filters.
+func (d *fakeDocker) ContainerList(ctx context.Context, options container.ListOptions) ([]container.Summary, error) {
+	d.listFilter = options.Filters
+	return d.containers, nil
+}
+
+// newTestOrchestrator returns an orchestrator running containers on docker.
+func newTestOrchestrator(docker dockerClient, config Config) *Orchestrator {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return &Orchestrator{docker: docker, config: config, log: log, snapshots: newSnapshots()}
+}
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name       string
+		cancel     bool // Whether the client gives up once the function has its event
+		grace      time.Duration
+		stopSignal string
+		exitCode   int64
+		wantOutput string
+		wantErr    bool
+		wantStop   []int    // Grace periods the container is stopped with before removal
+		wantSignal []string // Signals the container is stopped with
+		wantRemove bool     // Whether the orchestrator removes the container, rather than Docker once it exits
+	}{
+		{name: "completes", grace: 2 * time.Second, wantOutput: `{"hello":"world"}`},
+		{name: "fails", exitCode: 1, wantErr: true},
+		{name: "client cancels", cancel: true, wantErr: true, wantRemove: true},
+		{name: "client cancels with grace period", cancel: true, grace: 2 * time.Second, wantErr: true, wantStop: []int{2}, wantSignal: []string{""}, wantRemove: true},
+		{name: "client cancels with stop signal", cancel: true, grace: 2 * time.Second, stopSignal: "SIGINT", wantErr: true,
+			wantStop: []int{2}, wantSignal: []string{"SIGINT"}, wantRemove: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			docker := &fakeDocker{exitCode: tt.exitCode}
+			docker.run = func(event []byte, output io.Writer) {
+				if tt.cancel {
+					// Hang until the connection is closed
+					cancel()
+					io.Copy(io.Discard, output.(net.Conn))
+					return
+				}
+				output.Write([]byte(tt.wantOutput))
+			}
+			o := newTestOrchestrator(docker, Config{StopGracePeriod: tt.grace})
+
+			function := &storage.Function{Name: "hello", Image: "hello:latest", StopSignal: tt.stopSignal}
+			result, err := o.Execute(ctx, "inv1", function, nil, []byte(`{}`))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Execute = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && string(result.Output) != tt.wantOutput {
+				t.Errorf("output = %q, want %q", result.Output, tt.wantOutput)
+			}
+			if err == nil && (!result.ColdStart || result.Create < 0 || result.Start < 0 || result.Exec < 0) {
+				t.Errorf("result = %+v, want a cold start with its timing", result)
+			}
+			for deadline := time.Now().Add(5 * time.Second); tt.wantRemove && len(docker.removals()) == 0 && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+
+			docker.mu.Lock()
+			defer docker.mu.Unlock()
+			if !docker.createdHost.AutoRemove {
+				t.Error("container created without auto removal")
+			}
+			if docker.created.StopSignal != tt.stopSignal {
+				t.Errorf("container created with stop signal %q, want %q", docker.created.StopSignal, tt.stopSignal)
+			}
+			if !tt.wantRemove {
+				if len(docker.removed) != 0 {
+					t.Errorf("containers removed = %v, want the exited container left to Docker", docker.removed)
+				}
+				return
+			}
+			if len(docker.removed) != 1 || docker.removed[0] != "c1" || !docker.removeForced || !docker.removeVolume {
+				t.Errorf("containers removed = %v (forced %v, volumes %v), want c1 stopped and removed with its volumes",
+					docker.removed, docker.removeForced, docker.removeVolume)
+			}
+			if docker.removeCtxErr != nil {
+				t.Errorf("container removed with a done context: %v", docker.removeCtxErr)
+			}
+			if !reflect.DeepEqual(docker.stopped, tt.wantStop) {
+				t.Errorf("container stopped with grace periods %v, want %v", docker.stopped, tt.wantStop)
+			}
+			if !reflect.DeepEqual(docker.stopSignals, tt.wantSignal) {
+				t.Errorf("container stopped with signals %q, want %q", docker.stopSignals, tt.wantSignal)
+			}
+		})
+	}
+}
+
+func TestGraceSeconds(t *testing.T) {
+	tests := []struct {
+		grace time.Duration
+		want  int
+	}{
+		{grace: 0, want: 0},
+		{grace: 300 * time.Millisecond, want: 1},
+		{grace: 1500 * time.Millisecond, want: 2},
+		{grace: 2 * time.Second, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.grace.String(), func(t *testing.T) {
+			if got := graceSeconds(tt.grace); got != tt.want {
+				t.Errorf("graceSeconds(%v) = %d, want %d", tt.grace, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerConfigStopTimeout(t *testing.T) {
+	tests := []struct {
+		grace time.Duration
+		want  int
+	}{
+		{grace: 0, want: 0},
+		{grace: 1500 * time.Millisecond, want: 2},
+		{grace: 10 * time.Second, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.grace.String(), func(t *testing.T) {
+			o := newTestOrchestrator(nil, Config{StopGracePeriod: tt.grace})
+			config := o.containerConfig("inv-1", &storage.Function{Name: "hello", Image: "hello:latest"})
+			if config.StopTimeout == nil || *config.StopTimeout != tt.want {
+				t.Errorf("StopTimeout = %v, want %d", config.StopTimeout, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteEarlyExit(t *testing.T) {
+	// The function exits before Execute writes its event
+	docker := &fakeDocker{earlyOutput: `{"done":true}`}
+	o := newTestOrchestrator(docker, Config{})
+	event := []byte(`{"large":"` + strings.Repeat("x", 1<<20) + `"}`)
+
+	result, err := o.Execute(context.Background(), "inv1", &storage.Function{Name: "hello", Image: "hello:latest"}, nil, event)
+	if err != nil {
+		t.Fatalf("Execute = %v, want the early exit handled", err)
+	}
+	if string(result.Output) != docker.earlyOutput {
+		t.Errorf("output = %q, want %q", result.Output, docker.earlyOutput)
+	}
+}
+
+// fakePing answers pings with the errors given, one per attempt, and then
+// successfully.
+type fakePing struct {
+	dockerClient
+	errs     []error
+	attempts int
+}
+
+// Ping returns the error of the attempt.
+func (d *fakePing) Ping(ctx context.Context) (types.Ping, error) {
+	d.attempts++
+	if d.attempts <= len(d.errs) {
+		return types.Ping{}, d.errs[d.attempts-1]
+	}
+	return types.Ping{APIVersion: "1.47"}, nil
+}
+
+func TestWaitForDocker(t *testing.T) {
+	defer func(interval time.Duration) { pingInterval = interval }(pingInterval)
+	pingInterval = time.Millisecond
+
+	down := errors.New("connection refused")
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "up", wantAttempts: 1},
+		{name: "starting up", errs: []error{down, down}, wantAttempts: 3},
+		{name: "up on the last attempt", errs: []error{down, down, down, down}, wantAttempts: pingAttempts},
+		{name: "down", errs: []error{down, down, down, down, down, down}, wantAttempts: pingAttempts, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakePing{errs: tt.errs}
+			err := newTestOrchestrator(docker, Config{}).waitForDocker()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("waitForDocker = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), down.Error()) {
+				t.Errorf("waitForDocker = %v, want the last error", err)
+			}
+			if docker.attempts != tt.wantAttempts {
+				t.Errorf("pinged %d times, want %d", docker.attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestNewOrchestrator(t *testing.T) {
+	defer func(interval time.Duration) { pingInterval = interval }(pingInterval)
+	pingInterval = time.Millisecond
+
+	tests := []struct {
+		name    string
+		status  int // Status of the daemon's answers to pings
+		wantErr bool
+	}{
+		{name: "reachable", status: http.StatusOK},
+		{name: "failing", status: http.StatusInternalServerError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Api-Version", "1.47")
+				w.WriteHeader(tt.status)
+			}))
+			defer daemon.Close()
+			host := "tcp://" + daemon.Listener.Addr().String()
+			t.Setenv("DOCKER_HOST", host)
+
+			log := logrus.New()
+			log.SetOutput(io.Discard)
+			_, err := NewOrchestrator(Config{}, log)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewOrchestrator = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && (!strings.Contains(err.Error(), "unreachable") || !strings.Contains(err.Error(), host)) {
+				t.Errorf("NewOrchestrator = %v, want it to say the daemon at %s is unreachable", err, host)
+			}
+		})
+	}
+}
+
+// crashingDocker is an engine whose orchestrator crashes once it started a
+// container: the goroutine executing the function ends, and none of its
+// later requests reach the engine. The container runs on until its stdin is
+// closed, and then exits, removed only if it's auto-removed.
+type crashingDocker struct {
+	dockerClient
+
+	mu         sync.Mutex
+	containers map[string]bool // IDs of the containers that exist
+	autoRemove bool
+	crashed    bool
+	exited     chan struct{} // Closed once the container exits
+}
+
+func (d *crashingDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig,
+	networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.containers["c1"] = true
+	d.autoRemove = hostConfig.AutoRemove
+	return container.CreateResponse{ID: "c1"}, nil
+}
+
+// ContainerAttach runs the container on the other end of a pipe: it reads
+// its stdin until it's closed, then exits.
+func (d *crashingDocker) ContainerAttach(ctx context.Context, containerID string, options container.AttachOptions) (types.HijackedResponse, error) {
+	conn, function := net.Pipe()
+	go func() {
+		defer close(d.exited)
+		io.Copy(io.Discard, function)
+		function.Close()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.autoRemove {
+			delete(d.containers, containerID)
+		}
+	}()
+	return types.NewHijackedResponse(conn, ""), nil
+}
+
+// ContainerWait never reports the exit, the orchestrator is gone by then.
+func (d *crashingDocker) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.WaitResponse, <-chan error) {
+	return make(chan container.WaitResponse), make(chan error)
+}
+
+// ContainerStart starts the container, and crashes the orchestrator.
+func (d *crashingDocker) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	d.mu.Lock()
+	d.crashed = true
+	d.mu.Unlock()
+	runtime.Goexit()
+	return nil
+}
+
+// ContainerRemove removes the container, unless the orchestrator crashed.
+func (d *crashingDocker) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.crashed {
+		return errors.New("connection refused")
+	}
+	delete(d.containers, containerID)
+	return nil
+}
+
+func TestExecuteCrash(t *testing.T) {
+	docker := &crashingDocker{containers: make(map[string]bool), exited: make(chan struct{})}
+	o := newTestOrchestrator(docker, Config{})
+
+	crashed := make(chan struct{})
+	go func() {
+		defer close(crashed)
+		o.Execute(context.Background(), "inv-1", &storage.Function{Name: "hello", Image: "hello:latest"}, nil, []byte(`{}`))
+		t.Error("Execute returned, want the orchestrator to crash")
+	}()
+	<-crashed
+
+	// The connection of the crashed orchestrator is gone, so the container
+	// gets the end of its stdin and exits
+	select {
+	case <-docker.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the container didn't exit")
+	}
+	docker.mu.Lock()
+	defer docker.mu.Unlock()
+	if !docker.crashed {
+		t.Fatal("the orchestrator didn't start the container")
+	}
+	if len(docker.containers) != 0 {
+		t.Errorf("containers %v left after the crash, want them removed by the engine", docker.containers)
+	}
+}
+
+func TestExecuteUser(t *testing.T) {
+	tests := []struct {
+		name           string
+		function       storage.Function
+		wantUser       string
+		wantWorkingDir string
+	}{
+		{name: "default", function: storage.Function{Name: "hello"}, wantUser: "65534:65534"},
+		{
+			name:           "set",
+			function:       storage.Function{Name: "hello", User: "1000:1000", WorkingDir: "/srv"},
+			wantUser:       "1000:1000",
+			wantWorkingDir: "/srv",
+		},
+		{name: "user name", function: storage.Function{Name: "hello", User: "app"}, wantUser: "app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeDocker{run: func(event []byte, output io.Writer) {}}
+			o := newTestOrchestrator(docker, Config{DefaultUser: "65534:65534"})
+			if _, err := o.Execute(context.Background(), "inv1", &tt.function, nil, []byte(`{}`)); err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if docker.created.User != tt.wantUser || docker.created.WorkingDir != tt.wantWorkingDir {
+				t.Errorf("container runs as %q in %q, want %q in %q",
+					docker.created.User, docker.created.WorkingDir, tt.wantUser, tt.wantWorkingDir)
+			}
+		})
+	}
+}
+
+func TestExecuteLabels(t *testing.T) {
+	docker := &fakeDocker{run: func(event []byte, output io.Writer) {}}
+	o := newTestOrchestrator(docker, Config{})
+	function := &storage.Function{Name: "hello", Image: "serverless-hello:latest"}
+	if _, err := o.Execute(context.Background(), "inv1", function, nil, []byte(`{}`)); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	want := map[string]string{
+		LabelFunction:   "hello",
+		LabelVersion:    "serverless-hello:latest",
+		LabelImage:      "serverless-hello:latest",
+		LabelInvocation: "inv1",
+	}
+	if !reflect.DeepEqual(docker.created.Labels, want) {
+		t.Errorf("labels = %v, want %v", docker.created.Labels, want)
+	}
+}
+
+func TestListManagedContainers(t *testing.T) {
+	docker := &fakeDocker{containers: []container.Summary{{ID: "c1", Labels: map[string]string{LabelFunction: "hello"}}}}
+	o := newTestOrchestrator(docker, Config{})
+
+	containers, err := o.listManagedContainers(context.Background())
+	if err != nil {
+		t.Fatalf("listManagedContainers failed: %v", err)
+	}
+	if len(containers) != 1 || containers[0].ID != "c1" {
+		t.Errorf("containers = %v, want c1", containers)
+	}
+	if got := docker.listFilter.Get("label"); len(got) != 1 || got[0] != LabelFunction {
+		t.Errorf("filtered by labels %v, want %s", got, LabelFunction)
+	}
+}
+
+func TestExecuteEntrypoint(t *testing.T) {
+	tests := []struct {
+		name           string
+		function       storage.Function
+		wantEntrypoint []string
+		wantCmd        []string
+	}{
+		{name: "default", function: storage.Function{Name: "hello"}, wantEntrypoint: []string{"/app/function"}},
+		{
+			name:           "custom",
+			function:       storage.Function{Name: "hello", Entrypoint: []string{"/bin/handler", "--serve"}, Args: []string{"-v", "--port=0"}},
+			wantEntrypoint: []string{"/bin/handler", "--serve"},
+			wantCmd:        []string{"-v", "--port=0"},
+		},
+		{
+			name:           "arguments only",
+			function:       storage.Function{Name: "hello", Args: []string{"--mode", "fast"}},
+			wantEntrypoint: []string{"/app/function"},
+			wantCmd:        []string{"--mode", "fast"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeDocker{run: func(event []byte, output io.Writer) {}}
+			o := newTestOrchestrator(docker, Config{})
+			if _, err := o.Execute(context.Background(), "inv1", &tt.function, nil, []byte(`{}`)); err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if !reflect.DeepEqual([]string(docker.created.Entrypoint), tt.wantEntrypoint) {
+				t.Errorf("entrypoint = %q, want %q", docker.created.Entrypoint, tt.wantEntrypoint)
+			}
+			if !reflect.DeepEqual([]string(docker.created.Cmd), tt.wantCmd) {
+				t.Errorf("arguments = %q, want %q", docker.created.Cmd, tt.wantCmd)
+			}
+		})
+	}
+}
+
+func TestContainerConfigLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		function storage.Function
+		want     map[string]string
+	}{
+		{
+			name:     "unpinned",
+			function: storage.Function{Name: "hello", Image: "alpine:3"},
+			want: map[string]string{
+				LabelFunction: "hello", LabelVersion: "alpine:3", LabelImage: "alpine:3", LabelInvocation: "inv-1",
+			},
+		},
+		{
+			name:     "pinned to a digest",
+			function: storage.Function{Name: "hello", Image: "serverless-hello:latest", Digest: "sha256:abc"},
+			want: map[string]string{
+				LabelFunction: "hello", LabelVersion: "sha256:abc", LabelImage: "serverless-hello:latest", LabelInvocation: "inv-1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestOrchestrator(nil, Config{})
+			config := o.containerConfig("inv-1", &tt.function)
+			if !reflect.DeepEqual(config.Labels, tt.want) {
+				t.Errorf("labels = %v, want %v", config.Labels, tt.want)
+			}
+			if config.Image != tt.want[LabelVersion] {
+				t.Errorf("container runs %s, want the labeled version %s", config.Image, tt.want[LabelVersion])
+			}
+		})
+	}
+}
+
+func TestContainerConfigTimeout(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeoutMs int64
+		want      []string
+	}{
+		{name: "no timeout", want: []string{"MODE=test"}},
+		{name: "timeout", timeoutMs: 1500, want: []string{"MODE=test", "SERVERLESS_TIMEOUT_MS=1500"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestOrchestrator(nil, Config{})
+			function := &storage.Function{Name: "hello", Image: "hello:latest", Env: map[string]string{"MODE": "test"}, TimeoutMs: tt.timeoutMs}
+			if got := o.containerConfig("inv-1", function).Env; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("environment = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteCreateError(t *testing.T) {
+	tests := []struct {
+		name              string
+		createErr         error
+		wantImageNotFound bool
+	}{
+		{name: "image not found", createErr: errdefs.NotFound(errors.New("No such image: hello:latest")), wantImageNotFound: true},
+		{name: "other failure", createErr: errdefs.System(errors.New("disk full"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestOrchestrator(&fakeDocker{createErr: tt.createErr}, Config{})
+
+			_, err := o.Execute(context.Background(), "inv1", &storage.Function{Name: "hello", Image: "hello:latest"}, nil, []byte(`{}`))
+			if err == nil {
+				t.Fatal("Execute succeeded, want the create error")
+			}
+			if errors.Is(err, ErrImageNotFound) != tt.wantImageNotFound {
+				t.Errorf("Execute = %v, want ErrImageNotFound %v", err, tt.wantImageNotFound)
+			}
+			if tt.wantImageNotFound && !strings.Contains(err.Error(), "hello:latest") {
+				t.Errorf("Execute = %v, want the missing image named", err)
+			}
+		})
+	}
+}
+
+func TestExecuteReadonlyRootfs(t *testing.T) {
+	tests := []struct {
+		name         string
+		function     storage.Function
+		wantReadonly bool
+		wantTmpfs    map[string]string
+	}{
+		{name: "writable", function: storage.Function{Name: "hello"}},
+		{name: "read-only", function: storage.Function{Name: "hello", ReadonlyRootfs: true}, wantReadonly: true},
+		{
+			name:         "read-only with tmp",
+			function:     storage.Function{Name: "hello", ReadonlyRootfs: true, WritableTmp: true},
+			wantReadonly: true,
+			wantTmpfs:    map[string]string{"/tmp": tmpfsOptions},
+		},
+		{name: "tmp only", function: storage.Function{Name: "hello", WritableTmp: true}, wantTmpfs: map[string]string{"/tmp": tmpfsOptions}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeDocker{run: func(event []byte, output io.Writer) {}}
+			o := newTestOrchestrator(docker, Config{})
+			if _, err := o.Execute(context.Background(), "inv1", &tt.function, nil, []byte(`{}`)); err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if docker.createdHost == nil {
+				t.Fatal("container created without a host configuration")
+			}
+			if docker.createdHost.ReadonlyRootfs != tt.wantReadonly {
+				t.Errorf("read-only root filesystem = %v, want %v", docker.createdHost.ReadonlyRootfs, tt.wantReadonly)
+			}
+			if !reflect.DeepEqual(docker.createdHost.Tmpfs, tt.wantTmpfs) {
+				t.Errorf("tmpfs mounts = %v, want %v", docker.createdHost.Tmpfs, tt.wantTmpfs)
+			}
+		})
+	}
+}
+
+func TestExecuteDNS(t *testing.T) {
+	tests := []struct {
+		name     string
+		function storage.Function
+	}{
+		{name: "engine defaults", function: storage.Function{Name: "hello"}},
+		{
+			name: "custom",
+			function: storage.Function{
+				Name:       "hello",
+				DNS:        []string{"10.0.0.2", "fd00::53"},
+				ExtraHosts: []string{"billing.internal:10.0.3.7", "gateway:host-gateway"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeDocker{run: func(event []byte, output io.Writer) {}}
+			o := newTestOrchestrator(docker, Config{})
+			if _, err := o.Execute(context.Background(), "inv1", &tt.function, nil, []byte(`{}`)); err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if !reflect.DeepEqual(docker.createdHost.DNS, tt.function.DNS) {
+				t.Errorf("DNS servers = %v, want %v", docker.createdHost.DNS, tt.function.DNS)
+			}
+			if !reflect.DeepEqual(docker.createdHost.ExtraHosts, tt.function.ExtraHosts) {
+				t.Errorf("extra hosts = %v, want %v", docker.createdHost.ExtraHosts, tt.function.ExtraHosts)
+			}
+		})
+	}
+}
+
+// openDescriptors returns the number of file descriptors the process has open.
+func openDescriptors(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count file descriptors: %v", err)
+	}
+	return len(entries)
+}
+
+func TestExecuteConcurrent(t *testing.T) {
+	const executions = 200
+	docker := &fakeDocker{run: func(event []byte, output io.Writer) {
+		output.Write(event)
+	}}
+	o := newTestOrchestrator(docker, Config{APITimeout: time.Second, MaxConcurrency: 16})
+
+	descriptors, goroutines := openDescriptors(t), runtime.NumGoroutine()
+	var wg sync.WaitGroup
+	errs := make(chan error, executions)
+	for range executions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := o.Execute(context.Background(), "inv1", &storage.Function{Name: "hello", Image: "hello:latest"}, nil, []byte(`{"n":1}`))
+			if err == nil && string(result.Output) != `{"n":1}` {
+				err = errors.New("output = " + string(result.Output))
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent Execute failed: %v", err)
+	}
+	// The containers exited, so Docker removes them
+	if len(docker.removed) != 0 {
+		t.Errorf("%d containers removed, want them left to Docker", len(docker.removed))
+	}
+	// Give the function goroutines a moment to see their connections closed
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > goroutines {
+		t.Errorf("%d goroutines left running, had %d before", got, goroutines)
+	}
+	if got := openDescriptors(t); got > descriptors {
+		t.Errorf("%d file descriptors open, had %d before", got, descriptors)
+	}
+}
+
+// wedgedDocker is a daemon that never answers container creation.
+type wedgedDocker struct {
+	fakeDocker
+}
+
+// ContainerCreate blocks until the request is given up.
+func (d *wedgedDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig,
+	networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	<-ctx.Done()
+	return container.CreateResponse{}, ctx.Err()
+}
+
+func TestExecuteAPITimeout(t *testing.T) {
+	o := newTestOrchestrator(&wedgedDocker{}, Config{APITimeout: 50 * time.Millisecond})
+
+	began := time.Now()
+	_, err := o.Execute(context.Background(), "inv1", &storage.Function{Name: "hello", Image: "hello:latest"}, nil, []byte(`{}`))
+	if err == nil {
+		t.Fatal("Execute succeeded against a wedged daemon")
+	}
+	if elapsed := time.Since(began); elapsed > time.Second {
+		t.Errorf("Execute took %v, want it bounded by the API timeout", elapsed)
+	}
+}
+
+// cancellingDocker cancels the execution during one of its calls, which
+// then fails like the Docker client does on a cancelled context.
+type cancellingDocker struct {
+	fakeDocker
+	call   string // The call cancelling the execution
+	cancel context.CancelFunc
+	ran    chan struct{} // Closed once the function ran
+}
+
+// cancelled cancels the execution if it's during call, returning the error
+// the call fails with.
+func (d *cancellingDocker) cancelled(call string) error {
+	if call != d.call {
+		return nil
+	}
+	d.cancel()
+	return fmt.Errorf("error during connect: %w", context.Canceled)
+}
+
+// ContainerCreate fails if the execution is cancelled during creation.
+func (d *cancellingDocker) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig,
+	networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error) {
+	if err := d.cancelled("create"); err != nil {
+		return container.CreateResponse{}, err
+	}
+	return d.fakeDocker.ContainerCreate(ctx, config, hostConfig, networkingConfig, platform, containerName)
+}
+
+// ContainerAttach fails if the execution is cancelled while attaching.
+func (d *cancellingDocker) ContainerAttach(ctx context.Context, containerID string, options container.AttachOptions) (types.HijackedResponse, error) {
+	if err := d.cancelled("attach"); err != nil {
+		return types.HijackedResponse{}, err
+	}
+	return d.fakeDocker.ContainerAttach(ctx, containerID, options)
+}
+
+// ContainerStart fails if the execution is cancelled during the start.
+func (d *cancellingDocker) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	if err := d.cancelled("start"); err != nil {
+		return err
+	}
+	return d.fakeDocker.ContainerStart(ctx, containerID, options)
+}
+
+// ContainerWait fails the wait if the execution is cancelled while waiting,
+// once the function ran.
+func (d *cancellingDocker) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.WaitResponse, <-chan error) {
+	if d.call != "wait" {
+		return d.fakeDocker.ContainerWait(ctx, containerID, condition)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		<-d.ran
+		errCh <- d.cancelled("wait")
+	}()
+	return make(chan container.WaitResponse), errCh
+}
+
+func TestExecuteCancelledDuringCall(t *testing.T) {
+	for _, call := range []string{"create", "attach", "start", "wait"} {
+		t.Run(call, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			docker := &cancellingDocker{call: call, cancel: cancel, ran: make(chan struct{})}
+			docker.run = func(event []byte, output io.Writer) { close(docker.ran) }
+			o := newTestOrchestrator(docker, Config{})
+
+			_, err := o.Execute(ctx, "inv1", &storage.Function{Name: "hello", Image: "hello:latest"}, nil, []byte(`{}`))
+			if err == nil || !strings.HasPrefix(err.Error(), "execution cancelled") {
+				t.Fatalf("Execute = %v, want the execution reported as cancelled", err)
+			}
+		})
+	}
+}
+
+func TestNewDockerHTTPClient(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxConcurrency int
+		wantIdle       int
+	}{
+		{name: "unlimited", maxConcurrency: 0, wantIdle: idleConnsPerExecution},
+		{name: "single", maxConcurrency: 1, wantIdle: idleConnsPerExecution},
+		{name: "concurrent", maxConcurrency: 16, wantIdle: 16 * idleConnsPerExecution},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := newDockerHTTPClient(tt.maxConcurrency).Transport.(*http.Transport)
+			if transport.MaxIdleConns != tt.wantIdle || transport.MaxIdleConnsPerHost != tt.wantIdle {
+				t.Errorf("idle connections = %d (%d per host), want %d", transport.MaxIdleConns, transport.MaxIdleConnsPerHost, tt.wantIdle)
+			}
+		})
+	}
+}
+
+func TestExecuteOutputLimit(t *testing.T) {
+	tests := []struct {
+		name         string
+		serverLimit  int64
+		functionCap  int64
+		outputBytes  int
+		wantExceeded int64 // Limit reported as exceeded, 0 when the output is returned
+	}{
+		{name: "within the limit", serverLimit: 1024, outputBytes: 1000},
+		{name: "at the limit", serverLimit: 1024, outputBytes: 1024},
+		{name: "past the limit", serverLimit: 1024, outputBytes: 1025, wantExceeded: 1024},
+		{name: "chatty function", serverLimit: 1024, outputBytes: 4 << 20, wantExceeded: 1024},
+		{name: "function's own cap", serverLimit: 1024, functionCap: 64 << 10, outputBytes: 32 << 10},
+		{name: "past function's own cap", serverLimit: 1 << 20, functionCap: 100, outputBytes: 101, wantExceeded: 100},
+		{name: "no limit", outputBytes: 4 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeDocker{run: func(event []byte, output io.Writer) {
+				output.Write([]byte(strings.Repeat("x", tt.outputBytes)))
+			}}
+			o := newTestOrchestrator(docker, Config{MaxOutputBytes: tt.serverLimit})
+
+			function := &storage.Function{Name: "hello", Image: "hello:latest", MaxOutputBytes: tt.functionCap}
+			result, err := o.Execute(context.Background(), "inv1", function, nil, []byte(`{}`))
+			if tt.wantExceeded == 0 {
+				if err != nil {
+					t.Fatalf("Execute failed: %v", err)
+				}
+				if len(result.Output) != tt.outputBytes {
+					t.Errorf("output has %d bytes, want %d", len(result.Output), tt.outputBytes)
+				}
+				return
+			}
+			var limitErr *OutputLimitError
+			if !errors.As(err, &limitErr) || limitErr.Limit != tt.wantExceeded {
+				t.Fatalf("Execute = %v, want the limit of %d exceeded", err, tt.wantExceeded)
+			}
+			// The function is killed by removing its container
+			if len(docker.removed) != 1 || !docker.removeForced {
+				t.Errorf("containers removed = %v (forced %v), want the container killed", docker.removed, docker.removeForced)
+			}
+		})
+	}
+}
+
+func TestExecuteStream(t *testing.T) {
+	const events = "data: one\n\ndata: two\n\n"
+	tests := []struct {
+		name        string
+		limit       int64
+		wantStream  string
+		wantOutput  string
+		wantLimited bool
+	}{
+		{name: "streamed and collected", wantStream: events, wantOutput: events},
+		{name: "past the limit", limit: 12, wantStream: events, wantLimited: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeDocker{run: func(event []byte, output io.Writer) {
+				output.Write([]byte("data: one\n\n"))
+				output.Write([]byte("data: two\n\n"))
+			}}
+			o := newTestOrchestrator(docker, Config{MaxOutputBytes: tt.limit})
+
+			var stream bytes.Buffer
+			function := &storage.Function{Name: "ticker", Image: "ticker:latest"}
+			result, err := o.ExecuteStream(context.Background(), "inv1", function, nil, []byte(`{}`), &stream)
+			if tt.wantLimited {
+				if !errors.As(err, new(*OutputLimitError)) {
+					t.Fatalf("ExecuteStream = %v, want the output limit exceeded", err)
+				}
+			} else if err != nil {
+				t.Fatalf("ExecuteStream failed: %v", err)
+			} else if string(result.Output) != tt.wantOutput {
+				t.Errorf("output = %q, want %q", result.Output, tt.wantOutput)
+			}
+			if !strings.HasPrefix(tt.wantStream, stream.String()) || stream.Len() == 0 {
+				t.Errorf("streamed %q, want a prefix of %q", stream.String(), tt.wantStream)
+			}
+		})
+	}
+}
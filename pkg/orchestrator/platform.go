@@ -0,0 +1,58 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/akos011221/serverless/pkg/storage"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ValidPlatform reports whether a platform is given as os/arch or
+// os/arch/variant, e.g. linux/arm64.
+func ValidPlatform(platform string) bool {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// hostPlatform asks the engine which platform it runs containers on.
+func (o *Orchestrator) hostPlatform(ctx context.Context) (ocispec.Platform, error) {
+	apiCtx, cancel := o.apiContext(ctx)
+	defer cancel()
+	version, err := o.docker.ServerVersion(apiCtx)
+	if err != nil {
+		return ocispec.Platform{}, fmt.Errorf("failed to get the engine's platform: %v", err)
+	}
+	return ocispec.Platform{OS: version.Os, Architecture: version.Arch}, nil
+}
+
+// containerPlatform returns the platform a function's container runs on: the
+// host's, for functions whose image was built for several platforms, so the
+// matching variant of the image is picked. Functions not built for the host
+// fail clearly rather than with an exec format error. Nil leaves the choice
+// to the engine.
+func (o *Orchestrator) containerPlatform(function *storage.Function) (*ocispec.Platform, error) {
+	if len(function.Platforms) == 0 || o.platform.Architecture == "" {
+		return nil, nil
+	}
+	for _, platform := range function.Platforms {
+		osName, arch, _ := strings.Cut(platform, "/")
+		arch, _, _ = strings.Cut(arch, "/")
+		if osName == o.platform.OS && arch == o.platform.Architecture {
+			host := o.platform
+			return &host, nil
+		}
+	}
+	return nil, fmt.Errorf("image of function %s is built for %s, not for the host's %s/%s",
+		function.Name, strings.Join(function.Platforms, ", "), o.platform.OS, o.platform.Architecture)
+}
@@ -0,0 +1,111 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/docker/docker/api/types"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestValidPlatform(t *testing.T) {
+	tests := []struct {
+		platform string
+		want     bool
+	}{
+		{platform: "linux/amd64", want: true},
+		{platform: "linux/arm64/v8", want: true},
+		{platform: "windows/amd64", want: true},
+		{platform: "", want: false},
+		{platform: "linux", want: false},
+		{platform: "linux/", want: false},
+		{platform: "/amd64", want: false},
+		{platform: "linux//v8", want: false},
+		{platform: "linux/arm/v7/extra", want: false},
+	}
+	for _, tt := range tests {
+		if got := ValidPlatform(tt.platform); got != tt.want {
+			t.Errorf("ValidPlatform(%q) = %v, want %v", tt.platform, got, tt.want)
+		}
+	}
+}
+
+// versionDocker answers the engine's version with version, or err.
+type versionDocker struct {
+	dockerClient
+	version types.Version
+	err     error
+}
+
+func (d versionDocker) ServerVersion(ctx context.Context) (types.Version, error) {
+	return d.version, d.err
+}
+
+func TestHostPlatform(t *testing.T) {
+	tests := []struct {
+		name    string
+		docker  versionDocker
+		want    ocispec.Platform
+		wantErr bool
+	}{
+		{name: "amd64", docker: versionDocker{version: types.Version{Os: "linux", Arch: "amd64"}}, want: ocispec.Platform{OS: "linux", Architecture: "amd64"}},
+		{name: "arm64", docker: versionDocker{version: types.Version{Os: "linux", Arch: "arm64"}}, want: ocispec.Platform{OS: "linux", Architecture: "arm64"}},
+		{name: "engine unreachable", docker: versionDocker{err: errors.New("connection refused")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newTestOrchestrator(tt.docker, Config{})
+			got, err := o.hostPlatform(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("hostPlatform = %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hostPlatform = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerPlatform(t *testing.T) {
+	amd64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	tests := []struct {
+		name      string
+		host      ocispec.Platform
+		platforms []string // Built for
+		want      *ocispec.Platform
+		wantErr   string
+	}{
+		{name: "single platform build", host: amd64},
+		{name: "host unknown", platforms: []string{"linux/arm64"}},
+		{name: "built for the host", host: amd64, platforms: []string{"linux/arm64", "linux/amd64"}, want: &amd64},
+		{
+			name: "variant of the host",
+			host: ocispec.Platform{OS: "linux", Architecture: "arm64"}, platforms: []string{"linux/arm64/v8"},
+			want: &ocispec.Platform{OS: "linux", Architecture: "arm64"},
+		},
+		{name: "not built for the host", host: amd64, platforms: []string{"linux/arm64", "linux/arm/v7"}, wantErr: "built for linux/arm64, linux/arm/v7, not for the host's linux/amd64"},
+		{name: "other OS", host: amd64, platforms: []string{"windows/amd64"}, wantErr: "not for the host's linux/amd64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Orchestrator{platform: tt.host}
+			got, err := o.containerPlatform(&storage.Function{Name: "hello", Platforms: tt.platforms})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("containerPlatform = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("containerPlatform failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("containerPlatform = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+//go:build podman
+
+package orchestrator
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// TestPodmanSmoke runs a function on a live Podman socket. It only builds
+// with the podman tag:
+//
+//	go test -tags podman ./pkg/orchestrator -run Podman
+//
+// PODMAN_HOST overrides the socket, and PODMAN_SMOKE_IMAGE the image, which
+// must be pulled already.
+func TestPodmanSmoke(t *testing.T) {
+	image := os.Getenv("PODMAN_SMOKE_IMAGE")
+	if image == "" {
+		image = "docker.io/library/busybox:latest"
+	}
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+
+	o, err := NewOrchestrator(Config{Engine: EnginePodman, Host: os.Getenv("PODMAN_HOST")}, log)
+	if err != nil {
+		t.Fatalf("NewOrchestrator failed: %v", err)
+	}
+	// The image's shell runs the event as a script
+	result, err := o.Execute(context.Background(), "smoke", &storage.Function{Name: "smoke", Image: image}, nil, []byte(`echo '{"ok":true}'`))
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if got := string(result.Output); got != "{\"ok\":true}\n" {
+		t.Errorf("output = %q, want the echoed event", got)
+	}
+}
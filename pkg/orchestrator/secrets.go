@@ -0,0 +1,77 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// SecretsMountPoint is where a function's secrets are mounted in its
+// containers, one file per secret named after it.
+const SecretsMountPoint = "/run/secrets"
+
+// mountSecrets mounts a volume on a tmpfs at the secrets mount point, for
+// copySecrets to fill, see tmpfsVolume. Nothing is mounted for functions
+// without secrets.
+func mountSecrets(config *container.HostConfig, secrets map[string]string) {
+	if len(secrets) == 0 {
+		return
+	}
+	config.Mounts = append(config.Mounts, tmpfsVolume(SecretsMountPoint))
+}
+
+// copySecrets copies secrets to the secrets mount of a container created
+// but not yet started, one file per secret owned by the function's user and
+// readable by it only.
+func (o *Orchestrator) copySecrets(ctx context.Context, containerID string, secrets map[string]string) error {
+	if len(secrets) == 0 {
+		return nil
+	}
+	archive, err := secretsArchive(secrets)
+	if err != nil {
+		return err
+	}
+	if err := o.copyFiles(ctx, containerID, SecretsMountPoint, archive); err != nil {
+		return fmt.Errorf("failed to copy secrets: %v", err)
+	}
+	return nil
+}
+
+// secretsArchive returns a tar archive of secrets, one 0400 file per secret
+// named after it, in a stable order.
+func secretsArchive(secrets map[string]string) (*bytes.Buffer, error) {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	now := time.Now()
+	for _, name := range names {
+		value := secrets[name]
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0400,
+			Size:     int64(len(value)),
+			ModTime:  now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, fmt.Errorf("failed to write secret %s: %v", name, err)
+		}
+		if _, err := tw.Write([]byte(value)); err != nil {
+			return nil, fmt.Errorf("failed to write secret %s: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write secrets: %v", err)
+	}
+	return &archive, nil
+}
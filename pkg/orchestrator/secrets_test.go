@@ -0,0 +1,217 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// archiveFile is a file read back from a tar archive.
+type archiveFile struct {
+	Name    string
+	Mode    int64
+	Content string
+}
+
+// readArchive returns the files of a tar archive, in order.
+func readArchive(t *testing.T, r io.Reader) []archiveFile {
+	t.Helper()
+	var files []archiveFile
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("invalid archive: %v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("invalid archive: %v", err)
+		}
+		files = append(files, archiveFile{Name: header.Name, Mode: header.Mode, Content: string(content)})
+	}
+}
+
+// fakeCopy is an archive copied to a container.
+type fakeCopy struct {
+	containerID string
+	dst         string
+	options     container.CopyToContainerOptions
+	archive     []byte
+}
+
+// CopyToContainer reads the archive and records it.
+func (d *fakeDocker) CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options container.CopyToContainerOptions) error {
+	archive, err := io.ReadAll(content)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.copies = append(d.copies, fakeCopy{containerID: containerID, dst: dstPath, options: options, archive: archive})
+	return d.copyErr
+}
+
+func TestSecretsArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		want    []archiveFile
+	}{
+		{name: "none", secrets: map[string]string{}},
+		{
+			name:    "sorted by name",
+			secrets: map[string]string{"db_password": "hunter2", "API_KEY": "k", "cert.pem": "-----BEGIN-----\n"},
+			want: []archiveFile{
+				{Name: "API_KEY", Mode: 0400, Content: "k"},
+				{Name: "cert.pem", Mode: 0400, Content: "-----BEGIN-----\n"},
+				{Name: "db_password", Mode: 0400, Content: "hunter2"},
+			},
+		},
+		{
+			name:    "empty value",
+			secrets: map[string]string{"EMPTY": ""},
+			want:    []archiveFile{{Name: "EMPTY", Mode: 0400}},
+		},
+		{
+			name:    "binary value",
+			secrets: map[string]string{"KEY": "\x00\xff\n"},
+			want:    []archiveFile{{Name: "KEY", Mode: 0400, Content: "\x00\xff\n"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive, err := secretsArchive(tt.secrets)
+			if err != nil {
+				t.Fatalf("secretsArchive failed: %v", err)
+			}
+			if got := readArchive(t, archive); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("archive = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopySecrets(t *testing.T) {
+	tests := []struct {
+		name      string
+		secrets   map[string]string
+		copyErr   error
+		wantCopy  bool
+		wantErr   bool
+		wantMount bool
+	}{
+		{name: "no secrets"},
+		{name: "secrets", secrets: map[string]string{"TOKEN": "x"}, wantCopy: true, wantMount: true},
+		{name: "copy fails", secrets: map[string]string{"TOKEN": "x"}, copyErr: errors.New("no such container"), wantCopy: true, wantErr: true, wantMount: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeDocker{copyErr: tt.copyErr}
+			o := newTestOrchestrator(docker, Config{})
+
+			err := o.copySecrets(context.Background(), "c1", tt.secrets)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("copySecrets = %v, want error %v", err, tt.wantErr)
+			}
+			if copied := len(docker.copies) == 1; copied != tt.wantCopy {
+				t.Fatalf("%d archives copied, want a copy %v", len(docker.copies), tt.wantCopy)
+			}
+			if tt.wantCopy {
+				c := docker.copies[0]
+				if c.containerID != "c1" || c.dst != SecretsMountPoint || !c.options.CopyUIDGID {
+					t.Errorf("copied to %s:%s with %+v, want c1:%s owned by the container's user", c.containerID, c.dst, c.options, SecretsMountPoint)
+				}
+				if files := readArchive(t, bytes.NewReader(c.archive)); len(files) != len(tt.secrets) {
+					t.Errorf("archive holds %d files, want %d", len(files), len(tt.secrets))
+				}
+			}
+
+			// Secrets are copied to a volume that only exists with secrets
+			config := &container.HostConfig{}
+			mountSecrets(config, tt.secrets)
+			if mounted := hasVolume(config, SecretsMountPoint); mounted != tt.wantMount {
+				t.Errorf("secrets volume mounted = %v, want %v", mounted, tt.wantMount)
+			}
+		})
+	}
+}
+
+// hasVolume reports whether a host configuration mounts an anonymous tmpfs
+// volume at target.
+func hasVolume(config *container.HostConfig, target string) bool {
+	for _, m := range config.Mounts {
+		if m.Target != target {
+			continue
+		}
+		return m.Type == mount.TypeVolume && m.Source == "" && m.VolumeOptions != nil && m.VolumeOptions.DriverConfig != nil &&
+			m.VolumeOptions.DriverConfig.Options["type"] == "tmpfs"
+	}
+	return false
+}
+
+func TestExecuteSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+	}{
+		{name: "none"},
+		{name: "secrets", secrets: map[string]string{"API_TOKEN": "s3cr3t", "db.password": "hunter2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeDocker{run: func(event []byte, output io.Writer) {}}
+			o := newTestOrchestrator(docker, Config{})
+
+			function := &storage.Function{Name: "hello", Image: "hello:latest", Env: map[string]string{"GREETING": "hi"}}
+			if _, err := o.Execute(context.Background(), "inv1", function, tt.secrets, []byte(`{}`)); err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+
+			// Secrets never reach the container's configuration, which
+			// `docker inspect` shows
+			for _, value := range tt.secrets {
+				for _, env := range docker.created.Env {
+					if strings.Contains(env, value) {
+						t.Errorf("secret value in the environment: %s", env)
+					}
+				}
+			}
+			if mounted := hasVolume(docker.createdHost, SecretsMountPoint); mounted != (len(tt.secrets) > 0) {
+				t.Errorf("secrets volume mounted = %v, want %v", mounted, len(tt.secrets) > 0)
+			}
+			if len(tt.secrets) == 0 {
+				if len(docker.copies) != 0 {
+					t.Errorf("%d archives copied, want none", len(docker.copies))
+				}
+				return
+			}
+			if len(docker.copies) != 1 {
+				t.Fatalf("%d archives copied, want the secrets", len(docker.copies))
+			}
+			got := make(map[string]string)
+			for _, file := range readArchive(t, bytes.NewReader(docker.copies[0].archive)) {
+				got[file.Name] = file.Content
+			}
+			if !reflect.DeepEqual(got, tt.secrets) {
+				t.Errorf("secrets copied = %v, want %v", got, tt.secrets)
+			}
+			// The volume is anonymous, so Docker removes it along with the
+			// container once it exits
+			if !docker.createdHost.AutoRemove {
+				t.Error("container created without auto removal, which would leave its secrets volume")
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/akos011221/serverless/pkg/storage"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Session is a long-lived function container with its stdin and stdout kept
+// attached, for functions that process a stream of messages in a loop.
+type Session struct {
+	o           *Orchestrator
+	containerID string
+	hijacked    types.HijackedResponse
+	stdout      *io.PipeReader
+	closeOnce   sync.Once
+}
+
+// StartSession creates and starts a container for an interactive session,
+// with the secrets readable as files like in Execute.
+// The caller must Close the session to remove the container.
+func (o *Orchestrator) StartSession(ctx context.Context, invocationID string, function *storage.Function, secrets map[string]string) (*Session, error) {
+	function, err := o.refreshImage(ctx, function)
+	if err != nil {
+		return nil, err
+	}
+	platform, err := o.containerPlatform(function)
+	if err != nil {
+		return nil, err
+	}
+
+	config := o.containerConfig(invocationID, function)
+	// Stdin stays open across messages, unlike in Execute
+	config.OpenStdin = true
+	config.AttachStdin = true
+	config.AttachStdout = true
+	config.AttachStderr = true
+
+	apiCtx, cancel := o.apiContext(ctx)
+	resp, err := o.docker.ContainerCreate(apiCtx, config, hostConfig(function, secrets), nil, platform, "")
+	cancel()
+	if err != nil {
+		return nil, createError(config.Image, err)
+	}
+	if err := o.copySecrets(ctx, resp.ID, secrets); err != nil {
+		o.cleanupContainer(resp.ID)
+		return nil, err
+	}
+
+	// Attach before starting, so no output is lost
+	apiCtx, cancel = o.apiContext(ctx)
+	hijacked, err := o.docker.ContainerAttach(apiCtx, resp.ID, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+		Stderr: true,
+	})
+	cancel()
+	if err != nil {
+		o.cleanupContainer(resp.ID)
+		return nil, fmt.Errorf("failed to attach to container: %v", err)
+	}
+
+	apiCtx, cancel = o.apiContext(ctx)
+	err = o.docker.ContainerStart(apiCtx, resp.ID, container.StartOptions{})
+	cancel()
+	if err != nil {
+		hijacked.Close()
+		o.cleanupContainer(resp.ID)
+		return nil, fmt.Errorf("failed to start container: %v", err)
+	}
+
+	// Without a TTY, stdout and stderr are multiplexed on the stream, and
+	// stderr is forwarded like in Execute
+	stderr, err := o.forwardStderr(function, invocationID)
+	if err != nil {
+		hijacked.Close()
+		o.cleanupContainer(resp.ID)
+		return nil, err
+	}
+	stdout, stdoutWriter := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(stdoutWriter, stderr, hijacked.Reader)
+		stdoutWriter.CloseWithError(err)
+		stderr.Close()
+	}()
+
+	o.log.WithField("function", function.Name).Info("Session started")
+	return &Session{o: o, containerID: resp.ID, hijacked: hijacked, stdout: stdout}, nil
+}
+
+// Write sends data to the function's stdin.
+func (s *Session) Write(p []byte) (int, error) {
+	return s.hijacked.Conn.Write(p)
+}
+
+// Stdout returns the function's output stream. It ends when the container exits.
+func (s *Session) Stdout() io.Reader {
+	return s.stdout
+}
+
+// Close detaches from the container and removes it. It's safe to call more than once.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		s.hijacked.Close()
+		s.stdout.Close()
+		s.o.cleanupContainer(s.containerID)
+	})
+}
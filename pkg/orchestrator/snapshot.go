@@ -0,0 +1,220 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/docker/docker/api/types/checkpoint"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+	"github.com/sirupsen/logrus"
+)
+
+// Snapshots are experimental: a function with Snapshot set is checkpointed
+// with CRIU once it initialized, after its first run, and later cold starts
+// restore the checkpoint instead of starting the function from scratch. The
+// checkpoint is taken of a template container that runs until it waits for
+// its event on stdin, so what's restored is the initialized function, not an
+// earlier invocation. Engines without checkpoint support (Docker without
+// experimental mode or CRIU, Podman's Docker API) fail the first checkpoint,
+// after which snapshots are off and functions start as usual. Other failures
+// only leave the function without a checkpoint until its next run.
+//
+// Checkpoints outlive the server in SnapshotDir, so one taken before a
+// restart is found again rather than taken anew, and the checkpoints of
+// earlier deploys of a function are deleted once its current one is taken.
+
+// snapshots tracks the checkpoints functions are restored from.
+type snapshots struct {
+	mu          sync.Mutex
+	checkpoints map[string]bool // Checkpoints taken, by ID
+	pending     map[string]bool // Checkpoints being taken, by ID
+	unsupported bool            // Set once a checkpoint failed, disabling snapshots
+}
+
+// newSnapshots returns an empty snapshot registry.
+func newSnapshots() *snapshots {
+	return &snapshots{checkpoints: make(map[string]bool), pending: make(map[string]bool)}
+}
+
+// snapshotID names the checkpoint of a function. It changes with every
+// redeploy or patch of the function and with the image it runs, so a
+// checkpoint is never restored into a function configured differently. It
+// starts with the function's snapshotPrefix.
+func snapshotID(function *storage.Function) string {
+	sum := sha256.Sum256([]byte(function.Name + "\x00" + imageRef(function) + "\x00" +
+		strconv.FormatInt(function.UpdatedAt.UnixNano(), 10)))
+	return snapshotPrefix(function) + hex.EncodeToString(sum[:8])
+}
+
+// snapshotPrefix starts the IDs of all the checkpoints of a function, so
+// those of its earlier deploys can be found.
+func snapshotPrefix(function *storage.Function) string {
+	sum := sha256.Sum256([]byte(function.Name))
+	return "serverless-" + hex.EncodeToString(sum[:4]) + "-"
+}
+
+// checkpointUnsupported reports whether a checkpoint failed because the
+// engine can't take any, rather than for this function or transiently.
+func checkpointUnsupported(err error) bool {
+	if errdefs.IsNotImplemented(err) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, reason := range []string{"experimental", "not supported", "unsupported", "not implemented", "page not found"} {
+		if strings.Contains(message, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotsEnabled reports whether a function is restored from checkpoints.
+// Functions with secrets aren't, as their secrets would be written to the
+// checkpoint.
+func (o *Orchestrator) snapshotsEnabled(function *storage.Function) bool {
+	if !o.config.Snapshots || !function.Snapshot || len(function.SecretNames) > 0 {
+		return false
+	}
+	o.snapshots.mu.Lock()
+	defer o.snapshots.mu.Unlock()
+	return !o.snapshots.unsupported
+}
+
+// startOptions returns the options a function's container is started with:
+// restoring its checkpoint when it has one.
+func (o *Orchestrator) startOptions(function *storage.Function) container.StartOptions {
+	if !o.snapshotsEnabled(function) {
+		return container.StartOptions{}
+	}
+	id := snapshotID(function)
+	o.snapshots.mu.Lock()
+	defer o.snapshots.mu.Unlock()
+	if !o.snapshots.checkpoints[id] {
+		return container.StartOptions{}
+	}
+	return container.StartOptions{CheckpointID: id, CheckpointDir: o.config.SnapshotDir}
+}
+
+// forgetSnapshot drops a checkpoint that failed to restore into a container,
+// and deletes it, so the next run of the function takes a new one.
+func (o *Orchestrator) forgetSnapshot(ctx context.Context, containerID, id string) {
+	o.snapshots.mu.Lock()
+	delete(o.snapshots.checkpoints, id)
+	o.snapshots.mu.Unlock()
+
+	err := o.docker.CheckpointDelete(ctx, containerID, checkpoint.DeleteOptions{CheckpointID: id, CheckpointDir: o.config.SnapshotDir})
+	if err != nil {
+		o.log.WithError(err).WithField("checkpoint", id).Warn("Failed to delete checkpoint")
+	}
+}
+
+// snapshotAfterRun takes a checkpoint of a function in the background after
+// it ran, unless it has one or one is being taken.
+func (o *Orchestrator) snapshotAfterRun(function *storage.Function) {
+	if !o.snapshotsEnabled(function) {
+		return
+	}
+	id := snapshotID(function)
+	o.snapshots.mu.Lock()
+	if o.snapshots.checkpoints[id] || o.snapshots.pending[id] {
+		o.snapshots.mu.Unlock()
+		return
+	}
+	o.snapshots.pending[id] = true
+	o.snapshots.mu.Unlock()
+
+	go func() {
+		err := o.takeSnapshot(function, id)
+
+		o.snapshots.mu.Lock()
+		defer o.snapshots.mu.Unlock()
+		delete(o.snapshots.pending, id)
+		log := o.log.WithFields(logrus.Fields{"function": function.Name, "checkpoint": id})
+		if err != nil && checkpointUnsupported(err) {
+			o.snapshots.unsupported = true
+			log.WithError(err).Warn("Engine can't checkpoint functions, disabling snapshots")
+			return
+		}
+		if err != nil {
+			log.WithError(err).Warn("Failed to checkpoint function")
+			return
+		}
+		o.snapshots.checkpoints[id] = true
+		log.Info("Function checkpointed")
+	}()
+}
+
+// takeSnapshot starts a template container of a function, gives it
+// SnapshotDelay to initialize and checkpoints it, which stops it. The
+// container is configured like those of executions, so its checkpoint can be
+// restored into them. A checkpoint taken before a restart is kept instead,
+// and those of earlier deploys are deleted.
+func (o *Orchestrator) takeSnapshot(function *storage.Function, id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.config.SnapshotDelay+3*cleanupTimeout)
+	defer cancel()
+
+	config := o.containerConfig("snapshot-"+id, function)
+	config.OpenStdin = true
+	config.StdinOnce = true
+	config.AttachStdin = true
+	platform, err := o.containerPlatform(function)
+	if err != nil {
+		return err
+	}
+
+	resp, err := o.docker.ContainerCreate(ctx, config, hostConfig(function, nil), nil, platform, "")
+	if err != nil {
+		return fmt.Errorf("failed to create container: %v", err)
+	}
+	defer o.cleanupContainer(resp.ID)
+
+	// Checkpoints in a directory of their own are listed and deleted through
+	// any container
+	existing, err := o.docker.CheckpointList(ctx, resp.ID, checkpoint.ListOptions{CheckpointDir: o.config.SnapshotDir})
+	if err != nil {
+		return fmt.Errorf("failed to list checkpoints: %w", err)
+	}
+	found := false
+	for _, taken := range existing {
+		switch {
+		case taken.Name == id:
+			found = true
+		case strings.HasPrefix(taken.Name, snapshotPrefix(function)):
+			err := o.docker.CheckpointDelete(ctx, resp.ID, checkpoint.DeleteOptions{CheckpointID: taken.Name, CheckpointDir: o.config.SnapshotDir})
+			if err != nil {
+				o.log.WithError(err).WithField("checkpoint", taken.Name).Warn("Failed to delete stale checkpoint")
+			}
+		}
+	}
+	if found {
+		return nil
+	}
+
+	if err := o.docker.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("failed to start container: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(o.config.SnapshotDelay):
+	}
+
+	err = o.docker.CheckpointCreate(ctx, resp.ID, checkpoint.CreateOptions{
+		CheckpointID:  id,
+		CheckpointDir: o.config.SnapshotDir,
+		Exit:          true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint: %w", err)
+	}
+	return nil
+}
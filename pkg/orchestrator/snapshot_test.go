@@ -0,0 +1,267 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/docker/docker/api/types/checkpoint"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/errdefs"
+)
+
+// checkpointDocker is a client whose engine checkpoints containers, recording
+// the options containers are started with.
+type checkpointDocker struct {
+	*fakeDocker
+	checkpointErr error // Error checkpointing fails with
+	restoreErr    error // Error starting from a checkpoint fails with
+
+	mu          sync.Mutex
+	starts      []container.StartOptions // Options of the containers started
+	checkpoints []string                 // IDs of the checkpoints created
+	dir         map[string]bool          // Checkpoints in the snapshot directory, which outlives the server
+	deleted     []string                 // IDs of the checkpoints deleted
+}
+
+// ContainerStart records the options, failing restores with restoreErr.
+func (d *checkpointDocker) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
+	d.mu.Lock()
+	d.starts = append(d.starts, options)
+	d.mu.Unlock()
+	if options.CheckpointID != "" && d.restoreErr != nil {
+		return d.restoreErr
+	}
+	return d.fakeDocker.ContainerStart(ctx, containerID, options)
+}
+
+// CheckpointCreate records the checkpoint, or fails with checkpointErr, or
+// like Docker when the directory holds one of the same name.
+func (d *checkpointDocker) CheckpointCreate(ctx context.Context, containerID string, options checkpoint.CreateOptions) error {
+	if d.checkpointErr != nil {
+		return d.checkpointErr
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dir[options.CheckpointID] {
+		return fmt.Errorf("checkpoint with name %s already exists for container %s", options.CheckpointID, containerID)
+	}
+	if d.dir == nil {
+		d.dir = make(map[string]bool)
+	}
+	d.dir[options.CheckpointID] = true
+	d.checkpoints = append(d.checkpoints, options.CheckpointID)
+	return nil
+}
+
+// CheckpointList lists the checkpoints in the directory.
+func (d *checkpointDocker) CheckpointList(ctx context.Context, containerID string, options checkpoint.ListOptions) ([]checkpoint.Summary, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var summaries []checkpoint.Summary
+	for name := range d.dir {
+		summaries = append(summaries, checkpoint.Summary{Name: name})
+	}
+	return summaries, nil
+}
+
+// CheckpointDelete removes a checkpoint from the directory.
+func (d *checkpointDocker) CheckpointDelete(ctx context.Context, containerID string, options checkpoint.DeleteOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.dir, options.CheckpointID)
+	d.deleted = append(d.deleted, options.CheckpointID)
+	return nil
+}
+
+// lastStart returns the options the last container was started with.
+func (d *checkpointDocker) lastStart() container.StartOptions {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.starts[len(d.starts)-1]
+}
+
+// waitSnapshot waits until no checkpoint of a function is being taken.
+func waitSnapshot(t *testing.T, o *Orchestrator, function *storage.Function) {
+	t.Helper()
+	id := snapshotID(function)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		o.snapshots.mu.Lock()
+		pending := o.snapshots.pending[id]
+		o.snapshots.mu.Unlock()
+		if !pending {
+			return
+		}
+	}
+	t.Fatal("checkpoint still being taken")
+}
+
+func TestSnapshotID(t *testing.T) {
+	updated := time.Unix(1700000000, 0)
+	function := &storage.Function{Name: "hello", Image: "hello:1"}
+	function.UpdatedAt = updated
+	id := snapshotID(function)
+
+	redeployed := *function
+	redeployed.UpdatedAt = updated.Add(time.Second)
+	rebuilt := *function
+	rebuilt.Image = "hello:2"
+	for name, other := range map[string]*storage.Function{"redeployed": &redeployed, "other image": &rebuilt} {
+		if snapshotID(other) == id {
+			t.Errorf("%s function has the same checkpoint %s", name, id)
+		}
+	}
+	if again := snapshotID(function); again != id {
+		t.Errorf("snapshotID = %s, then %s, want it stable", id, again)
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	tests := []struct {
+		name          string
+		secrets       []string
+		serverOff     bool  // Whether the server has snapshots disabled
+		checkpointErr error // Error the engine fails checkpoints with
+		restoreErr    error // Error the engine fails restores with
+		wantRestored  bool  // Whether the second run is restored
+	}{
+		{name: "restored", wantRestored: true},
+		{name: "disabled on the server", serverOff: true},
+		{name: "function with secrets", secrets: []string{"token"}},
+		{name: "checkpoints unsupported", checkpointErr: errors.New("checkpoint only supported in experimental mode")},
+		{name: "checkpoint failed", checkpointErr: errors.New("connection reset by peer")},
+		{name: "restore failed", restoreErr: errors.New("criu failed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &checkpointDocker{
+				fakeDocker:    &fakeDocker{run: func(event []byte, output io.Writer) { output.Write([]byte(`{}`)) }},
+				checkpointErr: tt.checkpointErr,
+				restoreErr:    tt.restoreErr,
+			}
+			o := newTestOrchestrator(docker, Config{
+				Snapshots:     !tt.serverOff,
+				SnapshotDir:   "/var/lib/serverless/checkpoints",
+				SnapshotDelay: time.Millisecond,
+			})
+			function := &storage.Function{Name: "hello", Image: "hello:latest", Snapshot: true, SecretNames: tt.secrets}
+
+			first, err := o.Execute(context.Background(), "inv1", function, nil, []byte(`{}`))
+			if err != nil {
+				t.Fatalf("first Execute failed: %v", err)
+			}
+			if first.Restored {
+				t.Error("first run restored, want it started as usual")
+			}
+			waitSnapshot(t, o, function)
+
+			second, err := o.Execute(context.Background(), "inv2", function, nil, []byte(`{}`))
+			if err != nil {
+				t.Fatalf("second Execute failed: %v", err)
+			}
+			if second.Restored != tt.wantRestored {
+				t.Errorf("second run restored = %v, want %v", second.Restored, tt.wantRestored)
+			}
+			start := docker.lastStart()
+			if tt.wantRestored && (start.CheckpointID != snapshotID(function) || start.CheckpointDir != "/var/lib/serverless/checkpoints") {
+				t.Errorf("started with %+v, want the function's checkpoint", start)
+			}
+			if !tt.wantRestored && start.CheckpointID != "" {
+				t.Errorf("started with %+v, want no checkpoint", start)
+			}
+			if tt.restoreErr != nil {
+				o.snapshots.mu.Lock()
+				kept := o.snapshots.checkpoints[snapshotID(function)]
+				o.snapshots.mu.Unlock()
+				docker.mu.Lock()
+				deleted := slices.Contains(docker.deleted, snapshotID(function))
+				docker.mu.Unlock()
+				if kept || !deleted {
+					t.Error("checkpoint that failed to restore was kept")
+				}
+			}
+			o.snapshots.mu.Lock()
+			disabled := o.snapshots.unsupported
+			o.snapshots.mu.Unlock()
+			if wantDisabled := tt.checkpointErr != nil && checkpointUnsupported(tt.checkpointErr); disabled != wantDisabled {
+				t.Errorf("snapshots disabled = %v, want %v", disabled, wantDisabled)
+			}
+		})
+	}
+}
+
+func TestSnapshotsAfterRestart(t *testing.T) {
+	docker := &checkpointDocker{
+		fakeDocker: &fakeDocker{run: func(event []byte, output io.Writer) { output.Write([]byte(`{}`)) }},
+	}
+	config := Config{Snapshots: true, SnapshotDir: "/var/lib/serverless/checkpoints", SnapshotDelay: time.Millisecond}
+	function := &storage.Function{Name: "hello", Image: "hello:latest", Snapshot: true}
+	function.UpdatedAt = time.Unix(1700000000, 0)
+
+	// Runs the function twice on a fresh orchestrator, as after a restart,
+	// and reports whether the second run was restored
+	runTwice := func(function *storage.Function) bool {
+		t.Helper()
+		o := newTestOrchestrator(docker, config)
+		if _, err := o.Execute(context.Background(), "inv1", function, nil, []byte(`{}`)); err != nil {
+			t.Fatalf("first Execute failed: %v", err)
+		}
+		waitSnapshot(t, o, function)
+		result, err := o.Execute(context.Background(), "inv2", function, nil, []byte(`{}`))
+		if err != nil {
+			t.Fatalf("second Execute failed: %v", err)
+		}
+		return result.Restored
+	}
+
+	if !runTwice(function) {
+		t.Fatal("second run not restored before the restart")
+	}
+	if !runTwice(function) {
+		t.Error("second run not restored after a restart, want the checkpoint found again")
+	}
+	docker.mu.Lock()
+	if len(docker.checkpoints) != 1 {
+		t.Errorf("checkpoints created %q, want one, found again after the restart", docker.checkpoints)
+	}
+	docker.mu.Unlock()
+
+	// A redeploy takes a new checkpoint and deletes the stale one
+	redeployed := *function
+	redeployed.UpdatedAt = function.UpdatedAt.Add(time.Second)
+	if !runTwice(&redeployed) {
+		t.Error("second run of the redeployed function not restored")
+	}
+	docker.mu.Lock()
+	defer docker.mu.Unlock()
+	if want := map[string]bool{snapshotID(&redeployed): true}; !maps.Equal(docker.dir, want) {
+		t.Errorf("checkpoints left %v, want only the current one %v", docker.dir, want)
+	}
+}
+
+func TestCheckpointUnsupported(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: errors.New("checkpoint only supported in experimental mode"), want: true},
+		{err: errors.New("CRIU version check failed: not supported"), want: true},
+		{err: errdefs.NotImplemented(errors.New("checkpoints")), want: true},
+		{err: fmt.Errorf("failed to create checkpoint: %w", errdefs.NotImplemented(errors.New("nope"))), want: true},
+		{err: errors.New("checkpoint with name serverless-1 already exists for container c1")},
+		{err: errors.New("connection reset by peer")},
+		{err: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		if got := checkpointUnsupported(tt.err); got != tt.want {
+			t.Errorf("checkpointUnsupported(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package orchestrator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/functionio"
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// maxLogLine caps a forwarded stderr line, so a function writing without
+// newlines can't make the server buffer without bound.
+const maxLogLine = 64 << 10
+
+// stdoutMu serializes the lines of concurrent executions written to stdout.
+var stdoutMu sync.Mutex
+
+// logLine is a stderr line of a function as written to stdout or a file.
+type logLine struct {
+	Time       time.Time `json:"time"`
+	Function   string    `json:"function"`
+	Invocation string    `json:"invocation"`
+	Line       string    `json:"line"`
+}
+
+// stderrForwarder splits the stderr of an execution into lines, and forwards
+// each to the function's log destination, tagged with the function name and
+// the invocation ID.
+type stderrForwarder struct {
+	function   string
+	invocation string
+	log        *logrus.Logger
+	out        io.Writer // JSON lines destination, nil to log them
+	file       *os.File  // Closed with the forwarder, if the destination is a file
+	partial    bytes.Buffer
+}
+
+// forwardStderr returns the writer the stderr of an execution is forwarded
+// through. It must be closed once the execution ended, to flush the last line.
+func (o *Orchestrator) forwardStderr(function *storage.Function, invocationID string) (io.WriteCloser, error) {
+	forwarder := &stderrForwarder{function: function.Name, invocation: invocationID, log: o.log}
+	switch destination := function.LogDestination; destination {
+	case "", functionio.LogToServer:
+	case functionio.LogToStdout:
+		forwarder.out = lockedWriter{w: os.Stdout, mu: &stdoutMu}
+	case functionio.LogToNone:
+		forwarder.out = io.Discard
+	default:
+		path, _ := strings.CutPrefix(destination, functionio.LogToFile)
+		file, err := o.openLogFile(path)
+		if err != nil {
+			return nil, err
+		}
+		forwarder.out, forwarder.file = file, file
+	}
+	return forwarder, nil
+}
+
+// openLogFile opens a file of the function log directory for appending,
+// creating it if needed. Symlinks may not lead out of the directory: the
+// directory of the file is resolved, and the file itself can't be one.
+func (o *Orchestrator) openLogFile(name string) (*os.File, error) {
+	if o.config.FunctionLogDir == "" {
+		return nil, fmt.Errorf("file log destinations are disabled, the server has no function log directory")
+	}
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("log file %s is outside the function log directory", name)
+	}
+	root, err := filepath.EvalSymlinks(o.config.FunctionLogDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open function log directory: %v", err)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(filepath.Join(root, name)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log destination: %v", err)
+	}
+	if rel, err := filepath.Rel(root, dir); err != nil || !filepath.IsLocal(rel) {
+		return nil, fmt.Errorf("log file %s is outside the function log directory", name)
+	}
+	path := filepath.Join(dir, filepath.Base(name))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log destination: %v", err)
+	}
+	return file, nil
+}
+
+// Write forwards the complete lines in p, keeping a trailing partial line
+// until it's completed.
+func (f *stderrForwarder) Write(p []byte) (int, error) {
+	f.partial.Write(p)
+	for {
+		end := bytes.IndexByte(f.partial.Bytes(), '\n')
+		if end < 0 {
+			break
+		}
+		f.forward(f.partial.Next(end + 1)[:end])
+	}
+	// The rest is kept, unless it's grown too long
+	for f.partial.Len() >= maxLogLine {
+		f.forward(f.partial.Next(maxLogLine))
+	}
+	return len(p), nil
+}
+
+// Close forwards the last line, if it didn't end with a newline.
+func (f *stderrForwarder) Close() error {
+	if f.partial.Len() > 0 {
+		f.forward(f.partial.Bytes())
+		f.partial.Reset()
+	}
+	if f.file != nil {
+		return f.file.Close()
+	}
+	return nil
+}
+
+// forward sends one line to the destination.
+func (f *stderrForwarder) forward(line []byte) {
+	if f.out == nil {
+		f.log.WithFields(logrus.Fields{
+			"function":   f.function,
+			"invocation": f.invocation,
+		}).Debug(string(line))
+		return
+	}
+	data, _ := json.Marshal(logLine{ // Safe to ignore error, as the line is a string
+		Time:       time.Now(),
+		Function:   f.function,
+		Invocation: f.invocation,
+		Line:       string(line),
+	})
+	if _, err := f.out.Write(append(data, '\n')); err != nil {
+		f.log.WithError(err).WithField("function", f.function).Warn("Failed to forward function stderr")
+	}
+}
+
+// lockedWriter serializes writes to a writer shared by executions.
+type lockedWriter struct {
+	w  io.Writer
+	mu *sync.Mutex
+}
+
+// Write writes p under the lock.
+func (l lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
@@ -0,0 +1,231 @@
+package orchestrator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/functionio"
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+func TestOpenLogFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		setup   func(t *testing.T, root, outside string) // Prepares the log directory
+		wantErr bool
+	}{
+		{name: "new file", file: "hello.log"},
+		{
+			name: "existing file",
+			file: "hello.log",
+			setup: func(t *testing.T, root, outside string) {
+				mustWrite(t, filepath.Join(root, "hello.log"))
+			},
+		},
+		{
+			name: "subdirectory",
+			file: "team/hello.log",
+			setup: func(t *testing.T, root, outside string) {
+				mustMkdir(t, filepath.Join(root, "team"))
+			},
+		},
+		{
+			name: "symlinked directory within",
+			file: "alias/hello.log",
+			setup: func(t *testing.T, root, outside string) {
+				mustMkdir(t, filepath.Join(root, "team"))
+				mustSymlink(t, filepath.Join(root, "team"), filepath.Join(root, "alias"))
+			},
+		},
+		{name: "missing subdirectory", file: "missing/hello.log", wantErr: true},
+		{name: "parent directory", file: "../hello.log", wantErr: true},
+		{name: "absolute path", file: "/tmp/hello.log", wantErr: true},
+		{
+			name: "symlinked directory out",
+			file: "escape/hello.log",
+			setup: func(t *testing.T, root, outside string) {
+				mustSymlink(t, outside, filepath.Join(root, "escape"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "symlinked file",
+			file: "hello.log",
+			setup: func(t *testing.T, root, outside string) {
+				mustWrite(t, filepath.Join(outside, "target"))
+				mustSymlink(t, filepath.Join(outside, "target"), filepath.Join(root, "hello.log"))
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, outside := t.TempDir(), t.TempDir()
+			if tt.setup != nil {
+				tt.setup(t, root, outside)
+			}
+			o := newTestOrchestrator(nil, Config{FunctionLogDir: root})
+
+			file, err := o.openLogFile(tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("openLogFile(%s) = %v, want error %v", tt.file, err, tt.wantErr)
+			}
+			if err == nil {
+				file.Close()
+			}
+			if _, err := os.Stat(filepath.Join(outside, "hello.log")); err == nil {
+				t.Error("a log file was created outside the log directory")
+			}
+		})
+	}
+}
+
+func TestOpenLogFileDisabled(t *testing.T) {
+	o := newTestOrchestrator(nil, Config{})
+	if _, err := o.openLogFile("hello.log"); err == nil {
+		t.Error("openLogFile succeeded without a function log directory")
+	}
+}
+
+func TestForwardStderr(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+	}{
+		{name: "nothing"},
+		{name: "one line", writes: []string{"hello\n"}, want: []string{"hello"}},
+		{name: "last line without newline", writes: []string{"a\nb"}, want: []string{"a", "b"}},
+		{name: "line split across writes", writes: []string{"hel", "lo\nwor", "ld\n"}, want: []string{"hello", "world"}},
+		{name: "several lines in a write", writes: []string{"a\nb\nc\n"}, want: []string{"a", "b", "c"}},
+		{name: "empty line", writes: []string{"\n"}, want: []string{""}},
+		{
+			name:   "unterminated line cut once too long",
+			writes: []string{strings.Repeat("x", maxLogLine-5), strings.Repeat("x", 15)},
+			want:   []string{strings.Repeat("x", maxLogLine), strings.Repeat("x", 10)},
+		},
+		{
+			name:   "long line kept whole once terminated",
+			writes: []string{strings.Repeat("x", maxLogLine+10) + "\n"},
+			want:   []string{strings.Repeat("x", maxLogLine+10)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			o := newTestOrchestrator(nil, Config{FunctionLogDir: root})
+			function := &storage.Function{Name: "hello", LogDestination: functionio.LogToFile + "hello.log"}
+
+			forwarder, err := o.forwardStderr(function, "inv-1")
+			if err != nil {
+				t.Fatalf("forwardStderr failed: %v", err)
+			}
+			for _, write := range tt.writes {
+				if n, err := forwarder.Write([]byte(write)); n != len(write) || err != nil {
+					t.Fatalf("Write = %d, %v, want %d", n, err, len(write))
+				}
+			}
+			if err := forwarder.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(root, "hello.log"))
+			if err != nil {
+				t.Fatalf("failed to read the log file: %v", err)
+			}
+			var got []string
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			scanner.Buffer(nil, 2*maxLogLine)
+			for scanner.Scan() {
+				var line logLine
+				if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+					t.Fatalf("log line isn't JSON: %v", err)
+				}
+				if line.Function != "hello" || line.Invocation != "inv-1" || line.Time.IsZero() {
+					t.Errorf("log line = %+v, want it tagged with the function and invocation", line)
+				}
+				got = append(got, line.Line)
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatalf("failed to read the log file: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("forwarded %d lines, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("line %d = %.20q, want %.20q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestForwardStderrDestinations(t *testing.T) {
+	tests := []struct {
+		destination string
+		wantErr     bool
+	}{
+		{destination: ""},
+		{destination: functionio.LogToServer},
+		{destination: functionio.LogToNone},
+		{destination: functionio.LogToFile + "hello.log"},
+		{destination: functionio.LogToFile + "missing/hello.log", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			log := logrus.New()
+			var logged bytes.Buffer
+			log.SetOutput(&logged)
+			log.SetLevel(logrus.DebugLevel)
+			o := &Orchestrator{config: Config{FunctionLogDir: t.TempDir()}, log: log}
+			function := &storage.Function{Name: "hello", LogDestination: tt.destination}
+
+			forwarder, err := o.forwardStderr(function, "inv-1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("forwardStderr = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			forwarder.Write([]byte("boom\n"))
+			forwarder.Close()
+
+			toServer := tt.destination == "" || tt.destination == functionio.LogToServer
+			if got := strings.Contains(logged.String(), "boom"); got != toServer {
+				t.Errorf("line in the server's logs = %v, want %v", got, toServer)
+			}
+		})
+	}
+}
+
+// mustWrite creates an empty file.
+func mustWrite(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustMkdir creates a directory.
+func mustMkdir(t *testing.T, path string) {
+	t.Helper()
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustSymlink creates a symlink at path pointing to target.
+func mustSymlink(t *testing.T, target, path string) {
+	t.Helper()
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,109 @@
+package orchestrator
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// UploadsMountPoint is where the files uploaded with an invocation are
+// mounted in its container, see WithUploads.
+const UploadsMountPoint = "/run/uploads"
+
+// uploadsKey is the context key of the uploads directory of an invocation.
+type uploadsKey struct{}
+
+// WithUploads returns a context whose executions have the files of dir, a
+// host directory holding the files uploaded with the invocation, copied to
+// UploadsMountPoint. The caller removes dir once the execution finished.
+func WithUploads(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, uploadsKey{}, dir)
+}
+
+// uploadsDir returns the uploads directory of the executions made with ctx,
+// empty when there is none.
+func uploadsDir(ctx context.Context) string {
+	dir, _ := ctx.Value(uploadsKey{}).(string)
+	return dir
+}
+
+// mountUploads mounts a volume on a tmpfs at the uploads mount point, for
+// copyUploads to fill, see tmpfsVolume. Nothing is mounted without an
+// uploads directory.
+func mountUploads(config *container.HostConfig, dir string) {
+	if dir == "" {
+		return
+	}
+	config.Mounts = append(config.Mounts, tmpfsVolume(UploadsMountPoint))
+}
+
+// copyUploads copies the files of an uploads directory to the uploads mount
+// of a container created but not yet started, each owned by the function's
+// user and readable by it only.
+func (o *Orchestrator) copyUploads(ctx context.Context, containerID, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	// The archive is streamed, so the files aren't held in memory. Closing
+	// the reader stops the writer if the copy fails early
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	go func() {
+		writer.CloseWithError(writeUploadsArchive(writer, dir))
+	}()
+	if err := o.copyFiles(ctx, containerID, UploadsMountPoint, reader); err != nil {
+		return fmt.Errorf("failed to copy uploads: %v", err)
+	}
+	return nil
+}
+
+// writeUploadsArchive writes a tar archive of the files in dir to w, each as
+// a 0400 file of the same name.
+func writeUploadsArchive(w io.Writer, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := writeArchiveFile(tw, filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeArchiveFile adds a file to a tar archive, as a 0400 file of the same
+// name.
+func writeArchiveFile(tw *tar.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     info.Name(),
+		Mode:     0400,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
@@ -0,0 +1,156 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// writeUploads creates the uploads directory of a test with files, by name.
+func writeUploads(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write upload: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestWriteUploadsArchive(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		setup func(t *testing.T, dir string) // Adds entries that aren't regular files
+		want  []archiveFile
+	}{
+		{name: "empty"},
+		{
+			name:  "files",
+			files: map[string]string{"report.csv": "a,b\n1,2\n", "photo.jpg": "\xff\xd8\xff"},
+			want: []archiveFile{
+				{Name: "photo.jpg", Mode: 0400, Content: "\xff\xd8\xff"},
+				{Name: "report.csv", Mode: 0400, Content: "a,b\n1,2\n"},
+			},
+		},
+		{
+			name:  "large file",
+			files: map[string]string{"big.bin": strings.Repeat("x", 1<<20)},
+			want:  []archiveFile{{Name: "big.bin", Mode: 0400, Content: strings.Repeat("x", 1<<20)}},
+		},
+		{
+			name:  "directories and symlinks skipped",
+			files: map[string]string{"file.txt": "ok"},
+			setup: func(t *testing.T, dir string) {
+				if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink("/etc/passwd", filepath.Join(dir, "passwd")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []archiveFile{{Name: "file.txt", Mode: 0400, Content: "ok"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeUploads(t, tt.files)
+			if tt.setup != nil {
+				tt.setup(t, dir)
+			}
+			var archive bytes.Buffer
+			if err := writeUploadsArchive(&archive, dir); err != nil {
+				t.Fatalf("writeUploadsArchive failed: %v", err)
+			}
+			if got := readArchive(t, &archive); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("archive = %.200v, want %.200v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteUploadsArchiveMissingDir(t *testing.T) {
+	var archive bytes.Buffer
+	if err := writeUploadsArchive(&archive, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("writeUploadsArchive of a missing directory succeeded")
+	}
+}
+
+func TestCopyUploads(t *testing.T) {
+	tests := []struct {
+		name      string
+		dir       func(t *testing.T) string
+		copyErr   error
+		wantCopy  bool
+		wantFiles int
+		wantErr   bool
+	}{
+		{name: "no uploads", dir: func(t *testing.T) string { return "" }},
+		{
+			name:      "uploads",
+			dir:       func(t *testing.T) string { return writeUploads(t, map[string]string{"a": "1", "b": "2"}) },
+			wantCopy:  true,
+			wantFiles: 2,
+		},
+		{
+			name:      "copy fails",
+			dir:       func(t *testing.T) string { return writeUploads(t, map[string]string{"a": "1"}) },
+			copyErr:   errors.New("no such container"),
+			wantCopy:  true,
+			wantFiles: 1,
+			wantErr:   true,
+		},
+		{
+			name:    "directory gone",
+			dir:     func(t *testing.T) string { return filepath.Join(t.TempDir(), "missing") },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docker := &fakeDocker{copyErr: tt.copyErr}
+			o := newTestOrchestrator(docker, Config{})
+			dir := tt.dir(t)
+
+			err := o.copyUploads(context.Background(), "c1", dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("copyUploads = %v, want error %v", err, tt.wantErr)
+			}
+			if copied := len(docker.copies) == 1; copied != tt.wantCopy {
+				t.Fatalf("%d archives copied, want a copy %v", len(docker.copies), tt.wantCopy)
+			}
+			if tt.wantCopy {
+				c := docker.copies[0]
+				if c.dst != UploadsMountPoint || !c.options.CopyUIDGID {
+					t.Errorf("copied to %s with %+v, want %s owned by the container's user", c.dst, c.options, UploadsMountPoint)
+				}
+				if files := readArchive(t, bytes.NewReader(c.archive)); len(files) != tt.wantFiles {
+					t.Errorf("archive holds %d files, want %d", len(files), tt.wantFiles)
+				}
+			}
+
+			config := &container.HostConfig{}
+			mountUploads(config, dir)
+			if mounted := hasVolume(config, UploadsMountPoint); mounted != (dir != "") {
+				t.Errorf("uploads volume mounted = %v, want %v", mounted, dir != "")
+			}
+		})
+	}
+}
+
+func TestUploadsDir(t *testing.T) {
+	if dir := uploadsDir(context.Background()); dir != "" {
+		t.Errorf("uploadsDir without uploads = %q, want none", dir)
+	}
+	if dir := uploadsDir(WithUploads(context.Background(), "/tmp/u")); dir != "/tmp/u" {
+		t.Errorf("uploadsDir = %q, want /tmp/u", dir)
+	}
+}
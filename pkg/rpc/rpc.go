@@ -0,0 +1,176 @@
+// This package defines the gRPC interface of the platform, for low-latency internal callers: the service,
+// its messages, and a client. Messages are encoded as JSON (see Codec) rather than protobuf, so the service
+// is described here in Go and needs no code generation step.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// ServiceName is the full name of the functions service.
+const ServiceName = "serverless.Functions"
+
+// Full method names of the service's RPCs.
+const (
+	InvokeMethod = "/" + ServiceName + "/Invoke"
+	DeployMethod = "/" + ServiceName + "/Deploy"
+	ListMethod   = "/" + ServiceName + "/List"
+)
+
+// ActorKey is the metadata key naming who makes a change, like the X-Actor
+// header of the HTTP API.
+const ActorKey = "x-actor"
+
+// InvokeRequest invokes a function, or an alias, with an event.
+type InvokeRequest struct {
+	Function string          `json:"function"`
+	Event    json.RawMessage `json:"event,omitempty"` // Empty for the function's default event
+}
+
+// InvokeResponse is the outcome of a successful invocation.
+type InvokeResponse struct {
+	Function    string `json:"function"`     // Function that ran, which differs from the request for an alias
+	Output      []byte `json:"output"`       // Output of the function, verbatim
+	ContentType string `json:"content_type"` // Media type of the output
+	ColdStart   bool   `json:"cold_start"`
+	ExecMs      int64  `json:"exec_ms"`
+	Cached      bool   `json:"cached"` // Whether the result was served from the function's cache
+}
+
+// DeployRequest deploys a function, replacing one with the same name.
+type DeployRequest struct {
+	Function json.RawMessage `json:"function"` // Metadata of the function, as sent to POST /functions
+}
+
+// DeployResponse acknowledges a deploy.
+type DeployResponse struct {
+	TimeoutMs int64 `json:"timeout_ms"` // Effective execution timeout of the function
+}
+
+// ListRequest lists the functions.
+type ListRequest struct {
+	IncludeDeleted bool `json:"include_deleted"`
+}
+
+// ListResponse holds the functions, as returned by GET /functions.
+type ListResponse struct {
+	Functions []json.RawMessage `json:"functions"`
+}
+
+// FunctionsServer is the server side of the functions service.
+type FunctionsServer interface {
+	Invoke(context.Context, *InvokeRequest) (*InvokeResponse, error)
+	Deploy(context.Context, *DeployRequest) (*DeployResponse, error)
+	List(context.Context, *ListRequest) (*ListResponse, error)
+}
+
+// RegisterFunctionsServer serves the functions service with srv.
+func RegisterFunctionsServer(s *grpc.Server, srv FunctionsServer) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+// serviceDesc describes the functions service to gRPC, as protoc-gen-go-grpc
+// would generate it.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*FunctionsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Invoke", Handler: unaryHandler(InvokeMethod, FunctionsServer.Invoke)},
+		{MethodName: "Deploy", Handler: unaryHandler(DeployMethod, FunctionsServer.Deploy)},
+		{MethodName: "List", Handler: unaryHandler(ListMethod, FunctionsServer.List)},
+	},
+	Metadata: "serverless.Functions",
+}
+
+// unaryHandler adapts a method of the server to a gRPC handler, passing the
+// call through the server's interceptor if it has one.
+func unaryHandler[Req, Resp any](fullMethod string, method func(FunctionsServer, context.Context, *Req) (*Resp, error)) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		request := new(Req)
+		if err := dec(request); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return method(srv.(FunctionsServer), ctx, request)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}
+		handler := func(ctx context.Context, request any) (any, error) {
+			return method(srv.(FunctionsServer), ctx, request.(*Req))
+		}
+		return interceptor(ctx, request, info, handler)
+	}
+}
+
+// Client is the client side of the functions service.
+type Client struct {
+	conn grpc.ClientConnInterface
+}
+
+// NewClient returns a client of the functions service on conn.
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{conn: conn}
+}
+
+// Invoke invokes a function.
+func (c *Client) Invoke(ctx context.Context, request *InvokeRequest, opts ...grpc.CallOption) (*InvokeResponse, error) {
+	response := new(InvokeResponse)
+	if err := c.conn.Invoke(ctx, InvokeMethod, request, response, withCodec(opts)...); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Deploy deploys a function.
+func (c *Client) Deploy(ctx context.Context, request *DeployRequest, opts ...grpc.CallOption) (*DeployResponse, error) {
+	response := new(DeployResponse)
+	if err := c.conn.Invoke(ctx, DeployMethod, request, response, withCodec(opts)...); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// List lists the functions.
+func (c *Client) List(ctx context.Context, request *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	response := new(ListResponse)
+	if err := c.conn.Invoke(ctx, ListMethod, request, response, withCodec(opts)...); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// withCodec adds the JSON codec to the options of a call.
+func withCodec(opts []grpc.CallOption) []grpc.CallOption {
+	return append([]grpc.CallOption{grpc.CallContentSubtype(CodecName)}, opts...)
+}
+
+// CodecName is the content subtype of the service's messages, so they're sent
+// as application/grpc+json.
+const CodecName = "json"
+
+// Codec encodes the service's messages as JSON. It's registered with gRPC, so
+// servers pick it for calls made with its content subtype.
+type Codec struct{}
+
+// Marshal encodes a message.
+func (Codec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes a message.
+func (Codec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// Name returns the content subtype of the codec.
+func (Codec) Name() string {
+	return CodecName
+}
+
+// init registers the codec with gRPC.
+func init() {
+	encoding.RegisterCodec(Codec{})
+}
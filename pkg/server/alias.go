@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// aliasDetails is the externally visible state of an alias.
+type aliasDetails struct {
+	Name     string                `json:"name"`
+	Function string                `json:"function"`
+	Targets  []storage.AliasTarget `json:"targets"`
+}
+
+// handleAlias processes alias requests (/aliases/{name}).
+// GET shows the alias, PUT replaces its targets.
+func (s *Server) handleAlias(w http.ResponseWriter, r *http.Request) {
+	aliasName := strings.TrimPrefix(r.URL.Path, "/aliases/")
+	if aliasName == "" {
+		s.log.Warn("Missing alias name in request")
+		http.Error(w, "Alias name required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ctx, cancel := s.queryContext(r.Context())
+		defer cancel()
+		alias, err := s.store.GetAlias(ctx, aliasName)
+		if errors.Is(err, storage.ErrQueryTimeout) {
+			s.log.WithError(err).WithField("alias", aliasName).Warn("Database too slow to look up alias")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Database is busy, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, storage.ErrAliasNotFound) {
+			s.log.WithError(err).WithField("alias", aliasName).Warn("Alias not found")
+			http.Error(w, "Alias not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.log.WithError(err).WithField("alias", aliasName).Error("Failed to look up alias")
+			http.Error(w, "Failed to look up alias", http.StatusInternalServerError)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, aliasDetails{Name: alias.Name, Function: alias.Function, Targets: alias.Targets})
+	case http.MethodPut:
+		s.handleSetAlias(w, r, aliasName)
+	default:
+		s.log.WithField("method", r.Method).Warn("Invalid method for alias")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSetAlias validates and stores the targets of an alias.
+func (s *Server) handleSetAlias(w http.ResponseWriter, r *http.Request, aliasName string) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxPayloadBytes)
+	var request struct {
+		Function string                `json:"function"`
+		Targets  []storage.AliasTarget `json:"targets"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.log.WithError(err).Warn("Invalid alias request body")
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Functions take precedence on invoke, so an alias can't shadow one
+	if _, err := s.store.GetFunction(r.Context(), aliasName); err == nil {
+		s.log.WithField("alias", aliasName).Warn("Alias name taken by a function")
+		http.Error(w, "A function with this name exists", http.StatusConflict)
+		return
+	} else if !errors.Is(err, storage.ErrFunctionNotFound) {
+		s.lookupFailed(w, aliasName, err)
+		return
+	}
+
+	if _, err := s.store.GetFunction(r.Context(), request.Function); err != nil {
+		if !errors.Is(err, storage.ErrFunctionNotFound) {
+			s.lookupFailed(w, request.Function, err)
+			return
+		}
+		s.log.WithField("function", request.Function).Warn("Alias function not found")
+		http.Error(w, fmt.Sprintf("Function %s not found", request.Function), http.StatusBadRequest)
+		return
+	}
+	if len(request.Targets) == 0 {
+		http.Error(w, "At least one target required", http.StatusBadRequest)
+		return
+	}
+	total := 0
+	seen := make(map[string]bool)
+	for _, target := range request.Targets {
+		if !validDigest.MatchString(target.Digest) {
+			http.Error(w, fmt.Sprintf("Invalid digest %q, expected sha256:<64 hex digits>", target.Digest), http.StatusBadRequest)
+			return
+		}
+		if target.Weight < 0 {
+			http.Error(w, fmt.Sprintf("Weight of %s must not be negative", target.Digest), http.StatusBadRequest)
+			return
+		}
+		if seen[target.Digest] {
+			http.Error(w, fmt.Sprintf("Revision %s listed more than once", target.Digest), http.StatusBadRequest)
+			return
+		}
+		seen[target.Digest] = true
+		if _, err := s.store.GetRevision(r.Context(), request.Function, target.Digest); err != nil {
+			if !errors.Is(err, storage.ErrRevisionNotFound) {
+				s.lookupFailed(w, request.Function, err)
+				return
+			}
+			s.log.WithFields(logrus.Fields{"function": request.Function, "digest": target.Digest}).Warn("Alias target not found")
+			http.Error(w, fmt.Sprintf("Function %s was never deployed with %s", request.Function, target.Digest), http.StatusBadRequest)
+			return
+		}
+		total += target.Weight
+	}
+	if total == 0 {
+		http.Error(w, "At least one target needs a positive weight", http.StatusBadRequest)
+		return
+	}
+
+	alias := &storage.Alias{Name: aliasName, Function: request.Function, Targets: request.Targets}
+	if err := s.store.SaveAlias(alias); err != nil {
+		s.log.WithError(err).WithField("alias", aliasName).Error("Failed to store alias")
+		http.Error(w, "Failed to store alias", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.WithFields(logrus.Fields{"alias": aliasName, "function": alias.Function}).Info("Alias updated")
+	s.writeJSON(w, http.StatusOK, aliasDetails{Name: alias.Name, Function: alias.Function, Targets: alias.Targets})
+}
+
+// resolveFunction looks up the function an invocation of name runs. A name that
+// isn't a function is looked up as an alias: one of its revisions is picked at
+// random according to the weights, and the function is pinned to it. The
+// lookups share the query timeout.
+func (s *Server) resolveFunction(ctx context.Context, name string) (*storage.Function, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+
+	function, err := s.store.GetFunction(ctx, name)
+	if !errors.Is(err, storage.ErrFunctionNotFound) {
+		return function, err
+	}
+
+	alias, aliasErr := s.store.GetAlias(ctx, name)
+	if aliasErr != nil {
+		if !errors.Is(aliasErr, storage.ErrAliasNotFound) {
+			return nil, aliasErr
+		}
+		return nil, err
+	}
+	function, err = s.store.GetFunction(ctx, alias.Function)
+	if err != nil {
+		return nil, err
+	}
+	revision, err := s.store.GetRevision(ctx, alias.Function, pickTarget(alias.Targets, rand.IntN))
+	if err != nil {
+		return nil, err
+	}
+	function.Image = revision.Image
+	function.Digest = revision.Digest
+	return function, nil
+}
+
+// pickTarget selects the digest of a target with probability proportional to
+// its weight, drawing from intN, e.g. rand.IntN.
+func pickTarget(targets []storage.AliasTarget, intN func(n int) int) string {
+	total := 0
+	for _, target := range targets {
+		total += target.Weight
+	}
+
+	n := intN(total)
+	for _, target := range targets {
+		if n < target.Weight {
+			return target.Digest
+		}
+		n -= target.Weight
+	}
+	return targets[len(targets)-1].Digest
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// Digests of revisions deployed in the alias tests.
+const (
+	stableDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	canaryDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+// deployRevisions stores hello deployed with each digest in turn, leaving the
+// last one current.
+func deployRevisions(t *testing.T, s *Server, digests ...string) {
+	t.Helper()
+	for _, digest := range digests {
+		storeFunction(t, s, &storage.Function{Name: "hello", Image: "serverless-hello:latest", Runtime: "go", Digest: digest})
+	}
+}
+
+func TestPickTarget(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []storage.AliasTarget
+	}{
+		{name: "single", targets: []storage.AliasTarget{{Digest: stableDigest, Weight: 10}}},
+		{name: "canary", targets: []storage.AliasTarget{{Digest: stableDigest, Weight: 90}, {Digest: canaryDigest, Weight: 10}}},
+		{name: "even", targets: []storage.AliasTarget{{Digest: stableDigest, Weight: 1}, {Digest: canaryDigest, Weight: 1}}},
+		{name: "drained", targets: []storage.AliasTarget{{Digest: stableDigest, Weight: 0}, {Digest: canaryDigest, Weight: 5}}},
+	}
+	const picks = 100000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := rand.New(rand.NewPCG(1, 2))
+			counts := make(map[string]int)
+			for range picks {
+				counts[pickTarget(tt.targets, rng.IntN)]++
+			}
+
+			total := 0
+			for _, target := range tt.targets {
+				total += target.Weight
+			}
+			for _, target := range tt.targets {
+				want := float64(target.Weight) / float64(total)
+				got := float64(counts[target.Digest]) / picks
+				if math.Abs(got-want) > 0.01 {
+					t.Errorf("%s picked %.3f of the time, want %.3f", target.Digest, got, want)
+				}
+				if target.Weight == 0 && counts[target.Digest] > 0 {
+					t.Errorf("%s has no weight but was picked %d times", target.Digest, counts[target.Digest])
+				}
+			}
+		})
+	}
+}
+
+func TestSetAlias(t *testing.T) {
+	tests := []struct {
+		name       string
+		alias      string
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "canary",
+			alias:      "prod",
+			body:       `{"function":"hello","targets":[{"digest":"` + stableDigest + `","weight":90},{"digest":"` + canaryDigest + `","weight":10}]}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unknown function",
+			alias:      "prod",
+			body:       `{"function":"missing","targets":[{"digest":"` + stableDigest + `","weight":1}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "never deployed digest",
+			alias:      "prod",
+			body:       `{"function":"hello","targets":[{"digest":"sha256:3333333333333333333333333333333333333333333333333333333333333333","weight":1}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "not a digest",
+			alias:      "prod",
+			body:       `{"function":"hello","targets":[{"digest":"v2","weight":1}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "duplicate revision",
+			alias:      "prod",
+			body:       `{"function":"hello","targets":[{"digest":"` + stableDigest + `","weight":1},{"digest":"` + stableDigest + `","weight":1}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "negative weight",
+			alias:      "prod",
+			body:       `{"function":"hello","targets":[{"digest":"` + stableDigest + `","weight":-1}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no weight",
+			alias:      "prod",
+			body:       `{"function":"hello","targets":[{"digest":"` + stableDigest + `","weight":0}]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no targets",
+			alias:      "prod",
+			body:       `{"function":"hello","targets":[]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "shadows function",
+			alias:      "hello",
+			body:       `{"function":"hello","targets":[{"digest":"` + stableDigest + `","weight":1}]}`,
+			wantStatus: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			deployRevisions(t, s, stableDigest, canaryDigest)
+
+			w := httptest.NewRecorder()
+			s.handleAlias(w, httptest.NewRequest(http.MethodPut, "/aliases/"+tt.alias, strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			w = httptest.NewRecorder()
+			s.handleAlias(w, httptest.NewRequest(http.MethodGet, "/aliases/"+tt.alias, nil))
+			var details aliasDetails
+			if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil {
+				t.Fatalf("invalid alias: %v", err)
+			}
+			if details.Function != "hello" || len(details.Targets) != 2 {
+				t.Errorf("alias = %+v, want both revisions of hello", details)
+			}
+		})
+	}
+}
+
+func TestInvokeAlias(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+		return []byte(`{"ok":true}`), 0
+	}))
+	// The canary is the current deploy, the alias still routes to the stable revision
+	deployRevisions(t, s, stableDigest, canaryDigest)
+	body := `{"function":"hello","targets":[{"digest":"` + stableDigest + `","weight":1},{"digest":"` + canaryDigest + `","weight":0}]}`
+	w := httptest.NewRecorder()
+	s.handleAlias(w, httptest.NewRequest(http.MethodPut, "/aliases/prod", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("setting the alias failed with %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		wantDigest string
+	}{
+		{name: "alias", path: "/invoke/prod", wantDigest: stableDigest},
+		{name: "function", path: "/invoke/hello", wantDigest: canaryDigest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, tt.path, bytes.NewReader([]byte(`{}`))))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			if got := w.Header().Get("X-Serverless-Function"); got != "hello" {
+				t.Errorf("ran function %q, want hello", got)
+			}
+			if got := w.Header().Get("X-Serverless-Digest"); got != tt.wantDigest {
+				t.Errorf("ran revision %q, want %q", got, tt.wantDigest)
+			}
+		})
+	}
+}
+
+func TestInvokeAliasAsync(t *testing.T) {
+	engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+		return []byte(`{"ok":true}`), 0
+	})
+	s := newTestServer(t, engine)
+	deployRevisions(t, s, stableDigest, canaryDigest)
+	body := `{"function":"hello","targets":[{"digest":"` + stableDigest + `","weight":1},{"digest":"` + canaryDigest + `","weight":0}]}`
+	w := httptest.NewRecorder()
+	s.handleAlias(w, httptest.NewRequest(http.MethodPut, "/aliases/prod", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("setting the alias failed with %d: %s", w.Code, w.Body)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/invoke/prod", strings.NewReader(`{}`))
+	r.Header.Set(asyncHeader, "true")
+	w = httptest.NewRecorder()
+	s.handleInvoke(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	var job jobDetails
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatalf("invalid job details: %v", err)
+	}
+	s.runJob(context.Background(), <-s.jobQueue)
+
+	stored, err := s.store.GetJob(context.Background(), job.JobID)
+	if err != nil {
+		t.Fatalf("GetJob failed: %v", err)
+	}
+	if stored.Status != storage.JobSucceeded {
+		t.Fatalf("job %s: %s, want it to succeed", stored.Status, stored.Error)
+	}
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if len(engine.ran) != 1 || engine.ran[0] != stableDigest {
+		t.Errorf("ran images %v, want the stable revision %s", engine.ran, stableDigest)
+	}
+}
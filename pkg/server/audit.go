@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// actorHeader names who makes a change, recorded in the audit log. There's
+// no authentication, so it's what the client declares.
+const actorHeader = "X-Actor"
+
+const (
+	defaultAuditLimit = 50   // Events listed when the request doesn't say
+	maxAuditLimit     = 1000 // Most events listed at once
+	maxActorLength    = 128  // Longer actors are cut
+)
+
+// auditEntry is the externally visible form of an audit event.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Function string    `json:"function"`
+	Action   string    `json:"action"`
+	Actor    string    `json:"actor,omitempty"`
+	Details  string    `json:"details,omitempty"`
+}
+
+// requestActor returns who makes the change of a request.
+func requestActor(r *http.Request) string {
+	return r.Header.Get(actorHeader)
+}
+
+// recordAudit appends a change to a function to the audit log. The change
+// already happened, so failing to record it is logged rather than failing
+// the request.
+func (s *Server) recordAudit(actor, action, functionName, details string) {
+	actor = strings.TrimSpace(actor)
+	if len(actor) > maxActorLength {
+		actor = actor[:maxActorLength]
+	}
+	event := &storage.AuditEvent{
+		FunctionName: functionName,
+		Action:       action,
+		Actor:        actor,
+		Details:      details,
+	}
+	if err := s.store.RecordAuditEvent(event); err != nil {
+		s.log.WithError(err).WithFields(logrus.Fields{
+			"function": functionName,
+			"action":   action,
+		}).Error("Failed to record audit event")
+	}
+}
+
+// deployedImage describes the image of a deployed function for the audit
+// log, with its digest when it's known.
+func deployedImage(function *storage.Function) string {
+	if function.Digest == "" {
+		return function.Image
+	}
+	return function.Image + " " + function.Digest
+}
+
+// handleAudit returns the most recent changes to functions, newest first
+// (GET /audit). ?function= narrows them to a function, and ?limit= sets how
+// many are returned.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.log.WithField("method", r.Method).Warn("Invalid method for audit")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultAuditLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxAuditLimit)
+	}
+
+	events, err := s.store.ListAuditEvents(r.URL.Query().Get("function"), limit)
+	if err != nil {
+		s.log.WithError(err).Error("Failed to list audit events")
+		http.Error(w, "Failed to list audit events", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]auditEntry, 0, len(events))
+	for _, event := range events {
+		entries = append(entries, auditEntry{
+			Time:     event.CreatedAt,
+			Function: event.FunctionName,
+			Action:   event.Action,
+			Actor:    event.Actor,
+			Details:  event.Details,
+		})
+	}
+	s.writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// change sends a request changing functions as actor, failing the test
+// unless it succeeds.
+func change(t *testing.T, s *Server, method, path, body, actor string) {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if actor != "" {
+		r.Header.Set(actorHeader, actor)
+	}
+	w := httptest.NewRecorder()
+	if path == "/functions" {
+		s.handleFunctions(w, r)
+	} else {
+		s.handleFunction(w, r)
+	}
+	if w.Code >= 300 {
+		t.Fatalf("%s %s = %d: %s", method, path, w.Code, w.Body)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, nil))
+	change(t, s, http.MethodPost, "/functions", `{"name":"hello","image":"hello:1","runtime":"go"}`, "alice")
+	change(t, s, http.MethodPatch, "/functions/hello", `{"max_retries":2}`, "  bob  ")
+	change(t, s, http.MethodDelete, "/functions/hello", "", "carol")
+	change(t, s, http.MethodPost, "/functions/hello/restore", "", "")
+	change(t, s, http.MethodPost, "/functions", `{"name":"world","image":"world:1","runtime":"go"}`, strings.Repeat("x", 200))
+
+	tests := []struct {
+		name       string
+		query      string
+		want       []auditEntry // Without their time
+		wantStatus int
+	}{
+		{
+			name: "all, newest first",
+			want: []auditEntry{
+				{Function: "world", Action: "deploy", Actor: strings.Repeat("x", maxActorLength), Details: "world:1"},
+				{Function: "hello", Action: "restore"},
+				{Function: "hello", Action: "delete", Actor: "carol"},
+				{Function: "hello", Action: "update", Actor: "bob", Details: "max_retries"},
+				{Function: "hello", Action: "deploy", Actor: "alice", Details: "hello:1"},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:  "one function",
+			query: "?function=world",
+			want: []auditEntry{
+				{Function: "world", Action: "deploy", Actor: strings.Repeat("x", maxActorLength), Details: "world:1"},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:  "limited",
+			query: "?function=hello&limit=2",
+			want: []auditEntry{
+				{Function: "hello", Action: "restore"},
+				{Function: "hello", Action: "delete", Actor: "carol"},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{name: "unknown function", query: "?function=missing", want: []auditEntry{}, wantStatus: http.StatusOK},
+		{name: "zero limit", query: "?limit=0", wantStatus: http.StatusBadRequest},
+		{name: "invalid limit", query: "?limit=all", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleAudit(w, httptest.NewRequest(http.MethodGet, "/audit"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var entries []auditEntry
+			if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+				t.Fatalf("invalid audit log: %v", err)
+			}
+			got := make([]auditEntry, len(entries))
+			for i, entry := range entries {
+				if entry.Time.IsZero() {
+					t.Errorf("entry %d has no time", i)
+				}
+				got[i] = auditEntry{Function: entry.Function, Action: entry.Action, Actor: entry.Actor, Details: entry.Details}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("audit log = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned when a function's circuit breaker rejects an invocation.
+var errCircuitOpen = errors.New("circuit breaker open, function is failing repeatedly")
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"    // Invocations flow normally
+	breakerOpen     = "open"      // Invocations are rejected until the cooldown passes
+	breakerHalfOpen = "half-open" // A single trial invocation tests recovery
+)
+
+// breakerStatus is the externally visible state of a circuit breaker.
+type breakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"` // When an open breaker half-opens
+}
+
+// circuitBreaker stops invoking a function after it failed threshold times in
+// a row within window. Once open, invocations are short-circuited for the
+// cooldown, after which a single trial invocation decides whether to close
+// the breaker again or reopen it.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	state         string
+	failures      int       // Consecutive failures in the current window
+	firstFailure  time.Time // Start of the current failure window
+	openedAt      time.Time
+	trialInFlight bool // Whether the half-open trial invocation is running
+}
+
+// allow reports whether an invocation may proceed. In the half-open state only
+// one invocation is let through at a time.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		fallthrough
+	case breakerHalfOpen:
+		if b.trialInFlight {
+			return false
+		}
+		b.trialInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of an allowed invocation.
+func (b *circuitBreaker) record(success bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trialInFlight = false
+	if success {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	if b.state == breakerHalfOpen {
+		// The trial failed, so wait another cooldown
+		b.state = breakerOpen
+		b.openedAt = now
+		return
+	}
+
+	// Failures spread further apart than the window don't accumulate
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.window {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+}
+
+// release gives up an allowed invocation without an outcome (e.g. the client
+// went away), so a half-open breaker can run another trial.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trialInFlight = false
+}
+
+// status returns the current state of the breaker.
+func (b *circuitBreaker) status() breakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := breakerStatus{State: b.state, ConsecutiveFailures: b.failures}
+	if b.state == breakerOpen {
+		retryAt := b.openedAt.Add(b.cooldown)
+		status.RetryAt = &retryAt
+	}
+	return status
+}
+
+// retryAfter returns the whole seconds until the breaker lets an invocation
+// through again, as Retry-After takes them: the cooldown left while open,
+// rounded up, and at least one, as a trial may be running when it's
+// half-open.
+func (b *circuitBreaker) retryAfter(now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seconds := 1
+	if b.state == breakerOpen {
+		left := b.openedAt.Add(b.cooldown).Sub(now)
+		seconds = max(int((left+time.Second-1)/time.Second), seconds)
+	}
+	return seconds
+}
+
+// breakerRegistry holds the circuit breakers, keyed by function name.
+type breakerRegistry struct {
+	mu        sync.Mutex
+	breakers  map[string]*circuitBreaker
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+}
+
+// newBreakerRegistry creates a registry whose breakers use the given settings.
+func newBreakerRegistry(threshold int, window, cooldown time.Duration) *breakerRegistry {
+	return &breakerRegistry{
+		breakers:  make(map[string]*circuitBreaker),
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+	}
+}
+
+// get returns the breaker of a function, creating it on first use.
+func (r *breakerRegistry) get(functionName string) *circuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.breakers[functionName]
+	if !ok {
+		b = &circuitBreaker{
+			threshold: r.threshold,
+			window:    r.window,
+			cooldown:  r.cooldown,
+			state:     breakerClosed,
+		}
+		r.breakers[functionName] = b
+	}
+	return b
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// breakerStep is an operation on a circuit breaker, at an offset from the
+// start of the test.
+type breakerStep struct {
+	at        time.Duration
+	op        string // allow, fail, succeed or release
+	wantAllow bool   // For allow
+	wantState string // State after the step, empty not to check it
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	const (
+		window   = 10 * time.Second
+		cooldown = 30 * time.Second
+	)
+	tests := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{
+			name: "opens after threshold failures",
+			steps: []breakerStep{
+				{op: "fail", wantState: breakerClosed},
+				{at: time.Second, op: "fail", wantState: breakerClosed},
+				{at: 2 * time.Second, op: "fail", wantState: breakerOpen},
+				{at: 3 * time.Second, op: "allow", wantAllow: false},
+			},
+		},
+		{
+			name: "success resets the failures",
+			steps: []breakerStep{
+				{op: "fail"},
+				{op: "fail"},
+				{op: "succeed"},
+				{op: "fail"},
+				{op: "fail", wantState: breakerClosed},
+			},
+		},
+		{
+			name: "failures outside the window don't accumulate",
+			steps: []breakerStep{
+				{op: "fail"},
+				{at: 5 * time.Second, op: "fail"},
+				{at: 11 * time.Second, op: "fail", wantState: breakerClosed},
+				{at: 12 * time.Second, op: "fail", wantState: breakerClosed},
+				{at: 13 * time.Second, op: "fail", wantState: breakerOpen},
+			},
+		},
+		{
+			name: "half-opens after the cooldown, a trial at a time",
+			steps: []breakerStep{
+				{op: "fail"}, {op: "fail"}, {op: "fail"},
+				{at: cooldown - time.Second, op: "allow", wantAllow: false, wantState: breakerOpen},
+				{at: cooldown, op: "allow", wantAllow: true, wantState: breakerHalfOpen},
+				{at: cooldown, op: "allow", wantAllow: false},
+			},
+		},
+		{
+			name: "successful trial closes",
+			steps: []breakerStep{
+				{op: "fail"}, {op: "fail"}, {op: "fail"},
+				{at: cooldown, op: "allow", wantAllow: true},
+				{at: cooldown, op: "succeed", wantState: breakerClosed},
+				{at: cooldown, op: "allow", wantAllow: true},
+				{at: cooldown, op: "allow", wantAllow: true},
+			},
+		},
+		{
+			name: "failed trial reopens for another cooldown",
+			steps: []breakerStep{
+				{op: "fail"}, {op: "fail"}, {op: "fail"},
+				{at: cooldown, op: "allow", wantAllow: true},
+				{at: cooldown + time.Second, op: "fail", wantState: breakerOpen},
+				{at: 2 * cooldown, op: "allow", wantAllow: false},
+				{at: 2*cooldown + time.Second, op: "allow", wantAllow: true},
+			},
+		},
+		{
+			name: "released trial lets another through",
+			steps: []breakerStep{
+				{op: "fail"}, {op: "fail"}, {op: "fail"},
+				{at: cooldown, op: "allow", wantAllow: true},
+				{at: cooldown, op: "release", wantState: breakerHalfOpen},
+				{at: cooldown, op: "allow", wantAllow: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreakerRegistry(3, window, cooldown).get("f")
+			start := time.Now()
+			for i, step := range tt.steps {
+				now := start.Add(step.at)
+				switch step.op {
+				case "allow":
+					if got := b.allow(now); got != step.wantAllow {
+						t.Fatalf("step %d: allow = %v, want %v", i, got, step.wantAllow)
+					}
+				case "fail":
+					b.record(false, now)
+				case "succeed":
+					b.record(true, now)
+				case "release":
+					b.release()
+				}
+				if step.wantState != "" {
+					if state := b.status().State; state != step.wantState {
+						t.Fatalf("step %d: state = %s, want %s", i, state, step.wantState)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerRetryAfter(t *testing.T) {
+	const cooldown = 30 * time.Second
+	tests := []struct {
+		name    string
+		state   string
+		elapsed time.Duration // Since the breaker opened
+		want    int
+	}{
+		{name: "just opened", state: breakerOpen, want: 30},
+		{name: "rounded up", state: breakerOpen, elapsed: 10*time.Second + time.Millisecond, want: 20},
+		{name: "whole seconds left", state: breakerOpen, elapsed: 10 * time.Second, want: 20},
+		{name: "under a second left", state: breakerOpen, elapsed: cooldown - time.Millisecond, want: 1},
+		{name: "cooldown over", state: breakerOpen, elapsed: 2 * cooldown, want: 1},
+		{name: "half-open", state: breakerHalfOpen, want: 1},
+		{name: "closed", state: breakerClosed, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openedAt := time.Now()
+			b := &circuitBreaker{cooldown: cooldown, state: tt.state, openedAt: openedAt}
+			if got := b.retryAfter(openedAt.Add(tt.elapsed)); got != tt.want {
+				t.Errorf("retryAfter = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerRegistry(t *testing.T) {
+	r := newBreakerRegistry(1, time.Minute, time.Minute)
+	a := r.get("a")
+	if r.get("a") != a {
+		t.Error("get returned another breaker for the same function")
+	}
+	a.record(false, time.Now())
+	if state := r.get("b").status().State; state != breakerClosed {
+		t.Errorf("another function's breaker is %s, want closed", state)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+)
+
+// cacheHeader tells whether an invocation was answered from the result cache.
+const cacheHeader = "X-Serverless-Cache"
+
+// cacheEntry is a cached result of an invocation.
+type cacheEntry struct {
+	result *orchestrator.Result
+}
+
+// resultCache keeps the results of successful invocations of deterministic
+// functions for their cache TTL, keyed by eventKey. Unlike the dedup cache it
+// only serves finished results, and it's bypassed on request. Entries live in
+// memory, so they don't survive a restart of the server.
+type resultCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+// newResultCache creates an empty cache.
+func newResultCache() *resultCache {
+	return &resultCache{entries: make(map[string]*cacheEntry)}
+}
+
+// get returns the cached result for key, if there is one.
+func (c *resultCache) get(key string) (*orchestrator.Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return entry.result, true
+}
+
+// put caches a result for key, for ttl.
+func (c *resultCache) put(key string, result *orchestrator.Result, ttl time.Duration) {
+	entry := &cacheEntry{result: result}
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+
+	time.AfterFunc(ttl, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+	})
+}
+
+// invalidate drops the cached results of a function, e.g. because it was
+// redeployed and may now return something else.
+func (c *resultCache) invalidate(functionName string) {
+	prefix := functionName + "/"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// bypassCache reports whether a request asks for a fresh result with
+// Cache-Control: no-cache.
+func bypassCache(r *http.Request) bool {
+	for _, value := range r.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestResultCache(t *testing.T) {
+	c := newResultCache()
+	result := &orchestrator.Result{Output: []byte(`{"ok":true}`)}
+	hello := eventKey(&storage.Function{Name: "hello"}, []byte(`{}`))
+	other := eventKey(&storage.Function{Name: "hello-v2"}, []byte(`{}`))
+	c.put(hello, result, 50*time.Millisecond)
+	c.put(other, result, time.Minute)
+
+	if got, ok := c.get(hello); !ok || got != result {
+		t.Errorf("get = %v, %v, want the cached result", got, ok)
+	}
+	if _, ok := c.get(eventKey(&storage.Function{Name: "hello"}, []byte(`{"a":1}`))); ok {
+		t.Error("another event got the cached result")
+	}
+	if _, ok := c.get(eventKey(&storage.Function{Name: "hello", Digest: "sha256:1"}, []byte(`{}`))); ok {
+		t.Error("another revision got the cached result")
+	}
+
+	// Entries expire after their TTL
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := c.get(hello); ok {
+		t.Error("expired result still cached")
+	}
+
+	// Invalidating a function leaves functions sharing a name prefix alone
+	c.put(hello, result, time.Minute)
+	c.invalidate("hello")
+	if _, ok := c.get(hello); ok {
+		t.Error("invalidated result still cached")
+	}
+	if _, ok := c.get(other); !ok {
+		t.Error("invalidating hello dropped the results of hello-v2")
+	}
+}
+
+func TestBypassCache(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl []string
+		want         bool
+	}{
+		{name: "none"},
+		{name: "no-cache", cacheControl: []string{"no-cache"}, want: true},
+		{name: "case and spaces", cacheControl: []string{"max-age=0, No-Cache"}, want: true},
+		{name: "second header", cacheControl: []string{"max-age=0", "no-cache"}, want: true},
+		{name: "other directive", cacheControl: []string{"no-store"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/invoke/hello", nil)
+			for _, value := range tt.cacheControl {
+				r.Header.Add("Cache-Control", value)
+			}
+			if got := bypassCache(r); got != tt.want {
+				t.Errorf("bypassCache = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvokeCache(t *testing.T) {
+	// Each step invokes the function, unless it redeploys it or waits
+	type step struct {
+		event      string
+		noCache    bool
+		redeploy   bool
+		wait       time.Duration
+		wantHeader string // X-Serverless-Cache of the response
+		wantRun    bool   // Whether the function ran
+	}
+	tests := []struct {
+		name  string
+		ttlMs int64
+		steps []step
+	}{
+		{
+			name:  "hit and miss",
+			ttlMs: 60000,
+			steps: []step{
+				{event: `{"a":1}`, wantHeader: "MISS", wantRun: true},
+				{event: `{"a":1}`, wantHeader: "HIT"},
+				{event: `{"a":2}`, wantHeader: "MISS", wantRun: true},
+				{event: `{"a":2}`, wantHeader: "HIT"},
+			},
+		},
+		{
+			name:  "bypassed",
+			ttlMs: 60000,
+			steps: []step{
+				{event: `{"a":1}`, wantHeader: "MISS", wantRun: true},
+				{event: `{"a":1}`, noCache: true, wantHeader: "MISS", wantRun: true},
+				{event: `{"a":1}`, wantHeader: "HIT"},
+			},
+		},
+		{
+			name:  "expired",
+			ttlMs: 50,
+			steps: []step{
+				{event: `{"a":1}`, wantHeader: "MISS", wantRun: true},
+				{wait: 100 * time.Millisecond},
+				{event: `{"a":1}`, wantHeader: "MISS", wantRun: true},
+			},
+		},
+		{
+			name:  "invalidated on deploy",
+			ttlMs: 60000,
+			steps: []step{
+				{event: `{"a":1}`, wantHeader: "MISS", wantRun: true},
+				{redeploy: true},
+				{event: `{"a":1}`, wantHeader: "MISS", wantRun: true},
+			},
+		},
+		{
+			name: "disabled",
+			steps: []step{
+				{event: `{"a":1}`, wantRun: true},
+				{event: `{"a":1}`, wantRun: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs atomic.Int32
+			s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				n := runs.Add(1)
+				return []byte(`{"run":` + strconv.Itoa(int(n)) + `}`), 0
+			}))
+			deploy := func() {
+				t.Helper()
+				body, _ := json.Marshal(map[string]any{"name": "hello", "image": "hello:latest", "runtime": "go", "cache_ttl_ms": tt.ttlMs})
+				w := httptest.NewRecorder()
+				s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+				if w.Code != http.StatusOK {
+					t.Fatalf("deploy failed with %d: %s", w.Code, w.Body)
+				}
+			}
+			deploy()
+
+			for i, step := range tt.steps {
+				switch {
+				case step.redeploy:
+					deploy()
+					continue
+				case step.wait > 0:
+					time.Sleep(step.wait)
+					continue
+				}
+
+				before := runs.Load()
+				r := httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(step.event))
+				if step.noCache {
+					r.Header.Set("Cache-Control", "no-cache")
+				}
+				w := httptest.NewRecorder()
+				s.handleInvoke(w, r)
+				if w.Code != http.StatusOK {
+					t.Fatalf("step %d: status = %d, want %d: %s", i, w.Code, http.StatusOK, w.Body)
+				}
+				if got := w.Header().Get(cacheHeader); got != step.wantHeader {
+					t.Errorf("step %d: %s = %q, want %q", i, cacheHeader, got, step.wantHeader)
+				}
+				if ran := runs.Load() > before; ran != step.wantRun {
+					t.Errorf("step %d: function ran = %v, want %v", i, ran, step.wantRun)
+				}
+			}
+		})
+	}
+}
+
+func TestInvokeCacheFailure(t *testing.T) {
+	var runs atomic.Int32
+	s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+		runs.Add(1)
+		return []byte(`{"error":"flaky"}`), 1
+	}))
+	storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go", CacheTTLMs: 60000})
+
+	for range 2 {
+		w := httptest.NewRecorder()
+		s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(`{}`)))
+		if w.Code == http.StatusOK || w.Header().Get(cacheHeader) == "HIT" {
+			t.Errorf("failed invocation = %d (%s %q), want the failure, not cached", w.Code, cacheHeader, w.Header().Get(cacheHeader))
+		}
+	}
+	if runs.Load() != 2 {
+		t.Errorf("function ran %d times, want failures not cached", runs.Load())
+	}
+}
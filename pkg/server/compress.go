@@ -0,0 +1,140 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// readBody reads a request body of at most limit bytes, decompressing it when
+// sent with Content-Encoding: gzip. The limit applies to the decompressed body
+// as well, and exceeding it is reported with an *http.MaxBytesError.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	body := io.Reader(http.MaxBytesReader(w, r.Body, limit))
+
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+		return io.ReadAll(body)
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+
+		data, err := io.ReadAll(io.LimitReader(gz, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > limit {
+			return nil, &http.MaxBytesError{Limit: limit}
+		}
+		return data, nil
+	default:
+		return nil, &unsupportedEncodingError{encoding: encoding}
+	}
+}
+
+// unsupportedEncodingError is returned for request bodies in an encoding the
+// server can't decode.
+type unsupportedEncodingError struct {
+	encoding string
+}
+
+func (e *unsupportedEncodingError) Error() string {
+	return "unsupported content encoding " + e.encoding
+}
+
+// gzipResponses compresses responses for clients that accept gzip.
+func gzipResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the client accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(value), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body written through it. Responses that
+// already have a content encoding, e.g. set by a function in proxy mode, that
+// can't have a body, or that are event streams are passed through.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	compress    bool
+}
+
+// WriteHeader decides whether to compress before writing the header.
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	header := g.Header()
+	if header.Get("Content-Encoding") == "" && status != http.StatusNoContent && status != http.StatusNotModified &&
+		!strings.HasPrefix(header.Get("Content-Type"), eventStreamType) {
+		g.compress = true
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+// Write compresses data on its way to the client.
+func (g *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !g.wroteHeader {
+		// Sniff the type from the uncompressed data, the server would see gzip
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.compress {
+		return g.ResponseWriter.Write(data)
+	}
+	if g.gz == nil {
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	return g.gz.Write(data)
+}
+
+// Flush sends the data compressed so far to the client.
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap exposes the original writer to http.ResponseController.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// close flushes the compressed data.
+func (g *gzipResponseWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
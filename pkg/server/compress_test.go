@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// gzipped compresses data.
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadBody(t *testing.T) {
+	event := []byte(`{"hello":"world"}`)
+	tests := []struct {
+		name        string
+		encoding    string
+		body        []byte
+		limit       int64
+		want        []byte
+		wantTooBig  bool
+		wantEncoded bool // Whether the encoding is rejected as unsupported
+		wantErr     bool
+	}{
+		{name: "plain", body: event, limit: 1024, want: event},
+		{name: "identity", encoding: "identity", body: event, limit: 1024, want: event},
+		{name: "gzip", encoding: "gzip", body: gzipped(t, event), limit: 1024, want: event},
+		{name: "plain too big", body: event, limit: 4, wantTooBig: true, wantErr: true},
+		{
+			name:       "gzip too big once decompressed",
+			encoding:   "gzip",
+			body:       gzipped(t, bytes.Repeat([]byte("a"), 1<<20)),
+			limit:      64 << 10,
+			wantTooBig: true,
+			wantErr:    true,
+		},
+		{name: "not gzip", encoding: "gzip", body: event, limit: 1024, wantErr: true},
+		{name: "unsupported", encoding: "br", body: event, limit: 1024, wantEncoded: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/invoke/hello", bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				r.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			got, err := readBody(httptest.NewRecorder(), r, tt.limit)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readBody = %v, want error %v", err, tt.wantErr)
+			}
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) != tt.wantTooBig {
+				t.Errorf("readBody = %v, want too big %v", err, tt.wantTooBig)
+			}
+			var encodingErr *unsupportedEncodingError
+			if errors.As(err, &encodingErr) != tt.wantEncoded {
+				t.Errorf("readBody = %v, want unsupported encoding %v", err, tt.wantEncoded)
+			}
+			if err == nil && !bytes.Equal(got, tt.want) {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{acceptEncoding: "", want: false},
+		{acceptEncoding: "gzip", want: true},
+		{acceptEncoding: "deflate, gzip;q=0.5", want: true},
+		{acceptEncoding: "GZIP", want: true},
+		{acceptEncoding: "gzip;q=0", want: false},
+		{acceptEncoding: "br", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			if got := acceptsGzip(r); got != tt.want {
+				t.Errorf("acceptsGzip(%q) = %v, want %v", tt.acceptEncoding, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvokeGzipRoundTrip(t *testing.T) {
+	event := `{"data":"` + strings.Repeat("x", 16<<10) + `"}`
+	tests := []struct {
+		name           string
+		compressEvent  bool
+		acceptGzip     bool
+		presetEncoding string // Content-Encoding the handler sets itself
+		wantEncoding   string
+	}{
+		{name: "compressed both ways", compressEvent: true, acceptGzip: true, wantEncoding: "gzip"},
+		{name: "compressed event only", compressEvent: true},
+		{name: "compressed response only", acceptGzip: true, wantEncoding: "gzip"},
+		{name: "already encoded", acceptGzip: true, presetEncoding: "br", wantEncoding: "br"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			engine := newFakeEngine(t, func(e []byte) ([]byte, int) {
+				received = string(e)
+				return e, 0
+			})
+			s := newTestServer(t, engine)
+			storeFunction(t, s, &storage.Function{Name: "echo", Image: "echo:latest", Runtime: "go"})
+
+			invoke := http.HandlerFunc(s.handleInvoke)
+			var handler http.Handler = invoke
+			if tt.presetEncoding != "" {
+				handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Encoding", tt.presetEncoding)
+					invoke(w, r)
+				})
+			}
+			server := httptest.NewServer(gzipResponses(handler))
+			defer server.Close()
+
+			body := []byte(event)
+			if tt.compressEvent {
+				body = gzipped(t, body)
+			}
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/invoke/echo", bytes.NewReader(body))
+			if tt.compressEvent {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			if tt.acceptGzip {
+				// Set explicitly, so the transport leaves the response compressed
+				req.Header.Set("Accept-Encoding", "gzip")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("invoke failed: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			if received != event {
+				t.Errorf("function received %d bytes, want the %d byte event decompressed", len(received), len(event))
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+
+			reader := io.Reader(resp.Body)
+			if tt.wantEncoding == "gzip" {
+				gz, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatalf("response isn't gzip: %v", err)
+				}
+				reader = gz
+			}
+			output, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if string(output) != event {
+				t.Errorf("response has %d bytes, want the %d byte output", len(output), len(event))
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/envsubst"
+	"github.com/akos011221/serverless/pkg/logging"
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the server configuration, read from the same YAML file as the CLI's.
+type Config struct {
+	Addr   string `yaml:"server_addr"` // HTTP server address
+	DBPath string `yaml:"db_path"`     // SQLite database path
+
+	// Certificate and private key files of the server, which then serves
+	// HTTPS. Both are set, or neither for plain HTTP.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+
+	// Address the gRPC API is served on (see package rpc), over TLS as well
+	// when the server has a certificate. Empty disables it.
+	GRPCAddr string `yaml:"grpc_addr"`
+
+	UI bool `yaml:"ui"` // Serve the dashboard at /ui/
+
+	ReadTimeout  time.Duration `yaml:"read_timeout"`  // Maximum duration for reading a request
+	WriteTimeout time.Duration `yaml:"write_timeout"` // Maximum duration for writing a response
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`  // Keep-alive timeout for idle connections
+
+	MaxPayloadBytes     int64         `yaml:"max_payload_bytes"`     // Maximum size of a request body
+	ExecutionTimeout    time.Duration `yaml:"execution_timeout"`     // Maximum duration of a function execution, unless the function sets its own
+	MaxExecutionTimeout time.Duration `yaml:"max_execution_timeout"` // Longest timeout a function may set, execution_timeout when unset
+	StopGracePeriod     time.Duration `yaml:"stop_grace_period"`     // Time a timed out function gets to exit after SIGTERM before it's killed
+	MaxConcurrency      int           `yaml:"max_concurrency"`       // Maximum number of concurrently running functions
+	MaxOutputBytes      int64         `yaml:"max_output_bytes"`      // Cap on the output of an execution, unless the function sets its own
+	AlwaysPull          bool          `yaml:"always_pull"`           // Pull function images from their registry before each run, unless the function sets otherwise
+
+	// Experimental: restore functions deployed with snapshot from a CRIU
+	// checkpoint of them once initialized, taken SnapshotDelay after their
+	// container started, into SnapshotDir on the engine's host. Needs an
+	// engine with checkpoints, e.g. Docker in experimental mode with CRIU;
+	// without them functions start as usual.
+	Snapshots     bool          `yaml:"snapshots"`
+	SnapshotDir   string        `yaml:"snapshot_dir"`
+	SnapshotDelay time.Duration `yaml:"snapshot_delay"`
+
+	RuntimeEngine string `yaml:"runtime_engine"` // Container engine running functions: docker or podman
+	EngineHost    string `yaml:"engine_host"`    // API address of the engine, empty for its default socket
+
+	DefaultUser string `yaml:"default_user"` // User functions run as when they don't specify one
+
+	// Host directory the files of multipart invocations are kept in until
+	// they're copied to the container, empty for the system's temporary
+	// directory, and the largest body such an invocation may have
+	UploadsDir     string `yaml:"uploads_dir"`
+	MaxUploadBytes int64  `yaml:"max_upload_bytes"`
+
+	// Registries the images of deployed functions may come from, e.g.
+	// registry.example.com, or docker.io for Docker Hub. Images built by the
+	// CLI are always allowed. Empty allows any registry.
+	AllowedRegistries []string `yaml:"allowed_registries"`
+
+	DockerAPITimeout time.Duration `yaml:"docker_api_timeout"` // Bounds each Docker API request, 0 disables it
+	DBQueryTimeout   time.Duration `yaml:"db_query_timeout"`   // Bounds the database lookups of invocations, which then fail with 503, 0 disables it
+
+	GCInterval time.Duration `yaml:"gc_interval"` // Interval of the image garbage collection, 0 disables it
+
+	// Retention of the invocation records, pruned in the background: those
+	// older than InvocationRetention, and all but the newest MaxInvocations.
+	// Zero keeps them all.
+	InvocationRetention time.Duration `yaml:"invocation_retention"`
+	MaxInvocations      int           `yaml:"max_invocations"`
+
+	// Images pulled in the background on startup, e.g. the builder and base
+	// images of function builds, so the first build doesn't wait for them
+	BaseImages []string `yaml:"base_images"`
+
+	// Circuit breaker, opened for a function after BreakerThreshold consecutive
+	// failures within BreakerWindow, for BreakerCooldown. A zero threshold disables it.
+	BreakerThreshold int           `yaml:"breaker_threshold"`
+	BreakerWindow    time.Duration `yaml:"breaker_window"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown"`
+
+	// Event sources that trigger functions from message queues
+	EventSources []EventSourceConfig `yaml:"event_sources"`
+
+	LogLevel string `yaml:"log_level"` // Level of the server logs, overridden by --log-level
+	LogFile  string `yaml:"log_file"`  // File the server logs are written to as well, empty for none
+
+	// Directory the file: log destinations of functions are relative to,
+	// empty to disallow them
+	FunctionLogDir string `yaml:"function_log_dir"`
+}
+
+// DefaultConfig returns the configuration used for any field not set in the file.
+func DefaultConfig() Config {
+	return Config{
+		Addr:             "localhost:8080",
+		DBPath:           "serverless.db",
+		ReadTimeout:      10 * time.Second,
+		WriteTimeout:     60 * time.Second, // Invocations are bounded by their execution timeout instead
+		IdleTimeout:      30 * time.Second,
+		MaxPayloadBytes:  6 << 20, // 6 MiB
+		ExecutionTimeout: 30 * time.Second,
+		StopGracePeriod:  5 * time.Second,
+		MaxConcurrency:   10,
+		MaxOutputBytes:   6 << 20, // 6 MiB
+		RuntimeEngine:    orchestrator.EngineDocker,
+		DefaultUser:      "65534:65534", // nobody
+		MaxUploadBytes:   32 << 20,      // 32 MiB
+		DockerAPITimeout: 30 * time.Second,
+		DBQueryTimeout:   2 * time.Second,
+		BreakerThreshold: 5,
+		BreakerWindow:    time.Minute,
+		BreakerCooldown:  30 * time.Second,
+		SnapshotDir:      "/var/lib/serverless/checkpoints",
+		SnapshotDelay:    2 * time.Second,
+	}
+}
+
+// LoadConfig reads and parses the server configuration from a YAML file.
+// A missing file results in the default configuration.
+func LoadConfig(filePath string, log *logrus.Logger) (Config, error) {
+	config := DefaultConfig()
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.WithField("file", filePath).Warn("Config file not found, using defaults")
+			return config, nil
+		}
+		return config, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	// Environment variable references in values are expanded before parsing
+	data, err = envsubst.ExpandYAML(data)
+	if err != nil {
+		return config, fmt.Errorf("failed to expand config file: %v", err)
+	}
+
+	// Fields missing from the file keep their default values
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse config file: %v", err)
+	}
+
+	if err := config.validate(); err != nil {
+		return config, fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	log.WithField("config", config).Info("Server configuration loaded")
+	return config, nil
+}
+
+// validate checks that the configured values are usable.
+func (c Config) validate() error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if c.MaxPayloadBytes <= 0 {
+		return fmt.Errorf("max_payload_bytes must be positive")
+	}
+	if c.MaxUploadBytes <= 0 {
+		return fmt.Errorf("max_upload_bytes must be positive")
+	}
+	if c.ExecutionTimeout <= 0 {
+		return fmt.Errorf("execution_timeout must be positive")
+	}
+	if c.MaxExecutionTimeout != 0 && c.MaxExecutionTimeout < c.ExecutionTimeout {
+		return fmt.Errorf("max_execution_timeout must not be less than execution_timeout")
+	}
+	if c.StopGracePeriod < 0 {
+		return fmt.Errorf("stop_grace_period must not be negative")
+	}
+	if c.MaxConcurrency <= 0 {
+		return fmt.Errorf("max_concurrency must be positive")
+	}
+	if c.MaxOutputBytes <= 0 {
+		return fmt.Errorf("max_output_bytes must be positive")
+	}
+	if !orchestrator.ValidEngine(c.RuntimeEngine) {
+		return fmt.Errorf("runtime_engine must be %s or %s", orchestrator.EngineDocker, orchestrator.EnginePodman)
+	}
+	if c.DockerAPITimeout < 0 {
+		return fmt.Errorf("docker_api_timeout must not be negative")
+	}
+	if c.DBQueryTimeout < 0 {
+		return fmt.Errorf("db_query_timeout must not be negative")
+	}
+	if c.GCInterval < 0 {
+		return fmt.Errorf("gc_interval must not be negative")
+	}
+	if c.InvocationRetention < 0 || c.MaxInvocations < 0 {
+		return fmt.Errorf("invocation_retention and max_invocations must not be negative")
+	}
+	if c.Snapshots && (c.SnapshotDir == "" || c.SnapshotDelay <= 0) {
+		return fmt.Errorf("snapshots need a snapshot_dir and a positive snapshot_delay")
+	}
+	if c.BreakerThreshold < 0 {
+		return fmt.Errorf("breaker_threshold must not be negative")
+	}
+	if c.BreakerThreshold > 0 && (c.BreakerWindow <= 0 || c.BreakerCooldown <= 0) {
+		return fmt.Errorf("breaker_window and breaker_cooldown must be positive")
+	}
+	if c.DefaultUser != "" && !validUser.MatchString(c.DefaultUser) {
+		return fmt.Errorf("default_user %q is not a valid user spec", c.DefaultUser)
+	}
+	if c.LogLevel != "" {
+		if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
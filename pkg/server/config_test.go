@@ -0,0 +1,160 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeConfig writes a configuration file, returning its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	full := Config{
+		Addr:                "0.0.0.0:9090",
+		GRPCAddr:            "0.0.0.0:9091",
+		UI:                  true,
+		DBPath:              "/var/lib/serverless/db",
+		TLSCert:             "/etc/serverless/cert.pem",
+		TLSKey:              "/etc/serverless/key.pem",
+		ReadTimeout:         5 * time.Second,
+		WriteTimeout:        2 * time.Minute,
+		IdleTimeout:         time.Minute,
+		MaxPayloadBytes:     1024,
+		ExecutionTimeout:    90 * time.Second,
+		MaxExecutionTimeout: 5 * time.Minute,
+		StopGracePeriod:     2 * time.Second,
+		MaxConcurrency:      4,
+		MaxOutputBytes:      1 << 20,
+		RuntimeEngine:       "podman",
+		EngineHost:          "unix:///run/podman/podman.sock",
+		AlwaysPull:          true,
+		Snapshots:           true,
+		SnapshotDir:         "/srv/checkpoints",
+		SnapshotDelay:       500 * time.Millisecond,
+		BaseImages:          []string{"golang:1.23", "python:3.12"},
+		DefaultUser:         "1000:1000",
+		UploadsDir:          "/var/tmp/uploads",
+		MaxUploadBytes:      1 << 20,
+		BreakerThreshold:    3,
+		BreakerWindow:       10 * time.Second,
+		BreakerCooldown:     time.Minute,
+		DockerAPITimeout:    10 * time.Second,
+		DBQueryTimeout:      3 * time.Second,
+		FunctionLogDir:      "/var/log/serverless",
+		EventSources: []EventSourceConfig{
+			{Type: "redis", Connection: "localhost:6379", Queue: "events", Function: "hello", Requeue: true},
+		},
+	}
+	sparse := DefaultConfig()
+	sparse.Addr = "0.0.0.0:9090"
+	sparse.MaxConcurrency = 2
+	noGrace := DefaultConfig()
+	noGrace.StopGracePeriod = 0
+	disabled := DefaultConfig()
+	disabled.BreakerThreshold = 0
+	disabled.BreakerCooldown = 0
+
+	tests := []struct {
+		name    string
+		content string // Content of the file, none when empty
+		want    Config
+		wantErr bool
+	}{
+		{
+			name: "full",
+			content: `
+server_addr: 0.0.0.0:9090
+grpc_addr: 0.0.0.0:9091
+ui: true
+db_path: /var/lib/serverless/db
+tls_cert: /etc/serverless/cert.pem
+tls_key: /etc/serverless/key.pem
+read_timeout: 5s
+write_timeout: 2m
+idle_timeout: 1m
+max_payload_bytes: 1024
+execution_timeout: 90s
+max_execution_timeout: 5m
+stop_grace_period: 2s
+max_concurrency: 4
+max_output_bytes: 1048576
+runtime_engine: podman
+engine_host: unix:///run/podman/podman.sock
+always_pull: true
+snapshots: true
+snapshot_dir: /srv/checkpoints
+snapshot_delay: 500ms
+base_images:
+  - golang:1.23
+  - python:3.12
+default_user: "1000:1000"
+uploads_dir: /var/tmp/uploads
+max_upload_bytes: 1048576
+breaker_threshold: 3
+breaker_window: 10s
+breaker_cooldown: 1m
+docker_api_timeout: 10s
+db_query_timeout: 3s
+function_log_dir: /var/log/serverless
+event_sources:
+  - type: redis
+    connection: localhost:6379
+    queue: events
+    function: hello
+    requeue: true
+`,
+			want: full,
+		},
+		{name: "sparse", content: "server_addr: 0.0.0.0:9090\nmax_concurrency: 2\n", want: sparse},
+		{name: "missing", want: DefaultConfig()},
+		{name: "certificate without key", content: "tls_cert: /etc/serverless/cert.pem\n", wantErr: true},
+		{name: "key without certificate", content: "tls_key: /etc/serverless/key.pem\n", wantErr: true},
+		{name: "zero concurrency", content: "max_concurrency: 0\n", wantErr: true},
+		{name: "negative payload limit", content: "max_payload_bytes: -1\n", wantErr: true},
+		{name: "zero output limit", content: "max_output_bytes: 0\n", wantErr: true},
+		{name: "zero upload limit", content: "max_upload_bytes: 0\n", wantErr: true},
+		{name: "zero execution timeout", content: "execution_timeout: 0s\n", wantErr: true},
+		{name: "maximum below execution timeout", content: "execution_timeout: 1m\nmax_execution_timeout: 30s\n", wantErr: true},
+		{name: "unknown engine", content: "runtime_engine: containerd\n", wantErr: true},
+		{name: "negative grace period", content: "stop_grace_period: -1s\n", wantErr: true},
+		{name: "no grace period", content: "stop_grace_period: 0s\n", want: noGrace},
+		{name: "negative breaker threshold", content: "breaker_threshold: -1\n", wantErr: true},
+		{name: "breaker without cooldown", content: "breaker_cooldown: 0s\n", wantErr: true},
+		{name: "breaker disabled", content: "breaker_threshold: 0\nbreaker_cooldown: 0s\n", want: disabled},
+		{name: "snapshots without directory", content: "snapshots: true\nsnapshot_dir: \"\"\n", wantErr: true},
+		{name: "snapshots without delay", content: "snapshots: true\nsnapshot_delay: 0s\n", wantErr: true},
+		{name: "invalid default user", content: "default_user: \"root:\"\n", wantErr: true},
+		{name: "invalid duration", content: "read_timeout: soon\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "missing.yaml")
+			if tt.content != "" {
+				path = writeConfig(t, tt.content)
+			}
+			log := logrus.New()
+			log.SetOutput(io.Discard)
+
+			config, err := LoadConfig(path, log)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(config, tt.want) {
+				t.Errorf("config = %+v, want %+v", config, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+)
+
+// containerStatus is a function container as reported by GET /containers.
+type containerStatus struct {
+	orchestrator.ContainerInfo
+	AgeSeconds int64 `json:"age_seconds"`
+}
+
+// handleContainers lists the containers of functions (GET /containers), to
+// see what's executing and find stuck invocations.
+func (s *Server) handleContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.log.WithField("method", r.Method).Warn("Invalid method for containers")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	containers, err := s.orchestrator.ListContainers(r.Context())
+	if err != nil {
+		s.log.WithError(err).Error("Failed to list containers")
+		http.Error(w, "Failed to list containers", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	statuses := make([]containerStatus, 0, len(containers))
+	for _, c := range containers {
+		statuses = append(statuses, containerStatus{
+			ContainerInfo: c,
+			AgeSeconds:    int64(now.Sub(c.CreatedAt).Seconds()),
+		})
+	}
+	s.writeJSON(w, http.StatusOK, statuses)
+}
+
+// handlePrune removes the stopped containers of functions (POST /prune), e.g.
+// left behind by a crash, and reports what was removed.
+func (s *Server) handlePrune(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.log.WithField("method", r.Method).Warn("Invalid method for prune")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := s.orchestrator.PruneContainers(r.Context())
+	if err != nil {
+		s.log.WithError(err).Error("Failed to prune containers")
+		http.Error(w, fmt.Sprintf("Failed to prune containers: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+)
+
+func TestContainers(t *testing.T) {
+	created := time.Now().Add(-90 * time.Second)
+	engine := newFakeEngine(t, nil)
+	engine.listed = []map[string]any{
+		{"Id": "abc123", "Created": created.Unix(), "State": "running", "Status": "Up 90 seconds",
+			"Labels": map[string]string{orchestrator.LabelFunction: "hello", orchestrator.LabelInvocation: "inv-1", orchestrator.LabelImage: "hello:latest"}},
+		{"Id": "def456", "Created": created.Add(time.Minute).Unix(), "State": "created",
+			"Labels": map[string]string{orchestrator.LabelFunction: "other", orchestrator.LabelImage: "other:latest"}},
+	}
+	s := newTestServer(t, engine)
+
+	w := httptest.NewRecorder()
+	s.handleContainers(w, httptest.NewRequest(http.MethodGet, "/containers", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var statuses []containerStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("invalid containers: %v", err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("%d containers listed, want 2", len(statuses))
+	}
+	got := statuses[0]
+	if got.ID != "abc123" || got.Function != "hello" || got.Invocation != "inv-1" || got.State != "running" {
+		t.Errorf("container = %+v, want the running invocation of hello", got)
+	}
+	if got.AgeSeconds < 89 || got.AgeSeconds > 95 {
+		t.Errorf("age = %ds, want about 90s", got.AgeSeconds)
+	}
+
+	w = httptest.NewRecorder()
+	s.handleContainers(w, httptest.NewRequest(http.MethodDelete, "/containers", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	engine := newFakeEngine(t, nil)
+	engine.listed = []map[string]any{
+		{"Id": "abc123", "Created": time.Now().Add(-time.Hour).Unix(), "State": "exited", "SizeRw": 4096,
+			"Labels": map[string]string{orchestrator.LabelFunction: "hello"}},
+	}
+	s := newTestServer(t, engine)
+
+	w := httptest.NewRecorder()
+	s.handlePrune(w, httptest.NewRequest(http.MethodPost, "/prune", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var report orchestrator.ContainerPruneReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid report: %v", err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0] != "abc123" || report.SpaceReclaimed != 4096 {
+		t.Errorf("report = %+v, want abc123 removed with 4096 bytes reclaimed", report)
+	}
+
+	w = httptest.NewRecorder()
+	s.handlePrune(w, httptest.NewRequest(http.MethodGet, "/prune", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
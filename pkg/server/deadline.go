@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// deadlineHeader carries the deadline of the caller of an invocation, so a
+// chain of requests shares one budget: either a time (RFC 3339) or the
+// milliseconds left. The function gets whichever is shorter of it and its
+// timeout.
+const deadlineHeader = "X-Deadline"
+
+// errDeadlinePassed is returned when the caller's deadline passed before the
+// function could run.
+var errDeadlinePassed = errors.New("deadline passed before the function ran")
+
+// maxDeadlineMs bounds the milliseconds left of a deadline header, so they
+// don't overflow a time.Duration. It's still about 292 years.
+const maxDeadlineMs = math.MaxInt64 / int64(time.Millisecond)
+
+// parseDeadline parses the value of the deadline header, received at now.
+func parseDeadline(value string, now time.Time) (time.Time, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		ms = max(min(ms, maxDeadlineMs), -maxDeadlineMs)
+		return now.Add(time.Duration(ms) * time.Millisecond), nil
+	}
+	deadline, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q, expected an RFC 3339 time or the milliseconds left", deadlineHeader, value)
+	}
+	return deadline, nil
+}
+
+// callerDeadlineKey is the context key of the caller's deadline.
+type callerDeadlineKey struct{}
+
+// withCallerDeadline returns a context whose executions end by deadline.
+// Unlike a deadline of the context itself, running out of it times the
+// execution out rather than cancelling it.
+func withCallerDeadline(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, callerDeadlineKey{}, deadline)
+}
+
+// callerDeadline returns the caller's deadline of the executions made with
+// ctx, if it has one.
+func callerDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(callerDeadlineKey{}).(time.Time)
+	return deadline, ok
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseDeadline(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "1500", want: now.Add(1500 * time.Millisecond)},
+		{value: "0", want: now},
+		{value: "-200", want: now.Add(-200 * time.Millisecond)},
+		{value: "9223372036854775807", want: now.Add(time.Duration(maxDeadlineMs) * time.Millisecond)},
+		{value: "-9223372036854775808", want: now.Add(-time.Duration(maxDeadlineMs) * time.Millisecond)},
+		{value: "2024-05-01T12:00:30Z", want: now.Add(30 * time.Second)},
+		{value: "2024-05-01T14:00:30.25+02:00", want: now.Add(30*time.Second + 250*time.Millisecond)},
+		{value: "", wantErr: true},
+		{value: "1.5", wantErr: true},
+		{value: "2024-05-01 12:00:30", wantErr: true},
+		{value: "tomorrow", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseDeadline(tt.value, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDeadline(%q) = %v, want error %v", tt.value, err, tt.wantErr)
+			}
+			if err == nil && !got.Equal(tt.want) {
+				t.Errorf("parseDeadline(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteDeadline(t *testing.T) {
+	tests := []struct {
+		name         string
+		slotsTaken   bool          // Whether all execution slots are taken
+		deadline     time.Duration // Caller's deadline from now, 0 for none
+		cancelCaller bool          // Whether the caller gives up while waiting
+		wantErr      error         // Expected error, nil for any other
+	}{
+		{name: "deadline passes waiting for a slot", slotsTaken: true, deadline: 50 * time.Millisecond, wantErr: errDeadlinePassed},
+		{name: "deadline already passed", deadline: -time.Second, wantErr: errDeadlinePassed},
+		{name: "caller gives up waiting", slotsTaken: true, cancelCaller: true},
+		{name: "caller gives up before its deadline", slotsTaken: true, deadline: time.Minute, cancelCaller: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				slots:  newSlotScheduler(1),
+				quotas: newFunctionQuotas(),
+				log:    logrus.New(),
+			}
+			if tt.slotsTaken {
+				if err := s.slots.acquire(context.Background(), "other"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.deadline != 0 {
+				ctx = withCallerDeadline(ctx, time.Now().Add(tt.deadline))
+			}
+			if tt.cancelCaller {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+
+			began := time.Now()
+			_, err := s.executeHooked(ctx, &storage.Function{Name: "f"}, []byte(`{}`), nil)
+			if err == nil {
+				t.Fatal("executeHooked succeeded, want an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("executeHooked = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && errors.Is(err, errDeadlinePassed) {
+				t.Errorf("executeHooked = %v, want the caller's cancellation", err)
+			}
+			if waited := time.Since(began); waited > 5*time.Second {
+				t.Errorf("executeHooked returned after %v, want it bounded by the deadline", waited)
+			}
+			if running := s.quotas.status()["f"]; running != 0 {
+				t.Errorf("%d executions of f still counted", running)
+			}
+			if _, _, functions := s.slots.status(); functions["f"].Depth != 0 {
+				t.Error("the invocation is still waiting for a slot")
+			}
+		})
+	}
+}
+
+func TestInvokeDeadline(t *testing.T) {
+	tests := []struct {
+		name       string
+		deadline   string
+		wantStatus int
+		wantWithin time.Duration // Longest the invocation may take, 0 for any
+	}{
+		{name: "cuts off the function", deadline: "100", wantStatus: http.StatusGatewayTimeout, wantWithin: time.Second},
+		{name: "later than the function", deadline: "5000", wantStatus: http.StatusOK},
+		{name: "far in the future", deadline: "9223372036854775807", wantStatus: http.StatusOK},
+		{name: "invalid", deadline: "soon", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				time.Sleep(300 * time.Millisecond)
+				return []byte(`{"ok":true}`), 0
+			}))
+			storeFunction(t, s, &storage.Function{Name: "slow", Image: "slow:latest", Runtime: "go"})
+
+			r := httptest.NewRequest(http.MethodPost, "/invoke/slow", strings.NewReader(`{}`))
+			r.Header.Set(deadlineHeader, tt.deadline)
+			w := httptest.NewRecorder()
+			began := time.Now()
+			s.handleInvoke(w, r)
+			elapsed := time.Since(began)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantWithin != 0 && elapsed > tt.wantWithin {
+				t.Errorf("the invocation took %v, want it cut off within %v", elapsed, tt.wantWithin)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// eventKey identifies an event sent to a function by its content. The image
+// digest is part of it, so revisions of a function don't share results.
+func eventKey(function *storage.Function, event []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(function.Digest))
+	hash.Write([]byte{0})
+	hash.Write(event)
+	return function.Name + "/" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// dedupEntry is the outcome of an invocation, shared with identical ones.
+type dedupEntry struct {
+	done   chan struct{} // Closed once the invocation finished
+	result *orchestrator.Result
+	err    error
+}
+
+// dedupCache runs identical invocations once within a window, for functions
+// with side effects that must not be repeated. Identical invocations arriving
+// while the first one runs wait for its result. Only successful results are
+// kept, so a failed invocation can be retried. Entries live in memory, so
+// they don't survive a restart of the server.
+type dedupCache struct {
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+// newDedupCache creates an empty cache.
+func newDedupCache() *dedupCache {
+	return &dedupCache{entries: make(map[string]*dedupEntry)}
+}
+
+// do returns the result of the invocation identified by key if it succeeded
+// within the window, or else runs it.
+func (c *dedupCache) do(ctx context.Context, key string, window time.Duration, run func() (*orchestrator.Result, error)) (*orchestrator.Result, error) {
+	for {
+		c.mu.Lock()
+		entry, ok := c.entries[key]
+		if !ok {
+			entry = &dedupEntry{done: make(chan struct{})}
+			c.entries[key] = entry
+			c.mu.Unlock()
+			return c.run(key, entry, window, run)
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-entry.done:
+			if entry.err == nil {
+				return entry.result, nil
+			}
+			// The first invocation failed, so run it again
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for identical invocation: %v", ctx.Err())
+		}
+	}
+}
+
+// run executes an invocation for its entry, keeping a successful result for
+// the window.
+func (c *dedupCache) run(key string, entry *dedupEntry, window time.Duration, run func() (*orchestrator.Result, error)) (*orchestrator.Result, error) {
+	entry.result, entry.err = run()
+
+	forget := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+	}
+	if entry.err != nil {
+		forget()
+	} else {
+		time.AfterFunc(window, forget)
+	}
+	close(entry.done)
+	return entry.result, entry.err
+}
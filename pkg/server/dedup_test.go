@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestDedupCache(t *testing.T) {
+	const window = 50 * time.Millisecond
+	steps := []struct {
+		name    string
+		key     string
+		after   time.Duration // Wait before the step
+		fail    bool          // Whether the invocation fails when it runs
+		wantRun bool
+	}{
+		{name: "first", key: "hello/a", wantRun: true},
+		{name: "identical", key: "hello/a", wantRun: false},
+		{name: "distinct", key: "hello/b", wantRun: true},
+		{name: "window passed", key: "hello/a", after: 2 * window, wantRun: true},
+		{name: "failure", key: "hello/c", fail: true, wantRun: true},
+		{name: "retried after a failure", key: "hello/c", wantRun: true},
+	}
+	c := newDedupCache()
+	for _, step := range steps {
+		time.Sleep(step.after)
+		ran := false
+		result, err := c.do(context.Background(), step.key, window, func() (*orchestrator.Result, error) {
+			ran = true
+			if step.fail {
+				return nil, errors.New("function failed")
+			}
+			return &orchestrator.Result{Output: []byte(step.name)}, nil
+		})
+		if ran != step.wantRun {
+			t.Errorf("%s: ran = %v, want %v", step.name, ran, step.wantRun)
+		}
+		if (err != nil) != step.fail {
+			t.Errorf("%s: do = %v, want error %v", step.name, err, step.fail)
+		}
+		if !step.wantRun && string(result.Output) != "first" {
+			t.Errorf("%s: result %q, want the first invocation's", step.name, result.Output)
+		}
+	}
+}
+
+func TestDedupCacheConcurrent(t *testing.T) {
+	c := newDedupCache()
+	release := make(chan struct{})
+	var runs atomic.Int32
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := c.do(context.Background(), "hello/a", time.Minute, func() (*orchestrator.Result, error) {
+				runs.Add(1)
+				<-release
+				return &orchestrator.Result{Output: []byte("done")}, nil
+			})
+			if err != nil || string(result.Output) != "done" {
+				t.Errorf("do = %v, %v, want the shared result", result, err)
+			}
+		}()
+	}
+	// Identical invocations arriving while the first runs wait for it
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if runs.Load() != 1 {
+		t.Errorf("ran %d times, want once", runs.Load())
+	}
+}
+
+func TestInvokeDedup(t *testing.T) {
+	tests := []struct {
+		name     string
+		windowMs int64
+		events   []string
+		wantRuns int32
+	}{
+		{name: "repeated event", windowMs: 60000, events: []string{`{"order":1}`, `{"order":1}`, `{"order":1}`}, wantRuns: 1},
+		{name: "distinct events", windowMs: 60000, events: []string{`{"order":1}`, `{"order":2}`}, wantRuns: 2},
+		{name: "disabled", events: []string{`{"order":1}`, `{"order":1}`}, wantRuns: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var runs atomic.Int32
+			s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				n := runs.Add(1)
+				return []byte(`{"run":` + strconv.Itoa(int(n)) + `}`), 0
+			}))
+			storeFunction(t, s, &storage.Function{Name: "orders", Image: "orders:latest", Runtime: "go", DedupWindowMs: tt.windowMs})
+
+			outputs := make(map[string]string) // First output of each event
+			for _, event := range tt.events {
+				w := httptest.NewRecorder()
+				s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/orders", strings.NewReader(event)))
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+				}
+				if first, ok := outputs[event]; ok && tt.windowMs > 0 && w.Body.String() != first {
+					t.Errorf("repeated event got %s, want the cached %s", w.Body, first)
+				}
+				if _, ok := outputs[event]; !ok {
+					outputs[event] = w.Body.String()
+				}
+			}
+			if runs.Load() != tt.wantRuns {
+				t.Errorf("function ran %d times, want %d", runs.Load(), tt.wantRuns)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/akos011221/serverless/pkg/functionio"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// emptyEvent is the default event of functions that don't set one, so an
+// invocation without a body still gives them JSON to decode.
+const emptyEvent = "{}"
+
+// applyDefaultEvent deep-merges an event over a function's default event.
+// Fields of the event take precedence, and nested objects are merged field by
+// field. An empty event gets the default as-is, {} for functions without a
+// default event, and an event that isn't an object replaces the default
+// entirely. Functions taking raw events receive the event unchanged.
+func applyDefaultEvent(function *storage.Function, event []byte) ([]byte, error) {
+	if function.EventFormat == functionio.FormatRaw {
+		return event, nil
+	}
+	defaultEvent := function.DefaultEvent
+	if len(bytes.TrimSpace(event)) == 0 {
+		if defaultEvent == "" {
+			return []byte(emptyEvent), nil
+		}
+		return []byte(defaultEvent), nil
+	}
+	if defaultEvent == "" {
+		return event, nil
+	}
+
+	var incoming any
+	if err := decodeJSON(event, &incoming); err != nil {
+		return nil, &eventValidationError{Errors: []string{fmt.Sprintf("event is not valid JSON: %v", err)}}
+	}
+	overrides, ok := incoming.(map[string]any)
+	if !ok {
+		return event, nil
+	}
+
+	var defaults map[string]any
+	if err := decodeJSON([]byte(defaultEvent), &defaults); err != nil {
+		return nil, fmt.Errorf("invalid default event: %v", err)
+	}
+
+	merged, err := json.Marshal(mergeObjects(defaults, overrides))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode merged event: %v", err)
+	}
+	return merged, nil
+}
+
+// mergeObjects merges src into dst recursively and returns dst.
+func mergeObjects(dst, src map[string]any) map[string]any {
+	for key, value := range src {
+		srcObject, srcIsObject := value.(map[string]any)
+		dstObject, dstIsObject := dst[key].(map[string]any)
+		if srcIsObject && dstIsObject {
+			dst[key] = mergeObjects(dstObject, srcObject)
+			continue
+		}
+		dst[key] = value
+	}
+	return dst
+}
+
+// decodeJSON decodes a JSON document, keeping numbers exact.
+func decodeJSON(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/functionio"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestApplyDefaultEvent(t *testing.T) {
+	const defaults = `{"region":"eu","retries":3,"db":{"host":"localhost","port":5432,"tls":{"enabled":false}}}`
+	tests := []struct {
+		name         string
+		defaultEvent string
+		format       string // Event format of the function
+		event        string
+		want         string
+		wantInvalid  bool // Whether the event is rejected as invalid
+	}{
+		{name: "no default", event: `{"a":1}`, want: `{"a":1}`},
+		{name: "empty event without default", event: "", want: `{}`},
+		{name: "blank event without default", event: " \n", want: `{}`},
+		{name: "raw empty event", format: functionio.FormatRaw, event: "", want: ""},
+		{name: "raw event kept", defaultEvent: defaults, format: functionio.FormatRaw, event: `{"a":1}`, want: `{"a":1}`},
+		{name: "empty event", defaultEvent: defaults, event: "", want: defaults},
+		{name: "blank event", defaultEvent: defaults, event: " \n", want: defaults},
+		{
+			name:         "event takes precedence",
+			defaultEvent: defaults,
+			event:        `{"region":"us","extra":true}`,
+			want:         `{"db":{"host":"localhost","port":5432,"tls":{"enabled":false}},"extra":true,"region":"us","retries":3}`,
+		},
+		{
+			name:         "nested objects merged",
+			defaultEvent: defaults,
+			event:        `{"db":{"host":"db.internal","tls":{"enabled":true}}}`,
+			want:         `{"db":{"host":"db.internal","port":5432,"tls":{"enabled":true}},"region":"eu","retries":3}`,
+		},
+		{
+			name:         "object replaced by scalar",
+			defaultEvent: defaults,
+			event:        `{"db":null}`,
+			want:         `{"db":null,"region":"eu","retries":3}`,
+		},
+		{name: "non-object event", defaultEvent: defaults, event: `[1,2]`, want: `[1,2]`},
+		{name: "large numbers kept exact", defaultEvent: `{"id":1}`, event: `{"id":12345678901234567890}`, want: `{"id":12345678901234567890}`},
+		{name: "invalid event", defaultEvent: defaults, event: `{"region":`, wantInvalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			function := &storage.Function{DefaultEvent: tt.defaultEvent, EventFormat: tt.format}
+			got, err := applyDefaultEvent(function, []byte(tt.event))
+			var validationErr *eventValidationError
+			if errors.As(err, &validationErr) != tt.wantInvalid {
+				t.Fatalf("applyDefaultEvent = %v, want invalid %v", err, tt.wantInvalid)
+			}
+			if tt.wantInvalid {
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyDefaultEvent failed: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("event = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvokeDefaultEvent(t *testing.T) {
+	const schema = `{"type":"object","required":["id","region"]}`
+	tests := []struct {
+		name       string
+		event      string
+		wantStatus int
+		wantEvent  string // Event the function receives
+	}{
+		{name: "default validated", event: "", wantStatus: http.StatusUnprocessableEntity},
+		{name: "merged before validation", event: `{"id":7}`, wantStatus: http.StatusOK, wantEvent: `{"id":7,"region":"eu"}`},
+		{name: "override", event: `{"id":7,"region":"us"}`, wantStatus: http.StatusOK, wantEvent: `{"id":7,"region":"us"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				received = string(event)
+				return []byte(`{}`), 0
+			})
+			s := newTestServer(t, engine)
+			storeFunction(t, s, &storage.Function{Name: "users", Image: "users:latest", Runtime: "go", EventSchema: schema, DefaultEvent: `{"region":"eu"}`})
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/users", strings.NewReader(tt.event)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if received != tt.wantEvent {
+				t.Errorf("function received %q, want %q", received, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func TestInvokeEmptyBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    string
+		wantEvent string // Event the function receives
+	}{
+		{name: "json", wantEvent: `{}`},
+		{name: "raw", format: functionio.FormatRaw, wantEvent: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := "unset"
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				received = string(event)
+				return []byte(`{}`), 0
+			})
+			s := newTestServer(t, engine)
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go", EventFormat: tt.format})
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			if received != tt.wantEvent {
+				t.Errorf("function received %q, want %q", received, tt.wantEvent)
+			}
+		})
+	}
+}
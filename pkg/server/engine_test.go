@@ -0,0 +1,313 @@
+package server
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeEngine serves the Docker Engine API the orchestrator uses, running the
+// containers it creates with run: it gets the event written to the
+// container's stdin, and returns the output and exit code of the function.
+type fakeEngine struct {
+	*httptest.Server
+	run func(event []byte) (output []byte, exitCode int)
+
+	// interactive, when set, runs containers as sessions instead: it reads
+	// their stdin as it's written and writes their multiplexed stdout
+	interactive func(stdin io.Reader, stdout io.Writer)
+
+	// Images present on the engine, and in the registry it pulls from, and
+	// the labels of images by reference
+	images   map[string]bool
+	registry map[string]bool
+	labels   map[string]map[string]string
+
+	// Containers listed as running, and their logs
+	listed []map[string]any
+	logs   func(id string, stdout, stderr io.Writer)
+
+	mu         sync.Mutex
+	nextID     int
+	exitCodes  map[string]int           // Exit codes of the containers that ran, by ID
+	exited     map[string]chan struct{} // Closed once the container of an ID exits
+	autoRemove map[string]bool          // Containers removed once they exit, by ID
+	containers []string                 // IDs of the containers not yet removed
+	env        map[string][]string      // Environment of the containers created, by ID
+	ran        []string                 // Images of the containers created, in order
+
+	files map[string]map[string]string // Contents of the files copied to containers, by ID and path
+}
+
+// apiVersion matches the version prefix of Engine API paths.
+var apiVersion = regexp.MustCompile(`^/v[0-9.]+`)
+
+// newFakeEngine starts an engine running functions with run.
+func newFakeEngine(t *testing.T, run func(event []byte) ([]byte, int)) *fakeEngine {
+	t.Helper()
+	e := &fakeEngine{
+		run:        run,
+		exitCodes:  make(map[string]int),
+		exited:     make(map[string]chan struct{}),
+		autoRemove: make(map[string]bool),
+		env:        make(map[string][]string),
+	}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.serve))
+	t.Cleanup(e.Close)
+	return e
+}
+
+// serve handles an Engine API request.
+func (e *fakeEngine) serve(w http.ResponseWriter, r *http.Request) {
+	path := apiVersion.ReplaceAllString(r.URL.Path, "")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case path == "/_ping":
+		w.Header().Set("Api-Version", "1.47")
+		w.Write([]byte("OK"))
+	case path == "/containers/create":
+		var config struct {
+			Image      string
+			Env        []string
+			HostConfig struct{ AutoRemove bool }
+		}
+		json.NewDecoder(r.Body).Decode(&config)
+		e.mu.Lock()
+		e.nextID++
+		id := fmt.Sprintf("c%d", e.nextID)
+		e.containers = append(e.containers, id)
+		e.env[id] = config.Env
+		e.ran = append(e.ran, config.Image)
+		e.exited[id] = make(chan struct{})
+		e.autoRemove[id] = config.HostConfig.AutoRemove
+		e.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"Id": id})
+	case strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		ref := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")
+		e.mu.Lock()
+		present := e.images[ref]
+		labels := e.labels[ref]
+		e.mu.Unlock()
+		if !present {
+			http.Error(w, `{"message":"No such image: `+ref+`"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"Id": "sha256:" + ref, "Config": map[string]any{"Labels": labels}})
+	case path == "/images/create":
+		ref := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if !e.registry[ref] {
+			http.Error(w, `{"message":"manifest for `+ref+` not found"}`, http.StatusNotFound)
+			return
+		}
+		if e.images == nil {
+			e.images = make(map[string]bool)
+		}
+		e.images[ref] = true
+		json.NewEncoder(w).Encode(map[string]any{"status": "Downloaded newer image for " + ref})
+	case path == "/containers/json":
+		e.mu.Lock()
+		listed := e.listed
+		e.mu.Unlock()
+		if listed == nil {
+			listed = []map[string]any{}
+		}
+		json.NewEncoder(w).Encode(listed)
+	case len(parts) == 3 && parts[2] == "logs":
+		w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+		w.WriteHeader(http.StatusOK)
+		if e.logs != nil {
+			e.logs(parts[1], stdcopy.NewStdWriter(w, stdcopy.Stdout), stdcopy.NewStdWriter(w, stdcopy.Stderr))
+		}
+	case len(parts) == 3 && parts[2] == "archive" && r.Method == http.MethodPut:
+		if err := e.extract(parts[1], r.URL.Query().Get("path"), r.Body); err != nil {
+			http.Error(w, `{"message":"invalid archive"}`, http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case len(parts) == 3 && (parts[2] == "start" || parts[2] == "stop"):
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[2] == "attach":
+		e.attach(w, parts[1])
+	case len(parts) == 3 && parts[2] == "wait":
+		// Like Docker, the headers are sent right away and the status
+		// once the container exits
+		e.mu.Lock()
+		exited, ok := e.exited[parts[1]]
+		e.mu.Unlock()
+		if !ok {
+			http.Error(w, `{"message":"No such container: `+parts[1]+`"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-exited:
+		case <-r.Context().Done():
+			return
+		}
+		e.mu.Lock()
+		code := e.exitCodes[parts[1]]
+		e.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"StatusCode": code})
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		e.mu.Lock()
+		removed := e.remove(parts[1])
+		e.mu.Unlock()
+		if !removed {
+			http.Error(w, `{"message":"No such container: `+parts[1]+`"}`, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, `{"message":"not implemented"}`, http.StatusNotImplemented)
+	}
+}
+
+// attach runs the function of a container on the hijacked connection, once
+// its stdin is closed.
+func (e *fakeEngine) attach(w http.ResponseWriter, id string) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\n" +
+		"Connection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	buf.Flush()
+
+	if e.interactive != nil {
+		e.interactive(buf, stdcopy.NewStdWriter(conn, stdcopy.Stdout))
+		e.exit(id, 0)
+		return
+	}
+
+	event, err := io.ReadAll(buf)
+	if err != nil {
+		return
+	}
+	output, code := e.run(event)
+	stdcopy.NewStdWriter(conn, stdcopy.Stdout).Write(output)
+	e.exit(id, code)
+}
+
+// exit records that a container exited with code, removing it if it was
+// created to be removed on exit.
+func (e *fakeEngine) exit(id string, code int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.exitCodes[id] = code
+	if exited, ok := e.exited[id]; ok {
+		select {
+		case <-exited:
+		default:
+			close(exited)
+		}
+	}
+	if e.autoRemove[id] {
+		e.remove(id)
+	}
+}
+
+// remove forgets a container, reporting whether it existed. The caller must
+// hold e.mu.
+func (e *fakeEngine) remove(id string) bool {
+	for i, running := range e.containers {
+		if running == id {
+			e.containers = append(e.containers[:i], e.containers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// extract records the files of a tar archive copied to a container's dir.
+func (e *fakeEngine) extract(id, dir string, archive io.Reader) error {
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		e.mu.Lock()
+		if e.files == nil {
+			e.files = make(map[string]map[string]string)
+		}
+		if e.files[id] == nil {
+			e.files[id] = make(map[string]string)
+		}
+		e.files[id][path.Join(dir, header.Name)] = string(content)
+		e.mu.Unlock()
+	}
+}
+
+// file returns the content of a file copied to a container, and whether it was.
+func (e *fakeEngine) file(id, name string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	content, ok := e.files[id][name]
+	return content, ok
+}
+
+// running returns the IDs of the containers not yet removed.
+func (e *fakeEngine) running() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.containers...)
+}
+
+// newTestServer returns a server with the default configuration, running
+// functions on engine, with a fresh database.
+func newTestServer(t *testing.T, engine *fakeEngine) *Server {
+	t.Helper()
+	return newConfiguredServer(t, engine, DefaultConfig())
+}
+
+// newConfiguredServer returns a server with the given configuration, running
+// functions on engine, with a fresh database.
+func newConfiguredServer(t *testing.T, engine *fakeEngine, config Config) *Server {
+	t.Helper()
+	t.Setenv("DOCKER_HOST", "tcp://"+engine.Listener.Addr().String())
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "serverless.db"), log)
+	if err != nil {
+		t.Fatalf("failed to open the store: %v", err)
+	}
+	s, err := NewServer(config, store, log)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	return s
+}
+
+// storeFunction stores a function, as deployed.
+func storeFunction(t *testing.T, s *Server, function *storage.Function) {
+	t.Helper()
+	if err := s.store.SaveFunction(function, nil); err != nil {
+		t.Fatalf("failed to store function: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// failureStatus returns the HTTP status and message a failed invocation is
+// reported with.
+func failureStatus(function *storage.Function, err error) (int, string) {
+	if status, _, ok := exitStatus(function, err); ok {
+		return status, err.Error()
+	}
+	if status, message, ok := errorStatus(err); ok {
+		return status, message
+	}
+	return http.StatusInternalServerError, fmt.Sprintf("Function execution failed: %v", err)
+}
+
+// errorStatus returns the HTTP status and message of an error wrapping one of
+// the sentinel or typed errors of the server, the store or the orchestrator,
+// and false for any other error.
+func errorStatus(err error) (int, string, bool) {
+	switch {
+	case errors.As(err, new(*hookError)):
+		return http.StatusForbidden, err.Error(), true
+	case errors.Is(err, ErrConcurrencyLimit):
+		return http.StatusTooManyRequests, "Function is at its concurrency limit, try again later", true
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable, "Function is failing repeatedly, try again later", true
+	case errors.Is(err, errAlreadyCompleted):
+		return http.StatusConflict, "Function already completed its run, invoke it with ?force=true to run it again", true
+	case errors.Is(err, storage.ErrFunctionNotFound):
+		return http.StatusNotFound, "Function not found", true
+	case errors.Is(err, storage.ErrJobNotFound):
+		return http.StatusNotFound, "Job not found", true
+	case errors.Is(err, orchestrator.ErrImageNotFound):
+		return http.StatusFailedDependency, fmt.Sprintf("%v, redeploy the function", err), true
+	case errors.Is(err, storage.ErrQueryTimeout):
+		return http.StatusServiceUnavailable, "Database is busy, try again later", true
+	case errors.Is(err, ErrExecutionTimeout):
+		return http.StatusGatewayTimeout, "Function execution timed out", true
+	case errors.Is(err, errDeadlinePassed):
+		return http.StatusGatewayTimeout, "Deadline passed before the function ran", true
+	case errors.As(err, new(*orchestrator.OutputLimitError)), errors.As(err, new(*orchestrator.OutputFormatError)):
+		// Not a 502, which clients retry: a rerun writes just as much, or
+		// the same malformed, output
+		return http.StatusInternalServerError, err.Error(), true
+	case errors.As(err, new(*orchestrator.EventFormatError)):
+		return http.StatusBadRequest, err.Error(), true
+	default:
+		return 0, "", false
+	}
+}
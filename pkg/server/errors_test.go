@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestFailureStatus(t *testing.T) {
+	mapped := &storage.Function{ExitStatuses: map[string]int{"3": http.StatusNotFound, "10-19": http.StatusConflict}}
+	tests := []struct {
+		name        string
+		function    *storage.Function
+		err         error
+		wantStatus  int
+		wantMessage string // Part of the message expected
+	}{
+		{name: "default exit mapping", err: &orchestrator.ExitError{Code: 2}, wantStatus: http.StatusBadRequest, wantMessage: "code 2"},
+		{name: "unmapped exit code", err: &orchestrator.ExitError{Code: 1}, wantStatus: http.StatusInternalServerError, wantMessage: "Function execution failed"},
+		{name: "function's exit code", function: mapped, err: &orchestrator.ExitError{Code: 3}, wantStatus: http.StatusNotFound},
+		{name: "function's exit range", function: mapped, err: &orchestrator.ExitError{Code: 15}, wantStatus: http.StatusConflict},
+		{name: "function's mapping replaces the default", function: mapped, err: &orchestrator.ExitError{Code: 2}, wantStatus: http.StatusInternalServerError},
+		{name: "hook rejection", err: &hookError{err: errors.New("denied by policy")}, wantStatus: http.StatusForbidden, wantMessage: "denied by policy"},
+		{name: "concurrency limit", err: ErrConcurrencyLimit, wantStatus: http.StatusTooManyRequests},
+		{name: "circuit open", err: errCircuitOpen, wantStatus: http.StatusServiceUnavailable},
+		{name: "already completed", err: errAlreadyCompleted, wantStatus: http.StatusConflict, wantMessage: "force=true"},
+		{name: "function not found", err: fmt.Errorf("lookup: %w", storage.ErrFunctionNotFound), wantStatus: http.StatusNotFound},
+		{name: "image not found", err: fmt.Errorf("%w: alpine", orchestrator.ErrImageNotFound), wantStatus: http.StatusFailedDependency, wantMessage: "redeploy"},
+		{name: "job not found", err: fmt.Errorf("lookup: %w", storage.ErrJobNotFound), wantStatus: http.StatusNotFound, wantMessage: "Job"},
+		{name: "database busy", err: storage.ErrQueryTimeout, wantStatus: http.StatusServiceUnavailable},
+		{name: "execution timeout", err: ErrExecutionTimeout, wantStatus: http.StatusGatewayTimeout, wantMessage: "timed out"},
+		{name: "deadline passed", err: errDeadlinePassed, wantStatus: http.StatusGatewayTimeout, wantMessage: "Deadline"},
+		{name: "output limit", err: &orchestrator.OutputLimitError{Limit: 10}, wantStatus: http.StatusInternalServerError, wantMessage: "10 bytes"},
+		{name: "output format", err: &orchestrator.OutputFormatError{Format: "msgpack", Err: errors.New("bad")}, wantStatus: http.StatusInternalServerError},
+		{name: "event format", err: &orchestrator.EventFormatError{Format: "msgpack", Err: errors.New("bad")}, wantStatus: http.StatusBadRequest},
+		{name: "wrapped sentinel", err: fmt.Errorf("invoke: %w", ErrExecutionTimeout), wantStatus: http.StatusGatewayTimeout},
+		{name: "other error", err: errors.New("engine unreachable"), wantStatus: http.StatusInternalServerError, wantMessage: "engine unreachable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			function := tt.function
+			if function == nil {
+				function = &storage.Function{}
+			}
+			status, message := failureStatus(function, tt.err)
+			if status != tt.wantStatus {
+				t.Errorf("failureStatus(%v) status = %d, want %d", tt.err, status, tt.wantStatus)
+			}
+			if !strings.Contains(message, tt.wantMessage) {
+				t.Errorf("failureStatus(%v) message = %q, want it to contain %q", tt.err, message, tt.wantMessage)
+			}
+		})
+	}
+}
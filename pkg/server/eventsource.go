@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// EventSourceConfig binds an external event source to a function, so that
+// functions can be triggered by messages rather than HTTP requests.
+type EventSourceConfig struct {
+	Type       string `yaml:"type"`       // Source type, currently only "redis"
+	Connection string `yaml:"connection"` // Connection address, e.g. localhost:6379 or redis://...
+	Queue      string `yaml:"queue"`      // Name of the queue (Redis list) to consume
+	Function   string `yaml:"function"`   // Function invoked with each message
+	Requeue    bool   `yaml:"requeue"`    // Push messages back onto the queue when the invocation fails
+
+	// Deliveries of a requeued message before it's dropped, so one that
+	// always fails doesn't loop forever. Defaults to defaultMaxDeliveries.
+	MaxDeliveries int `yaml:"max_deliveries"`
+}
+
+// defaultMaxDeliveries is the number of deliveries of a requeued message
+// when max_deliveries is unset.
+const defaultMaxDeliveries = 5
+
+// EventSource is a consumer of messages from an external system.
+type EventSource interface {
+	// Receive blocks until a message is available. It returns a nil message
+	// when nothing arrived within the source's poll interval.
+	Receive(ctx context.Context) ([]byte, error)
+	// Requeue puts a message back onto the source for another attempt.
+	Requeue(ctx context.Context, message []byte) error
+	// Close releases the source's connection.
+	Close() error
+}
+
+// eventSourceBinding pairs a source with its configuration.
+type eventSourceBinding struct {
+	config EventSourceConfig
+	source EventSource
+}
+
+// eventSourceRetryDelay is how long a consumer backs off after a receive error,
+// so an unreachable source doesn't turn into a busy loop.
+const eventSourceRetryDelay = time.Second
+
+// AddEventSource creates the source described by cfg and binds it to its function.
+// Consumption starts when the server runs. Sources listed in the server
+// configuration are added by NewServer.
+func (s *Server) AddEventSource(cfg EventSourceConfig) error {
+	if cfg.Function == "" {
+		return fmt.Errorf("event source has no target function")
+	}
+	if cfg.MaxDeliveries < 0 {
+		return fmt.Errorf("event source max_deliveries must not be negative")
+	}
+
+	var source EventSource
+	switch cfg.Type {
+	case "redis":
+		src, err := newRedisSource(cfg)
+		if err != nil {
+			return err
+		}
+		source = src
+	default:
+		return fmt.Errorf("unsupported event source type %q", cfg.Type)
+	}
+
+	s.eventSources = append(s.eventSources, eventSourceBinding{config: cfg, source: source})
+	return nil
+}
+
+// startEventSources launches a consumer goroutine for every bound source.
+func (s *Server) startEventSources(ctx context.Context) {
+	for _, binding := range s.eventSources {
+		go s.consume(ctx, binding)
+	}
+}
+
+// consume pops messages from a source and invokes the bound function with each,
+// until ctx is cancelled.
+func (s *Server) consume(ctx context.Context, binding eventSourceBinding) {
+	log := s.log.WithFields(logrus.Fields{
+		"source":   binding.config.Type,
+		"queue":    binding.config.Queue,
+		"function": binding.config.Function,
+	})
+	log.Info("Consuming event source")
+
+	defer func() {
+		if err := binding.source.Close(); err != nil {
+			log.WithError(err).Warn("Failed to close event source")
+		}
+	}()
+
+	maxDeliveries := binding.config.MaxDeliveries
+	if maxDeliveries == 0 {
+		maxDeliveries = defaultMaxDeliveries
+	}
+	// Failed deliveries of the requeued messages, by content, so identical
+	// messages share a count. It's kept in memory, a restart resets it.
+	deliveries := make(map[string]int)
+
+	for ctx.Err() == nil {
+		message, err := binding.source.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.WithError(err).Warn("Failed to receive from event source")
+			select {
+			case <-ctx.Done():
+			case <-time.After(eventSourceRetryDelay):
+			}
+			continue
+		}
+		if message == nil {
+			continue
+		}
+
+		err = s.handleMessage(ctx, binding.config.Function, message)
+		if err == nil {
+			delete(deliveries, string(message))
+			continue
+		}
+		log.WithError(err).Warn("Event source invocation failed")
+		if !binding.config.Requeue {
+			continue
+		}
+		deliveries[string(message)]++
+		if attempts := deliveries[string(message)]; attempts >= maxDeliveries {
+			delete(deliveries, string(message))
+			log.WithField("deliveries", attempts).Error("Message failed every delivery, dropping it")
+			continue
+		}
+		if err := binding.source.Requeue(context.Background(), message); err != nil {
+			log.WithError(err).Error("Failed to requeue message")
+		}
+	}
+
+	log.Info("Stopped consuming event source")
+}
+
+// handleMessage invokes a function with a message received from an event source.
+func (s *Server) handleMessage(ctx context.Context, functionName string, message []byte) error {
+	// The function is looked up per message, so redeploys are picked up
+	function, err := s.resolveFunction(ctx, functionName)
+	if err != nil {
+		return err
+	}
+
+	message, err = applyDefaultEvent(function, message)
+	if err != nil {
+		return err
+	}
+	if err := s.validateEvent(function, message); err != nil {
+		return err
+	}
+
+	_, err = s.invoke(ctx, function, message)
+	return err
+}
+
+// redisSource consumes messages from a Redis list.
+type redisSource struct {
+	client *redis.Client
+	queue  string
+}
+
+// redisPollInterval bounds each blocking pop, so a consumer notices cancellation.
+const redisPollInterval = 5 * time.Second
+
+// newRedisSource connects to the Redis server given in the configuration.
+func newRedisSource(cfg EventSourceConfig) (*redisSource, error) {
+	if cfg.Queue == "" {
+		return nil, fmt.Errorf("redis event source requires a queue")
+	}
+
+	opts := &redis.Options{Addr: cfg.Connection}
+	if strings.HasPrefix(cfg.Connection, "redis://") || strings.HasPrefix(cfg.Connection, "rediss://") {
+		parsed, err := redis.ParseURL(cfg.Connection)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis connection: %v", err)
+		}
+		opts = parsed
+	}
+
+	return &redisSource{client: redis.NewClient(opts), queue: cfg.Queue}, nil
+}
+
+// Receive pops the next message from the head of the list.
+func (r *redisSource) Receive(ctx context.Context) ([]byte, error) {
+	result, err := r.client.BLPop(ctx, redisPollInterval, r.queue).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to pop from %s: %v", r.queue, err)
+	}
+	// BLPOP returns the key followed by the value
+	return []byte(result[1]), nil
+}
+
+// Requeue pushes the message to the tail, so other messages are processed before
+// it's retried.
+func (r *redisSource) Requeue(ctx context.Context, message []byte) error {
+	if err := r.client.RPush(ctx, r.queue, message).Err(); err != nil {
+		return fmt.Errorf("failed to push to %s: %v", r.queue, err)
+	}
+	return nil
+}
+
+// Close closes the Redis connection.
+func (r *redisSource) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// fakeSource is an in-memory queue of messages.
+type fakeSource struct {
+	mu       sync.Mutex
+	messages []string
+	requeued []string
+	closed   chan struct{}
+}
+
+// Receive pops the next message, or returns none after a short poll.
+func (f *fakeSource) Receive(ctx context.Context) ([]byte, error) {
+	f.mu.Lock()
+	if len(f.messages) == 0 {
+		f.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		return nil, nil
+	}
+	message := f.messages[0]
+	f.messages = f.messages[1:]
+	f.mu.Unlock()
+	return []byte(message), nil
+}
+
+// Requeue pushes the message back to the tail.
+func (f *fakeSource) Requeue(ctx context.Context, message []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requeued = append(f.requeued, string(message))
+	f.messages = append(f.messages, string(message))
+	return nil
+}
+
+// Close records the source was closed.
+func (f *fakeSource) Close() error {
+	close(f.closed)
+	return nil
+}
+
+func TestConsumeEventSource(t *testing.T) {
+	tests := []struct {
+		name         string
+		function     string // Function the source is bound to
+		requeue      bool
+		wantInvoked  []string // Events the function is invoked with, in order
+		wantRequeued []string // Messages requeued, first
+		alwaysFails  bool     // Whether messages are requeued over and over
+	}{
+		{
+			name:        "messages invoke the function",
+			function:    "hello",
+			wantInvoked: []string{"a", "flaky", "b"},
+		},
+		{
+			name:         "failed invocations requeued",
+			function:     "hello",
+			requeue:      true,
+			wantInvoked:  []string{"a", "flaky", "b", "flaky"},
+			wantRequeued: []string{"flaky"},
+		},
+		{
+			name:         "missing function",
+			function:     "missing",
+			requeue:      true,
+			wantRequeued: []string{"a", "flaky", "b"},
+			alwaysFails:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var invoked []string
+			attempts := make(map[string]int)
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				mu.Lock()
+				defer mu.Unlock()
+				invoked = append(invoked, string(event))
+				attempts[string(event)]++
+				// Fails the first time only
+				if string(event) == "flaky" && attempts["flaky"] == 1 {
+					return nil, 1
+				}
+				return event, 0
+			})
+			s := newTestServer(t, engine)
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+			source := &fakeSource{messages: []string{"a", "flaky", "b"}, closed: make(chan struct{})}
+			s.eventSources = append(s.eventSources, eventSourceBinding{
+				config: EventSourceConfig{Type: "fake", Function: tt.function, Requeue: tt.requeue},
+				source: source,
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			s.startEventSources(ctx)
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				mu.Lock()
+				done := len(invoked) >= len(tt.wantInvoked)
+				mu.Unlock()
+				source.mu.Lock()
+				done = done && len(source.requeued) >= len(tt.wantRequeued)
+				source.mu.Unlock()
+				if done {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			// A message in flight when the server stops fails and is
+			// requeued too, so only those requeued before are checked
+			source.mu.Lock()
+			requeued := append([]string(nil), source.requeued...)
+			source.mu.Unlock()
+			cancel()
+			select {
+			case <-source.closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("source not closed once the server stopped")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(invoked, tt.wantInvoked) {
+				t.Errorf("invoked with %q, want %q", invoked, tt.wantInvoked)
+			}
+			if len(requeued) > len(tt.wantRequeued) && !tt.alwaysFails {
+				t.Errorf("requeued %q, want %q", requeued, tt.wantRequeued)
+			} else if len(requeued) < len(tt.wantRequeued) || !reflect.DeepEqual(requeued[:len(tt.wantRequeued)], tt.wantRequeued) {
+				t.Errorf("requeued %q, want %q first", requeued, tt.wantRequeued)
+			}
+		})
+	}
+}
+
+func TestConsumePoisonMessage(t *testing.T) {
+	var mu sync.Mutex
+	var invoked []string
+	engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+		mu.Lock()
+		defer mu.Unlock()
+		invoked = append(invoked, string(event))
+		if string(event) == "poison" {
+			return nil, 1
+		}
+		return event, 0
+	})
+	s := newTestServer(t, engine)
+	hook := logtest.NewLocal(s.log)
+	storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+	source := &fakeSource{messages: []string{"poison", "b"}, closed: make(chan struct{})}
+	s.eventSources = append(s.eventSources, eventSourceBinding{
+		config: EventSourceConfig{Type: "fake", Function: "hello", Requeue: true, MaxDeliveries: 3},
+		source: source,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.startEventSources(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dropped := false
+		for _, entry := range hook.AllEntries() {
+			dropped = dropped || entry.Message == "Message failed every delivery, dropping it"
+		}
+		if dropped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the poison message wasn't dropped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Nothing is left to consume once it's dropped
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"poison", "b", "poison", "poison"}; !reflect.DeepEqual(invoked, want) {
+		t.Errorf("invoked with %q, want %q", invoked, want)
+	}
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	if want := []string{"poison", "poison"}; !reflect.DeepEqual(source.requeued, want) {
+		t.Errorf("requeued %q, want %q", source.requeued, want)
+	}
+}
+
+func TestAddEventSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  EventSourceConfig
+		wantErr bool
+	}{
+		{name: "redis", config: EventSourceConfig{Type: "redis", Connection: "localhost:6379", Queue: "q", Function: "f"}},
+		{name: "redis URL", config: EventSourceConfig{Type: "redis", Connection: "redis://localhost:6379/1", Queue: "q", Function: "f"}},
+		{name: "invalid redis URL", config: EventSourceConfig{Type: "redis", Connection: "redis://:x:y", Queue: "q", Function: "f"}, wantErr: true},
+		{name: "no queue", config: EventSourceConfig{Type: "redis", Connection: "localhost:6379", Function: "f"}, wantErr: true},
+		{name: "no function", config: EventSourceConfig{Type: "redis", Connection: "localhost:6379", Queue: "q"}, wantErr: true},
+		{name: "negative max deliveries", config: EventSourceConfig{Type: "redis", Connection: "localhost:6379", Queue: "q", Function: "f", MaxDeliveries: -1}, wantErr: true},
+		{name: "unknown type", config: EventSourceConfig{Type: "kafka", Function: "f"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			err := s.AddEventSource(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AddEventSource = %v, want error %v", err, tt.wantErr)
+			}
+			if bound := len(s.eventSources) == 1; bound == tt.wantErr {
+				t.Errorf("source bound = %v, want %v", bound, !tt.wantErr)
+			}
+			for _, binding := range s.eventSources {
+				binding.source.Close()
+			}
+		})
+	}
+}
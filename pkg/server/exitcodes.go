@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// defaultExitStatuses maps the exit codes of functions without their own
+// mapping: by convention, exit code 2 reports an invalid event.
+var defaultExitStatuses = map[string]int{"2": http.StatusBadRequest}
+
+// exitStatus returns the HTTP status a function's nonzero exit maps to, along
+// with the output the function wrote. ok is false for other errors and exit
+// codes without a mapping, which are reported as internal errors.
+func exitStatus(function *storage.Function, err error) (status int, output []byte, ok bool) {
+	var exitErr *orchestrator.ExitError
+	if !errors.As(err, &exitErr) {
+		return 0, nil, false
+	}
+
+	statuses := function.ExitStatuses
+	if len(statuses) == 0 {
+		statuses = defaultExitStatuses
+	}
+	for codes, status := range statuses {
+		low, high, err := parseExitCodes(codes)
+		if err == nil && exitErr.Code >= low && exitErr.Code <= high {
+			return status, exitErr.Output, true
+		}
+	}
+	return 0, nil, false
+}
+
+// clientError reports whether an invocation failed because the function
+// rejected its event, the event couldn't be delivered in its format, or the
+// function already completed its only run, which says nothing about the
+// function's health.
+func clientError(function *storage.Function, err error) bool {
+	if errors.As(err, new(*orchestrator.EventFormatError)) || errors.Is(err, errAlreadyCompleted) {
+		return true
+	}
+	status, _, ok := exitStatus(function, err)
+	return ok && status < http.StatusInternalServerError
+}
+
+// parseExitCodes parses an exit code ("2") or an inclusive range ("10-19").
+func parseExitCodes(codes string) (low, high int64, err error) {
+	lowText, highText, isRange := strings.Cut(codes, "-")
+	if low, err = strconv.ParseInt(lowText, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid exit code %q", codes)
+	}
+	high = low
+	if isRange {
+		if high, err = strconv.ParseInt(highText, 10, 64); err != nil || high < low {
+			return 0, 0, fmt.Errorf("invalid exit code range %q", codes)
+		}
+	}
+	if low < 1 || high > 255 {
+		return 0, 0, fmt.Errorf("exit codes %q out of range 1-255", codes)
+	}
+	return low, high, nil
+}
+
+// validateExitStatuses checks a function's exit code mapping. Every exit code
+// may be mapped only once.
+func validateExitStatuses(statuses map[string]int) error {
+	mapped := make(map[int64]string)
+	for codes, status := range statuses {
+		low, high, err := parseExitCodes(codes)
+		if err != nil {
+			return err
+		}
+		if status < 400 || status > 599 {
+			return fmt.Errorf("exit codes %q must map to a 4xx or 5xx status, got %d", codes, status)
+		}
+		for code := low; code <= high; code++ {
+			if other, ok := mapped[code]; ok {
+				return fmt.Errorf("exit codes %q and %q overlap", other, codes)
+			}
+			mapped[code] = codes
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestInvokeExitStatus(t *testing.T) {
+	mapping := map[string]int{"3": http.StatusNotFound, "10-19": http.StatusUnprocessableEntity, "20": http.StatusServiceUnavailable}
+	tests := []struct {
+		name       string
+		statuses   map[string]int // Mapping of the function, the default when nil
+		exitCode   int
+		wantStatus int
+		wantOutput bool // Whether the function's output is the response
+	}{
+		{name: "success", exitCode: 0, wantStatus: http.StatusOK, wantOutput: true},
+		{name: "default invalid event", exitCode: 2, wantStatus: http.StatusBadRequest, wantOutput: true},
+		{name: "default unmapped", exitCode: 1, wantStatus: http.StatusInternalServerError},
+		{name: "single code", statuses: mapping, exitCode: 3, wantStatus: http.StatusNotFound, wantOutput: true},
+		{name: "range start", statuses: mapping, exitCode: 10, wantStatus: http.StatusUnprocessableEntity, wantOutput: true},
+		{name: "range end", statuses: mapping, exitCode: 19, wantStatus: http.StatusUnprocessableEntity, wantOutput: true},
+		{name: "server error", statuses: mapping, exitCode: 20, wantStatus: http.StatusServiceUnavailable, wantOutput: true},
+		{name: "default replaced", statuses: mapping, exitCode: 2, wantStatus: http.StatusInternalServerError},
+		{name: "unmapped", statuses: mapping, exitCode: 42, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const output = `{"error":"no such user"}`
+			s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				return []byte(output), tt.exitCode
+			}))
+			storeFunction(t, s, &storage.Function{Name: "users", Image: "users:latest", Runtime: "go", ExitStatuses: tt.statuses})
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/users", strings.NewReader(`{}`)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Body.String() == output; got != tt.wantOutput {
+				t.Errorf("body = %q, want the function's output %v", w.Body, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestValidateExitStatuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses map[string]int
+		wantErr  bool
+	}{
+		{name: "none"},
+		{name: "code", statuses: map[string]int{"2": 400}},
+		{name: "range", statuses: map[string]int{"10-19": 422, "20": 503}},
+		{name: "whole range", statuses: map[string]int{"1-255": 500}},
+		{name: "zero", statuses: map[string]int{"0": 400}, wantErr: true},
+		{name: "too high", statuses: map[string]int{"256": 400}, wantErr: true},
+		{name: "reversed range", statuses: map[string]int{"19-10": 400}, wantErr: true},
+		{name: "not a code", statuses: map[string]int{"two": 400}, wantErr: true},
+		{name: "success status", statuses: map[string]int{"2": 200}, wantErr: true},
+		{name: "overlap", statuses: map[string]int{"10-19": 422, "15": 404}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateExitStatuses(tt.statuses); (err != nil) != tt.wantErr {
+				t.Errorf("validateExitStatuses = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
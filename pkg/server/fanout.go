@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// fanoutResult is the outcome of one function's invocation in a fan-out.
+type fanoutResult struct {
+	Status int             `json:"status"`
+	Output json.RawMessage `json:"output,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// handleInvokeAll invokes every function matching a label selector with the
+// same event (POST /invoke?label=key=value[,key=value...]), replying with the
+// result of each function by name. The invocations run concurrently, within
+// the server's concurrency limit.
+func (s *Server) handleInvokeAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.log.WithField("method", r.Method).Warn("Invalid method for invoke")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	selector, err := parseSelector(r.URL.Query()["label"])
+	if err != nil {
+		s.log.WithError(err).Warn("Invalid label selector")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	event, err := readBody(w, r, s.config.MaxPayloadBytes)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Event exceeds %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		s.log.WithError(err).Warn("Failed to read invoke event")
+		http.Error(w, "Failed to read event", http.StatusBadRequest)
+		return
+	}
+
+	functions, err := s.store.ListFunctions(false)
+	if err != nil {
+		s.log.WithError(err).Error("Failed to list functions")
+		http.Error(w, "Failed to list functions", http.StatusInternalServerError)
+		return
+	}
+	var matching []storage.Function
+	for _, function := range functions {
+		if matchesSelector(function.Labels, selector) {
+			matching = append(matching, function)
+		}
+	}
+	if len(matching) == 0 {
+		http.Error(w, "No functions match the label selector", http.StatusNotFound)
+		return
+	}
+
+	// Waiting for slots can take longer than the write timeout allows
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		s.log.WithError(err).Warn("Failed to clear write deadline")
+	}
+
+	results := make(map[string]fanoutResult, len(matching))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := range matching {
+		function := &matching[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := s.invokeOne(r, function, event)
+			mu.Lock()
+			results[function.Name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if r.Context().Err() != nil {
+		s.log.Warn("Client disconnected, fan-out cancelled")
+		return
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Status != http.StatusOK {
+			failed++
+		}
+	}
+	s.log.WithFields(logrus.Fields{"functions": len(results), "failed": failed}).Info("Fan-out invocation finished")
+	s.writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+// invokeOne runs a single function of a fan-out.
+func (s *Server) invokeOne(r *http.Request, function *storage.Function, event []byte) fanoutResult {
+	event, err := applyDefaultEvent(function, event)
+	if err == nil {
+		err = s.validateEvent(function, event)
+	}
+	if err != nil {
+		var validationErr *eventValidationError
+		if errors.As(err, &validationErr) {
+			return fanoutResult{Status: http.StatusUnprocessableEntity, Error: err.Error()}
+		}
+		return fanoutResult{Status: http.StatusInternalServerError, Error: err.Error()}
+	}
+
+	result, err := s.invoke(r.Context(), function, event)
+	if err != nil {
+		s.log.WithError(err).WithField("function", function.Name).Warn("Fan-out invocation failed")
+		status, message := failureStatus(function, err)
+		var output json.RawMessage
+		if _, out, ok := exitStatus(function, err); ok {
+			output = outputJSON(out)
+		}
+		return fanoutResult{Status: status, Output: output, Error: message}
+	}
+	return fanoutResult{Status: http.StatusOK, Output: outputJSON(result.Output)}
+}
+
+// outputJSON embeds a function's output in a JSON document: as-is when it's
+// JSON, as a string otherwise.
+func outputJSON(output []byte) json.RawMessage {
+	if len(output) == 0 {
+		return nil
+	}
+	if json.Valid(output) {
+		return output
+	}
+	encoded, _ := json.Marshal(string(output)) // Strings always encode
+	return encoded
+}
+
+// parseSelector parses label selectors of the form key=value[,key=value...].
+// All given labels must match.
+func parseSelector(values []string) (map[string]string, error) {
+	selector := make(map[string]string)
+	for _, value := range values {
+		for _, pair := range strings.Split(value, ",") {
+			key, val, ok := strings.Cut(pair, "=")
+			if !ok || key == "" {
+				return nil, fmt.Errorf("invalid label selector %q, expected key=value", pair)
+			}
+			selector[key] = val
+		}
+	}
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("label selector required, e.g. ?label=group=cron")
+	}
+	return selector, nil
+}
+
+// matchesSelector reports whether labels have all the selected values.
+func matchesSelector(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if actual, ok := labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
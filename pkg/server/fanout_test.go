@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// fanoutFunctions are deployed for the fan-out tests. Each function's default
+// event names it, so the engine knows which function runs.
+var fanoutFunctions = []storage.Function{
+	{Name: "flush-users", Labels: map[string]string{"group": "cron", "team": "a"}, DefaultEvent: `{"fn":"flush-users"}`},
+	{Name: "flush-orders", Labels: map[string]string{"group": "cron", "team": "b"}, DefaultEvent: `{"fn":"flush-orders"}`},
+	{Name: "flush-broken", Labels: map[string]string{"group": "cron", "team": "b"}, DefaultEvent: `{"fn":"flush-broken"}`},
+	{Name: "api", Labels: map[string]string{"group": "web"}, DefaultEvent: `{"fn":"api"}`},
+}
+
+func TestInvokeAll(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		wantStatus  int
+		wantResults map[string]int // Status of each function's result
+	}{
+		{
+			name:        "partial failure",
+			query:       "label=group=cron",
+			wantStatus:  http.StatusOK,
+			wantResults: map[string]int{"flush-users": http.StatusOK, "flush-orders": http.StatusOK, "flush-broken": http.StatusInternalServerError},
+		},
+		{
+			name:        "all labels must match",
+			query:       "label=group=cron,team=b",
+			wantStatus:  http.StatusOK,
+			wantResults: map[string]int{"flush-orders": http.StatusOK, "flush-broken": http.StatusInternalServerError},
+		},
+		{
+			name:        "repeated selectors",
+			query:       "label=group=cron&label=team=a",
+			wantStatus:  http.StatusOK,
+			wantResults: map[string]int{"flush-users": http.StatusOK},
+		},
+		{name: "no match", query: "label=group=batch", wantStatus: http.StatusNotFound},
+		{name: "no selector", query: "", wantStatus: http.StatusBadRequest},
+		{name: "invalid selector", query: "label=group", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				var e struct {
+					Fn string `json:"fn"`
+				}
+				json.Unmarshal(event, &e)
+				if e.Fn == "flush-broken" {
+					return []byte("cache unreachable"), 1
+				}
+				return event, 0
+			})
+			s := newTestServer(t, engine)
+			for _, function := range fanoutFunctions {
+				function.Image = function.Name + ":latest"
+				function.Runtime = "go"
+				storeFunction(t, s, &function)
+			}
+
+			w := httptest.NewRecorder()
+			s.handleInvokeAll(w, httptest.NewRequest(http.MethodPost, "/invoke?"+tt.query, strings.NewReader(`{"key":"sessions"}`)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Results map[string]fanoutResult `json:"results"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			statuses := make(map[string]int)
+			for name, result := range body.Results {
+				statuses[name] = result.Status
+				if result.Status == http.StatusOK {
+					// Every function gets the same event, over its defaults
+					want := `{"fn":"` + name + `","key":"sessions"}`
+					if string(result.Output) != want {
+						t.Errorf("%s output = %s, want %s", name, result.Output, want)
+					}
+				} else if result.Error == "" {
+					t.Errorf("%s failed without an error", name)
+				}
+			}
+			if !reflect.DeepEqual(statuses, tt.wantResults) {
+				t.Errorf("results = %v, want %v", statuses, tt.wantResults)
+			}
+		})
+	}
+}
+
+func TestInvokeAllConcurrencyLimit(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+		mu.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return []byte(`{}`), 0
+	})
+	config := DefaultConfig()
+	config.MaxConcurrency = 2
+	s := newConfiguredServer(t, engine, config)
+	for _, function := range fanoutFunctions {
+		function.Image = function.Name + ":latest"
+		function.Runtime = "go"
+		function.Labels = map[string]string{"group": "all"}
+		storeFunction(t, s, &function)
+	}
+
+	w := httptest.NewRecorder()
+	s.handleInvokeAll(w, httptest.NewRequest(http.MethodPost, "/invoke?label=group=all", strings.NewReader(`{}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if maxRunning > config.MaxConcurrency {
+		t.Errorf("%d functions ran at once, want at most %d", maxRunning, config.MaxConcurrency)
+	}
+}
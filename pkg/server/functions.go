@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// handleList returns the metadata of all functions (GET /functions). Deleted
+// functions are included with ?include_deleted=true, with their deletion time.
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	includeDeleted := false
+	if value := r.URL.Query().Get("include_deleted"); value != "" {
+		var err error
+		if includeDeleted, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "include_deleted must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	functions, err := s.store.ListFunctions(includeDeleted)
+	if err != nil {
+		s.log.WithError(err).Error("Failed to list functions")
+		http.Error(w, "Failed to list functions", http.StatusInternalServerError)
+		return
+	}
+
+	details := make([]functionDetails, 0, len(functions))
+	for i := range functions {
+		details = append(details, newFunctionDetails(&functions[i]))
+	}
+	s.writeJSON(w, http.StatusOK, details)
+}
+
+// exportedFunction is a function as exported, in the format of the deploy
+// metadata, so it can be deployed again as is. Secret values never leave the
+// server, so only their names are exported.
+type exportedFunction struct {
+	functionMetadata
+	SecretNames []string `json:"secret_names,omitempty"`
+}
+
+// handleExport returns the metadata of all functions in the deploy format
+// (GET /functions/export), e.g. to recreate them on another server. Images
+// are referenced by their tag only: a digest is the ID of the image on this
+// server's engine, which another engine may not know, so import pins the
+// image again.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.log.WithField("method", r.Method).Warn("Invalid method for export")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	functions, err := s.store.ListFunctions(false)
+	if err != nil {
+		s.log.WithError(err).Error("Failed to list functions")
+		http.Error(w, "Failed to list functions", http.StatusInternalServerError)
+		return
+	}
+
+	exported := make([]exportedFunction, 0, len(functions))
+	for i := range functions {
+		metadata := newFunctionMetadata(&functions[i])
+		metadata.Digest = ""
+		exported = append(exported, exportedFunction{
+			functionMetadata: metadata,
+			SecretNames:      functions[i].SecretNames,
+		})
+	}
+	s.log.WithField("functions", len(exported)).Info("Functions exported")
+	s.writeJSON(w, http.StatusOK, exported)
+}
+
+// handleDelete deletes a function (DELETE /functions/{name}). The function
+// can be restored until it's redeployed, and its image is kept until then.
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, functionName string) {
+	if err := s.store.DeleteFunction(functionName); err != nil {
+		if errors.Is(err, storage.ErrFunctionNotFound) {
+			s.log.WithError(err).WithField("function", functionName).Warn("Function not found")
+			http.Error(w, "Function not found", http.StatusNotFound)
+			return
+		}
+		s.log.WithError(err).WithField("function", functionName).Error("Failed to delete function")
+		http.Error(w, "Failed to delete function", http.StatusInternalServerError)
+		return
+	}
+
+	s.cache.invalidate(functionName)
+	s.schemas.forget(functionName)
+	s.log.WithField("function", functionName).Info("Function deleted")
+	s.recordAudit(requestActor(r), storage.AuditDelete, functionName, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRestore brings back a deleted function (POST /functions/{name}/restore).
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request, functionName string) {
+	if r.Method != http.MethodPost {
+		s.log.WithField("method", r.Method).Warn("Invalid method for restore")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.store.RestoreFunction(functionName); err != nil {
+		if errors.Is(err, storage.ErrFunctionNotFound) {
+			s.log.WithError(err).WithField("function", functionName).Warn("Deleted function not found")
+			http.Error(w, "No deleted function with this name", http.StatusNotFound)
+			return
+		}
+		s.log.WithError(err).WithField("function", functionName).Error("Failed to restore function")
+		http.Error(w, "Failed to restore function", http.StatusInternalServerError)
+		return
+	}
+
+	s.log.WithField("function", functionName).Info("Function restored")
+	s.recordAudit(requestActor(r), storage.AuditRestore, functionName, "")
+	s.handleDescribe(w, r, functionName)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// listFunctions returns the names of the functions listed at path, and the
+// ones of them that are deleted.
+func listFunctions(t *testing.T, s *Server, path string) (names, deleted []string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.handleFunctions(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing failed with %d: %s", w.Code, w.Body)
+	}
+	var details []functionDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil {
+		t.Fatalf("invalid list: %v", err)
+	}
+	for _, function := range details {
+		names = append(names, function.Name)
+		if function.DeletedAt != nil {
+			deleted = append(deleted, function.Name)
+		}
+	}
+	return names, deleted
+}
+
+func TestDeleteFunction(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, nil))
+	storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+	storeFunction(t, s, &storage.Function{Name: "other", Image: "other:latest", Runtime: "go"})
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantListed []string // Functions listed after the step
+		wantAll    []string // Functions listed with include_deleted after the step
+	}{
+		{name: "delete", method: http.MethodDelete, path: "/functions/hello", wantStatus: http.StatusNoContent, wantListed: []string{"other"}, wantAll: []string{"hello", "other"}},
+		{name: "describe deleted", method: http.MethodGet, path: "/functions/hello", wantStatus: http.StatusNotFound, wantListed: []string{"other"}, wantAll: []string{"hello", "other"}},
+		{name: "delete again", method: http.MethodDelete, path: "/functions/hello", wantStatus: http.StatusNotFound, wantListed: []string{"other"}, wantAll: []string{"hello", "other"}},
+		{name: "restore live", method: http.MethodPost, path: "/functions/other/restore", wantStatus: http.StatusNotFound, wantListed: []string{"other"}, wantAll: []string{"hello", "other"}},
+		{name: "restore wrong method", method: http.MethodGet, path: "/functions/hello/restore", wantStatus: http.StatusMethodNotAllowed, wantListed: []string{"other"}, wantAll: []string{"hello", "other"}},
+		{name: "restore", method: http.MethodPost, path: "/functions/hello/restore", wantStatus: http.StatusOK, wantListed: []string{"hello", "other"}, wantAll: []string{"hello", "other"}},
+		{name: "describe restored", method: http.MethodGet, path: "/functions/hello", wantStatus: http.StatusOK, wantListed: []string{"hello", "other"}, wantAll: []string{"hello", "other"}},
+	}
+	for _, step := range steps {
+		w := httptest.NewRecorder()
+		s.handleFunction(w, httptest.NewRequest(step.method, step.path, nil))
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body)
+		}
+
+		listed, deleted := listFunctions(t, s, "/functions")
+		if !reflect.DeepEqual(listed, step.wantListed) || deleted != nil {
+			t.Errorf("%s: listed %q (deleted %q), want %q", step.name, listed, deleted, step.wantListed)
+		}
+		all, deleted := listFunctions(t, s, "/functions?include_deleted=true")
+		if !reflect.DeepEqual(all, step.wantAll) {
+			t.Errorf("%s: listed %q including deleted, want %q", step.name, all, step.wantAll)
+		}
+		if wantDeleted := len(step.wantAll) - len(step.wantListed); len(deleted) != wantDeleted {
+			t.Errorf("%s: %q listed as deleted, want %d", step.name, deleted, wantDeleted)
+		}
+	}
+}
+
+func TestDeleteForgetsSchema(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, nil))
+	function := &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go", EventSchema: `{"type":"object"}`}
+	storeFunction(t, s, function)
+	s.warmSchema(function)
+
+	w := httptest.NewRecorder()
+	s.handleFunction(w, httptest.NewRequest(http.MethodDelete, "/functions/hello", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204: %s", w.Code, w.Body)
+	}
+	if _, ok := s.schemas.schemas["hello"]; ok {
+		t.Error("the deleted function's schema is still cached")
+	}
+}
+
+func TestListFunctions(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{name: "list", method: http.MethodGet, path: "/functions", wantStatus: http.StatusOK},
+		{name: "including deleted", method: http.MethodGet, path: "/functions?include_deleted=true", wantStatus: http.StatusOK},
+		{name: "invalid include_deleted", method: http.MethodGet, path: "/functions?include_deleted=maybe", wantStatus: http.StatusBadRequest},
+		{name: "wrong method", method: http.MethodPut, path: "/functions", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			w := httptest.NewRecorder()
+			s.handleFunctions(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	tests := []struct {
+		name        string
+		image       string // Image of the exported function
+		replaced    bool   // Whether the importing server has the function, with a secret
+		wantStatus  int
+		wantSecrets map[string]string
+	}{
+		{name: "new function", image: "app:1", wantStatus: http.StatusOK, wantSecrets: map[string]string{}},
+		{name: "replaced function keeps its secrets", image: "app:1", replaced: true, wantStatus: http.StatusOK,
+			wantSecrets: map[string]string{"TOKEN": "kept"}},
+		{name: "image missing", image: "gone:1", wantStatus: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := newTestServer(t, newFakeEngine(t, nil))
+			exported := &storage.Function{
+				Name: "hello", Image: tt.image, Runtime: "go", Env: map[string]string{"A": "1"},
+				Digest: "sha256:" + strings.Repeat("a", 64),
+			}
+			if err := source.store.SaveFunction(exported, map[string]string{"TOKEN": "exported"}); err != nil {
+				t.Fatalf("failed to store function: %v", err)
+			}
+			w := httptest.NewRecorder()
+			source.handleExport(w, httptest.NewRequest(http.MethodGet, "/functions/export", nil))
+			var functions []map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &functions); err != nil || len(functions) != 1 {
+				t.Fatalf("export = %s, want one function", w.Body)
+			}
+			if digest, ok := functions[0]["digest"]; ok && digest != "" {
+				t.Errorf("exported digest %v, want none", digest)
+			}
+
+			engine := newFakeEngine(t, nil)
+			engine.images = map[string]bool{"app:1": true}
+			target := newTestServer(t, engine)
+			if tt.replaced {
+				if err := target.store.SaveFunction(&storage.Function{Name: "hello", Image: "old:1", Runtime: "go", SecretNames: []string{"TOKEN"}},
+					map[string]string{"TOKEN": "kept"}); err != nil {
+					t.Fatalf("failed to store function: %v", err)
+				}
+			}
+			// As serverless import sends it
+			functions[0]["pin_digest"] = true
+			functions[0]["keep_secrets"] = true
+			body, _ := json.Marshal(functions[0])
+			w = httptest.NewRecorder()
+			target.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			imported, err := target.store.GetFunction(context.Background(), "hello")
+			if err != nil {
+				t.Fatalf("function not imported: %v", err)
+			}
+			if imported.Image != tt.image || !reflect.DeepEqual(imported.Env, exported.Env) {
+				t.Errorf("imported %s with env %v, want %s with %v", imported.Image, imported.Env, tt.image, exported.Env)
+			}
+			if imported.Digest != "sha256:"+tt.image {
+				t.Errorf("digest = %q, want the image on the importing engine", imported.Digest)
+			}
+			secrets, err := target.store.GetSecrets(context.Background(), "hello")
+			if err != nil {
+				t.Fatalf("failed to get secrets: %v", err)
+			}
+			if !reflect.DeepEqual(secrets, tt.wantSecrets) {
+				t.Errorf("secrets = %v, want %v", secrets, tt.wantSecrets)
+			}
+		})
+	}
+}
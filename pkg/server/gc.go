@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+)
+
+// collectGarbage removes images no longer referenced by any deployed function.
+// The images of all revisions are kept, so aliases and invocations can still
+// ask for them, as are images of deleted functions, so they can still be
+// restored.
+func (s *Server) collectGarbage(ctx context.Context) (*orchestrator.PruneReport, error) {
+	functions, err := s.store.ListFunctions(true)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := s.store.RevisionDigests()
+	if err != nil {
+		return nil, err
+	}
+
+	inUse := make([]string, 0, len(functions)+len(revisions))
+	for _, function := range functions {
+		inUse = append(inUse, function.Image)
+		if function.Digest != "" {
+			inUse = append(inUse, function.Digest)
+		}
+	}
+	inUse = append(inUse, revisions...)
+	return s.orchestrator.PruneImages(ctx, inUse)
+}
+
+// runGC periodically collects garbage until ctx is cancelled.
+func (s *Server) runGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.collectGarbage(ctx); err != nil {
+				s.log.WithError(err).Warn("Image garbage collection failed")
+			}
+		}
+	}
+}
+
+// handleGC processes on-demand garbage collection requests (POST /gc).
+func (s *Server) handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.log.WithField("method", r.Method).Warn("Invalid method for gc")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := s.collectGarbage(r.Context())
+	if err != nil {
+		s.log.WithError(err).Error("Image garbage collection failed")
+		http.Error(w, fmt.Sprintf("Garbage collection failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, report)
+}
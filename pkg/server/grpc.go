@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/rpc"
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcEnvelopeBytes is the room left in a gRPC message beyond the payload
+// limit, for the fields around the event.
+const grpcEnvelopeBytes = 4 << 10
+
+// grpcService serves the gRPC API (see package rpc), sharing the store,
+// orchestrator and limits of the HTTP API.
+type grpcService struct {
+	s *Server
+}
+
+// startGRPC serves the gRPC API on the configured address, over TLS when the
+// server has a certificate. A failure of the server is sent to serverErr.
+func (s *Server) startGRPC(serverErr chan<- error) (*grpc.Server, error) {
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(s.config.MaxPayloadBytes) + grpcEnvelopeBytes),
+		grpc.UnaryInterceptor(s.grpcInterceptor),
+	}
+	if s.config.TLSCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(s.config.TLSCert, s.config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+
+	listener, err := net.Listen("tcp", s.config.GRPCAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for gRPC: %v", err)
+	}
+
+	server := grpc.NewServer(opts...)
+	rpc.RegisterFunctionsServer(server, grpcService{s: s})
+	go func() {
+		s.log.WithField("addr", s.config.GRPCAddr).Info("Starting gRPC server")
+		if err := server.Serve(listener); err != nil {
+			serverErr <- fmt.Errorf("gRPC server failed: %v", err)
+		}
+	}()
+	return server, nil
+}
+
+// stopGRPC stops the gRPC server, letting the running calls finish until ctx
+// is done.
+func stopGRPC(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		server.Stop()
+	}
+}
+
+// grpcInterceptor logs each call like requestLogger, and turns a panicking
+// call into an internal error like recoverPanics.
+func (s *Server) grpcInterceptor(ctx context.Context, request any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (response any, err error) {
+	start := time.Now()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.log.WithFields(logrus.Fields{
+				"method": info.FullMethod,
+				"panic":  fmt.Sprint(recovered),
+				"stack":  string(debug.Stack()),
+			}).Error("gRPC handler panicked")
+			response, err = nil, status.Error(codes.Internal, "Internal server error")
+		}
+		s.log.WithFields(logrus.Fields{
+			"method":   info.FullMethod,
+			"code":     status.Code(err).String(),
+			"duration": time.Since(start),
+		}).Debug("gRPC call handled")
+	}()
+	return handler(ctx, request)
+}
+
+// Invoke runs a function with an event, like POST /invoke/{name} without the
+// async and proxy modes.
+func (g grpcService) Invoke(ctx context.Context, request *rpc.InvokeRequest) (*rpc.InvokeResponse, error) {
+	s := g.s
+	function, err := s.resolveFunction(ctx, request.Function)
+	if err != nil {
+		if errors.Is(err, storage.ErrQueryTimeout) {
+			return nil, status.Error(codes.Unavailable, "Database is busy, try again later")
+		}
+		if !errors.Is(err, storage.ErrFunctionNotFound) {
+			s.log.WithError(err).WithField("function", request.Function).Error("Failed to look up function")
+			return nil, status.Error(codes.Internal, "Failed to look up function")
+		}
+		return nil, status.Errorf(codes.NotFound, "Function %s not found", request.Function)
+	}
+
+	event, err := applyDefaultEvent(function, request.Event)
+	if err == nil {
+		err = s.validateEvent(function, event)
+	}
+	if err != nil {
+		var validationErr *eventValidationError
+		if errors.As(err, &validationErr) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		s.log.WithError(err).WithField("function", function.Name).Error("Failed to validate event")
+		return nil, status.Errorf(codes.Internal, "Failed to validate event: %v", err)
+	}
+
+	cacheKey := eventKey(function, event)
+	cacheTTL := time.Duration(function.CacheTTLMs) * time.Millisecond
+	if cacheTTL > 0 {
+		if result, ok := s.cache.get(cacheKey); ok {
+			return invokeResponse(function, result, true), nil
+		}
+	}
+
+	result, err := s.invoke(ctx, function, event)
+	if err != nil {
+		if ctx.Err() != nil {
+			s.log.WithField("function", function.Name).Warn("Client disconnected, invocation cancelled")
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		httpStatus, message := failureStatus(function, err)
+		s.log.WithError(err).WithFields(logrus.Fields{
+			"function": function.Name,
+			"status":   httpStatus,
+		}).Error("Function execution failed")
+		return nil, status.Error(grpcCode(httpStatus), message)
+	}
+
+	if cacheTTL > 0 {
+		s.cache.put(cacheKey, result, cacheTTL)
+	}
+	return invokeResponse(function, result, false), nil
+}
+
+// invokeResponse describes the result of a successful invocation.
+func invokeResponse(function *storage.Function, result *orchestrator.Result, cached bool) *rpc.InvokeResponse {
+	return &rpc.InvokeResponse{
+		Function:    function.Name,
+		Output:      result.Output,
+		ContentType: contentType(function),
+		ColdStart:   result.ColdStart,
+		ExecMs:      result.Exec.Milliseconds(),
+		Cached:      cached,
+	}
+}
+
+// Deploy stores a function, like POST /functions.
+func (g grpcService) Deploy(ctx context.Context, request *rpc.DeployRequest) (*rpc.DeployResponse, error) {
+	s := g.s
+	var metadata functionMetadata
+	if err := json.Unmarshal(request.Function, &metadata); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid function metadata: %v", err)
+	}
+	if metadata.Name == "" || metadata.Image == "" || metadata.Runtime == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing required fields")
+	}
+	function, err := metadata.function()
+	if err == nil {
+		err = s.applyImageDefaults(ctx, function)
+	}
+	if err == nil {
+		err = s.checkTimeout(function)
+	}
+	if err == nil {
+		err = s.checkLogDestination(function)
+	}
+	if err != nil {
+		s.log.WithError(err).WithField("function", metadata.Name).Warn("Invalid function metadata")
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.beforeDeploy(ctx, function); err != nil {
+		s.log.WithError(err).WithField("function", function.Name).Warn("Deploy rejected by hook")
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	// Pinning the digest verifies the image as well
+	pin := metadata.PinDigest && function.Digest == ""
+	if metadata.VerifyImage || pin {
+		if _, err := s.orchestrator.Warm(ctx, function); err != nil {
+			if errors.Is(err, orchestrator.ErrImageNotFound) {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+			s.log.WithError(err).WithField("function", function.Name).Error("Failed to verify function image")
+			return nil, status.Errorf(codes.Internal, "Failed to verify image: %v", err)
+		}
+	}
+
+	if pin {
+		if err := s.resolveDigest(ctx, function); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to resolve image digest: %v", err)
+		}
+	}
+
+	secrets, err := s.deploySecrets(ctx, &metadata, function)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to get secrets")
+	}
+	if err := s.saveFunction(ctx, function, secrets, incomingActor(ctx)); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to store function")
+	}
+	return &rpc.DeployResponse{TimeoutMs: s.executionTimeout(function).Milliseconds()}, nil
+}
+
+// List returns the metadata of all functions, like GET /functions.
+func (g grpcService) List(ctx context.Context, request *rpc.ListRequest) (*rpc.ListResponse, error) {
+	functions, err := g.s.store.ListFunctions(request.IncludeDeleted)
+	if err != nil {
+		g.s.log.WithError(err).Error("Failed to list functions")
+		return nil, status.Error(codes.Internal, "Failed to list functions")
+	}
+
+	response := &rpc.ListResponse{Functions: make([]json.RawMessage, 0, len(functions))}
+	for i := range functions {
+		details, err := json.Marshal(newFunctionDetails(&functions[i]))
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to encode function: %v", err)
+		}
+		response.Functions = append(response.Functions, details)
+	}
+	return response, nil
+}
+
+// incomingActor returns who makes the change of a gRPC call.
+func incomingActor(ctx context.Context) string {
+	if values := metadata.ValueFromIncomingContext(ctx, rpc.ActorKey); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcCode translates the HTTP status a failure is reported with over HTTP to
+// a gRPC status code.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusFailedDependency:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
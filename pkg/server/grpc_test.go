@@ -0,0 +1,236 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/rpc"
+	"github.com/akos011221/serverless/pkg/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newGRPCClient serves the gRPC API of s in memory and returns a client of it.
+func newGRPCClient(t *testing.T, s *Server) *rpc.Client {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.UnaryInterceptor(s.grpcInterceptor))
+	rpc.RegisterFunctionsServer(server, grpcService{s: s})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return rpc.NewClient(conn)
+}
+
+func TestGRPCInvoke(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+		if strings.Contains(string(event), `"fail":true`) {
+			return []byte("failed"), 1
+		}
+		return event, 0
+	}))
+	storeFunction(t, s, &storage.Function{Name: "echo", Image: "echo:latest", Runtime: "go", DefaultEvent: `{"default":true}`})
+	client := newGRPCClient(t, s)
+
+	tests := []struct {
+		name       string
+		function   string
+		event      string
+		wantCode   codes.Code
+		wantOutput string
+	}{
+		{name: "event", function: "echo", event: `{"user":"alice"}`, wantCode: codes.OK, wantOutput: `{"default":true,"user":"alice"}`},
+		{name: "default event", function: "echo", wantCode: codes.OK, wantOutput: `{"default":true}`},
+		{name: "function failed", function: "echo", event: `{"fail":true}`, wantCode: codes.Internal},
+		{name: "missing function", function: "missing", event: `{}`, wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &rpc.InvokeRequest{Function: tt.function}
+			if tt.event != "" {
+				request.Event = json.RawMessage(tt.event)
+			}
+			response, err := client.Invoke(context.Background(), request)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %s, want %s: %v", code, tt.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if string(response.Output) != tt.wantOutput || response.Function != tt.function {
+				t.Errorf("response = %+v, want output %s of %s", response, tt.wantOutput, tt.function)
+			}
+			if response.ContentType != "application/json" {
+				t.Errorf("content type = %q, want application/json", response.ContentType)
+			}
+		})
+	}
+}
+
+func TestGRPCDeployAndList(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, nil))
+	client := newGRPCClient(t, s)
+
+	tests := []struct {
+		name     string
+		function string
+		wantCode codes.Code
+	}{
+		{name: "deploy", function: `{"name":"hello","image":"hello:1","runtime":"go"}`, wantCode: codes.OK},
+		{name: "missing fields", function: `{"name":"hello"}`, wantCode: codes.InvalidArgument},
+		{name: "invalid metadata", function: `{"name":"hello","image":"hello:1","runtime":"go","memory_bytes":-1}`, wantCode: codes.InvalidArgument},
+		{name: "log file without a log directory", function: `{"name":"hello","image":"hello:1","runtime":"go","log_destination":"file:hello.log"}`, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.AppendToOutgoingContext(context.Background(), rpc.ActorKey, "alice")
+			response, err := client.Deploy(ctx, &rpc.DeployRequest{Function: json.RawMessage(tt.function)})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %s, want %s: %v", code, tt.wantCode, err)
+			}
+			if err == nil && response.TimeoutMs != s.config.ExecutionTimeout.Milliseconds() {
+				t.Errorf("deploy answered timeout_ms %d, want the server's %s", response.TimeoutMs, s.config.ExecutionTimeout)
+			}
+		})
+	}
+
+	response, err := client.List(context.Background(), &rpc.ListRequest{})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(response.Functions) != 1 {
+		t.Fatalf("listed %d functions, want 1", len(response.Functions))
+	}
+	var details functionDetails
+	if err := json.Unmarshal(response.Functions[0], &details); err != nil || details.Name != "hello" || details.Image != "hello:1" {
+		t.Errorf("listed %s, want hello with image hello:1", response.Functions[0])
+	}
+
+	w := httptest.NewRecorder()
+	s.handleAudit(w, httptest.NewRequest(http.MethodGet, "/audit", nil))
+	var entries []auditEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 1 || entries[0].Actor != "alice" {
+		t.Errorf("audit log = %s, want the deploy by alice", w.Body)
+	}
+}
+
+func TestGRPCDeployKeepSecrets(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, nil))
+	client := newGRPCClient(t, s)
+	if err := s.store.SaveFunction(&storage.Function{Name: "hello", Image: "hello:1", Runtime: "go", SecretNames: []string{"TOKEN"}},
+		map[string]string{"TOKEN": "kept"}); err != nil {
+		t.Fatalf("failed to store function: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		function    string
+		wantSecrets map[string]string
+	}{
+		{name: "kept", function: `{"name":"hello","image":"hello:2","runtime":"go","keep_secrets":true}`, wantSecrets: map[string]string{"TOKEN": "kept"}},
+		{name: "given ones win", function: `{"name":"hello","image":"hello:3","runtime":"go","keep_secrets":true,"secrets":{"KEY":"new"}}`, wantSecrets: map[string]string{"KEY": "new"}},
+		{name: "replaced", function: `{"name":"hello","image":"hello:4","runtime":"go"}`, wantSecrets: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := client.Deploy(context.Background(), &rpc.DeployRequest{Function: json.RawMessage(tt.function)}); err != nil {
+				t.Fatalf("Deploy failed: %v", err)
+			}
+			secrets, err := s.store.GetSecrets(context.Background(), "hello")
+			if err != nil {
+				t.Fatalf("failed to get secrets: %v", err)
+			}
+			if len(secrets) != len(tt.wantSecrets) || !maps.Equal(secrets, tt.wantSecrets) {
+				t.Errorf("secrets = %v, want %v", secrets, tt.wantSecrets)
+			}
+			function, err := s.store.GetFunction(context.Background(), "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(function.SecretNames) != len(tt.wantSecrets) {
+				t.Errorf("secret names %q, want those of %v", function.SecretNames, tt.wantSecrets)
+			}
+		})
+	}
+}
+
+func TestGRPCDeployPinDigest(t *testing.T) {
+	tests := []struct {
+		name       string
+		function   string
+		present    bool // Whether the image is on the engine or its registry
+		wantCode   codes.Code
+		wantDigest string
+	}{
+		{name: "pinned", function: `{"name":"hello","image":"hello:1","runtime":"go","pin_digest":true}`, present: true, wantCode: codes.OK, wantDigest: "sha256:hello:1"},
+		{name: "missing image", function: `{"name":"hello","image":"hello:1","runtime":"go","pin_digest":true}`, wantCode: codes.FailedPrecondition},
+		{name: "given digest kept", function: `{"name":"hello","image":"hello:1","runtime":"go","pin_digest":true,"digest":"` + stableDigest + `"}`, wantCode: codes.OK, wantDigest: stableDigest},
+		{name: "not pinned", function: `{"name":"hello","image":"hello:1","runtime":"go"}`, present: true, wantCode: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, nil)
+			engine.images = map[string]bool{}
+			if tt.present {
+				engine.images["hello:1"] = true
+			}
+			s := newTestServer(t, engine)
+			client := newGRPCClient(t, s)
+
+			_, err := client.Deploy(context.Background(), &rpc.DeployRequest{Function: json.RawMessage(tt.function)})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %s, want %s: %v", code, tt.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			function, err := s.store.GetFunction(context.Background(), "hello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if function.Digest != tt.wantDigest {
+				t.Errorf("digest = %q, want %q", function.Digest, tt.wantDigest)
+			}
+		})
+	}
+}
+
+func TestGRPCCode(t *testing.T) {
+	tests := []struct {
+		status int
+		want   codes.Code
+	}{
+		{status: http.StatusBadRequest, want: codes.InvalidArgument},
+		{status: http.StatusUnprocessableEntity, want: codes.InvalidArgument},
+		{status: http.StatusNotFound, want: codes.NotFound},
+		{status: http.StatusFailedDependency, want: codes.FailedPrecondition},
+		{status: http.StatusTooManyRequests, want: codes.ResourceExhausted},
+		{status: http.StatusServiceUnavailable, want: codes.Unavailable},
+		{status: http.StatusGatewayTimeout, want: codes.DeadlineExceeded},
+		{status: http.StatusInternalServerError, want: codes.Internal},
+	}
+	for _, tt := range tests {
+		if got := grpcCode(tt.status); got != tt.want {
+			t.Errorf("grpcCode(%d) = %s, want %s", tt.status, got, tt.want)
+		}
+	}
+}
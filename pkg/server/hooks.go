@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// DeployHook runs custom logic around deploys, e.g. to enforce a policy or to
+// notify an external system. Updates of a function count as deploys.
+type DeployHook interface {
+	// BeforeDeploy runs once the function is validated, before it's stored.
+	// It may change the function, and an error rejects the deploy.
+	BeforeDeploy(ctx context.Context, function *storage.Function) error
+	// AfterDeploy runs once the function is stored.
+	AfterDeploy(ctx context.Context, function *storage.Function)
+}
+
+// InvokeHook runs custom logic around executions of functions, whatever
+// triggered them. Invocations answered from the cache or by deduplication
+// don't execute the function, and don't run the hooks.
+type InvokeHook interface {
+	// BeforeInvoke runs before the function executes, with the event already
+	// validated. It returns the event to execute the function with, and an
+	// error rejects the invocation.
+	BeforeInvoke(ctx context.Context, function *storage.Function, event []byte) ([]byte, error)
+	// AfterInvoke runs once the execution ended, with its result or error.
+	AfterInvoke(ctx context.Context, function *storage.Function, result *orchestrator.Result, err error)
+}
+
+// NopDeployHook does nothing, embed it to implement only some of the methods
+// of DeployHook.
+type NopDeployHook struct{}
+
+// BeforeDeploy accepts the deploy as is.
+func (NopDeployHook) BeforeDeploy(context.Context, *storage.Function) error { return nil }
+
+// AfterDeploy does nothing.
+func (NopDeployHook) AfterDeploy(context.Context, *storage.Function) {}
+
+// NopInvokeHook does nothing, embed it to implement only some of the methods
+// of InvokeHook.
+type NopInvokeHook struct{}
+
+// BeforeInvoke passes the event through.
+func (NopInvokeHook) BeforeInvoke(_ context.Context, _ *storage.Function, event []byte) ([]byte, error) {
+	return event, nil
+}
+
+// AfterInvoke does nothing.
+func (NopInvokeHook) AfterInvoke(context.Context, *storage.Function, *orchestrator.Result, error) {}
+
+// AddDeployHook registers a hook run around every deploy. Hooks run in the
+// order they're added, and must be added before the server runs.
+func (s *Server) AddDeployHook(hook DeployHook) {
+	s.deployHooks = append(s.deployHooks, hook)
+}
+
+// AddInvokeHook registers a hook run around every execution. Hooks run in
+// the order they're added, each getting the event of the previous one, and
+// must be added before the server runs.
+func (s *Server) AddInvokeHook(hook InvokeHook) {
+	s.invokeHooks = append(s.invokeHooks, hook)
+}
+
+// hookError is returned when a hook rejects a deploy or an invocation.
+type hookError struct {
+	err error
+}
+
+func (e *hookError) Error() string {
+	return e.err.Error()
+}
+
+func (e *hookError) Unwrap() error {
+	return e.err
+}
+
+// beforeDeploy runs the deploy hooks before a function is stored, stopping at
+// the first that rejects it.
+func (s *Server) beforeDeploy(ctx context.Context, function *storage.Function) error {
+	for _, hook := range s.deployHooks {
+		if err := hook.BeforeDeploy(ctx, function); err != nil {
+			return &hookError{err: err}
+		}
+	}
+	return nil
+}
+
+// afterDeploy runs the deploy hooks once a function is stored.
+func (s *Server) afterDeploy(ctx context.Context, function *storage.Function) {
+	for _, hook := range s.deployHooks {
+		hook.AfterDeploy(ctx, function)
+	}
+}
+
+// beforeInvoke runs the invoke hooks before an execution, returning the event
+// to execute the function with.
+func (s *Server) beforeInvoke(ctx context.Context, function *storage.Function, event []byte) ([]byte, error) {
+	for _, hook := range s.invokeHooks {
+		var err error
+		if event, err = hook.BeforeInvoke(ctx, function, event); err != nil {
+			return nil, &hookError{err: err}
+		}
+	}
+	return event, nil
+}
+
+// afterInvoke runs the invoke hooks once an execution ended.
+func (s *Server) afterInvoke(ctx context.Context, function *storage.Function, result *orchestrator.Result, err error) {
+	for _, hook := range s.invokeHooks {
+		hook.AfterInvoke(ctx, function, result, err)
+	}
+}
+
+// registryAllowlist is a deploy hook that only accepts functions whose image
+// comes from one of the given registries, e.g. registry.example.com, or
+// docker.io for Docker Hub. The image the CLI builds for the function,
+// serverless-<name>:latest, is always accepted. It's
+// added by NewServer for allowed_registries.
+type registryAllowlist struct {
+	NopDeployHook
+	registries []string
+}
+
+// BeforeDeploy rejects images from other registries.
+func (a registryAllowlist) BeforeDeploy(_ context.Context, function *storage.Function) error {
+	if orchestrator.BuiltImage(function) {
+		return nil
+	}
+	registry := imageRegistry(function.Image)
+	for _, allowed := range a.registries {
+		if registry == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("registry %s of image %s is not allowed, use one of %s",
+		registry, function.Image, strings.Join(a.registries, ", "))
+}
+
+// dockerHub is the registry of image references that don't name one.
+const dockerHub = "docker.io"
+
+// imageRegistry returns the registry of an image reference. Like Docker, the
+// first component of the name is a registry when it looks like a host.
+func imageRegistry(image string) string {
+	first, _, ok := strings.Cut(image, "/")
+	if !ok || !strings.ContainsAny(first, ".:") && first != "localhost" {
+		return dockerHub
+	}
+	return first
+}
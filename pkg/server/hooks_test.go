@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// recordingHook is a deploy and invoke hook that rejects with reject, if set,
+// rewrites events with rewrite, if set, and records what it's called with.
+type recordingHook struct {
+	reject  error
+	rewrite func(event []byte) []byte
+
+	mu       sync.Mutex
+	deployed []string // Names of the functions AfterDeploy ran for
+	invoked  []string // Outputs, or errors, of the executions AfterInvoke ran for
+}
+
+func (h *recordingHook) BeforeDeploy(_ context.Context, function *storage.Function) error {
+	if h.reject != nil {
+		return h.reject
+	}
+	if function.Env == nil {
+		function.Env = make(map[string]string)
+	}
+	function.Env["DEPLOYED_BY"] = "hook"
+	return nil
+}
+
+func (h *recordingHook) AfterDeploy(_ context.Context, function *storage.Function) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.deployed = append(h.deployed, function.Name)
+}
+
+func (h *recordingHook) BeforeInvoke(_ context.Context, _ *storage.Function, event []byte) ([]byte, error) {
+	if h.reject != nil {
+		return nil, h.reject
+	}
+	if h.rewrite != nil {
+		return h.rewrite(event), nil
+	}
+	return event, nil
+}
+
+func (h *recordingHook) AfterInvoke(_ context.Context, _ *storage.Function, result *orchestrator.Result, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.invoked = append(h.invoked, "error: "+err.Error())
+		return
+	}
+	h.invoked = append(h.invoked, string(result.Output))
+}
+
+func TestDeployHooks(t *testing.T) {
+	tests := []struct {
+		name       string
+		reject     error
+		wantStatus int
+	}{
+		{name: "accepted", wantStatus: http.StatusOK},
+		{name: "rejected", reject: errors.New("denied by policy"), wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			hook := &recordingHook{reject: tt.reject}
+			s.AddDeployHook(hook)
+
+			body, _ := json.Marshal(map[string]string{"name": "hello", "image": "hello:latest", "runtime": "go"})
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			function, err := s.store.GetFunction(context.Background(), "hello")
+			if tt.reject != nil {
+				if !strings.Contains(w.Body.String(), tt.reject.Error()) {
+					t.Errorf("body = %q, want the hook's error", w.Body)
+				}
+				if err == nil {
+					t.Error("rejected function stored")
+				}
+				if len(hook.deployed) != 0 {
+					t.Errorf("AfterDeploy ran for %q after a rejection", hook.deployed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("function not stored: %v", err)
+			}
+			if len(function.Env) != 1 || function.Env["DEPLOYED_BY"] != "hook" {
+				t.Errorf("stored env %v, want the hook's change", function.Env)
+			}
+			if len(hook.deployed) != 1 || hook.deployed[0] != "hello" {
+				t.Errorf("AfterDeploy ran for %q, want hello once", hook.deployed)
+			}
+		})
+	}
+}
+
+func TestInvokeHooks(t *testing.T) {
+	tests := []struct {
+		name        string
+		hook        *recordingHook
+		wantStatus  int
+		wantEvent   string // Event the function got, empty when it didn't run
+		wantInvoked []string
+	}{
+		{
+			name:        "passed through",
+			hook:        &recordingHook{},
+			wantStatus:  http.StatusOK,
+			wantEvent:   `{"n":1}`,
+			wantInvoked: []string{`{"n":1}`},
+		},
+		{
+			name: "rewritten",
+			hook: &recordingHook{rewrite: func(event []byte) []byte {
+				return []byte(`{"wrapped":` + string(event) + `}`)
+			}},
+			wantStatus:  http.StatusOK,
+			wantEvent:   `{"wrapped":{"n":1}}`,
+			wantInvoked: []string{`{"wrapped":{"n":1}}`},
+		},
+		{
+			// Nothing executed, so AfterInvoke doesn't run
+			name:       "rejected",
+			hook:       &recordingHook{reject: errors.New("denied by policy")},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []byte
+			// The function echoes its event
+			s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				got = event
+				return event, 0
+			}))
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+			s.AddInvokeHook(tt.hook)
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(`{"n":1}`)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if string(got) != tt.wantEvent {
+				t.Errorf("function got %q, want %q", got, tt.wantEvent)
+			}
+			tt.hook.mu.Lock()
+			defer tt.hook.mu.Unlock()
+			if strings.Join(tt.hook.invoked, "\n") != strings.Join(tt.wantInvoked, "\n") {
+				t.Errorf("AfterInvoke got %q, want %q", tt.hook.invoked, tt.wantInvoked)
+			}
+		})
+	}
+}
+
+func TestRegistryAllowlist(t *testing.T) {
+	tests := []struct {
+		name       string
+		image      string
+		wantStatus int
+	}{
+		{name: "allowed registry", image: "registry.example.com/team/hello:1", wantStatus: http.StatusOK},
+		{name: "Docker Hub", image: "library/hello:1", wantStatus: http.StatusOK},
+		{name: "built by the CLI", image: "serverless-hello:latest", wantStatus: http.StatusOK},
+		{name: "other registry", image: "ghcr.io/team/hello:1", wantStatus: http.StatusForbidden},
+		{name: "registry with a port", image: "registry.example.com:5000/hello:1", wantStatus: http.StatusForbidden},
+		{name: "localhost", image: "localhost/hello:1", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.AllowedRegistries = []string{"registry.example.com", "docker.io"}
+			s := newConfiguredServer(t, newFakeEngine(t, nil), config)
+
+			body, _ := json.Marshal(map[string]string{"name": "hello", "image": tt.image, "runtime": "go"})
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "hello", want: "docker.io"},
+		{image: "hello:latest", want: "docker.io"},
+		{image: "library/hello", want: "docker.io"},
+		{image: "team/hello@sha256:abc", want: "docker.io"},
+		{image: "registry.example.com/hello", want: "registry.example.com"},
+		{image: "registry:5000/hello", want: "registry:5000"},
+		{image: "localhost/hello", want: "localhost"},
+		{image: "ghcr.io/team/hello:1", want: "ghcr.io"},
+	}
+	for _, tt := range tests {
+		if got := imageRegistry(tt.image); got != tt.want {
+			t.Errorf("imageRegistry(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
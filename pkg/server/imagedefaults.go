@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/docker/go-units"
+)
+
+// Image labels a function's author can set defaults with, so they travel with
+// the image, e.g. LABEL serverless.timeout=30 in its Dockerfile.
+const (
+	labelTimeout    = "serverless.timeout"     // Execution timeout, in seconds or as a duration such as 1m30s
+	labelMemory     = "serverless.memory"      // Memory limit, in MiB or as a size such as 1g
+	labelCPUs       = "serverless.cpus"        // CPU limit in cores
+	labelMaxRetries = "serverless.max_retries" // Retries of failed async invocations
+)
+
+// applyImageDefaults fills in the settings a deploy leaves unset from the
+// labels of the function's image, so explicit settings always win. Only an
+// image present on the Docker host is inspected, such as one the CLI built; a
+// registry image that isn't pulled yet has its labels ignored.
+func (s *Server) applyImageDefaults(ctx context.Context, function *storage.Function) error {
+	labels, err := s.orchestrator.ImageLabels(ctx, function)
+	if err != nil {
+		// The deploy doesn't depend on Docker, so it goes on without defaults
+		s.log.WithError(err).WithField("function", function.Name).Warn("Failed to read image labels, deploying without their defaults")
+		return nil
+	}
+	return imageDefaults(function, labels)
+}
+
+// imageDefaults applies the defaults of an image's labels to the settings of
+// a function that are unset.
+func imageDefaults(function *storage.Function, labels map[string]string) error {
+	if value, ok := labels[labelTimeout]; ok && function.TimeoutMs == 0 {
+		timeout, err := labelDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid image label %s=%s, expected seconds or a duration", labelTimeout, value)
+		}
+		function.TimeoutMs = timeout.Milliseconds()
+	}
+	if value, ok := labels[labelMemory]; ok && function.MemoryBytes == 0 {
+		memory, err := labelSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid image label %s=%s, expected MiB or a size", labelMemory, value)
+		}
+		function.MemoryBytes = memory
+	}
+	if value, ok := labels[labelCPUs]; ok && function.NanoCPUs == 0 {
+		cpus, err := strconv.ParseFloat(value, 64)
+		if err != nil || cpus <= 0 {
+			return fmt.Errorf("invalid image label %s=%s, expected a number of cores", labelCPUs, value)
+		}
+		function.NanoCPUs = int64(cpus * 1e9)
+	}
+	if value, ok := labels[labelMaxRetries]; ok && function.MaxRetries == 0 {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("invalid image label %s=%s, expected a number of retries", labelMaxRetries, value)
+		}
+		function.MaxRetries = retries
+	}
+	return nil
+}
+
+// labelDuration parses a duration label, where a plain number is in seconds.
+func labelDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds <= 0 {
+			return 0, fmt.Errorf("duration must be positive")
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return duration, nil
+}
+
+// labelSize parses a size label, where a plain number is in MiB.
+func labelSize(value string) (int64, error) {
+	if mib, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if mib <= 0 {
+			return 0, fmt.Errorf("size must be positive")
+		}
+		return mib * units.MiB, nil
+	}
+	size, err := units.RAMInBytes(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size, nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestImageDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		function storage.Function // Settings given with the deploy
+		labels   map[string]string
+		want     storage.Function
+		wantErr  bool
+	}{
+		{name: "no labels"},
+		{
+			name: "plain numbers",
+			labels: map[string]string{
+				labelTimeout: "30", labelMemory: "256", labelCPUs: "0.5", labelMaxRetries: "3",
+			},
+			want: storage.Function{TimeoutMs: 30000, MemoryBytes: 256 << 20, NanoCPUs: 5e8, MaxRetries: 3},
+		},
+		{
+			name:   "duration and size",
+			labels: map[string]string{labelTimeout: "1m30s", labelMemory: "1g"},
+			want:   storage.Function{TimeoutMs: 90000, MemoryBytes: 1 << 30},
+		},
+		{
+			name:     "explicit settings win",
+			function: storage.Function{TimeoutMs: 5000, MemoryBytes: 64 << 20, NanoCPUs: 1e9, MaxRetries: 1},
+			labels: map[string]string{
+				labelTimeout: "30", labelMemory: "256", labelCPUs: "0.5", labelMaxRetries: "3",
+			},
+			want: storage.Function{TimeoutMs: 5000, MemoryBytes: 64 << 20, NanoCPUs: 1e9, MaxRetries: 1},
+		},
+		{name: "other labels ignored", labels: map[string]string{"org.opencontainers.image.version": "1.0"}},
+		{name: "invalid timeout", labels: map[string]string{labelTimeout: "soon"}, wantErr: true},
+		{name: "zero timeout", labels: map[string]string{labelTimeout: "0"}, wantErr: true},
+		{name: "invalid memory", labels: map[string]string{labelMemory: "lots"}, wantErr: true},
+		{name: "negative CPUs", labels: map[string]string{labelCPUs: "-1"}, wantErr: true},
+		{name: "invalid retries", labels: map[string]string{labelMaxRetries: "2.5"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			function := tt.function
+			err := imageDefaults(&function, tt.labels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("imageDefaults = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(function, tt.want) {
+				t.Errorf("function = %+v, want %+v", function, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeployImageDefaults(t *testing.T) {
+	tests := []struct {
+		name        string
+		image       string
+		deploy      map[string]any // Settings given with the deploy
+		wantStatus  int
+		wantTimeout int64 // Effective timeout echoed by the deploy, 0 for the server's
+		wantMemory  int64
+	}{
+		{name: "defaults from the labels", image: "labelled:1", wantStatus: http.StatusOK, wantTimeout: 10000, wantMemory: 128 << 20},
+		{name: "explicit timeout", image: "labelled:1", deploy: map[string]any{"timeout_ms": 2000}, wantStatus: http.StatusOK, wantTimeout: 2000, wantMemory: 128 << 20},
+		{name: "image not present", image: "remote:1", wantStatus: http.StatusOK},
+		{name: "invalid label", image: "broken:1", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, nil)
+			engine.images = map[string]bool{"labelled:1": true, "broken:1": true}
+			engine.labels = map[string]map[string]string{
+				"labelled:1": {labelTimeout: "10", labelMemory: "128m"},
+				"broken:1":   {labelCPUs: "many"},
+			}
+			s := newTestServer(t, engine)
+
+			deploy := map[string]any{"name": "hello", "image": tt.image, "runtime": "go"}
+			for key, value := range tt.deploy {
+				deploy[key] = value
+			}
+			body, _ := json.Marshal(deploy)
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("deploy status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if tt.wantTimeout == 0 {
+				tt.wantTimeout = s.config.ExecutionTimeout.Milliseconds()
+			}
+			var result deployResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.TimeoutMs != tt.wantTimeout {
+				t.Errorf("deploy answered %s, want timeout_ms %d", w.Body, tt.wantTimeout)
+			}
+			function, err := s.store.GetFunction(context.Background(), "hello")
+			if err != nil {
+				t.Fatalf("GetFunction failed: %v", err)
+			}
+			if function.MemoryBytes != tt.wantMemory {
+				t.Errorf("memory = %d, want %d", function.MemoryBytes, tt.wantMemory)
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// asyncHeader opts an invocation into asynchronous execution: the server replies
+// with a job ID right away and the function runs in the background.
+const asyncHeader = "X-Serverless-Async"
+
+const (
+	jobQueueSize        = 1024             // Jobs waiting for a worker before submissions are rejected
+	defaultRetryBackoff = time.Second      // Backoff of functions that retry without configuring one
+	maxBackoffShift     = 10               // Caps the exponential backoff at 1024 times the base
+	maxJobWait          = 30 * time.Second // Longest a job request is held waiting for a change
+)
+
+// errJobQueueFull is returned when a job can't be queued.
+var errJobQueueFull = errors.New("job queue is full")
+
+// errJobFinished is returned when cancelling a job that already finished.
+var errJobFinished = errors.New("job already finished")
+
+// jobDetails is the externally visible state of a job.
+type jobDetails struct {
+	JobID     string    `json:"job_id"`
+	Function  string    `json:"function"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	Result    string    `json:"result,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// newJobDetails builds the description of a job from its record.
+func newJobDetails(job *storage.Job) jobDetails {
+	return jobDetails{
+		JobID:     job.JobID,
+		Function:  job.FunctionName,
+		Status:    job.Status,
+		Attempts:  job.Attempts,
+		Result:    string(job.Result),
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+}
+
+// submitJob stores a pending job for the function and queues it. A digest
+// pins the job to a revision of the function, otherwise it runs whatever
+// image the function has when the job starts. Force runs a run_once function
+// that already completed.
+func (s *Server) submitJob(function *storage.Function, digest string, force bool, event []byte) (*storage.Job, error) {
+	job := &storage.Job{
+		JobID:        newInvocationID(),
+		FunctionName: function.Name,
+		Digest:       digest,
+		Force:        force,
+		Event:        event,
+		Status:       storage.JobPending,
+	}
+	if err := s.store.CreateJob(job); err != nil {
+		return nil, err
+	}
+
+	if !s.enqueueJob(job.JobID) {
+		// The client is told the job wasn't accepted, so it mustn't run later
+		job.Status = storage.JobFailed
+		job.Error = errJobQueueFull.Error()
+		s.updateJob(job, s.log.WithField("job", job.JobID))
+		return job, errJobQueueFull
+	}
+	return job, nil
+}
+
+// enqueueJob hands a job to the workers without blocking.
+func (s *Server) enqueueJob(jobID string) bool {
+	select {
+	case s.jobQueue <- jobID:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueueJobAfter queues a pending job once delay passed, and keeps trying
+// every delay while the queue is full, until ctx is cancelled. The job stays
+// pending meanwhile, so a restart resumes it too.
+func (s *Server) enqueueJobAfter(ctx context.Context, jobID string, delay time.Duration, log *logrus.Entry) {
+	time.AfterFunc(delay, func() {
+		if ctx.Err() != nil || s.enqueueJob(jobID) {
+			return
+		}
+		log.WithField("delay", delay).Warn("Job queue full, postponing job")
+		s.enqueueJobAfter(ctx, jobID, delay, log)
+	})
+}
+
+// startJobWorkers resumes unfinished jobs and starts the workers executing
+// queued jobs until ctx is cancelled.
+func (s *Server) startJobWorkers(ctx context.Context) {
+	for i := 0; i < s.config.MaxConcurrency; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case jobID := <-s.jobQueue:
+					s.runJob(ctx, jobID)
+				}
+			}
+		}()
+	}
+
+	// Jobs interrupted by a previous shutdown are run again
+	jobs, err := s.store.ListUnfinishedJobs()
+	if err != nil {
+		s.log.WithError(err).Warn("Failed to resume unfinished jobs")
+		return
+	}
+	for _, job := range jobs {
+		if !s.enqueueJob(job.JobID) {
+			log := s.log.WithField("job", job.JobID)
+			log.Warn("Job queue full, postponing resumed job")
+			s.enqueueJobAfter(ctx, job.JobID, defaultRetryBackoff, log)
+		}
+	}
+}
+
+// runJob executes a job once. A failed execution is retried later according to
+// the function's retry policy, until its retries are exhausted. Jobs cancelled
+// while queued are dropped.
+func (s *Server) runJob(ctx context.Context, jobID string) {
+	log := s.log.WithField("job", jobID)
+
+	s.jobsMu.Lock()
+	job, err := s.store.GetJob(ctx, jobID)
+	if err != nil {
+		s.jobsMu.Unlock()
+		log.WithError(err).Warn("Failed to load job")
+		return
+	}
+	if job.Status == storage.JobCancelled {
+		s.jobsMu.Unlock()
+		log.Debug("Job cancelled, skipping")
+		return
+	}
+	log = log.WithField("function", job.FunctionName)
+
+	function, err := s.store.GetFunction(ctx, job.FunctionName)
+	if err == nil && job.Digest != "" {
+		function, err = s.pinRevision(ctx, function, job.Digest)
+	}
+	if err != nil {
+		s.finishJob(job, nil, err, log)
+		s.jobsMu.Unlock()
+		return
+	}
+
+	job.Status = storage.JobRunning
+	job.Attempts++
+	s.updateJob(job, log)
+
+	// The execution can be cancelled on its own, see cancelJob
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if job.Force {
+		jobCtx = withForcedRun(jobCtx)
+	}
+	s.runningJobs[jobID] = cancel
+	s.jobsMu.Unlock()
+
+	result, err := s.invoke(jobCtx, function, job.Event)
+
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	if _, running := s.runningJobs[jobID]; !running {
+		// Cancelled, which cancelJob already recorded
+		log.Info("Running job cancelled")
+		return
+	}
+	delete(s.runningJobs, jobID)
+
+	if ctx.Err() != nil {
+		// Shutting down, leave the job for the next start
+		job.Status = storage.JobPending
+		job.Attempts--
+		s.updateJob(job, log)
+		return
+	}
+
+	// Rejected events fail the same way again, so they aren't retried
+	if err != nil && job.Attempts <= function.MaxRetries && !clientError(function, err) {
+		job.Status = storage.JobPending
+		job.Error = err.Error()
+		s.updateJob(job, log)
+
+		delay := retryDelay(function, job.Attempts)
+		log.WithError(err).WithFields(logrus.Fields{
+			"attempt": job.Attempts,
+			"delay":   delay,
+		}).Warn("Job failed, retrying")
+		s.enqueueJobAfter(ctx, jobID, delay, log)
+		return
+	}
+
+	s.finishJob(job, result, err, log)
+}
+
+// finishJob records the final outcome of a job.
+func (s *Server) finishJob(job *storage.Job, result *orchestrator.Result, execErr error, log *logrus.Entry) {
+	if execErr != nil {
+		job.Status = storage.JobFailed
+		job.Error = execErr.Error()
+		log.WithError(execErr).WithField("attempts", job.Attempts).Warn("Job failed")
+	} else {
+		job.Status = storage.JobSucceeded
+		job.Result = result.Output
+		job.Error = ""
+		log.WithField("attempts", job.Attempts).Info("Job succeeded")
+	}
+
+	s.updateJob(job, log)
+}
+
+// cancelJob cancels a pending or running job. A pending job is dropped when a
+// worker picks it up, while a running job has its execution cancelled, which
+// stops the function's container. Finished jobs can't be cancelled.
+func (s *Server) cancelJob(ctx context.Context, jobID string) (*storage.Job, error) {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	job, err := s.store.GetJob(ctx, jobID)
+	if err != nil {
+		return nil, err
+	}
+	if jobFinished(job) {
+		return job, errJobFinished
+	}
+
+	if cancel, ok := s.runningJobs[jobID]; ok {
+		cancel()
+		delete(s.runningJobs, jobID)
+	}
+	job.Status = storage.JobCancelled
+	if err := s.store.UpdateJob(job); err != nil {
+		return nil, err
+	}
+	s.jobWaiters.notify()
+	return job, nil
+}
+
+// updateJob saves a job and wakes up the requests waiting for it to change.
+func (s *Server) updateJob(job *storage.Job, log *logrus.Entry) {
+	if err := s.store.UpdateJob(job); err != nil {
+		log.WithError(err).Warn("Failed to update job")
+	}
+	s.jobWaiters.notify()
+}
+
+// jobFinished reports whether a job reached a final status.
+func jobFinished(job *storage.Job) bool {
+	return job.Status == storage.JobSucceeded || job.Status == storage.JobFailed || job.Status == storage.JobCancelled
+}
+
+// jobWaiters lets requests wait for jobs to change, so clients can long-poll
+// instead of polling in a tight loop. Every change wakes up all waiters, which
+// then check whether their own job changed.
+type jobWaiters struct {
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+// watch returns a channel that is closed on the next change of any job.
+func (w *jobWaiters) watch() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.changed == nil {
+		w.changed = make(chan struct{})
+	}
+	return w.changed
+}
+
+// notify wakes up all waiters.
+func (w *jobWaiters) notify() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.changed != nil {
+		close(w.changed)
+		w.changed = nil
+	}
+}
+
+// retryDelay returns how long to wait before the next attempt, doubling the
+// function's backoff with every attempt made.
+func retryDelay(function *storage.Function, attempts int) time.Duration {
+	backoff := time.Duration(function.RetryBackoffMs) * time.Millisecond
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	shift := attempts - 1
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	return backoff << shift
+}
+
+// handleJob processes job requests (/jobs/{id}).
+// It supports long polling with the wait query parameter.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	jobID, subresource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	if jobID == "" {
+		s.log.Warn("Missing job ID in request")
+		http.Error(w, "Job ID required", http.StatusBadRequest)
+		return
+	}
+
+	switch subresource {
+	case "":
+	case "cancel":
+		s.handleCancelJob(w, r, jobID)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		s.log.WithField("method", r.Method).Warn("Invalid method for job")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// With ?wait=<duration>, an unfinished job is held until it changes or the
+	// duration elapses
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		wait, err = time.ParseDuration(value)
+		if err != nil || wait < 0 {
+			http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+			return
+		}
+		wait = min(wait, maxJobWait)
+	}
+
+	// Start watching before loading, so a change in between isn't missed
+	changed := s.jobWaiters.watch()
+
+	job, err := s.loadJob(r.Context(), jobID)
+	if err != nil {
+		s.jobLookupFailed(w, jobID, err)
+		return
+	}
+
+	if wait > 0 && !jobFinished(job) {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+		status, attempts := job.Status, job.Attempts
+		for job.Status == status && job.Attempts == attempts {
+			select {
+			case <-changed:
+			case <-timer.C:
+				s.writeJSON(w, http.StatusOK, newJobDetails(job))
+				return
+			case <-r.Context().Done():
+				return
+			}
+
+			changed = s.jobWaiters.watch()
+			if job, err = s.loadJob(r.Context(), jobID); err != nil {
+				s.jobLookupFailed(w, jobID, err)
+				return
+			}
+		}
+	}
+
+	s.writeJSON(w, http.StatusOK, newJobDetails(job))
+}
+
+// handleCancelJob cancels a pending or running job (POST /jobs/{id}/cancel).
+func (s *Server) handleCancelJob(w http.ResponseWriter, r *http.Request, jobID string) {
+	if r.Method != http.MethodPost {
+		s.log.WithField("method", r.Method).Warn("Invalid method for job cancel")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := s.queryContext(r.Context())
+	defer cancel()
+	job, err := s.cancelJob(ctx, jobID)
+	if errors.Is(err, errJobFinished) {
+		http.Error(w, fmt.Sprintf("Job already %s", job.Status), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.jobLookupFailed(w, jobID, err)
+		return
+	}
+
+	s.log.WithFields(logrus.Fields{"function": job.FunctionName, "job": jobID}).Info("Job cancelled")
+	s.writeJSON(w, http.StatusOK, newJobDetails(job))
+}
+
+// loadJob retrieves a job for a request, within the query timeout.
+func (s *Server) loadJob(ctx context.Context, jobID string) (*storage.Job, error) {
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+	return s.store.GetJob(ctx, jobID)
+}
+
+// jobLookupFailed replies to a failed lookup or update of a job with the
+// status its error maps to: 404 for a missing job, 503 when the database
+// didn't answer in time, and 500 otherwise.
+func (s *Server) jobLookupFailed(w http.ResponseWriter, jobID string, err error) {
+	log := s.log.WithError(err).WithField("job", jobID)
+	status, message, ok := errorStatus(err)
+	if !ok {
+		log.Error("Failed to load job")
+		http.Error(w, "Failed to load job", http.StatusInternalServerError)
+		return
+	}
+	log.Warn("Failed to load job")
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	http.Error(w, message, status)
+}
+
+// handleAsyncInvoke queues an asynchronous invocation and replies with its job
+// ID. A digest pins the job to a revision of the function, and force runs a
+// run_once function that already completed.
+func (s *Server) handleAsyncInvoke(w http.ResponseWriter, function *storage.Function, digest string, force bool, event []byte) {
+	job, err := s.submitJob(function, digest, force, event)
+	if err != nil {
+		if errors.Is(err, errJobQueueFull) {
+			s.log.WithField("function", function.Name).Warn("Job queue full")
+			http.Error(w, "Too many pending jobs, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		s.log.WithError(err).WithField("function", function.Name).Error("Failed to submit job")
+		http.Error(w, fmt.Sprintf("Failed to submit job: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.log.WithFields(logrus.Fields{"function": function.Name, "job": job.JobID}).Info("Job submitted")
+	s.writeJSON(w, http.StatusAccepted, newJobDetails(job))
+}
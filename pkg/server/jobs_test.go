@@ -0,0 +1,402 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// newJobTestServer creates a server with a store and a job queue of
+// queueSize, without workers or an orchestrator.
+func newJobTestServer(t *testing.T, queueSize int) *Server {
+	t.Helper()
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "db"), logrus.New())
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	return &Server{
+		store:       store,
+		jobQueue:    make(chan string, queueSize),
+		runningJobs: make(map[string]context.CancelFunc),
+		log:         logrus.New(),
+	}
+}
+
+func TestSubmitJob(t *testing.T) {
+	tests := []struct {
+		name       string
+		queueSize  int
+		queued     int // Jobs already waiting in the queue
+		wantErr    error
+		wantStatus string
+	}{
+		{name: "queued", queueSize: 2, wantStatus: storage.JobPending},
+		{name: "last free spot", queueSize: 2, queued: 1, wantStatus: storage.JobPending},
+		{name: "queue full", queueSize: 2, queued: 2, wantErr: errJobQueueFull, wantStatus: storage.JobFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newJobTestServer(t, tt.queueSize)
+			for i := 0; i < tt.queued; i++ {
+				s.jobQueue <- "other"
+			}
+			function := &storage.Function{Name: "hello"}
+
+			job, err := s.submitJob(function, "", false, []byte(`{}`))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("submitJob = %v, want %v", err, tt.wantErr)
+			}
+			stored, err := s.store.GetJob(context.Background(), job.JobID)
+			if err != nil {
+				t.Fatalf("the job wasn't stored: %v", err)
+			}
+			if stored.Status != tt.wantStatus {
+				t.Errorf("stored job status = %s, want %s", stored.Status, tt.wantStatus)
+			}
+			if tt.wantErr != nil && stored.Error != tt.wantErr.Error() {
+				t.Errorf("stored job error = %q, want %q", stored.Error, tt.wantErr.Error())
+			}
+
+			queued := tt.queued < tt.queueSize
+			if got := len(s.jobQueue) == tt.queued+1; got != queued {
+				t.Errorf("job queued = %v, want %v", got, queued)
+			}
+		})
+	}
+}
+
+func TestEnqueueJobAfter(t *testing.T) {
+	tests := []struct {
+		name      string
+		full      bool // Whether the queue is full until freed
+		cancel    bool // Whether the context is cancelled before the delay passes
+		wantQueue bool
+	}{
+		{name: "queue free", wantQueue: true},
+		{name: "queue full, then freed", full: true, wantQueue: true},
+		{name: "cancelled", cancel: true},
+		{name: "queue full, then cancelled", full: true, cancel: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newJobTestServer(t, 1)
+			if tt.full {
+				s.jobQueue <- "other"
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			delay := 10 * time.Millisecond
+			s.enqueueJobAfter(ctx, "job", delay, logrus.NewEntry(s.log))
+			if tt.full {
+				// A few retries find the queue full before it's freed
+				time.Sleep(5 * delay)
+				if got := <-s.jobQueue; got != "other" {
+					t.Fatalf("queue held %s, want the job queued first", got)
+				}
+			}
+
+			select {
+			case got := <-s.jobQueue:
+				if !tt.wantQueue {
+					t.Errorf("%s queued after the context was cancelled", got)
+				} else if got != "job" {
+					t.Errorf("queued %s, want job", got)
+				}
+			case <-time.After(20 * delay):
+				if tt.wantQueue {
+					t.Error("the job wasn't queued")
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		backoffMs int64
+		attempts  int
+		want      time.Duration
+	}{
+		{name: "first retry", backoffMs: 100, attempts: 1, want: 100 * time.Millisecond},
+		{name: "doubles", backoffMs: 100, attempts: 3, want: 400 * time.Millisecond},
+		{name: "default backoff", attempts: 2, want: 2 * defaultRetryBackoff},
+		{name: "negative backoff", backoffMs: -5, attempts: 1, want: defaultRetryBackoff},
+		{name: "capped", backoffMs: 1, attempts: 50, want: time.Millisecond << maxBackoffShift},
+		{name: "at the cap", backoffMs: 1, attempts: maxBackoffShift + 1, want: time.Millisecond << maxBackoffShift},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			function := &storage.Function{RetryBackoffMs: tt.backoffMs}
+			if got := retryDelay(function, tt.attempts); got != tt.want {
+				t.Errorf("retryDelay(%d ms, %d) = %v, want %v", tt.backoffMs, tt.attempts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunJobRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxRetries   int
+		failures     int // Failed attempts before the function succeeds
+		wantAttempts int
+		wantStatus   string
+	}{
+		{name: "succeeds first", maxRetries: 2, wantAttempts: 1, wantStatus: storage.JobSucceeded},
+		{name: "fails twice, then succeeds", maxRetries: 2, failures: 2, wantAttempts: 3, wantStatus: storage.JobSucceeded},
+		{name: "exhausts its retries", maxRetries: 2, failures: 5, wantAttempts: 3, wantStatus: storage.JobFailed},
+		{name: "no retries", failures: 1, wantAttempts: 1, wantStatus: storage.JobFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+				if attempts <= tt.failures {
+					return []byte("boom"), 1
+				}
+				return []byte(`{"ok":true}`), 0
+			})
+			s := newTestServer(t, engine)
+			function := &storage.Function{Name: "flaky", Image: "flaky:latest", MaxRetries: tt.maxRetries, RetryBackoffMs: 1}
+			storeFunction(t, s, function)
+
+			job, err := s.submitJob(function, "", false, []byte(`{}`))
+			if err != nil {
+				t.Fatalf("submitJob failed: %v", err)
+			}
+			// Run the job like a worker would, until it's no longer requeued
+			ctx := context.Background()
+			for {
+				select {
+				case jobID := <-s.jobQueue:
+					s.runJob(ctx, jobID)
+					continue
+				case <-time.After(500 * time.Millisecond):
+				}
+				break
+			}
+
+			stored, err := s.store.GetJob(context.Background(), job.JobID)
+			if err != nil {
+				t.Fatalf("GetJob failed: %v", err)
+			}
+			if stored.Status != tt.wantStatus || stored.Attempts != tt.wantAttempts {
+				t.Errorf("job %s after %d attempts, want %s after %d", stored.Status, stored.Attempts, tt.wantStatus, tt.wantAttempts)
+			}
+			if tt.wantStatus == storage.JobSucceeded && string(stored.Result) != `{"ok":true}` {
+				t.Errorf("result = %q, want the output", stored.Result)
+			}
+			if tt.wantStatus == storage.JobFailed && stored.Error == "" {
+				t.Error("failed job without the last error")
+			}
+		})
+	}
+}
+
+func TestHandleJobWait(t *testing.T) {
+	tests := []struct {
+		name       string
+		wait       string
+		finishes   bool // Whether the job finishes while the request waits
+		finished   bool // Whether the job finished before the request
+		wantStatus int
+		wantJob    string
+		wantHeld   time.Duration // Least time the request is held
+	}{
+		{name: "finishes within the wait", wait: "5s", finishes: true, wantStatus: http.StatusOK, wantJob: storage.JobSucceeded, wantHeld: 50 * time.Millisecond},
+		{name: "wait elapses", wait: "100ms", wantStatus: http.StatusOK, wantJob: storage.JobPending, wantHeld: 100 * time.Millisecond},
+		{name: "already finished", wait: "5s", finished: true, wantStatus: http.StatusOK, wantJob: storage.JobSucceeded},
+		{name: "no wait", wantStatus: http.StatusOK, wantJob: storage.JobPending},
+		{name: "invalid wait", wait: "soon", wantStatus: http.StatusBadRequest},
+		{name: "negative wait", wait: "-1s", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newJobTestServer(t, 1)
+			job := &storage.Job{JobID: "j1", FunctionName: "hello", Status: storage.JobPending}
+			if tt.finished {
+				job.Status = storage.JobSucceeded
+			}
+			if err := s.store.CreateJob(job); err != nil {
+				t.Fatal(err)
+			}
+			if tt.finishes {
+				time.AfterFunc(50*time.Millisecond, func() {
+					job.Status = storage.JobSucceeded
+					s.updateJob(job, logrus.NewEntry(s.log))
+				})
+			}
+
+			began := time.Now()
+			w := httptest.NewRecorder()
+			s.handleJob(w, httptest.NewRequest(http.MethodGet, "/jobs/j1?wait="+tt.wait, nil))
+			held := time.Since(began)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var got jobDetails
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid job: %v", err)
+			}
+			if got.Status != tt.wantJob {
+				t.Errorf("job status = %s, want %s", got.Status, tt.wantJob)
+			}
+			if held < tt.wantHeld || held > tt.wantHeld+time.Second {
+				t.Errorf("request held %v, want about %v", held, tt.wantHeld)
+			}
+		})
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     string
+		running    bool // Whether a worker is executing the job
+		wantErr    error
+		wantStatus string
+	}{
+		{name: "pending", status: storage.JobPending, wantStatus: storage.JobCancelled},
+		{name: "running", status: storage.JobRunning, running: true, wantStatus: storage.JobCancelled},
+		{name: "succeeded", status: storage.JobSucceeded, wantErr: errJobFinished, wantStatus: storage.JobSucceeded},
+		{name: "failed", status: storage.JobFailed, wantErr: errJobFinished, wantStatus: storage.JobFailed},
+		{name: "already cancelled", status: storage.JobCancelled, wantErr: errJobFinished, wantStatus: storage.JobCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newJobTestServer(t, 1)
+			job := &storage.Job{JobID: newInvocationID(), FunctionName: "hello", Status: tt.status}
+			if err := s.store.CreateJob(job); err != nil {
+				t.Fatalf("CreateJob failed: %v", err)
+			}
+			execution, stop := context.WithCancel(context.Background())
+			defer stop()
+			if tt.running {
+				s.runningJobs[job.JobID] = stop
+			}
+			changed := s.jobWaiters.watch()
+
+			cancelled, err := s.cancelJob(context.Background(), job.JobID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("cancelJob = %v, want %v", err, tt.wantErr)
+			}
+			if cancelled.Status != tt.wantStatus {
+				t.Errorf("returned job status = %s, want %s", cancelled.Status, tt.wantStatus)
+			}
+			stored, err := s.store.GetJob(context.Background(), job.JobID)
+			if err != nil {
+				t.Fatalf("GetJob failed: %v", err)
+			}
+			if stored.Status != tt.wantStatus {
+				t.Errorf("stored job status = %s, want %s", stored.Status, tt.wantStatus)
+			}
+
+			if tt.running {
+				if execution.Err() == nil {
+					t.Error("the running execution wasn't cancelled")
+				}
+				if _, ok := s.runningJobs[job.JobID]; ok {
+					t.Error("the job is still recorded as running")
+				}
+			}
+			select {
+			case <-changed:
+				if tt.wantErr != nil {
+					t.Error("waiters woken up though the job didn't change")
+				}
+			default:
+				if tt.wantErr == nil {
+					t.Error("waiters weren't woken up by the cancellation")
+				}
+			}
+		})
+	}
+}
+
+func TestCancelUnknownJob(t *testing.T) {
+	s := newJobTestServer(t, 1)
+	if _, err := s.cancelJob(context.Background(), "missing"); err == nil {
+		t.Error("cancelJob of an unknown job succeeded")
+	}
+}
+
+func TestJobLookupFailed(t *testing.T) {
+	tests := []struct {
+		name           string
+		queryTimeout   time.Duration
+		job            string
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{name: "found", queryTimeout: time.Second, job: "j1", wantStatus: http.StatusOK},
+		{name: "not found", queryTimeout: time.Second, job: "missing", wantStatus: http.StatusNotFound},
+		{name: "database too slow", queryTimeout: time.Nanosecond, job: "j1",
+			wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, method := range []string{http.MethodGet, http.MethodPost} {
+				s := newJobTestServer(t, 1)
+				s.config.DBQueryTimeout = tt.queryTimeout
+				if err := s.store.CreateJob(&storage.Job{JobID: "j1", FunctionName: "hello", Status: storage.JobPending}); err != nil {
+					t.Fatalf("CreateJob failed: %v", err)
+				}
+				path := "/jobs/" + tt.job
+				if method == http.MethodPost {
+					path += "/cancel"
+				}
+				w := httptest.NewRecorder()
+				s.handleJob(w, httptest.NewRequest(method, path, nil))
+				if w.Code != tt.wantStatus {
+					t.Fatalf("%s %s: status = %d, want %d: %s", method, path, w.Code, tt.wantStatus, w.Body)
+				}
+				if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+					t.Errorf("%s %s: Retry-After = %q, want %q", method, path, got, tt.wantRetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestRunCancelledJob(t *testing.T) {
+	s := newJobTestServer(t, 1)
+	job := &storage.Job{JobID: newInvocationID(), FunctionName: "hello", Status: storage.JobPending}
+	if err := s.store.CreateJob(job); err != nil {
+		t.Fatalf("CreateJob failed: %v", err)
+	}
+	if _, err := s.cancelJob(context.Background(), job.JobID); err != nil {
+		t.Fatalf("cancelJob failed: %v", err)
+	}
+
+	// A worker picking up the cancelled job drops it
+	s.runJob(context.Background(), job.JobID)
+	stored, err := s.store.GetJob(context.Background(), job.JobID)
+	if err != nil {
+		t.Fatalf("GetJob failed: %v", err)
+	}
+	if stored.Status != storage.JobCancelled || stored.Attempts != 0 {
+		t.Errorf("job = %s after %d attempts, want cancelled without any", stored.Status, stored.Attempts)
+	}
+}
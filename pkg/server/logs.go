@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+)
+
+// sseWriter turns the lines written to it into Server-Sent Events of the given
+// type, flushing each one to the client.
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	event   string
+	partial []byte // Incomplete last line
+}
+
+// Write emits an event for every complete line in p.
+func (s *sseWriter) Write(p []byte) (int, error) {
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		if err := s.emit(s.partial[:i]); err != nil {
+			return 0, err
+		}
+		s.partial = s.partial[i+1:]
+	}
+}
+
+// Flush emits the incomplete last line, if any.
+func (s *sseWriter) Flush() error {
+	if len(s.partial) == 0 {
+		return nil
+	}
+	err := s.emit(s.partial)
+	s.partial = nil
+	return err
+}
+
+// emit writes a single event.
+func (s *sseWriter) emit(line []byte) error {
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", s.event, bytes.TrimSuffix(line, []byte("\r"))); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// handleLogStream streams the output of a function's running invocation as
+// Server-Sent Events (GET /functions/{name}/logs/stream). Lines are sent as
+// "stdout" or "stderr" events, followed by an "end" event once the invocation
+// exits, or right away when no invocation is running.
+func (s *Server) handleLogStream(w http.ResponseWriter, r *http.Request, functionName string) {
+	if r.Method != http.MethodGet {
+		s.log.WithField("method", r.Method).Warn("Invalid method for log stream")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := s.lookupFunction(r, functionName); err != nil {
+		s.lookupFailed(w, functionName, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The stream lasts as long as the invocation, beyond the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		s.log.WithError(err).Warn("Failed to clear write deadline")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stdout := &sseWriter{w: w, flusher: flusher, event: "stdout"}
+	stderr := &sseWriter{w: w, flusher: flusher, event: "stderr"}
+
+	err := s.orchestrator.FollowLogs(r.Context(), functionName, stdout, stderr)
+	stdout.Flush()
+	stderr.Flush()
+
+	if errors.Is(err, orchestrator.ErrNoRunningContainer) {
+		fmt.Fprintf(w, "event: end\ndata: no running invocation\n\n")
+		return
+	}
+	if err != nil {
+		s.log.WithError(err).WithField("function", functionName).Warn("Failed to stream logs")
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+		return
+	}
+	fmt.Fprintf(w, "event: end\ndata: invocation finished\n\n")
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestLogStream(t *testing.T) {
+	tests := []struct {
+		name       string
+		function   string
+		running    bool // Whether an invocation is running
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "running invocation",
+			function:   "hello",
+			running:    true,
+			wantStatus: http.StatusOK,
+			wantBody: "event: stdout\ndata: starting\n\n" +
+				"event: stderr\ndata: warning: slow\n\n" +
+				"event: stdout\ndata: done\n\n" +
+				"event: end\ndata: invocation finished\n\n",
+		},
+		{
+			name:       "no running invocation",
+			function:   "hello",
+			wantStatus: http.StatusOK,
+			wantBody:   "event: end\ndata: no running invocation\n\n",
+		},
+		{name: "unknown function", function: "missing", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, nil)
+			if tt.running {
+				engine.listed = []map[string]any{
+					{"Id": "older", "Created": 100, "State": "running"},
+					{"Id": "newer", "Created": 200, "State": "running"},
+				}
+			}
+			engine.logs = func(id string, stdout, stderr io.Writer) {
+				if id != "newer" {
+					fmt.Fprintln(stdout, "logs of", id)
+					return
+				}
+				fmt.Fprint(stdout, "starting\n")
+				fmt.Fprint(stderr, "warning: slow\n")
+				// The last line isn't terminated
+				fmt.Fprint(stdout, "done")
+			}
+			s := newTestServer(t, engine)
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+
+			w := httptest.NewRecorder()
+			s.handleFunction(w, httptest.NewRequest(http.MethodGet, "/functions/"+tt.function+"/logs/stream", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+				t.Errorf("Content-Type = %q, want text/event-stream", got)
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("events = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// middleware wraps a handler with a cross-cutting concern, such as logging or
+// authentication.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps a handler with the middlewares. The first middleware is the
+// outermost, so requests pass through them in the order given.
+func chain(handler http.Handler, middlewares ...middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// middlewares returns the cross-cutting concerns wrapping all routes,
+// outermost first.
+func (s *Server) middlewares() []middleware {
+	return []middleware{
+		requestID,
+		except(s.requestLogger, "/healthz"),
+		s.recoverPanics,
+	}
+}
+
+// except applies a middleware to all requests but those for the given paths,
+// e.g. to keep health checks out of authentication.
+func except(m middleware, paths ...string) middleware {
+	skip := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		skip[path] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		wrapped := m(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skip[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			wrapped.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestIDHeader carries the ID of a request, taken from the client when it
+// sends one, so the request can be correlated with the server logs.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// requestID assigns every request an ID, echoed in the response.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newInvocationID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDFrom returns the ID of a request, empty outside of requestID.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger logs every request with its status and duration.
+func (s *Server) requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		s.log.WithFields(logrus.Fields{
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     recorder.status,
+			"duration":   time.Since(start),
+			"request_id": requestIDFrom(r.Context()),
+		}).Debug("Request handled")
+	})
+}
+
+// recoverPanics turns a panicking handler into a 500 response, instead of
+// dropping the connection, and logs the panic with its stack.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Handlers abort responses on purpose with this one
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			requestID := requestIDFrom(r.Context())
+			s.log.WithFields(logrus.Fields{
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"request_id": requestID,
+				"panic":      fmt.Sprint(recovered),
+				"stack":      string(debug.Stack()),
+			}).Error("Handler panicked")
+
+			// A response that already started can't be replaced
+			if recorder.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			s.writeJSON(recorder, http.StatusInternalServerError, map[string]string{
+				"error":      "Internal server error",
+				"request_id": requestID,
+			})
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// statusRecorder captures the status code written by a handler. It passes
+// flushing and hijacking through, so event streams and WebSockets keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader records the status before writing it.
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.wroteHeader = true
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records that the response started, with an implicit 200 status.
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(p)
+}
+
+// Flush sends buffered data to the client.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the caller take over the connection.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer doesn't support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	r.wroteHeader = true
+	return hijacker.Hijack()
+}
+
+// Unwrap exposes the original writer to http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
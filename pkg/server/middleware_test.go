@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// tracer records the order requests pass through middlewares and handlers.
+type tracer struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+// record appends a step to the trace.
+func (tr *tracer) record(step string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.steps = append(tr.steps, step)
+}
+
+// middleware returns a middleware recording when requests enter and leave it.
+func (tr *tracer) middleware(name string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tr.record(name + " in")
+			next.ServeHTTP(w, r)
+			tr.record(name + " out")
+		})
+	}
+}
+
+// handler returns a handler recording that it ran.
+func (tr *tracer) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr.record("handler")
+	})
+}
+
+func TestChain(t *testing.T) {
+	tests := []struct {
+		name        string
+		middlewares []string
+		skipped     []string // Paths the "b" middleware is skipped for
+		path        string
+		want        []string
+	}{
+		{name: "none", path: "/invoke/hello", want: []string{"handler"}},
+		{name: "one", middlewares: []string{"a"}, path: "/invoke/hello", want: []string{"a in", "handler", "a out"}},
+		{
+			name:        "in order",
+			middlewares: []string{"a", "b", "c"},
+			path:        "/invoke/hello",
+			want:        []string{"a in", "b in", "c in", "handler", "c out", "b out", "a out"},
+		},
+		{
+			name:        "skipped path",
+			middlewares: []string{"a", "b", "c"},
+			skipped:     []string{"/healthz"},
+			path:        "/healthz",
+			want:        []string{"a in", "c in", "handler", "c out", "a out"},
+		},
+		{
+			name:        "other path",
+			middlewares: []string{"a", "b", "c"},
+			skipped:     []string{"/healthz"},
+			path:        "/invoke/hello",
+			want:        []string{"a in", "b in", "c in", "handler", "c out", "b out", "a out"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &tracer{}
+			var middlewares []middleware
+			for _, name := range tt.middlewares {
+				m := tr.middleware(name)
+				if name == "b" && tt.skipped != nil {
+					m = except(m, tt.skipped...)
+				}
+				middlewares = append(middlewares, m)
+			}
+
+			server := httptest.NewServer(chain(tr.handler(), middlewares...))
+			defer server.Close()
+			resp, err := http.Get(server.URL + tt.path)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if !reflect.DeepEqual(tr.steps, tt.want) {
+				t.Errorf("steps = %q, want %q", tr.steps, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		requestID  string // Sent by the client
+		status     int
+		panics     bool
+		wantStatus int
+		wantLogged bool
+	}{
+		{name: "logged", path: "/invoke/hello", status: http.StatusOK, wantStatus: http.StatusOK, wantLogged: true},
+		{name: "error status", path: "/functions/missing", status: http.StatusNotFound, wantStatus: http.StatusNotFound, wantLogged: true},
+		{name: "client request ID", path: "/invoke/hello", requestID: "abc-123", status: http.StatusOK, wantStatus: http.StatusOK, wantLogged: true},
+		{name: "panic", path: "/invoke/hello", panics: true, wantStatus: http.StatusInternalServerError, wantLogged: true},
+		{name: "health check", path: "/healthz", status: http.StatusOK, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log, hook := test.NewNullLogger()
+			log.SetLevel(logrus.DebugLevel)
+			s := &Server{log: log}
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.panics {
+					panic("boom")
+				}
+				w.WriteHeader(tt.status)
+			})
+			server := httptest.NewServer(chain(handler, s.middlewares()...))
+			defer server.Close()
+			req, _ := http.NewRequest(http.MethodGet, server.URL+tt.path, nil)
+			if tt.requestID != "" {
+				req.Header.Set(requestIDHeader, tt.requestID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			id := resp.Header.Get(requestIDHeader)
+			if id == "" || (tt.requestID != "" && id != tt.requestID) {
+				t.Errorf("request ID %q, want %q or a generated one", id, tt.requestID)
+			}
+
+			// The request log is written last, as the outer middleware
+			entries := hook.AllEntries()
+			if !tt.wantLogged {
+				if len(entries) != 0 {
+					t.Errorf("logged %d entries, want none", len(entries))
+				}
+				return
+			}
+			if len(entries) == 0 {
+				t.Fatal("logged nothing, want the request")
+			}
+			logged := entries[len(entries)-1]
+			if got := logged.Data["path"]; got != tt.path {
+				t.Errorf("logged path %v, want %s", got, tt.path)
+			}
+			if got := logged.Data["status"]; got != tt.wantStatus {
+				t.Errorf("logged status %v, want %d", got, tt.wantStatus)
+			}
+			if got := logged.Data["request_id"]; got != id {
+				t.Errorf("logged request ID %v, want %q", got, id)
+			}
+			if tt.panics && (len(entries) != 2 || entries[0].Level != logrus.ErrorLevel || entries[0].Data["request_id"] != id) {
+				t.Errorf("logged %d entries, want the panic with its request ID before the request", len(entries))
+			}
+		})
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		wantError bool // Whether a JSON error response is written
+	}{
+		{
+			name:      "panic",
+			handler:   func(w http.ResponseWriter, r *http.Request) { panic("boom") },
+			wantError: true,
+		},
+		{
+			name:      "error value",
+			handler:   func(w http.ResponseWriter, r *http.Request) { panic(fmt.Errorf("boom")) },
+			wantError: true,
+		},
+		{
+			name: "response started",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+				panic("boom")
+			},
+		},
+		{
+			name:    "no panic",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log, hook := test.NewNullLogger()
+			s := &Server{log: log}
+
+			// The server logs aborted handlers, keep that out of the test output
+			server := httptest.NewUnstartedServer(chain(tt.handler, requestID, s.recoverPanics))
+			server.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+			server.Start()
+			defer server.Close()
+			resp, err := http.Get(server.URL + "/invoke/hello")
+			if err != nil {
+				if tt.wantError {
+					t.Fatalf("request failed: %v", err)
+				}
+				// An aborted response may drop the connection instead
+				return
+			}
+			defer resp.Body.Close()
+
+			if !tt.wantError {
+				if resp.StatusCode == http.StatusInternalServerError {
+					t.Errorf("status = %d, want the handler's", resp.StatusCode)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+			}
+			var body map[string]string
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatalf("invalid error response: %v", err)
+			}
+			if body["error"] == "" || body["request_id"] != resp.Header.Get(requestIDHeader) {
+				t.Errorf("response = %v, want an error with the request ID", body)
+			}
+			if strings.Contains(body["error"], "boom") {
+				t.Errorf("response %q leaks the panic", body["error"])
+			}
+			entries := hook.AllEntries()
+			if len(entries) != 1 || entries[0].Data["panic"] != "boom" || entries[0].Data["stack"] == "" {
+				t.Errorf("logged %d entries, want the panic with its stack", len(entries))
+			}
+		})
+	}
+}
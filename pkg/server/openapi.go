@@ -0,0 +1,25 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes the API for generating clients. It's maintained by
+// hand, so changes to the endpoints it covers must be made to it as well.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// handleOpenAPI returns the OpenAPI document of the API (GET /openapi.json).
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.log.WithField("method", r.Method).Warn("Invalid method for openapi")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
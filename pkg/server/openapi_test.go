@@ -0,0 +1,83 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// openAPIDocument is the part of an OpenAPI document the tests check.
+type openAPIDocument struct {
+	OpenAPI string `json:"openapi"`
+	Info    struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	} `json:"info"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components map[string]map[string]json.RawMessage `json:"components"`
+}
+
+// openAPIRef matches a reference to a component of the document.
+var openAPIRef = regexp.MustCompile(`"\$ref":\s*"#/components/([^/"]+)/([^"]+)"`)
+
+func TestOpenAPI(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, nil))
+	w := httptest.NewRecorder()
+	s.handleOpenAPI(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+
+	var doc openAPIDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("the document isn't JSON: %v", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") || doc.Info.Title == "" || doc.Info.Version == "" {
+		t.Errorf("openapi %q, info %+v, want an OpenAPI 3 document with a title and version", doc.OpenAPI, doc.Info)
+	}
+
+	// The endpoints clients are generated for
+	routes := map[string][]string{
+		"/functions":        {"get", "post"},
+		"/functions/{name}": {"get", "delete"},
+		"/invoke/{name}":    {"post"},
+		"/jobs/{id}":        {"get"},
+	}
+	for path, methods := range routes {
+		for _, method := range methods {
+			operation, ok := doc.Paths[path][method]
+			if !ok {
+				t.Errorf("%s %s isn't described", strings.ToUpper(method), path)
+				continue
+			}
+			var op struct {
+				OperationID string                     `json:"operationId"`
+				Responses   map[string]json.RawMessage `json:"responses"`
+			}
+			if err := json.Unmarshal(operation, &op); err != nil || op.OperationID == "" || len(op.Responses) == 0 {
+				t.Errorf("%s %s has no operationId or responses: %s", strings.ToUpper(method), path, operation)
+			}
+		}
+	}
+
+	for _, ref := range openAPIRef.FindAllStringSubmatch(w.Body.String(), -1) {
+		if _, ok := doc.Components[ref[1]][ref[2]]; !ok {
+			t.Errorf("reference to undefined component %s/%s", ref[1], ref[2])
+		}
+	}
+}
+
+func TestOpenAPIMethod(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, nil))
+	w := httptest.NewRecorder()
+	s.handleOpenAPI(w, httptest.NewRequest(http.MethodPost, "/openapi.json", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// newFunctionMetadata describes a deployed function as its deploy metadata,
+// the inverse of functionMetadata.function.
+func newFunctionMetadata(function *storage.Function) functionMetadata {
+	return functionMetadata{
+		Name:           function.Name,
+		Image:          function.Image,
+		Digest:         function.Digest,
+		Platforms:      function.Platforms,
+		Runtime:        function.Runtime,
+		User:           function.User,
+		WorkingDir:     function.WorkingDir,
+		StopSignal:     function.StopSignal,
+		Entrypoint:     function.Entrypoint,
+		Args:           function.Args,
+		Env:            function.Env,
+		Labels:         function.Labels,
+		MemoryBytes:    function.MemoryBytes,
+		NanoCPUs:       function.NanoCPUs,
+		DNS:            function.DNS,
+		ExtraHosts:     function.ExtraHosts,
+		MaxOutputBytes: function.MaxOutputBytes,
+		MaxConcurrency: function.MaxConcurrency,
+		EventSchema:    rawJSON(function.EventSchema),
+		DefaultEvent:   rawJSON(function.DefaultEvent),
+		MaxRetries:     function.MaxRetries,
+		RetryBackoffMs: function.RetryBackoffMs,
+		DedupWindowMs:  function.DedupWindowMs,
+		CacheTTLMs:     function.CacheTTLMs,
+		TimeoutMs:      function.TimeoutMs,
+		ExitStatuses:   function.ExitStatuses,
+		ContentType:    function.ContentType,
+		EventFormat:    function.EventFormat,
+		ResponseFormat: function.ResponseFormat,
+		LogDestination: function.LogDestination,
+		LogPayloads:    function.LogPayloads,
+		RedactPaths:    function.RedactPaths,
+		ReadonlyRootfs: &function.ReadonlyRootfs,
+		WritableTmp:    &function.WritableTmp,
+		AlwaysPull:     function.AlwaysPull,
+		Snapshot:       function.Snapshot,
+		RunOnce:        function.RunOnce,
+	}
+}
+
+// rawJSON returns a JSON document stored as a string, or null when it's empty.
+func rawJSON(document string) json.RawMessage {
+	if document == "" {
+		return nil
+	}
+	return json.RawMessage(document)
+}
+
+// functionColumns returns the values of the columns of a function that can be
+// patched, keyed by the column name, which is also the field's name in the
+// deploy metadata.
+func functionColumns(function *storage.Function) map[string]any {
+	return map[string]any{
+		"image":            function.Image,
+		"digest":           function.Digest,
+		"platforms":        function.Platforms,
+		"runtime":          function.Runtime,
+		"user":             function.User,
+		"working_dir":      function.WorkingDir,
+		"stop_signal":      function.StopSignal,
+		"entrypoint":       function.Entrypoint,
+		"args":             function.Args,
+		"env":              function.Env,
+		"labels":           function.Labels,
+		"memory_bytes":     function.MemoryBytes,
+		"nano_cpus":        function.NanoCPUs,
+		"dns":              function.DNS,
+		"extra_hosts":      function.ExtraHosts,
+		"max_output_bytes": function.MaxOutputBytes,
+		"max_concurrency":  function.MaxConcurrency,
+		"event_schema":     function.EventSchema,
+		"default_event":    function.DefaultEvent,
+		"max_retries":      function.MaxRetries,
+		"retry_backoff_ms": function.RetryBackoffMs,
+		"dedup_window_ms":  function.DedupWindowMs,
+		"cache_ttl_ms":     function.CacheTTLMs,
+		"timeout_ms":       function.TimeoutMs,
+		"exit_statuses":    function.ExitStatuses,
+		"content_type":     function.ContentType,
+		"event_format":     function.EventFormat,
+		"response_format":  function.ResponseFormat,
+		"log_destination":  function.LogDestination,
+		"log_payloads":     function.LogPayloads,
+		"redact_paths":     function.RedactPaths,
+		"readonly_rootfs":  function.ReadonlyRootfs,
+		"writable_tmp":     function.WritableTmp,
+		"always_pull":      function.AlwaysPull,
+		"snapshot":         function.Snapshot,
+		"run_once":         function.RunOnce,
+	}
+}
+
+// handlePatch updates some fields of a function, leaving the others intact
+// (PATCH /functions/{name}). The body is a JSON object with the fields of the
+// deploy metadata to change, e.g. {"memory_bytes": 268435456}.
+func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request, functionName string) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxPayloadBytes)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.log.WithError(err).Warn("Failed to read patch request body")
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		s.log.WithError(err).Warn("Invalid patch request body")
+		http.Error(w, "Invalid request body, expected a JSON object", http.StatusBadRequest)
+		return
+	}
+
+	function, err := s.lookupFunction(r, functionName)
+	if err != nil {
+		s.lookupFailed(w, functionName, err)
+		return
+	}
+
+	// Unknown fields are rejected, so a typo doesn't silently do nothing
+	columns := functionColumns(function)
+	for field := range fields {
+		if _, ok := columns[field]; !ok {
+			s.log.WithField("field", field).Warn("Unknown field in patch")
+			http.Error(w, fmt.Sprintf("Unknown field %q", field), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Apply the fields over the current metadata, and validate the result as
+	// a whole, as some fields depend on others. Given maps replace the current
+	// ones, rather than being merged into them.
+	metadata := newFunctionMetadata(function)
+	for field := range fields {
+		switch field {
+		case "env":
+			metadata.Env = nil
+		case "labels":
+			metadata.Labels = nil
+		case "exit_statuses":
+			metadata.ExitStatuses = nil
+		}
+	}
+	if err := json.Unmarshal(body, &metadata); err != nil {
+		s.log.WithError(err).WithField("function", functionName).Warn("Invalid patch field")
+		http.Error(w, fmt.Sprintf("Invalid field value: %v", err), http.StatusBadRequest)
+		return
+	}
+	patched, err := metadata.function()
+	if err == nil {
+		err = s.checkTimeout(patched)
+	}
+	if err == nil {
+		err = s.checkLogDestination(patched)
+	}
+	if err != nil {
+		s.log.WithError(err).WithField("function", functionName).Warn("Invalid function metadata")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.beforeDeploy(r.Context(), patched); err != nil {
+		s.log.WithError(err).WithField("function", functionName).Warn("Update rejected by hook")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Only the given columns are written
+	values := functionColumns(patched)
+	updates := make(map[string]any, len(fields))
+	for field := range fields {
+		updates[field] = values[field]
+	}
+	if err := s.store.PatchFunction(functionName, updates); err != nil {
+		if errors.Is(err, storage.ErrFunctionNotFound) {
+			s.lookupFailed(w, functionName, err)
+			return
+		}
+		s.log.WithError(err).WithField("function", functionName).Error("Failed to patch function")
+		http.Error(w, "Failed to patch function", http.StatusInternalServerError)
+		return
+	}
+
+	s.cache.invalidate(functionName)
+	s.warmSchema(patched)
+
+	changed := make([]string, 0, len(fields))
+	for field := range fields {
+		changed = append(changed, field)
+	}
+	sort.Strings(changed)
+	s.log.WithField("function", functionName).WithField("fields", changed).Info("Function updated")
+	s.recordAudit(requestActor(r), storage.AuditUpdate, functionName, strings.Join(changed, ","))
+	s.afterDeploy(r.Context(), patched)
+	s.handleDescribe(w, r, functionName)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestPatchFunction(t *testing.T) {
+	deployed := storage.Function{
+		Name:         "hello",
+		Image:        "serverless-hello:latest",
+		Runtime:      "go",
+		User:         "1000:1000",
+		Env:          map[string]string{"GREETING": "hi", "DEBUG": "0"},
+		Labels:       map[string]string{"team": "web"},
+		MemoryBytes:  128 << 20,
+		MaxRetries:   2,
+		ExitStatuses: map[string]int{"2": http.StatusBadRequest},
+		WritableTmp:  true,
+	}
+	tests := []struct {
+		name       string
+		function   string
+		body       string
+		wantStatus int
+		want       func(function *storage.Function) // Changes the patch makes to the deployed function
+	}{
+		{
+			name:       "one field",
+			function:   "hello",
+			body:       `{"memory_bytes":268435456}`,
+			wantStatus: http.StatusOK,
+			want:       func(f *storage.Function) { f.MemoryBytes = 256 << 20 },
+		},
+		{
+			name:       "several fields",
+			function:   "hello",
+			body:       `{"user":"app","max_retries":0,"readonly_rootfs":true}`,
+			wantStatus: http.StatusOK,
+			want:       func(f *storage.Function) { f.User, f.MaxRetries, f.ReadonlyRootfs = "app", 0, true },
+		},
+		{
+			name:       "map replaced",
+			function:   "hello",
+			body:       `{"env":{"DEBUG":"1"}}`,
+			wantStatus: http.StatusOK,
+			want:       func(f *storage.Function) { f.Env = map[string]string{"DEBUG": "1"} },
+		},
+		{
+			name:       "stop signal",
+			function:   "hello",
+			body:       `{"stop_signal":"SIGINT"}`,
+			wantStatus: http.StatusOK,
+			want:       func(f *storage.Function) { f.StopSignal = "SIGINT" },
+		},
+		{
+			name:       "event schema",
+			function:   "hello",
+			body:       `{"event_schema":{"type":"object"}}`,
+			wantStatus: http.StatusOK,
+			want:       func(f *storage.Function) { f.EventSchema = `{"type":"object"}` },
+		},
+		{name: "no fields", function: "hello", body: `{}`, wantStatus: http.StatusOK, want: func(f *storage.Function) {}},
+		{name: "unknown field", function: "hello", body: `{"timeout":60}`, wantStatus: http.StatusBadRequest},
+		{name: "name not patchable", function: "hello", body: `{"name":"other"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid value", function: "hello", body: `{"memory_bytes":"lots"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid metadata", function: "hello", body: `{"user":"root:"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid stop signal", function: "hello", body: `{"stop_signal":"SIGKILL"}`, wantStatus: http.StatusBadRequest},
+		{name: "not an object", function: "hello", body: `[1]`, wantStatus: http.StatusBadRequest},
+		{name: "missing function", function: "missing", body: `{"user":"app"}`, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			function := deployed
+			storeFunction(t, s, &function)
+
+			w := httptest.NewRecorder()
+			s.handleFunction(w, httptest.NewRequest(http.MethodPatch, "/functions/"+tt.function, strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			// Rejected patches leave the function as deployed
+			want := deployed
+			if tt.want != nil {
+				tt.want(&want)
+			}
+			got, err := s.store.GetFunction(context.Background(), "hello")
+			if err != nil {
+				t.Fatalf("GetFunction failed: %v", err)
+			}
+			want.ID, want.CreatedAt, want.UpdatedAt = got.ID, got.CreatedAt, got.UpdatedAt
+			if !reflect.DeepEqual(*got, want) {
+				t.Errorf("function = %+v, want %+v", *got, want)
+			}
+			// A patched schema is compiled ahead of the invocations
+			if cached, ok := s.schemas.schemas["hello"]; got.EventSchema != "" && (!ok || cached.source != got.EventSchema) {
+				t.Errorf("cached schema = %q, want the patched %q", cached.source, got.EventSchema)
+			}
+		})
+	}
+}
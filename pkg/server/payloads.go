@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// redactedValue replaces the values at the redacted paths of logged payloads.
+const redactedValue = "[REDACTED]"
+
+// maxLoggedPayload is the most bytes of an event or output that are logged,
+// longer ones are cut.
+const maxLoggedPayload = 4 << 10
+
+// validateRedactPaths checks the paths of a function's payloads to redact:
+// keys separated by dots, where * matches any key or array element and a
+// number an array element, e.g. user.email or cards.*.number.
+func validateRedactPaths(paths []string) error {
+	for _, path := range paths {
+		for _, segment := range strings.Split(path, ".") {
+			if segment == "" {
+				return fmt.Errorf("invalid redact path %q, expected keys separated by dots (e.g. user.email)", path)
+			}
+		}
+	}
+	return nil
+}
+
+// logPayloads logs the event and output of an execution, for functions that
+// ask for it, with their redact paths masked. The output of a function that
+// failed is logged when it exited with an error.
+func (s *Server) logPayloads(invocationID string, function *storage.Function, event []byte, result *orchestrator.Result, err error) {
+	fields := logrus.Fields{
+		"function":   function.Name,
+		"invocation": invocationID,
+		"event":      redactPayload(event, function.RedactPaths),
+	}
+	var exitErr *orchestrator.ExitError
+	switch {
+	case result != nil:
+		fields["output"] = redactPayload(result.Output, function.RedactPaths)
+	case errors.As(err, &exitErr):
+		fields["output"] = redactPayload(exitErr.Output, function.RedactPaths)
+	}
+	s.log.WithFields(fields).Info("Function payloads")
+}
+
+// redactPayload returns a payload as it's logged: with the values at the
+// paths replaced by redactedValue, and cut to maxLoggedPayload. The payload
+// itself is left untouched. A payload that isn't JSON can't be redacted, so
+// only its size is logged when there are paths to redact.
+func redactPayload(payload []byte, paths []string) string {
+	if len(paths) == 0 {
+		return truncatePayload(payload)
+	}
+	var document any
+	if err := decodeJSON(payload, &document); err != nil {
+		return fmt.Sprintf("<%d bytes, not JSON>", len(payload))
+	}
+	for _, path := range paths {
+		document = redactPath(document, strings.Split(path, "."))
+	}
+	redacted, err := json.Marshal(document)
+	if err != nil {
+		return fmt.Sprintf("<%d bytes, failed to redact>", len(payload))
+	}
+	return truncatePayload(redacted)
+}
+
+// redactPath replaces the values at a path within a decoded JSON value.
+// Paths that don't exist in the value are ignored.
+func redactPath(value any, segments []string) any {
+	if len(segments) == 0 {
+		return redactedValue
+	}
+	key, rest := segments[0], segments[1:]
+	switch v := value.(type) {
+	case map[string]any:
+		if key == "*" {
+			for k, child := range v {
+				v[k] = redactPath(child, rest)
+			}
+		} else if child, ok := v[key]; ok {
+			v[key] = redactPath(child, rest)
+		}
+	case []any:
+		if key == "*" {
+			for i, child := range v {
+				v[i] = redactPath(child, rest)
+			}
+		} else if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(v) {
+			v[i] = redactPath(v[i], rest)
+		}
+	}
+	return value
+}
+
+// truncatePayload cuts a payload to maxLoggedPayload.
+func truncatePayload(payload []byte) string {
+	if len(payload) <= maxLoggedPayload {
+		return string(payload)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", payload[:maxLoggedPayload], len(payload))
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestValidateRedactPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		paths   []string
+		wantErr bool
+	}{
+		{name: "none", paths: nil},
+		{name: "key", paths: []string{"password"}},
+		{name: "nested keys", paths: []string{"user.email", "cards.*.number", "items.0"}},
+		{name: "empty path", paths: []string{""}, wantErr: true},
+		{name: "leading dot", paths: []string{".email"}, wantErr: true},
+		{name: "trailing dot", paths: []string{"user."}, wantErr: true},
+		{name: "double dot", paths: []string{"user..email"}, wantErr: true},
+		{name: "one invalid among valid", paths: []string{"user.email", "a..b"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRedactPaths(tt.paths)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateRedactPaths(%q) = %v, want error %v", tt.paths, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedactPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		paths   []string
+		want    string
+	}{
+		{
+			name:    "no paths",
+			payload: `{"password":"hunter2"}`,
+			want:    `{"password":"hunter2"}`,
+		},
+		{
+			name:    "no paths, not JSON",
+			payload: `plain text`,
+			want:    `plain text`,
+		},
+		{
+			name:    "top-level key",
+			payload: `{"password":"hunter2","user":"bob"}`,
+			paths:   []string{"password"},
+			want:    `{"password":"[REDACTED]","user":"bob"}`,
+		},
+		{
+			name:    "nested key",
+			payload: `{"user":{"email":"bob@example.com","name":"bob"}}`,
+			paths:   []string{"user.email"},
+			want:    `{"user":{"email":"[REDACTED]","name":"bob"}}`,
+		},
+		{
+			name:    "object value",
+			payload: `{"user":{"email":"bob@example.com"},"id":1}`,
+			paths:   []string{"user"},
+			want:    `{"id":1,"user":"[REDACTED]"}`,
+		},
+		{
+			name:    "wildcard over array",
+			payload: `{"cards":[{"number":"4111"},{"number":"5500","brand":"mc"}]}`,
+			paths:   []string{"cards.*.number"},
+			want:    `{"cards":[{"number":"[REDACTED]"},{"brand":"mc","number":"[REDACTED]"}]}`,
+		},
+		{
+			name:    "wildcard over object",
+			payload: `{"tokens":{"a":"x","b":"y"}}`,
+			paths:   []string{"tokens.*"},
+			want:    `{"tokens":{"a":"[REDACTED]","b":"[REDACTED]"}}`,
+		},
+		{
+			name:    "array index",
+			payload: `{"items":["a","b","c"]}`,
+			paths:   []string{"items.1"},
+			want:    `{"items":["a","[REDACTED]","c"]}`,
+		},
+		{
+			name:    "array index out of range",
+			payload: `{"items":["a"]}`,
+			paths:   []string{"items.5", "items.-1"},
+			want:    `{"items":["a"]}`,
+		},
+		{
+			name:    "missing path",
+			payload: `{"user":{"name":"bob"}}`,
+			paths:   []string{"user.email", "account.id"},
+			want:    `{"user":{"name":"bob"}}`,
+		},
+		{
+			name:    "path through a scalar",
+			payload: `{"user":"bob"}`,
+			paths:   []string{"user.email"},
+			want:    `{"user":"bob"}`,
+		},
+		{
+			name:    "several paths",
+			payload: `{"a":1,"b":2,"c":3}`,
+			paths:   []string{"a", "c"},
+			want:    `{"a":"[REDACTED]","b":2,"c":"[REDACTED]"}`,
+		},
+		{
+			name:    "large numbers kept",
+			payload: `{"id":12345678901234567890,"secret":"x"}`,
+			paths:   []string{"secret"},
+			want:    `{"id":12345678901234567890,"secret":"[REDACTED]"}`,
+		},
+		{
+			name:    "not JSON",
+			payload: `password=hunter2`,
+			paths:   []string{"password"},
+			want:    `<16 bytes, not JSON>`,
+		},
+		{
+			name:    "empty payload",
+			payload: ``,
+			paths:   []string{"password"},
+			want:    `<0 bytes, not JSON>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := []byte(tt.payload)
+			if got := redactPayload(payload, tt.paths); got != tt.want {
+				t.Errorf("redactPayload(%s, %q) = %s, want %s", tt.payload, tt.paths, got, tt.want)
+			}
+			if string(payload) != tt.payload {
+				t.Errorf("redactPayload changed the payload to %s", payload)
+			}
+		})
+	}
+}
+
+func TestTruncatePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantCut bool
+	}{
+		{name: "empty", size: 0},
+		{name: "short", size: 10},
+		{name: "at the limit", size: maxLoggedPayload},
+		{name: "over the limit", size: maxLoggedPayload + 1, wantCut: true},
+		{name: "far over the limit", size: 10 * maxLoggedPayload, wantCut: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := strings.Repeat("x", tt.size)
+			got := truncatePayload([]byte(payload))
+			if !tt.wantCut {
+				if got != payload {
+					t.Errorf("truncatePayload cut a %d byte payload", tt.size)
+				}
+				return
+			}
+			want := payload[:maxLoggedPayload] + "... (" + strconv.Itoa(tt.size) + " bytes)"
+			if got != want {
+				t.Errorf("truncatePayload of %d bytes = %.20s...%s", tt.size, got, got[len(got)-20:])
+			}
+		})
+	}
+}
+
+func TestInvokeLogPayloads(t *testing.T) {
+	const event = `{"user":{"email":"bob@example.com","name":"bob"}}`
+	tests := []struct {
+		name       string
+		logs       bool
+		paths      []string
+		wantLogged map[string]string // Logged fields, nil when nothing is logged
+	}{
+		{
+			name:  "redacted",
+			logs:  true,
+			paths: []string{"user.email", "token"},
+			wantLogged: map[string]string{
+				"event":  `{"user":{"email":"[REDACTED]","name":"bob"}}`,
+				"output": `{"token":"[REDACTED]","user":"bob"}`,
+			},
+		},
+		{
+			name:       "nothing to redact",
+			logs:       true,
+			wantLogged: map[string]string{"event": event, "output": `{"token":"t0k3n","user":"bob"}`},
+		},
+		{name: "not logged", paths: []string{"user.email"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				received = string(event)
+				return []byte(`{"token":"t0k3n","user":"bob"}`), 0
+			}))
+			hook := logtest.NewLocal(s.log)
+			storeFunction(t, s, &storage.Function{
+				Name: "hello", Image: "hello:latest", Runtime: "go",
+				LogPayloads: tt.logs, RedactPaths: tt.paths,
+			})
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(event)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			// Only the logs are redacted
+			if received != event {
+				t.Errorf("function got %q, want the event as sent", received)
+			}
+			if w.Body.String() != `{"token":"t0k3n","user":"bob"}` {
+				t.Errorf("body = %q, want the output as written", w.Body)
+			}
+
+			var logged *logrus.Entry
+			for _, entry := range hook.AllEntries() {
+				if entry.Message == "Function payloads" {
+					logged = entry
+				}
+			}
+			if tt.wantLogged == nil {
+				if logged != nil {
+					t.Errorf("payloads logged: %v", logged.Data)
+				}
+				return
+			}
+			if logged == nil {
+				t.Fatal("payloads not logged")
+			}
+			for key, want := range tt.wantLogged {
+				if got := logged.Data[key]; got != want {
+					t.Errorf("logged %s = %v, want %s", key, got, want)
+				}
+			}
+		})
+	}
+}
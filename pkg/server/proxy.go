@@ -0,0 +1,46 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// proxyHeader opts an invocation into proxy mode, where the function's output is
+// an envelope describing the HTTP response rather than the response body itself.
+const proxyHeader = "X-Serverless-Proxy"
+
+// proxyResponse is the envelope a function returns in proxy mode
+// (in the style of AWS Lambda proxy integrations).
+type proxyResponse struct {
+	StatusCode int               `json:"statusCode"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+}
+
+// parseProxyResponse decodes and validates a function's proxy envelope.
+// A missing status code defaults to 200. The error describes what's wrong
+// with the envelope, the caller reports it as an invalid proxy response.
+func parseProxyResponse(output []byte) (*proxyResponse, error) {
+	var resp proxyResponse
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	if resp.StatusCode < 100 || resp.StatusCode > 599 {
+		return nil, fmt.Errorf("status code %d out of range", resp.StatusCode)
+	}
+	return &resp, nil
+}
+
+// writeProxyResponse writes the response described by the envelope.
+func writeProxyResponse(w http.ResponseWriter, resp *proxyResponse) error {
+	for name, value := range resp.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err := w.Write([]byte(resp.Body))
+	return err
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestProxyResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      string
+		proxy       bool // Whether the invocation is in proxy mode
+		wantStatus  int
+		wantHeaders map[string]string
+		wantBody    string
+	}{
+		{
+			name:        "not found",
+			output:      `{"statusCode":404,"headers":{"Content-Type":"text/plain","X-Reason":"gone"},"body":"no such user"}`,
+			proxy:       true,
+			wantStatus:  http.StatusNotFound,
+			wantHeaders: map[string]string{"Content-Type": "text/plain", "X-Reason": "gone"},
+			wantBody:    "no such user",
+		},
+		{
+			name:       "status defaults to 200",
+			output:     `{"body":"hi"}`,
+			proxy:      true,
+			wantStatus: http.StatusOK,
+			wantBody:   "hi",
+		},
+		{
+			name:       "not an envelope",
+			output:     `plain text`,
+			proxy:      true,
+			wantStatus: http.StatusBadGateway,
+			wantBody:   "Invalid proxy response: invalid character 'p' looking for beginning of value\n",
+		},
+		{
+			name:       "invalid status",
+			output:     `{"statusCode":42}`,
+			proxy:      true,
+			wantStatus: http.StatusBadGateway,
+			wantBody:   "Invalid proxy response: status code 42 out of range\n",
+		},
+		{
+			name:        "raw mode",
+			output:      `{"statusCode":404,"body":"no such user"}`,
+			wantStatus:  http.StatusOK,
+			wantHeaders: map[string]string{"Content-Type": "application/json"},
+			wantBody:    `{"statusCode":404,"body":"no such user"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				return []byte(tt.output), 0
+			})
+			s := newTestServer(t, engine)
+			storeFunction(t, s, &storage.Function{Name: "users", Image: "users:latest", Runtime: "go"})
+
+			r := httptest.NewRequest(http.MethodPost, "/invoke/users", strings.NewReader(`{"id":7}`))
+			if tt.proxy {
+				r.Header.Set(proxyHeader, "true")
+			}
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrConcurrencyLimit is returned when a function already runs as many
+// containers as it's allowed to. Invoke hooks see it as the error of the
+// execution.
+var ErrConcurrencyLimit = errors.New("function is at its concurrency limit")
+
+// functionQuotas counts the running executions of each function, so one
+// function can't take all of the server's execution slots.
+type functionQuotas struct {
+	mu      sync.Mutex
+	running map[string]int
+}
+
+// newFunctionQuotas creates an empty set of counters.
+func newFunctionQuotas() *functionQuotas {
+	return &functionQuotas{running: make(map[string]int)}
+}
+
+// acquire takes an execution of a function, unless it already runs limit
+// executions. A limit of 0 means no limit.
+func (q *functionQuotas) acquire(functionName string, limit int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if limit > 0 && q.running[functionName] >= limit {
+		return false
+	}
+	q.running[functionName]++
+	return true
+}
+
+// release gives back an execution taken with acquire.
+func (q *functionQuotas) release(functionName string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Idle functions are dropped, so deleted ones don't linger
+	if q.running[functionName] <= 1 {
+		delete(q.running, functionName)
+		return
+	}
+	q.running[functionName]--
+}
+
+// status returns the running executions of each function that has any.
+func (q *functionQuotas) status() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	running := make(map[string]int, len(q.running))
+	for functionName, count := range q.running {
+		running[functionName] = count
+	}
+	return running
+}
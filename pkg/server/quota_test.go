@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestFunctionQuotas(t *testing.T) {
+	q := newFunctionQuotas()
+	steps := []struct {
+		name     string
+		function string
+		limit    int
+		release  bool
+		want     bool
+	}{
+		{name: "first", function: "noisy", limit: 2, want: true},
+		{name: "second", function: "noisy", limit: 2, want: true},
+		{name: "at the limit", function: "noisy", limit: 2, want: false},
+		{name: "other function", function: "quiet", limit: 1, want: true},
+		{name: "released", function: "noisy", release: true},
+		{name: "after release", function: "noisy", limit: 2, want: true},
+		{name: "unlimited", function: "quiet", limit: 0, want: true},
+	}
+	for _, step := range steps {
+		if step.release {
+			q.release(step.function)
+			continue
+		}
+		if got := q.acquire(step.function, step.limit); got != step.want {
+			t.Errorf("%s: acquire = %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	q.release("quiet")
+	q.release("quiet")
+	if _, ok := q.running["quiet"]; ok {
+		t.Error("idle function still counted")
+	}
+}
+
+func TestInvokeFunctionConcurrency(t *testing.T) {
+	// Invocations of the noisy function hold their container until released
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+		if bytes.Contains(event, []byte("noisy")) {
+			started <- struct{}{}
+			<-release
+		}
+		return event, 0
+	})
+	s := newTestServer(t, engine)
+	storeFunction(t, s, &storage.Function{Name: "noisy", Image: "noisy:latest", Runtime: "go", MaxConcurrency: 2})
+	storeFunction(t, s, &storage.Function{Name: "quiet", Image: "quiet:latest", Runtime: "go"})
+	invoke := func(function string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/"+function, strings.NewReader(`{"from":"`+function+`"}`)))
+		return w
+	}
+
+	// Drive the noisy function to its cap
+	var wg sync.WaitGroup
+	statuses := make(chan int, 2)
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- invoke("noisy").Code
+		}()
+		<-started
+	}
+
+	// The server still has capacity, but not for the noisy function
+	if w := invoke("noisy"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("invoking the noisy function at its cap = %d (Retry-After %q), want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := invoke("quiet"); w.Code != http.StatusOK {
+		t.Errorf("invoking another function = %d, want it to proceed: %s", w.Code, w.Body)
+	}
+
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("invocation within the cap = %d, want %d", status, http.StatusOK)
+		}
+	}
+	if w := invoke("noisy"); w.Code != http.StatusOK {
+		t.Errorf("invoking the noisy function once released = %d, want %d", w.Code, http.StatusOK)
+	}
+}
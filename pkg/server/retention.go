@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// retentionInterval is how often invocation records are pruned by the
+// retention policy.
+const retentionInterval = 10 * time.Minute
+
+// pruneInvocations deletes the invocation records beyond the retention
+// policy: those older than invocation_retention, and all but the newest
+// max_invocations.
+func (s *Server) pruneInvocations() {
+	if s.config.InvocationRetention > 0 {
+		deleted, err := s.store.PruneInvocations(time.Now().Add(-s.config.InvocationRetention))
+		if err != nil {
+			s.log.WithError(err).Warn("Failed to prune old invocation records")
+		} else if deleted > 0 {
+			s.log.WithField("deleted", deleted).Info("Pruned old invocation records")
+		}
+	}
+	if s.config.MaxInvocations > 0 {
+		deleted, err := s.store.TrimInvocations(s.config.MaxInvocations)
+		if err != nil {
+			s.log.WithError(err).Warn("Failed to prune excess invocation records")
+		} else if deleted > 0 {
+			s.log.WithField("deleted", deleted).Info("Pruned excess invocation records")
+		}
+	}
+}
+
+// runRetention prunes invocation records right away, then periodically until
+// ctx is cancelled.
+func (s *Server) runRetention(ctx context.Context) {
+	s.pruneInvocations()
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.pruneInvocations()
+		}
+	}
+}
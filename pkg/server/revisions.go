@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// invalidDigestError is returned when an invocation asks for a revision by
+// something that isn't a digest.
+type invalidDigestError struct {
+	Digest string
+}
+
+// Error implements error.
+func (e *invalidDigestError) Error() string {
+	return fmt.Sprintf("invalid digest %q, expected sha256:<64 hex digits>", e.Digest)
+}
+
+// pinRevision returns the function running the image of one of its revisions,
+// given by digest, rather than its current one. Digests the function was never
+// deployed with fail as not found, the same as a missing function.
+func (s *Server) pinRevision(ctx context.Context, function *storage.Function, digest string) (*storage.Function, error) {
+	if !validDigest.MatchString(digest) {
+		return nil, &invalidDigestError{Digest: digest}
+	}
+	if digest == function.Digest {
+		return function, nil
+	}
+
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+	if _, err := s.store.GetRevision(ctx, function.Name, digest); err != nil {
+		return nil, err
+	}
+	pinned := *function
+	pinned.Digest = digest
+	return &pinned, nil
+}
+
+// pinFailed replies to an invocation whose revision couldn't be pinned.
+func (s *Server) pinFailed(w http.ResponseWriter, function *storage.Function, digest string, err error) {
+	var digestErr *invalidDigestError
+	if errors.As(err, &digestErr) {
+		s.log.WithField("function", function.Name).Warn("Invalid revision digest")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !errors.Is(err, storage.ErrRevisionNotFound) {
+		s.lookupFailed(w, function.Name, err)
+		return
+	}
+	s.log.WithError(err).WithField("function", function.Name).Warn("Unknown revision")
+	http.Error(w, fmt.Sprintf("Function %s has no revision %s", function.Name, digest), http.StatusNotFound)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestInvokeDigest(t *testing.T) {
+	const unknownDigest = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	tests := []struct {
+		name       string
+		digest     string
+		wantStatus int
+		wantRan    string // Image the function ran with, empty when it didn't run
+	}{
+		{name: "earlier revision", digest: stableDigest, wantStatus: http.StatusOK, wantRan: stableDigest},
+		{name: "current revision", digest: canaryDigest, wantStatus: http.StatusOK, wantRan: canaryDigest},
+		{name: "unknown digest", digest: unknownDigest, wantStatus: http.StatusNotFound},
+		{name: "malformed digest", digest: "sha256:1234", wantStatus: http.StatusBadRequest},
+		{name: "not a digest", digest: "latest", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				return []byte(`{"ok":true}`), 0
+			})
+			s := newTestServer(t, engine)
+			deployRevisions(t, s, stableDigest, canaryDigest)
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello?digest="+tt.digest, strings.NewReader(`{}`)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			engine.mu.Lock()
+			defer engine.mu.Unlock()
+			if tt.wantRan == "" {
+				if len(engine.ran) != 0 {
+					t.Errorf("ran images %v, want none", engine.ran)
+				}
+				return
+			}
+			if len(engine.ran) != 1 || engine.ran[0] != tt.wantRan {
+				t.Errorf("ran images %v, want %s", engine.ran, tt.wantRan)
+			}
+		})
+	}
+}
+
+func TestInvokeDigestAsync(t *testing.T) {
+	engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+		return []byte(`{"ok":true}`), 0
+	})
+	s := newTestServer(t, engine)
+	deployRevisions(t, s, stableDigest)
+
+	r := httptest.NewRequest(http.MethodPost, "/invoke/hello?digest="+stableDigest, strings.NewReader(`{}`))
+	r.Header.Set(asyncHeader, "true")
+	w := httptest.NewRecorder()
+	s.handleInvoke(w, r)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	var job jobDetails
+	if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+		t.Fatalf("invalid job details: %v", err)
+	}
+
+	// A deploy while the job is queued doesn't change the image it runs
+	deployRevisions(t, s, canaryDigest)
+	s.runJob(context.Background(), <-s.jobQueue)
+
+	stored, err := s.store.GetJob(context.Background(), job.JobID)
+	if err != nil {
+		t.Fatalf("GetJob failed: %v", err)
+	}
+	if stored.Status != storage.JobSucceeded {
+		t.Fatalf("job %s: %s, want it to succeed", stored.Status, stored.Error)
+	}
+	if stored.Digest != stableDigest {
+		t.Errorf("job digest = %q, want %s", stored.Digest, stableDigest)
+	}
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if len(engine.ran) != 1 || engine.ran[0] != stableDigest {
+		t.Errorf("ran images %v, want the pinned revision %s", engine.ran, stableDigest)
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// errAlreadyCompleted is returned when a run_once function that completed
+// is invoked again without being forced.
+var errAlreadyCompleted = errors.New("function already completed its run")
+
+// forceRunKey is the context key marking invocations that run a run_once
+// function even when it completed.
+type forceRunKey struct{}
+
+// withForcedRun marks the invocations made with ctx as forced.
+func withForcedRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceRunKey{}, true)
+}
+
+// forcedRun reports whether the invocations made with ctx are forced.
+func forcedRun(ctx context.Context) bool {
+	forced, _ := ctx.Value(forceRunKey{}).(bool)
+	return forced
+}
+
+// checkRunOnce rejects a run of a run_once function that completed, unless
+// it's forced. The completion is read from the store rather than function,
+// which may have been looked up before the previous run completed.
+func (s *Server) checkRunOnce(ctx context.Context, function *storage.Function) error {
+	if forcedRun(ctx) {
+		return nil
+	}
+	queryCtx, cancel := s.queryContext(ctx)
+	defer cancel()
+	current, err := s.store.GetFunction(queryCtx, function.Name)
+	if err != nil {
+		return err
+	}
+	if current.CompletedAt != nil {
+		return errAlreadyCompleted
+	}
+	return nil
+}
+
+// markCompleted records that a run_once function completed, so it isn't
+// run again unless forced.
+func (s *Server) markCompleted(function *storage.Function) {
+	if err := s.store.MarkCompleted(function.Name, time.Now()); err != nil {
+		s.log.WithError(err).WithField("function", function.Name).Error("Failed to record the completion of a run_once function")
+		return
+	}
+	s.log.WithField("function", function.Name).Info("Function completed its run")
+}
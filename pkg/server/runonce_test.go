@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestRunOnce(t *testing.T) {
+	fail := true
+	runs := 0
+	s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+		runs++
+		if fail {
+			return []byte("migration failed"), 1
+		}
+		return []byte(`{"migrated":true}`), 0
+	}))
+	storeFunction(t, s, &storage.Function{Name: "migrate", Image: "migrate:1", Runtime: "go", RunOnce: true})
+
+	steps := []struct {
+		name       string
+		query      string
+		fail       bool // Whether the function fails its run
+		wantStatus int
+		wantRun    bool // Whether the function runs
+	}{
+		{name: "failed run", fail: true, wantStatus: http.StatusInternalServerError, wantRun: true},
+		{name: "retried after the failure", wantStatus: http.StatusOK, wantRun: true},
+		{name: "refused once completed", wantStatus: http.StatusConflict},
+		{name: "forced", query: "?force=true", wantStatus: http.StatusOK, wantRun: true},
+		{name: "not forced", query: "?force=false", wantStatus: http.StatusConflict},
+	}
+	for _, step := range steps {
+		fail = step.fail
+		before := runs
+		w := httptest.NewRecorder()
+		s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/migrate"+step.query, strings.NewReader(`{}`)))
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body)
+		}
+		if ran := runs > before; ran != step.wantRun {
+			t.Errorf("%s: function ran = %v, want %v", step.name, ran, step.wantRun)
+		}
+	}
+
+	function, err := s.store.GetFunction(context.Background(), "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if function.CompletedAt == nil {
+		t.Fatal("the completion wasn't recorded")
+	}
+	completedAt := *function.CompletedAt
+
+	// A redeploy doesn't make it run again
+	storeFunction(t, s, &storage.Function{Name: "migrate", Image: "migrate:2", Runtime: "go", RunOnce: true})
+	function, err = s.store.GetFunction(context.Background(), "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if function.CompletedAt == nil || !function.CompletedAt.Equal(completedAt) {
+		t.Errorf("completed at %v after a redeploy, want %v", function.CompletedAt, completedAt)
+	}
+	w := httptest.NewRecorder()
+	s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/migrate", strings.NewReader(`{}`)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("status after a redeploy = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestRunOnceCompletedMeanwhile(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, nil))
+	function := &storage.Function{Name: "seed", Image: "seed:1", Runtime: "go", RunOnce: true}
+	storeFunction(t, s, function)
+	looked, err := s.store.GetFunction(context.Background(), "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another invocation completes it after this one looked it up
+	s.markCompleted(looked)
+	if err := s.checkRunOnce(context.Background(), looked); err != errAlreadyCompleted {
+		t.Errorf("checkRunOnce = %v, want errAlreadyCompleted", err)
+	}
+	if err := s.checkRunOnce(withForcedRun(context.Background()), looked); err != nil {
+		t.Errorf("checkRunOnce of a forced run = %v", err)
+	}
+}
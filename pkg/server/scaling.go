@@ -0,0 +1,136 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// scalingWindow is the span of recent invocations the scaling hints are
+// computed over, kept in one bucket per second.
+const scalingWindow = time.Minute
+
+// invocationBucket counts the invocations of a function that finished
+// within one second.
+type invocationBucket struct {
+	second    int64 // Unix second the counts are of, buckets of older ones are stale
+	count     int64
+	errors    int64
+	totalTime time.Duration
+}
+
+// invocationWindow is a ring of per-second buckets covering scalingWindow,
+// so recording an invocation and summing the window are both cheap.
+type invocationWindow struct {
+	buckets [int(scalingWindow / time.Second)]invocationBucket
+}
+
+// invocationRates keeps the recent invocations of each function.
+type invocationRates struct {
+	mu      sync.Mutex
+	windows map[string]*invocationWindow
+}
+
+// newInvocationRates returns an empty set of windows.
+func newInvocationRates() *invocationRates {
+	return &invocationRates{windows: make(map[string]*invocationWindow)}
+}
+
+// record adds an invocation of a function that finished at now.
+func (r *invocationRates) record(functionName string, duration time.Duration, failed bool, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	window, ok := r.windows[functionName]
+	if !ok {
+		window = &invocationWindow{}
+		r.windows[functionName] = window
+	}
+	second := now.Unix()
+	bucket := &window.buckets[second%int64(len(window.buckets))]
+	if bucket.second != second {
+		*bucket = invocationBucket{second: second}
+	}
+	bucket.count++
+	bucket.totalTime += duration
+	if failed {
+		bucket.errors++
+	}
+}
+
+// functionHints is how busy a function is, as reported by GET /scaling/hints.
+type functionHints struct {
+	InvocationsPerSecond float64 `json:"invocations_per_second"` // Over the window
+	AvgDurationMs        float64 `json:"avg_duration_ms"`        // Of the invocations in the window
+	ErrorRate            float64 `json:"error_rate"`             // Share of the invocations in the window that failed
+	Concurrency          int     `json:"concurrency"`            // Executions running right now
+	Queued               int     `json:"queued"`                 // Invocations waiting for an execution slot right now
+}
+
+// summary returns the hints of the functions invoked within the window
+// before now, dropping the windows of functions that weren't.
+func (r *invocationRates) summary(now time.Time) map[string]functionHints {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	oldest := now.Add(-scalingWindow).Unix()
+	hints := make(map[string]functionHints, len(r.windows))
+	for name, window := range r.windows {
+		var count, errors int64
+		var totalTime time.Duration
+		for _, bucket := range window.buckets {
+			if bucket.second > oldest && bucket.second <= now.Unix() {
+				count += bucket.count
+				errors += bucket.errors
+				totalTime += bucket.totalTime
+			}
+		}
+		if count == 0 {
+			delete(r.windows, name)
+			continue
+		}
+		hints[name] = functionHints{
+			InvocationsPerSecond: float64(count) / scalingWindow.Seconds(),
+			AvgDurationMs:        float64(totalTime) / float64(count) / float64(time.Millisecond),
+			ErrorRate:            float64(errors) / float64(count),
+		}
+	}
+	return hints
+}
+
+// scalingHints is the load of each function, for external autoscalers
+// deciding how many replicas of the server to run.
+type scalingHints struct {
+	WindowSeconds int                      `json:"window_seconds"` // Span the rates are computed over
+	Functions     map[string]functionHints `json:"functions"`      // Functions invoked within the window, or running
+}
+
+// handleScalingHints reports the recent load of each function (GET /scaling/hints).
+func (s *Server) handleScalingHints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.log.WithField("method", r.Method).Warn("Invalid method for scaling hints")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	functions := s.rates.summary(time.Now())
+	for name, running := range s.quotas.status() {
+		hints := functions[name]
+		hints.Concurrency = running
+		functions[name] = hints
+	}
+	_, _, queues := s.slots.status()
+	for name, queue := range queues {
+		if queue.Depth == 0 {
+			continue
+		}
+		hints := functions[name]
+		hints.Queued = queue.Depth
+		functions[name] = hints
+	}
+
+	s.writeJSON(w, http.StatusOK, scalingHints{
+		WindowSeconds: int(scalingWindow.Seconds()),
+		Functions:     functions,
+	})
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestInvocationRates(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	rates := newInvocationRates()
+	rates.record("stale", time.Second, false, now.Add(-2*scalingWindow)) // Long out of the window
+	rates.record("hello", time.Second, false, now.Add(-scalingWindow))   // Just out of it
+	rates.record("hello", 100*time.Millisecond, false, now.Add(-10*time.Second))
+	rates.record("hello", 300*time.Millisecond, true, now.Add(-10*time.Second))
+	rates.record("hello", 200*time.Millisecond, false, now)
+
+	got := rates.summary(now)
+	want := map[string]functionHints{
+		"hello": {InvocationsPerSecond: 3 / scalingWindow.Seconds(), AvgDurationMs: 200, ErrorRate: 1.0 / 3},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("summary = %+v, want %+v", got, want)
+	}
+	hints := got["hello"]
+	if math.Abs(hints.InvocationsPerSecond-want["hello"].InvocationsPerSecond) > 1e-9 ||
+		math.Abs(hints.AvgDurationMs-want["hello"].AvgDurationMs) > 1e-9 ||
+		math.Abs(hints.ErrorRate-want["hello"].ErrorRate) > 1e-9 {
+		t.Errorf("hints of hello = %+v, want %+v", hints, want["hello"])
+	}
+
+	// Functions no longer invoked are forgotten
+	rates.mu.Lock()
+	_, kept := rates.windows["stale"]
+	rates.mu.Unlock()
+	if kept {
+		t.Error("the window of a function not invoked within it was kept")
+	}
+	if got := rates.summary(now.Add(2 * scalingWindow)); len(got) != 0 {
+		t.Errorf("summary long after = %+v, want none", got)
+	}
+}
+
+func TestInvocationRatesReuseBuckets(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	rates := newInvocationRates()
+	rates.record("hello", time.Second, true, now)
+	// A window later the same bucket holds the new second only
+	later := now.Add(scalingWindow)
+	rates.record("hello", 10*time.Millisecond, false, later)
+
+	hints := rates.summary(later)["hello"]
+	if want := (functionHints{InvocationsPerSecond: 1 / scalingWindow.Seconds(), AvgDurationMs: 10}); !reflect.DeepEqual(hints, want) {
+		t.Errorf("hints = %+v, want %+v", hints, want)
+	}
+}
+
+func TestScalingHints(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) { return event, 0 }))
+	storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+	for range 3 {
+		w := httptest.NewRecorder()
+		s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(`{}`)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("invoke status = %d: %s", w.Code, w.Body)
+		}
+	}
+	// A function running right now, without invocations in the window yet
+	if !s.quotas.acquire("busy", 0) {
+		t.Fatal("failed to acquire a slot of busy")
+	}
+	defer s.quotas.release("busy")
+
+	w := httptest.NewRecorder()
+	s.handleScalingHints(w, httptest.NewRequest(http.MethodGet, "/scaling/hints", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	var hints scalingHints
+	if err := json.Unmarshal(w.Body.Bytes(), &hints); err != nil {
+		t.Fatalf("invalid hints: %v", err)
+	}
+	if hints.WindowSeconds != int(scalingWindow.Seconds()) {
+		t.Errorf("window = %ds, want %s", hints.WindowSeconds, scalingWindow)
+	}
+	hello := hints.Functions["hello"]
+	if math.Abs(hello.InvocationsPerSecond-3/scalingWindow.Seconds()) > 1e-9 || hello.ErrorRate != 0 || hello.Concurrency != 0 {
+		t.Errorf("hints of hello = %+v, want 3 successful invocations in the window, none running", hello)
+	}
+	if busy := hints.Functions["busy"]; busy.Concurrency != 1 || busy.InvocationsPerSecond != 0 {
+		t.Errorf("hints of busy = %+v, want one running execution", busy)
+	}
+
+	w = httptest.NewRecorder()
+	s.handleScalingHints(w, httptest.NewRequest(http.MethodPost, "/scaling/hints", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// slotWaiter is an invocation waiting for an execution slot.
+type slotWaiter struct {
+	function string
+	ready    chan struct{} // Closed when the slot is granted
+	granted  bool          // Set under the scheduler's lock
+}
+
+// functionWaits are the wait times of a function's invocations.
+type functionWaits struct {
+	depth     int           // Invocations waiting right now
+	waits     int64         // Invocations that got a slot, waiting or not
+	waitTotal time.Duration // Total time spent waiting by them
+}
+
+// slotScheduler limits concurrent executions to a number of slots. When all
+// slots are taken, invocations wait in a queue per function, and freed slots
+// go to the functions in turn, so a function flooding the server can't
+// starve the others: each waiting function gets a slot before any gets a second.
+type slotScheduler struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	queues  map[string]*list.List // Waiters of each function, oldest first
+	turns   *list.List            // Functions with waiters, the next to get a slot first
+	waits   map[string]*functionWaits
+	stats   queueStats // Totals over all functions
+}
+
+// newSlotScheduler creates a scheduler with limit slots.
+func newSlotScheduler(limit int) *slotScheduler {
+	return &slotScheduler{
+		limit:  limit,
+		queues: make(map[string]*list.List),
+		turns:  list.New(),
+		waits:  make(map[string]*functionWaits),
+	}
+}
+
+// acquire takes an execution slot for an invocation of a function, waiting
+// for its turn while all of them are taken. The slot must be given back with
+// release.
+func (s *slotScheduler) acquire(ctx context.Context, function string) error {
+	s.mu.Lock()
+	if s.running < s.limit && s.turns.Len() == 0 {
+		s.running++
+		s.recordWait(function, 0)
+		s.mu.Unlock()
+		return nil
+	}
+
+	began := time.Now()
+	waiter := &slotWaiter{function: function, ready: make(chan struct{})}
+	queue, ok := s.queues[function]
+	if !ok {
+		queue = list.New()
+		s.queues[function] = queue
+		s.turns.PushBack(function)
+	}
+	element := queue.PushBack(waiter)
+	s.waitsOf(function).depth++
+	s.stats.enter()
+	s.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		s.mu.Lock()
+		s.recordWait(function, time.Since(began))
+		s.mu.Unlock()
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if waiter.granted {
+			// The slot was granted just as the invocation gave up
+			s.running--
+			s.dispatch()
+		} else {
+			s.dequeue(function, queue, element)
+		}
+		return fmt.Errorf("waiting for execution slot: %v", ctx.Err())
+	}
+}
+
+// release gives back a slot, handing it to the function whose turn it is.
+func (s *slotScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.dispatch()
+}
+
+// dispatch grants free slots to waiting invocations, taking the oldest of
+// the function whose turn it is, which then goes to the back of the line.
+// The lock must be held.
+func (s *slotScheduler) dispatch() {
+	for s.running < s.limit && s.turns.Len() > 0 {
+		function := s.turns.Front().Value.(string)
+		queue := s.queues[function]
+		waiter := queue.Front().Value.(*slotWaiter)
+		s.dequeue(function, queue, queue.Front())
+		if _, ok := s.queues[function]; ok {
+			s.turns.MoveToBack(s.turns.Front())
+		}
+
+		waiter.granted = true
+		s.running++
+		close(waiter.ready)
+	}
+}
+
+// dequeue removes a waiter from its function's queue, and the function from
+// the turns once it has no waiters left. The lock must be held.
+func (s *slotScheduler) dequeue(function string, queue *list.List, element *list.Element) {
+	queue.Remove(element)
+	s.waitsOf(function).depth--
+	s.stats.leave()
+	if queue.Len() > 0 {
+		return
+	}
+	delete(s.queues, function)
+	for turn := s.turns.Front(); turn != nil; turn = turn.Next() {
+		if turn.Value.(string) == function {
+			s.turns.Remove(turn)
+			return
+		}
+	}
+}
+
+// waitsOf returns the wait times of a function. The lock must be held.
+func (s *slotScheduler) waitsOf(function string) *functionWaits {
+	waits, ok := s.waits[function]
+	if !ok {
+		waits = &functionWaits{}
+		s.waits[function] = waits
+	}
+	return waits
+}
+
+// recordWait records how long an invocation waited for its slot. The lock
+// must be held.
+func (s *slotScheduler) recordWait(function string, waited time.Duration) {
+	waits := s.waitsOf(function)
+	waits.waits++
+	waits.waitTotal += waited
+	s.stats.recordWait(waited)
+}
+
+// functionQueueStatus is the state of a function's queue as reported by GET /status.
+type functionQueueStatus struct {
+	Depth     int     `json:"depth"`
+	Waits     int64   `json:"waits"`
+	AvgWaitMs float64 `json:"avg_wait_ms"`
+}
+
+// status returns the number of running executions, the limit, and the wait
+// times of every function that was invoked.
+func (s *slotScheduler) status() (running, limit int, functions map[string]functionQueueStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	functions = make(map[string]functionQueueStatus, len(s.waits))
+	for function, waits := range s.waits {
+		status := functionQueueStatus{Depth: waits.depth, Waits: waits.waits}
+		if waits.waits > 0 {
+			status.AvgWaitMs = float64(waits.waitTotal) / float64(waits.waits) / float64(time.Millisecond)
+		}
+		functions[function] = status
+	}
+	return s.running, s.limit, functions
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForDepth waits until as many invocations are queued in a scheduler.
+func waitForDepth(t *testing.T, s *slotScheduler, depth int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.stats.depth.Load() != depth {
+		if time.Now().After(deadline) {
+			t.Fatalf("queue depth = %d, want %d", s.stats.depth.Load(), depth)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSlotSchedulerFairness(t *testing.T) {
+	tests := []struct {
+		name     string
+		arrivals string // Functions queueing for the one slot, in order
+		want     string // Functions granted the slot, in order
+	}{
+		{name: "one function", arrivals: "aaa", want: "aaa"},
+		{name: "flooding function", arrivals: "aaabc", want: "abcaa"},
+		{name: "interleaved", arrivals: "abab", want: "abab"},
+		{name: "late arrivals", arrivals: "aaaab", want: "abaaa"},
+		{name: "three functions", arrivals: "aabbcc", want: "abcabc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSlotScheduler(1)
+			if err := s.acquire(context.Background(), "holder"); err != nil {
+				t.Fatalf("acquire of a free slot failed: %v", err)
+			}
+
+			granted := make(chan string)
+			for i, function := range strings.Split(tt.arrivals, "") {
+				go func() {
+					if err := s.acquire(context.Background(), function); err != nil {
+						t.Errorf("acquire(%s) failed: %v", function, err)
+						return
+					}
+					granted <- function
+				}()
+				waitForDepth(t, s, int64(i+1))
+			}
+
+			// Each release hands the slot to the next waiter, which holds it
+			// until the next round
+			var order strings.Builder
+			for range tt.arrivals {
+				s.release()
+				select {
+				case function := <-granted:
+					order.WriteString(function)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no waiter got the slot, order so far %q", order.String())
+				}
+			}
+			s.release()
+
+			if order.String() != tt.want {
+				t.Errorf("slots granted to %q, want %q", order.String(), tt.want)
+			}
+			if running, _, _ := s.status(); running != 0 {
+				t.Errorf("%d slots still taken", running)
+			}
+		})
+	}
+}
+
+func TestSlotSchedulerQueueing(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		held    int // Slots taken before the tested acquire
+		waiting bool
+	}{
+		{name: "free slot", limit: 2, held: 1},
+		{name: "all slots taken", limit: 2, held: 2, waiting: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSlotScheduler(tt.limit)
+			for i := 0; i < tt.held; i++ {
+				if err := s.acquire(context.Background(), "holder"); err != nil {
+					t.Fatalf("acquire failed: %v", err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			err := s.acquire(ctx, "f")
+			if (err != nil) != tt.waiting {
+				t.Fatalf("acquire = %v, want an error %v", err, tt.waiting)
+			}
+			if tt.waiting && !strings.Contains(err.Error(), "waiting for execution slot") {
+				t.Errorf("acquire error = %v, want it to tell the wait was given up", err)
+			}
+		})
+	}
+}
+
+func TestSlotSchedulerCancel(t *testing.T) {
+	s := newSlotScheduler(1)
+	if err := s.acquire(context.Background(), "holder"); err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+
+	// A waiter giving up leaves the queue, and the others keep their turn
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error)
+	go func() { cancelled <- s.acquire(ctx, "a") }()
+	waitForDepth(t, s, 1)
+	granted := make(chan error)
+	go func() { granted <- s.acquire(context.Background(), "b") }()
+	waitForDepth(t, s, 2)
+
+	cancel()
+	if err := <-cancelled; err == nil {
+		t.Fatal("acquire succeeded after its context was cancelled")
+	}
+	waitForDepth(t, s, 1)
+	_, _, functions := s.status()
+	if functions["a"].Depth != 0 || functions["b"].Depth != 1 {
+		t.Errorf("queue depths = %+v, want only b waiting", functions)
+	}
+
+	s.release()
+	select {
+	case err := <-granted:
+		if err != nil {
+			t.Fatalf("acquire(b) failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the remaining waiter didn't get the freed slot")
+	}
+	s.release()
+
+	if running, _, _ := s.status(); running != 0 {
+		t.Errorf("%d slots still taken", running)
+	}
+	if len(s.queues) != 0 || s.turns.Len() != 0 {
+		t.Errorf("queues = %v, turns = %d, want none left", s.queues, s.turns.Len())
+	}
+	if err := s.acquire(context.Background(), "a"); err != nil {
+		t.Errorf("acquire of the freed slot failed: %v", err)
+	}
+}
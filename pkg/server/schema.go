@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaURL names the schema resource of a function when compiling it. It's
+// not a file URL, so relative references don't resolve to files either.
+const schemaURL = "function:///event_schema.json"
+
+// eventValidationError lists the reasons an event doesn't match a function's schema.
+type eventValidationError struct {
+	Errors []string `json:"errors"`
+}
+
+func (e *eventValidationError) Error() string {
+	return fmt.Sprintf("event doesn't match schema: %v", e.Errors)
+}
+
+// compileSchema parses a JSON Schema document. References resolve within the
+// document and to the JSON Schema meta-schemas only, never to files or URLs
+// the server could reach.
+func compileSchema(schema string) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("reference to %s not allowed, only references within the schema are", url)
+	}
+	if err := compiler.AddResource(schemaURL, strings.NewReader(schema)); err != nil {
+		return nil, fmt.Errorf("invalid event schema: %v", err)
+	}
+	compiled, err := compiler.Compile(schemaURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event schema: %v", err)
+	}
+	return compiled, nil
+}
+
+// schemaCache holds the compiled event schemas of functions, so a schema is
+// compiled when it's deployed rather than on every invocation.
+type schemaCache struct {
+	mu      sync.Mutex
+	schemas map[string]compiledSchema // By function name
+}
+
+// compiledSchema is an event schema along with its source.
+type compiledSchema struct {
+	source string
+	schema *jsonschema.Schema
+}
+
+// newSchemaCache returns an empty schema cache.
+func newSchemaCache() *schemaCache {
+	return &schemaCache{schemas: make(map[string]compiledSchema)}
+}
+
+// get returns the compiled event schema of a function, compiling it unless
+// it's cached. A schema that changed since it was cached is compiled again.
+func (c *schemaCache) get(function *storage.Function) (*jsonschema.Schema, error) {
+	c.mu.Lock()
+	cached, ok := c.schemas[function.Name]
+	c.mu.Unlock()
+	if ok && cached.source == function.EventSchema {
+		return cached.schema, nil
+	}
+
+	schema, err := compileSchema(function.EventSchema)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schemas[function.Name] = compiledSchema{source: function.EventSchema, schema: schema}
+	return schema, nil
+}
+
+// forget drops the schema of a deleted function.
+func (c *schemaCache) forget(functionName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.schemas, functionName)
+}
+
+// warmSchema compiles the event schema of a function that was deployed or
+// updated, so its invocations find it compiled. The schema was validated
+// already, a failure only shows again on invocation.
+func (s *Server) warmSchema(function *storage.Function) {
+	if function.EventSchema == "" {
+		s.schemas.forget(function.Name)
+		return
+	}
+	if _, err := s.schemas.get(function); err != nil {
+		s.log.WithError(err).WithField("function", function.Name).Warn("Failed to compile event schema")
+	}
+}
+
+// validateEvent checks an event against a function's event schema. Functions
+// without a schema accept any event. An event that doesn't match is reported
+// with an *eventValidationError.
+func (s *Server) validateEvent(function *storage.Function, event []byte) error {
+	if function.EventSchema == "" {
+		return nil
+	}
+
+	compiled, err := s.schemas.get(function)
+	if err != nil {
+		return err
+	}
+
+	var value any
+	if err := decodeJSON(event, &value); err != nil {
+		return &eventValidationError{Errors: []string{fmt.Sprintf("event is not valid JSON: %v", err)}}
+	}
+
+	err = compiled.Validate(value)
+	var validationErr *jsonschema.ValidationError
+	if errors.As(err, &validationErr) {
+		var messages []string
+		for _, cause := range validationErr.BasicOutput().Errors {
+			// The root entry only says that validation failed
+			if cause.KeywordLocation == "" {
+				continue
+			}
+			location := cause.InstanceLocation
+			if location == "" {
+				location = "/"
+			}
+			messages = append(messages, fmt.Sprintf("%s: %s", location, cause.Error))
+		}
+		return &eventValidationError{Errors: messages}
+	}
+	return err
+}
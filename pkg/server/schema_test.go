@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCompileSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr string // Part of the error expected, empty for none
+	}{
+		{name: "object schema", schema: `{"type":"object","required":["id"]}`},
+		{name: "empty schema", schema: `{}`},
+		{name: "internal reference", schema: `{"$defs":{"id":{"type":"integer"}},"properties":{"id":{"$ref":"#/$defs/id"}}}`},
+		{name: "meta-schema", schema: `{"$schema":"https://json-schema.org/draft/2020-12/schema","type":"string"}`},
+		{name: "not JSON", schema: `{"type":`, wantErr: "invalid event schema"},
+		{name: "invalid keyword value", schema: `{"type":"nonsense"}`, wantErr: "invalid event schema"},
+		{name: "remote reference", schema: `{"$ref":"http://169.254.169.254/latest/meta-data"}`, wantErr: "not allowed"},
+		{name: "file reference", schema: `{"$ref":"file:///etc/passwd"}`, wantErr: "not allowed"},
+		{name: "relative file reference", schema: `{"$ref":"other.json"}`, wantErr: "not allowed"},
+		{name: "unknown meta-schema", schema: `{"$schema":"http://example.com/schema"}`, wantErr: "invalid event schema"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileSchema(tt.schema)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("compileSchema(%s) failed: %v", tt.schema, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("compileSchema(%s) = %v, want an error containing %q", tt.schema, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateEvent(t *testing.T) {
+	const schema = `{
+		"type": "object",
+		"required": ["id"],
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"email": {"type": "string", "pattern": "@"}
+		}
+	}`
+	tests := []struct {
+		name       string
+		schema     string
+		event      string
+		wantErrors []string // Parts of the reasons expected, nil for a valid event
+	}{
+		{name: "no schema", event: `not even JSON`},
+		{name: "valid", schema: schema, event: `{"id":1,"email":"a@b"}`},
+		{name: "large integer", schema: schema, event: `{"id":12345678901234567890}`},
+		{name: "missing property", schema: schema, event: `{}`, wantErrors: []string{"/: ", "id"}},
+		{name: "wrong type", schema: schema, event: `{"id":"one"}`, wantErrors: []string{"/id: "}},
+		{name: "several reasons", schema: schema, event: `{"id":0,"email":"nope"}`, wantErrors: []string{"/id: ", "/email: "}},
+		{name: "not an object", schema: schema, event: `[1]`, wantErrors: []string{"/: "}},
+		{name: "not JSON", schema: schema, event: `{"id":`, wantErrors: []string{"not valid JSON"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{schemas: newSchemaCache(), log: logrus.New()}
+			function := &storage.Function{Name: "f", EventSchema: tt.schema}
+			err := s.validateEvent(function, []byte(tt.event))
+			if tt.wantErrors == nil {
+				if err != nil {
+					t.Errorf("validateEvent(%s) failed: %v", tt.event, err)
+				}
+				return
+			}
+			var validationErr *eventValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("validateEvent(%s) = %v, want an *eventValidationError", tt.event, err)
+			}
+			reasons := strings.Join(validationErr.Errors, "\n")
+			for _, want := range tt.wantErrors {
+				if !strings.Contains(reasons, want) {
+					t.Errorf("validateEvent(%s) reasons %q, want one containing %q", tt.event, validationErr.Errors, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaCache(t *testing.T) {
+	c := newSchemaCache()
+	function := &storage.Function{Name: "f", EventSchema: `{"type":"object"}`}
+	first, err := c.get(function)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if again, _ := c.get(function); again != first {
+		t.Error("an unchanged schema was compiled again")
+	}
+
+	// A redeployed schema replaces the cached one
+	function.EventSchema = `{"type":"array"}`
+	changed, err := c.get(function)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if changed == first {
+		t.Error("a changed schema wasn't compiled again")
+	}
+	if err := changed.Validate(map[string]any{}); err == nil {
+		t.Error("the changed schema accepted an object")
+	}
+
+	c.forget("f")
+	if _, ok := c.schemas["f"]; ok {
+		t.Error("forget kept the schema")
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestDeploySecrets(t *testing.T) {
+	const secret = "s3cr3t-value"
+	tests := []struct {
+		name       string
+		secrets    map[string]string
+		wantStatus int
+	}{
+		{name: "secrets", secrets: map[string]string{"API_TOKEN": secret, "db.password": secret + "-db"}, wantStatus: http.StatusOK},
+		{name: "none", wantStatus: http.StatusOK},
+		{name: "path in name", secrets: map[string]string{"../token": secret}, wantStatus: http.StatusBadRequest},
+		{name: "hidden file", secrets: map[string]string{".token": secret}, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				return []byte(`{"ok":true}`), 0
+			})
+			s := newTestServer(t, engine)
+			hook := test.NewLocal(s.log)
+			s.log.SetLevel(logrus.DebugLevel)
+
+			body, _ := json.Marshal(map[string]any{"name": "hello", "image": "hello:latest", "runtime": "go", "secrets": tt.secrets})
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			// Only the names are part of the metadata
+			w = httptest.NewRecorder()
+			s.handleFunction(w, httptest.NewRequest(http.MethodGet, "/functions/hello", nil))
+			if strings.Contains(w.Body.String(), secret) {
+				t.Errorf("described function holds a secret value: %s", w.Body)
+			}
+			var details functionDetails
+			if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil {
+				t.Fatalf("invalid description: %v", err)
+			}
+			if len(details.Secrets) != len(tt.secrets) {
+				t.Errorf("described secrets %q, want the %d names", details.Secrets, len(tt.secrets))
+			}
+			function, err := s.store.GetFunction(context.Background(), "hello")
+			if err != nil {
+				t.Fatalf("GetFunction failed: %v", err)
+			}
+			if record := fmt.Sprintf("%+v", *function); strings.Contains(record, secret) {
+				t.Errorf("stored function holds a secret value: %s", record)
+			}
+
+			// The function reads its secrets from files
+			w = httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(`{}`)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("invocation failed with %d: %s", w.Code, w.Body)
+			}
+			for name, value := range tt.secrets {
+				if got, ok := engine.file("c1", "/run/secrets/"+name); !ok || got != value {
+					t.Errorf("/run/secrets/%s = %q (copied %v), want %q", name, got, ok, value)
+				}
+			}
+
+			if len(hook.AllEntries()) == 0 {
+				t.Fatal("nothing logged")
+			}
+			for _, entry := range hook.AllEntries() {
+				line, _ := entry.String()
+				if strings.Contains(line, secret) {
+					t.Errorf("secret value logged: %s", line)
+				}
+			}
+		})
+	}
+}
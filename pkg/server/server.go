@@ -5,63 +5,202 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/akos011221/serverless/pkg/functionio"
 	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/stopsignal"
 	"github.com/akos011221/serverless/pkg/storage"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
 // Server manages the HTTP interface for the platform.
 // It handles function registration and invocation, delegation to storage and orcehstrator.
 type Server struct {
+	config       Config
 	store        *storage.Store
 	orchestrator *orchestrator.Orchestrator
+	eventSources []eventSourceBinding
+	slots        *slotScheduler // Limits concurrent executions to config.MaxConcurrency, sharing them fairly
+	breakers     *breakerRegistry
+	schemas      *schemaCache     // Compiled event schemas of functions
+	quotas       *functionQuotas  // Limits concurrent executions of each function to its MaxConcurrency
+	dedup        *dedupCache      // Results of recent invocations of functions with a dedup window
+	cache        *resultCache     // Results of invocations of functions with a cache TTL
+	rates        *invocationRates // Recent invocations of each function, for the scaling hints
+	jobQueue     chan string      // IDs of the jobs waiting for a worker
+	jobWaiters   jobWaiters
+	jobsMu       sync.Mutex                    // Serializes job status changes between workers and cancellations
+	runningJobs  map[string]context.CancelFunc // Cancels the executions of running jobs, by job ID
+	deployHooks  []DeployHook
+	invokeHooks  []InvokeHook
 	log          *logrus.Logger
 }
 
+// ErrExecutionTimeout is returned when a function exceeds the execution
+// timeout. Invoke hooks see it as the error of the execution.
+var ErrExecutionTimeout = errors.New("function execution timed out")
+
+// validUser matches a container user spec: a user name or UID, optionally
+// followed by a group name or GID (e.g. "app", "1000:1000").
+var validUser = regexp.MustCompile(`^([a-z_][a-z0-9_.-]*|[0-9]+)(:([a-z_][a-z0-9_.-]*|[0-9]+))?$`)
+
+// validDigest matches an image content digest.
+var validDigest = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// validEnvName matches an environment variable name.
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validSecretName matches a secret name, which is also a file name.
+var validSecretName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// validLabelKey matches a function label key.
+var validLabelKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// validHostname matches a host name, as in an /etc/hosts entry.
+var validHostname = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
 // NewServer initializes the server with its dependencies.
-func NewServer(store *storage.Store, log *logrus.Logger) (*Server, error) {
+func NewServer(config Config, store *storage.Store, log *logrus.Logger) (*Server, error) {
 	// Initizalize the orchestrator - which is the Docker container
 	// manager.
-	orch, err := orchestrator.NewOrchestrator(log)
+	orch, err := orchestrator.NewOrchestrator(orchestrator.Config{
+		Engine:          config.RuntimeEngine,
+		Host:            config.EngineHost,
+		DefaultUser:     config.DefaultUser,
+		APITimeout:      config.DockerAPITimeout,
+		MaxConcurrency:  config.MaxConcurrency,
+		MaxOutputBytes:  config.MaxOutputBytes,
+		StopGracePeriod: config.StopGracePeriod,
+		FunctionLogDir:  config.FunctionLogDir,
+		AlwaysPull:      config.AlwaysPull,
+		Snapshots:       config.Snapshots,
+		SnapshotDir:     config.SnapshotDir,
+		SnapshotDelay:   config.SnapshotDelay,
+	}, log)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize orchestrator: %v", err)
 	}
 
-	return &Server{
+	s := &Server{
+		config:       config,
 		store:        store,
 		orchestrator: orch,
+		slots:        newSlotScheduler(config.MaxConcurrency),
+		breakers:     newBreakerRegistry(config.BreakerThreshold, config.BreakerWindow, config.BreakerCooldown),
+		schemas:      newSchemaCache(),
+		quotas:       newFunctionQuotas(),
+		dedup:        newDedupCache(),
+		cache:        newResultCache(),
+		rates:        newInvocationRates(),
+		jobQueue:     make(chan string, jobQueueSize),
+		runningJobs:  make(map[string]context.CancelFunc),
 		log:          log,
-	}, nil
+	}
+
+	if len(config.AllowedRegistries) > 0 {
+		s.AddDeployHook(registryAllowlist{registries: config.AllowedRegistries})
+	}
+
+	for _, source := range config.EventSources {
+		if err := s.AddEventSource(source); err != nil {
+			return nil, fmt.Errorf("failed to configure event source for %s: %v", source.Function, err)
+		}
+	}
+
+	return s, nil
 }
 
 // Run starts the HTTP server, listening for function deployment and invocation requests.
-func (s *Server) Run(ctx context.Context, addr string) error {
+func (s *Server) Run(ctx context.Context) error {
+	addr := s.config.Addr
+	// Start consuming from the configured event sources, they stop once
+	// the context is cancelled
+	s.startEventSources(ctx)
+
+	s.startJobWorkers(ctx)
+
+	if s.config.GCInterval > 0 {
+		go s.runGC(ctx, s.config.GCInterval)
+	}
+
+	if len(s.config.BaseImages) > 0 {
+		go s.pullBaseImages(ctx)
+	}
+
+	if s.config.InvocationRetention > 0 || s.config.MaxInvocations > 0 {
+		go s.runRetention(ctx)
+	}
+
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/functions", s.handleDeploy)
-	mux.HandleFunc("/invoke/", s.handleInvoke)
+	mux.HandleFunc("/functions", s.handleFunctions)
+	mux.HandleFunc("/functions/", s.handleFunction)
+	mux.HandleFunc("/functions/export", s.handleExport)
+	mux.Handle("/invoke", gzipResponses(http.HandlerFunc(s.handleInvokeAll)))
+	mux.Handle("/invoke/", gzipResponses(http.HandlerFunc(s.handleInvoke)))
+	mux.HandleFunc("/gc", s.handleGC)
+	mux.HandleFunc("/containers", s.handleContainers)
+	mux.HandleFunc("/prune", s.handlePrune)
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/scaling/hints", s.handleScalingHints)
+	mux.HandleFunc("/ws/", s.handleWebSocket)
+	mux.HandleFunc("/jobs/", s.handleJob)
+	mux.HandleFunc("/aliases/", s.handleAlias)
+	mux.HandleFunc("/audit", s.handleAudit)
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/openapi.json", s.handleOpenAPI)
+	if s.config.UI {
+		mux.Handle("/ui/", s.uiHandler())
+	}
+
+	handler := chain(mux, s.middlewares()...)
 
 	server := &http.Server{
 		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  30 * time.Second,
+		Handler:      handler,
+		ReadTimeout:  s.config.ReadTimeout,
+		WriteTimeout: s.config.WriteTimeout,
+		IdleTimeout:  s.config.IdleTimeout,
 	}
 
 	// Server is running in goroutine so we can handle
 	// signals, like shutdown in the main thread
-	serverErr := make(chan error, 1)
+	serverErr := make(chan error, 2)
+	var grpcServer *grpc.Server
+	if s.config.GRPCAddr != "" {
+		var err error
+		if grpcServer, err = s.startGRPC(serverErr); err != nil {
+			return err
+		}
+		defer grpcServer.Stop()
+	}
 	go func() {
-		s.log.WithField("addr", addr).Info("Starting HTTP server")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if s.config.TLSCert != "" {
+			s.log.WithField("addr", addr).Info("Starting HTTPS server")
+			err = server.ListenAndServeTLS(s.config.TLSCert, s.config.TLSKey)
+		} else {
+			s.log.WithField("addr", addr).Info("Starting HTTP server")
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			serverErr <- fmt.Errorf("server failed: %v", err)
 		}
 	}()
@@ -73,6 +212,9 @@ func (s *Server) Run(ctx context.Context, addr string) error {
 		// Graceful shutdown
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
+		if grpcServer != nil {
+			stopGRPC(shutdownCtx, grpcServer)
+		}
 		if err := server.Shutdown(shutdownCtx); err != nil {
 			s.log.WithError(err).Warn("Server shutdown failed")
 			return fmt.Errorf("server shutdown failed: %v", err)
@@ -83,20 +225,70 @@ func (s *Server) Run(ctx context.Context, addr string) error {
 	}
 }
 
-// handeDeploy processes function deployment requests (POST /functions).
-func (s *Server) handleDeploy(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		s.log.WithField("method", r.Method).Warn("Invalid method for deploy")
+// functionMetadata is the description of a function given when deploying it.
+type functionMetadata struct {
+	Name           string            `json:"name"`
+	Image          string            `json:"image"`
+	Digest         string            `json:"digest"`
+	Platforms      []string          `json:"platforms"` // Platforms of the image, e.g. linux/arm64
+	Runtime        string            `json:"runtime"`
+	User           string            `json:"user"`
+	WorkingDir     string            `json:"working_dir"`
+	StopSignal     string            `json:"stop_signal"` // Signal the function is stopped with, e.g. SIGINT
+	Entrypoint     []string          `json:"entrypoint"`
+	Args           []string          `json:"args"`
+	Env            map[string]string `json:"env"`
+	Labels         map[string]string `json:"labels"`
+	MemoryBytes    int64             `json:"memory_bytes"`
+	NanoCPUs       int64             `json:"nano_cpus"`
+	DNS            []string          `json:"dns"`
+	ExtraHosts     []string          `json:"extra_hosts"`
+	MaxOutputBytes int64             `json:"max_output_bytes"`
+	MaxConcurrency int               `json:"max_concurrency"`
+	EventSchema    json.RawMessage   `json:"event_schema"`
+	DefaultEvent   json.RawMessage   `json:"default_event"`
+	MaxRetries     int               `json:"max_retries"`
+	RetryBackoffMs int64             `json:"retry_backoff_ms"`
+	DedupWindowMs  int64             `json:"dedup_window_ms"`
+	CacheTTLMs     int64             `json:"cache_ttl_ms"`
+	TimeoutMs      int64             `json:"timeout_ms"` // Execution timeout, 0 for the server's
+	ExitStatuses   map[string]int    `json:"exit_statuses"`
+	ContentType    string            `json:"content_type"`
+	EventFormat    string            `json:"event_format"`    // json, msgpack or raw, empty for json
+	ResponseFormat string            `json:"response_format"` // json, msgpack or raw, empty for json
+	LogDestination string            `json:"log_destination"`
+	LogPayloads    bool              `json:"log_payloads"` // Log the event and output of executions
+	RedactPaths    []string          `json:"redact_paths"` // Masked in the logged payloads, e.g. user.email
+	Secrets        map[string]string `json:"secrets"`      // Values are stored apart from the metadata
+	ReadonlyRootfs *bool             `json:"readonly_rootfs"`
+	WritableTmp    *bool             `json:"writable_tmp"`
+	AlwaysPull     *bool             `json:"always_pull"`  // Unset follows the server's always_pull
+	Snapshot       bool              `json:"snapshot"`     // Restore from a checkpoint, when the server has snapshots enabled
+	RunOnce        bool              `json:"run_once"`     // Refuse invocations once a run completed, unless forced
+	VerifyImage    bool              `json:"verify_image"` // Check the image exists before storing the function
+	PinDigest      bool              `json:"pin_digest"`   // Without a digest, pin the image the tag refers to, pulling it if it's missing
+	KeepSecrets    bool              `json:"keep_secrets"` // Without secrets, keep those of the function being replaced
+}
+
+// handleFunctions processes requests for the collection of functions
+// (/functions): listing them and deploying one.
+func (s *Server) handleFunctions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleList(w, r)
+	case http.MethodPost:
+		s.handleDeploy(w, r)
+	default:
+		s.log.WithField("method", r.Method).Warn("Invalid method for functions")
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
 	}
+}
 
+// handeDeploy processes function deployment requests (POST /functions).
+func (s *Server) handleDeploy(w http.ResponseWriter, r *http.Request) {
 	// Parse request body
-	var metadata struct {
-		Name    string `json:"name"`
-		Image   string `json:"image"`
-		Runtime string `json:"runtime"`
-	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxPayloadBytes)
+	var metadata functionMetadata
 	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
 		s.log.WithError(err).Warn("Invalid deploy request body")
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -109,21 +301,508 @@ func (s *Server) handleDeploy(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing required fields", http.StatusBadRequest)
 		return
 	}
+	function, err := metadata.function()
+	if err == nil {
+		err = s.applyImageDefaults(r.Context(), function)
+	}
+	if err == nil {
+		err = s.checkTimeout(function)
+	}
+	if err == nil {
+		err = s.checkLogDestination(function)
+	}
+	if err != nil {
+		s.log.WithError(err).WithField("function", metadata.Name).Warn("Invalid function metadata")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.beforeDeploy(r.Context(), function); err != nil {
+		s.log.WithError(err).WithField("function", function.Name).Warn("Deploy rejected by hook")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// A prebuilt image may be checked first, so a typo in its reference is
+	// caught now rather than by the first invocation
+	if metadata.VerifyImage && !s.verifyImage(w, r, function) {
+		return
+	}
+	if metadata.PinDigest && function.Digest == "" && !s.pinDigest(w, r, function) {
+		return
+	}
+
+	secrets, err := s.deploySecrets(r.Context(), &metadata, function)
+	if err != nil {
+		http.Error(w, "Failed to get secrets", http.StatusInternalServerError)
+		return
+	}
 
 	// Store the function in the database
-	if err := s.store.CreateFunction(metadata.Name, metadata.Image, metadata.Runtime); err != nil {
-		s.log.WithError(err).WithField("function", metadata.Name).Error("Failed to store function")
+	if err := s.saveFunction(r.Context(), function, secrets, requestActor(r)); err != nil {
 		http.Error(w, "Failed to store function", http.StatusInternalServerError)
 		return
 	}
 
-	// Log success
-	s.log.WithField("function", metadata.Name).Info("Function deployed successfully")
-	// Return 200 OK
+	// Echo the timeout the function runs with, so the deployer knows the
+	// contract it's held to
+	s.writeJSON(w, http.StatusOK, deployResult{
+		Name:      function.Name,
+		TimeoutMs: s.executionTimeout(function).Milliseconds(),
+	})
+}
+
+// deployResult is the response to a successful deploy.
+type deployResult struct {
+	Name      string `json:"name"`
+	TimeoutMs int64  `json:"timeout_ms"` // Effective execution timeout of the function
+}
+
+// executionTimeout returns how long a function's executions may run: its own
+// timeout, or the server's execution timeout.
+func (s *Server) executionTimeout(function *storage.Function) time.Duration {
+	if function.TimeoutMs > 0 {
+		return time.Duration(function.TimeoutMs) * time.Millisecond
+	}
+	return s.config.ExecutionTimeout
+}
+
+// checkTimeout rejects a function timeout beyond the server's maximum.
+func (s *Server) checkTimeout(function *storage.Function) error {
+	limit := s.config.MaxExecutionTimeout
+	if limit == 0 {
+		limit = s.config.ExecutionTimeout
+	}
+	if timeout := time.Duration(function.TimeoutMs) * time.Millisecond; timeout > limit {
+		return fmt.Errorf("timeout %v exceeds the server's maximum of %v", timeout, limit)
+	}
+	return nil
+}
+
+// checkLogDestination rejects a file log destination when the server has no
+// function log directory to keep it in.
+func (s *Server) checkLogDestination(function *storage.Function) error {
+	if strings.HasPrefix(function.LogDestination, functionio.LogToFile) && s.config.FunctionLogDir == "" {
+		return fmt.Errorf("log destination %s is disabled, the server has no function_log_dir", function.LogDestination)
+	}
+	return nil
+}
+
+// secretNames returns the names of secrets, sorted.
+func secretNames(secrets map[string]string) []string {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// deploySecrets returns the secrets a deployed function is stored with: those
+// of the metadata, or with keep_secrets and none given, those of the function
+// it replaces, which it then lists. Shared by the HTTP and gRPC APIs.
+func (s *Server) deploySecrets(ctx context.Context, metadata *functionMetadata, function *storage.Function) (map[string]string, error) {
+	if !metadata.KeepSecrets || len(metadata.Secrets) > 0 {
+		return metadata.Secrets, nil
+	}
+	secrets, err := s.store.GetSecrets(ctx, function.Name)
+	if err != nil {
+		s.log.WithError(err).WithField("function", function.Name).Error("Failed to get secrets")
+		return nil, err
+	}
+	function.SecretNames = secretNames(secrets)
+	return secrets, nil
+}
+
+// saveFunction stores a deployed function, shared by the HTTP and gRPC APIs.
+func (s *Server) saveFunction(ctx context.Context, function *storage.Function, secrets map[string]string, actor string) error {
+	if err := s.store.SaveFunction(function, secrets); err != nil {
+		s.log.WithError(err).WithField("function", function.Name).Error("Failed to store function")
+		return err
+	}
+	s.warmSchema(function)
+
+	// Results of the previous deploy may no longer hold
+	s.cache.invalidate(function.Name)
+
+	s.log.WithField("function", function.Name).Info("Function deployed successfully")
+	s.recordAudit(actor, storage.AuditDeploy, function.Name, deployedImage(function))
+	s.afterDeploy(ctx, function)
+	return nil
+}
+
+// validateExtraHost checks an extra /etc/hosts entry, given as host:ip. The
+// IP may be an IPv6 address, or host-gateway for the address of the host.
+func validateExtraHost(entry string) error {
+	host, ip, ok := strings.Cut(entry, ":")
+	if !ok || !validHostname.MatchString(host) {
+		return fmt.Errorf("invalid extra host %q, expected host:ip", entry)
+	}
+	if ip != "host-gateway" && net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid IP address %q of extra host %s", ip, host)
+	}
+	return nil
+}
+
+// function validates the metadata and converts it to a function record.
+func (m *functionMetadata) function() (*storage.Function, error) {
+	if m.Digest != "" && !validDigest.MatchString(m.Digest) {
+		return nil, fmt.Errorf("invalid digest %q, expected sha256:<64 hex digits>", m.Digest)
+	}
+	for _, platform := range m.Platforms {
+		if !orchestrator.ValidPlatform(platform) {
+			return nil, fmt.Errorf("invalid platform %q, expected os/arch such as linux/arm64", platform)
+		}
+	}
+	if m.User != "" && !validUser.MatchString(m.User) {
+		return nil, fmt.Errorf("invalid user %q, expected user[:group] as names or numeric IDs", m.User)
+	}
+	if m.WorkingDir != "" && !path.IsAbs(m.WorkingDir) {
+		return nil, fmt.Errorf("working directory %q must be an absolute path", m.WorkingDir)
+	}
+	if m.StopSignal != "" && !stopsignal.Valid(m.StopSignal) {
+		return nil, fmt.Errorf("unknown stop signal %q, expected a signal name such as SIGINT", m.StopSignal)
+	}
+	if hasEmpty(m.Entrypoint) || hasEmpty(m.Args) {
+		return nil, fmt.Errorf("entrypoint and arguments must be non-empty strings")
+	}
+	for name := range m.Env {
+		if !validEnvName.MatchString(name) {
+			return nil, fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+	for name := range m.Secrets {
+		if !validSecretName.MatchString(name) {
+			return nil, fmt.Errorf("invalid secret name %q, names are alphanumeric with . _ -", name)
+		}
+	}
+	for key, value := range m.Labels {
+		if !validLabelKey.MatchString(key) || strings.Contains(value, ",") {
+			return nil, fmt.Errorf("invalid label %q, keys are alphanumeric with . _ / - and values can't contain commas", key)
+		}
+	}
+	for _, server := range m.DNS {
+		if net.ParseIP(server) == nil {
+			return nil, fmt.Errorf("invalid DNS server %q, expected an IP address", server)
+		}
+	}
+	for _, entry := range m.ExtraHosts {
+		if err := validateExtraHost(entry); err != nil {
+			return nil, err
+		}
+	}
+	if m.MemoryBytes < 0 || m.NanoCPUs < 0 || m.MaxOutputBytes < 0 {
+		return nil, fmt.Errorf("memory_bytes, nano_cpus and max_output_bytes must not be negative")
+	}
+	eventSchema := string(m.EventSchema)
+	if eventSchema == "null" {
+		eventSchema = ""
+	}
+	if eventSchema != "" {
+		if _, err := compileSchema(eventSchema); err != nil {
+			return nil, err
+		}
+	}
+	defaultEvent := string(m.DefaultEvent)
+	if defaultEvent == "null" {
+		defaultEvent = ""
+	}
+	if defaultEvent != "" {
+		var object map[string]any
+		if err := json.Unmarshal(m.DefaultEvent, &object); err != nil {
+			return nil, fmt.Errorf("default event must be a JSON object")
+		}
+	}
+	if err := validateExitStatuses(m.ExitStatuses); err != nil {
+		return nil, err
+	}
+	if m.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(m.ContentType); err != nil {
+			return nil, fmt.Errorf("invalid content type %q: %v", m.ContentType, err)
+		}
+	}
+	if !functionio.ValidFormat(m.EventFormat) || !functionio.ValidFormat(m.ResponseFormat) {
+		return nil, fmt.Errorf("invalid event or response format, expected json, msgpack or raw")
+	}
+	// Raw events aren't interpreted, and may not be JSON at all
+	if m.EventFormat == functionio.FormatRaw && (len(m.EventSchema) > 0 || len(m.DefaultEvent) > 0) {
+		return nil, fmt.Errorf("event_schema and default_event need JSON events, not raw ones")
+	}
+	if m.ResponseFormat == functionio.FormatMsgpack && m.ContentType != "" {
+		if mediaType, _, _ := mime.ParseMediaType(m.ContentType); mediaType == eventStreamType {
+			return nil, fmt.Errorf("event streams are passed through as written, they can't have the msgpack response format")
+		}
+	}
+	if !functionio.ValidLogDestination(m.LogDestination) {
+		return nil, fmt.Errorf("invalid log destination %q, expected log, stdout, none or file:<path in the function log directory>", m.LogDestination)
+	}
+	if err := validateRedactPaths(m.RedactPaths); err != nil {
+		return nil, err
+	}
+	if m.DedupWindowMs < 0 || m.CacheTTLMs < 0 || m.TimeoutMs < 0 {
+		return nil, fmt.Errorf("dedup_window_ms, cache_ttl_ms and timeout_ms must not be negative")
+	}
+	if m.MaxConcurrency < 0 {
+		return nil, fmt.Errorf("max_concurrency must not be negative")
+	}
+	if m.MaxRetries < 0 || m.RetryBackoffMs < 0 {
+		return nil, fmt.Errorf("max_retries and retry_backoff_ms must not be negative")
+	}
+
+	return &storage.Function{
+		Name:           m.Name,
+		Image:          m.Image,
+		Digest:         m.Digest,
+		Platforms:      m.Platforms,
+		Runtime:        m.Runtime,
+		User:           m.User,
+		WorkingDir:     m.WorkingDir,
+		StopSignal:     m.StopSignal,
+		Entrypoint:     m.Entrypoint,
+		Args:           m.Args,
+		Env:            m.Env,
+		Labels:         m.Labels,
+		MemoryBytes:    m.MemoryBytes,
+		NanoCPUs:       m.NanoCPUs,
+		DNS:            m.DNS,
+		ExtraHosts:     m.ExtraHosts,
+		MaxOutputBytes: m.MaxOutputBytes,
+		MaxConcurrency: m.MaxConcurrency,
+		EventSchema:    eventSchema,
+		DefaultEvent:   defaultEvent,
+		MaxRetries:     m.MaxRetries,
+		RetryBackoffMs: m.RetryBackoffMs,
+		DedupWindowMs:  m.DedupWindowMs,
+		CacheTTLMs:     m.CacheTTLMs,
+		TimeoutMs:      m.TimeoutMs,
+		ExitStatuses:   m.ExitStatuses,
+		ContentType:    m.ContentType,
+		EventFormat:    m.EventFormat,
+		ResponseFormat: m.ResponseFormat,
+		LogDestination: m.LogDestination,
+		LogPayloads:    m.LogPayloads,
+		RedactPaths:    m.RedactPaths,
+		SecretNames:    secretNames(m.Secrets),
+		AlwaysPull:     m.AlwaysPull,
+		Snapshot:       m.Snapshot,
+		RunOnce:        m.RunOnce,
+		// Functions are hardened unless they opt out, with /tmp left for scratch files
+		ReadonlyRootfs: m.ReadonlyRootfs == nil || *m.ReadonlyRootfs,
+		WritableTmp:    m.WritableTmp == nil || *m.WritableTmp,
+	}, nil
+}
+
+// handleHealth reports that the server is up (/healthz).
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// defaultContentType is the media type of the output of functions that don't
+// declare their own.
+const defaultContentType = "application/json"
+
+// contentType returns the media type of a function's output. Raw output is
+// arbitrary bytes unless the function says otherwise, while MessagePack
+// output is returned as JSON.
+func contentType(function *storage.Function) string {
+	if function.ContentType != "" {
+		return function.ContentType
+	}
+	if function.ResponseFormat == functionio.FormatRaw {
+		return "application/octet-stream"
+	}
+	return defaultContentType
+}
+
+// hasEmpty reports whether any of the values is an empty string.
+func hasEmpty(values []string) bool {
+	for _, v := range values {
+		if v == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// functionDetails is the full description of a deployed function.
+type functionDetails struct {
+	Name           string            `json:"name"`
+	Image          string            `json:"image"`
+	Digest         string            `json:"digest,omitempty"`
+	Platforms      []string          `json:"platforms,omitempty"`
+	Runtime        string            `json:"runtime"`
+	User           string            `json:"user,omitempty"`
+	WorkingDir     string            `json:"working_dir,omitempty"`
+	StopSignal     string            `json:"stop_signal,omitempty"`
+	Entrypoint     []string          `json:"entrypoint,omitempty"`
+	Args           []string          `json:"args,omitempty"`
+	Env            []string          `json:"env,omitempty"` // Only the names, values may hold credentials
+	Labels         map[string]string `json:"labels,omitempty"`
+	MemoryBytes    int64             `json:"memory_bytes,omitempty"`
+	NanoCPUs       int64             `json:"nano_cpus,omitempty"`
+	DNS            []string          `json:"dns,omitempty"`
+	ExtraHosts     []string          `json:"extra_hosts,omitempty"`
+	MaxOutputBytes int64             `json:"max_output_bytes,omitempty"`
+	MaxConcurrency int               `json:"max_concurrency,omitempty"`
+	EventSchema    json.RawMessage   `json:"event_schema,omitempty"`
+	DefaultEvent   json.RawMessage   `json:"default_event,omitempty"`
+	MaxRetries     int               `json:"max_retries"`
+	RetryBackoffMs int64             `json:"retry_backoff_ms"`
+	DedupWindowMs  int64             `json:"dedup_window_ms,omitempty"`
+	CacheTTLMs     int64             `json:"cache_ttl_ms,omitempty"`
+	TimeoutMs      int64             `json:"timeout_ms,omitempty"`
+	ExitStatuses   map[string]int    `json:"exit_statuses,omitempty"`
+	ContentType    string            `json:"content_type"`
+	EventFormat    string            `json:"event_format,omitempty"`
+	ResponseFormat string            `json:"response_format,omitempty"`
+	LogDestination string            `json:"log_destination,omitempty"`
+	LogPayloads    bool              `json:"log_payloads,omitempty"`
+	RedactPaths    []string          `json:"redact_paths,omitempty"`
+	Secrets        []string          `json:"secrets,omitempty"` // Only the names, values are never returned
+	ReadonlyRootfs bool              `json:"readonly_rootfs"`
+	WritableTmp    bool              `json:"writable_tmp"`
+	AlwaysPull     *bool             `json:"always_pull,omitempty"`
+	Snapshot       bool              `json:"snapshot,omitempty"`
+	RunOnce        bool              `json:"run_once,omitempty"`
+	CompletedAt    *time.Time        `json:"completed_at,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	DeletedAt      *time.Time        `json:"deleted_at,omitempty"`
+
+	CircuitBreaker *breakerStatus `json:"circuit_breaker,omitempty"`
+}
+
+// newFunctionDetails builds the description of a function from its record.
+func newFunctionDetails(function *storage.Function) functionDetails {
+	details := functionDetails{
+		Name:           function.Name,
+		Image:          function.Image,
+		Digest:         function.Digest,
+		Platforms:      function.Platforms,
+		Runtime:        function.Runtime,
+		User:           function.User,
+		WorkingDir:     function.WorkingDir,
+		StopSignal:     function.StopSignal,
+		Entrypoint:     function.Entrypoint,
+		Args:           function.Args,
+		Env:            envNames(function.Env),
+		Labels:         function.Labels,
+		MemoryBytes:    function.MemoryBytes,
+		NanoCPUs:       function.NanoCPUs,
+		DNS:            function.DNS,
+		ExtraHosts:     function.ExtraHosts,
+		MaxOutputBytes: function.MaxOutputBytes,
+		MaxConcurrency: function.MaxConcurrency,
+		EventSchema:    json.RawMessage(function.EventSchema),
+		DefaultEvent:   json.RawMessage(function.DefaultEvent),
+		MaxRetries:     function.MaxRetries,
+		RetryBackoffMs: function.RetryBackoffMs,
+		DedupWindowMs:  function.DedupWindowMs,
+		CacheTTLMs:     function.CacheTTLMs,
+		TimeoutMs:      function.TimeoutMs,
+		ExitStatuses:   function.ExitStatuses,
+		ContentType:    contentType(function),
+		EventFormat:    function.EventFormat,
+		ResponseFormat: function.ResponseFormat,
+		LogDestination: function.LogDestination,
+		LogPayloads:    function.LogPayloads,
+		RedactPaths:    function.RedactPaths,
+		Secrets:        function.SecretNames,
+		ReadonlyRootfs: function.ReadonlyRootfs,
+		WritableTmp:    function.WritableTmp,
+		AlwaysPull:     function.AlwaysPull,
+		Snapshot:       function.Snapshot,
+		RunOnce:        function.RunOnce,
+		CompletedAt:    function.CompletedAt,
+		CreatedAt:      function.CreatedAt,
+		UpdatedAt:      function.UpdatedAt,
+	}
+	if function.DeletedAt.Valid {
+		details.DeletedAt = &function.DeletedAt.Time
+	}
+	return details
+}
+
+// envNames returns the sorted names of a function's environment variables.
+func envNames(env map[string]string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handleFunction processes requests for a single function (/functions/{name}).
+// Sub-resources of the function are dispatched to their own handlers.
+func (s *Server) handleFunction(w http.ResponseWriter, r *http.Request) {
+	functionName, subresource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/functions/"), "/")
+	if functionName == "" {
+		s.log.Warn("Missing function name in request")
+		http.Error(w, "Function name required", http.StatusBadRequest)
+		return
+	}
+
+	switch subresource {
+	case "":
+	case "logs/stream":
+		s.handleLogStream(w, r, functionName)
+		return
+	case "warm":
+		s.handleWarm(w, r, functionName)
+		return
+	case "restore":
+		s.handleRestore(w, r, functionName)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.handleDescribe(w, r, functionName)
+	case http.MethodPatch:
+		s.handlePatch(w, r, functionName)
+	case http.MethodDelete:
+		s.handleDelete(w, r, functionName)
+	default:
+		s.log.WithField("method", r.Method).Warn("Invalid method for function")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDescribe returns the full metadata of a function (GET /functions/{name}).
+func (s *Server) handleDescribe(w http.ResponseWriter, r *http.Request, functionName string) {
+	function, err := s.lookupFunction(r, functionName)
+	if err != nil {
+		s.lookupFailed(w, functionName, err)
+		return
+	}
+
+	details := newFunctionDetails(function)
+	if s.config.BreakerThreshold > 0 {
+		status := s.breakers.get(functionName).status()
+		details.CircuitBreaker = &status
+	}
+	s.writeJSON(w, http.StatusOK, details)
+}
+
+// writeJSON writes v as a JSON response with the given status.
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.log.WithError(err).Warn("Failed to write response")
+	}
 }
 
 // handleInvoke processes function invocation requests (POST /invoke{name}).
+// ?digest= invokes a revision of the function, see pinRevision.
 func (s *Server) handleInvoke(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		s.log.WithField("method", r.Method).Warn("Invalid method for invoke")
@@ -131,6 +810,20 @@ func (s *Server) handleInvoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	began := time.Now()
+
+	// The caller's deadline bounds the execution along with the function's
+	// timeout
+	if value := r.Header.Get(deadlineHeader); value != "" {
+		deadline, err := parseDeadline(value, began)
+		if err != nil {
+			s.log.WithError(err).Warn("Invalid invoke deadline")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r = r.WithContext(withCallerDeadline(r.Context(), deadline))
+	}
+
 	// Get function name from the URL path (/invoke/{name})
 	functionName := strings.TrimPrefix(r.URL.Path, "/invoke/")
 	if functionName == "" {
@@ -139,36 +832,490 @@ func (s *Server) handleInvoke(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve function metadata from storage
-	function, err := s.store.GetFunction(functionName)
+	// Retrieve function metadata from storage, resolving aliases
+	function, err := s.resolveFunction(r.Context(), functionName)
 	if err != nil {
-		s.log.WithError(err).WithField("function", functionName).Warn("Function not found")
-		http.Error(w, "Function not found", http.StatusNotFound)
+		s.lookupFailed(w, functionName, err)
 		return
 	}
 
-	// Read the event payload from the request body
-	event, err := io.ReadAll(r.Body)
+	// ?digest= runs the image of an earlier deployment instead of the
+	// current one
+	digest := r.URL.Query().Get("digest")
+	if digest != "" {
+		pinned, err := s.pinRevision(r.Context(), function, digest)
+		if err != nil {
+			s.pinFailed(w, function, digest, err)
+			return
+		}
+		function = pinned
+	}
+
+	// Read the event payload from the request body, which may be compressed.
+	// The files of multipart invocations are mounted in the container
+	// instead, and the event describes them
+	var event []byte
+	if isMultipart(r) {
+		if r.Header.Get(asyncHeader) == "true" {
+			s.log.WithField("function", functionName).Warn("Asynchronous invocation with uploads")
+			http.Error(w, "Files can't be uploaded to asynchronous invocations", http.StatusBadRequest)
+			return
+		}
+		var dir string
+		var removeUploads func()
+		event, dir, removeUploads, err = s.receiveUploads(w, r)
+		if err == nil {
+			defer removeUploads()
+			r = r.WithContext(orchestrator.WithUploads(r.Context(), dir))
+		}
+	} else {
+		event, err = readBody(w, r, s.config.MaxPayloadBytes)
+	}
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			s.log.WithField("limit", maxBytesErr.Limit).Warn("Invoke event too large")
+			http.Error(w, fmt.Sprintf("Event exceeds %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		var encodingErr *unsupportedEncodingError
+		if errors.As(err, &encodingErr) {
+			s.log.WithError(err).Warn("Unsupported invoke event encoding")
+			http.Error(w, "Unsupported Content-Encoding, use gzip or none", http.StatusUnsupportedMediaType)
+			return
+		}
 		s.log.WithError(err).Warn("Failed to read invoke event")
 		http.Error(w, "Failed to read event", http.StatusBadRequest)
 		return
 	}
 
-	// Execute the function via the orchestrator
-	result, err := s.orchestrator.Execute(context.Background(), function, event)
+	// Fill in the function's defaults, then reject events that don't match
+	// its schema before running it
+	event, err = applyDefaultEvent(function, event)
+	if err == nil {
+		err = s.validateEvent(function, event)
+	}
 	if err != nil {
-		s.log.WithError(err).WithField("function", functionName).Error("Function execution failed")
-		http.Error(w, fmt.Sprintf("Function execution failed: %v", err), http.StatusInternalServerError)
+		var validationErr *eventValidationError
+		if errors.As(err, &validationErr) {
+			s.log.WithField("function", functionName).Warn("Event doesn't match schema")
+			s.writeJSON(w, http.StatusUnprocessableEntity, validationErr)
+			return
+		}
+		s.log.WithError(err).WithField("function", functionName).Error("Failed to validate event")
+		http.Error(w, fmt.Sprintf("Failed to validate event: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	// A run_once function that completed only runs again when forced
+	force := r.URL.Query().Get("force") == "true"
+	if function.RunOnce && function.CompletedAt != nil && !force {
+		s.invokeFailed(w, r, function, began, errAlreadyCompleted)
+		return
+	}
+	if force {
+		r = r.WithContext(withForcedRun(r.Context()))
+	}
+
+	if r.Header.Get(asyncHeader) == "true" {
+		// The job runs the revision picked here, as the alias's weights
+		// may pick another one once it starts
+		if function.Name != functionName {
+			digest = function.Digest
+		}
+		s.handleAsyncInvoke(w, function, digest, force, event)
+		return
+	}
+
+	// Event streams are passed to the client as the function writes them,
+	// so they're neither cached nor deduplicated
+	if isEventStream(function) && r.Header.Get(proxyHeader) != "true" {
+		s.streamInvoke(w, r, function, began, event)
+		return
+	}
+
+	// Functions with a cache TTL get a recent result for the same event,
+	// unless the client asks for a fresh one
+	cacheKey := eventKey(function, event)
+	cacheTTL := time.Duration(function.CacheTTLMs) * time.Millisecond
+	if cacheTTL > 0 && !bypassCache(r) {
+		if result, ok := s.cache.get(cacheKey); ok {
+			s.log.WithField("function", functionName).Debug("Invocation answered from cache")
+			w.Header().Set(cacheHeader, "HIT")
+			s.writeResult(w, r, function, result)
+			return
+		}
+	}
+
+	// The execution is bounded by its timeout, which may be longer than the
+	// server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		s.log.WithError(err).Warn("Failed to clear write deadline")
+	}
+
+	// Execute the function via the orchestrator. The request context is
+	// passed so that a client disconnect cancels the container execution.
+	result, err := s.invoke(r.Context(), function, event)
+	if err != nil {
+		if r.Context().Err() != nil {
+			s.invokeLog(r, function, began, nil, err).Warn("Client disconnected, invocation cancelled")
+			return
+		}
+		s.invokeFailed(w, r, function, began, err)
+		return
+	}
+
+	if cacheTTL > 0 {
+		s.cache.put(cacheKey, result, cacheTTL)
+		w.Header().Set(cacheHeader, "MISS")
+	}
+	s.invokeLog(r, function, began, result, nil).Info("Function invoked")
+	s.writeResult(w, r, function, result)
+}
+
+// invokeLog returns the logger of an invocation that began at began, with
+// the function, the request ID, the duration and, once the function ran, the
+// size of its output and its exit code.
+func (s *Server) invokeLog(r *http.Request, function *storage.Function, began time.Time, result *orchestrator.Result, err error) *logrus.Entry {
+	fields := logrus.Fields{
+		"function":   function.Name,
+		"request_id": requestIDFrom(r.Context()),
+		"duration":   time.Since(began),
+	}
+	if result != nil {
+		fields["output_bytes"] = len(result.Output)
+		fields["cold_start"] = result.ColdStart
+	}
+	var exitErr *orchestrator.ExitError
+	switch {
+	case err == nil:
+		fields["exit_code"] = 0
+	case errors.As(err, &exitErr):
+		fields["exit_code"] = exitErr.Code
+		fields["output_bytes"] = len(exitErr.Output)
+	}
+	entry := s.log.WithFields(fields)
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	return entry
+}
+
+// invokeFailed replies to a failed synchronous invocation that began at
+// began. Failures the client caused are logged as warnings, the others as
+// errors.
+func (s *Server) invokeFailed(w http.ResponseWriter, r *http.Request, function *storage.Function, began time.Time, err error) {
+	log := s.invokeLog(r, function, began, nil, err)
+	if errors.Is(err, errCircuitOpen) {
+		log.Warn("Invocation rejected by circuit breaker")
+		w.Header().Set("Retry-After", strconv.Itoa(s.breakers.get(function.Name).retryAfter(time.Now())))
+	}
+	if errors.Is(err, ErrConcurrencyLimit) {
+		log.Warn("Invocation rejected, function at its concurrency limit")
+		w.Header().Set("Retry-After", "1")
+	}
+	if status, output, ok := exitStatus(function, err); ok {
+		log.WithField("status", status).Warn("Function exited with a mapped error")
+		w.Header().Set("X-Serverless-Function", function.Name)
+		w.Header().Set("Content-Type", contentType(function))
+		w.WriteHeader(status)
+		w.Write(output)
+		return
+	}
+	status, message := failureStatus(function, err)
+	log = log.WithField("status", status)
+	if status < http.StatusInternalServerError {
+		log.Warn("Function invocation rejected")
+	} else {
+		log.Error("Function execution failed")
+	}
+	http.Error(w, message, status)
+}
+
+// writeResult writes the output of a successful invocation as the response.
+func (s *Server) writeResult(w http.ResponseWriter, r *http.Request, function *storage.Function, result *orchestrator.Result) {
+	functionName := function.Name
+
 	// Set response headers and write the function's output
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Serverless-Function", function.Name)
+	if function.Digest != "" {
+		w.Header().Set("X-Serverless-Digest", function.Digest)
+	}
+	w.Header().Set("X-Serverless-Coldstart", strconv.FormatBool(result.ColdStart))
+	w.Header().Set("X-Serverless-Exec-Ms", strconv.FormatInt(result.Exec.Milliseconds(), 10))
+
+	// In proxy mode the function decides the status, headers and body
+	if r.Header.Get(proxyHeader) == "true" {
+		proxyResp, err := parseProxyResponse(result.Output)
+		if err != nil {
+			s.log.WithError(err).WithField("function", functionName).Warn("Function returned an invalid proxy response")
+			http.Error(w, fmt.Sprintf("Invalid proxy response: %v", err), http.StatusBadGateway)
+			return
+		}
+		if err := writeProxyResponse(w, proxyResp); err != nil {
+			s.log.WithError(err).Warn("Failed to write response")
+		}
+		return
+	}
+
+	// The output is passed through verbatim, labeled with the function's type
+	w.Header().Set("Content-Type", contentType(function))
 	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(result); err != nil {
+	if _, err := w.Write(result.Output); err != nil {
 		s.log.WithError(err).Warn("Failed to write response")
 		// At this point no HTTP error sent, because the headers are
 		// already written
 	}
 }
+
+// invoke executes a function with the given event and records the invocation.
+// It's shared by every trigger (HTTP, event sources). For functions with a
+// dedup window, an event identical to a recent one gets its result instead.
+func (s *Server) invoke(ctx context.Context, function *storage.Function, event []byte) (*orchestrator.Result, error) {
+	if function.DedupWindowMs <= 0 {
+		return s.execute(ctx, function, event)
+	}
+	window := time.Duration(function.DedupWindowMs) * time.Millisecond
+	return s.dedup.do(ctx, eventKey(function, event), window, func() (*orchestrator.Result, error) {
+		return s.execute(ctx, function, event)
+	})
+}
+
+// execute runs a function and records the invocation.
+// Executions beyond the concurrency limit wait for a free slot, while those
+// beyond the function's own limit are rejected, and functions that keep
+// failing are short-circuited by their breaker.
+func (s *Server) execute(ctx context.Context, function *storage.Function, event []byte) (*orchestrator.Result, error) {
+	return s.executeStream(ctx, function, event, nil)
+}
+
+// executeStream is execute, additionally copying the function's output to
+// stdout as it's written, unless stdout is nil.
+func (s *Server) executeStream(ctx context.Context, function *storage.Function, event []byte, stdout io.Writer) (*orchestrator.Result, error) {
+	event, err := s.beforeInvoke(ctx, function, event)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.executeHooked(ctx, function, event, stdout)
+	s.afterInvoke(ctx, function, result, err)
+	return result, err
+}
+
+// executeHooked executes a function once the invoke hooks let it.
+func (s *Server) executeHooked(ctx context.Context, function *storage.Function, event []byte, stdout io.Writer) (*orchestrator.Result, error) {
+	secrets, err := s.functionSecrets(ctx, function)
+	if err != nil {
+		return nil, err
+	}
+
+	admission, err := s.admit(ctx, function)
+	if err != nil {
+		return nil, err
+	}
+
+	// The function is told its effective timeout, see orchestrator.TimeoutEnv,
+	// which the caller's deadline may shorten
+	timeout := s.executionTimeout(function)
+	callerBound := false
+	if deadline, ok := callerDeadline(ctx); ok {
+		if remaining := time.Until(deadline); remaining < timeout {
+			timeout, callerBound = remaining, true
+		}
+	}
+	if timeout <= 0 {
+		admission.cancel()
+		return nil, errDeadlinePassed
+	}
+	execCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	withTimeout := *function
+	withTimeout.TimeoutMs = timeout.Milliseconds()
+	function = &withTimeout
+
+	invocationID := newInvocationID()
+	began := time.Now()
+	result, err := s.orchestrator.ExecuteStream(execCtx, invocationID, function, secrets, event, stdout)
+	if err != nil && ctx.Err() == nil && errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+		err = ErrExecutionTimeout
+	}
+	s.recordInvocation(invocationID, function.Name, result, err, time.Since(began))
+	if function.RunOnce && err == nil {
+		s.markCompleted(function)
+	}
+	if function.LogPayloads {
+		s.logPayloads(invocationID, function, event, result, err)
+	}
+
+	if ctx.Err() != nil || (callerBound && errors.Is(err, ErrExecutionTimeout)) {
+		// Cancelled by the caller, or out of its time, which says nothing
+		// about the function
+		admission.cancel()
+	} else {
+		admission.done(err == nil || clientError(function, err))
+	}
+	return result, err
+}
+
+// admission is an execution let through by admit, holding the function's
+// quota, its breaker's permission and a slot until it ends.
+type admission struct {
+	s        *Server
+	function string
+	breaker  *circuitBreaker // nil without circuit breakers
+}
+
+// admit lets an execution of function start, whether it's an invocation or a
+// session. Executions beyond the function's own limit, of a run_once
+// function that completed, or of a function whose breaker is open are
+// rejected, and the others wait for a slot of the concurrency limit, bounded
+// by the caller's deadline. The admission must be ended with done or cancel.
+func (s *Server) admit(ctx context.Context, function *storage.Function) (*admission, error) {
+	// A run_once function runs one execution at a time, so each sees
+	// whether the one before completed
+	limit := function.MaxConcurrency
+	if function.RunOnce {
+		limit = 1
+	}
+	if !s.quotas.acquire(function.Name, limit) {
+		return nil, ErrConcurrencyLimit
+	}
+	if function.RunOnce {
+		if err := s.checkRunOnce(ctx, function); err != nil {
+			s.quotas.release(function.Name)
+			return nil, err
+		}
+	}
+
+	a := &admission{s: s, function: function.Name}
+	if s.config.BreakerThreshold > 0 {
+		a.breaker = s.breakers.get(function.Name)
+		if !a.breaker.allow(time.Now()) {
+			s.quotas.release(function.Name)
+			return nil, errCircuitOpen
+		}
+	}
+
+	// The caller's deadline bounds the wait for a slot as well, which ends
+	// like a deadline that passed before the function could run
+	waitCtx := ctx
+	if deadline, ok := callerDeadline(ctx); ok {
+		var cancelWait context.CancelFunc
+		waitCtx, cancelWait = context.WithDeadline(ctx, deadline)
+		defer cancelWait()
+	}
+	if err := s.slots.acquire(waitCtx, function.Name); err != nil {
+		if a.breaker != nil {
+			a.breaker.release()
+		}
+		s.quotas.release(function.Name)
+		if ctx.Err() == nil && waitCtx.Err() != nil {
+			return nil, errDeadlinePassed
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// done ends an execution, recording whether it succeeded with the breaker.
+func (a *admission) done(success bool) {
+	if a.breaker != nil {
+		a.breaker.record(success, time.Now())
+	}
+	a.end()
+}
+
+// cancel ends an execution without an outcome, e.g. when the client went
+// away, which says nothing about the function.
+func (a *admission) cancel() {
+	if a.breaker != nil {
+		a.breaker.release()
+	}
+	a.end()
+}
+
+// end releases the slot and the quota of an execution.
+func (a *admission) end() {
+	a.s.slots.release()
+	a.s.quotas.release(a.function)
+}
+
+// functionSecrets loads the secret values of a function, if it has any,
+// within the query timeout.
+func (s *Server) functionSecrets(ctx context.Context, function *storage.Function) (map[string]string, error) {
+	if len(function.SecretNames) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := s.queryContext(ctx)
+	defer cancel()
+	return s.store.GetSecrets(ctx, function.Name)
+}
+
+// queryContext bounds the database lookups on the path of a request by the
+// query timeout, so a locked or slow database fails the request with
+// storage.ErrQueryTimeout instead of holding it.
+func (s *Server) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.config.DBQueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.config.DBQueryTimeout)
+}
+
+// lookupFunction retrieves a function for a request, within the query timeout.
+func (s *Server) lookupFunction(r *http.Request, name string) (*storage.Function, error) {
+	ctx, cancel := s.queryContext(r.Context())
+	defer cancel()
+	return s.store.GetFunction(ctx, name)
+}
+
+// lookupFailed replies to a failed lookup of a function: with 503 when the
+// database didn't answer in time, so clients back off and retry, with 404
+// when there's no such function and with 500 otherwise.
+func (s *Server) lookupFailed(w http.ResponseWriter, functionName string, err error) {
+	log := s.log.WithError(err).WithField("function", functionName)
+	switch {
+	case errors.Is(err, storage.ErrQueryTimeout):
+		log.Warn("Database too slow to look up function")
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Database is busy, try again later", http.StatusServiceUnavailable)
+	case errors.Is(err, storage.ErrFunctionNotFound):
+		log.Warn("Function not found")
+		http.Error(w, "Function not found", http.StatusNotFound)
+	default:
+		log.Error("Failed to look up function")
+		http.Error(w, "Failed to look up function", http.StatusInternalServerError)
+	}
+}
+
+// recordInvocation stores the outcome and timing of an invocation. Failing to
+// record is logged but doesn't fail the invocation itself.
+func (s *Server) recordInvocation(invocationID, functionName string, result *orchestrator.Result, execErr error, duration time.Duration) {
+	invocation := &storage.Invocation{
+		InvocationID: invocationID,
+		FunctionName: functionName,
+		Status:       "success",
+		DurationMs:   duration.Milliseconds(),
+	}
+	if execErr != nil {
+		invocation.Status = "error"
+		invocation.Error = execErr.Error()
+	}
+	if result != nil {
+		invocation.ColdStart = result.ColdStart
+		invocation.CreateMs = result.Create.Milliseconds()
+		invocation.StartMs = result.Start.Milliseconds()
+		invocation.ExecMs = result.Exec.Milliseconds()
+	}
+
+	s.rates.record(functionName, duration, execErr != nil, time.Now())
+	if err := s.store.RecordInvocation(invocation); err != nil {
+		s.log.WithError(err).WithField("function", functionName).Warn("Failed to record invocation")
+	}
+}
+
+// newInvocationID returns a random identifier for an invocation.
+func newInvocationID() string {
+	b := make([]byte, 16)
+	// crypto/rand.Read never returns an error
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,1204 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/functionio"
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestInvokeTiming(t *testing.T) {
+	tests := []struct {
+		name       string
+		runFor     time.Duration // How long the function runs
+		exitCode   int
+		wantStatus int
+	}{
+		{name: "quick", wantStatus: http.StatusOK},
+		{name: "slow", runFor: 50 * time.Millisecond, wantStatus: http.StatusOK},
+		{name: "failed", exitCode: 1, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				time.Sleep(tt.runFor)
+				return event, tt.exitCode
+			})
+			s := newTestServer(t, engine)
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+
+			began := time.Now()
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(`{"a":1}`)))
+			elapsed := time.Since(began)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if len(engine.running()) != 0 {
+				t.Errorf("containers left: %v", engine.running())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("X-Serverless-Coldstart"); got != "true" {
+				t.Errorf("X-Serverless-Coldstart = %q, want true", got)
+			}
+			execMs, err := strconv.ParseInt(w.Header().Get("X-Serverless-Exec-Ms"), 10, 64)
+			if err != nil {
+				t.Fatalf("X-Serverless-Exec-Ms isn't a number: %v", err)
+			}
+			if execMs < tt.runFor.Milliseconds() || execMs > elapsed.Milliseconds() {
+				t.Errorf("X-Serverless-Exec-Ms = %d, want between %d and %d", execMs, tt.runFor.Milliseconds(), elapsed.Milliseconds())
+			}
+			if w.Body.String() != `{"a":1}` {
+				t.Errorf("output = %q, want the event echoed", w.Body)
+			}
+		})
+	}
+}
+
+func TestDeployUser(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       string
+		workingDir string
+		wantStatus int
+	}{
+		{name: "unset", wantStatus: http.StatusOK},
+		{name: "IDs", user: "1000:1000", workingDir: "/srv/app", wantStatus: http.StatusOK},
+		{name: "names", user: "app:staff", wantStatus: http.StatusOK},
+		{name: "user only", user: "nobody", wantStatus: http.StatusOK},
+		{name: "empty group", user: "app:", wantStatus: http.StatusBadRequest},
+		{name: "extra field", user: "1:2:3", wantStatus: http.StatusBadRequest},
+		{name: "spaces", user: "app staff", wantStatus: http.StatusBadRequest},
+		{name: "relative working directory", workingDir: "srv", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			body, _ := json.Marshal(map[string]string{
+				"name": "hello", "image": "hello:latest", "runtime": "go", "user": tt.user, "working_dir": tt.workingDir,
+			})
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			function, err := s.store.GetFunction(context.Background(), "hello")
+			if w.Code != http.StatusOK {
+				if err == nil {
+					t.Error("invalid function stored")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("function not stored: %v", err)
+			}
+			if function.User != tt.user || function.WorkingDir != tt.workingDir {
+				t.Errorf("stored user %q in %q, want %q in %q", function.User, function.WorkingDir, tt.user, tt.workingDir)
+			}
+		})
+	}
+}
+
+func TestInvokeLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      string
+		runFor     time.Duration
+		wantStatus int
+	}{
+		{name: "within the limits", event: `{"a":1}`, wantStatus: http.StatusOK},
+		{name: "event too large", event: `{"a":"` + strings.Repeat("x", 64) + `"}`, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "execution times out", event: `{}`, runFor: time.Second, wantStatus: http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				time.Sleep(tt.runFor)
+				return event, 0
+			})
+			config := DefaultConfig()
+			config.MaxPayloadBytes = 32
+			config.ExecutionTimeout = 100 * time.Millisecond
+			s := newConfiguredServer(t, engine, config)
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(tt.event)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			// Timed out containers are stopped and removed in the background
+			for deadline := time.Now().Add(5 * time.Second); len(engine.running()) != 0 && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+			}
+			if len(engine.running()) != 0 {
+				t.Errorf("containers left: %v", engine.running())
+			}
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		want       functionDetails
+	}{
+		{
+			name:       "deployed",
+			method:     http.MethodGet,
+			path:       "/functions/hello",
+			wantStatus: http.StatusOK,
+			want: functionDetails{
+				Name: "hello", Image: "hello:latest", Runtime: "go", User: "1000", WorkingDir: "/srv",
+				ContentType: defaultContentType, CircuitBreaker: &breakerStatus{State: breakerClosed},
+			},
+		},
+		{name: "unknown", method: http.MethodGet, path: "/functions/missing", wantStatus: http.StatusNotFound},
+		{name: "no name", method: http.MethodGet, path: "/functions/", wantStatus: http.StatusBadRequest},
+		{name: "wrong method", method: http.MethodPut, path: "/functions/hello", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go", User: "1000", WorkingDir: "/srv"})
+
+			w := httptest.NewRecorder()
+			s.handleFunction(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var got functionDetails
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if got.CreatedAt.IsZero() || got.UpdatedAt.IsZero() {
+				t.Errorf("details = %+v, want the timestamps", got)
+			}
+			got.CreatedAt, got.UpdatedAt = time.Time{}, time.Time{}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("details = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescribeEnv(t *testing.T) {
+	const value = "postgres://app:s3cret@db:5432/app"
+	s := newTestServer(t, newFakeEngine(t, nil))
+	storeFunction(t, s, &storage.Function{
+		Name: "hello", Image: "hello:latest", Runtime: "go",
+		Env: map[string]string{"DATABASE_URL": value, "LEVEL": "debug"},
+	})
+
+	for _, path := range []string{"/functions/hello", "/functions"} {
+		w := httptest.NewRecorder()
+		if path == "/functions" {
+			s.handleFunctions(w, httptest.NewRequest(http.MethodGet, path, nil))
+		} else {
+			s.handleFunction(w, httptest.NewRequest(http.MethodGet, path, nil))
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d: %s", path, w.Code, w.Body)
+		}
+		if strings.Contains(w.Body.String(), value) || strings.Contains(w.Body.String(), "debug") {
+			t.Errorf("GET %s holds an env value: %s", path, w.Body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.handleFunction(w, httptest.NewRequest(http.MethodGet, "/functions/hello", nil))
+	var details functionDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil {
+		t.Fatalf("invalid description: %v", err)
+	}
+	if want := []string{"DATABASE_URL", "LEVEL"}; !reflect.DeepEqual(details.Env, want) {
+		t.Errorf("described env %q, want the names %q", details.Env, want)
+	}
+}
+
+func TestInvokeCircuitBreaker(t *testing.T) {
+	engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+		return nil, 1
+	})
+	config := DefaultConfig()
+	config.BreakerThreshold = 2
+	config.BreakerCooldown = time.Minute
+	s := newConfiguredServer(t, engine, config)
+	storeFunction(t, s, &storage.Function{Name: "broken", Image: "broken:latest", Runtime: "go"})
+
+	for i, want := range []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/broken", strings.NewReader(`{}`)))
+		if w.Code != want {
+			t.Fatalf("invocation %d: status = %d, want %d", i, w.Code, want)
+		}
+		if w.Code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != "60" {
+			t.Errorf("Retry-After = %q, want the cooldown of 60s", w.Header().Get("Retry-After"))
+		}
+	}
+	engine.mu.Lock()
+	created := engine.nextID
+	engine.mu.Unlock()
+	if created != 2 {
+		t.Errorf("%d containers created, want none once the breaker opened", created)
+	}
+
+	w := httptest.NewRecorder()
+	s.handleFunction(w, httptest.NewRequest(http.MethodGet, "/functions/broken", nil))
+	var details functionDetails
+	if err := json.Unmarshal(w.Body.Bytes(), &details); err != nil {
+		t.Fatalf("invalid description: %v", err)
+	}
+	if details.CircuitBreaker == nil || details.CircuitBreaker.State != breakerOpen || details.CircuitBreaker.RetryAt == nil {
+		t.Errorf("circuit breaker = %+v, want open with its retry time", details.CircuitBreaker)
+	}
+}
+
+func TestDeployEntrypoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		entrypoint []string
+		args       []string
+		wantStatus int
+	}{
+		{name: "unset", wantStatus: http.StatusOK},
+		{name: "custom", entrypoint: []string{"/bin/handler"}, args: []string{"--port", "0"}, wantStatus: http.StatusOK},
+		{name: "empty entrypoint element", entrypoint: []string{"/bin/handler", ""}, wantStatus: http.StatusBadRequest},
+		{name: "empty argument", args: []string{""}, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			body, _ := json.Marshal(map[string]any{
+				"name": "hello", "image": "hello:latest", "runtime": "go", "entrypoint": tt.entrypoint, "args": tt.args,
+			})
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			function, err := s.store.GetFunction(context.Background(), "hello")
+			if err != nil {
+				t.Fatalf("function not stored: %v", err)
+			}
+			if !reflect.DeepEqual(function.Entrypoint, tt.entrypoint) || !reflect.DeepEqual(function.Args, tt.args) {
+				t.Errorf("stored %q %q, want %q %q", function.Entrypoint, function.Args, tt.entrypoint, tt.args)
+			}
+		})
+	}
+}
+
+func TestInvokeEventSchema(t *testing.T) {
+	const schema = `{"type":"object","required":["id"],"properties":{"id":{"type":"integer"}}}`
+	tests := []struct {
+		name       string
+		schema     string
+		event      string
+		wantStatus int
+		wantRun    bool
+	}{
+		{name: "valid", schema: schema, event: `{"id":7}`, wantStatus: http.StatusOK, wantRun: true},
+		{name: "missing property", schema: schema, event: `{}`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "wrong type", schema: schema, event: `{"id":"seven"}`, wantStatus: http.StatusUnprocessableEntity},
+		{name: "no schema", event: `{"anything":true}`, wantStatus: http.StatusOK, wantRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := false
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				ran = true
+				return event, 0
+			})
+			s := newTestServer(t, engine)
+			storeFunction(t, s, &storage.Function{Name: "users", Image: "users:latest", Runtime: "go", EventSchema: tt.schema})
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/users", strings.NewReader(tt.event)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if ran != tt.wantRun {
+				t.Errorf("function ran = %v, want %v", ran, tt.wantRun)
+			}
+			if w.Code == http.StatusUnprocessableEntity {
+				var validationErr eventValidationError
+				if err := json.Unmarshal(w.Body.Bytes(), &validationErr); err != nil || len(validationErr.Errors) == 0 {
+					t.Errorf("body = %s, want the validation errors", w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestDeployEventSchema(t *testing.T) {
+	tests := []struct {
+		name       string
+		schema     string
+		wantStatus int
+	}{
+		{name: "valid", schema: `{"type":"object"}`, wantStatus: http.StatusOK},
+		{name: "invalid", schema: `{"type":"nonsense"}`, wantStatus: http.StatusBadRequest},
+		{name: "remote reference", schema: `{"$ref":"http://example.com/schema.json"}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			body := `{"name":"hello","image":"hello:latest","runtime":"go","event_schema":` + tt.schema + `}`
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", strings.NewReader(body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			function, err := s.store.GetFunction(context.Background(), "hello")
+			if err != nil || function.EventSchema != tt.schema {
+				t.Errorf("stored schema = %v (%v), want %s", function, err, tt.schema)
+			}
+		})
+	}
+}
+
+func TestDeployDigest(t *testing.T) {
+	const (
+		first  = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		second = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	)
+	tests := []struct {
+		name       string
+		digests    []string // Digest of each deploy of the function
+		wantStatus int
+	}{
+		{name: "recorded", digests: []string{first}, wantStatus: http.StatusOK},
+		{name: "none", digests: []string{""}, wantStatus: http.StatusOK},
+		{name: "redeployed", digests: []string{first, second}, wantStatus: http.StatusOK},
+		{name: "not a digest", digests: []string{"latest"}, wantStatus: http.StatusBadRequest},
+		{name: "short", digests: []string{"sha256:abc"}, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			var firstID uint
+			for i, digest := range tt.digests {
+				body, _ := json.Marshal(map[string]string{"name": "hello", "image": "serverless-hello:latest", "runtime": "go", "digest": digest})
+				w := httptest.NewRecorder()
+				s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+				if w.Code != tt.wantStatus {
+					t.Fatalf("deploy %d: status = %d, want %d: %s", i, w.Code, tt.wantStatus, w.Body)
+				}
+				if w.Code != http.StatusOK {
+					return
+				}
+				function, err := s.store.GetFunction(context.Background(), "hello")
+				if err != nil {
+					t.Fatalf("function not stored: %v", err)
+				}
+				if function.Digest != digest {
+					t.Errorf("deploy %d: stored digest %q, want %q", i, function.Digest, digest)
+				}
+				if i == 0 {
+					firstID = function.ID
+				} else if function.ID != firstID {
+					t.Errorf("redeploy stored record %d, want the record %d replaced", function.ID, firstID)
+				}
+			}
+		})
+	}
+}
+
+func TestDeployReadonlyRootfs(t *testing.T) {
+	tests := []struct {
+		name            string
+		metadata        map[string]any
+		wantReadonly    bool
+		wantWritableTmp bool
+	}{
+		{name: "default", metadata: map[string]any{}, wantReadonly: true, wantWritableTmp: true},
+		{name: "opted out", metadata: map[string]any{"readonly_rootfs": false}, wantWritableTmp: true},
+		{name: "no tmp", metadata: map[string]any{"writable_tmp": false}, wantReadonly: true},
+		{name: "explicit", metadata: map[string]any{"readonly_rootfs": true, "writable_tmp": true}, wantReadonly: true, wantWritableTmp: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			tt.metadata["name"] = "hello"
+			tt.metadata["image"] = "hello:latest"
+			tt.metadata["runtime"] = "go"
+			body, _ := json.Marshal(tt.metadata)
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			function, err := s.store.GetFunction(context.Background(), "hello")
+			if err != nil {
+				t.Fatalf("function not stored: %v", err)
+			}
+			if function.ReadonlyRootfs != tt.wantReadonly || function.WritableTmp != tt.wantWritableTmp {
+				t.Errorf("stored read-only %v with writable /tmp %v, want %v and %v",
+					function.ReadonlyRootfs, function.WritableTmp, tt.wantReadonly, tt.wantWritableTmp)
+			}
+		})
+	}
+}
+
+func TestDeployDNS(t *testing.T) {
+	tests := []struct {
+		name       string
+		dns        []string
+		extraHosts []string
+		wantStatus int
+	}{
+		{name: "none", wantStatus: http.StatusOK},
+		{name: "IPv4 server", dns: []string{"10.0.0.2"}, wantStatus: http.StatusOK},
+		{name: "IPv6 server", dns: []string{"fd00::53"}, wantStatus: http.StatusOK},
+		{name: "server name", dns: []string{"ns1.internal"}, wantStatus: http.StatusBadRequest},
+		{name: "extra hosts", extraHosts: []string{"billing.internal:10.0.3.7", "db:fd00::7"}, wantStatus: http.StatusOK},
+		{name: "host gateway", extraHosts: []string{"gateway:host-gateway"}, wantStatus: http.StatusOK},
+		{name: "no IP", extraHosts: []string{"billing.internal"}, wantStatus: http.StatusBadRequest},
+		{name: "invalid IP", extraHosts: []string{"billing.internal:10.0.3"}, wantStatus: http.StatusBadRequest},
+		{name: "invalid host", extraHosts: []string{"bad_host:10.0.3.7"}, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			body, _ := json.Marshal(map[string]any{
+				"name": "hello", "image": "hello:latest", "runtime": "go", "dns": tt.dns, "extra_hosts": tt.extraHosts,
+			})
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			function, err := s.store.GetFunction(context.Background(), "hello")
+			if err != nil {
+				t.Fatalf("function not stored: %v", err)
+			}
+			if len(function.DNS) != len(tt.dns) || (len(tt.dns) > 0 && !reflect.DeepEqual(function.DNS, tt.dns)) {
+				t.Errorf("stored DNS servers %v, want %v", function.DNS, tt.dns)
+			}
+			if len(function.ExtraHosts) != len(tt.extraHosts) || (len(tt.extraHosts) > 0 && !reflect.DeepEqual(function.ExtraHosts, tt.extraHosts)) {
+				t.Errorf("stored extra hosts %v, want %v", function.ExtraHosts, tt.extraHosts)
+			}
+		})
+	}
+}
+
+func TestInvokeOutputLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		functionCap int64
+		outputBytes int
+		wantStatus  int
+	}{
+		{name: "within the limit", outputBytes: 1024, wantStatus: http.StatusOK},
+		{name: "past the limit", outputBytes: 1025, wantStatus: http.StatusInternalServerError},
+		{name: "function's own cap", functionCap: 4096, outputBytes: 2048, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.MaxOutputBytes = 1024
+			s := newConfiguredServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				return bytes.Repeat([]byte("x"), tt.outputBytes), 0
+			}), config)
+			storeFunction(t, s, &storage.Function{Name: "chatty", Image: "chatty:latest", Runtime: "go", MaxOutputBytes: tt.functionCap})
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/chatty", strings.NewReader(`{}`)))
+			// Exceeding the limit isn't reported as a 502, which clients retry
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK && !strings.Contains(w.Body.String(), "exceeded the limit of 1024 bytes") {
+				t.Errorf("body = %q, want the limit named", w.Body)
+			}
+		})
+	}
+}
+
+func TestInvokeContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string // Declared by the function
+		output      string
+		exitCode    int
+		wantType    string
+	}{
+		{name: "json by default", output: `{"greeting":"hello"}`, wantType: "application/json"},
+		{name: "declared json", contentType: "application/json", output: `{"greeting":"hello"}`, wantType: "application/json"},
+		{name: "plain text", contentType: "text/plain; charset=utf-8", output: "hello, world\n", wantType: "text/plain; charset=utf-8"},
+		{name: "not json", contentType: "text/csv", output: "name,greeting\nworld,hello\n", wantType: "text/csv"},
+		{name: "mapped error", contentType: "text/plain", output: "no such user\n", exitCode: 2, wantType: "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				return []byte(tt.output), tt.exitCode
+			}))
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go", ContentType: tt.contentType})
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(`{}`)))
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			// The output is passed through verbatim
+			if w.Body.String() != tt.output {
+				t.Errorf("body = %q, want %q", w.Body, tt.output)
+			}
+		})
+	}
+}
+
+func TestInvokeFormats(t *testing.T) {
+	// {"a":1} in MessagePack: a map of one entry, from a 1-byte string to 1
+	msgpackEvent := "\x81\xa1a\x01"
+	tests := []struct {
+		name           string
+		eventFormat    string
+		responseFormat string
+		event          string
+		output         string // Written by the function
+		wantStdin      string // Empty when the function doesn't run
+		wantStatus     int
+		wantType       string
+		wantBody       string // Or part of the error
+	}{
+		{
+			name:        "msgpack event",
+			eventFormat: functionio.FormatMsgpack,
+			event:       `{"a":1}`,
+			output:      `{"ok":true}`,
+			wantStdin:   msgpackEvent,
+			wantStatus:  http.StatusOK,
+			wantType:    "application/json",
+			wantBody:    `{"ok":true}`,
+		},
+		{
+			name:           "msgpack output",
+			responseFormat: functionio.FormatMsgpack,
+			event:          `{}`,
+			output:         msgpackEvent,
+			wantStdin:      `{}`,
+			wantStatus:     http.StatusOK,
+			wantType:       "application/json",
+			wantBody:       `{"a":1}`,
+		},
+		{
+			name:           "raw passthrough",
+			eventFormat:    functionio.FormatRaw,
+			responseFormat: functionio.FormatRaw,
+			event:          "\x00not json\xff",
+			output:         "\x89PNG\r\n",
+			wantStdin:      "\x00not json\xff",
+			wantStatus:     http.StatusOK,
+			wantType:       "application/octet-stream",
+			wantBody:       "\x89PNG\r\n",
+		},
+		{
+			name:           "invalid msgpack output",
+			responseFormat: functionio.FormatMsgpack,
+			event:          `{}`,
+			output:         "\xc1",
+			wantStdin:      `{}`,
+			wantStatus:     http.StatusInternalServerError,
+			wantBody:       "function output is not valid msgpack",
+		},
+		{
+			name:        "event not JSON for msgpack",
+			eventFormat: functionio.FormatMsgpack,
+			event:       "not json",
+			wantStatus:  http.StatusBadRequest,
+			wantBody:    "event can't be delivered as msgpack",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdin []byte
+			s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				stdin = event
+				return []byte(tt.output), 0
+			}))
+			storeFunction(t, s, &storage.Function{
+				Name: "hello", Image: "hello:latest", Runtime: "go",
+				EventFormat: tt.eventFormat, ResponseFormat: tt.responseFormat,
+			})
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(tt.event)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %q", w.Code, tt.wantStatus, w.Body)
+			}
+			if string(stdin) != tt.wantStdin {
+				t.Errorf("stdin = %q, want %q", stdin, tt.wantStdin)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if !strings.Contains(w.Body.String(), tt.wantBody) {
+					t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+				}
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestDeployContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		wantStatus  int
+	}{
+		{name: "none", wantStatus: http.StatusOK},
+		{name: "media type", contentType: "text/plain", wantStatus: http.StatusOK},
+		{name: "with parameters", contentType: "text/plain; charset=utf-8", wantStatus: http.StatusOK},
+		{name: "invalid", contentType: "text/plain; charset", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, nil))
+			body, _ := json.Marshal(map[string]any{"name": "hello", "image": "hello:latest", "runtime": "go", "content_type": tt.contentType})
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestDeployVerifyImage(t *testing.T) {
+	const image = "registry.example.com/hello:1.2"
+	tests := []struct {
+		name       string
+		local      bool // Whether the engine has the image
+		registry   bool // Whether the registry has the image
+		verify     bool
+		wantStatus int
+	}{
+		{name: "present", local: true, verify: true, wantStatus: http.StatusOK},
+		{name: "pulled", registry: true, verify: true, wantStatus: http.StatusOK},
+		{name: "nonexistent", verify: true, wantStatus: http.StatusUnprocessableEntity},
+		{name: "not verified", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, nil)
+			engine.images = map[string]bool{image: tt.local}
+			engine.registry = map[string]bool{image: tt.registry}
+			s := newTestServer(t, engine)
+			body, _ := json.Marshal(map[string]any{"name": "hello", "image": image, "runtime": "go", "verify_image": tt.verify})
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			_, err := s.store.GetFunction(context.Background(), "hello")
+			if stored := err == nil; stored != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("function stored = %v, want it stored only once verified", stored)
+			}
+			if tt.verify && tt.registry && !engine.images[image] {
+				t.Error("image not pulled while verifying it")
+			}
+		})
+	}
+}
+
+func TestSecretNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		want    []string
+	}{
+		{name: "none", secrets: nil, want: []string{}},
+		{name: "one", secrets: map[string]string{"TOKEN": "x"}, want: []string{"TOKEN"}},
+		{name: "sorted", secrets: map[string]string{"b": "1", "A": "2", "a": "3"}, want: []string{"A", "a", "b"}},
+		{name: "empty value", secrets: map[string]string{"EMPTY": ""}, want: []string{"EMPTY"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := secretNames(tt.secrets); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("secretNames = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeTLSFiles writes the certificate and key of a TLS test server, valid for
+// 127.0.0.1, returning their paths and a pool trusting the certificate.
+func writeTLSFiles(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	ts := httptest.NewTLSServer(nil)
+	ts.Close()
+	cert := ts.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to marshal the key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	return certFile, keyFile, pool
+}
+
+func TestRunTLS(t *testing.T) {
+	tests := []struct {
+		name   string
+		tls    bool
+		scheme string
+	}{
+		{name: "plain HTTP", scheme: "http"},
+		{name: "HTTPS", tls: true, scheme: "https"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr := listener.Addr().String()
+			listener.Close()
+
+			config := DefaultConfig()
+			config.Addr = addr
+			client := &http.Client{Timeout: time.Second}
+			if tt.tls {
+				var pool *x509.CertPool
+				config.TLSCert, config.TLSKey, pool = writeTLSFiles(t)
+				client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+			}
+			s := newConfiguredServer(t, newFakeEngine(t, nil), config)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- s.Run(ctx) }()
+			defer func() {
+				cancel()
+				if err := <-done; err != nil {
+					t.Errorf("Run = %v", err)
+				}
+			}()
+
+			var resp *http.Response
+			for deadline := time.Now().Add(5 * time.Second); ; {
+				if resp, err = client.Get(tt.scheme + "://" + addr + "/healthz"); err == nil || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err != nil {
+				t.Fatalf("GET /healthz over %s failed: %v", tt.scheme, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status = %d, want 200", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestDeployLogDestination(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		logDir      string // function_log_dir of the server
+		wantStatus  int
+	}{
+		{name: "server logs", destination: "log", wantStatus: http.StatusOK},
+		{name: "stdout", destination: "stdout", wantStatus: http.StatusOK},
+		{name: "file in the log directory", destination: "file:hello.log", logDir: "/var/log/serverless", wantStatus: http.StatusOK},
+		{name: "file without a log directory", destination: "file:hello.log", wantStatus: http.StatusBadRequest},
+		{name: "absolute file", destination: "file:/etc/passwd", logDir: "/var/log/serverless", wantStatus: http.StatusBadRequest},
+		{name: "file outside the log directory", destination: "file:../hello.log", logDir: "/var/log/serverless", wantStatus: http.StatusBadRequest},
+		{name: "unknown", destination: "syslog", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.FunctionLogDir = tt.logDir
+			s := newConfiguredServer(t, newFakeEngine(t, nil), config)
+			body, _ := json.Marshal(map[string]string{
+				"name": "hello", "image": "hello:latest", "runtime": "go", "log_destination": tt.destination,
+			})
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+// lockStore holds the write lock of the database at path from a connection of
+// its own, with enough writers of s stuck behind it to take all the
+// connections of s's store, until the test ends.
+func lockStore(t *testing.T, s *Server, path string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE functions SET image = image"); err != nil {
+		t.Fatalf("failed to lock the database: %v", err)
+	}
+	var writers sync.WaitGroup
+	for i := range 8 {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			s.store.SaveFunction(&storage.Function{Name: fmt.Sprintf("writer-%d", i), Image: "writer:latest", Runtime: "go"}, nil)
+		}()
+	}
+	t.Cleanup(func() {
+		tx.Rollback()
+		writers.Wait()
+		db.Close()
+	})
+	// Let the writers take the connections
+	time.Sleep(100 * time.Millisecond)
+}
+
+func TestInvokeQueryTimeout(t *testing.T) {
+	const queryTimeout = 100 * time.Millisecond
+	tests := []struct {
+		name           string
+		locked         bool // Whether a writer holds the database
+		function       string
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{name: "answered in time", function: "hello", wantStatus: http.StatusOK},
+		{name: "not found", function: "missing", wantStatus: http.StatusNotFound},
+		{name: "database locked", locked: true, function: "hello",
+			wantStatus: http.StatusServiceUnavailable, wantRetryAfter: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) { return event, 0 })
+			t.Setenv("DOCKER_HOST", "tcp://"+engine.Listener.Addr().String())
+			log := logrus.New()
+			log.SetOutput(io.Discard)
+			path := filepath.Join(t.TempDir(), "serverless.db")
+			store, err := storage.NewStore(path, log)
+			if err != nil {
+				t.Fatalf("failed to open the store: %v", err)
+			}
+			config := DefaultConfig()
+			config.DBQueryTimeout = queryTimeout
+			s, err := NewServer(config, store, log)
+			if err != nil {
+				t.Fatalf("NewServer failed: %v", err)
+			}
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+			if tt.locked {
+				lockStore(t, s, path)
+			}
+
+			for _, path := range []string{"/invoke/" + tt.function, "/functions/" + tt.function} {
+				began := time.Now()
+				w := httptest.NewRecorder()
+				if strings.HasPrefix(path, "/invoke/") {
+					s.handleInvoke(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{}`)))
+				} else {
+					s.handleFunction(w, httptest.NewRequest(http.MethodGet, path, nil))
+				}
+				if w.Code != tt.wantStatus {
+					t.Fatalf("%s: status = %d, want %d: %s", path, w.Code, tt.wantStatus, w.Body)
+				}
+				if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+					t.Errorf("%s: Retry-After = %q, want %q", path, got, tt.wantRetryAfter)
+				}
+				// The lookup gives up at the deadline, not when the lock is released
+				if elapsed := time.Since(began); tt.locked && elapsed > 10*queryTimeout {
+					t.Errorf("%s: answered after %v, want about %v", path, elapsed, queryTimeout)
+				}
+			}
+		})
+	}
+}
+
+func TestDeployTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxTimeout  time.Duration // max_execution_timeout of the server, whose execution_timeout is 30s
+		timeoutMs   int64
+		wantStatus  int
+		wantTimeout int64 // Effective timeout echoed by the deploy
+	}{
+		{name: "server's timeout", wantStatus: http.StatusOK, wantTimeout: 30000},
+		{name: "shorter", timeoutMs: 5000, wantStatus: http.StatusOK, wantTimeout: 5000},
+		{name: "up to the maximum", maxTimeout: 2 * time.Minute, timeoutMs: 120000, wantStatus: http.StatusOK, wantTimeout: 120000},
+		{name: "beyond the maximum", maxTimeout: 2 * time.Minute, timeoutMs: 120001, wantStatus: http.StatusBadRequest},
+		{name: "beyond the execution timeout without a maximum", timeoutMs: 60000, wantStatus: http.StatusBadRequest},
+		{name: "negative", timeoutMs: -1, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.ExecutionTimeout = 30 * time.Second
+			config.MaxExecutionTimeout = tt.maxTimeout
+			s := newConfiguredServer(t, newFakeEngine(t, nil), config)
+
+			body, _ := json.Marshal(map[string]any{"name": "hello", "image": "hello:latest", "runtime": "go", "timeout_ms": tt.timeoutMs})
+			w := httptest.NewRecorder()
+			s.handleDeploy(w, httptest.NewRequest(http.MethodPost, "/functions", bytes.NewReader(body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("deploy status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var result deployResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || result.Name != "hello" || result.TimeoutMs != tt.wantTimeout {
+				t.Errorf("deploy answered %s, want timeout_ms %d", w.Body, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestInvokeBeyondWriteTimeout(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+		time.Sleep(300 * time.Millisecond)
+		return []byte(`{"ok":true}`), 0
+	}))
+	storeFunction(t, s, &storage.Function{Name: "slow", Image: "slow:latest", Runtime: "go"})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(s.handleInvoke))
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/invoke/slow", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("the response was cut off: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("the response was cut off: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != `{"ok":true}` {
+		t.Errorf("response = %d %q, want the output", resp.StatusCode, body)
+	}
+}
+
+func TestPatchTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeoutMs  int64
+		wantStatus int
+	}{
+		{name: "within the maximum", timeoutMs: 60000, wantStatus: http.StatusOK},
+		{name: "beyond the maximum", timeoutMs: 120001, wantStatus: http.StatusBadRequest},
+		{name: "negative", timeoutMs: -1, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.ExecutionTimeout = 30 * time.Second
+			config.MaxExecutionTimeout = 2 * time.Minute
+			s := newConfiguredServer(t, newFakeEngine(t, nil), config)
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+
+			w := httptest.NewRecorder()
+			patch := strings.NewReader(`{"timeout_ms":` + strconv.FormatInt(tt.timeoutMs, 10) + `}`)
+			s.handleFunction(w, httptest.NewRequest(http.MethodPatch, "/functions/hello", patch))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
+
+func TestInvokeTimeoutEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeoutMs int64
+		want      string
+	}{
+		{name: "server's timeout", want: "SERVERLESS_TIMEOUT_MS=30000"},
+		{name: "function's timeout", timeoutMs: 1500, want: "SERVERLESS_TIMEOUT_MS=1500"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				return []byte(`{}`), 0
+			})
+			config := DefaultConfig()
+			config.ExecutionTimeout = 30 * time.Second
+			s := newConfiguredServer(t, engine, config)
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go", TimeoutMs: tt.timeoutMs})
+
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(`{}`)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			engine.mu.Lock()
+			defer engine.mu.Unlock()
+			var got []string
+			for _, env := range engine.env["c1"] {
+				if strings.HasPrefix(env, "SERVERLESS_TIMEOUT_MS=") {
+					got = append(got, env)
+				}
+			}
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("function environment has %q, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// captureStdout returns what f prints to os.Stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	printed := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		printed <- string(b)
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	return <-printed
+}
+
+func TestInvokeLog(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      string
+		wantLevel  logrus.Level
+		wantFields logrus.Fields // Fields besides the duration
+		wantError  bool          // Whether the entry has the error
+	}{
+		{
+			name:       "success",
+			event:      `{"say":"hello"}`,
+			wantLevel:  logrus.InfoLevel,
+			wantFields: logrus.Fields{"function": "echo", "request_id": "req-1", "exit_code": 0, "output_bytes": 15, "cold_start": true},
+		},
+		{
+			name:       "function failed",
+			event:      `{"fail":true}`,
+			wantLevel:  logrus.ErrorLevel,
+			wantFields: logrus.Fields{"function": "echo", "request_id": "req-1", "exit_code": int64(3), "output_bytes": 6, "status": http.StatusInternalServerError},
+			wantError:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				if strings.Contains(string(event), `"fail"`) {
+					return []byte("failed"), 3
+				}
+				return event, 0
+			}))
+			storeFunction(t, s, &storage.Function{Name: "echo", Image: "echo:latest", Runtime: "go"})
+			hook := logtest.NewLocal(s.log)
+
+			r := httptest.NewRequest(http.MethodPost, "/invoke/echo", strings.NewReader(tt.event))
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, "req-1"))
+			stdout := captureStdout(t, func() {
+				s.handleInvoke(httptest.NewRecorder(), r)
+			})
+			// Invocations go to the server's log only
+			if stdout != "" {
+				t.Errorf("printed %q to stdout", stdout)
+			}
+
+			var entry *logrus.Entry
+			for _, e := range hook.AllEntries() {
+				if e.Data["request_id"] != nil {
+					entry = e
+				}
+			}
+			if entry == nil {
+				t.Fatalf("no invocation was logged, got %d entries", len(hook.AllEntries()))
+			}
+			if entry.Level != tt.wantLevel {
+				t.Errorf("level = %s, want %s", entry.Level, tt.wantLevel)
+			}
+			for key, want := range tt.wantFields {
+				if got := entry.Data[key]; got != want {
+					t.Errorf("%s = %v, want %v", key, got, want)
+				}
+			}
+			if duration, ok := entry.Data["duration"].(time.Duration); !ok || duration <= 0 {
+				t.Errorf("duration = %v, want the time the invocation took", entry.Data["duration"])
+			}
+			if _, ok := entry.Data[logrus.ErrorKey]; ok != tt.wantError {
+				t.Errorf("entry has an error %v, want %v", ok, tt.wantError)
+			}
+		})
+	}
+}
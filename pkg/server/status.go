@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// queueStats tracks invocations waiting for an execution slot. The counters
+// are atomic, so a status snapshot doesn't hold up the scheduler.
+type queueStats struct {
+	depth     atomic.Int64 // Invocations waiting right now
+	maxDepth  atomic.Int64 // Highest depth observed since startup
+	waits     atomic.Int64 // Invocations that got a slot, waiting or not
+	waitNanos atomic.Int64 // Total time spent waiting by them
+}
+
+// enter records an invocation starting to wait for a slot.
+func (q *queueStats) enter() {
+	depth := q.depth.Add(1)
+	for {
+		highest := q.maxDepth.Load()
+		if depth <= highest || q.maxDepth.CompareAndSwap(highest, depth) {
+			return
+		}
+	}
+}
+
+// leave records an invocation done waiting, whether it got a slot or gave up.
+func (q *queueStats) leave() {
+	q.depth.Add(-1)
+}
+
+// recordWait records the time an invocation waited for its slot, 0 when one
+// was free right away.
+func (q *queueStats) recordWait(waited time.Duration) {
+	q.waits.Add(1)
+	q.waitNanos.Add(int64(waited))
+}
+
+// queueStatus is the state of the execution queue as reported by GET /status.
+type queueStatus struct {
+	Depth     int64   `json:"depth"`
+	MaxDepth  int64   `json:"max_depth"`
+	AvgWaitMs float64 `json:"avg_wait_ms"`
+}
+
+// status returns a snapshot of the counters.
+func (q *queueStats) status() queueStatus {
+	status := queueStatus{Depth: q.depth.Load(), MaxDepth: q.maxDepth.Load()}
+	if waits := q.waits.Load(); waits > 0 {
+		status.AvgWaitMs = float64(q.waitNanos.Load()) / float64(waits) / float64(time.Millisecond)
+	}
+	return status
+}
+
+// serverStatus is the load of the server, to inform capacity decisions.
+type serverStatus struct {
+	Running    int                            `json:"running"`     // Executions holding a slot
+	Limit      int                            `json:"limit"`       // Concurrent executions allowed, max_concurrency
+	Queue      queueStatus                    `json:"queue"`       // Invocations waiting for a slot
+	Functions  map[string]functionQueueStatus `json:"functions"`   // Waits of each function invoked since startup
+	JobsQueued int                            `json:"jobs_queued"` // Async jobs waiting for a worker
+}
+
+// handleStatus reports the load of the server (GET /status).
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.log.WithField("method", r.Method).Warn("Invalid method for status")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	running, limit, functions := s.slots.status()
+	s.writeJSON(w, http.StatusOK, serverStatus{
+		Running:    running,
+		Limit:      limit,
+		Queue:      s.slots.stats.status(),
+		Functions:  functions,
+		JobsQueued: len(s.jobQueue),
+	})
+}
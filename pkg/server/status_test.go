@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestQueueStats(t *testing.T) {
+	var q queueStats
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.enter()
+			q.recordWait(2 * time.Millisecond)
+			q.leave()
+		}()
+	}
+	wg.Wait()
+	q.recordWait(0)
+
+	status := q.status()
+	if status.Depth != 0 {
+		t.Errorf("depth = %d, want 0 once everyone left", status.Depth)
+	}
+	if status.MaxDepth < 1 || status.MaxDepth > 50 {
+		t.Errorf("max depth = %d, want between 1 and 50", status.MaxDepth)
+	}
+	if want := 100.0 / 51; status.AvgWaitMs < want-0.001 || status.AvgWaitMs > want+0.001 {
+		t.Errorf("average wait = %vms, want %vms", status.AvgWaitMs, want)
+	}
+}
+
+func TestStatusQueueDepth(t *testing.T) {
+	// Invocations hold their slot until released
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+		started <- struct{}{}
+		<-release
+		return event, 0
+	})
+	config := DefaultConfig()
+	config.MaxConcurrency = 1
+	s := newConfiguredServer(t, engine, config)
+	storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+	status := func() serverStatus {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.handleStatus(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+		var status serverStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("invalid status %q: %v", w.Body, err)
+		}
+		return status
+	}
+
+	// One invocation takes the only slot, the others queue behind it
+	const queued = 3
+	var wg sync.WaitGroup
+	for i := range 1 + queued {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/hello", strings.NewReader(`{}`)))
+			if w.Code != http.StatusOK {
+				t.Errorf("invocation = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+		}()
+		if i == 0 {
+			<-started
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); status().Queue.Depth < queued && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	got := status()
+	if got.Queue.Depth != queued || got.Queue.MaxDepth != queued || got.Running != 1 || got.Limit != 1 {
+		t.Errorf("status = %+v, want %d invocations queued behind 1 running", got, queued)
+	}
+
+	// Released, the queue drains, and the waits show in the average
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	got = status()
+	if got.Queue.Depth != 0 || got.Queue.MaxDepth != queued || got.Running != 0 {
+		t.Errorf("status = %+v, want an empty queue that peaked at %d", got, queued)
+	}
+	if got.Queue.AvgWaitMs <= 0 {
+		t.Errorf("average wait = %vms, want the queued invocations' waits", got.Queue.AvgWaitMs)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// eventStreamType is the media type of Server-Sent Events.
+const eventStreamType = "text/event-stream"
+
+// isEventStream reports whether a function's output is a stream of
+// Server-Sent Events, which is passed to the client as it's written.
+func isEventStream(function *storage.Function) bool {
+	mediaType, _, err := mime.ParseMediaType(function.ContentType)
+	return err == nil && mediaType == eventStreamType
+}
+
+// streamWriter passes a function's output through to the client verbatim,
+// flushing each write so events arrive as the function emits them. The
+// response starts with the first write, so a function that fails before
+// writing anything still gets a regular error response.
+type streamWriter struct {
+	w        http.ResponseWriter
+	flusher  http.Flusher
+	function *storage.Function
+	started  bool
+}
+
+// start sends the headers of the stream, once.
+func (s *streamWriter) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	s.w.Header().Set("X-Serverless-Function", s.function.Name)
+	s.w.Header().Set("Content-Type", contentType(s.function))
+	s.w.Header().Set("Cache-Control", "no-cache")
+	s.w.WriteHeader(http.StatusOK)
+}
+
+// Write starts the response if needed, then writes p and flushes it. Empty
+// writes don't start the response.
+func (s *streamWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	s.start()
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	s.flusher.Flush()
+	return n, nil
+}
+
+// streamInvoke runs a function whose output is an event stream, keeping the
+// connection open until the function exits. A failure after the stream
+// started is reported as an "error" event, as the status is already sent.
+// The invocation began at began.
+func (s *Server) streamInvoke(w http.ResponseWriter, r *http.Request, function *storage.Function, began time.Time, event []byte) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The stream lasts as long as the function runs, bounded by the
+	// execution timeout rather than the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		s.log.WithError(err).Warn("Failed to clear write deadline")
+	}
+
+	stream := &streamWriter{w: w, flusher: flusher, function: function}
+	result, err := s.executeStream(r.Context(), function, event, stream)
+	if err == nil {
+		// Answers with an empty stream when nothing was emitted
+		stream.start()
+		s.invokeLog(r, function, began, result, nil).Info("Function invoked")
+		return
+	}
+
+	if r.Context().Err() != nil {
+		s.invokeLog(r, function, began, nil, err).Warn("Client disconnected, invocation cancelled")
+		return
+	}
+	if !stream.started {
+		s.invokeFailed(w, r, function, began, err)
+		return
+	}
+
+	status, message := failureStatus(function, err)
+	s.invokeLog(r, function, began, nil, err).WithField("status", status).Error("Function execution failed while streaming")
+	fmt.Fprintf(w, "event: error\ndata: %s\n\n", strings.ReplaceAll(message, "\n", " "))
+	flusher.Flush()
+}
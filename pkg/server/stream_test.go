@@ -0,0 +1,111 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+func TestIsEventStream(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{contentType: "", want: false},
+		{contentType: "application/json", want: false},
+		{contentType: "text/event-stream", want: true},
+		{contentType: "text/event-stream; charset=utf-8", want: true},
+		{contentType: "Text/Event-Stream", want: true},
+		{contentType: "text/event-streams", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := isEventStream(&storage.Function{ContentType: tt.contentType}); got != tt.want {
+				t.Errorf("isEventStream(%q) = %v, want %v", tt.contentType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvokeEventStream(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      string
+		exitCode    int
+		wantStatus  int
+		wantBody    string // Prefix of the body
+		wantError   bool   // Whether the body ends with an error event
+		wantHeaders bool   // Whether the response has the stream's headers
+	}{
+		{name: "events", output: "data: one\n\ndata: two\n\n", wantStatus: http.StatusOK, wantBody: "data: one\n\ndata: two\n\n", wantHeaders: true},
+		{name: "no events", wantStatus: http.StatusOK, wantHeaders: true},
+		{name: "failed before streaming", exitCode: 1, wantStatus: http.StatusInternalServerError},
+		{name: "failed while streaming", output: "data: one\n\n", exitCode: 1, wantStatus: http.StatusOK, wantBody: "data: one\n\n", wantError: true, wantHeaders: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+				return []byte(tt.output), tt.exitCode
+			}))
+			storeFunction(t, s, &storage.Function{Name: "ticker", Image: "ticker:latest", Runtime: "go", ContentType: "text/event-stream"})
+			server := httptest.NewServer(gzipResponses(http.HandlerFunc(s.handleInvoke)))
+			defer server.Close()
+
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/invoke/ticker", strings.NewReader(`{}`))
+			// Set explicitly, so a compressed stream would show
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("invoke failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, body)
+			}
+			if !strings.HasPrefix(string(body), tt.wantBody) {
+				t.Errorf("body = %q, want it to start with %q", body, tt.wantBody)
+			}
+			if got := strings.Contains(string(body), "event: error\ndata: "); got != tt.wantError {
+				t.Errorf("body = %q, want an error event %v", body, tt.wantError)
+			}
+			if !tt.wantHeaders {
+				return
+			}
+			if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+				t.Errorf("Content-Type = %q, want text/event-stream", got)
+			}
+			if got := resp.Header.Get("Cache-Control"); got != "no-cache" {
+				t.Errorf("Cache-Control = %q, want no-cache", got)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want the stream uncompressed", got)
+			}
+		})
+	}
+}
+
+func TestInvokeEventStreamNotCached(t *testing.T) {
+	var runs atomic.Int32
+	s := newTestServer(t, newFakeEngine(t, func(event []byte) ([]byte, int) {
+		runs.Add(1)
+		return []byte("data: tick\n\n"), 0
+	}))
+	storeFunction(t, s, &storage.Function{Name: "ticker", Image: "ticker:latest", Runtime: "go", ContentType: "text/event-stream", CacheTTLMs: 60000})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		s.handleInvoke(w, httptest.NewRequest(http.MethodPost, "/invoke/ticker", strings.NewReader(`{}`)))
+		if w.Code != http.StatusOK || w.Body.String() != "data: tick\n\n" {
+			t.Fatalf("invocation %d = %d %q, want the stream", i, w.Code, w.Body)
+		}
+	}
+	if got := runs.Load(); got != 2 {
+		t.Errorf("function ran %d times, want every stream to run it", got)
+	}
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles is the dashboard, a single page built on the JSON API, served at
+// /ui/ when the server runs with the UI enabled.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiHandler serves the dashboard's files (GET /ui/...).
+func (s *Server) uiHandler() http.Handler {
+	files, _ := fs.Sub(uiFiles, "ui") // The directory is embedded, so it exists
+	fileServer := http.StripPrefix("/ui/", http.FileServer(http.FS(files)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			s.log.WithField("method", r.Method).Warn("Invalid method for ui")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,153 @@
+// Dashboard of the platform, built on the same JSON API as the CLI.
+"use strict";
+
+// historyKey is where the invocations made from the dashboard are kept.
+const historyKey = "serverless.invocations";
+const historySize = 20;
+
+let selected = null;
+
+// api fetches a JSON endpoint, failing with the server's message.
+async function api(path) {
+  const response = await fetch(path, { headers: { Accept: "application/json" } });
+  if (!response.ok) {
+    throw new Error(`${path}: ${response.status} ${await response.text()}`);
+  }
+  return response.json();
+}
+
+// cell builds a table cell holding text.
+function cell(text) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  return td;
+}
+
+// fillTable replaces the rows of a table body.
+function fillTable(id, rows) {
+  const tbody = document.querySelector(`#${id} tbody`);
+  tbody.replaceChildren(...rows);
+}
+
+// loadFunctions lists the deployed functions.
+async function loadFunctions() {
+  const functions = await api("/functions");
+  document.getElementById("functions-empty").hidden = functions.length > 0;
+  fillTable("functions", functions.map((fn) => {
+    const tr = document.createElement("tr");
+    tr.append(
+      cell(fn.name),
+      cell(fn.runtime),
+      cell(fn.image),
+      cell(fn.timeout_ms ? `${fn.timeout_ms / 1000}s` : "default"),
+      cell(new Date(fn.updated_at).toLocaleString()),
+    );
+    tr.classList.toggle("selected", fn.name === selected);
+    tr.addEventListener("click", () => selectFunction(fn.name));
+    return tr;
+  }));
+}
+
+// loadContainers lists the containers of running invocations.
+async function loadContainers() {
+  const containers = await api("/containers");
+  fillTable("containers", containers.map((c) => {
+    const tr = document.createElement("tr");
+    tr.append(cell(c.function), cell(c.invocation || ""), cell(c.state), cell(`${c.age_seconds}s`));
+    return tr;
+  }));
+}
+
+// selectFunction shows the invoke form and details of a function.
+async function selectFunction(name) {
+  selected = name;
+  document.getElementById("invoke").hidden = false;
+  document.getElementById("invoke-name").textContent = name;
+  document.getElementById("result").hidden = true;
+  for (const tr of document.querySelectorAll("#functions tbody tr")) {
+    tr.classList.toggle("selected", tr.firstChild.textContent === name);
+  }
+  const details = await api(`/functions/${encodeURIComponent(name)}`);
+  document.getElementById("details").textContent = JSON.stringify(details, null, 2);
+}
+
+// invoke posts the event of the form to the selected function.
+async function invoke(event) {
+  event.preventDefault();
+  const body = document.getElementById("event").value;
+  const async = document.getElementById("async").checked;
+  const headers = { "Content-Type": "application/json" };
+  if (async) {
+    headers["X-Serverless-Async"] = "true";
+  }
+
+  const began = performance.now();
+  const response = await fetch(`/invoke/${encodeURIComponent(selected)}`, { method: "POST", headers, body });
+  const text = await response.text();
+  const duration = Math.round(performance.now() - began);
+
+  const status = document.getElementById("result-status");
+  status.textContent = `${response.status} ${response.statusText} in ${duration} ms`;
+  status.className = response.ok ? "ok" : "error";
+  document.getElementById("result-body").textContent = pretty(text);
+  document.getElementById("result").hidden = false;
+
+  remember({ time: Date.now(), function: selected, status: response.status, duration });
+  showHistory();
+  loadContainers().catch(showError);
+}
+
+// pretty indents JSON, leaving other text as is.
+function pretty(text) {
+  try {
+    return JSON.stringify(JSON.parse(text), null, 2);
+  } catch {
+    return text;
+  }
+}
+
+// history returns the invocations made from the dashboard, newest first.
+function history() {
+  try {
+    return JSON.parse(localStorage.getItem(historyKey)) || [];
+  } catch {
+    return [];
+  }
+}
+
+// remember records an invocation in the history.
+function remember(entry) {
+  const entries = [entry, ...history()].slice(0, historySize);
+  localStorage.setItem(historyKey, JSON.stringify(entries));
+}
+
+// showHistory lists the recent invocations.
+function showHistory() {
+  fillTable("invocations", history().map((entry) => {
+    const tr = document.createElement("tr");
+    const status = cell(entry.status);
+    status.className = entry.status < 400 ? "ok" : "error";
+    tr.append(cell(new Date(entry.time).toLocaleString()), cell(entry.function), status, cell(`${entry.duration} ms`));
+    return tr;
+  }));
+}
+
+// showError reports a failed request in the page.
+function showError(err) {
+  console.error(err);
+  const message = document.getElementById("error");
+  message.textContent = err.message;
+  message.hidden = false;
+}
+
+// refresh reloads everything the server reports.
+function refresh() {
+  document.getElementById("error").hidden = true;
+  loadFunctions().catch(showError);
+  loadContainers().catch(showError);
+}
+
+document.getElementById("invoke-form").addEventListener("submit", (event) => invoke(event).catch(showError));
+document.getElementById("refresh").addEventListener("click", refresh);
+showHistory();
+refresh();
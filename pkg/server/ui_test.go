@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUI(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, nil))
+	handler := s.uiHandler()
+
+	tests := []struct {
+		name            string
+		method          string
+		path            string
+		wantStatus      int
+		wantContentType string // Prefix of the media type served
+		wantBody        string // Part of the body
+	}{
+		{name: "index", method: http.MethodGet, path: "/ui/", wantStatus: http.StatusOK, wantContentType: "text/html", wantBody: "app.js"},
+		{name: "script", method: http.MethodGet, path: "/ui/app.js", wantStatus: http.StatusOK, wantContentType: "text/javascript", wantBody: "/functions"},
+		{name: "stylesheet", method: http.MethodGet, path: "/ui/style.css", wantStatus: http.StatusOK, wantContentType: "text/css"},
+		{name: "head", method: http.MethodHead, path: "/ui/", wantStatus: http.StatusOK, wantContentType: "text/html"},
+		{name: "missing file", method: http.MethodGet, path: "/ui/missing.js", wantStatus: http.StatusNotFound},
+		{name: "invalid method", method: http.MethodPost, path: "/ui/", wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantContentType) {
+				t.Errorf("Content-Type = %q, want %s", got, tt.wantContentType)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body doesn't contain %q", tt.wantBody)
+			}
+		})
+	}
+}
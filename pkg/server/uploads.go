@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+)
+
+// uploadedFile describes a file uploaded with an invocation, as the function
+// receives it.
+type uploadedFile struct {
+	Field       string `json:"field"`                  // Form field the file was uploaded as
+	Filename    string `json:"filename"`               // Name the client gave the file
+	ContentType string `json:"content_type,omitempty"` // Type the client gave the file
+	Path        string `json:"path"`                   // Where the function reads the file
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"` // So results of different files aren't mixed up by caching
+}
+
+// uploadEvent is the event of a multipart invocation, given to the function
+// in place of the request body.
+type uploadEvent struct {
+	Fields map[string]string `json:"fields,omitempty"` // Form fields that aren't files
+	Files  []uploadedFile    `json:"files"`
+}
+
+// isMultipart reports whether an invocation uploads files as multipart/form-data.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// receiveUploads writes the files of a multipart invocation to a fresh
+// directory under the uploads directory, only the server can read, and
+// returns the event describing them, the directory, to copy to the container
+// with orchestrator.WithUploads, and a function that removes it. The whole
+// body is limited to max_upload_bytes.
+func (s *Server) receiveUploads(w http.ResponseWriter, r *http.Request) ([]byte, string, func(), error) {
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil, "", nil, &unsupportedEncodingError{encoding: encoding}
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxUploadBytes)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	dir, err := os.MkdirTemp(s.config.UploadsDir, "serverless-uploads-")
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to create uploads directory: %v", err)
+	}
+	remove := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			s.log.WithError(err).Warn("Failed to remove uploads directory")
+		}
+	}
+
+	event := uploadEvent{Files: []uploadedFile{}}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			remove()
+			return nil, "", nil, err
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(part)
+			if err != nil {
+				remove()
+				return nil, "", nil, err
+			}
+			if event.Fields == nil {
+				event.Fields = make(map[string]string)
+			}
+			event.Fields[part.FormName()] = string(value)
+			continue
+		}
+
+		file, err := writeUpload(dir, len(event.Files), part.FileName(), part)
+		if err != nil {
+			remove()
+			return nil, "", nil, err
+		}
+		file.Field = part.FormName()
+		file.ContentType = part.Header.Get("Content-Type")
+		event.Files = append(event.Files, file)
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		remove()
+		return nil, "", nil, err
+	}
+	return data, dir, remove, nil
+}
+
+// writeUpload writes the index-th uploaded file of an invocation to dir. The
+// file is named after the index as well, so uploads with the same name don't
+// collide.
+func writeUpload(dir string, index int, filename string, content io.Reader) (uploadedFile, error) {
+	base := filepath.Base(filename)
+	if base == "/" || base == "." || base == ".." {
+		base = "file"
+	}
+	name := fmt.Sprintf("%d-%s", index, base)
+	out, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return uploadedFile{}, fmt.Errorf("failed to write upload %s: %v", filename, err)
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), content)
+	if err != nil {
+		return uploadedFile{}, err
+	}
+	if err := out.Close(); err != nil {
+		return uploadedFile{}, fmt.Errorf("failed to write upload %s: %v", filename, err)
+	}
+	return uploadedFile{
+		Filename: filename,
+		Path:     path.Join(orchestrator.UploadsMountPoint, name),
+		Size:     size,
+		SHA256:   hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/akos011221/serverless/pkg/storage"
+)
+
+// multipartBody encodes fields and files, each of a field name, file name and
+// content, as a multipart/form-data body, returning it and its content type.
+func multipartBody(t *testing.T, fields map[string]string, files [][3]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range files {
+		part, err := mw.CreateFormFile(file[0], file[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(file[2]))
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, mw.FormDataContentType()
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestInvokeUploads(t *testing.T) {
+	tests := []struct {
+		name       string
+		fields     map[string]string
+		files      [][3]string // Field, file name and content
+		wantFields map[string]string
+		wantFiles  []uploadedFile
+	}{
+		{
+			name:  "single file",
+			files: [][3]string{{"document", "report.txt", "quarterly numbers"}},
+			wantFiles: []uploadedFile{{
+				Field:       "document",
+				Filename:    "report.txt",
+				ContentType: "application/octet-stream",
+				Path:        "/run/uploads/0-report.txt",
+				Size:        int64(len("quarterly numbers")),
+				SHA256:      sha256Hex("quarterly numbers"),
+			}},
+		},
+		{
+			name:   "files and fields",
+			fields: map[string]string{"lang": "en"},
+			files: [][3]string{
+				{"images", "a.png", "first"},
+				{"images", "dir/a.png", "second"},
+			},
+			wantFields: map[string]string{"lang": "en"},
+			wantFiles: []uploadedFile{
+				{
+					Field:       "images",
+					Filename:    "a.png",
+					ContentType: "application/octet-stream",
+					Path:        "/run/uploads/0-a.png",
+					Size:        int64(len("first")),
+					SHA256:      sha256Hex("first"),
+				},
+				{
+					Field:       "images",
+					Filename:    "a.png",
+					ContentType: "application/octet-stream",
+					Path:        "/run/uploads/1-a.png",
+					Size:        int64(len("second")),
+					SHA256:      sha256Hex("second"),
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received []byte
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				received = event
+				return []byte(`{"ok":true}`), 0
+			})
+			config := DefaultConfig()
+			config.UploadsDir = t.TempDir()
+			s := newConfiguredServer(t, engine, config)
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+
+			body, contentType := multipartBody(t, tt.fields, tt.files)
+			r := httptest.NewRequest(http.MethodPost, "/invoke/hello", body)
+			r.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200, body %q", w.Code, w.Body.String())
+			}
+			var event uploadEvent
+			if err := json.Unmarshal(received, &event); err != nil {
+				t.Fatalf("the function got %q, not an upload event: %v", received, err)
+			}
+			if len(event.Fields) != len(tt.wantFields) {
+				t.Errorf("fields = %v, want %v", event.Fields, tt.wantFields)
+			}
+			for name, value := range tt.wantFields {
+				if event.Fields[name] != value {
+					t.Errorf("field %s = %q, want %q", name, event.Fields[name], value)
+				}
+			}
+			if len(event.Files) != len(tt.wantFiles) {
+				t.Fatalf("files = %+v, want %+v", event.Files, tt.wantFiles)
+			}
+			for i, want := range tt.wantFiles {
+				if event.Files[i] != want {
+					t.Errorf("file %d = %+v, want %+v", i, event.Files[i], want)
+				}
+				// The files of the uploads directory are copied to the container
+				content, ok := engine.file("c1", want.Path)
+				if !ok {
+					t.Errorf("%s wasn't copied to the container", want.Path)
+				} else if content != tt.files[i][2] {
+					t.Errorf("%s = %q, want %q", want.Path, content, tt.files[i][2])
+				}
+			}
+
+			entries, err := os.ReadDir(config.UploadsDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("uploads directory left behind: %v", entries)
+			}
+		})
+	}
+}
+
+func TestInvokeUploadsRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		async      bool
+		content    string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "asynchronous",
+			async:      true,
+			content:    "small",
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "Files can't be uploaded to asynchronous invocations\n",
+		},
+		{
+			name:       "beyond max_upload_bytes",
+			content:    strings.Repeat("x", 2048),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantBody:   "Event exceeds 1024 bytes\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newFakeEngine(t, func(event []byte) ([]byte, int) {
+				t.Error("the function ran")
+				return []byte(`{}`), 0
+			})
+			config := DefaultConfig()
+			config.UploadsDir = t.TempDir()
+			config.MaxUploadBytes = 1024
+			s := newConfiguredServer(t, engine, config)
+			storeFunction(t, s, &storage.Function{Name: "hello", Image: "hello:latest", Runtime: "go"})
+
+			body, contentType := multipartBody(t, nil, [][3]string{{"file", "data.bin", tt.content}})
+			r := httptest.NewRequest(http.MethodPost, "/invoke/hello", body)
+			r.Header.Set("Content-Type", contentType)
+			if tt.async {
+				r.Header.Set(asyncHeader, "true")
+			}
+			w := httptest.NewRecorder()
+			s.handleInvoke(w, r)
+
+			if w.Code != tt.wantStatus || w.Body.String() != tt.wantBody {
+				t.Errorf("response = %d %q, want %d %q", w.Code, w.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			entries, err := os.ReadDir(config.UploadsDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("uploads directory left behind: %v", entries)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// handleWarm prepares a function for a burst of invocations
+// (POST /functions/{name}/warm), replying once it's ready.
+func (s *Server) handleWarm(w http.ResponseWriter, r *http.Request, functionName string) {
+	if r.Method != http.MethodPost {
+		s.log.WithField("method", r.Method).Warn("Invalid method for warm")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	function, err := s.lookupFunction(r, functionName)
+	if err != nil {
+		s.lookupFailed(w, functionName, err)
+		return
+	}
+
+	// Pulls can take longer than the write timeout allows
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		s.log.WithError(err).Warn("Failed to clear write deadline")
+	}
+
+	// Containers aren't pooled, so warming makes sure the image is present
+	report, err := s.orchestrator.Warm(r.Context(), function)
+	if err != nil {
+		if errors.Is(err, orchestrator.ErrImageNotFound) {
+			s.log.WithError(err).WithField("function", functionName).Error("Function image missing")
+			http.Error(w, fmt.Sprintf("%v, redeploy the function", err), http.StatusFailedDependency)
+			return
+		}
+		s.log.WithError(err).WithField("function", functionName).Error("Failed to warm function")
+		http.Error(w, fmt.Sprintf("Failed to warm function: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, report)
+}
+
+// verifyImage makes sure the image of a function being deployed exists,
+// pulling it if it's missing. On failure it replies with an error and
+// returns false.
+func (s *Server) verifyImage(w http.ResponseWriter, r *http.Request, function *storage.Function) bool {
+	// Pulls can take longer than the write timeout allows
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		s.log.WithError(err).Warn("Failed to clear write deadline")
+	}
+
+	if _, err := s.orchestrator.Warm(r.Context(), function); err != nil {
+		if errors.Is(err, orchestrator.ErrImageNotFound) {
+			s.log.WithError(err).WithField("function", function.Name).Warn("Function image not found")
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return false
+		}
+		s.log.WithError(err).WithField("function", function.Name).Error("Failed to verify function image")
+		http.Error(w, fmt.Sprintf("Failed to verify image: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// pinDigest pins a function to the image its tag refers to, pulling it
+// first if it's missing, like a deploy of a freshly built image. Reports
+// whether it succeeded, having answered the request otherwise.
+func (s *Server) pinDigest(w http.ResponseWriter, r *http.Request, function *storage.Function) bool {
+	if !s.verifyImage(w, r, function) {
+		return false
+	}
+	if err := s.resolveDigest(r.Context(), function); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to resolve image digest: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// resolveDigest pins a function to the ID of its image, which must be present.
+// Shared by the HTTP and gRPC APIs.
+func (s *Server) resolveDigest(ctx context.Context, function *storage.Function) error {
+	digest, err := s.orchestrator.ImageDigest(ctx, function.Image)
+	if err != nil {
+		s.log.WithError(err).WithField("function", function.Name).Error("Failed to resolve image digest")
+		return err
+	}
+	function.Digest = digest
+	return nil
+}
+
+// pullBaseImages pulls the configured base images in the background once the
+// server starts, so the first function build doesn't wait for them. Failures
+// are only logged, builds pull what they're missing themselves.
+func (s *Server) pullBaseImages(ctx context.Context) {
+	began := time.Now()
+	failed := s.orchestrator.PullImages(ctx, s.config.BaseImages)
+	for image, err := range failed {
+		s.log.WithError(err).WithField("image", image).Warn("Failed to pull base image")
+	}
+	s.log.WithFields(logrus.Fields{
+		"images":   len(s.config.BaseImages),
+		"failed":   len(failed),
+		"duration": time.Since(began).Round(time.Millisecond),
+	}).Info("Base images pulled")
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/orchestrator"
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// wsCloseTimeout bounds sending the close message when a session ends.
+const wsCloseTimeout = time.Second
+
+var upgrader = websocket.Upgrader{}
+
+// handleWebSocket runs an interactive session with a function (GET /ws/{name}).
+// Each incoming message is written to the function's stdin as a line, and each
+// line of its stdout is sent back as a message. The function must process its
+// input in a loop. The container is removed when the socket closes.
+//
+// A session is admitted like an invocation, see admit, and the invoke hooks
+// run around it with no event or result. A session of a run_once function
+// that started marks it completed, and ?force=true runs one that completed.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	began := time.Now()
+	functionName := strings.TrimPrefix(r.URL.Path, "/ws/")
+	if functionName == "" {
+		s.log.Warn("Missing function name in websocket request")
+		http.Error(w, "Function name required", http.StatusBadRequest)
+		return
+	}
+
+	function, err := s.lookupFunction(r, functionName)
+	if err != nil {
+		s.lookupFailed(w, functionName, err)
+		return
+	}
+
+	ctx := r.Context()
+	if r.URL.Query().Get("force") == "true" {
+		ctx = withForcedRun(ctx)
+	}
+	if _, err := s.beforeInvoke(ctx, function, nil); err != nil {
+		s.invokeFailed(w, r, function, began, err)
+		return
+	}
+	admission, err := s.admit(ctx, function)
+	if err != nil {
+		s.afterInvoke(ctx, function, nil, err)
+		if ctx.Err() == nil {
+			s.invokeFailed(w, r, function, began, err)
+		}
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already replied with an error
+		s.log.WithError(err).WithField("function", functionName).Warn("WebSocket upgrade failed")
+		admission.cancel()
+		s.afterInvoke(ctx, function, nil, err)
+		return
+	}
+	defer conn.Close()
+
+	err = s.runSession(ctx, conn, function)
+	if function.RunOnce && err == nil {
+		s.markCompleted(function)
+	}
+	admission.done(err == nil || clientError(function, err))
+	s.afterInvoke(ctx, function, nil, err)
+}
+
+// runSession runs a session with a function over conn until either side
+// ends it. It fails only when the function couldn't be started, which
+// conn is closed with.
+func (s *Server) runSession(ctx context.Context, conn *websocket.Conn, function *storage.Function) error {
+	invocationID := newInvocationID()
+	log := s.log.WithFields(logrus.Fields{"function": function.Name, "invocation": invocationID})
+
+	secrets, err := s.functionSecrets(ctx, function)
+	if err != nil {
+		log.WithError(err).Error("Failed to load secrets")
+		s.closeWebSocket(conn, websocket.CloseInternalServerErr, "failed to start function")
+		return err
+	}
+
+	session, err := s.orchestrator.StartSession(ctx, invocationID, function, secrets)
+	if err != nil {
+		log.WithError(err).Error("Failed to start session")
+		reason := "failed to start function"
+		if errors.Is(err, orchestrator.ErrImageNotFound) {
+			reason = "function image not found, redeploy the function"
+		}
+		s.closeWebSocket(conn, websocket.CloseInternalServerErr, reason)
+		return err
+	}
+	defer session.Close()
+
+	// Forward stdout lines to the socket until the container exits
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(session.Stdout())
+		// A line can be as long as the output of an execution
+		scanner.Buffer(make([]byte, 64*1024), int(s.config.MaxOutputBytes))
+		for scanner.Scan() {
+			if err := conn.WriteMessage(websocket.TextMessage, scanner.Bytes()); err != nil {
+				return
+			}
+		}
+		// The output is closed once the socket is
+		err := scanner.Err()
+		if errors.Is(err, bufio.ErrTooLong) {
+			log.WithError(err).Warn("Function output line too long")
+			s.closeWebSocket(conn, websocket.CloseMessageTooBig, "function output line too long")
+			return
+		}
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.WithError(err).Warn("Failed to read session output")
+			s.closeWebSocket(conn, websocket.CloseInternalServerErr, "failed to read function output")
+			return
+		}
+		s.closeWebSocket(conn, websocket.CloseNormalClosure, "function exited")
+	}()
+
+	// Forward messages to stdin until the socket closes
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if _, err := session.Write(append(message, '\n')); err != nil {
+			log.WithError(err).Warn("Failed to write to session")
+			break
+		}
+	}
+
+	session.Close()
+	<-done
+	log.Info("Session closed")
+	return nil
+}
+
+// closeWebSocket sends a close message to the peer.
+func (s *Server) closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(wsCloseTimeout))
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akos011221/serverless/pkg/storage"
+	"github.com/gorilla/websocket"
+)
+
+// dialSession opens a WebSocket session with a function on s.
+func dialSession(t *testing.T, s *Server, functionName string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(s.handleWebSocket))
+	t.Cleanup(server.Close)
+	return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/"+functionName, nil)
+}
+
+// newEchoEngine starts an engine whose functions answer each line they read
+// until their stdin is closed.
+func newEchoEngine(t *testing.T) *fakeEngine {
+	t.Helper()
+	engine := newFakeEngine(t, nil)
+	engine.interactive = func(stdin io.Reader, stdout io.Writer) {
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			fmt.Fprintf(stdout, "echo: %s\n", scanner.Text())
+		}
+	}
+	return engine
+}
+
+// exchange sends a message on a session and checks the function echoes it.
+func exchange(t *testing.T, conn *websocket.Conn, message string) {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+		t.Fatalf("failed to send %q: %v", message, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, reply, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read the reply to %q: %v", message, err)
+	}
+	if want := "echo: " + message; string(reply) != want {
+		t.Errorf("reply = %q, want %q", reply, want)
+	}
+}
+
+func TestWebSocketSession(t *testing.T) {
+	engine := newEchoEngine(t)
+	s := newTestServer(t, engine)
+	storeFunction(t, s, &storage.Function{Name: "repl", Image: "repl:latest", Runtime: "go"})
+
+	conn, _, err := dialSession(t, s, "repl")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	for _, message := range []string{"one", "two", `{"three":3}`} {
+		exchange(t, conn, message)
+	}
+	conn.Close()
+
+	// The container is removed once the socket closes
+	deadline := time.Now().Add(5 * time.Second)
+	for len(engine.running()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(engine.running()) != 0 {
+		t.Errorf("containers left: %v", engine.running())
+	}
+}
+
+func TestWebSocketUnknownFunction(t *testing.T) {
+	s := newTestServer(t, newFakeEngine(t, nil))
+
+	_, resp, err := dialSession(t, s, "missing")
+	if err == nil {
+		t.Fatal("dial succeeded, want the upgrade refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("response = %v, want 404", resp)
+	}
+}
+
+func TestWebSocketConcurrencyLimit(t *testing.T) {
+	s := newTestServer(t, newEchoEngine(t))
+	storeFunction(t, s, &storage.Function{Name: "repl", Image: "repl:latest", Runtime: "go", MaxConcurrency: 1})
+
+	conn, _, err := dialSession(t, s, "repl")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	exchange(t, conn, "one")
+
+	// The running session takes the function's only execution
+	_, resp, err := dialSession(t, s, "repl")
+	if err == nil {
+		t.Fatal("second dial succeeded, want it refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("response = %v, want 429", resp)
+	}
+
+	// Its quota is given back once it closes
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, _, err := dialSession(t, s, "repl")
+		if err == nil {
+			exchange(t, conn, "two")
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dial after the session closed failed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebSocketRunOnce(t *testing.T) {
+	s := newTestServer(t, newEchoEngine(t))
+	storeFunction(t, s, &storage.Function{Name: "setup", Image: "setup:latest", Runtime: "go", RunOnce: true})
+
+	conn, _, err := dialSession(t, s, "setup")
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	exchange(t, conn, "one")
+	conn.Close()
+
+	// The session marks the function completed once it closes
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		function, err := s.store.GetFunction(context.Background(), "setup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if function.CompletedAt != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the completion wasn't recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, resp, err := dialSession(t, s, "setup")
+	if err == nil {
+		t.Fatal("dial succeeded, want it refused once completed")
+	}
+	if resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("response = %v, want 409", resp)
+	}
+
+	conn, _, err = dialSession(t, s, "setup?force=true")
+	if err != nil {
+		t.Fatalf("forced dial failed: %v", err)
+	}
+	exchange(t, conn, "two")
+	conn.Close()
+}
@@ -0,0 +1,17 @@
+// Package stopsignal lists the signals functions may ask to be stopped with,
+// so the CLI checks manifests against the same signals the server accepts.
+package stopsignal
+
+// allowed are the signals a function may be stopped with instead of SIGTERM,
+// by name. SIGKILL isn't one: it can't be handled, so it would skip the grace
+// period a function gets to clean up.
+var allowed = map[string]bool{
+	"SIGHUP": true, "SIGINT": true, "SIGQUIT": true, "SIGABRT": true, "SIGUSR1": true, "SIGUSR2": true,
+	"SIGPIPE": true, "SIGALRM": true, "SIGTERM": true, "SIGWINCH": true, "SIGPWR": true,
+}
+
+// Valid reports whether a function may be stopped with the named signal,
+// e.g. SIGINT.
+func Valid(name string) bool {
+	return allowed[name]
+}
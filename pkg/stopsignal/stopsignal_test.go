@@ -0,0 +1,30 @@
+package stopsignal
+
+import "testing"
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "SIGTERM", want: true},
+		{name: "SIGINT", want: true},
+		{name: "SIGQUIT", want: true},
+		{name: "SIGUSR1", want: true},
+		{name: "SIGWINCH", want: true},
+		{name: "SIGKILL"},
+		{name: "SIGSTOP"},
+		{name: ""},
+		{name: "TERM"},
+		{name: "sigterm"},
+		{name: "15"},
+		{name: "SIGTERM "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Valid(tt.name); got != tt.want {
+				t.Errorf("Valid(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
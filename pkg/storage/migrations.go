@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// migration is a numbered change to the schema or the data. Migrations run
+// once each, in order of version, and are recorded in schema_migrations.
+type migration struct {
+	Version int
+	Name    string
+	Migrate func(tx *gorm.DB) error
+}
+
+// migrations is the history of the schema. Append to it, never edit or
+// reorder the migrations released so far, as databases record them as
+// applied by version. The baseline creates the tables from the current
+// models, so later migrations must leave a schema that's already current
+// alone, e.g. check Migrator().HasColumn before adding a column, as
+// addColumns does.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Migrate: func(tx *gorm.DB) error {
+			// Also brings databases created before versioning up to date
+			return tx.AutoMigrate(&Function{}, &Invocation{}, &Job{}, &Alias{}, &FunctionRevision{}, &Secret{}, &AuditEvent{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "function_revisions",
+		Migrate: func(tx *gorm.DB) error {
+			if err := tx.AutoMigrate(&FunctionRevision{}); err != nil {
+				return err
+			}
+			if !tx.Migrator().HasColumn(&Job{}, "Digest") {
+				if err := tx.Migrator().AddColumn(&Job{}, "Digest"); err != nil {
+					return err
+				}
+			}
+			// The digests functions run now are their first known revisions
+			var functions []Function
+			if err := tx.Unscoped().Where("digest <> ''").Find(&functions).Error; err != nil {
+				return err
+			}
+			for i := range functions {
+				if err := recordRevision(tx, &functions[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 3,
+		Name:    "function_snapshot",
+		Migrate: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&Function{}, "Snapshot") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&Function{}, "Snapshot")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "function_payload_logging",
+		Migrate: func(tx *gorm.DB) error {
+			return addColumns(tx, &Function{}, "LogPayloads", "RedactPaths")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "function_run_once",
+		Migrate: func(tx *gorm.DB) error {
+			if err := addColumns(tx, &Function{}, "RunOnce", "CompletedAt"); err != nil {
+				return err
+			}
+			return addColumns(tx, &Job{}, "Force")
+		},
+	},
+	{
+		Version: 6,
+		Name:    "function_stop_signal",
+		Migrate: func(tx *gorm.DB) error {
+			return addColumns(tx, &Function{}, "StopSignal")
+		},
+	},
+}
+
+// addColumns adds the columns of fields of a model the table doesn't have yet.
+func addColumns(tx *gorm.DB, model any, fields ...string) error {
+	for _, field := range fields {
+		if tx.Migrator().HasColumn(model, field) {
+			continue
+		}
+		if err := tx.Migrator().AddColumn(model, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaMigration records an applied migration.
+type schemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// TableName stores applied migrations in the schema_migrations table.
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// migrate runs the migrations the database hasn't applied yet, each in a
+// transaction with its record, so a failed migration is retried on the next
+// start. Running it again on a current database changes nothing.
+func (s *Store) migrate() error {
+	if err := s.db.AutoMigrate(&schemaMigration{}); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	for _, m := range migrations {
+		applied := false
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			// Checked in the transaction, which holds the write lock, in case
+			// another server sharing the database got there first
+			var count int64
+			if err := tx.Model(&schemaMigration{}).Where("version = ?", m.Version).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return nil
+			}
+			if err := m.Migrate(tx); err != nil {
+				return err
+			}
+			applied = true
+			return tx.Create(&schemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Name, err)
+		}
+		if applied {
+			s.log.WithFields(logrus.Fields{"version": m.Version, "name": m.Name}).Info("Applied schema migration")
+		}
+	}
+	return nil
+}
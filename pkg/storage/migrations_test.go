@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// openRawDB opens a database without migrating it, to set up the schema a
+// test starts from.
+func openRawDB(t *testing.T, dbPath string) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	return db
+}
+
+// closeDB closes the connections of a database.
+func closeDB(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("failed to get the database: %v", err)
+	}
+	sqlDB.Close()
+}
+
+// appliedVersions returns the versions recorded in schema_migrations, in order.
+func appliedVersions(t *testing.T, store *Store) []int {
+	t.Helper()
+	var versions []int
+	if err := store.db.Model(&schemaMigration{}).Order("version").Pluck("version", &versions).Error; err != nil {
+		t.Fatalf("failed to read schema_migrations: %v", err)
+	}
+	return versions
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, dbPath string) // Prepares the database before the store opens it
+		check func(t *testing.T, store *Store)
+	}{
+		{
+			name: "fresh database",
+		},
+		{
+			name: "database created before versioning",
+			setup: func(t *testing.T, dbPath string) {
+				db := openRawDB(t, dbPath)
+				defer closeDB(t, db)
+				statements := []string{
+					`CREATE TABLE functions (id integer PRIMARY KEY AUTOINCREMENT, created_at datetime, updated_at datetime, deleted_at datetime, name text UNIQUE, image text, digest text, runtime text)`,
+					`CREATE TABLE jobs (id integer PRIMARY KEY AUTOINCREMENT, created_at datetime, updated_at datetime, deleted_at datetime, job_id text, function_name text, event blob, status text)`,
+					`INSERT INTO functions (name, image, digest, runtime) VALUES ('hello', 'serverless-hello:latest', 'sha256:abc', 'go')`,
+					`INSERT INTO functions (name, image, digest, runtime) VALUES ('unpinned', 'alpine', '', 'sh')`,
+				}
+				for _, statement := range statements {
+					if err := db.Exec(statement).Error; err != nil {
+						t.Fatalf("failed to set up the legacy schema: %v", err)
+					}
+				}
+			},
+			check: func(t *testing.T, store *Store) {
+				function, err := store.GetFunction(context.Background(), "hello")
+				if err != nil {
+					t.Fatalf("legacy function lost: %v", err)
+				}
+				if function.Image != "serverless-hello:latest" || function.Digest != "sha256:abc" {
+					t.Errorf("legacy function = %s@%s, want serverless-hello:latest@sha256:abc", function.Image, function.Digest)
+				}
+				revision, err := store.GetRevision(context.Background(), "hello", "sha256:abc")
+				if err != nil {
+					t.Fatalf("the deployed digest wasn't recorded as a revision: %v", err)
+				}
+				if revision.Image != "serverless-hello:latest" {
+					t.Errorf("revision image = %s, want serverless-hello:latest", revision.Image)
+				}
+				digests, err := store.RevisionDigests()
+				if err != nil {
+					t.Fatalf("RevisionDigests failed: %v", err)
+				}
+				if len(digests) != 1 {
+					t.Errorf("revision digests = %q, want only the pinned function's", digests)
+				}
+				if !store.db.Migrator().HasColumn(&Function{}, "Snapshot") {
+					t.Error("functions have no snapshot column")
+				}
+			},
+		},
+		{
+			name: "columns missing after the recorded baseline",
+			setup: func(t *testing.T, dbPath string) {
+				store := openTestStore(t, dbPath)
+				if err := store.db.Where("version >= ?", 4).Delete(&schemaMigration{}).Error; err != nil {
+					t.Fatalf("failed to forget migrations: %v", err)
+				}
+				for _, column := range []string{"LogPayloads", "RedactPaths", "RunOnce", "CompletedAt", "StopSignal"} {
+					if err := store.db.Migrator().DropColumn(&Function{}, column); err != nil {
+						t.Fatalf("failed to drop %s: %v", column, err)
+					}
+				}
+				if err := store.db.Migrator().DropColumn(&Job{}, "Force"); err != nil {
+					t.Fatalf("failed to drop Force: %v", err)
+				}
+				closeDB(t, store.db)
+			},
+			check: func(t *testing.T, store *Store) {
+				for _, column := range []string{"LogPayloads", "RedactPaths", "RunOnce", "CompletedAt", "StopSignal"} {
+					if !store.db.Migrator().HasColumn(&Function{}, column) {
+						t.Errorf("column %s wasn't added back", column)
+					}
+				}
+				if !store.db.Migrator().HasColumn(&Job{}, "Force") {
+					t.Error("column Force of jobs wasn't added back")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "db")
+			if tt.setup != nil {
+				tt.setup(t, dbPath)
+			}
+			store := openTestStore(t, dbPath)
+			checkAllApplied(t, store)
+			if tt.check != nil {
+				tt.check(t, store)
+			}
+
+			// Migrating a current database again changes nothing
+			if err := store.migrate(); err != nil {
+				t.Fatalf("migrating again failed: %v", err)
+			}
+			checkAllApplied(t, store)
+			if err := store.SaveFunction(&Function{Name: "after", Image: "alpine", Runtime: "sh", Digest: "sha256:def"}, map[string]string{"TOKEN": "x"}); err != nil {
+				t.Errorf("SaveFunction on the migrated schema failed: %v", err)
+			}
+		})
+	}
+}
+
+// checkAllApplied fails the test unless every migration is recorded once.
+func checkAllApplied(t *testing.T, store *Store) {
+	t.Helper()
+	versions := appliedVersions(t, store)
+	if len(versions) != len(migrations) {
+		t.Fatalf("applied versions = %v, want all %d migrations", versions, len(migrations))
+	}
+	for i, m := range migrations {
+		if versions[i] != m.Version {
+			t.Fatalf("applied versions = %v, want those of the migrations in order", versions)
+		}
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db")
+	store := openTestStore(t, dbPath)
+
+	saved := migrations
+	t.Cleanup(func() { migrations = saved })
+	next := saved[len(saved)-1].Version + 1
+
+	tests := []struct {
+		name    string
+		migrate func(tx *gorm.DB) error
+		wantErr bool
+		want    bool // Whether the migration is recorded as applied afterwards
+	}{
+		{
+			name: "failure rolls back",
+			migrate: func(tx *gorm.DB) error {
+				if err := tx.Exec(`CREATE TABLE partial (id integer)`).Error; err != nil {
+					return err
+				}
+				return errors.New("boom")
+			},
+			wantErr: true,
+		},
+		{
+			name: "retried on the next run",
+			migrate: func(tx *gorm.DB) error {
+				return tx.Exec(`CREATE TABLE partial (id integer)`).Error
+			},
+			want: true,
+		},
+		{
+			name: "not run again once applied",
+			migrate: func(tx *gorm.DB) error {
+				return errors.New("ran again")
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations = append(saved[:len(saved):len(saved)], migration{Version: next, Name: "test", Migrate: tt.migrate})
+			err := store.migrate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("migrate() = %v, want error %v", err, tt.wantErr)
+			}
+			var count int64
+			store.db.Model(&schemaMigration{}).Where("version = ?", next).Count(&count)
+			if applied := count == 1; applied != tt.want {
+				t.Errorf("migration recorded = %v, want %v", applied, tt.want)
+			}
+			if !tt.want && store.db.Migrator().HasTable("partial") {
+				t.Error("the failed migration's changes weren't rolled back")
+			}
+		})
+	}
+}
@@ -3,7 +3,12 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gorm.io/driver/sqlite"
@@ -13,11 +18,192 @@ import (
 // Function represents a deployed function.
 type Function struct {
 	gorm.Model
-	Name    string `gorm:"unique"`
-	Image   string
-	Runtime string
+	Name       string            `gorm:"unique"`
+	Labels     map[string]string `gorm:"serializer:json"` // Free-form labels, used to select functions
+	Image      string
+	Digest     string // ID of the image at deploy time, e.g. sha256:..., empty runs the tag
+	Runtime    string
+	User       string // User (and optionally group) the function runs as, e.g. 1000:1000
+	WorkingDir string // Working directory inside the container
+	StopSignal string // Signal the function is stopped with, e.g. SIGINT, empty for SIGTERM
+
+	// Platforms the image is built for, e.g. linux/amd64, empty for the
+	// platform it was built on
+	Platforms []string `gorm:"serializer:json"`
+
+	Entrypoint []string `gorm:"serializer:json"` // Overrides the image entrypoint
+	Args       []string `gorm:"serializer:json"` // Arguments passed to the entrypoint
+
+	Env         map[string]string `gorm:"serializer:json"` // Environment variables of the function
+	MemoryBytes int64             // Memory limit, 0 for none
+	NanoCPUs    int64             // CPU limit in billionths of a core, 0 for none
+
+	DNS        []string `gorm:"serializer:json"` // DNS servers of the container, empty for the engine's
+	ExtraHosts []string `gorm:"serializer:json"` // Extra /etc/hosts entries as host:ip
+
+	MaxOutputBytes int64 // Cap on the output of an execution, 0 for the server default
+	MaxConcurrency int   // Executions the function may run at once, 0 for no limit of its own
+
+	EventSchema  string // JSON Schema incoming events must match, empty accepts any event
+	DefaultEvent string // JSON object incoming events are merged over, empty for none
+
+	// Retry policy of async invocations: a failed job is retried up to
+	// MaxRetries times, waiting RetryBackoffMs doubled on every attempt.
+	MaxRetries     int
+	RetryBackoffMs int64
+
+	// Window in which an event identical to an earlier one gets the earlier
+	// result instead of invoking the function again, 0 disables it
+	DedupWindowMs int64
+
+	// How long the result of a successful invocation is reused for the same
+	// event, for deterministic functions, 0 disables caching
+	CacheTTLMs int64
+
+	// Execution timeout, 0 for the server's. Functions see the effective one
+	// in their environment, see orchestrator.TimeoutEnv
+	TimeoutMs int64
+
+	// HTTP statuses that nonzero exit codes map to, keyed by an exit code
+	// ("2") or an inclusive range ("10-19"). Empty uses the default mapping.
+	ExitStatuses map[string]int `gorm:"serializer:json"`
+
+	ContentType string // Media type of the function's output, empty for JSON
+
+	// Formats of the event on the function's stdin and of its output: json,
+	// msgpack or raw, empty for JSON, see functionio.FormatJSON
+	EventFormat    string
+	ResponseFormat string
+
+	// Where the function's stderr is forwarded: log, stdout, none or
+	// file:<path>, empty for the server's logs
+	LogDestination string
+
+	// Logs the event and output of every execution, for debugging, with the
+	// values at RedactPaths (e.g. user.email or cards.*.number) masked
+	LogPayloads bool
+	RedactPaths []string `gorm:"serializer:json"`
+
+	AlwaysPull     *bool // Pulls the image before each run, nil for the server's default
+	ReadonlyRootfs bool  // Mounts the container's root filesystem read-only
+	WritableTmp    bool  // Mounts a writable tmpfs at /tmp
+
+	// Restores the function from a checkpoint of it once initialized, when
+	// the server has snapshots enabled, see orchestrator.Config.Snapshots
+	Snapshot bool
+
+	// Runs the function once, e.g. a migration or a seed job: once it
+	// completed successfully, at CompletedAt, it's only invoked again when forced
+	RunOnce     bool
+	CompletedAt *time.Time
+
+	// Names of the function's secrets, whose values are stored apart as
+	// Secret records, so they're never returned with the metadata
+	SecretNames []string `gorm:"serializer:json"`
+}
+
+// Secret is a secret value of a function, handed to its containers as a file.
+type Secret struct {
+	gorm.Model
+	FunctionName string `gorm:"uniqueIndex:idx_function_secret"`
+	Name         string `gorm:"uniqueIndex:idx_function_secret"`
+	Value        string
+}
+
+// FunctionRevision is an image digest a function has been deployed with, so
+// aliases and invocations can ask for that exact image later, whatever the
+// function runs now.
+type FunctionRevision struct {
+	gorm.Model
+	FunctionName string `gorm:"uniqueIndex:idx_function_revision"`
+	Digest       string `gorm:"uniqueIndex:idx_function_revision"`
+	Image        string // Image reference the digest was deployed as
+}
+
+// Alias is a name routing invocations to one or more revisions of a function,
+// each receiving a share of the traffic proportional to its weight.
+type Alias struct {
+	gorm.Model
+	Name     string `gorm:"unique"`
+	Function string
+	Targets  []AliasTarget `gorm:"serializer:json"`
+}
+
+// AliasTarget is a revision an alias routes to.
+type AliasTarget struct {
+	Digest string `json:"digest"`
+	Weight int    `json:"weight"`
+}
+
+// Job statuses.
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is an asynchronous invocation of a function.
+type Job struct {
+	gorm.Model
+	JobID        string `gorm:"uniqueIndex"`
+	FunctionName string `gorm:"index"`
+	Event        []byte
+	Status       string `gorm:"index"`
+	Digest       string // Revision the job runs, empty for the function's current image
+	Force        bool   // Runs a run_once function even when it completed
+	Attempts     int    // Number of executions started so far
+	Result       []byte // Output of the successful execution
+	Error        string // Error of the last failed execution
+}
+
+// Invocation records a single function execution and its timing breakdown.
+type Invocation struct {
+	gorm.Model
+	InvocationID string `gorm:"index"`
+	FunctionName string `gorm:"index"`
+	Status       string // "success" or "error"
+	Error        string
+	ColdStart    bool
+	CreateMs     int64
+	StartMs      int64
+	ExecMs       int64
+	DurationMs   int64 // End-to-end duration as seen by the server
 }
 
+// Audit actions, the changes to functions recorded in the audit log.
+const (
+	AuditDeploy  = "deploy"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+)
+
+// AuditEvent records a change to a function: who made it and when.
+// Invocations aren't recorded, only changes to the lifecycle of functions.
+type AuditEvent struct {
+	gorm.Model
+	FunctionName string `gorm:"index"`
+	Action       string
+	Actor        string // Who made the change, as the client declared it, empty if unknown
+	Details      string // e.g. the image deployed or the fields updated
+}
+
+// TableName stores audit events in the audit_log table.
+func (AuditEvent) TableName() string {
+	return "audit_log"
+}
+
+// SQLite connection settings. WAL lets readers proceed while a write is in
+// progress, and the busy timeout makes concurrent writers wait for the lock
+// instead of failing with "database is locked". Transactions take the write
+// lock up front, so a read-then-write transaction can't deadlock with another.
+const (
+	connectionParams = "_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+	maxOpenConns     = 4
+)
+
 // Store manages function metadata.
 type Store struct {
 	db  *gorm.DB
@@ -26,38 +212,406 @@ type Store struct {
 
 // NewStore initializes the store.
 func NewStore(dbPath string, log *logrus.Logger) (*Store, error) {
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{})
+	dsn := dbPath + "?" + connectionParams
+	if strings.Contains(dbPath, "?") {
+		dsn = dbPath + "&" + connectionParams
+	}
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
-	// Auto-migrate schema.
-	if err := db.AutoMigrate(&Function{}); err != nil {
-		return nil, fmt.Errorf("failed to migrate schema: %v", err)
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure database: %v", err)
 	}
+	sqlDB.SetMaxOpenConns(maxOpenConns)
 
-	return &Store{db: db, log: log}, nil
+	store := &Store{db: db, log: log}
+	if err := store.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate schema: %v", err)
+	}
+	return store, nil
 }
 
-// CreateFunction stores a new function.
-func (s *Store) CreateFunction(name, image, runtime string) error {
-	function := Function{
-		Name:    name,
-		Image:   image,
-		Runtime: runtime,
-	}
-	if err := s.db.Create(&function).Error; err != nil {
-		return fmt.Errorf("failed to create function: %v", err)
+// SaveFunction stores a function along with its secrets, replacing the
+// previous deployment of a function with the same name, secrets included.
+// Redeploying a deleted function restores it.
+func (s *Store) SaveFunction(function *Function, secrets map[string]string) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Deleted functions keep their name, so they're replaced as well
+		var existing Function
+		found := tx.Unscoped().Where("name = ?", function.Name).Limit(1).Find(&existing)
+		if found.Error != nil {
+			return found.Error
+		}
+		if found.RowsAffected > 0 {
+			// Redeploy, keep the identity of the record, and whether it ran
+			function.ID = existing.ID
+			function.CreatedAt = existing.CreatedAt
+			function.CompletedAt = existing.CompletedAt
+		}
+		function.DeletedAt = gorm.DeletedAt{}
+		if err := tx.Unscoped().Save(function).Error; err != nil {
+			return err
+		}
+		if err := recordRevision(tx, function); err != nil {
+			return err
+		}
+
+		// Secrets are replaced as a whole, and removed for good
+		if err := tx.Unscoped().Where("function_name = ?", function.Name).Delete(&Secret{}).Error; err != nil {
+			return err
+		}
+		for name, value := range secrets {
+			secret := &Secret{FunctionName: function.Name, Name: name, Value: value}
+			if err := tx.Create(secret).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save function: %v", err)
 	}
-	s.log.WithField("function", name).Info("Function stored")
+	s.log.WithField("function", function.Name).Info("Function stored")
 	return nil
 }
 
-// GetFunction retrieves a function by name.
-func (s *Store) GetFunction(name string) (*Function, error) {
+// GetFunction retrieves a function by name. A missing function fails with
+// ErrFunctionNotFound, and a lookup that outlives the deadline of ctx with
+// ErrQueryTimeout.
+func (s *Store) GetFunction(ctx context.Context, name string) (*Function, error) {
 	var function Function
-	if err := s.db.Where("name = ?", name).First(&function).Error; err != nil {
-		return nil, fmt.Errorf("function not found: %v", err)
+	if err := s.db.WithContext(ctx).Where("name = ?", name).First(&function).Error; err != nil {
+		return nil, lookupError(ctx, "function", ErrFunctionNotFound, err)
 	}
 	return &function, nil
 }
+
+// ErrQueryTimeout is returned when a query didn't finish within the deadline
+// of its context, e.g. because the database is locked by a long write.
+var ErrQueryTimeout = errors.New("database query timed out")
+
+// ErrRevisionNotFound is returned when looking up a digest a function was
+// never deployed with.
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// ErrAliasNotFound is returned when looking up an alias that doesn't exist.
+var ErrAliasNotFound = errors.New("alias not found")
+
+// lookupError describes a failed lookup of a record: a timeout as
+// ErrQueryTimeout, a missing record as notFound, and any other failure of
+// the database as is.
+func lookupError(ctx context.Context, record string, notFound, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: looking up %s", ErrQueryTimeout, record)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return notFound
+	}
+	return fmt.Errorf("failed to look up %s: %v", record, err)
+}
+
+// PatchFunction updates the given columns of a function, leaving the others
+// intact. The fields are keyed by column name (e.g. "memory_bytes") and hold
+// values of the field types of Function.
+func (s *Store) PatchFunction(name string, fields map[string]interface{}) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var function Function
+		if err := tx.Where("name = ?", name).First(&function).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return fmt.Errorf("%w: %s", ErrFunctionNotFound, name)
+			}
+			return err
+		}
+
+		// Set the values on the record rather than updating with the map, so
+		// serialized columns are encoded like on a save
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(&function); err != nil {
+			return err
+		}
+		record := reflect.ValueOf(&function).Elem()
+		columns := make([]string, 0, len(fields))
+		for column, value := range fields {
+			field := stmt.Schema.LookUpField(column)
+			if field == nil || field.DBName != column || field.PrimaryKey || column == "name" {
+				return fmt.Errorf("unknown field %q", column)
+			}
+			if err := field.Set(tx.Statement.Context, record, value); err != nil {
+				return fmt.Errorf("invalid value of %s: %v", column, err)
+			}
+			columns = append(columns, column)
+		}
+		if len(columns) == 0 {
+			return nil
+		}
+		if err := tx.Model(&function).Select(columns).Updates(&function).Error; err != nil {
+			return err
+		}
+		return recordRevision(tx, &function)
+	})
+	if errors.Is(err, ErrFunctionNotFound) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to patch function: %v", err)
+	}
+	s.log.WithField("function", name).Info("Function patched")
+	return nil
+}
+
+// MarkCompleted records that a run_once function completed successfully.
+func (s *Store) MarkCompleted(name string, at time.Time) error {
+	err := s.db.Model(&Function{}).Where("name = ?", name).Update("completed_at", at).Error
+	if err != nil {
+		return fmt.Errorf("failed to mark function completed: %v", err)
+	}
+	return nil
+}
+
+// GetSecrets retrieves the secrets of a function, keyed by name.
+func (s *Store) GetSecrets(ctx context.Context, functionName string) (map[string]string, error) {
+	var records []Secret
+	if err := s.db.WithContext(ctx).Where("function_name = ?", functionName).Find(&records).Error; err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: getting secrets", ErrQueryTimeout)
+		}
+		return nil, fmt.Errorf("failed to get secrets: %v", err)
+	}
+	secrets := make(map[string]string, len(records))
+	for _, record := range records {
+		secrets[record.Name] = record.Value
+	}
+	return secrets, nil
+}
+
+// ListFunctions retrieves all functions, ordered by name. Deleted functions
+// are only included when includeDeleted is set.
+func (s *Store) ListFunctions(includeDeleted bool) ([]Function, error) {
+	query := s.db
+	if includeDeleted {
+		query = query.Unscoped()
+	}
+	var functions []Function
+	if err := query.Order("name").Find(&functions).Error; err != nil {
+		return nil, fmt.Errorf("failed to list functions: %v", err)
+	}
+	return functions, nil
+}
+
+// GetRevision retrieves the revision of a function deployed with digest. A
+// missing revision fails with ErrRevisionNotFound, and a lookup that outlives
+// the deadline of ctx with ErrQueryTimeout.
+func (s *Store) GetRevision(ctx context.Context, functionName, digest string) (*FunctionRevision, error) {
+	var revision FunctionRevision
+	err := s.db.WithContext(ctx).Where("function_name = ? AND digest = ?", functionName, digest).First(&revision).Error
+	if err != nil {
+		return nil, lookupError(ctx, "revision", ErrRevisionNotFound, err)
+	}
+	return &revision, nil
+}
+
+// RevisionDigests returns the image digests of all revisions of all
+// functions, which aliases may route to and invocations may ask for.
+func (s *Store) RevisionDigests() ([]string, error) {
+	var digests []string
+	if err := s.db.Model(&FunctionRevision{}).Distinct().Pluck("digest", &digests).Error; err != nil {
+		return nil, fmt.Errorf("failed to list revisions: %v", err)
+	}
+	return digests, nil
+}
+
+// recordRevision adds the digest a function is deployed with to its
+// revisions, unless it's already one of them or unknown.
+func recordRevision(tx *gorm.DB, function *Function) error {
+	if function.Digest == "" {
+		return nil
+	}
+	var count int64
+	err := tx.Model(&FunctionRevision{}).
+		Where("function_name = ? AND digest = ?", function.Name, function.Digest).
+		Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+	return tx.Create(&FunctionRevision{FunctionName: function.Name, Digest: function.Digest, Image: function.Image}).Error
+}
+
+// ErrFunctionNotFound is returned when looking up, patching, deleting or
+// restoring a function that doesn't exist.
+var ErrFunctionNotFound = errors.New("function not found")
+
+// DeleteFunction deletes a function. The record is kept as a tombstone, so
+// the function can be brought back with RestoreFunction.
+func (s *Store) DeleteFunction(name string) error {
+	deleted := s.db.Where("name = ?", name).Delete(&Function{})
+	if deleted.Error != nil {
+		return fmt.Errorf("failed to delete function: %v", deleted.Error)
+	}
+	if deleted.RowsAffected == 0 {
+		return fmt.Errorf("%w: %s", ErrFunctionNotFound, name)
+	}
+	s.log.WithField("function", name).Info("Function deleted")
+	return nil
+}
+
+// RestoreFunction brings back a deleted function.
+func (s *Store) RestoreFunction(name string) error {
+	restored := s.db.Unscoped().Model(&Function{}).
+		Where("name = ? AND deleted_at IS NOT NULL", name).
+		Update("deleted_at", nil)
+	if restored.Error != nil {
+		return fmt.Errorf("failed to restore function: %v", restored.Error)
+	}
+	if restored.RowsAffected == 0 {
+		return fmt.Errorf("%w: no deleted function %s", ErrFunctionNotFound, name)
+	}
+	s.log.WithField("function", name).Info("Function restored")
+	return nil
+}
+
+// SaveAlias stores an alias, replacing its previous targets.
+func (s *Store) SaveAlias(alias *Alias) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var existing Alias
+		found := tx.Where("name = ?", alias.Name).Limit(1).Find(&existing)
+		if found.Error != nil {
+			return found.Error
+		}
+		if found.RowsAffected > 0 {
+			alias.ID = existing.ID
+			alias.CreatedAt = existing.CreatedAt
+		}
+		return tx.Save(alias).Error
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save alias: %v", err)
+	}
+	s.log.WithField("alias", alias.Name).Info("Alias stored")
+	return nil
+}
+
+// GetAlias retrieves an alias by name. A missing alias fails with
+// ErrAliasNotFound.
+func (s *Store) GetAlias(ctx context.Context, name string) (*Alias, error) {
+	var alias Alias
+	if err := s.db.WithContext(ctx).Where("name = ?", name).First(&alias).Error; err != nil {
+		return nil, lookupError(ctx, "alias", ErrAliasNotFound, err)
+	}
+	return &alias, nil
+}
+
+// RecordInvocation stores the outcome of a function execution.
+func (s *Store) RecordInvocation(invocation *Invocation) error {
+	if err := s.db.Create(invocation).Error; err != nil {
+		return fmt.Errorf("failed to record invocation: %v", err)
+	}
+	return nil
+}
+
+// pruneBatchSize is how many invocation records a prune deletes per
+// statement, so it never holds the database's write lock for long.
+const pruneBatchSize = 1000
+
+// PruneInvocations deletes the invocation records created before before, in
+// batches, and returns how many it deleted.
+func (s *Store) PruneInvocations(before time.Time) (int64, error) {
+	return s.pruneInvocations(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("created_at < ?", before)
+	})
+}
+
+// TrimInvocations deletes all but the newest keep invocation records, in
+// batches, and returns how many it deleted.
+func (s *Store) TrimInvocations(keep int) (int64, error) {
+	var newest []uint
+	err := s.db.Unscoped().Model(&Invocation{}).Order("id DESC").Offset(keep).Limit(1).Pluck("id", &newest).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune invocations: %v", err)
+	}
+	if len(newest) == 0 {
+		return 0, nil
+	}
+	return s.pruneInvocations(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("id <= ?", newest[0])
+	})
+}
+
+// pruneInvocations deletes the invocation records matching filter, a batch
+// per statement, until none is left.
+func (s *Store) pruneInvocations(filter func(tx *gorm.DB) *gorm.DB) (int64, error) {
+	var total int64
+	for {
+		batch := filter(s.db.Unscoped().Model(&Invocation{})).Select("id").Order("id").Limit(pruneBatchSize)
+		result := s.db.Unscoped().Where("id IN (?)", batch).Delete(&Invocation{})
+		if result.Error != nil {
+			return total, fmt.Errorf("failed to prune invocations: %v", result.Error)
+		}
+		total += result.RowsAffected
+		if result.RowsAffected < pruneBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// RecordAuditEvent appends an event to the audit log.
+func (s *Store) RecordAuditEvent(event *AuditEvent) error {
+	if err := s.db.Create(event).Error; err != nil {
+		return fmt.Errorf("failed to record audit event: %v", err)
+	}
+	return nil
+}
+
+// ListAuditEvents retrieves the most recent events of the audit log, newest
+// first, up to limit. An empty function name lists the events of all functions.
+func (s *Store) ListAuditEvents(functionName string, limit int) ([]AuditEvent, error) {
+	query := s.db.Order("id DESC").Limit(limit)
+	if functionName != "" {
+		query = query.Where("function_name = ?", functionName)
+	}
+	var events []AuditEvent
+	if err := query.Find(&events).Error; err != nil {
+		return nil, fmt.Errorf("failed to list audit events: %v", err)
+	}
+	return events, nil
+}
+
+// CreateJob stores a new job.
+func (s *Store) CreateJob(job *Job) error {
+	if err := s.db.Create(job).Error; err != nil {
+		return fmt.Errorf("failed to create job: %v", err)
+	}
+	return nil
+}
+
+// ErrJobNotFound is returned when looking up a job that doesn't exist.
+var ErrJobNotFound = errors.New("job not found")
+
+// GetJob retrieves a job by its ID. A missing job fails with ErrJobNotFound,
+// and a lookup that outlives the deadline of ctx with ErrQueryTimeout.
+func (s *Store) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	var job Job
+	if err := s.db.WithContext(ctx).Where("job_id = ?", jobID).First(&job).Error; err != nil {
+		return nil, lookupError(ctx, "job", ErrJobNotFound, err)
+	}
+	return &job, nil
+}
+
+// UpdateJob saves the changes made to a job.
+func (s *Store) UpdateJob(job *Job) error {
+	if err := s.db.Save(job).Error; err != nil {
+		return fmt.Errorf("failed to update job: %v", err)
+	}
+	return nil
+}
+
+// ListUnfinishedJobs retrieves the jobs that are pending or running, oldest first.
+func (s *Store) ListUnfinishedJobs() ([]Job, error) {
+	var jobs []Job
+	if err := s.db.Where("status IN ?", []string{JobPending, JobRunning}).Order("id").Find(&jobs).Error; err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+	return jobs, nil
+}
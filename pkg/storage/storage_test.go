@@ -0,0 +1,509 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// openTestStore opens a store on the database at dbPath, closed when the
+// test ends.
+func openTestStore(t *testing.T, dbPath string) *Store {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	store, err := NewStore(dbPath, log)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := store.db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return store
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	tests := []struct {
+		name    string
+		writers int
+		writes  int // Writes of each writer
+	}{
+		{name: "few writers", writers: 2, writes: 100},
+		{name: "more writers than connections", writers: 4 * maxOpenConns, writes: 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestStore(t, filepath.Join(t.TempDir(), "serverless.db"))
+
+			// Writers log invocations while redeploying functions, as the
+			// server does when a deploy lands during traffic
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.writers*tt.writes)
+			for w := range tt.writers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range tt.writes {
+						var err error
+						if i%5 == 0 {
+							err = store.SaveFunction(&Function{Name: fmt.Sprintf("fn-%d", i%3), Image: "hello:latest", Runtime: "go"}, nil)
+						} else {
+							err = store.RecordInvocation(&Invocation{FunctionName: fmt.Sprintf("fn-%d", w), Status: "success"})
+						}
+						if err != nil {
+							errs <- err
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Errorf("concurrent write failed: %v", err)
+			}
+			var invocations int64
+			if err := store.db.Model(&Invocation{}).Count(&invocations).Error; err != nil {
+				t.Fatalf("failed to count invocations: %v", err)
+			}
+			if want := int64(tt.writers * (tt.writes - (tt.writes+4)/5)); invocations != want {
+				t.Errorf("%d invocations stored, want %d", invocations, want)
+			}
+			functions, err := store.ListFunctions(false)
+			if err != nil {
+				t.Fatalf("ListFunctions failed: %v", err)
+			}
+			if len(functions) != 3 {
+				t.Errorf("%d functions stored, want each of the 3 once despite concurrent redeploys", len(functions))
+			}
+		})
+	}
+}
+
+func TestPatchFunction(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  map[string]interface{}
+		want    func(function *Function) // Changes the patch makes to the function
+		wantErr bool
+	}{
+		{name: "column", fields: map[string]interface{}{"memory_bytes": int64(256 << 20)}, want: func(f *Function) { f.MemoryBytes = 256 << 20 }},
+		{
+			name:   "serialized column",
+			fields: map[string]interface{}{"env": map[string]string{"DEBUG": "1"}},
+			want:   func(f *Function) { f.Env = map[string]string{"DEBUG": "1"} },
+		},
+		{name: "zero value", fields: map[string]interface{}{"user": ""}, want: func(f *Function) { f.User = "" }},
+		{name: "unknown column", fields: map[string]interface{}{"timeout": 60}, wantErr: true},
+		{name: "name", fields: map[string]interface{}{"name": "other"}, wantErr: true},
+		{name: "invalid value", fields: map[string]interface{}{"memory_bytes": "lots"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestStore(t, filepath.Join(t.TempDir(), "serverless.db"))
+			deployed := Function{Name: "hello", Image: "hello:latest", Runtime: "go", User: "app", Env: map[string]string{"GREETING": "hi"}, MemoryBytes: 128 << 20}
+			function := deployed
+			if err := store.SaveFunction(&function, nil); err != nil {
+				t.Fatalf("SaveFunction failed: %v", err)
+			}
+
+			err := store.PatchFunction("hello", tt.fields)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PatchFunction = %v, want error %v", err, tt.wantErr)
+			}
+
+			// Fields not patched, and every field of a failed patch, are intact
+			want := deployed
+			if tt.want != nil {
+				tt.want(&want)
+			}
+			got, err := store.GetFunction(context.Background(), "hello")
+			if err != nil {
+				t.Fatalf("GetFunction failed: %v", err)
+			}
+			want.ID, want.CreatedAt, want.UpdatedAt = got.ID, got.CreatedAt, got.UpdatedAt
+			if !reflect.DeepEqual(*got, want) {
+				t.Errorf("function = %+v, want %+v", *got, want)
+			}
+		})
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "serverless.db"))
+	for _, name := range []string{"hello", "other"} {
+		if err := store.SaveFunction(&Function{Name: name, Image: name + ":latest", Runtime: "go"}, nil); err != nil {
+			t.Fatalf("SaveFunction failed: %v", err)
+		}
+	}
+	listed := func(includeDeleted bool) []string {
+		t.Helper()
+		functions, err := store.ListFunctions(includeDeleted)
+		if err != nil {
+			t.Fatalf("ListFunctions failed: %v", err)
+		}
+		var names []string
+		for _, function := range functions {
+			names = append(names, function.Name)
+		}
+		return names
+	}
+
+	// Deleted functions are hidden, but kept
+	if err := store.DeleteFunction("hello"); err != nil {
+		t.Fatalf("DeleteFunction failed: %v", err)
+	}
+	if _, err := store.GetFunction(context.Background(), "hello"); err == nil {
+		t.Error("GetFunction found the deleted function")
+	}
+	if got := listed(false); !reflect.DeepEqual(got, []string{"other"}) {
+		t.Errorf("listed %q, want the deleted function excluded", got)
+	}
+	if got := listed(true); !reflect.DeepEqual(got, []string{"hello", "other"}) {
+		t.Errorf("listed %q including deleted, want both functions", got)
+	}
+	if err := store.DeleteFunction("hello"); !errors.Is(err, ErrFunctionNotFound) {
+		t.Errorf("deleting again = %v, want ErrFunctionNotFound", err)
+	}
+
+	// Restoring brings back the function as it was
+	if err := store.RestoreFunction("hello"); err != nil {
+		t.Fatalf("RestoreFunction failed: %v", err)
+	}
+	function, err := store.GetFunction(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("GetFunction failed after restore: %v", err)
+	}
+	if function.Image != "hello:latest" {
+		t.Errorf("restored image %q, want hello:latest", function.Image)
+	}
+	if got := listed(false); !reflect.DeepEqual(got, []string{"hello", "other"}) {
+		t.Errorf("listed %q, want the restored function back", got)
+	}
+	if err := store.RestoreFunction("other"); !errors.Is(err, ErrFunctionNotFound) {
+		t.Errorf("restoring a live function = %v, want ErrFunctionNotFound", err)
+	}
+	if err := store.RestoreFunction("missing"); !errors.Is(err, ErrFunctionNotFound) {
+		t.Errorf("restoring an unknown function = %v, want ErrFunctionNotFound", err)
+	}
+
+	// Redeploying a deleted function replaces its tombstone
+	if err := store.DeleteFunction("other"); err != nil {
+		t.Fatalf("DeleteFunction failed: %v", err)
+	}
+	if err := store.SaveFunction(&Function{Name: "other", Image: "other:v2", Runtime: "go"}, nil); err != nil {
+		t.Fatalf("redeploying a deleted function failed: %v", err)
+	}
+	if function, err := store.GetFunction(context.Background(), "other"); err != nil || function.Image != "other:v2" {
+		t.Errorf("GetFunction = %+v, %v, want the redeployed function", function, err)
+	}
+	if got := listed(true); !reflect.DeepEqual(got, []string{"hello", "other"}) {
+		t.Errorf("listed %q including deleted, want each function once", got)
+	}
+}
+
+func TestSaveSecrets(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "serverless.db"))
+	deploys := []struct {
+		name    string
+		secrets map[string]string
+	}{
+		{name: "first deploy", secrets: map[string]string{"API_TOKEN": "one", "DB_PASSWORD": "two"}},
+		{name: "replaced", secrets: map[string]string{"API_TOKEN": "three"}},
+		{name: "removed"},
+	}
+	for _, deploy := range deploys {
+		function := &Function{Name: "hello", Image: "hello:latest", Runtime: "go"}
+		if err := store.SaveFunction(function, deploy.secrets); err != nil {
+			t.Fatalf("%s: SaveFunction failed: %v", deploy.name, err)
+		}
+		secrets, err := store.GetSecrets(context.Background(), "hello")
+		if err != nil {
+			t.Fatalf("%s: GetSecrets failed: %v", deploy.name, err)
+		}
+		if want := deploy.secrets; len(secrets) != len(want) || (len(want) > 0 && !reflect.DeepEqual(secrets, want)) {
+			t.Errorf("%s: secrets = %v, want %v", deploy.name, secrets, want)
+		}
+	}
+	if err := store.SaveFunction(&Function{Name: "other", Image: "other:latest", Runtime: "go"}, map[string]string{"API_TOKEN": "four"}); err != nil {
+		t.Fatalf("SaveFunction failed: %v", err)
+	}
+	if secrets, err := store.GetSecrets(context.Background(), "hello"); err != nil || len(secrets) != 0 {
+		t.Errorf("GetSecrets = %v, %v, want no secrets of another function", secrets, err)
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	store := openTestStore(t, filepath.Join(t.TempDir(), "serverless.db"))
+	if err := store.SaveFunction(&Function{Name: "hello", Image: "hello:1"}, map[string]string{"TOKEN": "x"}); err != nil {
+		t.Fatalf("SaveFunction failed: %v", err)
+	}
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		lookup      func(ctx context.Context) error
+		wantErr     bool
+		wantTimeout bool
+		wantMissing error // The sentinel a missing record fails with
+	}{
+		{
+			name:   "function found",
+			ctx:    context.Background(),
+			lookup: func(ctx context.Context) error { _, err := store.GetFunction(ctx, "hello"); return err },
+		},
+		{
+			name:        "function missing",
+			ctx:         context.Background(),
+			lookup:      func(ctx context.Context) error { _, err := store.GetFunction(ctx, "missing"); return err },
+			wantErr:     true,
+			wantMissing: ErrFunctionNotFound,
+		},
+		{
+			name:        "alias missing",
+			ctx:         context.Background(),
+			lookup:      func(ctx context.Context) error { _, err := store.GetAlias(ctx, "live"); return err },
+			wantErr:     true,
+			wantMissing: ErrAliasNotFound,
+		},
+		{
+			name: "revision missing",
+			ctx:  context.Background(),
+			lookup: func(ctx context.Context) error {
+				_, err := store.GetRevision(ctx, "hello", "sha256:missing")
+				return err
+			},
+			wantErr:     true,
+			wantMissing: ErrRevisionNotFound,
+		},
+		{
+			name:        "job missing",
+			ctx:         context.Background(),
+			lookup:      func(ctx context.Context) error { _, err := store.GetJob(ctx, "missing"); return err },
+			wantErr:     true,
+			wantMissing: ErrJobNotFound,
+		},
+		{
+			name:        "function lookup timed out",
+			ctx:         expired,
+			lookup:      func(ctx context.Context) error { _, err := store.GetFunction(ctx, "hello"); return err },
+			wantErr:     true,
+			wantTimeout: true,
+		},
+		{
+			name:        "alias lookup timed out",
+			ctx:         expired,
+			lookup:      func(ctx context.Context) error { _, err := store.GetAlias(ctx, "live"); return err },
+			wantErr:     true,
+			wantTimeout: true,
+		},
+		{
+			name:        "job lookup timed out",
+			ctx:         expired,
+			lookup:      func(ctx context.Context) error { _, err := store.GetJob(ctx, "missing"); return err },
+			wantErr:     true,
+			wantTimeout: true,
+		},
+		{
+			name:        "secrets lookup timed out",
+			ctx:         expired,
+			lookup:      func(ctx context.Context) error { _, err := store.GetSecrets(ctx, "hello"); return err },
+			wantErr:     true,
+			wantTimeout: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.lookup(tt.ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookup = %v, want error %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrQueryTimeout) != tt.wantTimeout {
+				t.Errorf("lookup = %v, want ErrQueryTimeout %v", err, tt.wantTimeout)
+			}
+			if tt.wantMissing != nil && !errors.Is(err, tt.wantMissing) {
+				t.Errorf("lookup = %v, want %v", err, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestRevisionDigests(t *testing.T) {
+	tests := []struct {
+		name    string
+		deploys []Function // Deployed in order
+		deleted []string   // Functions deleted afterwards
+		want    []string
+	}{
+		{name: "none"},
+		{
+			name:    "unpinned functions",
+			deploys: []Function{{Name: "a", Image: "alpine"}},
+		},
+		{
+			name: "every digest deployed",
+			deploys: []Function{
+				{Name: "a", Image: "serverless-a:latest", Digest: "sha256:a1"},
+				{Name: "a", Image: "serverless-a:latest", Digest: "sha256:a2"},
+				{Name: "b", Image: "serverless-b:latest", Digest: "sha256:b1"},
+			},
+			want: []string{"sha256:a1", "sha256:a2", "sha256:b1"},
+		},
+		{
+			name: "shared digest listed once",
+			deploys: []Function{
+				{Name: "a", Image: "app:1", Digest: "sha256:x"},
+				{Name: "b", Image: "app:1", Digest: "sha256:x"},
+				{Name: "a", Image: "app:1", Digest: "sha256:x"},
+			},
+			want: []string{"sha256:x"},
+		},
+		{
+			name:    "deleted functions keep their revisions",
+			deploys: []Function{{Name: "a", Image: "app:1", Digest: "sha256:x"}},
+			deleted: []string{"a"},
+			want:    []string{"sha256:x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestStore(t, filepath.Join(t.TempDir(), "db"))
+			for _, function := range tt.deploys {
+				if err := store.SaveFunction(&function, nil); err != nil {
+					t.Fatalf("SaveFunction failed: %v", err)
+				}
+			}
+			for _, name := range tt.deleted {
+				if err := store.DeleteFunction(name); err != nil {
+					t.Fatalf("DeleteFunction failed: %v", err)
+				}
+			}
+
+			digests, err := store.RevisionDigests()
+			if err != nil {
+				t.Fatalf("RevisionDigests failed: %v", err)
+			}
+			sort.Strings(digests)
+			if len(digests) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(digests, tt.want) {
+				t.Errorf("RevisionDigests = %q, want %q", digests, tt.want)
+			}
+		})
+	}
+}
+
+// seedInvocations stores count invocation records, the ith created age minus
+// i seconds ago, so later records are newer.
+func seedInvocations(t *testing.T, store *Store, count int, age time.Duration) {
+	t.Helper()
+	now := time.Now()
+	invocations := make([]Invocation, count)
+	for i := range invocations {
+		invocations[i].FunctionName = "hello"
+		invocations[i].Status = "success"
+		invocations[i].CreatedAt = now.Add(-age + time.Duration(i)*time.Second)
+	}
+	if err := store.db.CreateInBatches(invocations, 500).Error; err != nil {
+		t.Fatalf("failed to seed invocations: %v", err)
+	}
+}
+
+// remainingInvocations returns the IDs of the invocation records left, oldest first.
+func remainingInvocations(t *testing.T, store *Store) []uint {
+	t.Helper()
+	var ids []uint
+	if err := store.db.Unscoped().Model(&Invocation{}).Order("id").Pluck("id", &ids).Error; err != nil {
+		t.Fatalf("failed to list invocations: %v", err)
+	}
+	return ids
+}
+
+func TestPruneInvocations(t *testing.T) {
+	tests := []struct {
+		name        string
+		old, recent int // Records created two days and two hours ago
+		wantDeleted int64
+	}{
+		{name: "empty"},
+		{name: "nothing old", recent: 5},
+		{name: "all old", old: 5, wantDeleted: 5},
+		{name: "old and recent", old: 3, recent: 4, wantDeleted: 3},
+		{name: "more than a batch", old: 2*pruneBatchSize + 7, recent: 2, wantDeleted: 2*pruneBatchSize + 7},
+		{name: "exactly a batch", old: pruneBatchSize, recent: 1, wantDeleted: pruneBatchSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestStore(t, filepath.Join(t.TempDir(), "db"))
+			seedInvocations(t, store, tt.old, 48*time.Hour)
+			seedInvocations(t, store, tt.recent, 2*time.Hour)
+
+			deleted, err := store.PruneInvocations(time.Now().Add(-24 * time.Hour))
+			if err != nil {
+				t.Fatalf("PruneInvocations failed: %v", err)
+			}
+			if deleted != tt.wantDeleted {
+				t.Errorf("PruneInvocations deleted %d, want %d", deleted, tt.wantDeleted)
+			}
+			if left := len(remainingInvocations(t, store)); left != tt.recent {
+				t.Errorf("%d invocations left, want the %d recent ones", left, tt.recent)
+			}
+		})
+	}
+}
+
+func TestTrimInvocations(t *testing.T) {
+	tests := []struct {
+		name        string
+		count       int
+		keep        int
+		wantDeleted int64
+	}{
+		{name: "empty", keep: 10},
+		{name: "fewer than kept", count: 3, keep: 10},
+		{name: "as many as kept", count: 10, keep: 10},
+		{name: "one more than kept", count: 11, keep: 10, wantDeleted: 1},
+		{name: "more than a batch", count: pruneBatchSize + 50, keep: 20, wantDeleted: pruneBatchSize + 30},
+		{name: "keep none", count: 4, keep: 0, wantDeleted: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openTestStore(t, filepath.Join(t.TempDir(), "db"))
+			seedInvocations(t, store, tt.count, time.Hour)
+			before := remainingInvocations(t, store)
+
+			deleted, err := store.TrimInvocations(tt.keep)
+			if err != nil {
+				t.Fatalf("TrimInvocations failed: %v", err)
+			}
+			if deleted != tt.wantDeleted {
+				t.Errorf("TrimInvocations deleted %d, want %d", deleted, tt.wantDeleted)
+			}
+			// The newest records are the ones kept
+			left := remainingInvocations(t, store)
+			want := before[len(before)-len(left):]
+			if len(left) != tt.count-int(tt.wantDeleted) {
+				t.Fatalf("%d invocations left, want %d", len(left), tt.count-int(tt.wantDeleted))
+			}
+			for i := range left {
+				if left[i] != want[i] {
+					t.Fatalf("invocations left = %v, want the newest %v", left, want)
+				}
+			}
+		})
+	}
+}